@@ -58,7 +58,19 @@ func runProgram(logger *zap.Logger) (err error) {
 	orca := srv.GetOrchestrator(ctx)
 	defer func() { err = orca.Service().Wait() }()
 
-	if err := orca.Add(srv.HTTP("scheduler-pprof", time.Second, util.MakePPROF("0.0.0.0:7777"))); err != nil {
+	shutdownTracing, err := util.StartTracing(ctx, "autoscale-scheduler")
+	if err != nil {
+		return fmt.Errorf("Error starting tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", zap.Error(err))
+		}
+	}()
+
+	if err := orca.Add(srv.HTTP("scheduler-pprof", time.Second, util.MakePPROF("0.0.0.0:7777", func() any { return conf }))); err != nil {
 		return err
 	}
 
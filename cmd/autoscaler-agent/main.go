@@ -77,7 +77,19 @@ func main() {
 		logger.Info("Main loop returned without issue. Exiting.")
 	}()
 
-	if err := srv.GetOrchestrator(ctx).Add(srv.HTTP("agent-pprof", time.Second, util.MakePPROF("0.0.0.0:7777"))); err != nil {
+	shutdownTracing, err := util.StartTracing(ctx, "autoscaler-agent")
+	if err != nil {
+		logger.Panic("Failed to start tracing", zap.Error(err))
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", zap.Error(err))
+		}
+	}()
+
+	if err := srv.GetOrchestrator(ctx).Add(srv.HTTP("agent-pprof", time.Second, util.MakePPROF("0.0.0.0:7777", func() any { return config }))); err != nil {
 		logger.Panic("Failed to add pprof service", zap.Error(err))
 	}
 
@@ -0,0 +1,55 @@
+package v1
+
+import (
+	"fmt"
+)
+
+// FieldDeprecation describes a deprecated VirtualMachine field, so that the webhook can warn about
+// its use and the controller can track how many VMs still need to move off of it.
+//
+// +kubebuilder:object:generate=false
+type FieldDeprecation struct {
+	// Field is the path to the deprecated field, e.g. ".spec.guest.settings.swap"
+	Field string
+	// Replacement is the path to the field that should be used instead
+	Replacement string
+	// RemovalVersion is the NeonVM release that the field is expected to be removed in
+	RemovalVersion string
+	// InUse returns whether the VM sets the deprecated field
+	InUse func(*VirtualMachine) bool
+}
+
+// Warning returns the admission warning for VMs that use the deprecated field
+func (d FieldDeprecation) Warning() string {
+	return fmt.Sprintf(
+		"%s is deprecated and will be removed in %s; use %s instead",
+		d.Field, d.RemovalVersion, d.Replacement,
+	)
+}
+
+// VirtualMachineDeprecations is the registry of deprecated VirtualMachine fields.
+//
+// When deprecating a field, add it here - and when removing one, first check the
+// vm_deprecated_field_in_use metric from the controller to make sure nothing still uses it.
+var VirtualMachineDeprecations = []FieldDeprecation{
+	{
+		Field:          ".spec.guest.settings.swap",
+		Replacement:    ".spec.guest.settings.swapInfo",
+		RemovalVersion: "v0.30.0",
+		InUse: func(vm *VirtualMachine) bool {
+			return vm.Spec.Guest.Settings != nil && vm.Spec.Guest.Settings.Swap != nil
+		},
+	},
+}
+
+// DeprecatedFieldsInUse returns the entries in VirtualMachineDeprecations for each deprecated
+// field that the VM sets.
+func (r *VirtualMachine) DeprecatedFieldsInUse() []FieldDeprecation {
+	var inUse []FieldDeprecation
+	for _, d := range VirtualMachineDeprecations {
+		if d.InUse(r) {
+			inUse = append(inUse, d)
+		}
+	}
+	return inUse
+}
@@ -0,0 +1,193 @@
+package v1
+
+// Cluster-wide policy for VirtualMachines
+//
+// Cluster operators can limit what VMs may be created with a ConfigMap holding a JSON-encoded
+// VirtualMachinePolicy, given to neonvm-controller with -webhook-policy-configmap. The
+// VirtualMachine webhook reads it on every create and update, so changes take effect immediately,
+// without restarting the controller.
+//
+// Existing VMs that violate a new policy aren't affected: updates are only rejected if they add a
+// violation that the VM didn't already have (e.g. removing a required label), so that the
+// controller can still update them.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// VirtualMachinePolicyKey is the key in the policy ConfigMap that holds the VirtualMachinePolicy
+const VirtualMachinePolicyKey = "policy.json"
+
+// VirtualMachinePolicy gives the limits that all VMs in the cluster must stay within. Unset fields
+// aren't enforced.
+//
+// +kubebuilder:object:generate=false
+type VirtualMachinePolicy struct {
+	// MaxCPUs is the maximum allowed .spec.guest.cpus.max
+	MaxCPUs *MilliCPU `json:"maxCPUs,omitempty"`
+	// MaxMemorySlots is the maximum allowed .spec.guest.memorySlots.max
+	MaxMemorySlots *int32 `json:"maxMemorySlots,omitempty"`
+	// AllowedImageRegistries, if not empty, lists the registries (optionally with a repository
+	// prefix, e.g. "docker.io/neondatabase") that .spec.guest.rootDisk.image must be pulled from.
+	// Images without a registry are from docker.io.
+	AllowedImageRegistries []string `json:"allowedImageRegistries,omitempty"`
+	// RequiredLabels lists the labels that every VM must have
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+}
+
+// webhookPolicyConfigMap, if not nil, is the ConfigMap holding the VirtualMachinePolicy that the
+// VirtualMachine webhook enforces. It's set by SetWebhookPolicyConfigMap.
+var webhookPolicyConfigMap *types.NamespacedName
+
+// SetWebhookPolicyConfigMap makes the VirtualMachine webhook enforce the VirtualMachinePolicy in
+// the ConfigMap. If the ConfigMap doesn't exist, nothing is enforced.
+//
+// It must be called before SetupWebhookWithManager.
+func SetWebhookPolicyConfigMap(name types.NamespacedName) {
+	webhookPolicyConfigMap = &name
+}
+
+// fetchPolicy returns the VirtualMachinePolicy from webhookPolicyConfigMap, or nil if there isn't
+// one
+func fetchPolicy() (*VirtualMachinePolicy, error) {
+	if webhookPolicyConfigMap == nil || webhookReader == nil {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var cm corev1.ConfigMap
+	if err := webhookReader.Get(ctx, *webhookPolicyConfigMap, &cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not get ConfigMap %s: %w", webhookPolicyConfigMap, err)
+	}
+
+	policyJSON, ok := cm.Data[VirtualMachinePolicyKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s is missing key %q", webhookPolicyConfigMap, VirtualMachinePolicyKey)
+	}
+	var policy VirtualMachinePolicy
+	if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+		return nil, fmt.Errorf("could not unmarshal policy from ConfigMap %s: %w", webhookPolicyConfigMap, err)
+	}
+	return &policy, nil
+}
+
+// validatePolicy checks that the VM complies with the cluster's VirtualMachinePolicy, if there is
+// one.
+//
+// If the policy can't be read, the VM is rejected, so that a broken policy doesn't silently allow
+// everything.
+func (r *VirtualMachine) validatePolicy() field.ErrorList {
+	policy, err := fetchPolicy()
+	if err != nil {
+		return field.ErrorList{field.InternalError(field.NewPath("spec"), fmt.Errorf("could not read cluster VM policy: %w", err))}
+	} else if policy == nil {
+		return nil
+	}
+	return r.validateAgainstPolicy(policy)
+}
+
+// validatePolicyUpdate is like validatePolicy, but only returns the violations that the VM didn't
+// already have before the update
+func (r *VirtualMachine) validatePolicyUpdate(before *VirtualMachine) field.ErrorList {
+	policy, err := fetchPolicy()
+	if err != nil {
+		return field.ErrorList{field.InternalError(field.NewPath("spec"), fmt.Errorf("could not read cluster VM policy: %w", err))}
+	} else if policy == nil {
+		return nil
+	}
+
+	existing := make(map[string]bool)
+	for _, e := range before.validateAgainstPolicy(policy) {
+		existing[e.Field] = true
+	}
+	var allErrs field.ErrorList
+	for _, e := range r.validateAgainstPolicy(policy) {
+		if !existing[e.Field] {
+			allErrs = append(allErrs, e)
+		}
+	}
+	return allErrs
+}
+
+func (r *VirtualMachine) validateAgainstPolicy(policy *VirtualMachinePolicy) field.ErrorList {
+	var allErrs field.ErrorList
+	guestPath := field.NewPath("spec", "guest")
+
+	if policy.MaxCPUs != nil && r.Spec.Guest.CPUs.Max > *policy.MaxCPUs {
+		allErrs = append(allErrs, field.Invalid(
+			guestPath.Child("cpus", "max"),
+			r.Spec.Guest.CPUs.Max,
+			fmt.Sprintf("exceeds the cluster policy's maximum of %v", *policy.MaxCPUs),
+		))
+	}
+
+	if policy.MaxMemorySlots != nil && r.Spec.Guest.MemorySlots.Max > *policy.MaxMemorySlots {
+		allErrs = append(allErrs, field.Invalid(
+			guestPath.Child("memorySlots", "max"),
+			r.Spec.Guest.MemorySlots.Max,
+			fmt.Sprintf("exceeds the cluster policy's maximum of %d", *policy.MaxMemorySlots),
+		))
+	}
+
+	if len(policy.AllowedImageRegistries) != 0 {
+		image := r.Spec.Guest.RootDisk.Image
+		if !imageFromRegistries(image, policy.AllowedImageRegistries) {
+			allErrs = append(allErrs, field.Forbidden(
+				guestPath.Child("rootDisk", "image"),
+				fmt.Sprintf("image %q is not from a registry allowed by the cluster policy (%s)", image, strings.Join(policy.AllowedImageRegistries, ", ")),
+			))
+		}
+	}
+
+	for _, label := range policy.RequiredLabels {
+		if _, ok := r.Labels[label]; !ok {
+			allErrs = append(allErrs, field.Required(
+				field.NewPath("metadata", "labels").Key(label),
+				"label is required by the cluster policy",
+			))
+		}
+	}
+
+	return allErrs
+}
+
+// imageFromRegistries returns whether the image reference is from one of the registries, each of
+// which may also include a repository prefix
+func imageFromRegistries(image string, registries []string) bool {
+	normalized := normalizeImageReference(image)
+	for _, registry := range registries {
+		registry = strings.TrimSuffix(registry, "/")
+		if strings.HasPrefix(normalized, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeImageReference adds the implicit docker.io registry (and library/ repository) to the
+// image reference, if it doesn't have a registry
+func normalizeImageReference(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	// Same as docker: the first component is a registry if it looks like a hostname.
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return image
+	}
+	if !found {
+		return "docker.io/library/" + image
+	}
+	return "docker.io/" + first + "/" + rest
+}
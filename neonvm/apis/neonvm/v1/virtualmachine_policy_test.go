@@ -0,0 +1,92 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestValidateAgainstPolicy(t *testing.T) {
+	policy := &VirtualMachinePolicy{
+		MaxCPUs:                lo.ToPtr(MilliCPU(4000)),
+		MaxMemorySlots:         lo.ToPtr[int32](16),
+		AllowedImageRegistries: []string{"docker.io/neondatabase", "ghcr.io"},
+		RequiredLabels:         []string{"team"},
+	}
+
+	cases := []struct {
+		name     string
+		cpus     MilliCPU
+		slots    int32
+		image    string
+		labels   map[string]string
+		expected []string
+	}{
+		{
+			name:     "within policy",
+			cpus:     4000,
+			slots:    16,
+			image:    "neondatabase/vm-postgres-16:latest",
+			labels:   map[string]string{"team": "compute"},
+			expected: nil,
+		},
+		{
+			name:     "other allowed registry",
+			cpus:     1000,
+			slots:    4,
+			image:    "ghcr.io/example/vm:1.0",
+			labels:   map[string]string{"team": "compute"},
+			expected: nil,
+		},
+		{
+			name:  "all violations reported",
+			cpus:  8000,
+			slots: 32,
+			image: "quay.io/neondatabase/vm:latest",
+			labels: map[string]string{
+				"other": "",
+			},
+			expected: []string{
+				"spec.guest.cpus.max: Invalid value",
+				"spec.guest.memorySlots.max: Invalid value",
+				"spec.guest.rootDisk.image: Forbidden",
+				"metadata.labels[team]: Required value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Labels = c.labels
+			vm.Spec.Guest.CPUs.Max = c.cpus
+			vm.Spec.Guest.MemorySlots.Max = c.slots
+			vm.Spec.Guest.RootDisk.Image = c.image
+
+			errs := vm.validateAgainstPolicy(policy)
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestImageFromRegistries(t *testing.T) {
+	cases := []struct {
+		image      string
+		registries []string
+		expected   bool
+	}{
+		{"debian", []string{"docker.io/library"}, true},
+		{"debian", []string{"docker.io/neondatabase"}, false},
+		{"neondatabase/vm:1", []string{"docker.io"}, true},
+		{"neondatabase/vm:1", []string{"docker.io/neondatabase/"}, true},
+		{"neondatabase-evil/vm:1", []string{"docker.io/neondatabase"}, false},
+		{"localhost:5000/vm:1", []string{"localhost:5000"}, true},
+		{"ghcr.io.evil.com/vm:1", []string{"ghcr.io"}, false},
+	}
+
+	for _, c := range cases {
+		if actual := imageFromRegistries(c.image, c.registries); actual != c.expected {
+			t.Errorf("imageFromRegistries(%q, %v) = %v, expected %v", c.image, c.registries, actual, c.expected)
+		}
+	}
+}
@@ -20,7 +20,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/samber/lo"
 
@@ -37,9 +40,31 @@ import (
 // VM's name).
 const VirtualMachineNameLabel string = "vm.neon.tech/name"
 
+// VirtualMachineGeneratedForLabel is the label assigned to the auxiliary resources that the
+// controller generates for each VM (e.g. its SSH secret), providing the name of the VirtualMachine.
+//
+// It's used to find generated resources that were orphaned, so that they can be cleaned up. May be
+// missing on resources generated by older controllers.
+const VirtualMachineGeneratedForLabel string = "vm.neon.tech/generated-for"
+
+// VirtualMachineGeneratedForUIDAnnotation is the annotation assigned to the auxiliary resources that
+// the controller generates for each VM, alongside VirtualMachineGeneratedForLabel, providing the UID
+// of the VirtualMachine.
+//
+// Unlike the owner reference, it's kept if the VM is deleted with '--cascade=orphan', so it's used
+// as proof that the resource was generated for a VM that no longer exists. May be missing on
+// resources generated by older controllers.
+const VirtualMachineGeneratedForUIDAnnotation string = "vm.neon.tech/generated-for-uid"
+
 // Label that determines the version of runner pod. May be missing on older runners
 const RunnerPodVersionLabel string = "vm.neon.tech/runner-version"
 
+// RunnerPodRestartInputsAnnotation is the annotation added to each runner Pod with a hash of the
+// settings that the pod only picks up when it's created (e.g. the runner and kernel images). It's
+// used by the controller to find VMs that need to be restarted for a rollout. May be missing on
+// older runners.
+const RunnerPodRestartInputsAnnotation string = "vm.neon.tech/restart-inputs"
+
 // VirtualMachineUsageAnnotation is the annotation added to each runner Pod, mirroring information
 // about the resource allocations of the VM running in the pod.
 //
@@ -52,6 +77,117 @@ const VirtualMachineUsageAnnotation string = "vm.neon.tech/usage"
 // The value of this annotation is always a JSON-encoded VirtualMachineResources object.
 const VirtualMachineResourcesAnnotation string = "vm.neon.tech/resources"
 
+// VirtualMachineRequiredCapabilitiesAnnotation is the annotation added to runner Pods for VMs that
+// set .spec.requiredCapabilities, so that the scheduler can check them against each node.
+//
+// The value of this annotation is a JSON-encoded list of NodeCapability.
+const VirtualMachineRequiredCapabilitiesAnnotation string = "vm.neon.tech/required-capabilities"
+
+// VirtualMachineDevicesAnnotation is the annotation added to runner Pods for VMs that set
+// .spec.guest.devices, so that the scheduler plugin can check that the node has the devices.
+//
+// The value of this annotation is a JSON-encoded map of each extended resource name to the number
+// of devices needed.
+const VirtualMachineDevicesAnnotation string = "vm.neon.tech/devices"
+
+// VirtualMachinePriorityAnnotation is the annotation added to runner Pods for VMs that set
+// .spec.priority, so that the scheduler plugin can take it into account.
+//
+// The value of this annotation is the VirtualMachinePriority.
+const VirtualMachinePriorityAnnotation string = "vm.neon.tech/priority"
+
+// VirtualMachineAutoscalingAnnotation is the annotation added to runner Pods for VMs that set
+// .spec.autoscaling, so that the scheduler plugin can take it into account.
+//
+// The value of this annotation is always a JSON-encoded AutoscalingSpec.
+const VirtualMachineAutoscalingAnnotation string = "vm.neon.tech/autoscaling"
+
+// VirtualMachineScalingCorrelationIDAnnotation is the annotation set by the autoscaler-agent
+// alongside changes to the VM's resources, giving the ID of the agent's scaling transaction that
+// made the change. It's included in the logs and events for the resulting resize.
+const VirtualMachineScalingCorrelationIDAnnotation string = "vm.neon.tech/scaling-correlation-id"
+
+// VirtualMachineScalingTraceParentAnnotation is the annotation set by the autoscaler-agent
+// alongside changes to the VM's resources, giving the W3C 'traceparent' of the agent's request
+// that made the change, if it was traced. The NeonVM controller records its trace ID on the spans
+// for the resulting reconciles, so that the two traces can be found together.
+const VirtualMachineScalingTraceParentAnnotation string = "vm.neon.tech/scaling-traceparent"
+
+// VirtualMachineAgentConnectedAnnotation is the annotation set by the autoscaler-agent to "true"
+// when it connects to the vm-monitor in the guest, and to "false" when the connection ends. The
+// controller reflects it in the VM's AgentConnected condition.
+const VirtualMachineAgentConnectedAnnotation string = "vm.neon.tech/agent-connected"
+
+// VirtualMachineProtectedAnnotation is the annotation that, when set to "true", makes the webhook
+// reject deletion of the VM, unless VirtualMachineForceDeleteAnnotation is also set to "true".
+const VirtualMachineProtectedAnnotation string = "neonvm/protected"
+
+// VirtualMachineForceDeleteAnnotation is the annotation that, when set to "true", allows deleting
+// the VM even if it's protected (see VirtualMachineProtectedAnnotation) or being migrated.
+const VirtualMachineForceDeleteAnnotation string = "neonvm/force-delete"
+
+// VMImageMetadataLabel is the label that vm-builder sets on the images it builds, with the
+// JSON-encoded VMImageMetadata of the image.
+const VMImageMetadataLabel string = "vm.neon.tech/image-metadata"
+
+// VMImageMetadataPath is the path of the JSON-encoded VMImageMetadata in the images built by
+// vm-builder, alongside the disk image. May be missing in images built by older versions.
+const VMImageMetadataPath string = "/vm-image.json"
+
+// ConsolePort is the port on which neonvm-runner serves the guest's serial console output. See
+// VirtualMachineStatus.ConsoleURL for more.
+const ConsolePort int32 = 20189
+
+// NodeCapabilityLabelPrefix is the prefix of the labels that nodes publish their capabilities with.
+// See NodeCapability.NodeLabel for more.
+const NodeCapabilityLabelPrefix string = "capability.vm.neon.tech/"
+
+// NodeCapability is a feature that a node must support for a VM to run on it.
+//
+// +kubebuilder:validation:Enum=virtio-mem;hugepages;sr-iov;nested-virt;confidential-compute;amd64;arm64
+type NodeCapability string
+
+const (
+	NodeCapabilityVirtioMem NodeCapability = "virtio-mem"
+	// NodeCapabilityHugepages is for nodes with hugepages set aside for VMs. It's required by all
+	// VMs with .spec.guest.memoryBacking hugepages.
+	NodeCapabilityHugepages  NodeCapability = "hugepages"
+	NodeCapabilitySRIOV      NodeCapability = "sr-iov"
+	NodeCapabilityNestedVirt NodeCapability = "nested-virt"
+	// NodeCapabilityConfidentialCompute is for nodes that can run AMD SEV-SNP or Intel TDX guests.
+	// It's required by all VMs with .spec.enableConfidentialCompute.
+	NodeCapabilityConfidentialCompute NodeCapability = "confidential-compute"
+	NodeCapabilityAMD64               NodeCapability = "amd64"
+	NodeCapabilityARM64               NodeCapability = "arm64"
+)
+
+// VirtualMachinePriority is the class of a VM's priority for resources on its node.
+//
+// +kubebuilder:validation:Enum=LatencySensitive;Standard;Batch
+type VirtualMachinePriority string
+
+const (
+	// PriorityLatencySensitive is for VMs that should get resources before all others.
+	PriorityLatencySensitive VirtualMachinePriority = "LatencySensitive"
+	// PriorityStandard is the default priority.
+	PriorityStandard VirtualMachinePriority = "Standard"
+	// PriorityBatch is for VMs that can wait for resources while other VMs need them.
+	PriorityBatch VirtualMachinePriority = "Batch"
+)
+
+// NodeLabel returns the label that nodes with this capability have.
+//
+// Architectures use the well-known 'kubernetes.io/arch' label. Everything else uses a label with
+// NodeCapabilityLabelPrefix, set to "true".
+func (c NodeCapability) NodeLabel() (key string, value string) {
+	switch c {
+	case NodeCapabilityAMD64, NodeCapabilityARM64:
+		return corev1.LabelArchStable, string(c)
+	default:
+		return NodeCapabilityLabelPrefix + string(c), "true"
+	}
+}
+
 // VirtualMachineUsage provides information about a VM's current usage. This is the type of the
 // JSON-encoded data in the VirtualMachineUsageAnnotation attached to each runner pod.
 type VirtualMachineUsage struct {
@@ -88,10 +224,42 @@ type VirtualMachineSpec struct {
 	// +optional
 	RunnerPort int32 `json:"runnerPort,omitempty"`
 
+	// TerminationGracePeriodSeconds is how long the guest has to power off after an ACPI powerdown
+	// request (e.g. when the VM is deleted), before QEMU is killed. Whether the guest powered off
+	// in time is recorded in .status.lastShutdown.
 	// +kubebuilder:default:=5
 	// +optional
 	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds"`
 
+	// RequiredCapabilities lists the node capabilities that the VM requires. The scheduler only
+	// places the runner pod on nodes that publish all of them (see NodeCapability.NodeLabel).
+	//
+	// Changes take effect when the runner pod is next created, e.g. on restart or migration.
+	// +optional
+	RequiredCapabilities []NodeCapability `json:"requiredCapabilities,omitempty"`
+
+	// Priority is the VM's class of priority for resources on its node. The scheduler plugin
+	// prefers less loaded nodes for higher priority VMs, and denies upscaling to lower priority VMs
+	// first when the node is running out of room.
+	//
+	// Defaults to Standard.
+	// +optional
+	Priority VirtualMachinePriority `json:"priority,omitempty"`
+
+	// MigrationPolicy controls where the target pods for the VM's live migrations may be placed,
+	// relative to the source pod.
+	//
+	// Changes take effect for migrations that start afterwards.
+	// +optional
+	MigrationPolicy *MigrationPolicy `json:"migrationPolicy,omitempty"`
+
+	// Autoscaling allows enabling, disabling, or temporarily pausing autoscaling for the VM. If
+	// unset, autoscaling is controlled only by the "autoscaling.neon.tech/enabled" label.
+	//
+	// Whether autoscaling is in effect is reported by the AutoscalingEnabled condition.
+	// +optional
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+
 	NodeSelector       map[string]string           `json:"nodeSelector,omitempty"`
 	Affinity           *corev1.Affinity            `json:"affinity,omitempty"`
 	Tolerations        []corev1.Toleration         `json:"tolerations,omitempty"`
@@ -99,10 +267,20 @@ type VirtualMachineSpec struct {
 	ServiceAccountName string                      `json:"serviceAccountName,omitempty"`
 	PodResources       corev1.ResourceRequirements `json:"podResources,omitempty"`
 
+	// RestartPolicy controls whether the VM is restarted when its runner pod stops: Always,
+	// OnFailure (only if the runner pod failed), or Never. Restarts soon after the previous one are
+	// delayed by an exponential backoff, so that a guest that keeps crashing doesn't restart in a
+	// tight loop.
 	// +kubebuilder:default:=Always
 	// +optional
 	RestartPolicy RestartPolicy `json:"restartPolicy"`
 
+	// RunPolicy controls whether the guest should be running or paused. While paused, the guest's
+	// CPUs are stopped (via QMP 'stop'), but the runner pod and guest memory are kept.
+	// +kubebuilder:default:=Running
+	// +optional
+	RunPolicy RunPolicy `json:"runPolicy,omitempty"`
+
 	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 
 	Guest Guest `json:"guest"`
@@ -110,6 +288,14 @@ type VirtualMachineSpec struct {
 	// Running init containers is costly, so InitScript field should be preferred over ExtraInitContainers
 	ExtraInitContainers []corev1.Container `json:"extraInitContainers,omitempty"`
 
+	// ExtraContainers are added to the runner pod alongside the runner container, e.g. for log
+	// shippers, tracing agents, or proxies. Their names and ports must not conflict with the ones
+	// used by NeonVM. They must keep running for as long as the VM does: if one exits, the runner
+	// pod is treated as failed.
+	// Changes take effect when the runner pod is next recreated.
+	// +optional
+	ExtraContainers []corev1.Container `json:"extraContainers,omitempty"`
+
 	// InitScript will be executed in the main container before VM is started.
 	// +optional
 	InitScript string `json:"initScript,omitempty"`
@@ -122,6 +308,15 @@ type VirtualMachineSpec struct {
 	// +optional
 	ExtraNetwork *ExtraNetwork `json:"extraNetwork,omitempty"`
 
+	// IPFamilies are the IP families that the guest's default network interface is set up for.
+	// The runner pod must have an address in each of them, so this should match the cluster's pod
+	// networking. With IPv6, the guest gets its address with SLAAC, and the ports in
+	// .spec.guest.ports are forwarded over both families.
+	//
+	// Defaults to [IPv4]. Cannot be updated.
+	// +optional
+	IPFamilies []IPFamily `json:"ipFamilies,omitempty"`
+
 	// +optional
 	ServiceLinks *bool `json:"service_links,omitempty"`
 
@@ -130,15 +325,152 @@ type VirtualMachineSpec struct {
 	// +optional
 	EnableAcceleration *bool `json:"enableAcceleration,omitempty"`
 
+	// EnableConfidentialCompute runs the guest as a confidential VM, with its memory encrypted by
+	// AMD SEV-SNP or Intel TDX - whichever the node supports. The VM is only scheduled onto nodes
+	// with the "confidential-compute" capability.
+	//
+	// Confidential VMs can't be hotplugged or live migrated, so they're resized by restarting them,
+	// and migrations fail. Cannot be updated.
+	// +optional
+	EnableConfidentialCompute *bool `json:"enableConfidentialCompute,omitempty"`
+
 	// Override for normal neonvm-runner image
 	// +optional
 	RunnerImage *string `json:"runnerImage,omitempty"`
 
 	// Enable SSH on the VM. It works only if the VM image is built using VM Builder that
-	// has SSH support (TODO: mention VM Builder version).
+	// has SSH support (TODO: mention VM Builder version). Has no effect with bootMethod UEFI.
 	// +kubebuilder:default:=true
 	// +optional
 	EnableSSH *bool `json:"enableSSH,omitempty"`
+
+	// RestoreFrom, if set, bootstraps the VM's disks (and optionally its memory) from a completed
+	// VirtualMachineSnapshot, instead of starting from a fresh copy of the root disk image.
+	// +optional
+	RestoreFrom *RestoreFrom `json:"restoreFrom,omitempty"`
+
+	// CloneFrom, if set, bootstraps the VM's disks from another VM in the same namespace, by taking
+	// a snapshot of its disks while it keeps running, and then restoring from that snapshot.
+	// Cannot be updated.
+	// +optional
+	CloneFrom *CloneFrom `json:"cloneFrom,omitempty"`
+}
+
+// MigrationPolicy controls the placement of migration target pods
+type MigrationPolicy struct {
+	// SpreadAcross lists the failure domains that a migration's target pod must not share with
+	// the source pod, so that migrating away from failing hardware doesn't land on the same
+	// hardware. Targets that can't be placed accordingly remain pending.
+	// +optional
+	SpreadAcross []FailureDomain `json:"spreadAcross,omitempty"`
+}
+
+// AutoscalingSpec controls whether the autoscaler-agent and scheduler plugin may change the VM's
+// resources
+type AutoscalingSpec struct {
+	// Enabled overrides the "autoscaling.neon.tech/enabled" label, if set.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Pause, if set, freezes autoscaling for the VM at its current size, regardless of Enabled.
+	// It's meant for use during incidents, so that everyone can see why the VM isn't scaling.
+	// +optional
+	Pause *AutoscalingPause `json:"pause,omitempty"`
+}
+
+// AutoscalingPause records why autoscaling was paused for a VM
+type AutoscalingPause struct {
+	// Reason is a human-readable explanation of why autoscaling is paused
+	// +kubebuilder:validation:MinLength=1
+	Reason string `json:"reason"`
+}
+
+// IsEnabled returns whether autoscaling is in effect for the VM, given whether it's enabled by
+// label. The AutoscalingSpec may be nil.
+func (s *AutoscalingSpec) IsEnabled(labelEnabled bool) bool {
+	if s == nil {
+		return labelEnabled
+	} else if s.Pause != nil {
+		return false
+	} else if s.Enabled != nil {
+		return *s.Enabled
+	}
+	return labelEnabled
+}
+
+// FailureDomain is a set of nodes that may fail together, identified by a well-known node label.
+// See FailureDomain.TopologyKey for more.
+//
+// +kubebuilder:validation:Enum=host;zone
+type FailureDomain string
+
+const (
+	// FailureDomainHost is a single node
+	FailureDomainHost FailureDomain = "host"
+	// FailureDomainZone is all the nodes in an availability zone
+	FailureDomainZone FailureDomain = "zone"
+)
+
+// TopologyKey returns the node label that identifies the failure domain
+func (d FailureDomain) TopologyKey() string {
+	switch d {
+	case FailureDomainZone:
+		return corev1.LabelTopologyZone
+	default:
+		return corev1.LabelHostname
+	}
+}
+
+// CloneFrom references the VM that a VM is cloned from
+//
+// The clone's disks are restored from a VirtualMachineSnapshot of the source VM, named
+// "<clone name>-clone" and owned by the clone, so that it's deleted along with it.
+type CloneFrom struct {
+	// VMName is the name of the VM to clone, in the same namespace. It must be running.
+	VMName string `json:"vmName"`
+
+	// Target is where the snapshot of the source VM is written to, in the same way as
+	// VirtualMachineSnapshot's .spec.target.
+	Target SnapshotTarget `json:"target"`
+
+	// PreserveIdentity, if true, gives the clone the same guest identity as the source VM - i.e.,
+	// the same cloud-init instance ID and hostname - so that the guest doesn't treat it as a new
+	// machine. By default, the clone gets its own identity, so that cloud-init runs its
+	// once-per-instance modules again (e.g. regenerating SSH host keys).
+	// +optional
+	// +kubebuilder:default:=false
+	PreserveIdentity bool `json:"preserveIdentity"`
+}
+
+// GuestIdentity returns the name that identifies the guest of the VM with the given name, which is
+// the name of the source VM for clones that preserve identity
+func (spec *VirtualMachineSpec) GuestIdentity(vmName string) string {
+	if spec.CloneFrom != nil && spec.CloneFrom.PreserveIdentity {
+		return spec.CloneFrom.VMName
+	}
+	return vmName
+}
+
+// RestoresDisks returns whether the VM's disks are bootstrapped from a snapshot, either directly
+// with .spec.restoreFrom or from the snapshot of the source VM with .spec.cloneFrom
+func (spec *VirtualMachineSpec) RestoresDisks() bool {
+	return spec.RestoreFrom != nil || spec.CloneFrom != nil
+}
+
+// RestoreFrom references the VirtualMachineSnapshot that a VM is restored from
+type RestoreFrom struct {
+	// SnapshotName is the name of a VirtualMachineSnapshot in the VM's namespace. The snapshot
+	// must have succeeded.
+	SnapshotName string `json:"snapshotName"`
+
+	// RestoreMemory, if true, also loads the snapshot's memory and device state, so that the guest
+	// resumes from exactly where it was when the snapshot was taken, rather than booting again.
+	//
+	// This requires that the snapshot was taken with includeMemory, and that the VM has exactly
+	// the same CPU and memory configuration as the snapshotted VM.
+	// +optional
+	// +kubebuilder:default:=false
+	RestoreMemory bool `json:"restoreMemory"`
 }
 
 func (spec *VirtualMachineSpec) Resources() VirtualMachineResources {
@@ -149,6 +481,31 @@ func (spec *VirtualMachineSpec) Resources() VirtualMachineResources {
 	}
 }
 
+// NodeCapabilities returns the capabilities that the VM's node must have: those listed in
+// .spec.requiredCapabilities, plus any implied by the rest of the spec.
+func (spec *VirtualMachineSpec) NodeCapabilities() []NodeCapability {
+	capabilities := slices.Clone(spec.RequiredCapabilities)
+	if spec.ConfidentialCompute() && !slices.Contains(capabilities, NodeCapabilityConfidentialCompute) {
+		capabilities = append(capabilities, NodeCapabilityConfidentialCompute)
+	}
+	if spec.Guest.HugepageSizeOrNil() != nil && !slices.Contains(capabilities, NodeCapabilityHugepages) {
+		capabilities = append(capabilities, NodeCapabilityHugepages)
+	}
+	return capabilities
+}
+
+// ConfidentialCompute returns whether .spec.enableConfidentialCompute is true
+func (spec *VirtualMachineSpec) ConfidentialCompute() bool {
+	return spec.EnableConfidentialCompute != nil && *spec.EnableConfidentialCompute
+}
+
+// ResizedByRestart returns whether the VM's CPUs and memory are fixed while it's running, so that
+// it can only be resized by restarting it. This is the case for VMs booted via UEFI, and for
+// confidential VMs.
+func (spec *VirtualMachineSpec) ResizedByRestart() bool {
+	return spec.Guest.BootMethod == BootMethodUEFI || spec.ConfidentialCompute()
+}
+
 // +kubebuilder:validation:Enum=Always;OnFailure;Never
 type RestartPolicy string
 
@@ -158,15 +515,82 @@ const (
 	RestartPolicyNever     RestartPolicy = "Never"
 )
 
+// +kubebuilder:validation:Enum=Running;Paused
+type RunPolicy string
+
+const (
+	RunPolicyRunning RunPolicy = "Running"
+	RunPolicyPaused  RunPolicy = "Paused"
+)
+
+// +kubebuilder:validation:Enum=Kernel;UEFI
+type BootMethod string
+
+const (
+	// BootMethodKernel boots the guest by loading the kernel directly, with the root disk built by
+	// vm-builder. This is required for online autoscaling.
+	BootMethodKernel BootMethod = "Kernel"
+	// BootMethodUEFI boots the root disk as an opaque, full-disk image via UEFI firmware. Nothing is
+	// expected to run inside the guest, so the VM can only be resized by restarting it.
+	BootMethodUEFI BootMethod = "UEFI"
+)
+
+// +kubebuilder:validation:Enum=IPv4;IPv6
+type IPFamily string
+
+const (
+	IPFamilyIPv4 IPFamily = "IPv4"
+	IPFamilyIPv6 IPFamily = "IPv6"
+)
+
+// HasIPFamily returns whether the VM's default network interface is set up for the IP family,
+// treating an empty .spec.ipFamilies as [IPv4].
+func (spec *VirtualMachineSpec) HasIPFamily(family IPFamily) bool {
+	if len(spec.IPFamilies) == 0 {
+		return family == IPFamilyIPv4
+	}
+	return slices.Contains(spec.IPFamilies, family)
+}
+
 type Guest struct {
+	// BootMethod controls how the guest is booted. With UEFI, the root disk is booted as-is, and
+	// the kernel, runtime settings, and swap are not used.
+	// Cannot be updated.
+	// +kubebuilder:default:=Kernel
+	// +optional
+	BootMethod BootMethod `json:"bootMethod,omitempty"`
+
+	// EnableGuestAgent adds a virtio-serial channel for the QEMU guest agent. It's only meaningful
+	// for UEFI guests that run qemu-ga.
+	// +optional
+	EnableGuestAgent *bool `json:"enableGuestAgent,omitempty"`
+
 	// +optional
 	KernelImage *string `json:"kernelImage,omitempty"`
 
 	// +optional
 	AppendKernelCmdline *string `json:"appendKernelCmdline,omitempty"`
 
+	// KernelCmdline lists extra kernel command line parameters, each of the form 'name' or
+	// 'name=value', that are appended to the ones set by neonvm-runner. Parameters that would
+	// interfere with how the VM is run (e.g. 'init' or 'mem') are rejected.
+	//
+	// Changes take effect when the VM next restarts.
+	// +optional
+	KernelCmdline []string `json:"kernelCmdline,omitempty"`
+
 	// +optional
 	CPUs CPUs `json:"cpus"`
+	// CPUBurst, if set, allows the VM to temporarily use more CPU than .cpus.use, when it's being
+	// throttled and the node has spare capacity. See CPUBurst for more.
+	// Cannot be updated.
+	// +optional
+	CPUBurst *CPUBurst `json:"cpuBurst,omitempty"`
+	// CPUScalingMode selects how the VM's CPUs are scaled. See CPUScalingMode for more.
+	// If not set, the controller's default is used (see its '-default-cpu-scaling-mode' flag).
+	// Changes take effect when the VM next restarts.
+	// +optional
+	CPUScalingMode *CPUScalingMode `json:"cpuScalingMode,omitempty"`
 	// +optional
 	// +kubebuilder:default:="1Gi"
 	MemorySlotSize resource.Quantity `json:"memorySlotSize"`
@@ -174,6 +598,17 @@ type Guest struct {
 	MemorySlots MemorySlots `json:"memorySlots"`
 	// +optional
 	MemoryProvider *MemoryProvider `json:"memoryProvider,omitempty"`
+	// MemoryBacking selects what the guest's memory is allocated from on the host. With hugepages,
+	// the runner pod requests enough hugepages of .hugepageSize for the guest's maximum memory, and
+	// the VM requires the hugepages node capability.
+	// Cannot be updated.
+	// +optional
+	MemoryBacking *MemoryBacking `json:"memoryBacking,omitempty"`
+	// HugepageSize is the size of the hugepages that back the guest's memory with memoryBacking
+	// hugepages: either 2Mi or 1Gi. Defaults to 2Mi.
+	// Cannot be updated.
+	// +optional
+	HugepageSize *resource.Quantity `json:"hugepageSize,omitempty"`
 	// +optional
 	RootDisk RootDisk `json:"rootDisk"`
 	// Docker image Entrypoint array replacement.
@@ -186,10 +621,44 @@ type Guest struct {
 	// List of environment variables to set in the vmstart process.
 	// +optional
 	Env []EnvVar `json:"env,omitempty" patchStrategy:"merge" patchMergeKey:"name"`
+	// Network tunes the guest's default network interface. The extra network interface, if any, is
+	// unaffected.
+	// Cannot be updated.
+	// +optional
+	Network *GuestNetwork `json:"network,omitempty"`
 	// List of ports to expose from the container.
 	// Cannot be updated.
 	// +optional
 	Ports []Port `json:"ports,omitempty"`
+	// PortForwarding selects how neonvm-runner forwards traffic for the ports above to the guest.
+	// If not set, the controller's default is used (see its '-default-port-forwarding' flag).
+	// Changes take effect when the runner pod is next recreated.
+	// +optional
+	PortForwarding *PortForwarding `json:"portForwarding,omitempty"`
+
+	// Devices are host devices passed through to the guest with VFIO, e.g. GPUs. Each device is
+	// allocated to the runner pod by a device plugin on the node, which advertises them as the
+	// extended resource ResourceName.
+	//
+	// VMs with devices can't be live-migrated.
+	// Cannot be updated.
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Devices []GuestDevice `json:"devices,omitempty"`
+
+	// CloudInit, if set, provides user-data to the guest when it boots, so that guests based on
+	// standard cloud images can be configured without building a custom image.
+	// Cannot be updated.
+	// +optional
+	CloudInit *CloudInit `json:"cloudInit,omitempty"`
+
+	// ReadinessProbe, if set, is periodically run against the guest by neonvm-runner. The runner
+	// pod is only ready while the probe succeeds, so that Services only route to the VM once its
+	// workload is actually up.
+	// Cannot be updated.
+	// +optional
+	ReadinessProbe *GuestProbe `json:"readinessProbe,omitempty"`
 
 	// Additional settings for the VM.
 	// Cannot be updated.
@@ -215,6 +684,29 @@ func (g Guest) ValidateForMemoryProvider(p MemoryProvider) error {
 	return nil
 }
 
+// HugepageSizeOrNil returns the size of the hugepages that back the guest's memory, or nil if it isn't
+// backed by hugepages
+func (g Guest) HugepageSizeOrNil() *resource.Quantity {
+	if g.MemoryBacking == nil || *g.MemoryBacking != MemoryBackingHugepages {
+		return nil
+	}
+	if g.HugepageSize != nil {
+		return g.HugepageSize
+	}
+	return &DefaultHugepageSize
+}
+
+// HugepagesResourceName returns the name of the resource that the runner pod requests for the
+// hugepages backing the guest's memory (e.g. "hugepages-2Mi"), or "" if it isn't backed by
+// hugepages
+func (g Guest) HugepagesResourceName() corev1.ResourceName {
+	size := g.HugepageSizeOrNil()
+	if size == nil {
+		return ""
+	}
+	return corev1.ResourceName(corev1.ResourceHugePagesPrefix + size.String())
+}
+
 type GuestSettings struct {
 	// Individual lines to add to a sysctl.conf file. See sysctl.conf(5) for more
 	// +optional
@@ -261,8 +753,10 @@ func (s *GuestSettings) GetSwapInfo() (*SwapInfo, error) {
 
 	if s.Swap != nil {
 		return &SwapInfo{
-			Size:       *s.Swap,
-			SkipSwapon: nil,
+			Size:          *s.Swap,
+			SkipSwapon:    nil,
+			Policy:        nil,
+			MemoryPercent: nil,
 		}, nil
 	} else if s.SwapInfo != nil {
 		return lo.ToPtr(*s.SwapInfo), nil
@@ -283,6 +777,55 @@ type SwapInfo struct {
 	//
 	// +optional
 	SkipSwapon *bool `json:"skipSwapon,omitempty"`
+	// Policy determines whether the size of the swap changes as the VM's memory scales. Defaults
+	// to Fixed.
+	//
+	// With ProportionalToMemory, Size is the size of the swap disk, and so also the maximum size
+	// of the swap.
+	//
+	// +optional
+	Policy *SwapPolicy `json:"policy,omitempty"`
+	// MemoryPercent is the size of the swap as a percentage of the VM's memory, when Policy is
+	// ProportionalToMemory.
+	//
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=1000
+	// +optional
+	MemoryPercent *int32 `json:"memoryPercent,omitempty"`
+}
+
+// SwapPolicy determines how the size of a VM's swap is chosen
+//
+// +kubebuilder:validation:Enum=Fixed;ProportionalToMemory
+type SwapPolicy string
+
+const (
+	// SwapPolicyFixed means that the swap is always SwapInfo.Size.
+	SwapPolicyFixed SwapPolicy = "Fixed"
+	// SwapPolicyProportionalToMemory means that the swap is SwapInfo.MemoryPercent of the VM's
+	// memory, up to SwapInfo.Size. It's resized online as the VM's memory changes.
+	SwapPolicyProportionalToMemory SwapPolicy = "ProportionalToMemory"
+)
+
+// IsProportional returns whether the swap is resized as the VM's memory changes
+func (s SwapInfo) IsProportional() bool {
+	return s.Policy != nil && *s.Policy == SwapPolicyProportionalToMemory
+}
+
+// SizeForMemory returns the size of the swap for a VM with the given amount of memory, according to
+// the swap's Policy.
+func (s SwapInfo) SizeForMemory(memory resource.Quantity) resource.Quantity {
+	if !s.IsProportional() || s.MemoryPercent == nil {
+		return s.Size
+	}
+
+	size := memory.Value() * int64(*s.MemoryPercent) / 100
+	// Round down to a whole number of MiB, so that sizes are always a multiple of the page size.
+	size -= size % (1 << 20)
+	if size > s.Size.Value() {
+		return s.Size
+	}
+	return *resource.NewQuantity(size, resource.BinarySI)
 }
 
 type CPUs struct {
@@ -291,6 +834,28 @@ type CPUs struct {
 	Use MilliCPU `json:"use"`
 }
 
+// CPUBurst configures time-sliced CPU bursting for a VM.
+//
+// When the VM's CPU is being throttled at its current allocation (.spec.guest.cpus.use), and the
+// node has enough idle CPU, neonvm-runner raises the limit to Limit for up to MaxDurationSeconds,
+// smoothing latency spikes while the autoscaler-agent catches up. Bursts are never above
+// .spec.guest.cpus.max, and are ended early if the node runs out of idle CPU.
+//
+// CPU used while bursting is reported separately from the allocation, in
+// .status.cpuBurst.milliCPUSecondsTotal.
+type CPUBurst struct {
+	// Limit is the CPU allowed while bursting. It must be between .spec.guest.cpus.min and
+	// .spec.guest.cpus.max. Bursting is skipped while .spec.guest.cpus.use is at least Limit.
+	Limit MilliCPU `json:"limit"`
+	// MaxDurationSeconds is the maximum length of a single burst.
+	// +kubebuilder:validation:Minimum=1
+	MaxDurationSeconds int32 `json:"maxDurationSeconds"`
+	// CooldownSeconds is the minimum time between the end of one burst and the start of the next.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	CooldownSeconds int32 `json:"cooldownSeconds,omitempty"`
+}
+
 // MilliCPU is a special type to represent vCPUs * 1000
 // e.g. 2 vCPU is 2000, 0.25 is 250
 //
@@ -399,6 +964,97 @@ func (p *MemoryProvider) FlagFunc(value string) error {
 	return nil
 }
 
+// MemoryBacking is what the guest's memory is allocated from on the host.
+//
+// +kubebuilder:validation:Enum=ram;hugepages
+type MemoryBacking string
+
+const (
+	// MemoryBackingRAM allocates the guest's memory from ordinary anonymous memory. This is the
+	// default.
+	MemoryBackingRAM MemoryBacking = "ram"
+	// MemoryBackingHugepages allocates the guest's memory from hugepages, which reduces TLB misses
+	// for memory-intensive workloads. Hugepages can't be overcommitted, so the runner pod requests
+	// them for the guest's maximum memory.
+	MemoryBackingHugepages MemoryBacking = "hugepages"
+)
+
+// DefaultHugepageSize is the size of hugepages used when .spec.guest.hugepageSize isn't set
+var DefaultHugepageSize = resource.MustParse("2Mi")
+
+// CPUScalingMode is the mechanism used to change the number of CPUs available to the guest.
+//
+// In all modes, the runner pod's cgroup is limited to the VM's fractional .spec.guest.cpus.use.
+// They differ in how many CPUs the guest sees.
+//
+// +kubebuilder:validation:Enum=QMPHotplug;CgroupThrottling;GuestCpuset
+type CPUScalingMode string
+
+const (
+	// CPUScalingModeQMPHotplug hotplugs and unplugs vCPUs through QEMU, so that the guest has
+	// ceil(.cpus.use) CPUs. This is the original behavior.
+	CPUScalingModeQMPHotplug CPUScalingMode = "QMPHotplug"
+	// CPUScalingModeCgroupThrottling starts the guest with .cpus.max CPUs, and only limits the
+	// runner pod's cgroup. The guest always sees all of its CPUs, so scaling doesn't depend on
+	// the guest's hotplug support, but it may run more threads than it has CPU time for.
+	CPUScalingModeCgroupThrottling CPUScalingMode = "CgroupThrottling"
+	// CPUScalingModeGuestCpuset starts the guest with .cpus.max CPUs, and has an agent inside the
+	// guest online or offline them to match ceil(.cpus.use), in addition to limiting the runner
+	// pod's cgroup. This avoids QEMU's vCPU hotplug, while keeping the guest's view of its CPUs
+	// accurate.
+	CPUScalingModeGuestCpuset CPUScalingMode = "GuestCpuset"
+)
+
+// FlagFunc is a parsing function to be used with flag.Func
+func (m *CPUScalingMode) FlagFunc(value string) error {
+	possibleValues := []string{
+		string(CPUScalingModeQMPHotplug),
+		string(CPUScalingModeCgroupThrottling),
+		string(CPUScalingModeGuestCpuset),
+	}
+
+	if !slices.Contains(possibleValues, value) {
+		return fmt.Errorf("Unknown CPUScalingMode %q, must be one of %v", value, possibleValues)
+	}
+
+	*m = CPUScalingMode(value)
+	return nil
+}
+
+// PortForwarding is the implementation used by neonvm-runner to forward traffic from the runner
+// pod's ports to the guest.
+//
+// Both implementations install the same DNAT rules, so forwarded packets never leave the kernel;
+// they differ only in the netfilter backend that the rules are loaded into.
+//
+// +kubebuilder:validation:Enum=IPTables;NFTables
+type PortForwarding string
+
+const (
+	// PortForwardingIPTables installs the rules with iptables-legacy. This is the original
+	// behavior.
+	PortForwardingIPTables PortForwarding = "IPTables"
+	// PortForwardingNFTables installs the rules with iptables-nft, using the kernel's nf_tables
+	// instead of the legacy xtables. This avoids mixing backends on nodes where kube-proxy (or the
+	// CNI) uses nftables.
+	PortForwardingNFTables PortForwarding = "NFTables"
+)
+
+// FlagFunc is a parsing function to be used with flag.Func
+func (p *PortForwarding) FlagFunc(value string) error {
+	possibleValues := []string{
+		string(PortForwardingIPTables),
+		string(PortForwardingNFTables),
+	}
+
+	if !slices.Contains(possibleValues, value) {
+		return fmt.Errorf("Unknown PortForwarding %q, must be one of %v", value, possibleValues)
+	}
+
+	*p = PortForwarding(value)
+	return nil
+}
+
 type RootDisk struct {
 	Image string `json:"image"`
 	// +optional
@@ -408,6 +1064,117 @@ type RootDisk struct {
 	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy"`
 	// +optional
 	Execute []string `json:"execute,omitempty"`
+	// Streaming, if set, lazily pulls the root disk contents over the network instead of copying
+	// the full image before the VM starts.
+	//
+	// With streaming, the VM boots from a local qcow2 overlay whose backing file is read remotely.
+	// Blocks that haven't yet been fetched are read on demand.
+	// +optional
+	Streaming *RootDiskStreaming `json:"streaming,omitempty"`
+	// BaseImageCache, if set, stores the root disk image in a cache shared between VMs, and boots
+	// the VM from a local qcow2 overlay on top of it.
+	//
+	// The image is only copied into the cache by the first VM that uses it, so VMs with large
+	// images start faster. Base images that aren't used by any VM are eventually removed.
+	// +optional
+	BaseImageCache *RootDiskBaseImageCache `json:"baseImageCache,omitempty"`
+	// Platform, if set, declares the architecture and OS that the image was built for.
+	//
+	// The controller checks it against the nodes the VM may be scheduled on, and reports a
+	// mismatch instead of creating a runner pod that can't boot the image. Runner pods are also
+	// placed on nodes with the declared platform, unless .spec.affinity gives other node terms.
+	// +optional
+	Platform *RootDiskPlatform `json:"platform,omitempty"`
+	// Format is the format of the disk image in the root disk container image, which must be at
+	// /disk.qcow2 or /disk.raw respectively. Defaults to qcow2.
+	//
+	// Raw images are attached as-is, without conversion. With streaming or the base image cache,
+	// the VM still boots from a local qcow2 overlay, backed by the image in its own format.
+	// +optional
+	Format DiskImageFormat `json:"format,omitempty"`
+	// Compression is the compression of the disk image in the root disk container image. With
+	// zstd, the image must be at /disk.qcow2.zst or /disk.raw.zst, and the runner decompresses it
+	// before the VM starts. With the base image cache, the decompressed image is cached, so that
+	// it's only decompressed by the first VM that uses it. Defaults to none.
+	//
+	// Compressed images can't be streamed.
+	// +optional
+	Compression DiskImageCompression `json:"compression,omitempty"`
+	// IOLimits, if set, limits the rate of I/O to the root disk. It can be changed while the VM is
+	// running.
+	// +optional
+	IOLimits *DiskIOLimits `json:"ioLimits,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=qcow2;raw
+type DiskImageFormat string
+
+const (
+	DiskImageFormatQCOW2 DiskImageFormat = "qcow2"
+	DiskImageFormatRaw   DiskImageFormat = "raw"
+)
+
+// +kubebuilder:validation:Enum=none;zstd
+type DiskImageCompression string
+
+const (
+	DiskImageCompressionNone DiskImageCompression = "none"
+	DiskImageCompressionZstd DiskImageCompression = "zstd"
+)
+
+// ImageFormat returns the format of the root disk image, defaulting to qcow2
+func (d *RootDisk) ImageFormat() DiskImageFormat {
+	if d.Format == "" {
+		return DiskImageFormatQCOW2
+	}
+	return d.Format
+}
+
+// ImageCompressed returns whether the root disk image is compressed with zstd
+func (d *RootDisk) ImageCompressed() bool {
+	return d.Compression == DiskImageCompressionZstd
+}
+
+// ImagePath returns the path of the disk image inside the root disk container image
+func (d *RootDisk) ImagePath() string {
+	path := "/disk." + string(d.ImageFormat())
+	if d.ImageCompressed() {
+		path += ".zst"
+	}
+	return path
+}
+
+// RootDiskPlatform is the platform that a root disk image was built for. Values are the same as
+// the 'kubernetes.io/arch' and 'kubernetes.io/os' node labels.
+type RootDiskPlatform struct {
+	// +kubebuilder:validation:Enum=amd64;arm64
+	Architecture string `json:"architecture"`
+	// +optional
+	// +kubebuilder:default:=linux
+	OS string `json:"os,omitempty"`
+}
+
+// RootDiskBaseImageCache is the volume that stores read-only base images for root disks. Exactly
+// one of HostPath or PersistentVolumeClaim must be set.
+type RootDiskBaseImageCache struct {
+	// HostPath is a directory on the node to store base images in. It's created if it doesn't
+	// exist.
+	// +optional
+	HostPath *string `json:"hostPath,omitempty"`
+	// PersistentVolumeClaim is the name of a PVC in the VM's namespace to store base images in.
+	// If it's shared between VMs on different nodes, it must support ReadWriteMany.
+	// +optional
+	PersistentVolumeClaim *string `json:"persistentVolumeClaim,omitempty"`
+}
+
+type RootDiskStreaming struct {
+	// URL is the HTTP(S) location of the root disk image, in .spec.guest.rootDisk.format
+	URL string `json:"url"`
+	// Prefetch, if true, copies the remaining contents of the image into the local overlay in the
+	// background, so that the VM eventually stops depending on the remote source.
+	// +optional
+	// +kubebuilder:default:=true
+	Prefetch *bool `json:"prefetch,omitempty"`
 }
 
 type EnvVar struct {
@@ -443,9 +1210,172 @@ const (
 	ProtocolUDP Protocol = "UDP"
 )
 
+// GuestProbe describes a check of the guest's workload, run by neonvm-runner.
+//
+// Exactly one of HTTPGet, TCPSocket, or Exec must be set.
+type GuestProbe struct {
+	// HTTPGet, if set, makes an HTTP GET request to the guest. Any status code from 200 to 399
+	// counts as success.
+	// +optional
+	HTTPGet *GuestHTTPGetAction `json:"httpGet,omitempty"`
+	// TCPSocket, if set, opens a TCP connection to the guest. The probe succeeds if the connection
+	// is established.
+	// +optional
+	TCPSocket *GuestTCPSocketAction `json:"tcpSocket,omitempty"`
+	// Exec, if set, runs a command in the guest over SSH. The probe succeeds if the command exits
+	// with status 0. Requires .spec.enableSSH.
+	// +optional
+	Exec *GuestExecAction `json:"exec,omitempty"`
+
+	// Number of seconds after the VM has started before the probe is first run.
+	// +optional
+	// +kubebuilder:default:=0
+	// +kubebuilder:validation:Minimum=0
+	InitialDelaySeconds int32 `json:"initialDelaySeconds,omitempty"`
+	// How often, in seconds, to run the probe.
+	// +optional
+	// +kubebuilder:default:=10
+	// +kubebuilder:validation:Minimum=1
+	PeriodSeconds int32 `json:"periodSeconds,omitempty"`
+	// Number of seconds after which each run of the probe times out.
+	// +optional
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=1
+	TimeoutSeconds int32 `json:"timeoutSeconds,omitempty"`
+	// Number of consecutive successes for the guest to be considered ready after having failed.
+	// +optional
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=1
+	SuccessThreshold int32 `json:"successThreshold,omitempty"`
+	// Number of consecutive failures for the guest to be considered not ready after having
+	// succeeded.
+	// +optional
+	// +kubebuilder:default:=3
+	// +kubebuilder:validation:Minimum=1
+	FailureThreshold int32 `json:"failureThreshold,omitempty"`
+}
+
+// GuestNetwork describes the tuning of the guest's default network interface.
+type GuestNetwork struct {
+	// Queues gives the number of queue pairs for the virtio-net device. With more than one queue,
+	// the guest can spread network processing across its CPUs, which is required for high
+	// throughput. Must not be more than .spec.guest.cpus.max.
+	// +optional
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=1
+	Queues int32 `json:"queues,omitempty"`
+	// Vhost sets whether the virtio-net device is backed by vhost-net, which handles the device's
+	// data path in the host kernel instead of in QEMU.
+	// +optional
+	// +kubebuilder:default:=true
+	Vhost *bool `json:"vhost,omitempty"`
+	// MTU, if set, is the MTU of the interface's tap device, and advertised to the guest. If not
+	// set, the default of 1500 is used.
+	// +optional
+	// +kubebuilder:validation:Minimum=68
+	// +kubebuilder:validation:Maximum=65535
+	MTU *int32 `json:"mtu,omitempty"`
+}
+
+// GuestDevice is a host device passed through to the guest
+type GuestDevice struct {
+	// Name identifies the device within the VM
+	// +kubebuilder:validation:Pattern=^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+	// +kubebuilder:validation:MaxLength=32
+	Name string `json:"name"`
+	// ResourceName is the extended resource that the node's device plugin advertises the devices
+	// as, e.g. "nvidia.com/GA100". Each device is one of the resource.
+	ResourceName corev1.ResourceName `json:"resourceName"`
+	// Type is the type of device that the device plugin allocates: either a whole PCI device
+	// ("PCI"), or a mediated device ("Mediated"), e.g. a vGPU. Defaults to PCI.
+	// +kubebuilder:default:=PCI
+	// +optional
+	Type GuestDeviceType `json:"type,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=PCI;Mediated
+type GuestDeviceType string
+
+const (
+	// GuestDeviceTypePCI is a whole PCI device, given by the device plugin as its PCI address
+	GuestDeviceTypePCI GuestDeviceType = "PCI"
+	// GuestDeviceTypeMediated is a mediated device (e.g. a vGPU), given by the device plugin as
+	// its UUID
+	GuestDeviceTypeMediated GuestDeviceType = "Mediated"
+)
+
+// DeviceResources returns the number of each extended resource that the VM's devices need
+func (spec *VirtualMachineSpec) DeviceResources() map[corev1.ResourceName]int64 {
+	if len(spec.Guest.Devices) == 0 {
+		return nil
+	}
+	resources := make(map[corev1.ResourceName]int64)
+	for _, d := range spec.Guest.Devices {
+		resources[d.ResourceName] += 1
+	}
+	return resources
+}
+
+// CloudInit provides user-data to the guest, for either cloud-init or Ignition
+type CloudInit struct {
+	// Format selects how the user-data is provided to the guest. With NoCloud, neonvm-runner
+	// attaches a cloud-init NoCloud seed disk (an ISO labelled 'cidata') with the user-data. With
+	// Ignition, the user-data is passed as the Ignition config through QEMU's firmware
+	// configuration device. Defaults to NoCloud.
+	// +kubebuilder:default:=NoCloud
+	// +optional
+	Format CloudInitFormat `json:"format,omitempty"`
+	// UserData is the user-data itself, e.g. a '#cloud-config' document or an Ignition config.
+	// Exactly one of userData and userDataSecretRef must be set.
+	// +optional
+	UserData *string `json:"userData,omitempty"`
+	// UserDataSecretRef selects a key of a Secret in the VM's namespace that holds the user-data,
+	// for user-data that contains credentials.
+	// Exactly one of userData and userDataSecretRef must be set.
+	// +optional
+	UserDataSecretRef *corev1.SecretKeySelector `json:"userDataSecretRef,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=NoCloud;Ignition
+type CloudInitFormat string
+
+const (
+	// CloudInitFormatNoCloud provides the user-data on a cloud-init NoCloud seed disk
+	CloudInitFormatNoCloud CloudInitFormat = "NoCloud"
+	// CloudInitFormatIgnition provides the user-data as an Ignition config, through QEMU's
+	// firmware configuration device
+	CloudInitFormatIgnition CloudInitFormat = "Ignition"
+)
+
+type GuestHTTPGetAction struct {
+	// Path to request. Defaults to "/".
+	// +optional
+	Path string `json:"path,omitempty"`
+	// Port in the guest to connect to.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int `json:"port"`
+}
+
+type GuestTCPSocketAction struct {
+	// Port in the guest to connect to.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int `json:"port"`
+}
+
+type GuestExecAction struct {
+	// Command to run in the guest, as its individual arguments.
+	// +kubebuilder:validation:MinItems=1
+	Command []string `json:"command"`
+}
+
 type Disk struct {
 	// Disk's name.
 	// Must be a DNS_LABEL and unique within the virtual machine.
+	//
+	// The disk's virtio serial number is derived from its name (see DiskSerial), so that it is
+	// available in the guest as /dev/disk/by-id/virtio-<serial>, regardless of attach order.
 	Name string `json:"name"`
 	// Mounted read-only if true, read-write otherwise (false or unspecified).
 	// Defaults to false.
@@ -455,10 +1385,53 @@ type Disk struct {
 	// Path within the virtual machine at which the disk should be mounted.  Must
 	// not contain ':'.
 	MountPath string `json:"mountPath"`
+	// Hotpluggable disks may be added to or removed from .spec.disks while the VM is running. The
+	// controller attaches and detaches them without restarting the VM.
+	//
+	// Only emptyDisk sources can be hotpluggable, because the runner pod's volumes can't change
+	// after it's created. Removing a hotpluggable disk discards its contents.
+	// +optional
+	Hotpluggable bool `json:"hotpluggable,omitempty"`
+	// IOLimits, if set, limits the rate of I/O to the disk. It can be changed while the VM is
+	// running.
+	//
+	// Only emptyDisk and volumeSnapshot disks can have I/O limits.
+	// +optional
+	IOLimits *DiskIOLimits `json:"ioLimits,omitempty"`
 	// DiskSource represents the location and type of the mounted disk.
 	DiskSource `json:",inline"`
 }
 
+// MaxDiskSerialLength is the maximum length of a virtio disk serial number.
+const MaxDiskSerialLength = 20
+
+// MaxHotpluggableDiskMountPathLength is the maximum length of the mount path of a hotpluggable
+// disk, which is stored in the "last mounted on" field of its ext4 superblock.
+const MaxHotpluggableDiskMountPathLength = 63
+
+// DiskSerial returns the virtio serial number for the disk with the given name.
+//
+// Names that fit are used as-is. Longer names are truncated and suffixed with a hash of the full
+// name, so that the serial is stable and distinct disks are very unlikely to share one.
+func DiskSerial(name string) string {
+	if len(name) <= MaxDiskSerialLength {
+		return name
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", hash.Sum32())
+	return name[:MaxDiskSerialLength-len(suffix)] + suffix
+}
+
+// HotplugDiskDeviceID returns the ID of the QEMU device for the hotpluggable disk with the given
+// name, so that it can be removed later.
+//
+// The disk's block node (or drive, if it was attached at boot) is named after the disk itself, so
+// that it can be referred to in the same way as other disks - e.g. for snapshots.
+func HotplugDiskDeviceID(name string) string {
+	return "disk-" + name
+}
+
 type DiskSource struct {
 	// EmptyDisk represents a temporary empty qcow2 disk that shares a vm's lifetime.
 	EmptyDisk *EmptyDiskSource `json:"emptyDisk,omitempty"`
@@ -471,6 +1444,11 @@ type DiskSource struct {
 	// TmpfsDisk represents a tmpfs.
 	// +optional
 	Tmpfs *TmpfsDiskSource `json:"tmpfs,omitempty"`
+	// VolumeSnapshot represents a disk provisioned from a CSI VolumeSnapshot. The controller creates
+	// a block-mode PersistentVolumeClaim from the snapshot, and waits for the snapshot to be ready
+	// before starting the VM.
+	// +optional
+	VolumeSnapshot *VolumeSnapshotDiskSource `json:"volumeSnapshot,omitempty"`
 }
 
 type EmptyDiskSource struct {
@@ -483,6 +1461,111 @@ type TmpfsDiskSource struct {
 	Size resource.Quantity `json:"size"`
 }
 
+type VolumeSnapshotDiskSource struct {
+	// SnapshotName is the name of the VolumeSnapshot (snapshot.storage.k8s.io/v1), in the same
+	// namespace as the VM.
+	SnapshotName string `json:"snapshotName"`
+	// Size of the PersistentVolumeClaim. Must be at least the snapshot's restore size.
+	Size resource.Quantity `json:"size"`
+	// StorageClassName of the PersistentVolumeClaim. Defaults to the cluster's default storage
+	// class.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// Discard enables the "discard" mount option for the filesystem
+	// +optional
+	Discard bool `json:"discard,omitempty"`
+}
+
+// DiskIOLimits limits the rate of I/O to a disk, so that a VM can't saturate its node's disks.
+// Unset limits aren't enforced.
+//
+// A total limit can't be combined with the read or write limit of the same kind.
+type DiskIOLimits struct {
+	// TotalIOPS is the maximum number of read and write operations per second
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TotalIOPS *int64 `json:"totalIOPS,omitempty"`
+	// ReadIOPS is the maximum number of read operations per second
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ReadIOPS *int64 `json:"readIOPS,omitempty"`
+	// WriteIOPS is the maximum number of write operations per second
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	WriteIOPS *int64 `json:"writeIOPS,omitempty"`
+	// TotalBandwidth is the maximum number of bytes read and written per second
+	// +optional
+	TotalBandwidth *resource.Quantity `json:"totalBandwidth,omitempty"`
+	// ReadBandwidth is the maximum number of bytes read per second
+	// +optional
+	ReadBandwidth *resource.Quantity `json:"readBandwidth,omitempty"`
+	// WriteBandwidth is the maximum number of bytes written per second
+	// +optional
+	WriteBandwidth *resource.Quantity `json:"writeBandwidth,omitempty"`
+}
+
+// DiskIOThrottle is the effective form of DiskIOLimits, in the terms of QEMU's block throttling.
+// Zero is unlimited.
+//
+// +kubebuilder:object:generate=false
+type DiskIOThrottle struct {
+	IOPSTotal int64
+	IOPSRead  int64
+	IOPSWrite int64
+	BPSTotal  int64
+	BPSRead   int64
+	BPSWrite  int64
+}
+
+// Throttle returns the QEMU throttling for the limits, which may be nil
+func (l *DiskIOLimits) Throttle() DiskIOThrottle {
+	if l == nil {
+		return DiskIOThrottle{}
+	}
+	iops := func(v *int64) int64 {
+		if v == nil {
+			return 0
+		}
+		return *v
+	}
+	bps := func(q *resource.Quantity) int64 {
+		if q == nil {
+			return 0
+		}
+		return q.Value()
+	}
+	return DiskIOThrottle{
+		IOPSTotal: iops(l.TotalIOPS),
+		IOPSRead:  iops(l.ReadIOPS),
+		IOPSWrite: iops(l.WriteIOPS),
+		BPSTotal:  bps(l.TotalBandwidth),
+		BPSRead:   bps(l.ReadBandwidth),
+		BPSWrite:  bps(l.WriteBandwidth),
+	}
+}
+
+// RootDiskDriveName is the name of the root disk's QEMU drive. Other disks' drives are named after
+// the disk.
+const RootDiskDriveName = "rootdisk"
+
+// DiskIOLimits returns the I/O limits of each of the VM's disks that has them, by the name of its
+// QEMU drive
+func (spec *VirtualMachineSpec) DiskIOLimits() map[string]DiskIOLimits {
+	limits := make(map[string]DiskIOLimits)
+	if spec.Guest.RootDisk.IOLimits != nil {
+		limits[RootDiskDriveName] = *spec.Guest.RootDisk.IOLimits.DeepCopy()
+	}
+	for _, disk := range spec.Disks {
+		if disk.IOLimits != nil {
+			limits[disk.Name] = *disk.IOLimits.DeepCopy()
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return limits
+}
+
 type ExtraNetwork struct {
 	// Enable extra network interface
 	// +kubebuilder:default:=false
@@ -516,10 +1599,30 @@ type VirtualMachineStatus struct {
 	// Number of times the VM runner pod has been recreated
 	// +optional
 	RestartCount int32 `json:"restartCount"`
+	// ConsecutiveRestarts is the number of times in a row that the VM was restarted without the
+	// guest staying up for long enough in between. Restarts are delayed by an exponential backoff
+	// based on it.
+	// +optional
+	ConsecutiveRestarts int32 `json:"consecutiveRestarts,omitempty"`
+	// NextRestartTime is when the VM will be restarted, while it's waiting out its restart backoff.
+	// +optional
+	NextRestartTime *metav1.Time `json:"nextRestartTime,omitempty"`
 	// +optional
 	PodName string `json:"podName,omitempty"`
 	// +optional
 	PodIP string `json:"podIP,omitempty"`
+	// LastShutdown records how the guest last shut down, if it has: either Graceful, if it powered
+	// off after an ACPI powerdown request, or Forced, if QEMU was killed because it didn't power off
+	// within .spec.terminationGracePeriodSeconds.
+	// +optional
+	LastShutdown VmShutdownKind `json:"lastShutdown,omitempty"`
+	// ConsoleURL is where the runner pod serves the most recent output from the guest's serial
+	// console, including its boot logs. Add '?follow=true' to stream new output.
+	//
+	// If the controller is configured with a QMP auth token, requests must include it as
+	// 'Authorization: Bearer <token>'.
+	// +optional
+	ConsoleURL string `json:"consoleURL,omitempty"`
 	// +optional
 	ExtraNetIP string `json:"extraNetIP,omitempty"`
 	// +optional
@@ -528,14 +1631,135 @@ type VirtualMachineStatus struct {
 	Node string `json:"node,omitempty"`
 	// +optional
 	CPUs *MilliCPU `json:"cpus,omitempty"`
+	// CPUBurst is the state of CPU bursting, as reported by neonvm-runner, if the VM has
+	// .spec.guest.cpuBurst set.
+	// +optional
+	CPUBurst *CPUBurstStatus `json:"cpuBurst,omitempty"`
+	// CPUScalingMode is the CPU scaling mode that the VM's current runner pod was started with.
+	// +optional
+	CPUScalingMode *CPUScalingMode `json:"cpuScalingMode,omitempty"`
 	// +optional
 	MemorySize *resource.Quantity `json:"memorySize,omitempty"`
 	// +optional
 	MemoryProvider *MemoryProvider `json:"memoryProvider,omitempty"`
+	// SwapSize is the size that the VM's swap was last resized to, if its swap is proportional to
+	// memory.
+	// +optional
+	SwapSize *resource.Quantity `json:"swapSize,omitempty"`
+	// HotplugDisks are the names of the hotpluggable disks that are currently attached to the VM.
+	// +optional
+	HotplugDisks []string `json:"hotplugDisks,omitempty"`
+	// DiskIOLimits are the I/O limits currently applied to each of the VM's disks, by the name of
+	// its QEMU drive ("rootdisk" for the root disk). Disks without limits aren't included.
+	// +optional
+	DiskIOLimits map[string]DiskIOLimits `json:"diskIOLimits,omitempty"`
+	// TimeSync is the state of synchronizing the guest's clock, which falls behind while the guest
+	// is paused or being live migrated.
+	// +optional
+	TimeSync *TimeSyncStatus `json:"timeSync,omitempty"`
+	// ImageMetadata is the metadata that vm-builder embedded in the root disk image, as reported
+	// by the runner pod. It's unset if the image doesn't have any.
+	// +optional
+	ImageMetadata *VMImageMetadata `json:"imageMetadata,omitempty"`
 	// +optional
 	SSHSecretName string `json:"sshSecretName,omitempty"`
 }
 
+type CPUBurstStatus struct {
+	// Active is true if the VM is currently bursting above .spec.guest.cpus.use
+	Active bool `json:"active"`
+	// MilliCPUSecondsTotal is the total CPU allowed above .spec.guest.cpus.use while bursting,
+	// integrated over time, since the runner pod started. It resets when the runner pod is
+	// recreated.
+	MilliCPUSecondsTotal int64 `json:"milliCPUSecondsTotal"`
+}
+
+// TimeSyncStatus is the state of synchronizing the guest's clock after it was resumed or live
+// migrated
+type TimeSyncStatus struct {
+	// PendingSince is when the guest was resumed or live migrated, if its clock hasn't been
+	// synchronized since then.
+	// +optional
+	PendingSince *metav1.Time `json:"pendingSince,omitempty"`
+	// LastSyncTime is when the guest's clock was last synchronized.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// Method is how the guest's clock was last synchronized.
+	// +optional
+	Method TimeSyncMethod `json:"method,omitempty"`
+}
+
+// TimeSyncMethod is how neonvm-runner synchronizes the guest's clock
+//
+// +kubebuilder:validation:Enum=GuestAgent;NTP
+type TimeSyncMethod string
+
+const (
+	// TimeSyncMethodGuestAgent sets the guest's clock to the host's with the QEMU guest agent's
+	// guest-set-time command. It's used for UEFI VMs with .spec.guest.enableGuestAgent.
+	TimeSyncMethodGuestAgent TimeSyncMethod = "GuestAgent"
+	// TimeSyncMethodNTP tells the guest's chronyd to step its clock to its time source (the host's
+	// clock, via the KVM PTP device), over SSH. It's used for VMs with .spec.enableSSH.
+	TimeSyncMethodNTP TimeSyncMethod = "NTP"
+)
+
+// TimeSyncMethod returns how the guest's clock can be synchronized, or nil if it can't be
+func (spec *VirtualMachineSpec) TimeSyncMethod() *TimeSyncMethod {
+	if spec.Guest.BootMethod == BootMethodUEFI {
+		if spec.Guest.EnableGuestAgent != nil && *spec.Guest.EnableGuestAgent {
+			return lo.ToPtr(TimeSyncMethodGuestAgent)
+		}
+		return nil
+	}
+	if spec.EnableSSH != nil && *spec.EnableSSH {
+		return lo.ToPtr(TimeSyncMethodNTP)
+	}
+	return nil
+}
+
+// VMImageMetadata describes how a root disk image was built. vm-builder embeds it in the images it
+// builds, at VMImageMetadataPath and in the VMImageMetadataLabel label.
+type VMImageMetadata struct {
+	// BuilderVersion is the version of vm-builder that built the image.
+	// +optional
+	BuilderVersion string `json:"builderVersion,omitempty"`
+	// BaseImage is the source image that the VM image was built from.
+	// +optional
+	BaseImage string `json:"baseImage,omitempty"`
+	// BaseImageDigest is the digest of BaseImage when the VM image was built.
+	// +optional
+	BaseImageDigest string `json:"baseImageDigest,omitempty"`
+	// Platform is the platform that the image was built for.
+	// +optional
+	Platform *RootDiskPlatform `json:"platform,omitempty"`
+	// KernelVersion is the version of the guest kernel that the image was built for, e.g. 6.1.92.
+	// +optional
+	KernelVersion string `json:"kernelVersion,omitempty"`
+	// MemorySlotSize is the memory slot size that the image was built for.
+	// +optional
+	MemorySlotSize *resource.Quantity `json:"memorySlotSize,omitempty"`
+	// Components are the versions of the agents and tools built into the image, by name.
+	// +optional
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// ParseKernelVersion returns the major and minor version from a kernel version like "6.1.92" or
+// "5.15.0-neon"
+func ParseKernelVersion(version string) (major, minor int, _ error) {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid kernel version %q: expected <major>.<minor>[.<patch>]", version)
+	}
+	// Allow suffixes on the minor version when there's no patch version, e.g. "6.1-rc1"
+	minorStr, _, _ := strings.Cut(parts[1], "-")
+	major, errMajor := strconv.Atoi(parts[0])
+	minor, errMinor := strconv.Atoi(minorStr)
+	if errMajor != nil || errMinor != nil || major < 0 || minor < 0 {
+		return 0, 0, fmt.Errorf("invalid kernel version %q: expected <major>.<minor>[.<patch>]", version)
+	}
+	return major, minor, nil
+}
+
 type VmPhase string
 
 const (
@@ -557,6 +1781,51 @@ const (
 	VmMigrating VmPhase = "Migrating"
 	// VmScaling means that devices are plugging/unplugging to/from the VM
 	VmScaling VmPhase = "Scaling"
+	// VmPaused means that the guest's CPUs have been stopped because of .spec.runPolicy, but the
+	// runner pod is still running.
+	VmPaused VmPhase = "Paused"
+)
+
+// Types of the conditions in VirtualMachineStatus.Conditions that are maintained by the controller
+// alongside .status.phase, so that tooling can wait on them - e.g. with
+// 'kubectl wait --for=condition=GuestBooted'.
+const (
+	// VmConditionScheduled is True once the runner pod has been assigned to a node.
+	VmConditionScheduled = "Scheduled"
+	// VmConditionGuestBooted is True once the guest's init has finished, as reported by
+	// neonvm-runner.
+	VmConditionGuestBooted = "GuestBooted"
+	// VmConditionAgentConnected is True while the autoscaler-agent is connected to the vm-monitor
+	// in the guest, as reported by the agent with VirtualMachineAgentConnectedAnnotation.
+	VmConditionAgentConnected = "AgentConnected"
+	// VmConditionScaling is True while the VM's CPUs or memory are being changed.
+	VmConditionScaling = "Scaling"
+	// VmConditionMigrationInProgress is True while the VM is being live-migrated to another node.
+	VmConditionMigrationInProgress = "MigrationInProgress"
+	// VmConditionAutoscalingEnabled is True while autoscaling is in effect for the VM. If
+	// autoscaling is paused via .spec.autoscaling.pause, the message gives the reason.
+	VmConditionAutoscalingEnabled = "AutoscalingEnabled"
+	// VmConditionCrashLoopBackOff is True while the VM keeps stopping soon after it's restarted,
+	// so that its restarts are being delayed by a long backoff.
+	VmConditionCrashLoopBackOff = "CrashLoopBackOff"
+	// VmConditionImageCompatible is False if the metadata embedded in the root disk image by
+	// vm-builder shows that it's incompatible with the VM, e.g. because its kernel is too old for
+	// virtio-mem. It's Unknown if the image has no metadata.
+	VmConditionImageCompatible = "ImageCompatible"
+)
+
+// VmShutdownKind describes how the guest last shut down. See VirtualMachineStatus.LastShutdown.
+//
+// +kubebuilder:validation:Enum=Graceful;Forced
+type VmShutdownKind string
+
+const (
+	// VmShutdownGraceful means that the guest powered off by itself after an ACPI powerdown
+	// request.
+	VmShutdownGraceful VmShutdownKind = "Graceful"
+	// VmShutdownForced means that the guest didn't power off within
+	// .spec.terminationGracePeriodSeconds, so neonvm-runner killed QEMU.
+	VmShutdownForced VmShutdownKind = "Forced"
 )
 
 // IsAlive returns whether the guest in the VM is expected to be running
@@ -597,8 +1866,12 @@ func (vm *VirtualMachine) Cleanup() {
 	vm.Status.PodIP = ""
 	vm.Status.Node = ""
 	vm.Status.CPUs = nil
+	vm.Status.CPUScalingMode = nil
 	vm.Status.MemorySize = nil
 	vm.Status.MemoryProvider = nil
+	vm.Status.SwapSize = nil
+	vm.Status.HotplugDisks = nil
+	vm.Status.DiskIOLimits = nil
 }
 
 func (vm *VirtualMachine) HasRestarted() bool {
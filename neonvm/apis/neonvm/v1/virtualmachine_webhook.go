@@ -17,19 +17,79 @@ limitations under the License.
 package v1
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"net/url"
 	"reflect"
 	"slices"
+	"strings"
+	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
+// webhookReader is used by the VirtualMachine webhook to look up other objects referenced by the
+// VM, like the VirtualMachineSnapshot in .spec.restoreFrom. It's set by SetupWebhookWithManager.
+//
+// If nil, checks that require looking up other objects are skipped.
+var webhookReader client.Reader
+
+// webhookCheckDiskReferences, if true, makes the VirtualMachine webhook warn about disks that
+// reference objects that don't exist. It's set by SetWebhookCheckDiskReferences.
+var webhookCheckDiskReferences bool
+
+// SetWebhookCheckDiskReferences sets whether the VirtualMachine webhook checks that the
+// ConfigMaps, Secrets, and VolumeSnapshots referenced by new VMs' disks exist. Missing objects are
+// reported as admission warnings, not errors, because they may be created after the VM.
+//
+// It must be called before SetupWebhookWithManager.
+func SetWebhookCheckDiskReferences(enabled bool) {
+	webhookCheckDiskReferences = enabled
+}
+
+// PodResourcesOverhead gives the resources that the runner pod needs on top of the guest's
+// maximum CPU and memory, for QEMU and neonvm-runner itself.
+//
+// +kubebuilder:object:generate=false
+type PodResourcesOverhead struct {
+	// MemoryFixed is a fixed amount of memory added to the guest's maximum.
+	MemoryFixed resource.Quantity
+	// MemoryFraction is the fraction of the guest's maximum memory added on top of it, e.g. for
+	// QEMU's page tables.
+	MemoryFraction float64
+	// CPUFixed is a fixed amount of CPU added to the guest's maximum.
+	CPUFixed resource.Quantity
+}
+
+// webhookPodResourcesOverhead, if not nil, makes the VirtualMachine webhook check that the limits
+// in .spec.podResources are enough for the guest at its maximum size. It's set by
+// SetWebhookPodResourcesOverhead.
+var webhookPodResourcesOverhead *PodResourcesOverhead
+
+// SetWebhookPodResourcesOverhead makes the VirtualMachine webhook reject new VMs with
+// .spec.podResources limits below the guest's maximum CPU or memory plus the overhead, which would
+// otherwise get QEMU throttled or OOM-killed when the VM is scaled up.
+//
+// It must be called before SetupWebhookWithManager.
+func SetWebhookPodResourcesOverhead(overhead PodResourcesOverhead) {
+	webhookPodResourcesOverhead = &overhead
+}
+
 func (r *VirtualMachine) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	webhookReader = mgr.GetAPIReader()
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -44,44 +104,137 @@ func (r *VirtualMachine) Default() {
 	// Nothing to do.
 }
 
-//+kubebuilder:webhook:path=/validate-vm-neon-tech-v1-virtualmachine,mutating=false,failurePolicy=fail,sideEffects=None,groups=vm.neon.tech,resources=virtualmachines,verbs=create;update,versions=v1,name=vvirtualmachine.kb.io,admissionReviewVersions=v1
+//+kubebuilder:webhook:path=/validate-vm-neon-tech-v1-virtualmachine,mutating=false,failurePolicy=fail,sideEffects=None,groups=vm.neon.tech,resources=virtualmachines,verbs=create;update;delete,versions=v1,name=vvirtualmachine.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &VirtualMachine{}
 
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (r *VirtualMachine) ValidateCreate() (admission.Warnings, error) {
-	// validate .spec.guest.cpus.use and .spec.guest.cpus.max
-	if r.Spec.Guest.CPUs.Use < r.Spec.Guest.CPUs.Min {
-		return nil, fmt.Errorf(".spec.guest.cpus.use (%v) should be greater than or equal to the .spec.guest.cpus.min (%v)",
-			r.Spec.Guest.CPUs.Use,
-			r.Spec.Guest.CPUs.Min)
-	}
-	if r.Spec.Guest.CPUs.Use > r.Spec.Guest.CPUs.Max {
-		return nil, fmt.Errorf(".spec.guest.cpus.use (%v) should be less than or equal to the .spec.guest.cpus.max (%v)",
-			r.Spec.Guest.CPUs.Use,
-			r.Spec.Guest.CPUs.Max)
-	}
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	guestPath := specPath.Child("guest")
+
+	allErrs = append(allErrs, r.validateScalingBounds()...)
 
 	// validate .spec.guest.memorySlotSize w.r.t. .spec.guest.memoryProvider
 	if r.Spec.Guest.MemoryProvider != nil {
 		if err := r.Spec.Guest.ValidateForMemoryProvider(*r.Spec.Guest.MemoryProvider); err != nil {
-			return nil, fmt.Errorf(".spec.guest: %w", err)
+			allErrs = append(allErrs, field.Invalid(guestPath.Child("memorySlotSize"), r.Spec.Guest.MemorySlotSize.String(), err.Error()))
 		}
 	}
 
-	// validate .spec.guest.memorySlots.use and .spec.guest.memorySlots.max
-	if r.Spec.Guest.MemorySlots.Use < r.Spec.Guest.MemorySlots.Min {
-		return nil, fmt.Errorf(".spec.guest.memorySlots.use (%d) should be greater than or equal to the .spec.guest.memorySlots.min (%d)",
-			r.Spec.Guest.MemorySlots.Use,
-			r.Spec.Guest.MemorySlots.Min)
+	// validate .spec.guest.bootMethod
+	allErrs = append(allErrs, r.validateBootMethod()...)
+
+	// validate .spec.guest.kernelCmdline
+	allErrs = append(allErrs, r.validateKernelCmdline()...)
+
+	// validate .spec.enableConfidentialCompute
+	allErrs = append(allErrs, r.validateConfidentialCompute()...)
+
+	// validate .spec.guest.cpuScalingMode
+	allErrs = append(allErrs, r.validateCPUScalingMode()...)
+
+	// validate .spec.guest.rootDisk.streaming
+	if streaming := r.Spec.Guest.RootDisk.Streaming; streaming != nil {
+		urlPath := guestPath.Child("rootDisk", "streaming", "url")
+		u, err := url.Parse(streaming.URL)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(urlPath, streaming.URL, err.Error()))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			allErrs = append(allErrs, field.Invalid(urlPath, streaming.URL, fmt.Sprintf("scheme must be http or https, got %q", u.Scheme)))
+		}
 	}
-	if r.Spec.Guest.MemorySlots.Use > r.Spec.Guest.MemorySlots.Max {
-		return nil, fmt.Errorf(".spec.guest.memorySlots.use (%d) should be less than or equal to the .spec.guest.memorySlots.max (%d)",
-			r.Spec.Guest.MemorySlots.Use,
-			r.Spec.Guest.MemorySlots.Max)
+
+	// validate .spec.guest.rootDisk.baseImageCache
+	allErrs = append(allErrs, r.validateBaseImageCache()...)
+
+	// validate .spec.guest.rootDisk.compression
+	if r.Spec.Guest.RootDisk.ImageCompressed() && r.Spec.Guest.RootDisk.Streaming != nil {
+		allErrs = append(allErrs, field.Forbidden(guestPath.Child("rootDisk", "compression"), "cannot be used with .spec.guest.rootDisk.streaming"))
+	}
+
+	// validate .spec.guest.rootDisk.ioLimits
+	allErrs = append(allErrs, validateIOLimits(guestPath.Child("rootDisk", "ioLimits"), r.Spec.Guest.RootDisk.IOLimits)...)
+
+	// validate .spec.restoreFrom
+	if r.Spec.RestoreFrom != nil {
+		if r.Spec.Guest.RootDisk.Streaming != nil {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("rootDisk", "streaming"), "cannot be used with .spec.restoreFrom"))
+		}
+		if r.Spec.Guest.RootDisk.BaseImageCache != nil {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("rootDisk", "baseImageCache"), "cannot be used with .spec.restoreFrom"))
+		}
+		allErrs = append(allErrs, r.validateRestoreFrom()...)
+	}
+
+	// validate .spec.cloneFrom
+	if r.Spec.CloneFrom != nil {
+		if r.Spec.Guest.RootDisk.Streaming != nil {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("rootDisk", "streaming"), "cannot be used with .spec.cloneFrom"))
+		}
+		if r.Spec.Guest.RootDisk.BaseImageCache != nil {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("rootDisk", "baseImageCache"), "cannot be used with .spec.cloneFrom"))
+		}
+		allErrs = append(allErrs, r.validateCloneFrom()...)
+	}
+
+	// validate .spec.disks
+	allErrs = append(allErrs, r.validateDisks()...)
+
+	// validate .spec.guest.ports
+	allErrs = append(allErrs, r.validatePorts()...)
+
+	// validate .spec.extraContainers
+	allErrs = append(allErrs, r.validateExtraContainers()...)
+
+	// validate .spec.guest.readinessProbe
+	allErrs = append(allErrs, r.validateReadinessProbe()...)
+
+	// validate .spec.guest.network
+	allErrs = append(allErrs, r.validateGuestNetwork()...)
+
+	// validate .spec.guest.devices
+	allErrs = append(allErrs, r.validateDevices()...)
+
+	// validate .spec.guest.cloudInit
+	allErrs = append(allErrs, r.validateCloudInit()...)
+
+	// validate .spec.guest.memoryBacking and .spec.guest.hugepageSize
+	allErrs = append(allErrs, r.validateMemoryBacking()...)
+
+	// validate .spec.ipFamilies
+	allErrs = append(allErrs, r.validateIPFamilies()...)
+
+	// validate .spec.podResources
+	allErrs = append(allErrs, r.validatePodResources()...)
+
+	// validate against the cluster's VirtualMachinePolicy
+	allErrs = append(allErrs, r.validatePolicy()...)
+
+	// validate that at most one type of swap is provided:
+	if settings := r.Spec.Guest.Settings; settings != nil {
+		if settings.Swap != nil && settings.SwapInfo != nil {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("settings", "swap"), "cannot have both 'swap' and 'swapInfo' enabled"))
+		}
+		if settings.SwapInfo != nil {
+			allErrs = append(allErrs, validateSwapPolicy(*settings.SwapInfo)...)
+		}
 	}
 
-	// validate .spec.disk names
+	warnings := r.warnings()
+	if webhookCheckDiskReferences {
+		warnings = append(warnings, r.diskReferenceWarnings()...)
+	}
+
+	return warnings, r.toAggregate(allErrs)
+}
+
+// validateDisks validates .spec.disks
+func (r *VirtualMachine) validateDisks() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
 	reservedDiskNames := []string{
 		"virtualmachineimages",
 		"rootdisk",
@@ -92,35 +245,942 @@ func (r *VirtualMachine) ValidateCreate() (admission.Warnings, error) {
 		"ssh-privatekey",
 		"ssh-publickey",
 		"ssh-authorized-keys",
+		"restore-snapshot",
+		"rootdisk-base-images",
 	}
-	for _, disk := range r.Spec.Disks {
+	diskSerials := make(map[string]string)
+	for i, disk := range r.Spec.Disks {
+		namePath := specPath.Child("disks").Index(i).Child("name")
 		if slices.Contains(reservedDiskNames, disk.Name) {
-			return nil, fmt.Errorf("'%s' is reserved for .spec.disks[].name", disk.Name)
+			allErrs = append(allErrs, field.Invalid(namePath, disk.Name, "name is reserved"))
 		}
 		if len(disk.Name) > 32 {
-			return nil, fmt.Errorf("disk name '%s' too long, should be less than or equal to 32", disk.Name)
+			allErrs = append(allErrs, field.TooLongMaxLength(namePath, disk.Name, 32))
+		}
+		// Disk names are used for the virtio serial number and the guest's /dev/disk/by-id
+		// symlinks, so they must be safe to use in both.
+		for _, msg := range validation.IsDNS1123Label(disk.Name) {
+			allErrs = append(allErrs, field.Invalid(namePath, disk.Name, msg))
+		}
+		serial := DiskSerial(disk.Name)
+		if other, ok := diskSerials[serial]; ok && other == disk.Name {
+			allErrs = append(allErrs, field.Duplicate(namePath, disk.Name))
+		} else if ok {
+			allErrs = append(allErrs, field.Invalid(namePath, disk.Name, fmt.Sprintf("virtio serial %q conflicts with disk %q", serial, other)))
+		}
+		diskSerials[serial] = disk.Name
+		if disk.Hotpluggable {
+			allErrs = append(allErrs, validateHotpluggableDisk(specPath.Child("disks").Index(i), disk)...)
+		}
+		if disk.IOLimits != nil {
+			ioLimitsPath := specPath.Child("disks").Index(i).Child("ioLimits")
+			if disk.EmptyDisk == nil && disk.VolumeSnapshot == nil {
+				allErrs = append(allErrs, field.Forbidden(ioLimitsPath, "only emptyDisk and volumeSnapshot disks can have I/O limits"))
+			}
+			allErrs = append(allErrs, validateIOLimits(ioLimitsPath, disk.IOLimits)...)
+		}
+		if disk.VolumeSnapshot != nil {
+			// VolumeSnapshot disks are found in the guest by their virtio serial number, which
+			// is limited to 20 characters.
+			if len(disk.Name) > 20 {
+				allErrs = append(allErrs, field.TooLongMaxLength(namePath, disk.Name, 20))
+			}
+			if disk.VolumeSnapshot.Size.Sign() <= 0 {
+				sizePath := specPath.Child("disks").Index(i).Child("volumeSnapshot", "size")
+				allErrs = append(allErrs, field.Invalid(sizePath, disk.VolumeSnapshot.Size.String(), "must be greater than zero"))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateHotpluggableDisk validates a disk with .hotpluggable set
+func validateHotpluggableDisk(path *field.Path, disk Disk) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if disk.EmptyDisk == nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("hotpluggable"), disk.Hotpluggable, "only emptyDisk disks can be hotpluggable"))
+	}
+	// The disk's name is used as the name of its QEMU block node, which must start with a letter.
+	if disk.Name != "" && (disk.Name[0] < 'a' || disk.Name[0] > 'z') {
+		allErrs = append(allErrs, field.Invalid(path.Child("name"), disk.Name, "names of hotpluggable disks must start with a letter"))
+	}
+	// Hotplugged disks are found in the guest by their virtio serial number, which is limited to 20
+	// characters.
+	if len(disk.Name) > MaxDiskSerialLength {
+		allErrs = append(allErrs, field.TooLongMaxLength(path.Child("name"), disk.Name, MaxDiskSerialLength))
+	}
+	// The guest gets the mount path of a hotplugged disk from its filesystem's "last mounted on"
+	// field, which has room for 63 bytes.
+	if len(disk.MountPath) > MaxHotpluggableDiskMountPathLength {
+		allErrs = append(allErrs, field.TooLongMaxLength(path.Child("mountPath"), disk.MountPath, MaxHotpluggableDiskMountPathLength))
+	}
+	if !strings.HasPrefix(disk.MountPath, "/") {
+		allErrs = append(allErrs, field.Invalid(path.Child("mountPath"), disk.MountPath, "must be an absolute path"))
+	}
+
+	return allErrs
+}
+
+// validateIOLimits validates the I/O limits of a disk, which may be nil
+func validateIOLimits(path *field.Path, limits *DiskIOLimits) field.ErrorList {
+	var allErrs field.ErrorList
+	if limits == nil {
+		return nil
+	}
+
+	// QEMU doesn't allow a total limit together with a read or write limit of the same kind.
+	if limits.TotalIOPS != nil && (limits.ReadIOPS != nil || limits.WriteIOPS != nil) {
+		allErrs = append(allErrs, field.Forbidden(path.Child("totalIOPS"), "cannot be used with readIOPS or writeIOPS"))
+	}
+	if limits.TotalBandwidth != nil && (limits.ReadBandwidth != nil || limits.WriteBandwidth != nil) {
+		allErrs = append(allErrs, field.Forbidden(path.Child("totalBandwidth"), "cannot be used with readBandwidth or writeBandwidth"))
+	}
+
+	for _, bw := range []struct {
+		name  string
+		value *resource.Quantity
+	}{
+		{"totalBandwidth", limits.TotalBandwidth},
+		{"readBandwidth", limits.ReadBandwidth},
+		{"writeBandwidth", limits.WriteBandwidth},
+	} {
+		if bw.value != nil && bw.value.Value() <= 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child(bw.name), bw.value.String(), "must be greater than zero"))
+		}
+	}
+
+	return allErrs
+}
+
+// withoutIOLimits returns the disk without its I/O limits, which can be changed while the VM is
+// running
+func (d Disk) withoutIOLimits() Disk {
+	d.IOLimits = nil
+	return d
+}
+
+// validateDiskChanges checks that only hotpluggable disks were added to or removed from
+// .spec.disks, and that no disk was otherwise changed, except for its I/O limits.
+func (r *VirtualMachine) validateDiskChanges(before *VirtualMachine) field.ErrorList {
+	var allErrs field.ErrorList
+	disksPath := field.NewPath("spec", "disks")
+
+	withoutHotpluggable := func(disks []Disk) []Disk {
+		return slices.DeleteFunc(slices.Clone(disks), func(d Disk) bool { return d.Hotpluggable })
+	}
+	if !slices.EqualFunc(withoutHotpluggable(r.Spec.Disks), withoutHotpluggable(before.Spec.Disks), func(a, b Disk) bool {
+		return reflect.DeepEqual(a.withoutIOLimits(), b.withoutIOLimits())
+	}) {
+		allErrs = append(allErrs, field.Forbidden(disksPath, "only hotpluggable disks may be added or removed"))
+	}
+	for i, disk := range r.Spec.Disks {
+		j := slices.IndexFunc(before.Spec.Disks, func(d Disk) bool { return d.Name == disk.Name })
+		if j != -1 && !reflect.DeepEqual(disk.withoutIOLimits(), before.Spec.Disks[j].withoutIOLimits()) {
+			allErrs = append(allErrs, field.Forbidden(disksPath.Index(i), "disks cannot be changed"))
+		}
+	}
+	if len(allErrs) != 0 {
+		return allErrs
+	}
+
+	// Check that the new disks are valid.
+	return r.validateDisks()
+}
+
+// volumeSnapshotGVK is the GroupVersionKind of CSI VolumeSnapshots. We use unstructured objects for
+// them, to avoid depending on the external-snapshotter client.
+var volumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   "snapshot.storage.k8s.io",
+	Version: "v1",
+	Kind:    "VolumeSnapshot",
+}
+
+// diskReferenceWarnings returns admission warnings for each of the VM's disks that references a
+// ConfigMap, Secret, or VolumeSnapshot that doesn't exist.
+func (r *VirtualMachine) diskReferenceWarnings() admission.Warnings {
+	if webhookReader == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var warnings admission.Warnings
+	for i, disk := range r.Spec.Disks {
+		path := field.NewPath("spec", "disks").Index(i)
+
+		var kind, name string
+		var obj client.Object
+		switch {
+		case disk.ConfigMap != nil && (disk.ConfigMap.Optional == nil || !*disk.ConfigMap.Optional):
+			kind, name = "ConfigMap", disk.ConfigMap.Name
+			path = path.Child("configMap", "name")
+			obj = &corev1.ConfigMap{}
+		case disk.Secret != nil && (disk.Secret.Optional == nil || !*disk.Secret.Optional):
+			kind, name = "Secret", disk.Secret.SecretName
+			path = path.Child("secret", "secretName")
+			obj = &corev1.Secret{}
+		case disk.VolumeSnapshot != nil:
+			kind, name = "VolumeSnapshot", disk.VolumeSnapshot.SnapshotName
+			path = path.Child("volumeSnapshot", "snapshotName")
+			snapshot := &unstructured.Unstructured{}
+			snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+			obj = snapshot
+		default:
+			continue
+		}
+
+		key := types.NamespacedName{Namespace: r.Namespace, Name: name}
+		if err := webhookReader.Get(ctx, key, obj); err != nil {
+			if apierrors.IsNotFound(err) {
+				warnings = append(warnings, fmt.Sprintf("%s: %s %q not found", path, kind, name))
+			} else {
+				warnings = append(warnings, fmt.Sprintf("%s: could not check that %s %q exists: %s", path, kind, name, err))
+			}
+		}
+	}
+
+	return warnings
+}
+
+// validatePodResources checks that the requests in .spec.podResources are not above the limits
+// and, if configured with SetWebhookPodResourcesOverhead, that the limits leave room for the guest
+// at its maximum size.
+func (r *VirtualMachine) validatePodResources() field.ErrorList {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "podResources")
+	res := r.Spec.PodResources
+
+	for name, request := range res.Requests {
+		if limit, ok := res.Limits[name]; ok && request.Cmp(limit) > 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("requests").Key(string(name)), request.String(),
+				fmt.Sprintf("must be less than or equal to %s limit of %s", name, limit.String())))
+		}
+	}
+
+	overhead := webhookPodResourcesOverhead
+	if overhead == nil {
+		return allErrs
+	}
+
+	if limit, ok := res.Limits[corev1.ResourceMemory]; ok {
+		maxMemory := r.Spec.Guest.MemorySlotSize.Value() * int64(r.Spec.Guest.MemorySlots.Max)
+		overheadMemory := int64(float64(maxMemory)*overhead.MemoryFraction) + overhead.MemoryFixed.Value()
+		// Hugepage-backed guest memory is requested separately, so it doesn't count against the
+		// memory limit. See addHugepages in the controller.
+		if r.Spec.Guest.HugepageSizeOrNil() != nil {
+			if limit.Value() < overheadMemory {
+				allErrs = append(allErrs, field.Invalid(path.Child("limits").Key(string(corev1.ResourceMemory)), limit.String(), fmt.Sprintf(
+					"must be at least %s: %s + %g of the guest's maximum memory of %s as overhead",
+					resource.NewQuantity(overheadMemory, resource.BinarySI), overhead.MemoryFixed.String(),
+					overhead.MemoryFraction, resource.NewQuantity(maxMemory, resource.BinarySI),
+				)))
+			}
+		} else if required := maxMemory + overheadMemory; limit.Value() < required {
+			allErrs = append(allErrs, field.Invalid(path.Child("limits").Key(string(corev1.ResourceMemory)), limit.String(), fmt.Sprintf(
+				"must be at least %s: the guest's maximum memory of %s, plus %s + %g of it as overhead",
+				resource.NewQuantity(required, resource.BinarySI), resource.NewQuantity(maxMemory, resource.BinarySI),
+				overhead.MemoryFixed.String(), overhead.MemoryFraction,
+			)))
+		}
+	}
+
+	if limit, ok := res.Limits[corev1.ResourceCPU]; ok {
+		required := r.Spec.Guest.CPUs.Max.ToResourceQuantity()
+		required.Add(overhead.CPUFixed)
+		if limit.Cmp(*required) < 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("limits").Key(string(corev1.ResourceCPU)), limit.String(), fmt.Sprintf(
+				"must be at least %s: the guest's maximum CPU of %v, plus %s as overhead",
+				required.String(), r.Spec.Guest.CPUs.Max, overhead.CPUFixed.String(),
+			)))
+		}
+	}
+
+	return allErrs
+}
+
+// validateScalingBounds checks that each .use is within the bounds given by .min and .max, and
+// likewise for .cpuBurst.limit
+func (r *VirtualMachine) validateScalingBounds() field.ErrorList {
+	var allErrs field.ErrorList
+	guestPath := field.NewPath("spec", "guest")
+
+	cpus := r.Spec.Guest.CPUs
+	if cpus.Use < cpus.Min {
+		allErrs = append(allErrs, field.Invalid(guestPath.Child("cpus", "use"), cpus.Use,
+			fmt.Sprintf("should be greater than or equal to .spec.guest.cpus.min (%v)", cpus.Min)))
+	}
+	if cpus.Use > cpus.Max {
+		allErrs = append(allErrs, field.Invalid(guestPath.Child("cpus", "use"), cpus.Use,
+			fmt.Sprintf("should be less than or equal to .spec.guest.cpus.max (%v)", cpus.Max)))
+	}
+	if burst := r.Spec.Guest.CPUBurst; burst != nil {
+		burstPath := guestPath.Child("cpuBurst")
+		if burst.Limit < cpus.Min || burst.Limit > cpus.Max {
+			allErrs = append(allErrs, field.Invalid(burstPath.Child("limit"), burst.Limit,
+				fmt.Sprintf("should be between .spec.guest.cpus.min (%v) and .spec.guest.cpus.max (%v)", cpus.Min, cpus.Max)))
+		}
+		if burst.MaxDurationSeconds <= 0 {
+			allErrs = append(allErrs, field.Invalid(burstPath.Child("maxDurationSeconds"), burst.MaxDurationSeconds,
+				"should be greater than zero"))
+		}
+		if burst.CooldownSeconds < 0 {
+			allErrs = append(allErrs, field.Invalid(burstPath.Child("cooldownSeconds"), burst.CooldownSeconds,
+				"should not be negative"))
+		}
+	}
+
+	slots := r.Spec.Guest.MemorySlots
+	if slots.Use < slots.Min {
+		allErrs = append(allErrs, field.Invalid(guestPath.Child("memorySlots", "use"), slots.Use,
+			fmt.Sprintf("should be greater than or equal to .spec.guest.memorySlots.min (%d)", slots.Min)))
+	}
+	if slots.Use > slots.Max {
+		allErrs = append(allErrs, field.Invalid(guestPath.Child("memorySlots", "use"), slots.Use,
+			fmt.Sprintf("should be less than or equal to .spec.guest.memorySlots.max (%d)", slots.Max)))
+	}
+
+	return allErrs
+}
+
+// validateBootMethod checks that the fields used by the guest are compatible with its boot method.
+//
+// UEFI guests boot an opaque disk image, so nothing that's passed to the guest via the kernel
+// command line or the runtime disk can be used. The guest agent channel only makes sense for them.
+func (r *VirtualMachine) validateBootMethod() field.ErrorList {
+	var allErrs field.ErrorList
+	guestPath := field.NewPath("spec", "guest")
+	guest := r.Spec.Guest
+
+	if guest.BootMethod != BootMethodUEFI {
+		if guest.EnableGuestAgent != nil && *guest.EnableGuestAgent {
+			allErrs = append(allErrs, field.Forbidden(guestPath.Child("enableGuestAgent"), "only supported with bootMethod UEFI"))
+		}
+		return allErrs
+	}
+
+	forbidden := []struct {
+		path *field.Path
+		set  bool
+	}{
+		{guestPath.Child("kernelImage"), guest.KernelImage != nil},
+		{guestPath.Child("appendKernelCmdline"), guest.AppendKernelCmdline != nil},
+		{guestPath.Child("kernelCmdline"), len(guest.KernelCmdline) != 0},
+		{guestPath.Child("command"), len(guest.Command) != 0},
+		{guestPath.Child("args"), len(guest.Args) != 0},
+		{guestPath.Child("env"), len(guest.Env) != 0},
+		{guestPath.Child("settings"), guest.Settings != nil},
+	}
+	for _, f := range forbidden {
+		if f.set {
+			allErrs = append(allErrs, field.Forbidden(f.path, "cannot be used with bootMethod UEFI"))
+		}
+	}
+	if r.Spec.RestoreFrom != nil && r.Spec.RestoreFrom.RestoreMemory {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "restoreFrom", "restoreMemory"), "cannot be used with bootMethod UEFI"))
+	}
+
+	return allErrs
+}
+
+// validateConfidentialCompute checks that confidential VMs don't use anything that relies on the
+// host being able to access the guest's memory, or on hardware that can't run them.
+func (r *VirtualMachine) validateConfidentialCompute() field.ErrorList {
+	if !r.Spec.ConfidentialCompute() {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	ccPath := field.NewPath("spec", "enableConfidentialCompute")
+
+	if r.Spec.EnableAcceleration != nil && !*r.Spec.EnableAcceleration {
+		allErrs = append(allErrs, field.Forbidden(ccPath, "requires .spec.enableAcceleration"))
+	}
+	// The guest is booted by the technology's own firmware, which can't boot from the root disk.
+	if r.Spec.Guest.BootMethod == BootMethodUEFI {
+		allErrs = append(allErrs, field.Forbidden(ccPath, "cannot be used with bootMethod UEFI"))
+	}
+	if slices.Contains(r.Spec.RequiredCapabilities, NodeCapabilityARM64) {
+		allErrs = append(allErrs, field.Forbidden(ccPath, "not supported on arm64"))
+	}
+	if r.Spec.RestoreFrom != nil && r.Spec.RestoreFrom.RestoreMemory {
+		allErrs = append(allErrs, field.Forbidden(ccPath, "cannot be used with .spec.restoreFrom.restoreMemory"))
+	}
+
+	return allErrs
+}
+
+// validateCPUScalingMode checks that .spec.guest.cpuScalingMode, if set, can be used by the VM.
+//
+// VMs that are resized by restart start with the CPUs they're using and don't scale CPUs at
+// runtime, so only QMPHotplug (the mode they're treated as using) is allowed for them.
+func (r *VirtualMachine) validateCPUScalingMode() field.ErrorList {
+	mode := r.Spec.Guest.CPUScalingMode
+	if mode == nil || *mode == CPUScalingModeQMPHotplug {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	modePath := field.NewPath("spec", "guest", "cpuScalingMode")
+
+	if r.Spec.Guest.BootMethod == BootMethodUEFI {
+		allErrs = append(allErrs, field.Forbidden(modePath, fmt.Sprintf("%s cannot be used with bootMethod UEFI", *mode)))
+	}
+	if r.Spec.ConfidentialCompute() {
+		allErrs = append(allErrs, field.Forbidden(modePath, fmt.Sprintf("%s cannot be used with .spec.enableConfidentialCompute", *mode)))
+	}
+
+	return allErrs
+}
+
+// validateReadinessProbe checks that .spec.guest.readinessProbe, if set, has exactly one handler,
+// and that it can be run against the guest.
+func (r *VirtualMachine) validateReadinessProbe() field.ErrorList {
+	probe := r.Spec.Guest.ReadinessProbe
+	if probe == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	probePath := field.NewPath("spec", "guest", "readinessProbe")
+
+	handlers := 0
+	for _, set := range []bool{probe.HTTPGet != nil, probe.TCPSocket != nil, probe.Exec != nil} {
+		if set {
+			handlers++
+		}
+	}
+	if handlers != 1 {
+		allErrs = append(allErrs, field.Invalid(probePath, handlers, "exactly one of httpGet, tcpSocket, or exec must be set"))
+	}
+
+	if probe.HTTPGet != nil && probe.HTTPGet.Path != "" && !strings.HasPrefix(probe.HTTPGet.Path, "/") {
+		allErrs = append(allErrs, field.Invalid(probePath.Child("httpGet", "path"), probe.HTTPGet.Path, "must start with '/'"))
+	}
+
+	if probe.Exec != nil {
+		execPath := probePath.Child("exec")
+		if len(probe.Exec.Command) == 0 {
+			allErrs = append(allErrs, field.Required(execPath.Child("command"), "command must not be empty"))
+		}
+		// The command is run over SSH, which isn't available with UEFI.
+		if r.Spec.EnableSSH == nil || !*r.Spec.EnableSSH {
+			allErrs = append(allErrs, field.Forbidden(execPath, "requires .spec.enableSSH"))
+		} else if r.Spec.Guest.BootMethod == BootMethodUEFI {
+			allErrs = append(allErrs, field.Forbidden(execPath, "cannot be used with bootMethod UEFI"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateDevices checks that each of .spec.guest.devices is allocated by a device plugin, and that
+// the VM doesn't use anything that can't be used with devices passed through to the guest.
+func (r *VirtualMachine) validateDevices() field.ErrorList {
+	if len(r.Spec.Guest.Devices) == 0 {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	devicesPath := field.NewPath("spec", "guest", "devices")
+
+	for i, d := range r.Spec.Guest.Devices {
+		// Device plugins advertise extended resources, which must be domain-prefixed, outside of
+		// the kubernetes.io domain.
+		resourcePath := devicesPath.Index(i).Child("resourceName")
+		name := string(d.ResourceName)
+		if errs := validation.IsQualifiedName(name); len(errs) != 0 {
+			allErrs = append(allErrs, field.Invalid(resourcePath, name, strings.Join(errs, "; ")))
+		} else if !strings.Contains(name, "/") || strings.HasPrefix(name, "kubernetes.io/") {
+			allErrs = append(allErrs, field.Invalid(resourcePath, name, "must be an extended resource, e.g. 'nvidia.com/GA100'"))
+		}
+	}
+
+	// The guest's encrypted memory can't be accessed by the devices with DMA.
+	if r.Spec.ConfidentialCompute() {
+		allErrs = append(allErrs, field.Forbidden(devicesPath, "cannot be used with .spec.enableConfidentialCompute"))
+	}
+	// QEMU can't save the state of VFIO devices.
+	if r.Spec.RestoreFrom != nil && r.Spec.RestoreFrom.RestoreMemory {
+		allErrs = append(allErrs, field.Forbidden(devicesPath, "cannot be used with .spec.restoreFrom.restoreMemory"))
+	}
+
+	return allErrs
+}
+
+// validateCloudInit checks that .spec.guest.cloudInit, if set, has exactly one source of user-data
+func (r *VirtualMachine) validateCloudInit() field.ErrorList {
+	cloudInit := r.Spec.Guest.CloudInit
+	if cloudInit == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	cloudInitPath := field.NewPath("spec", "guest", "cloudInit")
+
+	switch {
+	case cloudInit.UserData == nil && cloudInit.UserDataSecretRef == nil:
+		allErrs = append(allErrs, field.Required(cloudInitPath, "one of userData or userDataSecretRef must be set"))
+	case cloudInit.UserData != nil && cloudInit.UserDataSecretRef != nil:
+		allErrs = append(allErrs, field.Forbidden(cloudInitPath.Child("userDataSecretRef"), "cannot be set with userData"))
+	}
+
+	if ref := cloudInit.UserDataSecretRef; ref != nil {
+		refPath := cloudInitPath.Child("userDataSecretRef")
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), "name must not be empty"))
+		}
+		if ref.Key == "" {
+			allErrs = append(allErrs, field.Required(refPath.Child("key"), "key must not be empty"))
+		}
+	}
+
+	return allErrs
+}
+
+// validateMemoryBacking checks that .spec.guest.hugepageSize is only set with memoryBacking
+// hugepages, and that it's a supported size that evenly divides the memory slot size.
+func (r *VirtualMachine) validateMemoryBacking() field.ErrorList {
+	guest := r.Spec.Guest
+	guestPath := field.NewPath("spec", "guest")
+
+	size := guest.HugepageSizeOrNil()
+	if size == nil {
+		if guest.HugepageSize != nil {
+			return field.ErrorList{field.Forbidden(guestPath.Child("hugepageSize"), "can only be set with memoryBacking hugepages")}
+		}
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	supported := []string{"2Mi", "1Gi"}
+	if !slices.ContainsFunc(supported, func(s string) bool { return size.Equal(resource.MustParse(s)) }) {
+		allErrs = append(allErrs, field.NotSupported(guestPath.Child("hugepageSize"), size.String(), supported))
+	} else if guest.MemorySlotSize.Value()%size.Value() != 0 {
+		allErrs = append(allErrs, field.Invalid(guestPath.Child("memorySlotSize"), guest.MemorySlotSize.String(),
+			fmt.Sprintf("must be a multiple of hugepageSize %s", size.String())))
+	}
+
+	// Confidential guests' memory is set up by confidential.go in neonvm-runner, separately.
+	if r.Spec.ConfidentialCompute() {
+		allErrs = append(allErrs, field.Forbidden(guestPath.Child("memoryBacking"), "cannot be used with .spec.enableConfidentialCompute"))
+	}
+
+	return allErrs
+}
+
+// validateGuestNetwork checks that .spec.guest.network, if set, doesn't have more queues than the
+// guest can have CPUs to process them.
+func (r *VirtualMachine) validateGuestNetwork() field.ErrorList {
+	network := r.Spec.Guest.Network
+	if network == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	networkPath := field.NewPath("spec", "guest", "network")
+
+	// nb: queues is already checked to be at least 1 by the CRD's validation.
+	if maxCPUs := r.Spec.Guest.CPUs.Max.RoundedUp(); uint32(network.Queues) > maxCPUs {
+		allErrs = append(allErrs, field.Invalid(networkPath.Child("queues"), network.Queues, fmt.Sprintf("must not be more than .spec.guest.cpus.max (%d)", maxCPUs)))
+	}
+
+	return allErrs
+}
+
+// deniedKernelParams are the kernel command line parameters that can't be set with
+// .spec.guest.kernelCmdline, because neonvm-runner or the guest's init rely on them.
+//
+// Entries ending in '.' deny all parameters with that prefix.
+var deniedKernelParams = []string{
+	// boot and init
+	"init", "rdinit", "root", "rootfstype", "rootflags", "ro", "rw", "nfsroot", "ip",
+	// logging and crash handling
+	"console", "earlycon", "panic",
+	// memory, which must match what we hotplug
+	"mem", "memmap", "movable_node", "movablecore", "kernelcore", "memhp_default_state", "memory_hotplug.",
+	// CPUs, which must match what we hotplug
+	"maxcpus", "nr_cpus", "possible_cpus", "nosmp",
+}
+
+// validateBaseImageCache checks that .spec.guest.rootDisk.baseImageCache, if set, has exactly one
+// volume source and isn't used with streaming
+func (r *VirtualMachine) validateBaseImageCache() field.ErrorList {
+	cache := r.Spec.Guest.RootDisk.BaseImageCache
+	if cache == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	cachePath := field.NewPath("spec", "guest", "rootDisk", "baseImageCache")
+	if (cache.HostPath == nil) == (cache.PersistentVolumeClaim == nil) {
+		allErrs = append(allErrs, field.Invalid(cachePath, "", "exactly one of hostPath or persistentVolumeClaim must be set"))
+	}
+	if cache.HostPath != nil && !strings.HasPrefix(*cache.HostPath, "/") {
+		allErrs = append(allErrs, field.Invalid(cachePath.Child("hostPath"), *cache.HostPath, "must be an absolute path"))
+	}
+	if r.Spec.Guest.RootDisk.Streaming != nil {
+		allErrs = append(allErrs, field.Forbidden(cachePath, "cannot be used with .spec.guest.rootDisk.streaming"))
+	}
+	return allErrs
+}
+
+// validateKernelCmdline checks that each .spec.guest.kernelCmdline entry is a single parameter that
+// isn't denied by deniedKernelParams
+func (r *VirtualMachine) validateKernelCmdline() field.ErrorList {
+	var allErrs field.ErrorList
+	cmdlinePath := field.NewPath("spec", "guest", "kernelCmdline")
+
+	for i, param := range r.Spec.Guest.KernelCmdline {
+		path := cmdlinePath.Index(i)
+		if param == "" || strings.ContainsAny(param, " \t\n\"") {
+			allErrs = append(allErrs, field.Invalid(path, param, "must be a single parameter, without whitespace or quotes"))
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		for _, denied := range deniedKernelParams {
+			if name == denied || (strings.HasSuffix(denied, ".") && strings.HasPrefix(name, denied)) {
+				allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("kernel parameter %q is managed by NeonVM", name)))
+				break
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// validateSwapPolicy checks that .spec.guest.settings.swapInfo.memoryPercent is set iff the swap is
+// proportional to memory
+func validateSwapPolicy(swapInfo SwapInfo) field.ErrorList {
+	var allErrs field.ErrorList
+	swapPath := field.NewPath("spec", "guest", "settings", "swapInfo")
+
+	if swapInfo.IsProportional() {
+		if swapInfo.MemoryPercent == nil {
+			allErrs = append(allErrs, field.Required(swapPath.Child("memoryPercent"), "required when policy is ProportionalToMemory"))
+		}
+		// Resizing the swap enables it, so it can't be left for something else to enable.
+		if swapInfo.SkipSwapon != nil && *swapInfo.SkipSwapon {
+			allErrs = append(allErrs, field.Forbidden(swapPath.Child("skipSwapon"), "cannot be used with policy ProportionalToMemory"))
+		}
+	} else if swapInfo.MemoryPercent != nil {
+		allErrs = append(allErrs, field.Forbidden(swapPath.Child("memoryPercent"), "only allowed when policy is ProportionalToMemory"))
+	}
+
+	return allErrs
+}
+
+// validateCloneFrom checks that .spec.cloneFrom references a different VM that exists, and that
+// the snapshot of it has a valid target.
+//
+// Like restoring a snapshot's disks, cloning requires that the VM can scale at least as high as the
+// source VM is using. That's not checked here, because the source may scale before the snapshot
+// is taken.
+func (r *VirtualMachine) validateCloneFrom() field.ErrorList {
+	var allErrs field.ErrorList
+	clonePath := field.NewPath("spec", "cloneFrom")
+	cloneFrom := r.Spec.CloneFrom
+
+	if r.Spec.RestoreFrom != nil {
+		allErrs = append(allErrs, field.Forbidden(clonePath, "cannot be used with .spec.restoreFrom"))
+	}
+	allErrs = append(allErrs, validateSnapshotTarget(clonePath.Child("target"), cloneFrom.Target)...)
+
+	if cloneFrom.VMName == "" {
+		return append(allErrs, field.Required(clonePath.Child("vmName"), ""))
+	} else if cloneFrom.VMName == r.Name {
+		return append(allErrs, field.Invalid(clonePath.Child("vmName"), cloneFrom.VMName, "VM cannot be cloned from itself"))
+	}
+	if webhookReader == nil {
+		return allErrs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var source VirtualMachine
+	key := types.NamespacedName{Namespace: r.Namespace, Name: cloneFrom.VMName}
+	if err := webhookReader.Get(ctx, key, &source); err != nil {
+		if apierrors.IsNotFound(err) {
+			return append(allErrs, field.NotFound(clonePath.Child("vmName"), cloneFrom.VMName))
+		}
+		return append(allErrs, field.InternalError(clonePath.Child("vmName"), err))
+	}
+
+	// The clone boots from the source's root disk, so it must boot the same way.
+	if r.Spec.Guest.BootMethod != source.Spec.Guest.BootMethod {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "guest", "bootMethod"), r.Spec.Guest.BootMethod,
+			fmt.Sprintf("must match the source VM's bootMethod (%s)", source.Spec.Guest.BootMethod)))
+	}
+
+	return allErrs
+}
+
+// validateRestoreFrom checks that the snapshot referenced by .spec.restoreFrom exists, has
+// succeeded, and was taken with resources that are compatible with the VM.
+//
+// Restoring only the disks requires that the VM can scale at least as high as the snapshotted VM
+// was using. Restoring memory requires that the CPU and memory configuration is exactly the same,
+// because QEMU can only load the saved state into an identical set of devices.
+func (r *VirtualMachine) validateRestoreFrom() field.ErrorList {
+	var allErrs field.ErrorList
+	restorePath := field.NewPath("spec", "restoreFrom")
+	guestPath := field.NewPath("spec", "guest")
+	restoreFrom := r.Spec.RestoreFrom
+
+	if restoreFrom.SnapshotName == "" {
+		return append(allErrs, field.Required(restorePath.Child("snapshotName"), ""))
+	}
+	if webhookReader == nil {
+		return allErrs
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var snapshot VirtualMachineSnapshot
+	key := types.NamespacedName{Namespace: r.Namespace, Name: restoreFrom.SnapshotName}
+	if err := webhookReader.Get(ctx, key, &snapshot); err != nil {
+		if apierrors.IsNotFound(err) {
+			return append(allErrs, field.NotFound(restorePath.Child("snapshotName"), restoreFrom.SnapshotName))
+		}
+		return append(allErrs, field.InternalError(restorePath.Child("snapshotName"), err))
+	}
+
+	restore := snapshot.Status.Restore
+	if snapshot.Status.Phase != VmsSucceeded || restore == nil {
+		return append(allErrs, field.Invalid(restorePath.Child("snapshotName"), restoreFrom.SnapshotName,
+			fmt.Sprintf("snapshot has not succeeded (phase is %q)", snapshot.Status.Phase)))
+	}
+
+	guest, snapGuest := r.Spec.Guest, restore.Guest
+
+	if !restoreFrom.RestoreMemory {
+		if guest.CPUs.Max < snapGuest.CPUs.Use {
+			allErrs = append(allErrs, field.Invalid(guestPath.Child("cpus", "max"), guest.CPUs.Max,
+				fmt.Sprintf("should be greater than or equal to the snapshot's cpus.use (%v)", snapGuest.CPUs.Use)))
+		}
+		maxMemory := guest.MemorySlotSize.Value() * int64(guest.MemorySlots.Max)
+		snapMemory := snapGuest.MemorySlotSize.Value() * int64(snapGuest.MemorySlots.Use)
+		if maxMemory < snapMemory {
+			allErrs = append(allErrs, field.Invalid(guestPath.Child("memorySlots", "max"), guest.MemorySlots.Max,
+				fmt.Sprintf("maximum memory should be greater than or equal to the snapshot's memory usage (%d bytes)", snapMemory)))
+		}
+		return allErrs
+	}
+
+	if restore.MemoryFile == "" {
+		allErrs = append(allErrs, field.Invalid(restorePath.Child("restoreMemory"), true,
+			"snapshot was not taken with includeMemory"))
+	}
+
+	type match struct {
+		path     *field.Path
+		value    any
+		snapshot any
+	}
+	mustMatch := []match{
+		{guestPath.Child("cpus"), guest.CPUs, snapGuest.CPUs},
+		{guestPath.Child("memorySlots"), guest.MemorySlots, snapGuest.MemorySlots},
+		{guestPath.Child("memorySlotSize"), guest.MemorySlotSize.Value(), snapGuest.MemorySlotSize.Value()},
+	}
+	if guest.MemoryProvider != nil && restore.MemoryProvider != nil {
+		mustMatch = append(mustMatch, match{guestPath.Child("memoryProvider"), *guest.MemoryProvider, *restore.MemoryProvider})
+	}
+	if guest.CPUScalingMode != nil && restore.CPUScalingMode != nil {
+		mustMatch = append(mustMatch, match{guestPath.Child("cpuScalingMode"), *guest.CPUScalingMode, *restore.CPUScalingMode})
+	}
+	for _, m := range mustMatch {
+		if !reflect.DeepEqual(m.value, m.snapshot) {
+			allErrs = append(allErrs, field.Invalid(m.path, m.value,
+				fmt.Sprintf("must match the snapshot (%v) to restore memory", m.snapshot)))
+		}
+	}
+
+	return allErrs
+}
+
+// validateIPFamilies checks that .spec.ipFamilies has at most one of each supported IP family
+func (r *VirtualMachine) validateIPFamilies() field.ErrorList {
+	var allErrs field.ErrorList
+	path := field.NewPath("spec", "ipFamilies")
+	supported := []string{string(IPFamilyIPv4), string(IPFamilyIPv6)}
+
+	seen := make(map[IPFamily]struct{})
+	for i, family := range r.Spec.IPFamilies {
+		if !slices.Contains(supported, string(family)) {
+			allErrs = append(allErrs, field.NotSupported(path.Index(i), family, supported))
+			continue
+		}
+		if _, ok := seen[family]; ok {
+			allErrs = append(allErrs, field.Duplicate(path.Index(i), family))
 		}
+		seen[family] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// validatePorts checks .spec.guest.ports
+//
+// The same port number may be used once for each protocol, matching the rules for a pod's
+// containerPorts. Ports used by the runner pod itself are not allowed.
+func (r *VirtualMachine) validatePorts() field.ErrorList {
+	type portKey struct {
+		port     int
+		protocol Protocol
 	}
 
-	// validate .spec.guest.ports[].name
+	reservedPorts := r.reservedPorts()
+
+	var allErrs field.ErrorList
+	seenNames := make(map[string]struct{})
+	seenPorts := make(map[portKey]struct{})
+
+	for i, port := range r.Spec.Guest.Ports {
+		path := field.NewPath("spec", "guest", "ports").Index(i)
+
+		if port.Name == "qmp" {
+			allErrs = append(allErrs, field.Invalid(path.Child("name"), port.Name, "'qmp' is reserved name for .spec.guest.ports[].name"))
+		} else if port.Name != "" {
+			if _, ok := seenNames[port.Name]; ok {
+				allErrs = append(allErrs, field.Duplicate(path.Child("name"), port.Name))
+			}
+			seenNames[port.Name] = struct{}{}
+		}
+
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = ProtocolTCP
+		}
+		if protocol != ProtocolTCP && protocol != ProtocolUDP {
+			allErrs = append(allErrs, field.NotSupported(path.Child("protocol"), port.Protocol, []string{string(ProtocolTCP), string(ProtocolUDP)}))
+		}
+
+		if port.Port < 1 || port.Port > 65535 {
+			allErrs = append(allErrs, field.Invalid(path.Child("port"), port.Port, "must be between 1 and 65535, inclusive"))
+			continue
+		}
+		if reservedBy, ok := reservedPorts[port.Port]; ok && protocol == ProtocolTCP {
+			allErrs = append(allErrs, field.Invalid(path.Child("port"), port.Port, fmt.Sprintf("already used by %s", reservedBy)))
+		}
+
+		key := portKey{port: port.Port, protocol: protocol}
+		if _, ok := seenPorts[key]; ok {
+			allErrs = append(allErrs, field.Duplicate(path.Child("port"), fmt.Sprintf("%d/%s", port.Port, protocol)))
+		}
+		seenPorts[key] = struct{}{}
+	}
+
+	return allErrs
+}
+
+// reservedPorts returns the TCP ports used by the runner pod itself, with what they're used by
+func (r *VirtualMachine) reservedPorts() map[int]string {
+	return map[int]string{
+		int(r.Spec.QMP):         ".spec.qmp",
+		int(r.Spec.QMPManual):   ".spec.qmpManual",
+		int(r.Spec.RunnerPort):  ".spec.runnerPort",
+		int(SnapshotExportPort): "snapshot exports",
+		int(ConsolePort):        "the serial console",
+	}
+}
+
+// reservedContainerNames are the names of the containers (and init containers) that the controller
+// adds to the runner pod
+var reservedContainerNames = []string{"neonvm-runner", "neonvm-container-mgr", "init", "init-kernel", "restore-snapshot"}
+
+// validateExtraContainers checks that .spec.extraContainers don't conflict with the rest of the
+// runner pod: their names must be unique, and their ports must not be used by the runner.
+func (r *VirtualMachine) validateExtraContainers() field.ErrorList {
+	var allErrs field.ErrorList
+	containersPath := field.NewPath("spec", "extraContainers")
+
+	seenNames := make(map[string]struct{})
+	for _, c := range r.Spec.ExtraInitContainers {
+		seenNames[c.Name] = struct{}{}
+	}
+
+	type portKey struct {
+		port     int
+		protocol corev1.Protocol
+	}
+	usedPorts := make(map[portKey]string)
+	for port, usedBy := range r.reservedPorts() {
+		usedPorts[portKey{port: port, protocol: corev1.ProtocolTCP}] = usedBy
+	}
 	for _, port := range r.Spec.Guest.Ports {
-		if len(port.Name) != 0 && port.Name == "qmp" {
-			return nil, errors.New("'qmp' is reserved name for .spec.guest.ports[].name")
+		protocol := corev1.Protocol(port.Protocol)
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
 		}
+		usedPorts[portKey{port: port.Port, protocol: protocol}] = ".spec.guest.ports"
 	}
 
-	// validate that at most one type of swap is provided:
-	if settings := r.Spec.Guest.Settings; settings != nil {
-		if settings.Swap != nil && settings.SwapInfo != nil {
-			return nil, errors.New("cannot have both 'swap' and 'swapInfo' enabled")
+	for i, c := range r.Spec.ExtraContainers {
+		path := containersPath.Index(i)
+
+		if c.Name == "" {
+			allErrs = append(allErrs, field.Required(path.Child("name"), ""))
+		} else if slices.Contains(reservedContainerNames, c.Name) {
+			allErrs = append(allErrs, field.Invalid(path.Child("name"), c.Name, "name is reserved for containers added by NeonVM"))
+		} else if _, ok := seenNames[c.Name]; ok {
+			allErrs = append(allErrs, field.Duplicate(path.Child("name"), c.Name))
+		}
+		seenNames[c.Name] = struct{}{}
+
+		if c.Image == "" {
+			allErrs = append(allErrs, field.Required(path.Child("image"), ""))
+		}
+
+		for j, port := range c.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			key := portKey{port: int(port.ContainerPort), protocol: protocol}
+			if usedBy, ok := usedPorts[key]; ok {
+				allErrs = append(allErrs, field.Invalid(path.Child("ports").Index(j).Child("containerPort"), port.ContainerPort,
+					fmt.Sprintf("already used by %s", usedBy)))
+			}
+			usedPorts[key] = fmt.Sprintf("container %q", c.Name)
 		}
 	}
 
-	return nil, nil
+	return allErrs
+}
+
+// warnings returns admission warnings for soft issues with the VirtualMachine that don't prevent
+// it from being accepted, like use of deprecated fields.
+func (r *VirtualMachine) warnings() admission.Warnings {
+	var warnings admission.Warnings
+
+	for _, d := range r.DeprecatedFieldsInUse() {
+		warnings = append(warnings, d.Warning())
+	}
+	if r.Spec.Guest.MemoryProvider == nil {
+		warnings = append(warnings, ".spec.guest.memoryProvider is unset; the default may change when the VM is restarted")
+	}
+
+	return warnings
+}
+
+// toAggregate converts the list of errors into a single error for the admission response, or nil
+// if there were no errors.
+func (r *VirtualMachine) toAggregate(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(SchemeGroupVersion.WithKind("VirtualMachine").GroupKind(), r.Name, allErrs)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *VirtualMachine) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	var allErrs field.ErrorList
+
 	// process immutable fields
 	before, _ := old.(*VirtualMachine)
 
@@ -128,20 +1188,36 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) (admission.Warnings,
 		fieldName string
 		getter    func(*VirtualMachine) any
 	}{
-		{".spec.guest.cpus.min", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Min }},
-		{".spec.guest.cpus.max", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Max }},
-		{".spec.guest.memorySlots.min", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Min }},
-		{".spec.guest.memorySlots.max", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Max }},
+		{"spec.guest.cpus.min", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Min }},
+		{"spec.guest.cpus.max", func(v *VirtualMachine) any { return v.Spec.Guest.CPUs.Max }},
+		{"spec.guest.cpuBurst", func(v *VirtualMachine) any { return v.Spec.Guest.CPUBurst }},
+		{"spec.guest.memorySlots.min", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Min }},
+		{"spec.guest.memorySlots.max", func(v *VirtualMachine) any { return v.Spec.Guest.MemorySlots.Max }},
 		// nb: we don't check memoryProvider here, so that it's allowed to be mutable as a way of
 		// getting flexibility to solidify the memory provider or change it across restarts.
 		// ref https://github.com/neondatabase/autoscaling/pull/970#discussion_r1644225986
-		{".spec.guest.memoryProvider", func(v *VirtualMachine) any { return v.Spec.Guest.MemoryProvider }},
-		{".spec.guest.ports", func(v *VirtualMachine) any { return v.Spec.Guest.Ports }},
-		{".spec.guest.rootDisk", func(v *VirtualMachine) any { return v.Spec.Guest.RootDisk }},
-		{".spec.guest.command", func(v *VirtualMachine) any { return v.Spec.Guest.Command }},
-		{".spec.guest.args", func(v *VirtualMachine) any { return v.Spec.Guest.Args }},
-		{".spec.guest.env", func(v *VirtualMachine) any { return v.Spec.Guest.Env }},
-		{".spec.guest.settings", func(v *VirtualMachine) any {
+		{"spec.guest.memoryProvider", func(v *VirtualMachine) any { return v.Spec.Guest.MemoryProvider }},
+		{"spec.guest.ports", func(v *VirtualMachine) any { return v.Spec.Guest.Ports }},
+		{"spec.guest.readinessProbe", func(v *VirtualMachine) any { return v.Spec.Guest.ReadinessProbe }},
+		{"spec.guest.network", func(v *VirtualMachine) any { return v.Spec.Guest.Network }},
+		{"spec.guest.devices", func(v *VirtualMachine) any { return v.Spec.Guest.Devices }},
+		{"spec.guest.cloudInit", func(v *VirtualMachine) any { return v.Spec.Guest.CloudInit }},
+		{"spec.guest.memoryBacking", func(v *VirtualMachine) any { return v.Spec.Guest.MemoryBacking }},
+		{"spec.guest.hugepageSize", func(v *VirtualMachine) any { return v.Spec.Guest.HugepageSize }},
+		// nb: .spec.guest.rootDisk.ioLimits can be changed while the VM is running
+		{"spec.guest.rootDisk", func(v *VirtualMachine) any {
+			rootDisk := v.Spec.Guest.RootDisk
+			rootDisk.IOLimits = nil
+			return rootDisk
+		}},
+		{"spec.guest.bootMethod", func(v *VirtualMachine) any { return v.Spec.Guest.BootMethod }},
+		{"spec.guest.enableGuestAgent", func(v *VirtualMachine) any { return v.Spec.Guest.EnableGuestAgent }},
+		{"spec.restoreFrom", func(v *VirtualMachine) any { return v.Spec.RestoreFrom }},
+		{"spec.cloneFrom", func(v *VirtualMachine) any { return v.Spec.CloneFrom }},
+		{"spec.guest.command", func(v *VirtualMachine) any { return v.Spec.Guest.Command }},
+		{"spec.guest.args", func(v *VirtualMachine) any { return v.Spec.Guest.Args }},
+		{"spec.guest.env", func(v *VirtualMachine) any { return v.Spec.Guest.Env }},
+		{"spec.guest.settings", func(v *VirtualMachine) any {
 			if v.Spec.Guest.Settings == nil {
 				//nolint:gocritic // linter complains that we could say 'nil' directly. It's typed vs untyped nil.
 				return v.Spec.Guest.Settings
@@ -150,19 +1226,32 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) (admission.Warnings,
 				return v.Spec.Guest.Settings.WithoutSwapFields()
 			}
 		}},
-		{".spec.disks", func(v *VirtualMachine) any { return v.Spec.Disks }},
-		{".spec.podResources", func(v *VirtualMachine) any { return v.Spec.PodResources }},
-		{".spec.enableAcceleration", func(v *VirtualMachine) any { return v.Spec.EnableAcceleration }},
-		{".spec.enableSSH", func(v *VirtualMachine) any { return v.Spec.EnableSSH }},
-		{".spec.initScript", func(v *VirtualMachine) any { return v.Spec.InitScript }},
+		// nb: .spec.disks is checked separately below, because hotpluggable disks can be added and
+		// removed.
+		{"spec.podResources", func(v *VirtualMachine) any { return v.Spec.PodResources }},
+		{"spec.enableAcceleration", func(v *VirtualMachine) any { return v.Spec.EnableAcceleration }},
+		{"spec.enableConfidentialCompute", func(v *VirtualMachine) any { return v.Spec.EnableConfidentialCompute }},
+		{"spec.enableSSH", func(v *VirtualMachine) any { return v.Spec.EnableSSH }},
+		{"spec.initScript", func(v *VirtualMachine) any { return v.Spec.InitScript }},
+		{"spec.ipFamilies", func(v *VirtualMachine) any { return v.Spec.IPFamilies }},
 	}
 
 	for _, info := range immutableFields {
 		if !reflect.DeepEqual(info.getter(r), info.getter(before)) {
-			return nil, fmt.Errorf("%s is immutable", info.fieldName)
+			allErrs = append(allErrs, field.Forbidden(field.NewPath(info.fieldName), "field is immutable"))
 		}
 	}
 
+	// validate changes to .spec.disks
+	if !reflect.DeepEqual(r.Spec.Disks, before.Spec.Disks) {
+		allErrs = append(allErrs, r.validateDiskChanges(before)...)
+	}
+
+	// validate changes to .spec.guest.rootDisk.ioLimits
+	if !reflect.DeepEqual(r.Spec.Guest.RootDisk.IOLimits, before.Spec.Guest.RootDisk.IOLimits) {
+		allErrs = append(allErrs, validateIOLimits(field.NewPath("spec", "guest", "rootDisk", "ioLimits"), r.Spec.Guest.RootDisk.IOLimits)...)
+	}
+
 	// validate swap changes by comparing the SwapInfo for each.
 	//
 	// If there's an error with the old object, but NOT an error with the new one, we'll allow the
@@ -172,50 +1261,95 @@ func (r *VirtualMachine) ValidateUpdate(old runtime.Object) (admission.Warnings,
 	// If we didn't have that exception, we could *in theory* end up with an object in a bad state,
 	// but be unable to fix it because the old state is bad - even if the new one is ok - because
 	// the webhook would return an error from the old state being invalid, which disallows the update
-	if r.Spec.Guest.Settings != nil /* from above, if new GuestSettings != nil, then old is as well */ {
+	if r.Spec.Guest.Settings != nil && before.Spec.Guest.Settings != nil {
+		swapPath := field.NewPath("spec", "guest", "settings", "swapInfo")
 		newSwapInfo, err := r.Spec.Guest.Settings.GetSwapInfo()
 		if err != nil {
-			return nil, err
-		}
-		oldSwapInfo, err := before.Spec.Guest.Settings.GetSwapInfo()
-		if err != nil {
+			allErrs = append(allErrs, field.Invalid(swapPath, r.Spec.Guest.Settings.SwapInfo, err.Error()))
+		} else if oldSwapInfo, err := before.Spec.Guest.Settings.GetSwapInfo(); err != nil {
 			// do nothing; we'll allow fixing broken objects.
-		} else {
-			if !reflect.DeepEqual(newSwapInfo, oldSwapInfo) {
-				return nil, errors.New(".spec.guest.settings.{swap,swapInfo} is immutable")
-			}
+		} else if !reflect.DeepEqual(newSwapInfo, oldSwapInfo) {
+			allErrs = append(allErrs, field.Forbidden(swapPath, ".spec.guest.settings.{swap,swapInfo} is immutable"))
 		}
 	}
 
-	// validate .spec.guest.cpu.use
-	if r.Spec.Guest.CPUs.Use < r.Spec.Guest.CPUs.Min {
-		return nil, fmt.Errorf(".cpus.use (%v) should be greater than or equal to the .cpus.min (%v)",
-			r.Spec.Guest.CPUs.Use,
-			r.Spec.Guest.CPUs.Min)
+	// validate .spec.guest.cpus.use and .spec.guest.memorySlots.use
+	allErrs = append(allErrs, r.validateScalingBounds()...)
+
+	// validate .spec.guest.kernelCmdline
+	allErrs = append(allErrs, r.validateKernelCmdline()...)
+
+	// validate .spec.enableConfidentialCompute
+	allErrs = append(allErrs, r.validateConfidentialCompute()...)
+
+	// validate .spec.guest.cpuScalingMode
+	allErrs = append(allErrs, r.validateCPUScalingMode()...)
+
+	// validate .spec.extraContainers
+	allErrs = append(allErrs, r.validateExtraContainers()...)
+
+	// validate against the cluster's VirtualMachinePolicy
+	allErrs = append(allErrs, r.validatePolicyUpdate(before)...)
+
+	return r.warnings(), r.toAggregate(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+//
+// Deletion is rejected while the VM is protected (see VirtualMachineProtectedAnnotation) or being
+// migrated, unless VirtualMachineForceDeleteAnnotation is set.
+func (r *VirtualMachine) ValidateDelete() (admission.Warnings, error) {
+	if r.Annotations[VirtualMachineForceDeleteAnnotation] == "true" {
+		return nil, nil
 	}
-	if r.Spec.Guest.CPUs.Use > r.Spec.Guest.CPUs.Max {
-		return nil, fmt.Errorf(".cpus.use (%v) should be less than or equal to the .cpus.max (%v)",
-			r.Spec.Guest.CPUs.Use,
-			r.Spec.Guest.CPUs.Max)
+
+	if r.Annotations[VirtualMachineProtectedAnnotation] == "true" {
+		return nil, r.forbidDelete(fmt.Sprintf("VM is protected by the %q annotation", VirtualMachineProtectedAnnotation))
 	}
 
-	// validate .spec.guest.memorySlots.use
-	if r.Spec.Guest.MemorySlots.Use < r.Spec.Guest.MemorySlots.Min {
-		return nil, fmt.Errorf(".memorySlots.use (%d) should be greater than or equal to the .memorySlots.min (%d)",
-			r.Spec.Guest.MemorySlots.Use,
-			r.Spec.Guest.MemorySlots.Min)
+	// The VM's phase is checked first, so that migrations are detected even if the
+	// VirtualMachineMigrations can't be looked up.
+	if r.Status.Phase == VmPreMigrating || r.Status.Phase == VmMigrating {
+		return nil, r.forbidDelete(fmt.Sprintf("VM is being migrated (phase is %q)", r.Status.Phase))
+	}
+	migration, err := r.activeMigration()
+	if err != nil {
+		// Don't block deletion just because the migrations couldn't be listed. The phase check
+		// above still catches migrations that have started.
+		return admission.Warnings{fmt.Sprintf("could not check for running migrations: %s", err)}, nil
 	}
-	if r.Spec.Guest.MemorySlots.Use > r.Spec.Guest.MemorySlots.Max {
-		return nil, fmt.Errorf(".memorySlots.use (%d) should be less than or equal to the .memorySlots.max (%d)",
-			r.Spec.Guest.MemorySlots.Use,
-			r.Spec.Guest.MemorySlots.Max)
+	if migration != "" {
+		return nil, r.forbidDelete(fmt.Sprintf("VM is being migrated by VirtualMachineMigration %q", migration))
 	}
 
 	return nil, nil
 }
 
-// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
-func (r *VirtualMachine) ValidateDelete() (admission.Warnings, error) {
-	// No deletion validation required currently.
-	return nil, nil
+// forbidDelete returns the error for a rejected deletion, explaining how to force it
+func (r *VirtualMachine) forbidDelete(reason string) error {
+	return apierrors.NewForbidden(SchemeGroupVersion.WithResource("virtualmachines").GroupResource(), r.Name,
+		fmt.Errorf("%s; set the %q annotation to \"true\" to delete it anyway", reason, VirtualMachineForceDeleteAnnotation))
+}
+
+// activeMigration returns the name of a VirtualMachineMigration that is running for the VM, or the
+// empty string if there isn't one. Pending migrations don't count, because nothing has happened
+// yet that deleting the VM could interrupt.
+func (r *VirtualMachine) activeMigration() (string, error) {
+	if webhookReader == nil {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var migrations VirtualMachineMigrationList
+	if err := webhookReader.List(ctx, &migrations, client.InNamespace(r.Namespace)); err != nil {
+		return "", err
+	}
+	for _, m := range migrations.Items {
+		if m.Spec.VmName == r.Name && m.DeletionTimestamp.IsZero() && m.Status.Phase == VmmRunning {
+			return m.Name, nil
+		}
+	}
+	return "", nil
 }
@@ -0,0 +1,1101 @@
+package v1
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// assertFieldErrors checks that errs has exactly one error for each of the expected prefixes, in
+// order
+func assertFieldErrors(t *testing.T, errs field.ErrorList, expected []string) {
+	t.Helper()
+
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), expected[i]) {
+			t.Errorf("error %d: expected prefix %q, got %q", i, expected[i], err.Error())
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	cases := []struct {
+		name   string
+		ports  []Port
+		errors []string
+	}{
+		{
+			name: "valid",
+			ports: []Port{
+				{Name: "postgres", Port: 5432, Protocol: ProtocolTCP},
+				{Name: "dns-tcp", Port: 53, Protocol: ProtocolTCP},
+				{Name: "dns-udp", Port: 53, Protocol: ProtocolUDP},
+				{Name: "", Port: 8080, Protocol: ""},
+			},
+			errors: nil,
+		},
+		{
+			name: "all violations reported",
+			ports: []Port{
+				{Name: "qmp", Port: 1000, Protocol: ProtocolTCP},
+				{Name: "a", Port: 5432, Protocol: ProtocolTCP},
+				{Name: "a", Port: 5432, Protocol: ""},
+				{Name: "b", Port: 0, Protocol: ProtocolTCP},
+				{Name: "c", Port: 2000, Protocol: "SCTP"},
+				{Name: "d", Port: 20183, Protocol: ProtocolTCP},
+			},
+			errors: []string{
+				"spec.guest.ports[0].name: Invalid value",
+				"spec.guest.ports[2].name: Duplicate value",
+				"spec.guest.ports[2].port: Duplicate value",
+				"spec.guest.ports[3].port: Invalid value",
+				"spec.guest.ports[4].protocol: Unsupported value",
+				"spec.guest.ports[5].port: Invalid value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.QMP = 20183
+			vm.Spec.QMPManual = 20184
+			vm.Spec.RunnerPort = 25183
+			vm.Spec.Guest.Ports = c.ports
+
+			errs := vm.validatePorts()
+			assertFieldErrors(t, errs, c.errors)
+		})
+	}
+}
+
+func TestValidateExtraContainers(t *testing.T) {
+	vm := &VirtualMachine{}
+	vm.Spec.QMP = 20183
+	vm.Spec.QMPManual = 20184
+	vm.Spec.RunnerPort = 25183
+	vm.Spec.Guest.Ports = []Port{{Name: "postgres", Port: 5432, Protocol: ProtocolTCP}}
+	vm.Spec.ExtraInitContainers = []corev1.Container{{Name: "setup", Image: "setup"}}
+	vm.Spec.ExtraContainers = []corev1.Container{
+		{Name: "log-shipper", Image: "vector", Ports: []corev1.ContainerPort{{ContainerPort: 9598}, {ContainerPort: 5432, Protocol: corev1.ProtocolUDP}}},
+		{Name: "neonvm-runner", Image: "runner"},
+		{Name: "setup", Image: "setup"},
+		{Name: "proxy", Image: "", Ports: []corev1.ContainerPort{{ContainerPort: 5432}, {ContainerPort: 9598}, {ContainerPort: 25183}}},
+	}
+
+	expected := []string{
+		"spec.extraContainers[1].name: Invalid value",
+		"spec.extraContainers[2].name: Duplicate value",
+		"spec.extraContainers[3].image: Required value",
+		"spec.extraContainers[3].ports[0].containerPort: Invalid value",
+		"spec.extraContainers[3].ports[1].containerPort: Invalid value",
+		"spec.extraContainers[3].ports[2].containerPort: Invalid value",
+	}
+	errs := vm.validateExtraContainers()
+	assertFieldErrors(t, errs, expected)
+}
+
+func TestValidateIPFamilies(t *testing.T) {
+	cases := []struct {
+		name     string
+		families []IPFamily
+		errors   []string
+	}{
+		{
+			name:     "default",
+			families: nil,
+			errors:   nil,
+		},
+		{
+			name:     "dual-stack",
+			families: []IPFamily{IPFamilyIPv6, IPFamilyIPv4},
+			errors:   nil,
+		},
+		{
+			name:     "all violations reported",
+			families: []IPFamily{IPFamilyIPv4, "IPv5", IPFamilyIPv4},
+			errors: []string{
+				"spec.ipFamilies[1]: Unsupported value",
+				"spec.ipFamilies[2]: Duplicate value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.IPFamilies = c.families
+
+			errs := vm.validateIPFamilies()
+			assertFieldErrors(t, errs, c.errors)
+		})
+	}
+}
+
+func TestValidateCreateAggregatesErrors(t *testing.T) {
+	vm := &VirtualMachine{}
+	vm.Spec.Guest.CPUs = CPUs{Min: 1000, Use: 500, Max: 2000}
+	vm.Spec.Guest.MemorySlots = MemorySlots{Min: 1, Use: 5, Max: 4}
+	vm.Spec.Guest.Ports = []Port{{Name: "qmp", Port: 1000, Protocol: ProtocolTCP}}
+
+	warnings, err := vm.ValidateCreate()
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	for _, field := range []string{"spec.guest.cpus.use", "spec.guest.memorySlots.use", "spec.guest.ports[0].name"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to mention %s, got: %s", field, err)
+		}
+	}
+	if len(warnings) == 0 {
+		t.Error("expected warning about unset memoryProvider")
+	}
+}
+
+func TestDiskSerial(t *testing.T) {
+	if serial := DiskSerial("pgdata"); serial != "pgdata" {
+		t.Errorf("expected short name to be used as-is, got %q", serial)
+	}
+
+	long := DiskSerial("a-rather-long-disk-name-0")
+	if len(long) != MaxDiskSerialLength {
+		t.Errorf("expected serial of length %d, got %q", MaxDiskSerialLength, long)
+	}
+	if long != DiskSerial("a-rather-long-disk-name-0") {
+		t.Error("expected serial to be stable")
+	}
+	if long == DiskSerial("a-rather-long-disk-name-1") {
+		t.Errorf("expected serials for distinct names to differ, both were %q", long)
+	}
+
+	vm := &VirtualMachine{}
+	vm.Spec.Guest.CPUs = CPUs{Min: 1000, Use: 1000, Max: 1000}
+	vm.Spec.Guest.MemorySlots = MemorySlots{Min: 1, Use: 1, Max: 1}
+	vm.Spec.Disks = []Disk{
+		{Name: "data", MountPath: "/data", DiskSource: DiskSource{Tmpfs: &TmpfsDiskSource{Size: resource.MustParse("1Mi")}}},
+		{Name: "Bad,Name", MountPath: "/bad", DiskSource: DiskSource{Tmpfs: &TmpfsDiskSource{Size: resource.MustParse("1Mi")}}},
+	}
+	_, err := vm.ValidateCreate()
+	if err == nil || !strings.Contains(err.Error(), "spec.disks[1].name") {
+		t.Errorf("expected error about spec.disks[1].name, got: %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "spec.disks[0].name") {
+		t.Errorf("expected no error about spec.disks[0].name, got: %v", err)
+	}
+}
+
+func TestValidateKernelCmdline(t *testing.T) {
+	vm := &VirtualMachine{}
+	vm.Spec.Guest.KernelCmdline = []string{
+		"transparent_hugepage=never",
+		"quiet",
+		"init=/bin/sh",
+		"memory_hotplug.online_policy=online",
+		"a=1 b=2",
+		"",
+	}
+	expected := []string{
+		"spec.guest.kernelCmdline[2]: Forbidden",
+		"spec.guest.kernelCmdline[3]: Forbidden",
+		"spec.guest.kernelCmdline[4]: Invalid value",
+		"spec.guest.kernelCmdline[5]: Invalid value",
+	}
+
+	errs := vm.validateKernelCmdline()
+	assertFieldErrors(t, errs, expected)
+}
+
+func TestValidateConfidentialCompute(t *testing.T) {
+	vm := &VirtualMachine{}
+	vm.Spec.EnableConfidentialCompute = lo.ToPtr(true)
+	vm.Spec.EnableAcceleration = lo.ToPtr(false)
+	vm.Spec.RequiredCapabilities = []NodeCapability{NodeCapabilityARM64}
+	vm.Spec.RestoreFrom = &RestoreFrom{SnapshotName: "snap", RestoreMemory: true}
+	vm.Spec.Guest.BootMethod = BootMethodUEFI
+
+	if errs := vm.validateConfidentialCompute(); len(errs) != 4 {
+		t.Errorf("expected 4 errors, got %d: %v", len(errs), errs)
+	}
+
+	caps := vm.Spec.NodeCapabilities()
+	if !slices.Contains(caps, NodeCapabilityConfidentialCompute) || len(vm.Spec.RequiredCapabilities) != 1 {
+		t.Errorf("expected confidential-compute to be added to a copy of the required capabilities, got %v", caps)
+	}
+	if spec := (VirtualMachineSpec{EnableConfidentialCompute: lo.ToPtr(true)}); !spec.ResizedByRestart() {
+		t.Error("expected confidential VM to be resized by restart")
+	}
+}
+
+func TestValidateCPUScalingMode(t *testing.T) {
+	cases := []struct {
+		name       string
+		mode       *CPUScalingMode
+		bootMethod BootMethod
+		cc         bool
+		errors     int
+	}{
+		{"unset with UEFI", nil, BootMethodUEFI, false, 0},
+		{"QMPHotplug with UEFI", lo.ToPtr(CPUScalingModeQMPHotplug), BootMethodUEFI, false, 0},
+		{"CgroupThrottling", lo.ToPtr(CPUScalingModeCgroupThrottling), BootMethodKernel, false, 0},
+		{"GuestCpuset with UEFI", lo.ToPtr(CPUScalingModeGuestCpuset), BootMethodUEFI, false, 1},
+		{"CgroupThrottling with confidential compute", lo.ToPtr(CPUScalingModeCgroupThrottling), BootMethodKernel, true, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.CPUScalingMode = c.mode
+			vm.Spec.Guest.BootMethod = c.bootMethod
+			vm.Spec.EnableConfidentialCompute = lo.ToPtr(c.cc)
+
+			if errs := vm.validateCPUScalingMode(); len(errs) != c.errors {
+				t.Errorf("expected %d errors, got %d: %v", c.errors, len(errs), errs)
+			}
+		})
+	}
+}
+
+func TestValidateBaseImageCache(t *testing.T) {
+	cases := []struct {
+		name     string
+		cache    RootDiskBaseImageCache
+		expected []string
+	}{
+		{
+			name:     "hostPath",
+			cache:    RootDiskBaseImageCache{HostPath: lo.ToPtr("/var/lib/neonvm/base-images"), PersistentVolumeClaim: nil},
+			expected: nil,
+		},
+		{
+			name:     "pvc",
+			cache:    RootDiskBaseImageCache{HostPath: nil, PersistentVolumeClaim: lo.ToPtr("base-images")},
+			expected: nil,
+		},
+		{
+			name:     "neither",
+			cache:    RootDiskBaseImageCache{HostPath: nil, PersistentVolumeClaim: nil},
+			expected: []string{"spec.guest.rootDisk.baseImageCache: Invalid value"},
+		},
+		{
+			name:  "both, relative hostPath",
+			cache: RootDiskBaseImageCache{HostPath: lo.ToPtr("base-images"), PersistentVolumeClaim: lo.ToPtr("base-images")},
+			expected: []string{
+				"spec.guest.rootDisk.baseImageCache: Invalid value",
+				"spec.guest.rootDisk.baseImageCache.hostPath: Invalid value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.RootDisk.BaseImageCache = &c.cache
+
+			errs := vm.validateBaseImageCache()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestRootDiskImagePath(t *testing.T) {
+	cases := []struct {
+		format      DiskImageFormat
+		compression DiskImageCompression
+		expected    string
+	}{
+		{"", "", "/disk.qcow2"},
+		{DiskImageFormatRaw, DiskImageCompressionNone, "/disk.raw"},
+		{DiskImageFormatQCOW2, DiskImageCompressionZstd, "/disk.qcow2.zst"},
+		{DiskImageFormatRaw, DiskImageCompressionZstd, "/disk.raw.zst"},
+	}
+
+	for _, c := range cases {
+		rootDisk := RootDisk{Format: c.format, Compression: c.compression}
+		if path := rootDisk.ImagePath(); path != c.expected {
+			t.Errorf("format %q, compression %q: expected %q, got %q", c.format, c.compression, c.expected, path)
+		}
+	}
+}
+
+func TestValidateCPUBurst(t *testing.T) {
+	cases := []struct {
+		name     string
+		burst    CPUBurst
+		expected []string
+	}{
+		{
+			name:     "valid",
+			burst:    CPUBurst{Limit: 2000, MaxDurationSeconds: 30, CooldownSeconds: 60},
+			expected: nil,
+		},
+		{
+			name:  "above max, zero duration",
+			burst: CPUBurst{Limit: 8000, MaxDurationSeconds: 0, CooldownSeconds: -1},
+			expected: []string{
+				"spec.guest.cpuBurst.limit: Invalid value",
+				"spec.guest.cpuBurst.maxDurationSeconds: Invalid value",
+				"spec.guest.cpuBurst.cooldownSeconds: Invalid value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.CPUs = CPUs{Min: 250, Max: 4000, Use: 1000}
+			vm.Spec.Guest.CPUBurst = &c.burst
+
+			errs := vm.validateScalingBounds()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateSwapPolicy(t *testing.T) {
+	proportional := SwapPolicyProportionalToMemory
+	percent := int32(50)
+	skip := true
+
+	cases := []struct {
+		name     string
+		swapInfo SwapInfo
+		expected []string
+	}{
+		{
+			name:     "fixed",
+			swapInfo: SwapInfo{Size: resource.MustParse("1Gi")},
+			expected: nil,
+		},
+		{
+			name:     "proportional",
+			swapInfo: SwapInfo{Size: resource.MustParse("1Gi"), Policy: &proportional, MemoryPercent: &percent},
+			expected: nil,
+		},
+		{
+			name:     "proportional without percent, with skipSwapon",
+			swapInfo: SwapInfo{Size: resource.MustParse("1Gi"), Policy: &proportional, SkipSwapon: &skip},
+			expected: []string{
+				"spec.guest.settings.swapInfo.memoryPercent: Required value",
+				"spec.guest.settings.swapInfo.skipSwapon: Forbidden",
+			},
+		},
+		{
+			name:     "fixed with percent",
+			swapInfo: SwapInfo{Size: resource.MustParse("1Gi"), MemoryPercent: &percent},
+			expected: []string{
+				"spec.guest.settings.swapInfo.memoryPercent: Forbidden",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := validateSwapPolicy(c.swapInfo)
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+
+	size := SwapInfo{Size: resource.MustParse("1Gi"), Policy: &proportional, MemoryPercent: &percent}.
+		SizeForMemory(resource.MustParse("1Gi"))
+	if size.Value() != 512<<20 {
+		t.Errorf("expected swap size for 1Gi memory to be 512Mi, got %s", size.String())
+	}
+	size = SwapInfo{Size: resource.MustParse("1Gi"), Policy: &proportional, MemoryPercent: &percent}.
+		SizeForMemory(resource.MustParse("4Gi"))
+	if size.Value() != 1<<30 {
+		t.Errorf("expected swap size for 4Gi memory to be capped at 1Gi, got %s", size.String())
+	}
+}
+
+func TestValidatePodResources(t *testing.T) {
+	webhookPodResourcesOverhead = &PodResourcesOverhead{
+		MemoryFixed:    resource.MustParse("256Mi"),
+		MemoryFraction: 0.125,
+		CPUFixed:       resource.MustParse("100m"),
+	}
+	defer func() { webhookPodResourcesOverhead = nil }()
+
+	cases := []struct {
+		name     string
+		requests corev1.ResourceList
+		limits   corev1.ResourceList
+		errors   []string
+	}{
+		{
+			name:     "unset",
+			requests: nil,
+			limits:   nil,
+			errors:   nil,
+		},
+		{
+			// 4 slots of 1Gi = 4Gi, plus 512Mi (1/8) plus 256Mi
+			name:     "exactly enough",
+			requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("4864Mi"),
+				corev1.ResourceCPU:    resource.MustParse("2100m"),
+			},
+			errors: nil,
+		},
+		{
+			name:     "all violations reported",
+			requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+			limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+				corev1.ResourceCPU:    resource.MustParse("2"),
+			},
+			errors: []string{
+				"spec.podResources.requests[memory]: Invalid value",
+				"spec.podResources.limits[memory]: Invalid value",
+				"spec.podResources.limits[cpu]: Invalid value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.CPUs.Max = MilliCPU(2000)
+			vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+			vm.Spec.Guest.MemorySlots.Max = 4
+			vm.Spec.PodResources.Requests = c.requests
+			vm.Spec.PodResources.Limits = c.limits
+
+			errs := vm.validatePodResources()
+			assertFieldErrors(t, errs, c.errors)
+		})
+	}
+}
+
+func TestDiskReferenceWarnings(t *testing.T) {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(corev1.SchemeGroupVersion, &corev1.ConfigMap{}, &corev1.Secret{})
+
+	webhookReader = fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "exists"}}).
+		Build()
+	defer func() { webhookReader = nil }()
+
+	optional := true
+	vm := &VirtualMachine{}
+	vm.Namespace = "default"
+	vm.Spec.Disks = []Disk{
+		{Name: "a", DiskSource: DiskSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "exists"},
+		}}},
+		{Name: "b", DiskSource: DiskSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+		}}},
+		{Name: "c", DiskSource: DiskSource{Secret: &corev1.SecretVolumeSource{SecretName: "missing"}}},
+		{Name: "d", DiskSource: DiskSource{Secret: &corev1.SecretVolumeSource{SecretName: "missing", Optional: &optional}}},
+	}
+	expected := []string{
+		`spec.disks[1].configMap.name: ConfigMap "missing" not found`,
+		`spec.disks[2].secret.secretName: Secret "missing" not found`,
+	}
+
+	warnings := vm.diskReferenceWarnings()
+	if !reflect.DeepEqual([]string(warnings), expected) {
+		t.Errorf("expected warnings %q, got %q", expected, warnings)
+	}
+}
+
+func TestValidateCloneFrom(t *testing.T) {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(SchemeGroupVersion, &VirtualMachine{})
+
+	source := &VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "source"}}
+	source.Spec.Guest.BootMethod = BootMethodKernel
+	webhookReader = fake.NewClientBuilder().WithScheme(scheme).WithObjects(source).Build()
+	defer func() { webhookReader = nil }()
+
+	pvcTarget := SnapshotTarget{PersistentVolumeClaim: &SnapshotPVCTarget{ClaimName: "snapshots"}}
+
+	cases := []struct {
+		name       string
+		cloneFrom  CloneFrom
+		bootMethod BootMethod
+		expected   []string
+	}{
+		{
+			name:       "valid",
+			cloneFrom:  CloneFrom{VMName: "source", Target: pvcTarget},
+			bootMethod: BootMethodKernel,
+			expected:   nil,
+		},
+		{
+			name:       "missing target",
+			cloneFrom:  CloneFrom{VMName: "source"},
+			bootMethod: BootMethodKernel,
+			expected:   []string{"spec.cloneFrom.target: Required value"},
+		},
+		{
+			name:       "itself",
+			cloneFrom:  CloneFrom{VMName: "clone", Target: pvcTarget},
+			bootMethod: BootMethodKernel,
+			expected:   []string{"spec.cloneFrom.vmName: Invalid value"},
+		},
+		{
+			name:       "missing source",
+			cloneFrom:  CloneFrom{VMName: "missing", Target: pvcTarget},
+			bootMethod: BootMethodKernel,
+			expected:   []string{"spec.cloneFrom.vmName: Not found"},
+		},
+		{
+			name:       "different boot method",
+			cloneFrom:  CloneFrom{VMName: "source", Target: pvcTarget},
+			bootMethod: BootMethodUEFI,
+			expected:   []string{"spec.guest.bootMethod: Invalid value"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "clone"}}
+			vm.Spec.CloneFrom = &c.cloneFrom
+			vm.Spec.Guest.BootMethod = c.bootMethod
+
+			errs := vm.validateCloneFrom()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateDelete(t *testing.T) {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(SchemeGroupVersion, &VirtualMachineMigration{}, &VirtualMachineMigrationList{})
+
+	migration := func(name, vmName string, phase VmmPhase) *VirtualMachineMigration {
+		m := &VirtualMachineMigration{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		m.Spec.VmName = vmName
+		m.Status.Phase = phase
+		return m
+	}
+	webhookReader = fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			migration("done", "example", VmmSucceeded),
+			migration("other", "other", VmmRunning),
+			migration("active", "migrating", VmmRunning),
+			migration("pending", "pending", VmmPending),
+			migration("new", "pending", ""),
+		).
+		Build()
+	defer func() { webhookReader = nil }()
+
+	cases := []struct {
+		name        string
+		vmName      string
+		annotations map[string]string
+		phase       VmPhase
+		allowed     bool
+	}{
+		{name: "unprotected", vmName: "example", allowed: true},
+		{name: "protected", vmName: "example", annotations: map[string]string{VirtualMachineProtectedAnnotation: "true"}, allowed: false},
+		{name: "protected false", vmName: "example", annotations: map[string]string{VirtualMachineProtectedAnnotation: "false"}, allowed: true},
+		{name: "protected forced", vmName: "example", annotations: map[string]string{
+			VirtualMachineProtectedAnnotation:   "true",
+			VirtualMachineForceDeleteAnnotation: "true",
+		}, allowed: true},
+		{name: "migrating phase", vmName: "example", phase: VmMigrating, allowed: false},
+		{name: "active migration", vmName: "migrating", allowed: false},
+		{name: "active migration forced", vmName: "migrating", annotations: map[string]string{
+			VirtualMachineForceDeleteAnnotation: "true",
+		}, allowed: true},
+		{name: "pending migration", vmName: "pending", allowed: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: c.vmName, Annotations: c.annotations}}
+			vm.Status.Phase = c.phase
+
+			_, err := vm.ValidateDelete()
+			if c.allowed && err != nil {
+				t.Errorf("expected deletion to be allowed, got %v", err)
+			} else if !c.allowed && !apierrors.IsForbidden(err) {
+				t.Errorf("expected deletion to be forbidden, got %v", err)
+			}
+		})
+	}
+
+	// If migrations can't be listed, deletion is allowed with a warning. The reader's scheme
+	// doesn't know about VirtualMachineMigrations, so listing them fails.
+	webhookReader = fake.NewClientBuilder().WithScheme(runtime.NewScheme()).Build()
+	vm := &VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example"}}
+	warnings, err := vm.ValidateDelete()
+	if err != nil {
+		t.Errorf("expected deletion to be allowed, got %v", err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("expected a warning, got %q", warnings)
+	}
+}
+
+func TestDeprecationWarnings(t *testing.T) {
+	swap := resource.MustParse("1Gi")
+	vm := &VirtualMachine{}
+	vm.Spec.Guest.MemoryProvider = lo.ToPtr(MemoryProviderVirtioMem)
+
+	if warnings := vm.warnings(); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %q", warnings)
+	}
+
+	vm.Spec.Guest.Settings = &GuestSettings{Swap: &swap}
+	expected := []string{
+		".spec.guest.settings.swap is deprecated and will be removed in v0.30.0; use .spec.guest.settings.swapInfo instead",
+	}
+	if warnings := vm.warnings(); !reflect.DeepEqual([]string(warnings), expected) {
+		t.Errorf("expected warnings %q, got %q", expected, warnings)
+	}
+}
+
+func TestValidateDiskChanges(t *testing.T) {
+	emptyDisk := func(name string, hotpluggable bool) Disk {
+		return Disk{
+			Name:         name,
+			MountPath:    "/mnt/" + name,
+			Hotpluggable: hotpluggable,
+			DiskSource: DiskSource{EmptyDisk: &EmptyDiskSource{
+				Size: resource.MustParse("1Gi"),
+			}},
+		}
+	}
+	resized := emptyDisk("hot", true)
+	resized.EmptyDisk.Size = resource.MustParse("2Gi")
+	limited := emptyDisk("cold", false)
+	limited.IOLimits = &DiskIOLimits{TotalIOPS: lo.ToPtr[int64](1000)}
+
+	cases := []struct {
+		name     string
+		before   []Disk
+		after    []Disk
+		expected []string
+	}{
+		{
+			name:     "add hotpluggable",
+			before:   []Disk{emptyDisk("cold", false)},
+			after:    []Disk{emptyDisk("cold", false), emptyDisk("hot", true)},
+			expected: nil,
+		},
+		{
+			name:     "remove hotpluggable",
+			before:   []Disk{emptyDisk("hot", true), emptyDisk("cold", false)},
+			after:    []Disk{emptyDisk("cold", false)},
+			expected: nil,
+		},
+		{
+			name:     "add not hotpluggable",
+			before:   []Disk{emptyDisk("cold", false)},
+			after:    []Disk{emptyDisk("cold", false), emptyDisk("other", false)},
+			expected: []string{"spec.disks: Forbidden"},
+		},
+		{
+			name:     "change hotpluggable",
+			before:   []Disk{emptyDisk("hot", true)},
+			after:    []Disk{resized},
+			expected: []string{"spec.disks[0]: Forbidden"},
+		},
+		{
+			name:     "change I/O limits",
+			before:   []Disk{emptyDisk("cold", false)},
+			after:    []Disk{limited},
+			expected: nil,
+		},
+		{
+			name:   "add invalid hotpluggable",
+			before: nil,
+			after: []Disk{{
+				Name:         "1-config",
+				MountPath:    "config",
+				Hotpluggable: true,
+				DiskSource: DiskSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "config"},
+				}},
+			}},
+			expected: []string{
+				"spec.disks[0].hotpluggable: Invalid value",
+				"spec.disks[0].name: Invalid value",
+				"spec.disks[0].mountPath: Invalid value",
+			},
+		},
+		{
+			name:     "add duplicate hotpluggable",
+			before:   []Disk{emptyDisk("hot", true)},
+			after:    []Disk{emptyDisk("hot", true), emptyDisk("hot", true)},
+			expected: []string{"spec.disks[1].name: Duplicate value"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := &VirtualMachine{}
+			before.Spec.Disks = c.before
+			vm := &VirtualMachine{}
+			vm.Spec.Disks = c.after
+
+			errs := vm.validateDiskChanges(before)
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateReadinessProbe(t *testing.T) {
+	cases := []struct {
+		name      string
+		probe     *GuestProbe
+		enableSSH bool
+		expected  []string
+	}{
+		{
+			name:      "unset",
+			probe:     nil,
+			enableSSH: false,
+			expected:  nil,
+		},
+		{
+			name:      "httpGet",
+			probe:     &GuestProbe{HTTPGet: &GuestHTTPGetAction{Path: "/healthz", Port: 8080}},
+			enableSSH: false,
+			expected:  nil,
+		},
+		{
+			name:      "no handler",
+			probe:     &GuestProbe{},
+			enableSSH: false,
+			expected:  []string{"spec.guest.readinessProbe: Invalid value"},
+		},
+		{
+			name: "two handlers",
+			probe: &GuestProbe{
+				HTTPGet:   &GuestHTTPGetAction{Path: "healthz", Port: 8080},
+				TCPSocket: &GuestTCPSocketAction{Port: 8080},
+			},
+			enableSSH: false,
+			expected: []string{
+				"spec.guest.readinessProbe: Invalid value",
+				"spec.guest.readinessProbe.httpGet.path: Invalid value",
+			},
+		},
+		{
+			name:      "exec",
+			probe:     &GuestProbe{Exec: &GuestExecAction{Command: []string{"pg_isready"}}},
+			enableSSH: true,
+			expected:  nil,
+		},
+		{
+			name:      "exec without ssh",
+			probe:     &GuestProbe{Exec: &GuestExecAction{Command: []string{"pg_isready"}}},
+			enableSSH: false,
+			expected:  []string{"spec.guest.readinessProbe.exec: Forbidden"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.ReadinessProbe = c.probe
+			vm.Spec.EnableSSH = lo.ToPtr(c.enableSSH)
+
+			errs := vm.validateReadinessProbe()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateGuestNetwork(t *testing.T) {
+	cases := []struct {
+		name     string
+		network  *GuestNetwork
+		expected []string
+	}{
+		{
+			name:     "unset",
+			network:  nil,
+			expected: nil,
+		},
+		{
+			name:     "queues equal to max cpus",
+			network:  &GuestNetwork{Queues: 4, Vhost: nil, MTU: nil},
+			expected: nil,
+		},
+		{
+			name:     "queues more than max cpus",
+			network:  &GuestNetwork{Queues: 5, Vhost: nil, MTU: nil},
+			expected: []string{"spec.guest.network.queues: Invalid value"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.CPUs.Max = MilliCPU(3500)
+			vm.Spec.Guest.Network = c.network
+
+			errs := vm.validateGuestNetwork()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateDevices(t *testing.T) {
+	cases := []struct {
+		name         string
+		devices      []GuestDevice
+		confidential bool
+		expected     []string
+	}{
+		{
+			name: "valid",
+			devices: []GuestDevice{
+				{Name: "gpu0", ResourceName: "nvidia.com/GA100", Type: GuestDeviceTypePCI},
+				{Name: "gpu1", ResourceName: "nvidia.com/GRID_A100-4C", Type: GuestDeviceTypeMediated},
+			},
+			confidential: false,
+			expected:     nil,
+		},
+		{
+			name: "not extended resources",
+			devices: []GuestDevice{
+				{Name: "a", ResourceName: "cpu", Type: GuestDeviceTypePCI},
+				{Name: "b", ResourceName: "kubernetes.io/gpu", Type: GuestDeviceTypePCI},
+				{Name: "c", ResourceName: "nvidia.com/not valid", Type: GuestDeviceTypePCI},
+			},
+			confidential: false,
+			expected: []string{
+				"spec.guest.devices[0].resourceName: Invalid value",
+				"spec.guest.devices[1].resourceName: Invalid value",
+				"spec.guest.devices[2].resourceName: Invalid value",
+			},
+		},
+		{
+			name: "confidential",
+			devices: []GuestDevice{
+				{Name: "gpu0", ResourceName: "nvidia.com/GA100", Type: GuestDeviceTypePCI},
+			},
+			confidential: true,
+			expected:     []string{"spec.guest.devices: Forbidden"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.Devices = c.devices
+			vm.Spec.EnableConfidentialCompute = lo.ToPtr(c.confidential)
+
+			errs := vm.validateDevices()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateCloudInit(t *testing.T) {
+	cases := []struct {
+		name      string
+		cloudInit *CloudInit
+		expected  []string
+	}{
+		{
+			name:      "unset",
+			cloudInit: nil,
+			expected:  nil,
+		},
+		{
+			name:      "inline",
+			cloudInit: &CloudInit{Format: CloudInitFormatNoCloud, UserData: lo.ToPtr("#cloud-config\n")},
+			expected:  nil,
+		},
+		{
+			name: "secret",
+			cloudInit: &CloudInit{
+				Format: CloudInitFormatIgnition,
+				UserDataSecretRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "ignition"},
+					Key:                  "config.ign",
+				},
+			},
+			expected: nil,
+		},
+		{
+			name:      "no user-data",
+			cloudInit: &CloudInit{Format: CloudInitFormatNoCloud},
+			expected:  []string{"spec.guest.cloudInit: Required value"},
+		},
+		{
+			name: "both",
+			cloudInit: &CloudInit{
+				Format:   CloudInitFormatNoCloud,
+				UserData: lo.ToPtr("#cloud-config\n"),
+				UserDataSecretRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: ""},
+					Key:                  "user-data",
+				},
+			},
+			expected: []string{
+				"spec.guest.cloudInit.userDataSecretRef: Forbidden",
+				"spec.guest.cloudInit.userDataSecretRef.name: Required value",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.CloudInit = c.cloudInit
+
+			errs := vm.validateCloudInit()
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
+
+func TestValidateMemoryBacking(t *testing.T) {
+	cases := []struct {
+		name             string
+		backing          *MemoryBacking
+		hugepageSize     string
+		memorySlotSize   string
+		confidential     bool
+		expected         []string
+		expectedResource corev1.ResourceName
+	}{
+		{
+			name:             "unset",
+			memorySlotSize:   "1Gi",
+			expected:         nil,
+			expectedResource: "",
+		},
+		{
+			name:             "default hugepage size",
+			backing:          lo.ToPtr(MemoryBackingHugepages),
+			memorySlotSize:   "1Gi",
+			expected:         nil,
+			expectedResource: "hugepages-2Mi",
+		},
+		{
+			name:             "1Gi hugepages",
+			backing:          lo.ToPtr(MemoryBackingHugepages),
+			hugepageSize:     "1Gi",
+			memorySlotSize:   "2Gi",
+			expected:         nil,
+			expectedResource: "hugepages-1Gi",
+		},
+		{
+			name:             "hugepage size without hugepages",
+			backing:          lo.ToPtr(MemoryBackingRAM),
+			hugepageSize:     "2Mi",
+			memorySlotSize:   "1Gi",
+			expected:         []string{"spec.guest.hugepageSize: Forbidden"},
+			expectedResource: "",
+		},
+		{
+			name:             "unsupported hugepage size",
+			backing:          lo.ToPtr(MemoryBackingHugepages),
+			hugepageSize:     "4Mi",
+			memorySlotSize:   "1Gi",
+			expected:         []string{"spec.guest.hugepageSize: Unsupported value"},
+			expectedResource: "hugepages-4Mi",
+		},
+		{
+			name:             "slot size not a multiple",
+			backing:          lo.ToPtr(MemoryBackingHugepages),
+			hugepageSize:     "1Gi",
+			memorySlotSize:   "512Mi",
+			expected:         []string{"spec.guest.memorySlotSize: Invalid value"},
+			expectedResource: "hugepages-1Gi",
+		},
+		{
+			name:             "confidential",
+			backing:          lo.ToPtr(MemoryBackingHugepages),
+			memorySlotSize:   "1Gi",
+			confidential:     true,
+			expected:         []string{"spec.guest.memoryBacking: Forbidden"},
+			expectedResource: "hugepages-2Mi",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &VirtualMachine{}
+			vm.Spec.Guest.MemoryBacking = c.backing
+			if c.hugepageSize != "" {
+				vm.Spec.Guest.HugepageSize = lo.ToPtr(resource.MustParse(c.hugepageSize))
+			}
+			vm.Spec.Guest.MemorySlotSize = resource.MustParse(c.memorySlotSize)
+			vm.Spec.EnableConfidentialCompute = lo.ToPtr(c.confidential)
+
+			errs := vm.validateMemoryBacking()
+			assertFieldErrors(t, errs, c.expected)
+
+			if name := vm.Spec.Guest.HugepagesResourceName(); name != c.expectedResource {
+				t.Errorf("expected hugepages resource %q, got %q", c.expectedResource, name)
+			}
+		})
+	}
+}
+
+func TestValidateIOLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		limits   *DiskIOLimits
+		expected []string
+	}{
+		{
+			name:     "unset",
+			limits:   nil,
+			expected: nil,
+		},
+		{
+			name: "valid",
+			limits: &DiskIOLimits{
+				ReadIOPS:       lo.ToPtr[int64](1000),
+				WriteIOPS:      lo.ToPtr[int64](500),
+				TotalBandwidth: lo.ToPtr(resource.MustParse("100Mi")),
+			},
+			expected: nil,
+		},
+		{
+			name: "total with read or write",
+			limits: &DiskIOLimits{
+				TotalIOPS:      lo.ToPtr[int64](1000),
+				ReadIOPS:       lo.ToPtr[int64](1000),
+				TotalBandwidth: lo.ToPtr(resource.MustParse("100Mi")),
+				WriteBandwidth: lo.ToPtr(resource.MustParse("50Mi")),
+			},
+			expected: []string{
+				"spec.guest.rootDisk.ioLimits.totalIOPS: Forbidden",
+				"spec.guest.rootDisk.ioLimits.totalBandwidth: Forbidden",
+			},
+		},
+		{
+			name: "zero bandwidth",
+			limits: &DiskIOLimits{
+				ReadBandwidth: lo.ToPtr(resource.MustParse("0")),
+			},
+			expected: []string{"spec.guest.rootDisk.ioLimits.readBandwidth: Invalid value"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := validateIOLimits(field.NewPath("spec", "guest", "rootDisk", "ioLimits"), c.limits)
+			assertFieldErrors(t, errs, c.expected)
+		})
+	}
+}
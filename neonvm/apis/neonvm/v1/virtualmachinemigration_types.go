@@ -17,6 +17,9 @@ limitations under the License.
 package v1
 
 import (
+	"fmt"
+	"slices"
+
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -57,6 +60,19 @@ type VirtualMachineMigrationSpec struct {
 	// +kubebuilder:default:=false
 	AllowPostCopy bool `json:"allowPostCopy"`
 
+	// PostCopyAfterIterations gives the number of pre-copy passes over the VM's memory after which
+	// the migration switches to post-copy, with allowPostCopy. Zero switches immediately.
+	//
+	// Once post-copy starts, the VM runs on the target, which fetches the remaining memory from the
+	// source on demand - so the migration completes in bounded time, but can no longer be rolled
+	// back to the source if it fails.
+	//
+	// If not set, the controller's default is used (see its '-migration-postcopy-after-iterations'
+	// flag).
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	PostCopyAfterIterations *int32 `json:"postCopyAfterIterations,omitempty"`
+
 	// Use Auto converge by default
 	// +optional
 	// +kubebuilder:default:=true
@@ -66,6 +82,57 @@ type VirtualMachineMigrationSpec struct {
 	// +optional
 	// +kubebuilder:default:="1Gi"
 	MaxBandwidth resource.Quantity `json:"maxBandwidth"`
+
+	// DowntimeLimitMilliseconds gives the maximum time, in milliseconds, that the VM may be paused
+	// for at the end of the migration, while the remaining memory is copied. Larger values let
+	// busy VMs converge sooner, at the cost of a longer pause.
+	// If not set, the controller's default is used (see its '-migration-downtime-limit' flag).
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=2000000
+	DowntimeLimitMilliseconds *int64 `json:"downtimeLimitMilliseconds,omitempty"`
+
+	// MultifdChannels gives the number of parallel connections to send memory over. Zero disables
+	// multifd, which sends everything over a single connection. Multifd can't be used with
+	// allowPostCopy.
+	// If not set, the controller's default is used (see its '-migration-multifd-channels' flag).
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=255
+	MultifdChannels *int32 `json:"multifdChannels,omitempty"`
+
+	// Compression selects how memory is compressed while it's sent. Zstd requires multifd; without
+	// it, QEMU only supports zlib compression.
+	// If not set, the controller's default is used (see its '-migration-compression' flag).
+	// +optional
+	Compression *MigrationCompression `json:"compression,omitempty"`
+}
+
+// MigrationCompression selects how memory is compressed during migration
+//
+// +kubebuilder:validation:Enum=None;Zlib;Zstd
+type MigrationCompression string
+
+const (
+	MigrationCompressionNone MigrationCompression = "None"
+	MigrationCompressionZlib MigrationCompression = "Zlib"
+	MigrationCompressionZstd MigrationCompression = "Zstd"
+)
+
+// FlagFunc is a parsing function to be used with flag.Func
+func (c *MigrationCompression) FlagFunc(value string) error {
+	possibleValues := []string{
+		string(MigrationCompressionNone),
+		string(MigrationCompressionZlib),
+		string(MigrationCompressionZstd),
+	}
+
+	if !slices.Contains(possibleValues, value) {
+		return fmt.Errorf("Unknown MigrationCompression %q, must be one of %v", value, possibleValues)
+	}
+
+	*c = MigrationCompression(value)
+	return nil
 }
 
 // VirtualMachineMigrationStatus defines the observed state of VirtualMachineMigration
@@ -88,6 +155,10 @@ type VirtualMachineMigrationStatus struct {
 	SourcePodName string `json:"sourcePodName,omitempty"`
 	// +optional
 	TargetPodName string `json:"targetPodName,omitempty"`
+	// PostCopyStarted is true once the migration has switched to post-copy. From then on, the
+	// target runner pod is authoritative for the VM.
+	// +optional
+	PostCopyStarted bool `json:"postCopyStarted,omitempty"`
 	// +optional
 	SourcePodIP string `json:"sourcePodIP,omitempty"`
 	// +optional
@@ -21,7 +21,9 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 func (r *VirtualMachineMigration) SetupWebhookWithManager(mgr ctrl.Manager) error {
@@ -45,14 +47,42 @@ var _ webhook.Validator = &VirtualMachineMigration{}
 
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (r *VirtualMachineMigration) ValidateCreate() (admission.Warnings, error) {
-	// TODO: implement creation validation webhook (?)
-	return nil, nil
+	return nil, r.toAggregate(r.validateTunables())
+}
+
+// validateTunables checks that the migration tunables that are set can be used together. Those
+// that aren't set are filled in from the controller's defaults, which it checks on startup.
+func (r *VirtualMachineMigration) validateTunables() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	multifd := r.Spec.MultifdChannels != nil && *r.Spec.MultifdChannels > 0
+	if multifd && r.Spec.AllowPostCopy {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("multifdChannels"), "cannot be used with allowPostCopy"))
+	}
+
+	if r.Spec.PostCopyAfterIterations != nil && !r.Spec.AllowPostCopy {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("postCopyAfterIterations"), "requires allowPostCopy"))
+	}
+
+	noMultifd := r.Spec.AllowPostCopy || (r.Spec.MultifdChannels != nil && *r.Spec.MultifdChannels == 0)
+	if r.Spec.Compression != nil && *r.Spec.Compression == MigrationCompressionZstd && noMultifd {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("compression"), *r.Spec.Compression, "Zstd requires multifd"))
+	}
+
+	return allErrs
+}
+
+func (r *VirtualMachineMigration) toAggregate(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(SchemeGroupVersion.WithKind("VirtualMachineMigration").GroupKind(), r.Name, allErrs)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *VirtualMachineMigration) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
-	// TODO: implement update validation webhook
-	return nil, nil
+	return nil, r.toAggregate(r.validateTunables())
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
@@ -0,0 +1,183 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SnapshotExportPort is the port on which neonvm-runner serves the files of in-progress snapshots
+const SnapshotExportPort int32 = 20188
+
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// VirtualMachineSnapshotSpec defines the desired state of VirtualMachineSnapshot
+type VirtualMachineSnapshotSpec struct {
+	VmName string `json:"vmName"`
+
+	// IncludeMemory, if true, also saves the guest's memory and device state, so that the VM can be
+	// resumed from exactly where it was. The guest is paused while its memory is being saved.
+	//
+	// Otherwise, only the disks are saved, and the guest keeps running throughout.
+	// +optional
+	// +kubebuilder:default:=false
+	IncludeMemory bool `json:"includeMemory"`
+
+	// Target is where the snapshot is written to
+	Target SnapshotTarget `json:"target"`
+}
+
+// SnapshotTarget is the location that a snapshot is exported to. Exactly one of the fields must be
+// set.
+type SnapshotTarget struct {
+	// +optional
+	ObjectStorage *SnapshotObjectStorageTarget `json:"objectStorage,omitempty"`
+	// +optional
+	PersistentVolumeClaim *SnapshotPVCTarget `json:"persistentVolumeClaim,omitempty"`
+}
+
+type SnapshotObjectStorageTarget struct {
+	Bucket string `json:"bucket"`
+	// +optional
+	Region string `json:"region,omitempty"`
+	// Prefix is prepended to the key of each object in the snapshot. The snapshot's objects are
+	// stored under "<prefix>/<namespace>/<snapshot name>/".
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+	// Endpoint, if not empty, overrides the default S3 endpoint (e.g. for minio)
+	// +optional
+	Endpoint string `json:"endpoint,omitempty"`
+	// CredentialsSecretName is the name of a Secret in the snapshot's namespace containing
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. If empty, the export job's default credentials
+	// are used.
+	// +optional
+	CredentialsSecretName string `json:"credentialsSecretName,omitempty"`
+}
+
+type SnapshotPVCTarget struct {
+	// ClaimName is the name of a PersistentVolumeClaim in the snapshot's namespace
+	ClaimName string `json:"claimName"`
+	// Path is the directory within the volume that the snapshot is written into. Defaults to the
+	// snapshot's name.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// VirtualMachineSnapshotStatus defines the observed state of VirtualMachineSnapshot
+type VirtualMachineSnapshotStatus struct {
+	// Represents the observations of a VirtualMachineSnapshot's current state.
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+
+	// The phase of a snapshot is a simple, high-level summary of where it is in its lifecycle.
+	// +optional
+	Phase VmsPhase `json:"phase,omitempty"`
+	// PodName is the name of the runner pod that the snapshot is taken from
+	// +optional
+	PodName string `json:"podName,omitempty"`
+	// +optional
+	PodIP string `json:"podIP,omitempty"`
+	// ExportJobName is the name of the Job copying the snapshot to its target
+	// +optional
+	ExportJobName string `json:"exportJobName,omitempty"`
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Restore contains everything required to recreate the VM from this snapshot. It's set when
+	// capturing begins, but can only be used once the snapshot has succeeded.
+	// +optional
+	Restore *SnapshotRestoreInfo `json:"restore,omitempty"`
+}
+
+// SnapshotRestoreInfo records the contents and location of a completed snapshot
+type SnapshotRestoreInfo struct {
+	// Location is the URI of the directory containing the snapshot's files: either
+	// "s3://<bucket>/<key prefix>" or "pvc://<claim name>/<path>".
+	Location string `json:"location"`
+	// Disks lists the disks that were saved, with their file names relative to Location
+	Disks []SnapshotDisk `json:"disks"`
+	// MemoryFile, if not empty, is the file name (relative to Location) of the gzip-compressed
+	// memory and device state
+	// +optional
+	MemoryFile string `json:"memoryFile,omitempty"`
+	// Guest is the VM's guest spec at the time of the snapshot. The VM must be restored with the
+	// same CPU and memory configuration in order to load saved memory.
+	Guest Guest `json:"guest"`
+	// MemoryProvider is the memory provider the VM was running with
+	// +optional
+	MemoryProvider *MemoryProvider `json:"memoryProvider,omitempty"`
+	// CPUScalingMode is the CPU scaling mode the VM was running with
+	// +optional
+	CPUScalingMode *CPUScalingMode `json:"cpuScalingMode,omitempty"`
+}
+
+type SnapshotDisk struct {
+	// Name is the QEMU drive ID of the disk - "rootdisk", or the name of one of spec.disks
+	Name string `json:"name"`
+	// File is the name of the qcow2 image, relative to the snapshot's location
+	File string `json:"file"`
+}
+
+type VmsPhase string
+
+const (
+	// VmsPending means the snapshot has been accepted by the system, but is waiting for the VM
+	// to be running.
+	VmsPending VmsPhase = "Pending"
+	// VmsCapturing means the VM's disks (and memory) are being saved within the runner pod
+	VmsCapturing VmsPhase = "Capturing"
+	// VmsExporting means the saved files are being copied to the snapshot's target
+	VmsExporting VmsPhase = "Exporting"
+	// VmsSucceeded means that the snapshot is complete, and can be restored from
+	VmsSucceeded VmsPhase = "Succeeded"
+	// VmsFailed means that the snapshot failed
+	VmsFailed VmsPhase = "Failed"
+)
+
+//+genclient
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:singular=neonvms
+
+// VirtualMachineSnapshot is the Schema for the virtualmachinesnapshots API
+// +kubebuilder:printcolumn:name="VM",type=string,JSONPath=`.spec.vmName`
+// +kubebuilder:printcolumn:name="Memory",type=boolean,JSONPath=`.spec.includeMemory`
+// +kubebuilder:printcolumn:name="Pod",type=string,priority=1,JSONPath=`.status.podName`
+// +kubebuilder:printcolumn:name="Location",type=string,priority=1,JSONPath=`.status.restore.location`
+// +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+type VirtualMachineSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   VirtualMachineSnapshotSpec   `json:"spec,omitempty"`
+	Status VirtualMachineSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// VirtualMachineSnapshotList contains a list of VirtualMachineSnapshot
+type VirtualMachineSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineSnapshot{}, &VirtualMachineSnapshotList{}) //nolint:exhaustruct // just being used to provide the types
+}
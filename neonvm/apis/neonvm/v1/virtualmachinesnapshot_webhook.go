@@ -0,0 +1,100 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"reflect"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func (r *VirtualMachineSnapshot) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-vm-neon-tech-v1-virtualmachinesnapshot,mutating=false,failurePolicy=fail,sideEffects=None,groups=vm.neon.tech,resources=virtualmachinesnapshots,verbs=create;update,versions=v1,name=vvirtualmachinesnapshot.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &VirtualMachineSnapshot{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachineSnapshot) ValidateCreate() (admission.Warnings, error) {
+	var allErrs field.ErrorList
+
+	if r.Spec.VmName == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("spec", "vmName"), ""))
+	}
+
+	allErrs = append(allErrs, validateSnapshotTarget(field.NewPath("spec", "target"), r.Spec.Target)...)
+
+	return nil, r.toAggregate(allErrs)
+}
+
+// validateSnapshotTarget checks that exactly one of the target's locations is set, and that it's
+// complete. It's also used for .spec.cloneFrom.target of VirtualMachines.
+func validateSnapshotTarget(targetPath *field.Path, target SnapshotTarget) field.ErrorList {
+	var allErrs field.ErrorList
+
+	switch {
+	case target.ObjectStorage == nil && target.PersistentVolumeClaim == nil:
+		allErrs = append(allErrs, field.Required(targetPath, "one of objectStorage or persistentVolumeClaim must be set"))
+	case target.ObjectStorage != nil && target.PersistentVolumeClaim != nil:
+		allErrs = append(allErrs, field.Forbidden(targetPath, "only one of objectStorage or persistentVolumeClaim may be set"))
+	case target.ObjectStorage != nil:
+		if target.ObjectStorage.Bucket == "" {
+			allErrs = append(allErrs, field.Required(targetPath.Child("objectStorage", "bucket"), ""))
+		}
+	case target.PersistentVolumeClaim != nil:
+		if target.PersistentVolumeClaim.ClaimName == "" {
+			allErrs = append(allErrs, field.Required(targetPath.Child("persistentVolumeClaim", "claimName"), ""))
+		}
+	}
+
+	return allErrs
+}
+
+func (r *VirtualMachineSnapshot) toAggregate(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(SchemeGroupVersion.WithKind("VirtualMachineSnapshot").GroupKind(), r.Name, allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachineSnapshot) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	before, _ := old.(*VirtualMachineSnapshot)
+
+	var allErrs field.ErrorList
+	if !reflect.DeepEqual(r.Spec, before.Spec) {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec"), "field is immutable"))
+	}
+
+	return nil, r.toAggregate(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachineSnapshot) ValidateDelete() (admission.Warnings, error) {
+	// No deletion validation required currently.
+	return nil, nil
+}
@@ -27,6 +27,76 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoscalingPause) DeepCopyInto(out *AutoscalingPause) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoscalingPause.
+func (in *AutoscalingPause) DeepCopy() *AutoscalingPause {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoscalingPause)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AutoscalingSpec) DeepCopyInto(out *AutoscalingSpec) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Pause != nil {
+		in, out := &in.Pause, &out.Pause
+		*out = new(AutoscalingPause)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AutoscalingSpec.
+func (in *AutoscalingSpec) DeepCopy() *AutoscalingSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AutoscalingSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUBurst) DeepCopyInto(out *CPUBurst) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUBurst.
+func (in *CPUBurst) DeepCopy() *CPUBurst {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUBurst)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CPUBurstStatus) DeepCopyInto(out *CPUBurstStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CPUBurstStatus.
+func (in *CPUBurstStatus) DeepCopy() *CPUBurstStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(CPUBurstStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *CPUs) DeepCopyInto(out *CPUs) {
 	*out = *in
@@ -42,6 +112,47 @@ func (in *CPUs) DeepCopy() *CPUs {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloneFrom) DeepCopyInto(out *CloneFrom) {
+	*out = *in
+	in.Target.DeepCopyInto(&out.Target)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloneFrom.
+func (in *CloneFrom) DeepCopy() *CloneFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(CloneFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CloudInit) DeepCopyInto(out *CloudInit) {
+	*out = *in
+	if in.UserData != nil {
+		in, out := &in.UserData, &out.UserData
+		*out = new(string)
+		**out = **in
+	}
+	if in.UserDataSecretRef != nil {
+		in, out := &in.UserDataSecretRef, &out.UserDataSecretRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CloudInit.
+func (in *CloudInit) DeepCopy() *CloudInit {
+	if in == nil {
+		return nil
+	}
+	out := new(CloudInit)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Disk) DeepCopyInto(out *Disk) {
 	*out = *in
@@ -50,6 +161,11 @@ func (in *Disk) DeepCopyInto(out *Disk) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.IOLimits != nil {
+		in, out := &in.IOLimits, &out.IOLimits
+		*out = new(DiskIOLimits)
+		(*in).DeepCopyInto(*out)
+	}
 	in.DiskSource.DeepCopyInto(&out.DiskSource)
 }
 
@@ -63,6 +179,51 @@ func (in *Disk) DeepCopy() *Disk {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiskIOLimits) DeepCopyInto(out *DiskIOLimits) {
+	*out = *in
+	if in.TotalIOPS != nil {
+		in, out := &in.TotalIOPS, &out.TotalIOPS
+		*out = new(int64)
+		**out = **in
+	}
+	if in.ReadIOPS != nil {
+		in, out := &in.ReadIOPS, &out.ReadIOPS
+		*out = new(int64)
+		**out = **in
+	}
+	if in.WriteIOPS != nil {
+		in, out := &in.WriteIOPS, &out.WriteIOPS
+		*out = new(int64)
+		**out = **in
+	}
+	if in.TotalBandwidth != nil {
+		in, out := &in.TotalBandwidth, &out.TotalBandwidth
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.ReadBandwidth != nil {
+		in, out := &in.ReadBandwidth, &out.ReadBandwidth
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.WriteBandwidth != nil {
+		in, out := &in.WriteBandwidth, &out.WriteBandwidth
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiskIOLimits.
+func (in *DiskIOLimits) DeepCopy() *DiskIOLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(DiskIOLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DiskSource) DeepCopyInto(out *DiskSource) {
 	*out = *in
@@ -86,6 +247,11 @@ func (in *DiskSource) DeepCopyInto(out *DiskSource) {
 		*out = new(TmpfsDiskSource)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.VolumeSnapshot != nil {
+		in, out := &in.VolumeSnapshot, &out.VolumeSnapshot
+		*out = new(VolumeSnapshotDiskSource)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiskSource.
@@ -147,6 +313,11 @@ func (in *ExtraNetwork) DeepCopy() *ExtraNetwork {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Guest) DeepCopyInto(out *Guest) {
 	*out = *in
+	if in.EnableGuestAgent != nil {
+		in, out := &in.EnableGuestAgent, &out.EnableGuestAgent
+		*out = new(bool)
+		**out = **in
+	}
 	if in.KernelImage != nil {
 		in, out := &in.KernelImage, &out.KernelImage
 		*out = new(string)
@@ -157,7 +328,22 @@ func (in *Guest) DeepCopyInto(out *Guest) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.KernelCmdline != nil {
+		in, out := &in.KernelCmdline, &out.KernelCmdline
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	out.CPUs = in.CPUs
+	if in.CPUBurst != nil {
+		in, out := &in.CPUBurst, &out.CPUBurst
+		*out = new(CPUBurst)
+		**out = **in
+	}
+	if in.CPUScalingMode != nil {
+		in, out := &in.CPUScalingMode, &out.CPUScalingMode
+		*out = new(CPUScalingMode)
+		**out = **in
+	}
 	out.MemorySlotSize = in.MemorySlotSize.DeepCopy()
 	out.MemorySlots = in.MemorySlots
 	if in.MemoryProvider != nil {
@@ -165,6 +351,16 @@ func (in *Guest) DeepCopyInto(out *Guest) {
 		*out = new(MemoryProvider)
 		**out = **in
 	}
+	if in.MemoryBacking != nil {
+		in, out := &in.MemoryBacking, &out.MemoryBacking
+		*out = new(MemoryBacking)
+		**out = **in
+	}
+	if in.HugepageSize != nil {
+		in, out := &in.HugepageSize, &out.HugepageSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
 	in.RootDisk.DeepCopyInto(&out.RootDisk)
 	if in.Command != nil {
 		in, out := &in.Command, &out.Command
@@ -181,11 +377,36 @@ func (in *Guest) DeepCopyInto(out *Guest) {
 		*out = make([]EnvVar, len(*in))
 		copy(*out, *in)
 	}
+	if in.Network != nil {
+		in, out := &in.Network, &out.Network
+		*out = new(GuestNetwork)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Ports != nil {
 		in, out := &in.Ports, &out.Ports
 		*out = make([]Port, len(*in))
 		copy(*out, *in)
 	}
+	if in.PortForwarding != nil {
+		in, out := &in.PortForwarding, &out.PortForwarding
+		*out = new(PortForwarding)
+		**out = **in
+	}
+	if in.Devices != nil {
+		in, out := &in.Devices, &out.Devices
+		*out = make([]GuestDevice, len(*in))
+		copy(*out, *in)
+	}
+	if in.CloudInit != nil {
+		in, out := &in.CloudInit, &out.CloudInit
+		*out = new(CloudInit)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ReadinessProbe != nil {
+		in, out := &in.ReadinessProbe, &out.ReadinessProbe
+		*out = new(GuestProbe)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Settings != nil {
 		in, out := &in.Settings, &out.Settings
 		*out = new(GuestSettings)
@@ -203,6 +424,111 @@ func (in *Guest) DeepCopy() *Guest {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestExecAction) DeepCopyInto(out *GuestExecAction) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestExecAction.
+func (in *GuestExecAction) DeepCopy() *GuestExecAction {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestExecAction)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestDevice) DeepCopyInto(out *GuestDevice) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestDevice.
+func (in *GuestDevice) DeepCopy() *GuestDevice {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestDevice)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestHTTPGetAction) DeepCopyInto(out *GuestHTTPGetAction) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestHTTPGetAction.
+func (in *GuestHTTPGetAction) DeepCopy() *GuestHTTPGetAction {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestHTTPGetAction)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestNetwork) DeepCopyInto(out *GuestNetwork) {
+	*out = *in
+	if in.Vhost != nil {
+		in, out := &in.Vhost, &out.Vhost
+		*out = new(bool)
+		**out = **in
+	}
+	if in.MTU != nil {
+		in, out := &in.MTU, &out.MTU
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestNetwork.
+func (in *GuestNetwork) DeepCopy() *GuestNetwork {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestNetwork)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestProbe) DeepCopyInto(out *GuestProbe) {
+	*out = *in
+	if in.HTTPGet != nil {
+		in, out := &in.HTTPGet, &out.HTTPGet
+		*out = new(GuestHTTPGetAction)
+		**out = **in
+	}
+	if in.TCPSocket != nil {
+		in, out := &in.TCPSocket, &out.TCPSocket
+		*out = new(GuestTCPSocketAction)
+		**out = **in
+	}
+	if in.Exec != nil {
+		in, out := &in.Exec, &out.Exec
+		*out = new(GuestExecAction)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestProbe.
+func (in *GuestProbe) DeepCopy() *GuestProbe {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestProbe)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GuestSettings) DeepCopyInto(out *GuestSettings) {
 	*out = *in
@@ -233,6 +559,21 @@ func (in *GuestSettings) DeepCopy() *GuestSettings {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GuestTCPSocketAction) DeepCopyInto(out *GuestTCPSocketAction) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GuestTCPSocketAction.
+func (in *GuestTCPSocketAction) DeepCopy() *GuestTCPSocketAction {
+	if in == nil {
+		return nil
+	}
+	out := new(GuestTCPSocketAction)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *IPAllocation) DeepCopyInto(out *IPAllocation) {
 	*out = *in
@@ -288,140 +629,356 @@ func (in *IPPoolList) DeepCopyInto(out *IPPoolList) {
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPPoolList.
-func (in *IPPoolList) DeepCopy() *IPPoolList {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPPoolList.
+func (in *IPPoolList) DeepCopy() *IPPoolList {
+	if in == nil {
+		return nil
+	}
+	out := new(IPPoolList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *IPPoolList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
+	*out = *in
+	if in.Allocations != nil {
+		in, out := &in.Allocations, &out.Allocations
+		*out = make(map[string]IPAllocation, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPPoolSpec.
+func (in *IPPoolSpec) DeepCopy() *IPPoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(IPPoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MemorySlots) DeepCopyInto(out *MemorySlots) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MemorySlots.
+func (in *MemorySlots) DeepCopy() *MemorySlots {
+	if in == nil {
+		return nil
+	}
+	out := new(MemorySlots)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MigrationInfo) DeepCopyInto(out *MigrationInfo) {
+	*out = *in
+	out.Ram = in.Ram
+	out.Compression = in.Compression
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfo.
+func (in *MigrationInfo) DeepCopy() *MigrationInfo {
+	if in == nil {
+		return nil
+	}
+	out := new(MigrationInfo)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MigrationInfoCompression) DeepCopyInto(out *MigrationInfoCompression) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfoCompression.
+func (in *MigrationInfoCompression) DeepCopy() *MigrationInfoCompression {
+	if in == nil {
+		return nil
+	}
+	out := new(MigrationInfoCompression)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MigrationInfoRam) DeepCopyInto(out *MigrationInfoRam) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfoRam.
+func (in *MigrationInfoRam) DeepCopy() *MigrationInfoRam {
+	if in == nil {
+		return nil
+	}
+	out := new(MigrationInfoRam)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MigrationPolicy) DeepCopyInto(out *MigrationPolicy) {
+	*out = *in
+	if in.SpreadAcross != nil {
+		in, out := &in.SpreadAcross, &out.SpreadAcross
+		*out = make([]FailureDomain, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationPolicy.
+func (in *MigrationPolicy) DeepCopy() *MigrationPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(MigrationPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Port) DeepCopyInto(out *Port) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Port.
+func (in *Port) DeepCopy() *Port {
+	if in == nil {
+		return nil
+	}
+	out := new(Port)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RestoreFrom) DeepCopyInto(out *RestoreFrom) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RestoreFrom.
+func (in *RestoreFrom) DeepCopy() *RestoreFrom {
+	if in == nil {
+		return nil
+	}
+	out := new(RestoreFrom)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RootDisk) DeepCopyInto(out *RootDisk) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	if in.Execute != nil {
+		in, out := &in.Execute, &out.Execute
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Streaming != nil {
+		in, out := &in.Streaming, &out.Streaming
+		*out = new(RootDiskStreaming)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.BaseImageCache != nil {
+		in, out := &in.BaseImageCache, &out.BaseImageCache
+		*out = new(RootDiskBaseImageCache)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Platform != nil {
+		in, out := &in.Platform, &out.Platform
+		*out = new(RootDiskPlatform)
+		**out = **in
+	}
+	if in.IOLimits != nil {
+		in, out := &in.IOLimits, &out.IOLimits
+		*out = new(DiskIOLimits)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootDisk.
+func (in *RootDisk) DeepCopy() *RootDisk {
+	if in == nil {
+		return nil
+	}
+	out := new(RootDisk)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RootDiskBaseImageCache) DeepCopyInto(out *RootDiskBaseImageCache) {
+	*out = *in
+	if in.HostPath != nil {
+		in, out := &in.HostPath, &out.HostPath
+		*out = new(string)
+		**out = **in
+	}
+	if in.PersistentVolumeClaim != nil {
+		in, out := &in.PersistentVolumeClaim, &out.PersistentVolumeClaim
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootDiskBaseImageCache.
+func (in *RootDiskBaseImageCache) DeepCopy() *RootDiskBaseImageCache {
 	if in == nil {
 		return nil
 	}
-	out := new(IPPoolList)
+	out := new(RootDiskBaseImageCache)
 	in.DeepCopyInto(out)
 	return out
 }
 
-// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *IPPoolList) DeepCopyObject() runtime.Object {
-	if c := in.DeepCopy(); c != nil {
-		return c
-	}
-	return nil
-}
-
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *IPPoolSpec) DeepCopyInto(out *IPPoolSpec) {
+func (in *RootDiskPlatform) DeepCopyInto(out *RootDiskPlatform) {
 	*out = *in
-	if in.Allocations != nil {
-		in, out := &in.Allocations, &out.Allocations
-		*out = make(map[string]IPAllocation, len(*in))
-		for key, val := range *in {
-			(*out)[key] = val
-		}
-	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IPPoolSpec.
-func (in *IPPoolSpec) DeepCopy() *IPPoolSpec {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootDiskPlatform.
+func (in *RootDiskPlatform) DeepCopy() *RootDiskPlatform {
 	if in == nil {
 		return nil
 	}
-	out := new(IPPoolSpec)
+	out := new(RootDiskPlatform)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *MemorySlots) DeepCopyInto(out *MemorySlots) {
+func (in *RootDiskStreaming) DeepCopyInto(out *RootDiskStreaming) {
 	*out = *in
+	if in.Prefetch != nil {
+		in, out := &in.Prefetch, &out.Prefetch
+		*out = new(bool)
+		**out = **in
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MemorySlots.
-func (in *MemorySlots) DeepCopy() *MemorySlots {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootDiskStreaming.
+func (in *RootDiskStreaming) DeepCopy() *RootDiskStreaming {
 	if in == nil {
 		return nil
 	}
-	out := new(MemorySlots)
+	out := new(RootDiskStreaming)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *MigrationInfo) DeepCopyInto(out *MigrationInfo) {
+func (in *SnapshotDisk) DeepCopyInto(out *SnapshotDisk) {
 	*out = *in
-	out.Ram = in.Ram
-	out.Compression = in.Compression
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfo.
-func (in *MigrationInfo) DeepCopy() *MigrationInfo {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotDisk.
+func (in *SnapshotDisk) DeepCopy() *SnapshotDisk {
 	if in == nil {
 		return nil
 	}
-	out := new(MigrationInfo)
+	out := new(SnapshotDisk)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *MigrationInfoCompression) DeepCopyInto(out *MigrationInfoCompression) {
+func (in *SnapshotObjectStorageTarget) DeepCopyInto(out *SnapshotObjectStorageTarget) {
 	*out = *in
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfoCompression.
-func (in *MigrationInfoCompression) DeepCopy() *MigrationInfoCompression {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotObjectStorageTarget.
+func (in *SnapshotObjectStorageTarget) DeepCopy() *SnapshotObjectStorageTarget {
 	if in == nil {
 		return nil
 	}
-	out := new(MigrationInfoCompression)
+	out := new(SnapshotObjectStorageTarget)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *MigrationInfoRam) DeepCopyInto(out *MigrationInfoRam) {
+func (in *SnapshotPVCTarget) DeepCopyInto(out *SnapshotPVCTarget) {
 	*out = *in
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigrationInfoRam.
-func (in *MigrationInfoRam) DeepCopy() *MigrationInfoRam {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotPVCTarget.
+func (in *SnapshotPVCTarget) DeepCopy() *SnapshotPVCTarget {
 	if in == nil {
 		return nil
 	}
-	out := new(MigrationInfoRam)
+	out := new(SnapshotPVCTarget)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *Port) DeepCopyInto(out *Port) {
+func (in *SnapshotRestoreInfo) DeepCopyInto(out *SnapshotRestoreInfo) {
 	*out = *in
+	if in.Disks != nil {
+		in, out := &in.Disks, &out.Disks
+		*out = make([]SnapshotDisk, len(*in))
+		copy(*out, *in)
+	}
+	in.Guest.DeepCopyInto(&out.Guest)
+	if in.MemoryProvider != nil {
+		in, out := &in.MemoryProvider, &out.MemoryProvider
+		*out = new(MemoryProvider)
+		**out = **in
+	}
+	if in.CPUScalingMode != nil {
+		in, out := &in.CPUScalingMode, &out.CPUScalingMode
+		*out = new(CPUScalingMode)
+		**out = **in
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Port.
-func (in *Port) DeepCopy() *Port {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotRestoreInfo.
+func (in *SnapshotRestoreInfo) DeepCopy() *SnapshotRestoreInfo {
 	if in == nil {
 		return nil
 	}
-	out := new(Port)
+	out := new(SnapshotRestoreInfo)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *RootDisk) DeepCopyInto(out *RootDisk) {
+func (in *SnapshotTarget) DeepCopyInto(out *SnapshotTarget) {
 	*out = *in
-	out.Size = in.Size.DeepCopy()
-	if in.Execute != nil {
-		in, out := &in.Execute, &out.Execute
-		*out = make([]string, len(*in))
-		copy(*out, *in)
+	if in.ObjectStorage != nil {
+		in, out := &in.ObjectStorage, &out.ObjectStorage
+		*out = new(SnapshotObjectStorageTarget)
+		**out = **in
+	}
+	if in.PersistentVolumeClaim != nil {
+		in, out := &in.PersistentVolumeClaim, &out.PersistentVolumeClaim
+		*out = new(SnapshotPVCTarget)
+		**out = **in
 	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RootDisk.
-func (in *RootDisk) DeepCopy() *RootDisk {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SnapshotTarget.
+func (in *SnapshotTarget) DeepCopy() *SnapshotTarget {
 	if in == nil {
 		return nil
 	}
-	out := new(RootDisk)
+	out := new(SnapshotTarget)
 	in.DeepCopyInto(out)
 	return out
 }
@@ -435,6 +992,16 @@ func (in *SwapInfo) DeepCopyInto(out *SwapInfo) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.Policy != nil {
+		in, out := &in.Policy, &out.Policy
+		*out = new(SwapPolicy)
+		**out = **in
+	}
+	if in.MemoryPercent != nil {
+		in, out := &in.MemoryPercent, &out.MemoryPercent
+		*out = new(int32)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwapInfo.
@@ -447,6 +1014,29 @@ func (in *SwapInfo) DeepCopy() *SwapInfo {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TimeSyncStatus) DeepCopyInto(out *TimeSyncStatus) {
+	*out = *in
+	if in.PendingSince != nil {
+		in, out := &in.PendingSince, &out.PendingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TimeSyncStatus.
+func (in *TimeSyncStatus) DeepCopy() *TimeSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TimeSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TmpfsDiskSource) DeepCopyInto(out *TmpfsDiskSource) {
 	*out = *in
@@ -463,6 +1053,38 @@ func (in *TmpfsDiskSource) DeepCopy() *TmpfsDiskSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VMImageMetadata) DeepCopyInto(out *VMImageMetadata) {
+	*out = *in
+	if in.Platform != nil {
+		in, out := &in.Platform, &out.Platform
+		*out = new(RootDiskPlatform)
+		**out = **in
+	}
+	if in.MemorySlotSize != nil {
+		in, out := &in.MemorySlotSize, &out.MemorySlotSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Components != nil {
+		in, out := &in.Components, &out.Components
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VMImageMetadata.
+func (in *VMImageMetadata) DeepCopy() *VMImageMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(VMImageMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachine) DeepCopyInto(out *VirtualMachine) {
 	*out = *in
@@ -596,7 +1218,27 @@ func (in *VirtualMachineMigrationSpec) DeepCopyInto(out *VirtualMachineMigration
 		*out = new(corev1.NodeAffinity)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PostCopyAfterIterations != nil {
+		in, out := &in.PostCopyAfterIterations, &out.PostCopyAfterIterations
+		*out = new(int32)
+		**out = **in
+	}
 	out.MaxBandwidth = in.MaxBandwidth.DeepCopy()
+	if in.DowntimeLimitMilliseconds != nil {
+		in, out := &in.DowntimeLimitMilliseconds, &out.DowntimeLimitMilliseconds
+		*out = new(int64)
+		**out = **in
+	}
+	if in.MultifdChannels != nil {
+		in, out := &in.MultifdChannels, &out.MultifdChannels
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Compression != nil {
+		in, out := &in.Compression, &out.Compression
+		*out = new(MigrationCompression)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineMigrationSpec.
@@ -650,6 +1292,116 @@ func (in *VirtualMachineResources) DeepCopy() *VirtualMachineResources {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshot) DeepCopyInto(out *VirtualMachineSnapshot) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshot.
+func (in *VirtualMachineSnapshot) DeepCopy() *VirtualMachineSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineSnapshot) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotList) DeepCopyInto(out *VirtualMachineSnapshotList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]VirtualMachineSnapshot, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotList.
+func (in *VirtualMachineSnapshotList) DeepCopy() *VirtualMachineSnapshotList {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *VirtualMachineSnapshotList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotSpec) DeepCopyInto(out *VirtualMachineSnapshotSpec) {
+	*out = *in
+	in.Target.DeepCopyInto(&out.Target)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotSpec.
+func (in *VirtualMachineSnapshotSpec) DeepCopy() *VirtualMachineSnapshotSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineSnapshotStatus) DeepCopyInto(out *VirtualMachineSnapshotStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Restore != nil {
+		in, out := &in.Restore, &out.Restore
+		*out = new(SnapshotRestoreInfo)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSnapshotStatus.
+func (in *VirtualMachineSnapshotStatus) DeepCopy() *VirtualMachineSnapshotStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineSnapshotStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 	*out = *in
@@ -658,6 +1410,21 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = new(int64)
 		**out = **in
 	}
+	if in.RequiredCapabilities != nil {
+		in, out := &in.RequiredCapabilities, &out.RequiredCapabilities
+		*out = make([]NodeCapability, len(*in))
+		copy(*out, *in)
+	}
+	if in.MigrationPolicy != nil {
+		in, out := &in.MigrationPolicy, &out.MigrationPolicy
+		*out = new(MigrationPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Autoscaling != nil {
+		in, out := &in.Autoscaling, &out.Autoscaling
+		*out = new(AutoscalingSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.NodeSelector != nil {
 		in, out := &in.NodeSelector, &out.NodeSelector
 		*out = make(map[string]string, len(*in))
@@ -691,6 +1458,13 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.ExtraContainers != nil {
+		in, out := &in.ExtraContainers, &out.ExtraContainers
+		*out = make([]corev1.Container, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Disks != nil {
 		in, out := &in.Disks, &out.Disks
 		*out = make([]Disk, len(*in))
@@ -703,6 +1477,11 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = new(ExtraNetwork)
 		**out = **in
 	}
+	if in.IPFamilies != nil {
+		in, out := &in.IPFamilies, &out.IPFamilies
+		*out = make([]IPFamily, len(*in))
+		copy(*out, *in)
+	}
 	if in.ServiceLinks != nil {
 		in, out := &in.ServiceLinks, &out.ServiceLinks
 		*out = new(bool)
@@ -713,6 +1492,11 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.EnableConfidentialCompute != nil {
+		in, out := &in.EnableConfidentialCompute, &out.EnableConfidentialCompute
+		*out = new(bool)
+		**out = **in
+	}
 	if in.RunnerImage != nil {
 		in, out := &in.RunnerImage, &out.RunnerImage
 		*out = new(string)
@@ -723,6 +1507,16 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = new(bool)
 		**out = **in
 	}
+	if in.RestoreFrom != nil {
+		in, out := &in.RestoreFrom, &out.RestoreFrom
+		*out = new(RestoreFrom)
+		**out = **in
+	}
+	if in.CloneFrom != nil {
+		in, out := &in.CloneFrom, &out.CloneFrom
+		*out = new(CloneFrom)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineSpec.
@@ -745,11 +1539,25 @@ func (in *VirtualMachineStatus) DeepCopyInto(out *VirtualMachineStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.NextRestartTime != nil {
+		in, out := &in.NextRestartTime, &out.NextRestartTime
+		*out = (*in).DeepCopy()
+	}
 	if in.CPUs != nil {
 		in, out := &in.CPUs, &out.CPUs
 		*out = new(MilliCPU)
 		**out = **in
 	}
+	if in.CPUBurst != nil {
+		in, out := &in.CPUBurst, &out.CPUBurst
+		*out = new(CPUBurstStatus)
+		**out = **in
+	}
+	if in.CPUScalingMode != nil {
+		in, out := &in.CPUScalingMode, &out.CPUScalingMode
+		*out = new(CPUScalingMode)
+		**out = **in
+	}
 	if in.MemorySize != nil {
 		in, out := &in.MemorySize, &out.MemorySize
 		x := (*in).DeepCopy()
@@ -760,6 +1568,33 @@ func (in *VirtualMachineStatus) DeepCopyInto(out *VirtualMachineStatus) {
 		*out = new(MemoryProvider)
 		**out = **in
 	}
+	if in.SwapSize != nil {
+		in, out := &in.SwapSize, &out.SwapSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.HotplugDisks != nil {
+		in, out := &in.HotplugDisks, &out.HotplugDisks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DiskIOLimits != nil {
+		in, out := &in.DiskIOLimits, &out.DiskIOLimits
+		*out = make(map[string]DiskIOLimits, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
+	if in.TimeSync != nil {
+		in, out := &in.TimeSync, &out.TimeSync
+		*out = new(TimeSyncStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImageMetadata != nil {
+		in, out := &in.ImageMetadata, &out.ImageMetadata
+		*out = new(VMImageMetadata)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineStatus.
@@ -796,3 +1631,24 @@ func (in *VirtualMachineUsage) DeepCopy() *VirtualMachineUsage {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VolumeSnapshotDiskSource) DeepCopyInto(out *VolumeSnapshotDiskSource) {
+	*out = *in
+	out.Size = in.Size.DeepCopy()
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VolumeSnapshotDiskSource.
+func (in *VolumeSnapshotDiskSource) DeepCopy() *VolumeSnapshotDiskSource {
+	if in == nil {
+		return nil
+	}
+	out := new(VolumeSnapshotDiskSource)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -39,6 +39,10 @@ func (c *FakeNeonvmV1) VirtualMachineMigrations(namespace string) v1.VirtualMach
 	return &FakeVirtualMachineMigrations{c, namespace}
 }
 
+func (c *FakeNeonvmV1) VirtualMachineSnapshots(namespace string) v1.VirtualMachineSnapshotInterface {
+	return &FakeVirtualMachineSnapshots{c, namespace}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeNeonvmV1) RESTClient() rest.Interface {
@@ -22,3 +22,5 @@ type IPPoolExpansion interface{}
 type VirtualMachineExpansion interface{}
 
 type VirtualMachineMigrationExpansion interface{}
+
+type VirtualMachineSnapshotExpansion interface{}
@@ -30,6 +30,7 @@ type NeonvmV1Interface interface {
 	IPPoolsGetter
 	VirtualMachinesGetter
 	VirtualMachineMigrationsGetter
+	VirtualMachineSnapshotsGetter
 }
 
 // NeonvmV1Client is used to interact with features provided by the neonvm group.
@@ -49,6 +50,10 @@ func (c *NeonvmV1Client) VirtualMachineMigrations(namespace string) VirtualMachi
 	return newVirtualMachineMigrations(c, namespace)
 }
 
+func (c *NeonvmV1Client) VirtualMachineSnapshots(namespace string) VirtualMachineSnapshotInterface {
+	return newVirtualMachineSnapshots(c, namespace)
+}
+
 // NewForConfig creates a new NeonvmV1Client for the given config.
 // NewForConfig is equivalent to NewForConfigAndClient(c, httpClient),
 // where httpClient was generated with rest.HTTPClientFor(c).
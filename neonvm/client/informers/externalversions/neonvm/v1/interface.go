@@ -29,6 +29,8 @@ type Interface interface {
 	VirtualMachines() VirtualMachineInformer
 	// VirtualMachineMigrations returns a VirtualMachineMigrationInformer.
 	VirtualMachineMigrations() VirtualMachineMigrationInformer
+	// VirtualMachineSnapshots returns a VirtualMachineSnapshotInformer.
+	VirtualMachineSnapshots() VirtualMachineSnapshotInformer
 }
 
 type version struct {
@@ -56,3 +58,8 @@ func (v *version) VirtualMachines() VirtualMachineInformer {
 func (v *version) VirtualMachineMigrations() VirtualMachineMigrationInformer {
 	return &virtualMachineMigrationInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// VirtualMachineSnapshots returns a VirtualMachineSnapshotInformer.
+func (v *version) VirtualMachineSnapshots() VirtualMachineSnapshotInformer {
+	return &virtualMachineSnapshotInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
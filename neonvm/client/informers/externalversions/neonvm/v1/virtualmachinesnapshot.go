@@ -0,0 +1,89 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Code generated by informer-gen. DO NOT EDIT.
+
+package v1
+
+import (
+	"context"
+	time "time"
+
+	neonvmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	versioned "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	internalinterfaces "github.com/neondatabase/autoscaling/neonvm/client/informers/externalversions/internalinterfaces"
+	v1 "github.com/neondatabase/autoscaling/neonvm/client/listers/neonvm/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	watch "k8s.io/apimachinery/pkg/watch"
+	cache "k8s.io/client-go/tools/cache"
+)
+
+// VirtualMachineSnapshotInformer provides access to a shared informer and lister for
+// VirtualMachineSnapshots.
+type VirtualMachineSnapshotInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() v1.VirtualMachineSnapshotLister
+}
+
+type virtualMachineSnapshotInformer struct {
+	factory          internalinterfaces.SharedInformerFactory
+	tweakListOptions internalinterfaces.TweakListOptionsFunc
+	namespace        string
+}
+
+// NewVirtualMachineSnapshotInformer constructs a new informer for VirtualMachineSnapshot type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewVirtualMachineSnapshotInformer(client versioned.Interface, namespace string, resyncPeriod time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	return NewFilteredVirtualMachineSnapshotInformer(client, namespace, resyncPeriod, indexers, nil)
+}
+
+// NewFilteredVirtualMachineSnapshotInformer constructs a new informer for VirtualMachineSnapshot type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewFilteredVirtualMachineSnapshotInformer(client versioned.Interface, namespace string, resyncPeriod time.Duration, indexers cache.Indexers, tweakListOptions internalinterfaces.TweakListOptionsFunc) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.NeonvmV1().VirtualMachineSnapshots(namespace).List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.NeonvmV1().VirtualMachineSnapshots(namespace).Watch(context.TODO(), options)
+			},
+		},
+		&neonvmv1.VirtualMachineSnapshot{},
+		resyncPeriod,
+		indexers,
+	)
+}
+
+func (f *virtualMachineSnapshotInformer) defaultInformer(client versioned.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return NewFilteredVirtualMachineSnapshotInformer(client, f.namespace, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, f.tweakListOptions)
+}
+
+func (f *virtualMachineSnapshotInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&neonvmv1.VirtualMachineSnapshot{}, f.defaultInformer)
+}
+
+func (f *virtualMachineSnapshotInformer) Lister() v1.VirtualMachineSnapshotLister {
+	return v1.NewVirtualMachineSnapshotLister(f.Informer().GetIndexer())
+}
@@ -23,16 +23,43 @@ type ReconcilerConfig struct {
 
 	MaxConcurrentReconciles int
 
+	// NamespaceRateLimit sets the per-namespace rate limit for reconciles, so that a single
+	// namespace can't starve the others. See namespace_ratelimit.go for more.
+	NamespaceRateLimit NamespaceRateLimit
+
+	// ObjectRateLimit sets the per-object rate limit for reconciles, so that a single object can't
+	// hog the workers. See reconcile_concurrency.go for more.
+	ObjectRateLimit ObjectRateLimit
+
+	// MaxConcurrentExpensiveOperations is the maximum number of reconciles for each controller that
+	// may perform expensive operations (e.g. QMP calls for scaling, or starting migrations) at the
+	// same time, out of MaxConcurrentReconciles. Zero means no limit.
+	//
+	// This guarantees that some workers are always available for cheaper reconciles, like creating
+	// runner pods for new VMs. See reconcile_concurrency.go for more.
+	MaxConcurrentExpensiveOperations int
+
 	// QEMUDiskCacheSettings sets the values of the 'cache.*' settings used for QEMU disks.
 	//
 	// This field is passed to neonvm-runner as the `-qemu-disk-cache-settings` arg, and is directly
 	// used in setting up the VM disks via QEMU's `-drive` flag.
 	QEMUDiskCacheSettings string
 
+	// QMPAuthToken is the token used to authenticate to neonvm-runner's QMP proxy, and to the
+	// runner's other authenticated endpoints. Empty means authentication is disabled. See
+	// qmp_auth.go for more.
+	//
+	// It's left out of the effective configuration served at /config.
+	QMPAuthToken string `json:"-"`
+
 	// DefaultMemoryProvider is the memory provider (dimm slots or virtio-mem) that will be used for
 	// new VMs (or, when old ones restart) if nothing is explicitly set.
 	DefaultMemoryProvider vmv1.MemoryProvider
 
+	// MemoryProviderMigration, if true, switches VMs from DIMMSlots to VirtioMem when they next
+	// restart, unless they explicitly set their memory provider. See memory_provider_migration.go.
+	MemoryProviderMigration bool
+
 	// MemhpAutoMovableRatio specifies the value that new neonvm-runners will set as the
 	// kernel's 'memory_hotplug.auto_movable_ratio', iff the memory provider is virtio-mem.
 	//
@@ -41,6 +68,14 @@ type ReconcilerConfig struct {
 	// The range of sensible values may extend further, but we have not tested that.
 	MemhpAutoMovableRatio string
 
+	// DefaultPortForwarding is the port forwarding implementation used by new runner pods for VMs
+	// that don't set .spec.guest.portForwarding. If empty, it's treated as IPTables.
+	DefaultPortForwarding vmv1.PortForwarding
+
+	// DefaultCPUScalingMode is the CPU scaling mode used by new runner pods for VMs that don't set
+	// .spec.guest.cpuScalingMode. If empty, it's treated as QMPHotplug.
+	DefaultCPUScalingMode vmv1.CPUScalingMode
+
 	// FailurePendingPeriod is the period for the propagation of
 	// reconciliation failures to the observability instruments
 	FailurePendingPeriod time.Duration
@@ -48,6 +83,22 @@ type ReconcilerConfig struct {
 	// FailingRefreshInterval is the interval between consecutive
 	// updates of metrics and logs, related to failing reconciliations
 	FailingRefreshInterval time.Duration
+
+	// SnapshotExportImage is the image used for the Jobs that copy VirtualMachineSnapshots to their
+	// target. It must contain bash, curl, and the aws CLI.
+	SnapshotExportImage string
+
+	// QMPBreaker configures the per-node circuit breakers that pause VM resizes on nodes where QMP
+	// operations keep failing. See qmp_breaker.go for more.
+	QMPBreaker QMPBreakerConfig
+
+	// Rollout configures the gradual restart of VMs whose runner pods were created with outdated
+	// settings, e.g. an older runner image. See rollout.go for more.
+	Rollout RolloutConfig
+
+	// Migration gives the defaults for the live migration tunables that aren't set on each
+	// VirtualMachineMigration. See migration_tuning.go for more.
+	Migration MigrationConfig
 }
 
 func (c *ReconcilerConfig) criEndpointSocketPath() string {
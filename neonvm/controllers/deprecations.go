@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// deprecatedFieldsRefreshInterval is how often DeprecatedFieldsRefresher recounts the VMs using
+// each deprecated field
+const deprecatedFieldsRefreshInterval = time.Minute
+
+// DeprecatedFieldsRefresher periodically updates the vm_deprecated_field_in_use metric with the
+// number of VirtualMachines that set each field in vmv1.VirtualMachineDeprecations, so that we
+// know when it's safe to remove them.
+//
+// It implements manager.Runnable.
+type DeprecatedFieldsRefresher struct {
+	Client  client.Reader
+	Metrics ReconcilerMetrics
+}
+
+func (r DeprecatedFieldsRefresher) Start(ctx context.Context) error {
+	go r.run(ctx)
+	return nil
+}
+
+func (r DeprecatedFieldsRefresher) run(ctx context.Context) {
+	log := log.FromContext(ctx)
+
+	for {
+		if err := r.refresh(ctx); err != nil {
+			log.Error(err, "Failed to count VirtualMachines using deprecated fields")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(deprecatedFieldsRefreshInterval):
+		}
+	}
+}
+
+func (r DeprecatedFieldsRefresher) refresh(ctx context.Context) error {
+	var vms vmv1.VirtualMachineList
+	if err := r.Client.List(ctx, &vms); err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for i := range vms.Items {
+		for _, d := range vms.Items[i].DeprecatedFieldsInUse() {
+			counts[d.Field] += 1
+		}
+	}
+
+	for _, d := range vmv1.VirtualMachineDeprecations {
+		r.Metrics.deprecatedFieldInUse.WithLabelValues(d.Field, d.RemovalVersion).Set(float64(counts[d.Field]))
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package controllers
+
+// Exec API for VirtualMachines
+//
+// The controller serves the 'exec.vm.neon.tech/v1' API group, which is registered with the
+// Kubernetes API server as an aggregated API (see config/webhook/exec_apiservice.yaml), with a
+// single subresource:
+//
+//	POST /apis/exec.vm.neon.tech/v1/namespaces/<namespace>/virtualmachines/<name>/exec
+//
+// The request body is an api.ExecRequest, which we pass on to the VM's runner pod to run in the
+// guest (see runner/exec.go), responding with its api.ExecResult.
+//
+// Because requests go through the API server, they're authorized by RBAC like any other: users
+// need the 'create' verb on 'virtualmachines/exec' in the 'exec.vm.neon.tech' group, rather than
+// the VM's SSH key. The API server authenticates itself to us with a client certificate signed by
+// its requestheader CA, from the kube-system/extension-apiserver-authentication ConfigMap, and
+// gives the user in the X-Remote-User header.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const (
+	ExecAPIGroup   = "exec.vm.neon.tech"
+	ExecAPIVersion = "v1"
+)
+
+// ExecAPIServer serves the exec API. See the comment at the top of this file for more.
+//
+// It implements manager.Runnable.
+type ExecAPIServer struct {
+	Client client.Client
+	// APIReader is used to read the API server's requestheader CA, so that ConfigMaps don't need
+	// to be cached.
+	APIReader client.Reader
+	// Addr is the address to serve the API on. If empty, the server is disabled.
+	Addr string
+	// CertDir is the directory with the serving certificate, as tls.crt and tls.key.
+	CertDir string
+	// QMPAuthToken authenticates requests to the runner pods. It's required: runners refuse /exec
+	// without it, so the API won't start if it's empty.
+	QMPAuthToken string
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, so that the API is served by all
+// replicas.
+func (s ExecAPIServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s ExecAPIServer) Start(ctx context.Context) error {
+	if s.Addr == "" {
+		return nil
+	}
+	if s.QMPAuthToken == "" {
+		return errors.New("exec API requires a QMP auth token (-qmp-auth-token-file)")
+	}
+	log := log.FromContext(ctx).WithName("exec-api")
+
+	clientCAs, allowedNames, err := s.requestHeaderClientCAs(ctx)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := certwatcher.New(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+	if err != nil {
+		return fmt.Errorf("failed to load serving certificate: %w", err)
+	}
+	go func() {
+		if err := watcher.Start(ctx); err != nil {
+			log.Error(err, "Certificate watcher failed")
+		}
+	}()
+
+	server := &http.Server{
+		Addr:              s.Addr,
+		Handler:           util.InstrumentHTTPHandler(s.authenticate(allowedNames, http.HandlerFunc(s.serve)), "Exec API"),
+		ReadHeaderTimeout: 5 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: watcher.GetCertificate,
+			ClientAuth:     tls.VerifyClientCertIfGiven,
+			ClientCAs:      clientCAs,
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	log.Info("Serving exec API", "addr", s.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("exec API server failed: %w", err)
+	}
+	return nil
+}
+
+// requestHeaderClientCAs returns the CAs for the API server's client certificates, and the common
+// names that they're allowed to have (empty if any name is allowed)
+func (s ExecAPIServer) requestHeaderClientCAs(ctx context.Context) (*x509.CertPool, []string, error) {
+	var cm corev1.ConfigMap
+	key := types.NamespacedName{Namespace: metav1.NamespaceSystem, Name: "extension-apiserver-authentication"}
+	if err := s.APIReader.Get(ctx, key, &cm); err != nil {
+		return nil, nil, fmt.Errorf("failed to get ConfigMap %s: %w", key, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(cm.Data["requestheader-client-ca-file"])) {
+		return nil, nil, fmt.Errorf("ConfigMap %s has no valid requestheader-client-ca-file", key)
+	}
+
+	var allowedNames []string
+	if names := cm.Data["requestheader-allowed-names"]; names != "" {
+		if err := json.Unmarshal([]byte(names), &allowedNames); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal requestheader-allowed-names in ConfigMap %s: %w", key, err)
+		}
+	}
+
+	return pool, allowedNames, nil
+}
+
+// authenticate only passes on requests from the API server, i.e. those with a verified client
+// certificate with one of the allowed names
+func (s ExecAPIServer) authenticate(allowedNames []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeExecAPIStatus(w, http.StatusUnauthorized, "client certificate required")
+			return
+		}
+		if len(allowedNames) != 0 && !slices.Contains(allowedNames, r.TLS.VerifiedChains[0][0].Subject.CommonName) {
+			writeExecAPIStatus(w, http.StatusForbidden, "client certificate common name is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s ExecAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	groupVersion := ExecAPIGroup + "/" + ExecAPIVersion
+
+	// Discovery
+	switch r.URL.Path {
+	case "/apis":
+		writeExecAPIJSON(w, &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups:   []metav1.APIGroup{execAPIGroup()},
+		})
+		return
+	case "/apis/" + ExecAPIGroup:
+		group := execAPIGroup()
+		writeExecAPIJSON(w, &group)
+		return
+	case "/apis/" + groupVersion:
+		writeExecAPIJSON(w, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: groupVersion,
+			APIResources: []metav1.APIResource{{
+				Name:               "virtualmachines/exec",
+				SingularName:       "",
+				Namespaced:         true,
+				Group:              "",
+				Version:            "",
+				Kind:               "ExecResult",
+				Verbs:              []string{"create"},
+				ShortNames:         nil,
+				Categories:         nil,
+				StorageVersionHash: "",
+			}},
+		})
+		return
+	}
+
+	// /apis/<group>/<version>/namespaces/<namespace>/virtualmachines/<name>/exec
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/apis/"+groupVersion+"/"), "/")
+	if len(parts) != 5 || parts[0] != "namespaces" || parts[2] != "virtualmachines" || parts[4] != "exec" {
+		writeExecAPIStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeExecAPIStatus(w, http.StatusMethodNotAllowed, "must be POST")
+		return
+	}
+	s.handleExec(w, r, types.NamespacedName{Namespace: parts[1], Name: parts[3]})
+}
+
+func (s ExecAPIServer) handleExec(w http.ResponseWriter, r *http.Request, vmName types.NamespacedName) {
+	log := log.FromContext(r.Context()).WithName("exec-api").WithValues(
+		"VirtualMachine", vmName, "user", r.Header.Get("X-Remote-User"),
+	)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeExecAPIStatus(w, http.StatusBadRequest, fmt.Sprintf("failed to read body: %s", err))
+		return
+	}
+	var req api.ExecRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeExecAPIStatus(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err))
+		return
+	}
+	if len(req.Command) == 0 {
+		writeExecAPIStatus(w, http.StatusBadRequest, "command must not be empty")
+		return
+	}
+
+	var vm vmv1.VirtualMachine
+	if err := s.Client.Get(r.Context(), vmName, &vm); err != nil {
+		if apierrors.IsNotFound(err) {
+			writeExecAPIStatus(w, http.StatusNotFound, fmt.Sprintf("VirtualMachine %s not found", vmName))
+		} else {
+			writeExecAPIStatus(w, http.StatusInternalServerError, fmt.Sprintf("failed to get VirtualMachine: %s", err))
+		}
+		return
+	}
+	if vm.Status.Phase != vmv1.VmRunning || vm.Status.PodIP == "" {
+		writeExecAPIStatus(w, http.StatusConflict, fmt.Sprintf("VirtualMachine %s is not running", vmName))
+		return
+	}
+
+	log.Info("Running command in VM", "command", req.Command)
+
+	timeoutSeconds := req.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = api.ExecDefaultTimeoutSeconds
+	}
+	timeoutSeconds = min(timeoutSeconds, api.ExecMaxTimeoutSeconds)
+	// Give the runner some extra time to respond once the command has timed out.
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(timeoutSeconds)+10*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/exec", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vmv1.ConsolePort)))
+	runnerReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		writeExecAPIStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	runnerReq.Header.Set("Content-Type", "application/json")
+	runnerReq.Header.Set("Authorization", "Bearer "+s.QMPAuthToken)
+
+	resp, err := http.DefaultClient.Do(runnerReq)
+	if err != nil {
+		log.Error(err, "Failed to send exec request to runner pod")
+		writeExecAPIStatus(w, http.StatusBadGateway, fmt.Sprintf("failed to reach runner pod: %s", err))
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		writeExecAPIStatus(w, http.StatusBadGateway, fmt.Sprintf("failed to read response from runner pod: %s", err))
+		return
+	}
+	if resp.StatusCode != 200 {
+		writeExecAPIStatus(w, resp.StatusCode, fmt.Sprintf("runner pod: %s", strings.TrimSpace(string(respBody))))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(respBody)
+}
+
+func execAPIGroup() metav1.APIGroup {
+	version := metav1.GroupVersionForDiscovery{
+		GroupVersion: ExecAPIGroup + "/" + ExecAPIVersion,
+		Version:      ExecAPIVersion,
+	}
+	return metav1.APIGroup{
+		TypeMeta:                   metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"},
+		Name:                       ExecAPIGroup,
+		Versions:                   []metav1.GroupVersionForDiscovery{version},
+		PreferredVersion:           version,
+		ServerAddressByClientCIDRs: nil,
+	}
+}
+
+func writeExecAPIJSON(w http.ResponseWriter, obj any) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// writeExecAPIStatus responds with an error as a metav1.Status, like the API server would
+func writeExecAPIStatus(w http.ResponseWriter, code int, message string) {
+	body, _ := json.Marshal(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   metav1.StatusReasonUnknown,
+		Details:  nil,
+		Code:     int32(code),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,434 @@
+// Package fakerunner provides a fake neonvm-runner for tests: a QMP server that emulates the parts
+// of QEMU that the controller uses (CPU and memory hotplug, virtio-mem, run state, migration, and
+// drive backup jobs), alongside the runner's own HTTP API.
+//
+// It lets the controller's resize and migration code paths run end-to-end against real sockets in
+// environments without KVM, like CI. The emulation follows QEMU's observable behavior - e.g. the
+// order of hotpluggable CPU slots, and the errors for unknown commands - but hotplug always succeeds
+// immediately, unless a failure is injected with (*Runner).FailCommand.
+package fakerunner
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// qmpCommand is a single command received by the QMP server
+type qmpCommand struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments"`
+	ID        json.RawMessage `json:"id,omitempty"`
+}
+
+// qmpError is an error response from the QMP server, in the same format as QEMU's
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+func genericError(format string, args ...any) *qmpError {
+	return &qmpError{Class: "GenericError", Desc: fmt.Sprintf(format, args...)}
+}
+
+// serveQMP runs the QMP protocol on the connection until it's closed
+func (r *Runner) serveQMP(conn net.Conn) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	// nb: responses must each be on a single line, because go-qemu reads them with a
+	// bufio.Scanner.
+	write := func(v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	greeting := map[string]any{
+		"QMP": map[string]any{
+			"version": map[string]any{
+				"qemu":    map[string]int{"major": 8, "minor": 2, "micro": 0},
+				"package": "fakerunner",
+			},
+			"capabilities": []string{},
+		},
+	}
+	if err := write(greeting); err != nil {
+		return
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var cmd qmpCommand
+		if err := dec.Decode(&cmd); err != nil {
+			return
+		}
+
+		result, err := r.runQMPCommand(cmd)
+
+		resp := map[string]any{}
+		if len(cmd.ID) != 0 {
+			resp["id"] = cmd.ID
+		}
+		var qerr *qmpError
+		if errors.As(err, &qerr) {
+			resp["error"] = qerr
+		} else if err != nil {
+			resp["error"] = genericError("%s", err)
+		} else {
+			if result == nil {
+				result = struct{}{}
+			}
+			resp["return"] = result
+		}
+
+		if err := write(resp); err != nil {
+			return
+		}
+		if cmd.Execute == "quit" && err == nil {
+			return
+		}
+	}
+}
+
+// runQMPCommand executes the command against the fake QEMU's state, returning the value for the
+// response's "return" field.
+func (r *Runner) runQMPCommand(cmd qmpCommand) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, cmd.Execute)
+	if desc, ok := r.failures[cmd.Execute]; ok {
+		return nil, genericError("%s", desc)
+	}
+
+	args := map[string]any{}
+	if len(cmd.Arguments) != 0 {
+		if err := json.Unmarshal(cmd.Arguments, &args); err != nil {
+			return nil, genericError("invalid arguments: %s", err)
+		}
+	}
+	str := func(key string) string {
+		s, _ := args[key].(string)
+		return s
+	}
+	num := func(key string) int64 {
+		n, _ := args[key].(float64)
+		return int64(n)
+	}
+
+	switch cmd.Execute {
+	case "qmp_capabilities":
+		return nil, nil
+
+	case "query-status":
+		status := "running"
+		if !r.running {
+			status = "paused"
+		}
+		return map[string]any{"running": r.running, "status": status}, nil
+	case "stop":
+		r.running = false
+		return nil, nil
+	case "cont":
+		r.running = true
+		return nil, nil
+	case "quit":
+		r.running = false
+		return nil, nil
+
+	case "query-hotpluggable-cpus":
+		return r.queryHotpluggableCPUs(), nil
+
+	case "query-memory-size-summary":
+		return map[string]int64{
+			"base-memory":    r.config.BaseMemory,
+			"plugged-memory": r.pluggedMemory(),
+		}, nil
+	case "query-memory-devices":
+		return r.queryMemoryDevices(), nil
+	case "qom-list":
+		if str("path") != "/objects" {
+			return nil, genericError("Device '%s' not found", str("path"))
+		}
+		return r.listObjects(), nil
+	case "qom-get", "qom-set":
+		if str("path") != "vm0" || str("property") != "requested-size" || r.config.VirtioMemMax == 0 {
+			return nil, genericError("Device '%s' not found", str("path"))
+		}
+		if cmd.Execute == "qom-get" {
+			return r.virtioMemSize, nil
+		}
+		size := num("value")
+		if size < 0 || size > r.config.VirtioMemMax {
+			return nil, genericError("Property 'requested-size' out of range")
+		}
+		r.virtioMemSize = size
+		return nil, nil
+
+	case "object-add":
+		if qomType := str("qom-type"); qomType != "memory-backend-ram" && qomType != "memory-backend-memfd" {
+			return nil, genericError("Invalid qom-type '%s'", str("qom-type"))
+		}
+		id := str("id")
+		if _, ok := r.memBackends[id]; ok {
+			return nil, genericError("attempt to add duplicate property '%s' to object (type 'container')", id)
+		}
+		r.memBackends[id] = num("size")
+		return nil, nil
+	case "object-del":
+		id := str("id")
+		if _, ok := r.memBackends[id]; !ok {
+			return nil, genericError("object '%s' not found", id)
+		}
+		for _, memdev := range r.dimms {
+			if memdev == id {
+				return nil, genericError("object '%s' is in use, can not be deleted", id)
+			}
+		}
+		delete(r.memBackends, id)
+		return nil, nil
+
+	case "device_add":
+		return nil, r.deviceAdd(str("driver"), str("id"), str("memdev"), num("core-id"))
+	case "device_del":
+		return nil, r.deviceDel(str("id"))
+
+	case "migrate-set-capabilities", "migrate-set-parameters":
+		return nil, nil
+	case "migrate":
+		r.migrationStatus = "active"
+		return nil, nil
+	case "migrate-start-postcopy":
+		if r.migrationStatus != "active" {
+			return nil, genericError("Postcopy must be started after migration has been started")
+		}
+		r.migrationStatus = "postcopy-active"
+		return nil, nil
+	case "migrate_cancel":
+		if r.migrationStatus == "active" || r.migrationStatus == "postcopy-active" {
+			r.migrationStatus = "cancelled"
+		}
+		return nil, nil
+	case "query-migrate":
+		if r.migrationStatus == "" {
+			return map[string]any{}, nil
+		}
+		return map[string]any{"status": r.migrationStatus}, nil
+
+	case "transaction":
+		return nil, r.transaction(cmd.Arguments)
+	case "query-jobs":
+		return r.queryJobs(), nil
+	case "job-dismiss":
+		id := str("id")
+		job, ok := r.jobs[id]
+		if !ok {
+			return nil, genericError("Job not found")
+		} else if job.status != "concluded" {
+			return nil, genericError("Job '%s' in state '%s' cannot accept command verb 'dismiss'", id, job.status)
+		}
+		delete(r.jobs, id)
+		return nil, nil
+
+	default:
+		return nil, &qmpError{
+			Class: "CommandNotFound",
+			Desc:  fmt.Sprintf("The command %s has not been found", cmd.Execute),
+		}
+	}
+}
+
+// transaction starts the drive backups in the 'transaction' command. Other actions aren't
+// supported.
+func (r *Runner) transaction(rawArgs json.RawMessage) error {
+	var args struct {
+		Actions []struct {
+			Type string `json:"type"`
+			Data struct {
+				JobID string `json:"job-id"`
+			} `json:"data"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return genericError("invalid arguments: %s", err)
+	}
+	for _, a := range args.Actions {
+		if a.Type != "drive-backup" {
+			return genericError("Invalid parameter '%s'", a.Type)
+		} else if _, ok := r.jobs[a.Data.JobID]; ok {
+			return genericError("Job ID '%s' already in use", a.Data.JobID)
+		}
+	}
+	for _, a := range args.Actions {
+		r.jobs[a.Data.JobID] = &blockJob{status: "running", err: ""}
+	}
+	return nil
+}
+
+func (r *Runner) queryJobs() []map[string]any {
+	ids := make([]string, 0, len(r.jobs))
+	for id := range r.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var jobs []map[string]any
+	for _, id := range ids {
+		job := map[string]any{"id": id, "type": "backup", "status": r.jobs[id].status}
+		if r.jobs[id].err != "" {
+			job["error"] = r.jobs[id].err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+const cpuDriver = "host-x86_64-cpu"
+
+func (r *Runner) queryHotpluggableCPUs() []map[string]any {
+	// QEMU lists the slots from the highest core ID to the lowest.
+	var slots []map[string]any
+	for core := r.config.MaxCPUs - 1; core >= 0; core-- {
+		slot := map[string]any{
+			"props":       map[string]int{"core-id": core, "thread-id": 0, "socket-id": 0},
+			"vcpus-count": 1,
+			"type":        cpuDriver,
+		}
+		if core < r.config.BootCPUs {
+			slot["qom-path"] = fmt.Sprintf("/machine/unattached/device[%d]", core)
+		} else if _, ok := r.hotplugCPUs[core]; ok {
+			slot["qom-path"] = cpuQOMPath(core)
+		}
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+func cpuQOMPath(core int) string {
+	return fmt.Sprintf("/machine/peripheral/cpu%d", core)
+}
+
+func (r *Runner) deviceAdd(driver, id, memdev string, coreID int64) error {
+	switch driver {
+	case cpuDriver:
+		core := int(coreID)
+		if core < r.config.BootCPUs || core >= r.config.MaxCPUs {
+			return genericError("core-id %d is not hotpluggable", core)
+		} else if _, ok := r.hotplugCPUs[core]; ok {
+			return genericError("CPU[%d] with APIC ID %d exists", core, core)
+		}
+		r.hotplugCPUs[core] = id
+		return nil
+	case "pc-dimm":
+		if _, ok := r.dimms[id]; ok {
+			return genericError("Duplicate device ID '%s'", id)
+		} else if _, ok := r.memBackends[memdev]; !ok {
+			return genericError("can't find memory backend '%s'", memdev)
+		}
+		for _, used := range r.dimms {
+			if used == memdev {
+				return genericError("can't use already busy memdev: %s", memdev)
+			}
+		}
+		r.dimms[id] = memdev
+		return nil
+	default:
+		return genericError("'%s' is not a valid device model name", driver)
+	}
+}
+
+func (r *Runner) deviceDel(id string) error {
+	if _, ok := r.dimms[id]; ok {
+		delete(r.dimms, id)
+		return nil
+	}
+
+	// CPUs are removed by their QOM path
+	for core, cpuID := range r.hotplugCPUs {
+		if id == cpuQOMPath(core) || id == cpuID {
+			delete(r.hotplugCPUs, core)
+			return nil
+		}
+	}
+
+	return &qmpError{Class: "DeviceNotFound", Desc: fmt.Sprintf("Device '%s' not found", id)}
+}
+
+func (r *Runner) pluggedMemory() int64 {
+	total := r.virtioMemSize
+	for _, memdev := range r.dimms {
+		total += r.memBackends[memdev]
+	}
+	return total
+}
+
+func (r *Runner) queryMemoryDevices() []map[string]any {
+	ids := make([]string, 0, len(r.dimms))
+	for id := range r.dimms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var devices []map[string]any
+	for i, id := range ids {
+		memdev := r.dimms[id]
+		devices = append(devices, map[string]any{
+			"type": "dimm",
+			"data": map[string]any{
+				"id":           id,
+				"memdev":       "/objects/" + memdev,
+				"size":         r.memBackends[memdev],
+				"slot":         i,
+				"hotplugged":   true,
+				"hotpluggable": true,
+			},
+		})
+	}
+	if r.config.VirtioMemMax != 0 {
+		devices = append(devices, map[string]any{
+			"type": "virtio-mem",
+			"data": map[string]any{
+				"id":             "vm0",
+				"memdev":         "/objects/vmem0",
+				"size":           r.virtioMemSize,
+				"requested-size": r.virtioMemSize,
+				"max-size":       r.config.VirtioMemMax,
+			},
+		})
+	}
+	return devices
+}
+
+func (r *Runner) listObjects() []map[string]string {
+	objects := []map[string]string{
+		{"name": "pc.ram", "type": "child<memory-backend-ram>"},
+	}
+	ids := make([]string, 0, len(r.memBackends))
+	for id := range r.memBackends {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(ids[i], "memslot"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(ids[j], "memslot"))
+		return a < b
+	})
+	for _, id := range ids {
+		objects = append(objects, map[string]string{"name": id, "type": "child<memory-backend-ram>"})
+	}
+	return objects
+}
@@ -0,0 +1,282 @@
+package fakerunner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// Config describes the VM emulated by a Runner
+type Config struct {
+	// BootCPUs is the number of CPUs that the VM was started with, which can't be unplugged
+	BootCPUs int
+	// MaxCPUs is the total number of CPU slots
+	MaxCPUs int
+	// BaseMemory is the size, in bytes, of the memory that the VM was started with
+	BaseMemory int64
+	// VirtioMemMax, if not zero, adds a virtio-mem device with the given maximum size, in bytes
+	VirtioMemMax int64
+	// CgroupCPU is the initial CPU limit reported by the runner's /cpu_current endpoint
+	CgroupCPU vmv1.MilliCPU
+}
+
+// ConfigForVM returns the Config for the VM as neonvm-runner would start it, i.e. with its minimum
+// CPUs and memory.
+func ConfigForVM(vm *vmv1.VirtualMachine) Config {
+	guest := vm.Spec.Guest
+	slotSize := guest.MemorySlotSize.Value()
+
+	var virtioMemMax int64
+	if vm.Status.MemoryProvider != nil && *vm.Status.MemoryProvider == vmv1.MemoryProviderVirtioMem {
+		virtioMemMax = int64(guest.MemorySlots.Max-guest.MemorySlots.Min) * slotSize
+	}
+
+	return Config{
+		BootCPUs:     int(guest.CPUs.Min.RoundedUp()),
+		MaxCPUs:      int(guest.CPUs.Max.RoundedUp()),
+		BaseMemory:   int64(guest.MemorySlots.Min) * slotSize,
+		VirtioMemMax: virtioMemMax,
+		CgroupCPU:    guest.CPUs.Min,
+	}
+}
+
+// Runner is a fake neonvm-runner, serving QMP and the runner's HTTP API on localhost
+type Runner struct {
+	config Config
+
+	qmpListener  net.Listener
+	httpListener net.Listener
+	httpServer   *http.Server
+	wg           sync.WaitGroup
+
+	mu sync.Mutex
+	// commands is the list of QMP commands received, in order
+	commands []string
+	// failures maps QMP commands to the error description to fail them with
+	failures map[string]string
+
+	running         bool
+	hotplugCPUs     map[int]string   // core ID -> device ID
+	memBackends     map[string]int64 // object ID -> size
+	dimms           map[string]string
+	virtioMemSize   int64
+	migrationStatus string
+	jobs            map[string]*blockJob
+	cgroupCPU       vmv1.MilliCPU
+}
+
+// blockJob is a drive backup started with the 'transaction' command
+type blockJob struct {
+	status string
+	// err is the job's error, if it concluded unsuccessfully
+	err string
+}
+
+// Start starts a new Runner emulating a VM with the given Config. It must be stopped with Close.
+func Start(config Config) (*Runner, error) {
+	if config.BootCPUs < 1 || config.MaxCPUs < config.BootCPUs {
+		return nil, fmt.Errorf("invalid CPUs: boot = %d, max = %d", config.BootCPUs, config.MaxCPUs)
+	}
+
+	qmpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for QMP: %w", err)
+	}
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = qmpListener.Close()
+		return nil, fmt.Errorf("error listening for runner API: %w", err)
+	}
+
+	r := &Runner{
+		config:       config,
+		qmpListener:  qmpListener,
+		httpListener: httpListener,
+		httpServer:   nil, // set below
+		wg:           sync.WaitGroup{},
+
+		mu:       sync.Mutex{},
+		commands: nil,
+		failures: make(map[string]string),
+
+		running:         true,
+		hotplugCPUs:     make(map[int]string),
+		memBackends:     make(map[string]int64),
+		dimms:           make(map[string]string),
+		virtioMemSize:   0,
+		migrationStatus: "",
+		jobs:            make(map[string]*blockJob),
+		cgroupCPU:       config.CgroupCPU,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cpu_current", r.handleCPUCurrent)
+	mux.HandleFunc("/cpu_change", r.handleCPUChange)
+	mux.HandleFunc("/swap_change", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.httpServer = &http.Server{Handler: mux} //nolint:gosec // only used in tests
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		_ = r.httpServer.Serve(httpListener)
+	}()
+	go func() {
+		defer r.wg.Done()
+		for {
+			conn, err := qmpListener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serveQMP(conn)
+		}
+	}()
+
+	return r, nil
+}
+
+// Close stops the Runner's servers
+func (r *Runner) Close() error {
+	err := errors.Join(r.qmpListener.Close(), r.httpServer.Close())
+	r.wg.Wait()
+	return err
+}
+
+// ApplyTo points the VM's status and ports at the Runner, as if it were the VM's runner pod
+func (r *Runner) ApplyTo(vm *vmv1.VirtualMachine) {
+	vm.Status.PodIP = "127.0.0.1"
+	vm.Spec.QMP = int32(r.qmpListener.Addr().(*net.TCPAddr).Port)
+	vm.Spec.RunnerPort = int32(r.httpListener.Addr().(*net.TCPAddr).Port)
+}
+
+// FailCommand makes all future QMP commands with the name fail with the given description, or
+// succeed again if desc is empty.
+func (r *Runner) FailCommand(command string, desc string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if desc == "" {
+		delete(r.failures, command)
+	} else {
+		r.failures[command] = desc
+	}
+}
+
+// Commands returns the names of the QMP commands received so far, in order
+func (r *Runner) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.commands...)
+}
+
+// CPUs returns the number of CPUs currently plugged into the VM
+func (r *Runner) CPUs() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.config.BootCPUs + len(r.hotplugCPUs)
+}
+
+// CgroupCPU returns the runner's current CPU limit, as set by the /cpu_change endpoint
+func (r *Runner) CgroupCPU() vmv1.MilliCPU {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cgroupCPU
+}
+
+// MemorySize returns the total size of the VM's memory, in bytes
+func (r *Runner) MemorySize() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.config.BaseMemory + r.pluggedMemory()
+}
+
+// Running returns whether the VM's CPUs are running, i.e. not stopped by 'stop' or 'quit'
+func (r *Runner) Running() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.running
+}
+
+// MigrationStatus returns the status of the current migration, as reported by 'query-migrate'
+func (r *Runner) MigrationStatus() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.migrationStatus
+}
+
+// SetMigrationStatus sets the status of the current migration, e.g. to "completed" or "failed".
+func (r *Runner) SetMigrationStatus(status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.migrationStatus = status
+}
+
+// Jobs returns the IDs of the block jobs that haven't been dismissed
+func (r *Runner) Jobs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for _, job := range r.queryJobs() {
+		ids = append(ids, job["id"].(string))
+	}
+	return ids
+}
+
+// ConcludeJob marks the block job as concluded, failed with errMsg if it's not empty
+func (r *Runner) ConcludeJob(id string, errMsg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[id]; ok {
+		job.status = "concluded"
+		job.err = errMsg
+	}
+}
+
+func (r *Runner) handleCPUCurrent(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.mu.Lock()
+	resp := api.VCPUCgroup{VCPUs: r.cgroupCPU, Burst: nil}
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Runner) handleCPUChange(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var change api.VCPUChange
+	if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.cgroupCPU = change.VCPUs
+	r.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -110,11 +110,32 @@ var _ = Describe("VirtualMachine controller", func() {
 					IsK3s:                   false,
 					UseContainerMgr:         true,
 					MaxConcurrentReconciles: 1,
+					NamespaceRateLimit:      controllers.NamespaceRateLimit{QPS: 0, Burst: 0},
+					ObjectRateLimit:         controllers.ObjectRateLimit{QPS: 0, Burst: 0},
 					QEMUDiskCacheSettings:   "cache=none",
 					DefaultMemoryProvider:   vmv1.MemoryProviderDIMMSlots,
+					MemoryProviderMigration: false,
 					MemhpAutoMovableRatio:   "301",
+					DefaultCPUScalingMode:   vmv1.CPUScalingModeQMPHotplug,
 					FailurePendingPeriod:    1 * time.Minute,
 					FailingRefreshInterval:  1 * time.Minute,
+					SnapshotExportImage:     "",
+					QMPBreaker:              controllers.QMPBreakerConfig{FailureThreshold: 0, OpenDuration: 0},
+					Rollout: controllers.RolloutConfig{
+						MaxUnavailable:      0,
+						BootSLO:             0,
+						MaxFailureRate:      0,
+						FailureWindow:       0,
+						MinRestartsForPause: 0,
+					},
+					Migration: controllers.MigrationConfig{
+						DowntimeLimit:           0,
+						MultifdChannels:         0,
+						Compression:             "",
+						PostCopyAfterIterations: 0,
+					},
+
+					MaxConcurrentExpensiveOperations: 0,
 				},
 			}
 
@@ -0,0 +1,131 @@
+package controllers
+
+// Migrating VMs from DIMMSlots to VirtioMem
+//
+// A VM's memory provider can only change when it restarts. With memoryProviderMigration enabled,
+// VMs that don't explicitly set .spec.guest.memoryProvider switch to VirtioMem on their next
+// restart, regardless of the default memory provider. Each VM's progress is tracked by the
+// MemoryProviderMigrated condition, and the progress across all VMs is exposed in the
+// vm_memory_provider_migration_vms metric.
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	// typeMemoryProviderMigrated represents whether the VM has been migrated to VirtioMem. It's only
+	// set when memoryProviderMigration is enabled.
+	typeMemoryProviderMigrated = "MemoryProviderMigrated"
+
+	memoryProviderMigrationReasonMigrated       = "Migrated"
+	memoryProviderMigrationReasonPendingRestart = "PendingRestart"
+	memoryProviderMigrationReasonPinnedBySpec   = "PinnedBySpec"
+	memoryProviderMigrationReasonIncompatible   = "Incompatible"
+)
+
+// memoryProviderMigrationTarget returns whether the VM should switch to VirtioMem on its next
+// restart, and the reason if not.
+func memoryProviderMigrationTarget(vm *vmv1.VirtualMachine) (ok bool, reason string, message string) {
+	if p := vm.Spec.Guest.MemoryProvider; p != nil && *p != vmv1.MemoryProviderVirtioMem {
+		return false, memoryProviderMigrationReasonPinnedBySpec, "VM explicitly sets .spec.guest.memoryProvider"
+	}
+	if err := vm.Spec.Guest.ValidateForMemoryProvider(vmv1.MemoryProviderVirtioMem); err != nil {
+		return false, memoryProviderMigrationReasonIncompatible, err.Error()
+	}
+	return true, "", ""
+}
+
+// setMemoryProviderMigrationCondition updates the VM's MemoryProviderMigrated condition, or
+// removes it if memoryProviderMigration is disabled.
+func (r *VMReconciler) setMemoryProviderMigrationCondition(vm *vmv1.VirtualMachine) {
+	if !r.Config.MemoryProviderMigration {
+		meta.RemoveStatusCondition(&vm.Status.Conditions, typeMemoryProviderMigrated)
+		return
+	}
+
+	condition := metav1.Condition{
+		Type:    typeMemoryProviderMigrated,
+		Status:  metav1.ConditionFalse,
+		Reason:  "",
+		Message: "",
+	}
+
+	if p := vm.Status.MemoryProvider; p != nil && *p == vmv1.MemoryProviderVirtioMem {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = memoryProviderMigrationReasonMigrated
+		condition.Message = "VM is using VirtioMem"
+	} else if ok, reason, message := memoryProviderMigrationTarget(vm); !ok {
+		condition.Reason = reason
+		condition.Message = message
+	} else {
+		condition.Reason = memoryProviderMigrationReasonPendingRestart
+		condition.Message = "VM will switch to VirtioMem when it next restarts"
+	}
+
+	meta.SetStatusCondition(&vm.Status.Conditions, condition)
+}
+
+// memoryProviderMigrationCollector is a prometheus.Collector that counts VMs by the reason of
+// their MemoryProviderMigrated condition.
+//
+// It's a collector (instead of a gauge updated on each reconcile) so that the counts always match
+// the current set of VMs, including ones that were deleted.
+type memoryProviderMigrationCollector struct {
+	client client.Reader
+	desc   *prometheus.Desc
+}
+
+// registerMemoryProviderMigrationMetrics registers the collector for the progress of
+// memoryProviderMigration. The client should read from the manager's cache.
+func registerMemoryProviderMigrationMetrics(c client.Reader) error {
+	return metrics.Registry.Register(&memoryProviderMigrationCollector{
+		client: c,
+		desc: prometheus.NewDesc(
+			"vm_memory_provider_migration_vms",
+			"Number of VMs by the state of their migration from DIMMSlots to VirtioMem",
+			[]string{"reason"},
+			nil,
+		),
+	})
+}
+
+func (c *memoryProviderMigrationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *memoryProviderMigrationCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var vms vmv1.VirtualMachineList
+	if err := c.client.List(ctx, &vms); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+
+	counts := map[string]int{
+		memoryProviderMigrationReasonMigrated:       0,
+		memoryProviderMigrationReasonPendingRestart: 0,
+		memoryProviderMigrationReasonPinnedBySpec:   0,
+		memoryProviderMigrationReasonIncompatible:   0,
+	}
+	for _, vm := range vms.Items {
+		if cond := meta.FindStatusCondition(vm.Status.Conditions, typeMemoryProviderMigrated); cond != nil {
+			counts[cond.Reason] += 1
+		}
+	}
+
+	for reason, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), reason)
+	}
+}
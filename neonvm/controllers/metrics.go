@@ -7,6 +7,7 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -15,8 +16,10 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/neonvm/controllers/failurelag"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 type ReconcilerMetrics struct {
@@ -26,6 +29,26 @@ type ReconcilerMetrics struct {
 	vmCreationToVMRunningTime      prometheus.Histogram
 	vmRestartCounts                prometheus.Counter
 	reconcileDuration              prometheus.HistogramVec
+	reconcilePhaseDuration         *prometheus.HistogramVec
+	reconcileErrors                *prometheus.CounterVec
+	namespaceQueueDepth            *prometheus.GaugeVec
+	namespaceThrottled             *prometheus.CounterVec
+	qmpBreakerState                *prometheus.GaugeVec
+	qmpBreakerTrips                *prometheus.CounterVec
+	qmpBreakerPaused               *prometheus.CounterVec
+	objectThrottled                *prometheus.CounterVec
+	expensiveInProgress            *prometheus.GaugeVec
+	expensiveDeferred              *prometheus.CounterVec
+	rolloutInFlight                prometheus.Gauge
+	rolloutRestarts                *prometheus.CounterVec
+	rolloutBootDuration            prometheus.Histogram
+	rolloutPaused                  prometheus.Gauge
+	rolloutPauses                  prometheus.Counter
+	deprecatedFieldInUse           *prometheus.GaugeVec
+	orphanedResources              *prometheus.CounterVec
+	orphanSweepFailures            prometheus.Counter
+	qmpCommandDuration             *prometheus.HistogramVec
+	qmpCommandErrors               *prometheus.CounterVec
 }
 
 const OutcomeLabel = "outcome"
@@ -78,6 +101,144 @@ func MakeReconcilerMetrics() ReconcilerMetrics {
 				Buckets: buckets,
 			}, []string{OutcomeLabel},
 		)),
+		reconcilePhaseDuration: util.RegisterMetric(metrics.Registry, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "reconcile_phase_duration_seconds",
+				Help:    "Time duration of reconciles for each specific controller, by the phase of the object when the reconcile started",
+				Buckets: buckets,
+			},
+			[]string{"controller", "phase"},
+		)),
+		reconcileErrors: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "reconcile_errors_total",
+				Help: "Number of failed reconciles for each specific controller, by error class",
+			},
+			[]string{"controller", "class"},
+		)),
+		namespaceQueueDepth: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "reconcile_namespace_queue_depth",
+				Help: "Number of objects in each namespace waiting to be reconciled due to per-namespace rate limiting",
+			},
+			[]string{"controller", "namespace"},
+		)),
+		namespaceThrottled: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "reconcile_namespace_throttled_total",
+				Help: "Number of reconciles deferred by per-namespace rate limiting",
+			},
+			[]string{"controller", "namespace"},
+		)),
+		qmpBreakerState: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vm_qmp_circuit_breaker_state",
+				Help: "State of the per-node circuit breakers for QMP operations, for nodes that have had recent failures",
+			},
+			[]string{"node", "state"},
+		)),
+		qmpBreakerTrips: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_qmp_circuit_breaker_trips_total",
+				Help: "Number of times the circuit breaker for QMP operations on a node has opened",
+			},
+			[]string{"node"},
+		)),
+		qmpBreakerPaused: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_qmp_circuit_breaker_paused_operations_total",
+				Help: "Number of VM resize operations paused because the node's QMP circuit breaker was open",
+			},
+			[]string{"node"},
+		)),
+		objectThrottled: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "reconcile_object_throttled_total",
+				Help: "Number of reconciles deferred by per-object rate limiting",
+			},
+			[]string{"controller"},
+		)),
+		expensiveInProgress: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "reconcile_expensive_operations_in_progress",
+				Help: "Number of reconciles currently performing expensive operations, like QMP calls or starting migrations",
+			},
+			[]string{"controller"},
+		)),
+		expensiveDeferred: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "reconcile_expensive_operations_deferred_total",
+				Help: "Number of expensive operations deferred because the limit on concurrent expensive operations was reached",
+			},
+			[]string{"controller"},
+		)),
+		rolloutInFlight: util.RegisterMetric(metrics.Registry, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "vm_rollout_restarts_in_progress",
+				Help: "Number of VMs currently restarting to roll out changes that require a restart",
+			},
+		)),
+		rolloutRestarts: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_rollout_restarts_total",
+				Help: "Number of VM restarts for rollouts, by whether the VM was running again within the boot SLO",
+			},
+			[]string{OutcomeLabel},
+		)),
+		rolloutBootDuration: util.RegisterMetric(metrics.Registry, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "vm_rollout_restart_duration_seconds",
+				Help:    "Time from restarting a VM for a rollout until it's running again",
+				Buckets: []float64{1, 2, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600},
+			},
+		)),
+		rolloutPaused: util.RegisterMetric(metrics.Registry, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "vm_rollout_paused",
+				Help: "Whether rollouts are paused because too many recent restarts failed (1 if so, 0 otherwise)",
+			},
+		)),
+		rolloutPauses: util.RegisterMetric(metrics.Registry, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "vm_rollout_pauses_total",
+				Help: "Number of times rollouts have been paused because too many recent restarts failed",
+			},
+		)),
+		deprecatedFieldInUse: util.RegisterMetric(metrics.Registry, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "vm_deprecated_field_in_use",
+				Help: "Number of VirtualMachines that set each deprecated field, by the release it's expected to be removed in",
+			},
+			[]string{"field", "removal_version"},
+		)),
+		orphanedResources: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_orphaned_resources_total",
+				Help: "Number of generated resources found by the orphan sweep, by kind and whether they were deleted or adopted",
+			},
+			[]string{"kind", "action"},
+		)),
+		orphanSweepFailures: util.RegisterMetric(metrics.Registry, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "vm_orphan_sweep_failures_total",
+				Help: "Number of orphan sweeps that failed to list or clean up some generated resources",
+			},
+		)),
+		qmpCommandDuration: util.RegisterMetric(metrics.Registry, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "vm_qmp_command_duration_seconds",
+				Help:    "Time duration of QMP commands sent to VMs, by command (or \"connect\", for connecting to QMP)",
+				Buckets: buckets,
+			},
+			[]string{"command"},
+		)),
+		qmpCommandErrors: util.RegisterMetric(metrics.Registry, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "vm_qmp_command_errors_total",
+				Help: "Number of QMP commands sent to VMs that failed, by command (or \"connect\", for connecting to QMP)",
+			},
+			[]string{"command"},
+		)),
 	}
 	return m
 }
@@ -90,11 +251,28 @@ const (
 	ConflictOutcome ReconcileOutcome = "conflict"
 )
 
+// ObserveReconcileDuration records the duration of a reconcile, with the trace from the context as
+// an exemplar, if there is one.
 func (m ReconcilerMetrics) ObserveReconcileDuration(
+	ctx context.Context,
 	outcome ReconcileOutcome,
 	duration time.Duration,
 ) {
-	m.reconcileDuration.WithLabelValues(string(outcome)).Observe(duration.Seconds())
+	util.ObserveWithTrace(ctx, m.reconcileDuration.WithLabelValues(string(outcome)), duration.Seconds())
+}
+
+// reconcilePhaseTimer starts timing a reconcile of an object that was in the phase, returning a
+// function that records its duration. It's intended to be deferred.
+//
+// An empty phase (i.e. a newly created object) is reported as "None".
+func (m ReconcilerMetrics) reconcilePhaseTimer(ctx context.Context, controller string, phase string) func() {
+	if phase == "" {
+		phase = "None"
+	}
+	start := time.Now()
+	return func() {
+		util.ObserveWithTrace(ctx, m.reconcilePhaseDuration.WithLabelValues(controller, phase), time.Since(start).Seconds())
+	}
 }
 
 type wrappedReconciler struct {
@@ -205,11 +383,17 @@ func (f FailingRefresher) Start(ctx context.Context) error {
 	return nil
 }
 
-func (d *wrappedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (d *wrappedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
 	log := log.FromContext(ctx)
 
+	ctx, span := util.StartSpan(ctx, fmt.Sprintf("Reconcile %s", d.ControllerName),
+		attribute.String("k8s.namespace.name", req.Namespace),
+		attribute.String("k8s.object.name", req.Name),
+	)
+	defer func() { util.EndSpan(span, err) }()
+
 	now := time.Now()
-	res, err := d.Reconciler.Reconcile(ctx, req)
+	res, err = d.Reconciler.Reconcile(ctx, req)
 	duration := time.Since(now)
 
 	outcome := SuccessOutcome
@@ -231,14 +415,17 @@ func (d *wrappedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 			d.conflicting.RecordSuccess(req.NamespacedName)
 		}
 
+		class := errclass.Of(err)
+		d.Metrics.reconcileErrors.WithLabelValues(d.ControllerName, string(class)).Inc()
+
 		log.Error(err, "Failed to reconcile VirtualMachine",
-			"duration", duration.String(), "outcome", outcome)
+			"duration", duration.String(), "outcome", outcome, "errorClass", class)
 	} else {
 		d.failing.RecordSuccess(req.NamespacedName)
 		d.conflicting.RecordSuccess(req.NamespacedName)
 		log.Info("Successful reconciliation", "duration", duration.String())
 	}
-	d.Metrics.ObserveReconcileDuration(outcome, duration)
+	d.Metrics.ObserveReconcileDuration(ctx, outcome, duration)
 	d.Metrics.failing.WithLabelValues(d.ControllerName,
 		string(FailureOutcome)).Set(float64(d.failing.DegradedCount()))
 	d.Metrics.failing.WithLabelValues(d.ControllerName,
@@ -265,3 +452,64 @@ func (r *wrappedReconciler) Snapshot() ReconcileSnapshot {
 		Conflicting:    conflicting,
 	}
 }
+
+// vmPhaseCollector is a prometheus.Collector that counts VMs by their phase.
+//
+// Like memoryProviderMigrationCollector, it lists VMs from the cache on each scrape, so that the
+// counts always match the current set of VMs.
+type vmPhaseCollector struct {
+	client client.Reader
+	desc   *prometheus.Desc
+}
+
+// registerVMPhaseMetrics registers the collector for the number of VMs in each phase. The client
+// should read from the manager's cache.
+func registerVMPhaseMetrics(c client.Reader) error {
+	return metrics.Registry.Register(&vmPhaseCollector{
+		client: c,
+		desc: prometheus.NewDesc(
+			"vm_phase_vms",
+			"Number of VirtualMachines in each phase (\"None\" for VMs that haven't been reconciled yet)",
+			[]string{"phase"},
+			nil,
+		),
+	})
+}
+
+func (c *vmPhaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *vmPhaseCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var vms vmv1.VirtualMachineList
+	if err := c.client.List(ctx, &vms); err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+
+	counts := map[vmv1.VmPhase]int{
+		"":                  0,
+		vmv1.VmPending:      0,
+		vmv1.VmRunning:      0,
+		vmv1.VmSucceeded:    0,
+		vmv1.VmFailed:       0,
+		vmv1.VmPreMigrating: 0,
+		vmv1.VmMigrating:    0,
+		vmv1.VmScaling:      0,
+		vmv1.VmPaused:       0,
+	}
+	for _, vm := range vms.Items {
+		counts[vm.Status.Phase] += 1
+	}
+
+	for phase, count := range counts {
+		label := string(phase)
+		if phase == "" {
+			label = "None"
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), label)
+	}
+}
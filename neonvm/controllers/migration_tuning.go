@@ -0,0 +1,150 @@
+package controllers
+
+// Live migration tunables
+//
+// Some of the QEMU migration parameters can be set on each VirtualMachineMigration, falling back
+// to the controller's defaults (see MigrationConfig). They're resolved into migrationParams when
+// the migration is started, and applied to both the source and target QEMU before 'migrate'.
+//
+// Multifd sends memory over multiple connections, which is needed to saturate fast networks, but
+// QEMU doesn't support it alongside xbzrle, the legacy 'compress' capability, or postcopy. So:
+//
+//   - With multifd, compression is done by multifd itself (with 'multifd-compression'), and xbzrle
+//     is disabled.
+//   - Without multifd, any compression other than None uses the legacy 'compress' capability,
+//     which only supports zlib.
+//   - If postcopy is allowed, multifd is never used - even if it's the controller's default.
+//
+// With postcopy, the controller switches the migration to post-copy once QEMU has made
+// postCopyAfterIterations passes over the VM's memory (or immediately, if that's zero). From then
+// on, the VM runs on the target, so the source can't take over again if the migration fails: the
+// target is kept as the VM's runner pod, and the source is stopped. See
+// (*VirtualMachineMigrationReconciler).switchVMToTargetPod.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// MigrationConfig gives the defaults for the migration tunables that aren't set in a
+// VirtualMachineMigration's spec.
+type MigrationConfig struct {
+	// DowntimeLimit is the maximum time that the VM may be paused for at the end of the migration.
+	DowntimeLimit time.Duration
+	// MultifdChannels is the number of parallel connections to send memory over. Zero disables
+	// multifd.
+	MultifdChannels int
+	// Compression selects how memory is compressed while it's sent.
+	Compression vmv1.MigrationCompression
+	// PostCopyAfterIterations is the number of pre-copy passes over the VM's memory after which
+	// migrations that allow postcopy switch to it.
+	PostCopyAfterIterations int
+}
+
+// xbzrleCacheSize is the size of the cache used for xbzrle, when multifd isn't used
+var xbzrleCacheSize = resource.MustParse("256Mi")
+
+// migrationParams are the effective tunables for a single migration
+type migrationParams struct {
+	allowPostCopy           bool
+	postCopyAfterIterations int64
+	autoConverge            bool
+	maxBandwidth            int64
+	downtimeLimitMs         int64
+	multifdChannels         int
+	compression             vmv1.MigrationCompression
+}
+
+func resolveMigrationParams(migration *vmv1.VirtualMachineMigration, config MigrationConfig) migrationParams {
+	spec := &migration.Spec
+
+	params := migrationParams{
+		allowPostCopy:           spec.AllowPostCopy,
+		postCopyAfterIterations: int64(config.PostCopyAfterIterations),
+		autoConverge:            spec.AutoConverge,
+		maxBandwidth:            spec.MaxBandwidth.Value(),
+		downtimeLimitMs:         config.DowntimeLimit.Milliseconds(),
+		multifdChannels:         config.MultifdChannels,
+		compression:             config.Compression,
+	}
+	if spec.PostCopyAfterIterations != nil {
+		params.postCopyAfterIterations = int64(*spec.PostCopyAfterIterations)
+	}
+	if spec.DowntimeLimitMilliseconds != nil {
+		params.downtimeLimitMs = *spec.DowntimeLimitMilliseconds
+	}
+	if spec.MultifdChannels != nil {
+		params.multifdChannels = int(*spec.MultifdChannels)
+	}
+	if spec.Compression != nil {
+		params.compression = *spec.Compression
+	}
+	if params.compression == "" {
+		params.compression = vmv1.MigrationCompressionNone
+	}
+
+	if params.allowPostCopy {
+		params.multifdChannels = 0
+	}
+
+	return params
+}
+
+// shouldStartPostCopy returns whether a migration that hasn't yet switched to post-copy should do
+// so now
+func (p migrationParams) shouldStartPostCopy(info *MigrationInfo) bool {
+	return p.allowPostCopy && info.Status == "active" && info.Ram.DirtySyncCount >= p.postCopyAfterIterations
+}
+
+func (p migrationParams) multifd() bool {
+	return p.multifdChannels > 0
+}
+
+// qmpCommands returns the QMP commands to set up migration with these params, to be run on both the
+// source and target QEMU
+func (p migrationParams) qmpCommands() ([][]byte, error) {
+	type capability struct {
+		Capability string `json:"capability"`
+		State      bool   `json:"state"`
+	}
+	capabilities := []capability{
+		{Capability: "postcopy-ram", State: p.allowPostCopy},
+		{Capability: "xbzrle", State: !p.multifd()},
+		{Capability: "compress", State: !p.multifd() && p.compression != vmv1.MigrationCompressionNone},
+		{Capability: "auto-converge", State: p.autoConverge},
+		{Capability: "zero-blocks", State: true},
+		{Capability: "multifd", State: p.multifd()},
+	}
+
+	parameters := map[string]any{
+		"max-bandwidth": p.maxBandwidth,
+	}
+	if p.downtimeLimitMs != 0 {
+		parameters["downtime-limit"] = p.downtimeLimitMs
+	}
+	if p.multifd() {
+		parameters["multifd-channels"] = p.multifdChannels
+		parameters["multifd-compression"] = strings.ToLower(string(p.compression))
+	} else {
+		parameters["xbzrle-cache-size"] = xbzrleCacheSize.Value()
+	}
+
+	var cmds [][]byte
+	for _, cmd := range []map[string]any{
+		{"execute": "migrate-set-capabilities", "arguments": map[string]any{"capabilities": capabilities}},
+		{"execute": "migrate-set-parameters", "arguments": parameters},
+	} {
+		raw, err := json.Marshal(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %w", cmd["execute"], err)
+		}
+		cmds = append(cmds, raw)
+	}
+	return cmds, nil
+}
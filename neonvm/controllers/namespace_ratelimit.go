@@ -0,0 +1,141 @@
+package controllers
+
+// Per-namespace rate limiting of reconciles
+//
+// All objects share a single workqueue per controller, so a namespace with thousands of objects
+// being created or deleted can keep every worker busy, starving other namespaces. To prevent that,
+// each namespace gets its own token bucket. A request for a namespace that's out of tokens returns
+// immediately and is requeued for when a token will be available, freeing the worker for requests
+// from other namespaces.
+//
+// We can't do this in the workqueue itself, because the version of controller-runtime we use
+// doesn't allow replacing it.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// NamespaceRateLimit configures per-namespace rate limiting of reconciles
+type NamespaceRateLimit struct {
+	// QPS is the sustained number of reconciles per second allowed for each namespace. Zero
+	// disables rate limiting.
+	QPS float64
+	// Burst is the number of reconciles allowed for a namespace in a burst, above QPS.
+	Burst int
+}
+
+// namespaceLimiterIdlePeriod is how long after its last use a namespace's limiter may be removed.
+// It should be long enough that any limiter that hasn't been used in this time has refilled.
+const namespaceLimiterIdlePeriod = 5 * time.Minute
+
+type namespaceRateLimitedReconciler struct {
+	inner          reconcile.Reconciler
+	controllerName string
+	config         NamespaceRateLimit
+	metrics        ReconcilerMetrics
+
+	mu        sync.Mutex
+	limiters  map[string]*namespaceLimiter
+	lastPrune time.Time
+}
+
+type namespaceLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+	// deferred is the set of requests that have been deferred by the limiter and not reconciled
+	// since. Its size is the namespace's depth in the queue due to rate limiting.
+	deferred map[ctrl.Request]struct{}
+}
+
+// withNamespaceRateLimit wraps the reconciler with per-namespace rate limiting, if it's enabled
+func withNamespaceRateLimit(
+	r reconcile.Reconciler,
+	controllerName string,
+	config NamespaceRateLimit,
+	metrics ReconcilerMetrics,
+) reconcile.Reconciler {
+	if config.QPS == 0 {
+		return r
+	}
+	return &namespaceRateLimitedReconciler{
+		inner:          r,
+		controllerName: controllerName,
+		config:         config,
+		metrics:        metrics,
+		mu:             sync.Mutex{},
+		limiters:       make(map[string]*namespaceLimiter),
+		lastPrune:      time.Now(),
+	}
+}
+
+func (r *namespaceRateLimitedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if delay := r.take(req); delay != 0 {
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	return r.inner.Reconcile(ctx, req)
+}
+
+// take consumes a token for the request's namespace, returning zero if the request can proceed.
+// Otherwise, no token is consumed and take returns how long until one will be available.
+func (r *namespaceRateLimitedReconciler) take(req ctrl.Request) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.pruneIdle(now)
+
+	l, ok := r.limiters[req.Namespace]
+	if !ok {
+		l = &namespaceLimiter{
+			limiter:  rate.NewLimiter(rate.Limit(r.config.QPS), r.config.Burst),
+			lastUsed: now,
+			deferred: make(map[ctrl.Request]struct{}),
+		}
+		r.limiters[req.Namespace] = l
+	}
+	l.lastUsed = now
+
+	reservation := l.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		delete(l.deferred, req)
+	} else {
+		reservation.CancelAt(now)
+		l.deferred[req] = struct{}{}
+		r.metrics.namespaceThrottled.WithLabelValues(r.controllerName, req.Namespace).Inc()
+	}
+
+	if len(l.deferred) != 0 {
+		r.metrics.namespaceQueueDepth.WithLabelValues(r.controllerName, req.Namespace).Set(float64(len(l.deferred)))
+	} else {
+		// Remove the series instead of setting it to zero, so that namespaces that are no longer
+		// being rate limited don't stick around forever.
+		r.metrics.namespaceQueueDepth.DeleteLabelValues(r.controllerName, req.Namespace)
+	}
+
+	return delay
+}
+
+// pruneIdle removes limiters for namespaces that haven't had any requests recently. It's a no-op
+// if it was last called less than namespaceLimiterIdlePeriod ago.
+func (r *namespaceRateLimitedReconciler) pruneIdle(now time.Time) {
+	if now.Sub(r.lastPrune) < namespaceLimiterIdlePeriod {
+		return
+	}
+	r.lastPrune = now
+
+	for namespace, l := range r.limiters {
+		if now.Sub(l.lastUsed) >= namespaceLimiterIdlePeriod {
+			// Deferred requests would have been retried long before now, so any that remain are
+			// for objects that were deleted.
+			delete(r.limiters, namespace)
+			r.metrics.namespaceQueueDepth.DeleteLabelValues(r.controllerName, namespace)
+		}
+	}
+}
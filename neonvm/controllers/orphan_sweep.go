@@ -0,0 +1,181 @@
+package controllers
+
+// Cleanup of orphaned auxiliary resources
+//
+// Besides runner pods, the VM controller generates auxiliary resources for VMs: the SSH secret
+// (with .spec.enableSSH) and the PVCs for disks restored from VolumeSnapshots. They're owned by the
+// VM, so they're normally garbage collected with it. But that isn't always enough: deleting a VM
+// with '--cascade=orphan' removes the owner references, as does restoring resources from a backup
+// without their owners, and a resource may outlive its VM while the VM is recreated with the same
+// name.
+//
+// So generated resources are also labeled with the VM they're for (see
+// vmv1.VirtualMachineGeneratedForLabel), and annotated with its UID (see
+// vmv1.VirtualMachineGeneratedForUIDAnnotation). OrphanSweeper periodically checks the generated
+// Secrets and clone VirtualMachineSnapshots: those that lost their owner reference are adopted again
+// by their VM, if it still exists, and those generated for a VM that no longer exists (or was
+// recreated with a different UID) are deleted.
+//
+// The annotation is what proves that we generated an object for a particular VM - the label alone
+// doesn't, because it's just the VM's name. So objects with neither an owner reference to a VM nor
+// the annotation (i.e. from older controllers) are only ever adopted, never deleted. PVCs are left
+// alone entirely: they may hold data that's worth more than the VM they were restored for.
+//
+// The controller doesn't generate any other kinds of resources for VMs. In particular, there are no
+// per-VM Services, NetworkPolicies, or certificates: the runner pod is reached on its own IP, and
+// the exec API's serving certificate is shared (see exec_api.go).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// orphanSweepMinAge is how old a generated resource must be before the sweep checks it, so that we
+// don't race with the creation of its VM.
+const orphanSweepMinAge = time.Minute
+
+// generatedResourceKinds are the kinds of auxiliary resources that the sweep checks
+var generatedResourceKinds = []struct {
+	kind    string
+	newList func() client.ObjectList
+}{
+	{"Secret", func() client.ObjectList { return &corev1.SecretList{} }},
+	{"VirtualMachineSnapshot", func() client.ObjectList { return &vmv1.VirtualMachineSnapshotList{} }},
+}
+
+// OrphanSweeper periodically deletes the generated resources for VMs that no longer exist, and
+// adopts those that lost their owner reference. See the comment at the top of this file for more.
+//
+// It implements manager.Runnable.
+type OrphanSweeper struct {
+	Client client.Client
+	// APIReader is used to list the generated resources, so that they don't need to be cached.
+	APIReader client.Reader
+	Scheme    *runtime.Scheme
+	// Interval is the time between sweeps. If zero, the sweeper is disabled.
+	Interval time.Duration
+	Metrics  ReconcilerMetrics
+}
+
+func (s OrphanSweeper) Start(ctx context.Context) error {
+	if s.Interval == 0 {
+		return nil
+	}
+	go s.run(ctx)
+	return nil
+}
+
+func (s OrphanSweeper) run(ctx context.Context) {
+	log := log.FromContext(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.Interval):
+		}
+
+		if err := s.sweep(ctx, time.Now()); err != nil {
+			log.Error(err, "Failed to sweep orphaned generated resources")
+			s.Metrics.orphanSweepFailures.Inc()
+		}
+	}
+}
+
+// sweep checks all generated resources once, continuing past failures
+func (s OrphanSweeper) sweep(ctx context.Context, now time.Time) error {
+	var errs []error
+
+	for _, k := range generatedResourceKinds {
+		list := k.newList()
+		if err := s.APIReader.List(ctx, list, client.HasLabels{vmv1.VirtualMachineGeneratedForLabel}); err != nil {
+			errs = append(errs, fmt.Errorf("failed to list %ss: %w", k.kind, err))
+			continue
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to extract %ss from list: %w", k.kind, err))
+			continue
+		}
+		for _, item := range items {
+			obj := item.(client.Object)
+			if err := s.sweepObject(ctx, k.kind, obj, now); err != nil {
+				errs = append(errs, fmt.Errorf("%s %s/%s: %w", k.kind, obj.GetNamespace(), obj.GetName(), err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s OrphanSweeper) sweepObject(ctx context.Context, kind string, obj client.Object, now time.Time) error {
+	log := log.FromContext(ctx).WithValues("kind", kind, "namespace", obj.GetNamespace(), "name", obj.GetName())
+
+	if obj.GetDeletionTimestamp() != nil || now.Sub(obj.GetCreationTimestamp().Time) < orphanSweepMinAge {
+		return nil
+	}
+
+	vmName := obj.GetLabels()[vmv1.VirtualMachineGeneratedForLabel]
+	// The UID of the VM the object was generated for, if we know it
+	generatedFor := types.UID(obj.GetAnnotations()[vmv1.VirtualMachineGeneratedForUIDAnnotation])
+	owner := metav1.GetControllerOf(obj)
+	if owner != nil {
+		if owner.APIVersion != vmv1.SchemeGroupVersion.String() || owner.Kind != "VirtualMachine" {
+			// Not ours to clean up.
+			return nil
+		}
+		vmName = owner.Name
+		generatedFor = owner.UID
+	}
+
+	var vm vmv1.VirtualMachine
+	err := s.Client.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: vmName}, &vm)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get VirtualMachine %s: %w", vmName, err)
+	}
+	vmExists := err == nil
+
+	switch {
+	case vmExists && (generatedFor == "" || generatedFor == vm.UID) && owner == nil:
+		if err := ctrl.SetControllerReference(&vm, obj, s.Scheme); err != nil {
+			return err
+		}
+		if err := s.Client.Update(ctx, obj); err != nil {
+			return fmt.Errorf("failed to adopt: %w", err)
+		}
+		log.Info("Adopted generated resource without owner reference", "VirtualMachine", vmName)
+		s.Metrics.orphanedResources.WithLabelValues(kind, "adopted").Inc()
+	case vmExists && generatedFor == vm.UID:
+		// Not orphaned.
+	case generatedFor == "":
+		// Without an owner reference or the annotation, we can't tell that the object is really
+		// ours.
+	default:
+		// Either the VM doesn't exist, or it's a new VM with the same name. Use the UID as a
+		// precondition, in case the resource was recreated in the meantime.
+		uid := obj.GetUID()
+		err := s.Client.Delete(ctx, obj, client.Preconditions{UID: &uid}, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete: %w", err)
+		}
+		log.Info("Deleted orphaned generated resource", "VirtualMachine", vmName, "generatedForUID", generatedFor)
+		s.Metrics.orphanedResources.WithLabelValues(kind, "deleted").Inc()
+	}
+
+	return nil
+}
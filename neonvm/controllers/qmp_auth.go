@@ -0,0 +1,52 @@
+package controllers
+
+// Authentication to neonvm-runner's QMP proxy
+//
+// If the controller is given a QMP auth token (ReconcilerConfig.QMPAuthToken), new runner pods are
+// passed its hash, and the runner only forwards QMP commands to QEMU from clients that have
+// authenticated with the token. See neonvm/runner/qmp_proxy.go for more.
+//
+// Runner pods created without the hash (e.g. before the token was configured) don't know about the
+// authentication command, so we ignore QEMU's error that the command doesn't exist.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-qemu/qmp"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// qmpAuthTokenHash returns the hash of the token to pass to new runner pods, or "" if
+// authentication is disabled
+func qmpAuthTokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+	return api.QMPAuthTokenHash(token)
+}
+
+// qmpAuthenticate authenticates the connection to neonvm-runner's QMP proxy, if enabled
+func qmpAuthenticate(mon *qmp.SocketMonitor, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	qmpcmd, err := json.Marshal(map[string]any{
+		"execute":   api.QMPAuthenticateCommand,
+		"arguments": api.QMPAuthenticateArguments{Token: token},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := qmpRun(mon, qmpcmd); err != nil {
+		// Runner pods without the proxy pass the command to QEMU, which doesn't know it.
+		if strings.Contains(err.Error(), "has not been found") {
+			return nil
+		}
+		return fmt.Errorf("failed to authenticate to QMP: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package controllers
+
+// Per-node circuit breakers for QMP operations
+//
+// When something goes wrong on a node (e.g. its storage stalls), QMP operations for every VM on
+// that node start failing or timing out. Because each failed reconcile is retried, this turns into
+// a retry storm of hotplug operations against QEMU processes that are already struggling, which
+// can make the incident worse.
+//
+// To prevent that, each node gets a circuit breaker that counts consecutive failures of resize
+// operations on its VMs. Once there are QMPBreakerConfig.FailureThreshold of them, the breaker
+// opens, and resizes for VMs on the node are paused (the VMs stay in the Scaling phase) for
+// QMPBreakerConfig.OpenDuration. After that, a single resize is allowed through as a trial: if it
+// succeeds the breaker closes, otherwise it opens again.
+//
+// Only non-critical operations are paused - everything else (e.g. keeping status up-to-date or
+// handling a deleted runner pod) still happens as usual.
+
+import (
+	"sync"
+	"time"
+)
+
+// QMPBreakerConfig configures the per-node circuit breakers for QMP operations
+type QMPBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed resize operations on a node after which
+	// resizes for VMs on the node are paused. Zero disables the circuit breakers.
+	FailureThreshold int
+	// OpenDuration is how long resizes are paused for, before trying one again.
+	OpenDuration time.Duration
+}
+
+type qmpBreakerState string
+
+const (
+	qmpBreakerClosed   qmpBreakerState = "closed"
+	qmpBreakerOpen     qmpBreakerState = "open"
+	qmpBreakerHalfOpen qmpBreakerState = "half-open"
+)
+
+var qmpBreakerStates = []qmpBreakerState{qmpBreakerClosed, qmpBreakerOpen, qmpBreakerHalfOpen}
+
+// qmpNodeBreakers is the set of circuit breakers for each node.
+//
+// A nil *qmpNodeBreakers always allows operations, so that the circuit breakers are disabled if
+// they were never set up (e.g. in tests).
+type qmpNodeBreakers struct {
+	config  QMPBreakerConfig
+	metrics ReconcilerMetrics
+
+	mu    sync.Mutex
+	nodes map[string]*qmpBreaker
+}
+
+type qmpBreaker struct {
+	state               qmpBreakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	// trialInProgress is true while in the half-open state, if an operation has been allowed
+	// through and its result not yet recorded.
+	trialInProgress bool
+}
+
+// newQMPNodeBreakers returns the circuit breakers for the config, or nil if they're disabled
+func newQMPNodeBreakers(config QMPBreakerConfig, metrics ReconcilerMetrics) *qmpNodeBreakers {
+	if config.FailureThreshold == 0 {
+		return nil
+	}
+	return &qmpNodeBreakers{
+		config:  config,
+		metrics: metrics,
+		mu:      sync.Mutex{},
+		nodes:   make(map[string]*qmpBreaker),
+	}
+}
+
+// allow returns whether a non-critical QMP operation may be performed on the node. If allow
+// returns true, the result of the operation must be passed to record.
+func (b *qmpNodeBreakers) allow(node string) bool {
+	if b == nil || node == "" {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.nodes[node]
+	if !ok {
+		return true
+	}
+
+	switch breaker.state {
+	case qmpBreakerOpen:
+		if time.Since(breaker.openedAt) < b.config.OpenDuration {
+			b.metrics.qmpBreakerPaused.WithLabelValues(node).Inc()
+			return false
+		}
+		b.setState(node, breaker, qmpBreakerHalfOpen)
+		breaker.trialInProgress = true
+		return true
+	case qmpBreakerHalfOpen:
+		if breaker.trialInProgress {
+			b.metrics.qmpBreakerPaused.WithLabelValues(node).Inc()
+			return false
+		}
+		breaker.trialInProgress = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the result of a QMP operation on the node that was allowed by allow
+func (b *qmpNodeBreakers) record(node string, err error) {
+	if b == nil || node == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	breaker, ok := b.nodes[node]
+	if err == nil {
+		if ok {
+			// Successful operations on healthy nodes are the common case, so we only keep state
+			// for nodes that have had failures.
+			delete(b.nodes, node)
+			b.metrics.qmpBreakerState.DeletePartialMatch(map[string]string{"node": node})
+		}
+		return
+	}
+
+	if !ok {
+		breaker = &qmpBreaker{
+			state:               qmpBreakerClosed,
+			consecutiveFailures: 0,
+			openedAt:            time.Time{},
+			trialInProgress:     false,
+		}
+		b.nodes[node] = breaker
+		b.setState(node, breaker, qmpBreakerClosed)
+	}
+
+	breaker.consecutiveFailures += 1
+	breaker.trialInProgress = false
+	if breaker.state == qmpBreakerHalfOpen || breaker.consecutiveFailures >= b.config.FailureThreshold {
+		if breaker.state != qmpBreakerOpen {
+			b.metrics.qmpBreakerTrips.WithLabelValues(node).Inc()
+		}
+		breaker.openedAt = time.Now()
+		b.setState(node, breaker, qmpBreakerOpen)
+	}
+}
+
+func (b *qmpNodeBreakers) setState(node string, breaker *qmpBreaker, state qmpBreakerState) {
+	breaker.state = state
+	for _, s := range qmpBreakerStates {
+		value := 0.0
+		if s == state {
+			value = 1.0
+		}
+		b.metrics.qmpBreakerState.WithLabelValues(node, string(s)).Set(value)
+	}
+}
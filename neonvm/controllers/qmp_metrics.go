@@ -0,0 +1,56 @@
+package controllers
+
+// Metrics for QMP commands sent to VMs
+//
+// QMP commands are sent by free functions (see vm_qmp_queries.go) that don't have access to the
+// reconcilers' metrics, so - like the QMP auth token - the metrics are set once at startup, and all
+// commands are sent via qmpRun to record them.
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// qmpMetrics are the metrics that QMP commands are recorded in. It's set once at startup, by
+// SetQMPMetrics. Nil means QMP commands aren't recorded (e.g. in tests).
+var qmpMetrics *ReconcilerMetrics
+
+// SetQMPMetrics sets the metrics that the latency and errors of QMP commands are recorded in.
+//
+// It must be called before starting the reconcilers.
+func SetQMPMetrics(m ReconcilerMetrics) {
+	qmpMetrics = &m
+}
+
+// qmpConnectCommand is the "command" label used for connecting to QMP, including authentication
+const qmpConnectCommand = "connect"
+
+// qmpRun runs the QMP command on the monitor, recording its latency and whether it failed
+func qmpRun(mon QMPRunner, cmd []byte) ([]byte, error) {
+	start := time.Now()
+	raw, err := mon.Run(cmd)
+	observeQMPCommand(qmpCommandName(cmd), time.Since(start), err)
+	return raw, err
+}
+
+func observeQMPCommand(command string, duration time.Duration, err error) {
+	if qmpMetrics == nil {
+		return
+	}
+	qmpMetrics.qmpCommandDuration.WithLabelValues(command).Observe(duration.Seconds())
+	if err != nil {
+		qmpMetrics.qmpCommandErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// qmpCommandName returns the name of the QMP command, e.g. "query-cpus-fast", or "unknown" if it
+// can't be parsed.
+func qmpCommandName(cmd []byte) string {
+	var parsed struct {
+		Execute string `json:"execute"`
+	}
+	if err := json.Unmarshal(cmd, &parsed); err != nil || parsed.Execute == "" {
+		return "unknown"
+	}
+	return parsed.Execute
+}
@@ -0,0 +1,185 @@
+package controllers
+
+// Per-object rate limiting and limits on expensive operations
+//
+// Reconciles are all handled by the same pool of MaxConcurrentReconciles workers, whether they're
+// a quick status update or a slow QMP operation. Without further limits, a burst of scaling
+// requests (or a handful of VMs being reconciled in a tight loop) can occupy every worker, so that
+// e.g. runner pods for new VMs aren't created until the burst is over.
+//
+// So, in addition to per-namespace rate limiting (see namespace_ratelimit.go), we have:
+//
+//  1. Per-object rate limiting, which works the same way as the per-namespace limits, but keyed by
+//     the object being reconciled.
+//  2. A separate limit on the number of reconciles performing "expensive" operations (QMP calls
+//     for scaling, starting migrations) at the same time. A reconcile that would perform an
+//     expensive operation while the limit is reached skips it and is requeued, freeing its worker
+//     for "cheap" reconciles in the meantime. This is effectively a separate queue for expensive
+//     operations, with its own concurrency.
+//
+// We can't do this with separate workqueues, because the version of controller-runtime we use
+// doesn't allow replacing them.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ObjectRateLimit configures per-object rate limiting of reconciles
+type ObjectRateLimit struct {
+	// QPS is the sustained number of reconciles per second allowed for each object. Zero disables
+	// rate limiting.
+	QPS float64
+	// Burst is the number of reconciles allowed for an object in a burst, above QPS.
+	Burst int
+}
+
+// expensiveOperationRetryInterval is how long until a reconcile is retried when it skipped an
+// expensive operation because the limit was reached
+const expensiveOperationRetryInterval = time.Second
+
+type objectRateLimitedReconciler struct {
+	inner          reconcile.Reconciler
+	controllerName string
+	config         ObjectRateLimit
+	metrics        ReconcilerMetrics
+
+	mu        sync.Mutex
+	limiters  map[ctrl.Request]*objectLimiter
+	lastPrune time.Time
+}
+
+type objectLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// withObjectRateLimit wraps the reconciler with per-object rate limiting, if it's enabled
+func withObjectRateLimit(
+	r reconcile.Reconciler,
+	controllerName string,
+	config ObjectRateLimit,
+	metrics ReconcilerMetrics,
+) reconcile.Reconciler {
+	if config.QPS == 0 {
+		return r
+	}
+	return &objectRateLimitedReconciler{
+		inner:          r,
+		controllerName: controllerName,
+		config:         config,
+		metrics:        metrics,
+		mu:             sync.Mutex{},
+		limiters:       make(map[ctrl.Request]*objectLimiter),
+		lastPrune:      time.Now(),
+	}
+}
+
+func (r *objectRateLimitedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if delay := r.take(req); delay != 0 {
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	return r.inner.Reconcile(ctx, req)
+}
+
+// take consumes a token for the object, returning zero if the request can proceed. Otherwise, no
+// token is consumed and take returns how long until one will be available.
+func (r *objectRateLimitedReconciler) take(req ctrl.Request) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.pruneIdle(now)
+
+	l, ok := r.limiters[req]
+	if !ok {
+		l = &objectLimiter{
+			limiter:  rate.NewLimiter(rate.Limit(r.config.QPS), r.config.Burst),
+			lastUsed: now,
+		}
+		r.limiters[req] = l
+	}
+	l.lastUsed = now
+
+	reservation := l.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay != 0 {
+		reservation.CancelAt(now)
+		r.metrics.objectThrottled.WithLabelValues(r.controllerName).Inc()
+	}
+	return delay
+}
+
+// pruneIdle removes limiters for objects that haven't had any requests recently. It's a no-op if it
+// was last called less than namespaceLimiterIdlePeriod ago.
+func (r *objectRateLimitedReconciler) pruneIdle(now time.Time) {
+	if now.Sub(r.lastPrune) < namespaceLimiterIdlePeriod {
+		return
+	}
+	r.lastPrune = now
+
+	for req, l := range r.limiters {
+		if now.Sub(l.lastUsed) >= namespaceLimiterIdlePeriod {
+			delete(r.limiters, req)
+		}
+	}
+}
+
+// expensiveOperationLimiter limits the number of reconciles performing expensive operations at the
+// same time.
+//
+// A nil *expensiveOperationLimiter has no limit, so that it's disabled if it was never set up (e.g.
+// in tests).
+type expensiveOperationLimiter struct {
+	controllerName string
+	metrics        ReconcilerMetrics
+	slots          chan struct{}
+}
+
+// newExpensiveOperationLimiter returns a limiter allowing up to limit concurrent expensive
+// operations, or nil if limit is zero
+func newExpensiveOperationLimiter(
+	controllerName string,
+	limit int,
+	metrics ReconcilerMetrics,
+) *expensiveOperationLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &expensiveOperationLimiter{
+		controllerName: controllerName,
+		metrics:        metrics,
+		slots:          make(chan struct{}, limit),
+	}
+}
+
+// tryAcquire returns whether an expensive operation may start now. If tryAcquire returns true,
+// release must be called once the operation is complete.
+func (l *expensiveOperationLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.metrics.expensiveInProgress.WithLabelValues(l.controllerName).Inc()
+		return true
+	default:
+		l.metrics.expensiveDeferred.WithLabelValues(l.controllerName).Inc()
+		return false
+	}
+}
+
+func (l *expensiveOperationLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	<-l.slots
+	l.metrics.expensiveInProgress.WithLabelValues(l.controllerName).Dec()
+}
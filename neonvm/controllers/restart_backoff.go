@@ -0,0 +1,89 @@
+package controllers
+
+// Restart backoff and crash loop detection
+//
+// When a VM's runner pod stops and .spec.restartPolicy says it should be restarted, the restart is
+// delayed by an exponential backoff based on .status.consecutiveRestarts - the number of restarts in
+// a row where the runner pod didn't stay up for restartBackoffResetAfter. The first restart isn't
+// delayed at all, then each one after that waits twice as long as the last, up to
+// restartBackoffMax. While waiting, the VM stays in its Succeeded or Failed phase, with the time of
+// the restart in .status.nextRestartTime.
+//
+// Once there have been crashLoopThreshold consecutive restarts, the VM's CrashLoopBackOff
+// condition is set, until the runner pod stays up for long enough to reset the count.
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	// restartBackoffInitial is the delay before the second consecutive restart
+	restartBackoffInitial = 10 * time.Second
+	// restartBackoffMax is the longest that a restart is delayed for
+	restartBackoffMax = 5 * time.Minute
+	// restartBackoffResetAfter is how long the runner pod must stay up for its next restart to not
+	// be counted as consecutive
+	restartBackoffResetAfter = 10 * time.Minute
+	// crashLoopThreshold is the number of consecutive restarts after which the VM is considered to
+	// be crash looping
+	crashLoopThreshold = 3
+)
+
+// restartBackoff returns how long to delay a restart after the given number of consecutive
+// restarts
+func restartBackoff(consecutiveRestarts int32) time.Duration {
+	if consecutiveRestarts <= 0 {
+		return 0
+	}
+	backoff := restartBackoffInitial
+	for i := int32(1); i < consecutiveRestarts; i++ {
+		backoff *= 2
+		if backoff >= restartBackoffMax {
+			return restartBackoffMax
+		}
+	}
+	return backoff
+}
+
+// restartAfterBackoff is called while the VM's runner pod has stopped and it should be restarted.
+// It returns true once the VM's backoff has passed, after updating its status for the restart.
+func (r *VMReconciler) restartAfterBackoff(vm *vmv1.VirtualMachine, now time.Time) bool {
+	if vm.Status.NextRestartTime == nil {
+		backoff := restartBackoff(vm.Status.ConsecutiveRestarts)
+		vm.Status.NextRestartTime = &metav1.Time{Time: now.Add(backoff)}
+		if backoff != 0 {
+			r.Recorder.Event(vm, corev1.EventTypeWarning, "BackOff",
+				fmt.Sprintf("Restarting VM in %s, after %d consecutive restarts", backoff, vm.Status.ConsecutiveRestarts))
+		}
+	}
+
+	if now.Before(vm.Status.NextRestartTime.Time) {
+		return false
+	}
+
+	vm.Status.NextRestartTime = nil
+	vm.Status.ConsecutiveRestarts += 1
+	return true
+}
+
+// resetRestartBackoff resets the VM's consecutive restarts once its runner pod has been up for long
+// enough
+func resetRestartBackoff(vm *vmv1.VirtualMachine, pod *corev1.Pod, now time.Time) {
+	if vm.Status.ConsecutiveRestarts == 0 || pod.Status.StartTime == nil {
+		return
+	}
+	if now.Sub(pod.Status.StartTime.Time) >= restartBackoffResetAfter {
+		vm.Status.ConsecutiveRestarts = 0
+	}
+}
+
+// crashLooping returns whether the VM has restarted too many times in a row
+func crashLooping(vm *vmv1.VirtualMachine) bool {
+	return vm.Status.ConsecutiveRestarts >= crashLoopThreshold
+}
@@ -0,0 +1,384 @@
+package controllers
+
+// Gradual rollout of changes that require restarting VMs
+//
+// Some changes only take effect when a VM's runner pod is recreated: a new neonvm-runner image, a
+// new kernel image or kernel command line, or controller settings that are passed to the runner at
+// startup. Each runner pod is annotated with a hash of these "restart inputs" when it's created
+// (see vmv1.RunnerPodRestartInputsAnnotation), so we can tell which VMs are out of date.
+//
+// With a rollout enabled (RolloutConfig.MaxUnavailable > 0), out-of-date VMs are restarted by the
+// controller, with at most MaxUnavailable VMs restarting at once across the fleet. A restart
+// succeeds if the VM is running again, with up-to-date restart inputs, within BootSLO. If the
+// fraction of failed restarts in the last FailureWindow reaches MaxFailureRate, the rollout is
+// paused until enough of those failures are older than FailureWindow.
+//
+// Progress for each VM is tracked with the RestartInputsUpToDate condition, and across the fleet
+// with the vm_rollout_* metrics.
+//
+// Rollouts usually come with a restart of the controller itself (e.g. for a new runner image), so
+// the fleet-wide state is rebuilt from the VMs' conditions on startup: VMs that are still
+// Restarting count towards MaxUnavailable again, and if any VM is waiting because the rollout was
+// Paused, it stays paused for another FailureWindow, because the failures that caused it weren't
+// kept.
+//
+// Runner pods created before the annotation was added don't have it, and are never restarted by a
+// rollout.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// RolloutConfig configures the gradual restart of VMs with out-of-date restart inputs
+type RolloutConfig struct {
+	// MaxUnavailable is the maximum number of VMs that may be restarting because of a rollout at
+	// the same time. Zero disables rollouts.
+	MaxUnavailable int
+	// BootSLO is how long a VM may take to be running again after it's restarted, before the
+	// restart is counted as a failure.
+	BootSLO time.Duration
+	// MaxFailureRate is the fraction of restarts in the last FailureWindow that may fail before the
+	// rollout is paused.
+	MaxFailureRate float64
+	// FailureWindow is the period over which the failure rate is calculated.
+	FailureWindow time.Duration
+	// MinRestartsForPause is the minimum number of restarts in the last FailureWindow before the
+	// failure rate is checked, so that a single early failure doesn't pause the rollout.
+	MinRestartsForPause int
+}
+
+const (
+	// typeRestartInputsUpToDate represents whether the VM's runner pod was created with the current
+	// restart inputs. It's only set when rollouts are enabled.
+	typeRestartInputsUpToDate = "RestartInputsUpToDate"
+
+	rolloutReasonUpToDate   = "UpToDate"
+	rolloutReasonWaiting    = "Waiting"
+	rolloutReasonPaused     = "Paused"
+	rolloutReasonRestarting = "Restarting"
+)
+
+// restartInputs are the settings that a VM's runner pod only picks up when it's created
+type restartInputs struct {
+	RunnerImage           string          `json:"runnerImage"`
+	KernelImage           *string         `json:"kernelImage"`
+	AppendKernelCmdline   *string         `json:"appendKernelCmdline"`
+	KernelCmdline         []string        `json:"kernelCmdline"`
+	BootMethod            vmv1.BootMethod `json:"bootMethod"`
+	QEMUDiskCacheSettings string          `json:"qemuDiskCacheSettings"`
+	MemhpAutoMovableRatio string          `json:"memhpAutoMovableRatio"`
+	// PortForwarding is only set if it's not IPTables, so that adding it didn't change the hash
+	// for existing runner pods.
+	PortForwarding vmv1.PortForwarding `json:"portForwarding,omitempty"`
+}
+
+// restartInputsHash returns the hash of the restart inputs for a new runner pod for the VM
+func restartInputsHash(vm *vmv1.VirtualMachine, runnerImage string, config *ReconcilerConfig) string {
+	inputs := restartInputs{
+		RunnerImage:           runnerImage,
+		KernelImage:           vm.Spec.Guest.KernelImage,
+		AppendKernelCmdline:   vm.Spec.Guest.AppendKernelCmdline,
+		KernelCmdline:         vm.Spec.Guest.KernelCmdline,
+		BootMethod:            vm.Spec.Guest.BootMethod,
+		QEMUDiskCacheSettings: config.QEMUDiskCacheSettings,
+		MemhpAutoMovableRatio: config.MemhpAutoMovableRatio,
+		PortForwarding:        "",
+	}
+	if pf := pickPortForwarding(config, vm); pf != vmv1.PortForwardingIPTables {
+		inputs.PortForwarding = pf
+	}
+	// Marshaling a struct of strings can't fail.
+	data, _ := json.Marshal(inputs)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// rolloutTracker limits and tracks the restarts of VMs for a rollout.
+//
+// A nil *rolloutTracker means rollouts are disabled.
+type rolloutTracker struct {
+	config  RolloutConfig
+	metrics ReconcilerMetrics
+
+	mu sync.Mutex
+	// restored is true once the state has been rebuilt from the VMs' conditions. See restore.
+	restored bool
+	// inFlight stores the time that each VM currently restarting was restarted
+	inFlight map[types.NamespacedName]*rolloutRestart
+	// outcomes are the results of recent restarts, oldest first
+	outcomes []rolloutOutcome
+	// pausedUntil, if set, is when a pause that was in effect before the controller restarted ends
+	pausedUntil time.Time
+	paused      bool
+}
+
+type rolloutRestart struct {
+	startedAt time.Time
+	// failed is true if the restart has already been counted as a failure for exceeding the
+	// BootSLO. The VM stays in flight until it's running again.
+	failed bool
+}
+
+type rolloutOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// newRolloutTracker returns the tracker for the config, or nil if rollouts are disabled
+func newRolloutTracker(config RolloutConfig, metrics ReconcilerMetrics) *rolloutTracker {
+	if config.MaxUnavailable == 0 {
+		return nil
+	}
+	return &rolloutTracker{
+		config:      config,
+		metrics:     metrics,
+		mu:          sync.Mutex{},
+		restored:    false,
+		inFlight:    make(map[types.NamespacedName]*rolloutRestart),
+		outcomes:    nil,
+		pausedUntil: time.Time{},
+		paused:      false,
+	}
+}
+
+// restore rebuilds the tracker's state from the RestartInputsUpToDate conditions of every VM, if it
+// hasn't been already. It must be called before the tracker is first used.
+func (t *rolloutTracker) restore(ctx context.Context, c client.Reader) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.restored {
+		return nil
+	}
+
+	var vms vmv1.VirtualMachineList
+	if err := c.List(ctx, &vms); err != nil {
+		return fmt.Errorf("failed to list VMs to restore rollout state: %w", err)
+	}
+
+	now := time.Now()
+	wasPaused := false
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		cond := meta.FindStatusCondition(vm.Status.Conditions, typeRestartInputsUpToDate)
+		if cond == nil {
+			continue
+		}
+		switch cond.Reason {
+		case rolloutReasonRestarting:
+			// We don't know exactly when the restart started, so it gets the full BootSLO from now.
+			key := types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}
+			t.inFlight[key] = &rolloutRestart{startedAt: now, failed: false}
+		case rolloutReasonPaused:
+			wasPaused = true
+		}
+	}
+
+	if wasPaused {
+		t.pausedUntil = now.Add(t.config.FailureWindow)
+	}
+	t.restored = true
+	t.metrics.rolloutInFlight.Set(float64(len(t.inFlight)))
+	t.update(now)
+
+	log.FromContext(ctx).Info(
+		"Restored rollout state",
+		"inFlight", len(t.inFlight),
+		"paused", t.paused,
+	)
+	return nil
+}
+
+// tryStart returns whether the VM may be restarted now, and if not, the condition reason and
+// message explaining why.
+func (t *rolloutTracker) tryStart(vm types.NamespacedName) (ok bool, reason string, message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.update(now)
+
+	if _, ok := t.inFlight[vm]; ok {
+		return true, "", ""
+	} else if t.paused {
+		return false, rolloutReasonPaused, "Rollout is paused because too many recent restarts failed"
+	} else if len(t.inFlight) >= t.config.MaxUnavailable {
+		return false, rolloutReasonWaiting, fmt.Sprintf("Waiting for other VMs to restart (%d in progress)", len(t.inFlight))
+	}
+
+	t.inFlight[vm] = &rolloutRestart{startedAt: now, failed: false}
+	t.metrics.rolloutInFlight.Set(float64(len(t.inFlight)))
+	return true, "", ""
+}
+
+// finished records that the VM is running with up-to-date restart inputs, if it was restarting.
+func (t *rolloutTracker) finished(vm types.NamespacedName) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	restart, ok := t.inFlight[vm]
+	if !ok {
+		return
+	}
+	delete(t.inFlight, vm)
+	t.metrics.rolloutInFlight.Set(float64(len(t.inFlight)))
+
+	now := time.Now()
+	t.metrics.rolloutBootDuration.Observe(now.Sub(restart.startedAt).Seconds())
+	if !restart.failed {
+		t.record(now, false)
+	}
+	t.update(now)
+}
+
+// forget stops tracking the VM, e.g. because it was deleted.
+func (t *rolloutTracker) forget(vm types.NamespacedName) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, vm)
+	t.metrics.rolloutInFlight.Set(float64(len(t.inFlight)))
+}
+
+// update counts restarts that have exceeded the BootSLO as failures, drops outcomes older than the
+// FailureWindow, and pauses or resumes the rollout based on the failure rate. t.mu must be held.
+func (t *rolloutTracker) update(now time.Time) {
+	for _, restart := range t.inFlight {
+		if !restart.failed && now.Sub(restart.startedAt) > t.config.BootSLO {
+			restart.failed = true
+			t.record(now, true)
+		}
+	}
+
+	cutoff := now.Add(-t.config.FailureWindow)
+	for len(t.outcomes) != 0 && t.outcomes[0].at.Before(cutoff) {
+		t.outcomes = t.outcomes[1:]
+	}
+
+	failures := 0
+	for _, o := range t.outcomes {
+		if o.failed {
+			failures += 1
+		}
+	}
+	paused := len(t.outcomes) >= t.config.MinRestartsForPause &&
+		len(t.outcomes) != 0 &&
+		float64(failures)/float64(len(t.outcomes)) >= t.config.MaxFailureRate
+	// A pause from before the controller restarted is kept until pausedUntil, but isn't counted
+	// again in rolloutPauses.
+	restoredPause := now.Before(t.pausedUntil)
+	if paused && !t.paused && !restoredPause {
+		t.metrics.rolloutPauses.Inc()
+	}
+	paused = paused || restoredPause
+
+	if paused != t.paused {
+		t.paused = paused
+		value := 0.0
+		if paused {
+			value = 1.0
+		}
+		t.metrics.rolloutPaused.Set(value)
+	}
+}
+
+// record adds the outcome of a restart. t.mu must be held.
+func (t *rolloutTracker) record(now time.Time, failed bool) {
+	t.outcomes = append(t.outcomes, rolloutOutcome{at: now, failed: failed})
+	outcome := "success"
+	if failed {
+		outcome = "failure"
+	}
+	t.metrics.rolloutRestarts.WithLabelValues(outcome).Inc()
+}
+
+// rolloutRestartInProgress returns whether the VM's runner pod was deleted by checkRollout, so that
+// the VM should be started again once the pod is gone, regardless of its restart policy.
+func rolloutRestartInProgress(vm *vmv1.VirtualMachine) bool {
+	c := meta.FindStatusCondition(vm.Status.Conditions, typeRestartInputsUpToDate)
+	return c != nil && c.Reason == rolloutReasonRestarting
+}
+
+// checkRollout updates the VM's RestartInputsUpToDate condition, restarting it if it's out of date
+// and the rollout allows it.
+//
+// It must only be called for running VMs.
+func (r *VMReconciler) checkRollout(ctx context.Context, vm *vmv1.VirtualMachine, vmRunner *corev1.Pod) error {
+	if r.rollout == nil {
+		meta.RemoveStatusCondition(&vm.Status.Conditions, typeRestartInputsUpToDate)
+		return nil
+	}
+
+	current, ok := vmRunner.Annotations[vmv1.RunnerPodRestartInputsAnnotation]
+	if !ok || vmRunner.DeletionTimestamp != nil {
+		return nil
+	}
+
+	image, err := imageForVmRunner()
+	if err != nil {
+		return err
+	}
+
+	if err := r.rollout.restore(ctx, r.Client); err != nil {
+		return err
+	}
+
+	key := types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}
+	if current == restartInputsHash(vm, image, r.Config) {
+		r.rollout.finished(key)
+		meta.SetStatusCondition(&vm.Status.Conditions, metav1.Condition{
+			Type:    typeRestartInputsUpToDate,
+			Status:  metav1.ConditionTrue,
+			Reason:  rolloutReasonUpToDate,
+			Message: "Runner pod was created with the current restart inputs",
+		})
+		return nil
+	}
+
+	condition := metav1.Condition{
+		Type:    typeRestartInputsUpToDate,
+		Status:  metav1.ConditionFalse,
+		Reason:  "",
+		Message: "",
+	}
+	ok, condition.Reason, condition.Message = r.rollout.tryStart(key)
+	if !ok {
+		meta.SetStatusCondition(&vm.Status.Conditions, condition)
+		return nil
+	}
+
+	log.FromContext(ctx).Info("Restarting VM to roll out new restart inputs", "VirtualMachine", vm.Name)
+	r.Recorder.Event(vm, "Normal", "RolloutRestart",
+		fmt.Sprintf("VM %s is being restarted to roll out changes that require a restart", vm.Name))
+	if err := r.deleteRunnerPodIfEnabled(ctx, vm, vmRunner); err != nil {
+		r.rollout.forget(key)
+		return err
+	}
+
+	condition.Reason = rolloutReasonRestarting
+	condition.Message = "VM is being restarted to roll out changes that require a restart"
+	meta.SetStatusCondition(&vm.Status.Conditions, condition)
+	return nil
+}
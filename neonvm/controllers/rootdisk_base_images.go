@@ -0,0 +1,109 @@
+package controllers
+
+// Shared cache of base images for root disks
+//
+// With .spec.guest.rootDisk.baseImageCache, the init container copies the root disk image into a
+// volume shared between VMs (unless it's already there), instead of into the pod's own emptyDir.
+// The runner then creates the VM's root disk as a qcow2 overlay, with the cached image as its
+// read-only backing file.
+//
+// Cached images are named by a hash of the image reference alongside the size and modification
+// time of the disk inside it, so that a tag being pushed again results in a new base image, rather
+// than changing the contents under existing overlays.
+//
+// Compressed images are cached decompressed, so that they can be used as backing files. The init
+// container only copies the compressed image into the cache (as "<base>.zst"), and the first
+// runner to use it decompresses it in place.
+//
+// The runner is responsible for garbage collecting unused base images - see
+// neonvm/runner/rootdisk_base_image.go.
+
+import (
+	"fmt"
+
+	"github.com/samber/lo"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	rootDiskBaseImagesVolume = "rootdisk-base-images"
+	// rootDiskBaseImagesPath is where the cache is mounted, in both the init and runner containers.
+	// The path to the base image is stored in the root disk overlay, so it must be the same in all
+	// runner pods.
+	rootDiskBaseImagesPath = "/vm/base-images"
+	// rootDiskBasePathFile is the file in the images volume that the init container writes the path
+	// of the base image to, for the runner.
+	rootDiskBasePathFile = "/vm/images/rootdisk.base"
+)
+
+// baseImageCacheInitScript returns the init container's script that makes sure the root disk image
+// is in the cache.
+//
+// The image is copied to a temporary file first, so that other VMs never see a partially-copied
+// base image. The base image is touched even if it already exists, so that it isn't garbage
+// collected before the runner starts using it.
+func baseImageCacheInitScript(vm *vmv1.VirtualMachine) string {
+	rootDisk := &vm.Spec.Guest.RootDisk
+
+	// The file that's copied into the cache: the base image itself, or its compressed version.
+	cached := `"$base"`
+	if rootDisk.ImageCompressed() {
+		cached = `"$base.zst"`
+	}
+
+	return fmt.Sprintf(`set -e
+key=$(echo "$ROOTDISK_IMAGE $(stat -c '%%s-%%Y' %[4]s)" | sha256sum | cut -c1-32)
+base=%[1]s/$key.%[5]s
+if [ -f "$base" ]; then
+	touch "$base"
+else
+	if [ ! -f %[6]s ]; then
+		tmp=$(mktemp %[1]s/.tmp-XXXXXX)
+		cp %[4]s "$tmp"
+		chmod 0444 "$tmp"
+		chown 36:34 "$tmp"
+		mv "$tmp" %[6]s
+	fi
+	touch %[6]s
+fi
+echo "$base" > %[2]s
+%[3]s
+`, rootDiskBaseImagesPath, rootDiskBasePathFile, ipForwardingCommand(vm), rootDisk.ImagePath(), rootDisk.ImageFormat(), cached)
+}
+
+// addBaseImageCacheVolume adds the base image cache volume to the pod, mounted in the init and
+// runner containers
+func addBaseImageCacheVolume(pod *corev1.Pod, vm *vmv1.VirtualMachine) {
+	cache := vm.Spec.Guest.RootDisk.BaseImageCache
+
+	var source corev1.VolumeSource
+	if cache.HostPath != nil {
+		source.HostPath = &corev1.HostPathVolumeSource{
+			Path: *cache.HostPath,
+			Type: lo.ToPtr(corev1.HostPathDirectoryOrCreate),
+		}
+	} else {
+		source.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: *cache.PersistentVolumeClaim,
+			ReadOnly:  false,
+		}
+	}
+
+	mount := corev1.VolumeMount{
+		Name:      rootDiskBaseImagesVolume,
+		MountPath: rootDiskBaseImagesPath,
+	}
+	pod.Spec.InitContainers[0].VolumeMounts = append(pod.Spec.InitContainers[0].VolumeMounts, mount)
+	pod.Spec.InitContainers[0].Env = append(pod.Spec.InitContainers[0].Env, corev1.EnvVar{
+		Name:  "ROOTDISK_IMAGE",
+		Value: vm.Spec.Guest.RootDisk.Image,
+	})
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, mount)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         rootDiskBaseImagesVolume,
+		VolumeSource: source,
+	})
+}
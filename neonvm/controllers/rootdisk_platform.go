@@ -0,0 +1,91 @@
+package controllers
+
+// Checking the root disk image's platform against the node pool
+//
+// An image built for the wrong architecture doesn't fail when the runner pod is created - QEMU
+// just can't boot it, and the VM ends up in a restart loop that's only noticed minutes later. So
+// when .spec.guest.rootDisk.platform is set, we check it against the nodes the VM could be
+// scheduled on (those matching .spec.nodeSelector and the required node affinity) before creating
+// the runner pod.
+//
+// If none of those nodes have the image's architecture and OS, the VM stays Pending with a
+// Degraded condition and a warning event explaining why. If there are no matching nodes at all, we
+// can't tell anything (e.g. the node pool may be scaled to zero), so the VM proceeds as usual.
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/samber/lo"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/component-helpers/scheduling/corev1/nodeaffinity"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// rootDiskPlatformMismatchReason is the reason for the Degraded condition and events when the root
+// disk image's platform isn't supported by any eligible node.
+const rootDiskPlatformMismatchReason = "ImagePlatformMismatch"
+
+// checkRootDiskPlatform returns a non-empty message if the VM's root disk image declares a platform
+// that none of the nodes it can be scheduled on support.
+func (r *VMReconciler) checkRootDiskPlatform(ctx context.Context, vm *vmv1.VirtualMachine) (string, error) {
+	if vm.Spec.Guest.RootDisk.Platform == nil {
+		return "", nil
+	}
+
+	var nodes corev1.NodeList
+	if err := r.List(ctx, &nodes); err != nil {
+		return "", fmt.Errorf("failed to list nodes: %w", err)
+	}
+	return rootDiskPlatformMismatch(vm, nodes.Items), nil
+}
+
+// rootDiskPlatformMismatch implements checkRootDiskPlatform for a given set of nodes.
+func rootDiskPlatformMismatch(vm *vmv1.VirtualMachine, nodes []corev1.Node) string {
+	platform := vm.Spec.Guest.RootDisk.Platform
+	if platform == nil {
+		return ""
+	}
+	osName := platform.OS
+	if osName == "" {
+		osName = "linux"
+	}
+
+	// Use the VM's own scheduling constraints, without the defaults from affinityForVirtualMachine
+	// (which are derived from the platform itself).
+	affinity := nodeaffinity.GetRequiredNodeAffinity(&corev1.Pod{
+		Spec: corev1.PodSpec{
+			NodeSelector: vm.Spec.NodeSelector,
+			Affinity:     vm.Spec.Affinity,
+		},
+	})
+
+	var eligible []string
+	for i := range nodes {
+		node := &nodes[i]
+		if ok, err := affinity.Match(node); err != nil || !ok {
+			continue
+		}
+		nodeArch := node.Labels[corev1.LabelArchStable]
+		nodeOS := node.Labels[corev1.LabelOSStable]
+		if nodeArch == platform.Architecture && nodeOS == osName {
+			return ""
+		}
+		eligible = append(eligible, fmt.Sprintf("%s/%s", nodeOS, nodeArch))
+	}
+
+	if len(eligible) == 0 {
+		return ""
+	}
+
+	eligible = lo.Uniq(eligible)
+	slices.Sort(eligible)
+	return fmt.Sprintf(
+		"Root disk image is built for %s/%s, but the nodes that VirtualMachine %s can be scheduled on only support %s",
+		osName, platform.Architecture, vm.Name, strings.Join(eligible, ", "),
+	)
+}
@@ -0,0 +1,199 @@
+package controllers
+
+// Detection of third-party mutations to runner pods
+//
+// Other controllers or admission webhooks in the cluster (e.g. service meshes, security agents)
+// may inject sidecars into runner pods or change their resources. QEMU assumes that it has the
+// runner container's resources to itself, so these changes can break VMs in subtle ways.
+//
+// We detect this in two places:
+//
+//  1. During reconciliation, by comparing the runner pod with what we'd expect, and surfacing the
+//     result via the RunnerPodMutated condition on the VirtualMachine.
+//  2. Optionally, with a validating webhook that rejects such mutations outright, for runner pods
+//     in namespaces labeled with RejectRunnerPodMutationsLabel.
+//
+// Both derive what's expected from the pod's VirtualMachine, so that the pod itself can't be used
+// to declare which containers are allowed.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/exp/slices"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	// typeRunnerPodMutatedVirtualMachine is the condition type set when the runner pod differs
+	// from the one created by the controller.
+	typeRunnerPodMutatedVirtualMachine = "RunnerPodMutated"
+
+	// RejectRunnerPodMutationsLabel is the namespace label that enables rejecting third-party
+	// mutations to runner pods. It is matched by the webhook's namespaceSelector.
+	RejectRunnerPodMutationsLabel = "vm.neon.tech/reject-runner-pod-mutations"
+
+	// RunnerPodWebhookPath is the path that the runner pod validating webhook is served at
+	RunnerPodWebhookPath = "/validate-runner-pod"
+)
+
+var expectedRunnerContainers = []string{"neonvm-runner", "neonvm-container-mgr"}
+
+// runnerPodMutations returns a human-readable description of each way that the runner pod differs
+// from what the controller would have created for the VM.
+//
+// We only check the properties that matter for QEMU: the set of containers, and the resources of
+// the runner container.
+func runnerPodMutations(vm *vmv1.VirtualMachine, pod *corev1.Pod) []string {
+	var mutations []string
+
+	expectedInitContainers := []string{rootDiskInitContainerName, "init-kernel", restoreInitContainerName}
+	for _, c := range vm.Spec.ExtraInitContainers {
+		expectedInitContainers = append(expectedInitContainers, c.Name)
+	}
+	for _, c := range pod.Spec.InitContainers {
+		if !slices.Contains(expectedInitContainers, c.Name) {
+			mutations = append(mutations, fmt.Sprintf("unexpected init container %q", c.Name))
+		}
+	}
+
+	expectedContainers := slices.Clone(expectedRunnerContainers)
+	for _, c := range vm.Spec.ExtraContainers {
+		expectedContainers = append(expectedContainers, c.Name)
+	}
+	for _, c := range pod.Spec.Containers {
+		if !slices.Contains(expectedContainers, c.Name) {
+			mutations = append(mutations, fmt.Sprintf("unexpected container %q", c.Name))
+			continue
+		}
+		if c.Name != "neonvm-runner" {
+			continue
+		}
+
+		// Only compare the resources that the VM sets, because others may be defaulted by the API
+		// server (e.g. requests are set equal to limits if omitted).
+		compare := func(kind string, expected, actual corev1.ResourceList) {
+			for name, qty := range expected {
+				if actualQty, ok := actual[name]; !ok || !actualQty.Equal(qty) {
+					mutations = append(mutations, fmt.Sprintf(
+						"runner container %s %s changed from %s to %s", kind, name, qty.String(), actualQty.String(),
+					))
+				}
+			}
+		}
+		compare("limit", vm.Spec.PodResources.Limits, c.Resources.Limits)
+		compare("request", vm.Spec.PodResources.Requests, c.Resources.Requests)
+	}
+
+	return mutations
+}
+
+// RunnerPodValidator is an admission.Handler that rejects mutations to runner pods
+//
+// It's only invoked for runner pods in namespaces labeled with RejectRunnerPodMutationsLabel, which
+// is enforced by the webhook configuration.
+type RunnerPodValidator struct {
+	decoder *admission.Decoder
+	// reader is used to get the pod's VirtualMachine
+	reader client.Reader
+}
+
+func NewRunnerPodValidator(scheme *runtime.Scheme, reader client.Reader) *RunnerPodValidator {
+	return &RunnerPodValidator{decoder: admission.NewDecoder(scheme), reader: reader}
+}
+
+//+kubebuilder:webhook:path=/validate-runner-pod,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create;update,versions=v1,name=vrunnerpod.kb.io,admissionReviewVersions=v1
+
+func (v *RunnerPodValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := v.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	vmName, ok := pod.Labels[vmv1.VirtualMachineNameLabel]
+	if !ok {
+		return admission.Allowed("not a runner pod")
+	}
+
+	var vm vmv1.VirtualMachine
+	if err := v.reader.Get(ctx, types.NamespacedName{Namespace: req.Namespace, Name: vmName}, &vm); err != nil {
+		// Like the webhook's failurePolicy, don't block the pod if we can't check it. The
+		// controller will still report mutations via the RunnerPodMutated condition.
+		log.FromContext(ctx).Error(err, "Failed to get VirtualMachine for runner pod", "VirtualMachine", vmName)
+		return admission.Allowed(fmt.Sprintf("could not get VirtualMachine %q", vmName))
+	}
+
+	mutations := runnerPodMutations(&vm, pod)
+	// Also reject changes to the runner's resources that the VM doesn't set, comparing against
+	// the previous version of the pod, which was already checked at creation.
+	if len(req.OldObject.Raw) != 0 {
+		oldPod := &corev1.Pod{}
+		if err := v.decoder.DecodeRaw(req.OldObject, oldPod); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		mutations = append(mutations, runnerResourceChanges(oldPod, pod)...)
+	}
+
+	if len(mutations) != 0 {
+		return admission.Denied(fmt.Sprintf("runner pod mutations are not allowed: %s", strings.Join(mutations, "; ")))
+	}
+	return admission.Allowed("")
+}
+
+// runnerResourceChanges returns a description of any changes to the runner container's resources
+// between oldPod and newPod.
+func runnerResourceChanges(oldPod, newPod *corev1.Pod) []string {
+	find := func(pod *corev1.Pod) *corev1.Container {
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].Name == "neonvm-runner" {
+				return &pod.Spec.Containers[i]
+			}
+		}
+		return nil
+	}
+
+	oldRunner, newRunner := find(oldPod), find(newPod)
+	if oldRunner == nil || newRunner == nil {
+		return nil
+	}
+	if !DeepEqual(oldRunner.Resources, newRunner.Resources) {
+		return []string{"runner container resources changed"}
+	}
+	return nil
+}
+
+// checkRunnerPodMutations updates the RunnerPodMutated condition on the VM, emitting an event when
+// mutations are first detected.
+func (r *VMReconciler) checkRunnerPodMutations(vm *vmv1.VirtualMachine, pod *corev1.Pod) {
+	mutations := runnerPodMutations(vm, pod)
+	if len(mutations) == 0 {
+		meta.SetStatusCondition(&vm.Status.Conditions,
+			metav1.Condition{Type: typeRunnerPodMutatedVirtualMachine,
+				Status:  metav1.ConditionFalse,
+				Reason:  "Reconciling",
+				Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) matches expected spec", pod.Name, vm.Name)})
+		return
+	}
+
+	message := fmt.Sprintf("Pod (%s) for VirtualMachine (%s) was modified: %s", pod.Name, vm.Name, strings.Join(mutations, "; "))
+	if !meta.IsStatusConditionTrue(vm.Status.Conditions, typeRunnerPodMutatedVirtualMachine) {
+		r.Recorder.Event(vm, "Warning", "RunnerPodMutated", message)
+	}
+	meta.SetStatusCondition(&vm.Status.Conditions,
+		metav1.Condition{Type: typeRunnerPodMutatedVirtualMachine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "Reconciling",
+			Message: message})
+}
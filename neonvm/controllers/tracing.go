@@ -0,0 +1,111 @@
+package controllers
+
+// Tracing for reconciles, admission webhooks, and QMP commands
+//
+// Each reconcile is run in a span by wrappedReconciler (see metrics.go), to which the reconcilers
+// add the VM's name and generation once they've fetched it. QMP commands that change the state of
+// the VM are run in child spans of the reconcile with traceQMP, so that slow or failing commands
+// show up in the reconcile's trace.
+//
+// Admission webhooks are served in spans by TracingWebhookServer, which wraps each registered hook
+// with a handler that starts a span - continuing the trace from the request's headers, if there is
+// one - and sets the attributes of the object under review.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// vmSpanAttributes returns the attributes identifying the VM in a span
+func vmSpanAttributes(vm *vmv1.VirtualMachine) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", vm.Namespace),
+		attribute.String("vm.name", vm.Name),
+		attribute.Int64("vm.generation", vm.Generation),
+	}
+	if id, ok := vm.Annotations[vmv1.VirtualMachineScalingCorrelationIDAnnotation]; ok {
+		attrs = append(attrs, attribute.String("autoscaling.correlation_id", id))
+	}
+	if traceID := util.TraceIDFromTraceParent(vm.Annotations[vmv1.VirtualMachineScalingTraceParentAnnotation]); traceID != "" {
+		attrs = append(attrs, attribute.String("autoscaling.scaling_trace_id", traceID))
+	}
+	return attrs
+}
+
+// setVMSpanAttributes adds the VM's attributes to the reconcile's span
+func setVMSpanAttributes(ctx context.Context, vm *vmv1.VirtualMachine) {
+	trace.SpanFromContext(ctx).SetAttributes(vmSpanAttributes(vm)...)
+}
+
+// traceQMP runs the QMP command in a child span of the current one
+func traceQMP(ctx context.Context, vm *vmv1.VirtualMachine, command string, fn func() error) error {
+	_, span := util.StartSpan(ctx, "QMP "+command, vmSpanAttributes(vm)...)
+	err := fn()
+	util.EndSpan(span, err)
+	return err
+}
+
+// TracingWebhookServer is a webhook.Server that serves each registered hook in a span
+type TracingWebhookServer struct {
+	webhook.Server
+}
+
+// Register implements webhook.Server
+func (s TracingWebhookServer) Register(path string, hook http.Handler) {
+	s.Server.Register(path, util.InstrumentHTTPHandler(admissionSpanHandler{hook: hook}, "Admission "+path))
+}
+
+// admissionSpanHandler sets the attributes of the object under review on the request's span, before
+// passing the request on to the hook
+type admissionSpanHandler struct {
+	hook http.Handler
+}
+
+// admissionReviewSummary is the subset of an AdmissionReview that we use for span attributes
+type admissionReviewSummary struct {
+	Request *struct {
+		Kind struct {
+			Kind string `json:"kind"`
+		} `json:"kind"`
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Operation string `json:"operation"`
+		Object    struct {
+			Metadata struct {
+				Generation int64 `json:"generation"`
+			} `json:"metadata"`
+		} `json:"object"`
+	} `json:"request"`
+}
+
+func (h admissionSpanHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		// Leave it to the hook to respond to a body it can't read or decode.
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var review admissionReviewSummary
+		if err == nil && json.Unmarshal(body, &review) == nil && review.Request != nil {
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("k8s.namespace.name", review.Request.Namespace),
+				attribute.String("k8s.object.kind", review.Request.Kind.Kind),
+				attribute.String("k8s.object.name", review.Request.Name),
+				attribute.Int64("k8s.object.generation", review.Request.Object.Metadata.Generation),
+				attribute.String("admission.operation", review.Request.Operation),
+			)
+		}
+	}
+
+	h.hook.ServeHTTP(w, r)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+// Cloning VMs with .spec.cloneFrom
+//
+// To clone a VM, the controller takes a VirtualMachineSnapshot of the source VM's disks, owned by
+// the clone so that it's deleted along with it. The source keeps running while its disks are
+// captured (see QmpStartSnapshot). Once the snapshot has succeeded, the clone's runner pod is
+// created and restored from it, exactly as if the clone had .spec.restoreFrom set - so the snapshot
+// is also reused if the clone is restarted.
+//
+// If the snapshot fails, it's deleted so that it's taken again on the next reconcile.
+//
+// The guest's identity is handled by neonvm-runner - see VirtualMachineSpec.GuestIdentity.
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// cloneSnapshotName returns the name of the snapshot of the source VM that the clone is restored
+// from
+func cloneSnapshotName(vm *vmv1.VirtualMachine) string {
+	return fmt.Sprintf("%s-clone", vm.Name)
+}
+
+// ensureCloneSnapshot creates the snapshot of the VM's .spec.cloneFrom source, if it doesn't
+// already exist, and returns it once it has succeeded. Until then, it returns nil.
+func (r *VMReconciler) ensureCloneSnapshot(ctx context.Context, vm *vmv1.VirtualMachine) (*vmv1.VirtualMachineSnapshot, error) {
+	log := log.FromContext(ctx)
+	name := cloneSnapshotName(vm)
+
+	snapshot := &vmv1.VirtualMachineSnapshot{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: vm.Namespace}, snapshot)
+	if apierrors.IsNotFound(err) {
+		snapshot, err = r.cloneSnapshotForVirtualMachine(vm)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Creating snapshot of VM to clone", "VirtualMachineSnapshot.Name", name, "Source.Name", vm.Spec.CloneFrom.VMName)
+		if err := r.Create(ctx, snapshot); err != nil {
+			return nil, fmt.Errorf("failed to create VirtualMachineSnapshot %s: %w", name, err)
+		}
+		r.Recorder.Event(vm, "Normal", "Cloning",
+			fmt.Sprintf("Taking snapshot %s of VM %s to clone", name, vm.Spec.CloneFrom.VMName))
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get VirtualMachineSnapshot %s: %w", name, err)
+	}
+
+	switch snapshot.Status.Phase {
+	case vmv1.VmsSucceeded:
+		return snapshot, nil
+	case vmv1.VmsFailed:
+		log.Info("Snapshot of VM to clone failed, deleting it to try again", "VirtualMachineSnapshot.Name", name)
+		r.Recorder.AnnotatedEventf(vm, map[string]string{errclass.EventAnnotation: string(errclass.TransientInfra)},
+			"Warning", "CloneFailed", "Snapshot %s of VM %s failed, retrying", name, vm.Spec.CloneFrom.VMName)
+		if err := r.Delete(ctx, snapshot); err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to delete failed VirtualMachineSnapshot %s: %w", name, err)
+		}
+		return nil, nil
+	default:
+		log.Info("Waiting for snapshot of VM to clone", "VirtualMachineSnapshot.Name", name, "phase", snapshot.Status.Phase)
+		return nil, nil
+	}
+}
+
+func (r *VMReconciler) cloneSnapshotForVirtualMachine(vm *vmv1.VirtualMachine) (*vmv1.VirtualMachineSnapshot, error) {
+	snapshot := &vmv1.VirtualMachineSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cloneSnapshotName(vm),
+			Namespace:   vm.Namespace,
+			Labels:      labelsForGeneratedResource(vm),
+			Annotations: annotationsForGeneratedResource(vm),
+		},
+		Spec: vmv1.VirtualMachineSnapshotSpec{
+			VmName:        vm.Spec.CloneFrom.VMName,
+			IncludeMemory: false,
+			Target:        *vm.Spec.CloneFrom.Target.DeepCopy(),
+		},
+	}
+
+	// Set the ownerRef for the snapshot, so that it's deleted with the clone
+	if err := ctrl.SetControllerReference(vm, snapshot, r.Scheme); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,216 @@
+package controllers
+
+// Lifecycle conditions
+//
+// Alongside .status.phase, we maintain a set of standard conditions on each VM (see the
+// VmCondition* constants in the API), so that tooling can wait on specific parts of the VM's
+// lifecycle - e.g. 'kubectl wait --for=condition=GuestBooted'. The conditions are recomputed on
+// every reconcile, after the phase has been updated:
+//
+//   - Scheduled comes from the runner pod's node assignment.
+//   - GuestBooted comes from neonvm-runner, which watches the guest's serial console for the line
+//     that vm-builder's init prints once it's done. Once True, it stays True until the VM stops,
+//     so we don't need to ask the runner again.
+//   - AgentConnected comes from the annotation that the autoscaler-agent sets on the VM when it
+//     connects to (or disconnects from) the vm-monitor.
+//   - Scaling and MigrationInProgress come from the phase.
+//   - CrashLoopBackOff comes from the VM's consecutive restarts - see restart_backoff.go.
+//   - ImageCompatible comes from the metadata that vm-builder embedded in the root disk image - see
+//     vm_image_metadata.go.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// errGuestStatusUnsupported is returned by getRunnerGuestStatus for runners that don't serve
+// /guest_status
+var errGuestStatusUnsupported = errors.New("runner does not support /guest_status")
+
+// updateLifecycleConditions sets the VM's lifecycle conditions from its current state
+func (r *VMReconciler) updateLifecycleConditions(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	var pod *corev1.Pod
+	if vm.Status.PodName != "" {
+		pod = &corev1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, pod)
+		if apierrors.IsNotFound(err) {
+			pod = nil
+		} else if err != nil {
+			return fmt.Errorf("failed to get runner pod: %w", err)
+		}
+	}
+
+	setCondition := func(conditionType string, status metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&vm.Status.Conditions, metav1.Condition{
+			Type:               conditionType,
+			Status:             status,
+			ObservedGeneration: vm.Generation,
+			Reason:             reason,
+			Message:            message,
+		})
+	}
+
+	// Scheduled
+	switch {
+	case pod == nil:
+		setCondition(vmv1.VmConditionScheduled, metav1.ConditionFalse, "NoRunnerPod", "Runner pod has not been created")
+	case pod.Spec.NodeName != "":
+		setCondition(vmv1.VmConditionScheduled, metav1.ConditionTrue, "RunnerPodScheduled",
+			fmt.Sprintf("Runner pod %s is scheduled on node %s", pod.Name, pod.Spec.NodeName))
+	default:
+		reason, message := "SchedulingPending", fmt.Sprintf("Runner pod %s has not been scheduled yet", pod.Name)
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse && c.Reason != "" {
+				reason, message = c.Reason, c.Message
+			}
+		}
+		setCondition(vmv1.VmConditionScheduled, metav1.ConditionFalse, reason, message)
+	}
+
+	// GuestBooted
+	switch vm.Status.Phase {
+	case vmv1.VmRunning, vmv1.VmScaling, vmv1.VmPreMigrating, vmv1.VmMigrating, vmv1.VmPaused:
+		if c := meta.FindStatusCondition(vm.Status.Conditions, vmv1.VmConditionGuestBooted); c != nil {
+			if c.Status == metav1.ConditionTrue || c.Reason == "Unsupported" {
+				break // no need to check again
+			}
+		}
+		status, err := getRunnerGuestStatus(ctx, vm, r.Config.QMPAuthToken)
+		switch {
+		case errors.Is(err, errGuestStatusUnsupported):
+			setCondition(vmv1.VmConditionGuestBooted, metav1.ConditionUnknown, "Unsupported",
+				"Runner pod does not report whether the guest has booted")
+		case err != nil:
+			// We'll try again on the next reconcile.
+			setCondition(vmv1.VmConditionGuestBooted, metav1.ConditionUnknown, "CheckFailed",
+				fmt.Sprintf("Failed to get guest status from runner: %s", err))
+		case status.Booted:
+			setCondition(vmv1.VmConditionGuestBooted, metav1.ConditionTrue, "Booted", "Guest has booted")
+		default:
+			setCondition(vmv1.VmConditionGuestBooted, metav1.ConditionFalse, "Booting", "Guest is booting")
+		}
+	default:
+		setCondition(vmv1.VmConditionGuestBooted, metav1.ConditionFalse, "NotRunning",
+			fmt.Sprintf("VM is %s", vm.Status.Phase))
+	}
+
+	// AgentConnected
+	switch vm.Annotations[vmv1.VirtualMachineAgentConnectedAnnotation] {
+	case "true":
+		setCondition(vmv1.VmConditionAgentConnected, metav1.ConditionTrue, "MonitorConnected",
+			"autoscaler-agent is connected to the vm-monitor")
+	case "false":
+		setCondition(vmv1.VmConditionAgentConnected, metav1.ConditionFalse, "MonitorDisconnected",
+			"autoscaler-agent is not connected to the vm-monitor")
+	default:
+		setCondition(vmv1.VmConditionAgentConnected, metav1.ConditionUnknown, "NotReported",
+			"autoscaler-agent has not reported a connection to the vm-monitor")
+	}
+
+	// Scaling
+	if vm.Status.Phase == vmv1.VmScaling {
+		setCondition(vmv1.VmConditionScaling, metav1.ConditionTrue, "Scaling",
+			fmt.Sprintf("Scaling to %v CPUs and %d memory slots", vm.Spec.Guest.CPUs.Use, vm.Spec.Guest.MemorySlots.Use))
+	} else {
+		setCondition(vmv1.VmConditionScaling, metav1.ConditionFalse, "NotScaling", "VM is not being scaled")
+	}
+
+	// MigrationInProgress
+	switch vm.Status.Phase {
+	case vmv1.VmPreMigrating, vmv1.VmMigrating:
+		setCondition(vmv1.VmConditionMigrationInProgress, metav1.ConditionTrue, string(vm.Status.Phase),
+			fmt.Sprintf("VM is %s", vm.Status.Phase))
+	default:
+		setCondition(vmv1.VmConditionMigrationInProgress, metav1.ConditionFalse, "NoMigration", "VM is not being migrated")
+	}
+
+	// AutoscalingEnabled
+	switch {
+	case vm.Spec.Autoscaling != nil && vm.Spec.Autoscaling.Pause != nil:
+		setCondition(vmv1.VmConditionAutoscalingEnabled, metav1.ConditionFalse, "Paused",
+			fmt.Sprintf("Autoscaling is paused: %s", vm.Spec.Autoscaling.Pause.Reason))
+	case vm.Spec.Autoscaling != nil && vm.Spec.Autoscaling.Enabled != nil:
+		if *vm.Spec.Autoscaling.Enabled {
+			setCondition(vmv1.VmConditionAutoscalingEnabled, metav1.ConditionTrue, "EnabledBySpec",
+				"Autoscaling is enabled by .spec.autoscaling.enabled")
+		} else {
+			setCondition(vmv1.VmConditionAutoscalingEnabled, metav1.ConditionFalse, "DisabledBySpec",
+				"Autoscaling is disabled by .spec.autoscaling.enabled")
+		}
+	case api.HasAutoscalingEnabled(vm):
+		setCondition(vmv1.VmConditionAutoscalingEnabled, metav1.ConditionTrue, "EnabledByLabel",
+			fmt.Sprintf("Autoscaling is enabled by the %q label", api.LabelEnableAutoscaling))
+	default:
+		setCondition(vmv1.VmConditionAutoscalingEnabled, metav1.ConditionFalse, "NotEnabled",
+			fmt.Sprintf("Autoscaling is not enabled by .spec.autoscaling or the %q label", api.LabelEnableAutoscaling))
+	}
+
+	// CrashLoopBackOff
+	if crashLooping(vm) {
+		message := fmt.Sprintf("VM has restarted %d times in a row", vm.Status.ConsecutiveRestarts)
+		if vm.Status.NextRestartTime != nil {
+			message += fmt.Sprintf(", next restart at %s", vm.Status.NextRestartTime.UTC().Format(time.RFC3339))
+		}
+		setCondition(vmv1.VmConditionCrashLoopBackOff, metav1.ConditionTrue, "CrashLooping", message)
+	} else {
+		setCondition(vmv1.VmConditionCrashLoopBackOff, metav1.ConditionFalse, "NotCrashLooping",
+			fmt.Sprintf("VM has restarted %d times in a row", vm.Status.ConsecutiveRestarts))
+	}
+
+	// ImageCompatible
+	status, reason, message := imageCompatibility(vm, pod)
+	if status == metav1.ConditionFalse && !meta.IsStatusConditionFalse(vm.Status.Conditions, vmv1.VmConditionImageCompatible) {
+		r.Recorder.Event(vm, "Warning", "ImageIncompatible", message)
+	}
+	setCondition(vmv1.VmConditionImageCompatible, status, reason, message)
+
+	return nil
+}
+
+// getRunnerGuestStatus asks the VM's runner whether the guest has booted
+func getRunnerGuestStatus(ctx context.Context, vm *vmv1.VirtualMachine, authToken string) (*api.GuestStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/guest_status", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vmv1.ConsolePort)))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, errGuestStatusUnsupported
+	} else if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var status api.GuestStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	return &status, nil
+}
@@ -26,10 +26,12 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	nadapiv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
@@ -56,6 +58,8 @@ import (
 	"github.com/neondatabase/autoscaling/neonvm/controllers/buildtag"
 	"github.com/neondatabase/autoscaling/neonvm/pkg/ipam"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 	"github.com/neondatabase/autoscaling/pkg/util/patch"
 )
 
@@ -84,6 +88,11 @@ type VMReconciler struct {
 	Config   *ReconcilerConfig
 
 	Metrics ReconcilerMetrics `exhaustruct:"optional"`
+
+	// qmpBreakers, expensiveOps, and rollout are set by SetupWithManager
+	qmpBreakers  *qmpNodeBreakers           `exhaustruct:"optional"`
+	expensiveOps *expensiveOperationLimiter `exhaustruct:"optional"`
+	rollout      *rolloutTracker            `exhaustruct:"optional"`
 }
 
 // The following markers are used to generate the rules permissions (RBAC) on config/rbac using controller-gen
@@ -93,10 +102,14 @@ type VMReconciler struct {
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachines/finalizers,verbs=update
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
-//+kubebuilder:rbac:groups=core,resources=nodes,verbs=list
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;list;watch
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=ippools,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vm.neon.tech,resources=ippools/finalizers,verbs=update
@@ -127,6 +140,7 @@ func (r *VMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Re
 		log.Error(err, "Unable to fetch VirtualMachine")
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
+	setVMSpanAttributes(ctx, &vm)
 
 	// examine DeletionTimestamp to determine if object is under deletion
 	if vm.ObjectMeta.DeletionTimestamp.IsZero() {
@@ -151,6 +165,7 @@ func (r *VMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Re
 			// our finalizer is present, so lets handle any external dependency
 			log.Info("Performing Finalizer Operations for VirtualMachine before delete it")
 			r.doFinalizerOperationsForVirtualMachine(ctx, &vm)
+			r.rollout.forget(req.NamespacedName)
 
 			// remove our finalizer from the list and update it.
 			log.Info("Removing Finalizer for VirtualMachine after successfully perform the operations")
@@ -173,6 +188,10 @@ func (r *VMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Re
 			"Failed to reconcile (%s): %s", vm.Name, err)
 		return ctrl.Result{}, err
 	}
+	if err := r.updateLifecycleConditions(ctx, &vm); err != nil {
+		log.Error(err, "Failed to update VirtualMachine lifecycle conditions")
+		return ctrl.Result{}, err
+	}
 
 	// If the status changed, try to update the object
 	if !DeepEqual(statusBefore, vm.Status) {
@@ -269,7 +288,7 @@ func (r *VMReconciler) updateVMStatusCPU(
 	// Otherwise, we update the status.
 	var currentCPUUsage vmv1.MilliCPU
 	if cgroupUsage != nil {
-		if cgroupUsage.VCPUs.RoundedUp() != qmpPluggedCPUs {
+		if cpusHotplugged(vm) && cgroupUsage.VCPUs.RoundedUp() != qmpPluggedCPUs {
 			// This is not expected but it's fine. We only report the
 			// mismatch here and will resolve it in the next reconcile
 			// iteration loops by comparing these values to spec CPU use
@@ -281,6 +300,7 @@ func (r *VMReconciler) updateVMStatusCPU(
 				"cgroup vCPUs", cgroupUsage.VCPUs)
 		}
 		currentCPUUsage = min(cgroupUsage.VCPUs, vmv1.MilliCPU(1000*qmpPluggedCPUs))
+		vm.Status.CPUBurst = cgroupUsage.Burst
 	} else {
 		currentCPUUsage = vmv1.MilliCPU(1000 * qmpPluggedCPUs)
 	}
@@ -306,9 +326,41 @@ func (r *VMReconciler) updateVMStatusMemory(
 	}
 }
 
-func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine) error {
+// updateVMSwapSize resizes the VM's swap to match its memory, if the swap is proportional to memory
+// and the size has changed.
+func (r *VMReconciler) updateVMSwapSize(
+	ctx context.Context,
+	vm *vmv1.VirtualMachine,
+	memorySize *resource.Quantity,
+) error {
+	if vm.Spec.Guest.Settings == nil {
+		return nil
+	}
+	swapInfo, err := vm.Spec.Guest.Settings.GetSwapInfo()
+	if err != nil || swapInfo == nil || !swapInfo.IsProportional() {
+		return err
+	}
+
+	// If .status.swapSize is unset, we don't know the current size, so always resize.
+	size := swapInfo.SizeForMemory(*memorySize)
+	if vm.Status.SwapSize != nil && size.Equal(*vm.Status.SwapSize) {
+		return nil
+	}
+
+	if err := setRunnerSwap(ctx, vm, size); err != nil {
+		return err
+	}
+	vm.Status.SwapSize = &size
+	r.Recorder.Event(vm, "Normal", "SwapInfo",
+		fmt.Sprintf("VirtualMachine %s swap resized to %v", vm.Name, vm.Status.SwapSize))
+	return nil
+}
+
+func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine) (retErr error) {
 	log := log.FromContext(ctx)
 
+	defer r.Metrics.reconcilePhaseTimer(ctx, "virtualmachine", string(vm.Status.Phase))()
+
 	// Let's check and just set the condition status as Unknown when no status are available
 	if vm.Status.Conditions == nil || len(vm.Status.Conditions) == 0 {
 		// set Unknown condition status for AvailableVirtualMachine
@@ -329,6 +381,12 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		log.Error(nil, "Setting default MemoryProvider for VM", "MemoryProvider", oldMemProvider)
 		vm.Status.MemoryProvider = lo.ToPtr(oldMemProvider)
 	}
+	// Likewise for the CPU scaling mode, which was always QMPHotplug before it could be set.
+	if vm.Status.PodName != "" && vm.Status.CPUScalingMode == nil {
+		vm.Status.CPUScalingMode = lo.ToPtr(vmv1.CPUScalingModeQMPHotplug)
+	}
+
+	r.setMemoryProviderMigrationCondition(vm)
 
 	switch vm.Status.Phase {
 
@@ -360,20 +418,30 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			message := fmt.Sprintf("Acquired IP %s for overlay network interface", ip.String())
 			log.Info(message)
 			vm.Status.ExtraNetIP = ip.IP.String()
-			vm.Status.ExtraNetMask = fmt.Sprintf("%d.%d.%d.%d", ip.Mask[0], ip.Mask[1], ip.Mask[2], ip.Mask[3])
+			if ip.IP.To4() != nil {
+				vm.Status.ExtraNetMask = fmt.Sprintf("%d.%d.%d.%d", ip.Mask[0], ip.Mask[1], ip.Mask[2], ip.Mask[3])
+			} else {
+				// IPv6 masks are stored as the prefix length, which is what the guest needs to
+				// configure the address. See makeKernelCmdline in neonvm-runner.
+				ones, _ := ip.Mask.Size()
+				vm.Status.ExtraNetMask = fmt.Sprint(ones)
+			}
 			r.Recorder.Event(vm, "Normal", "OverlayNet", message)
 		}
 		// VirtualMachine just created, change Phase to "Pending"
 		vm.Status.Phase = vmv1.VmPending
 	case vmv1.VmPending:
-		// Generate runner pod name and set desired memory provider.
-		// Together with Status.MemoryProvider set for PodName != "" above,
-		// It is now guaranteed to have Status.MemoryProvider != nil
+		// Generate runner pod name and set desired memory provider and CPU scaling mode.
+		// Together with Status.MemoryProvider and Status.CPUScalingMode set for PodName != "" above,
+		// It is now guaranteed to have Status.MemoryProvider != nil and Status.CPUScalingMode != nil
 		if len(vm.Status.PodName) == 0 {
 			vm.Status.PodName = names.SimpleNameGenerator.GenerateName(fmt.Sprintf("%s-", vm.Name))
 			if vm.Status.MemoryProvider == nil {
 				vm.Status.MemoryProvider = lo.ToPtr(pickMemoryProvider(r.Config, vm))
 			}
+			if vm.Status.CPUScalingMode == nil {
+				vm.Status.CPUScalingMode = lo.ToPtr(pickCPUScalingMode(r.Config, vm))
+			}
 			// Update the .Status on API Server to avoid creating multiple pods for a single VM
 			// See https://github.com/neondatabase/autoscaling/issues/794 for the context
 			if err := r.Status().Update(ctx, vm); err != nil {
@@ -387,6 +455,23 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		vmRunner := &corev1.Pod{}
 		err := r.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, vmRunner)
 		if err != nil && apierrors.IsNotFound(err) {
+			// Don't create a runner pod that won't be able to boot the image.
+			if msg, err := r.checkRootDiskPlatform(ctx, vm); err != nil {
+				log.Error(err, "Failed to check root disk image platform")
+				return err
+			} else if msg != "" {
+				log.Info("Root disk image platform is not supported by any eligible node", "message", msg)
+				r.Recorder.Event(vm, "Warning", rootDiskPlatformMismatchReason, msg)
+				meta.SetStatusCondition(&vm.Status.Conditions,
+					metav1.Condition{Type: typeDegradedVirtualMachine,
+						Status:  metav1.ConditionTrue,
+						Reason:  rootDiskPlatformMismatchReason,
+						Message: msg})
+				return nil
+			} else if c := meta.FindStatusCondition(vm.Status.Conditions, typeDegradedVirtualMachine); c != nil && c.Reason == rootDiskPlatformMismatchReason {
+				meta.RemoveStatusCondition(&vm.Status.Conditions, typeDegradedVirtualMachine)
+			}
+
 			var sshSecret *corev1.Secret
 			if enableSSH {
 				// Check if the ssh secret already exists, if not create a new one
@@ -415,8 +500,44 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 				}
 			}
 
+			var restoreFrom *vmv1.VirtualMachineSnapshot
+			if vm.Spec.RestoreFrom != nil {
+				restoreFrom = &vmv1.VirtualMachineSnapshot{}
+				err := r.Get(ctx, types.NamespacedName{
+					Name:      vm.Spec.RestoreFrom.SnapshotName,
+					Namespace: vm.Namespace,
+				}, restoreFrom)
+				if err != nil {
+					log.Error(err, "Failed to get VirtualMachineSnapshot to restore from", "Snapshot.Name", vm.Spec.RestoreFrom.SnapshotName)
+					r.Recorder.AnnotatedEventf(vm, map[string]string{errclass.EventAnnotation: string(errclass.Of(err))},
+						"Warning", "RestoreFailed", "Failed to get snapshot %s: %s", vm.Spec.RestoreFrom.SnapshotName, err)
+					return err
+				}
+			}
+			// Clones are restored from a snapshot of the source VM, which must be taken first.
+			if vm.Spec.CloneFrom != nil {
+				snapshot, err := r.ensureCloneSnapshot(ctx, vm)
+				if err != nil {
+					log.Error(err, "Failed to prepare snapshot of VM to clone")
+					return err
+				} else if snapshot == nil {
+					// check again on the next reconcile
+					return nil
+				}
+				restoreFrom = snapshot
+			}
+
+			// Disks from VolumeSnapshots must be ready before the pod can use them.
+			if ready, err := r.ensureVolumeSnapshotDisks(ctx, vm); err != nil {
+				log.Error(err, "Failed to prepare volumeSnapshot disks")
+				return err
+			} else if !ready {
+				// check again on the next reconcile
+				return nil
+			}
+
 			// Define a new pod
-			pod, err := r.podForVirtualMachine(vm, memoryProvider, sshSecret)
+			pod, err := r.podForVirtualMachine(vm, memoryProvider, sshSecret, restoreFrom)
 			if err != nil {
 				log.Error(err, "Failed to define new Pod resource for VirtualMachine")
 				return err
@@ -428,6 +549,10 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 				return err
 			}
 			log.Info("Runner Pod was created", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+			// Hotpluggable disks in the spec are attached at boot
+			vm.Status.HotplugDisks = hotpluggableDiskNames(vm)
+			// ... and so are the disks' I/O limits
+			vm.Status.DiskIOLimits = attachedDiskIOLimits(vm)
 
 			msg := fmt.Sprintf("VirtualMachine %s created, Pod %s", vm.Name, pod.Name)
 			if sshSecret != nil {
@@ -446,7 +571,12 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		switch runnerStatus(vmRunner) {
 		case runnerRunning:
 			vm.Status.PodIP = vmRunner.Status.PodIP
+			vm.Status.ConsoleURL = consoleURL(vm.Status.PodIP)
 			vm.Status.Phase = vmv1.VmRunning
+			if vm.Spec.RestoreFrom != nil && vm.Spec.RestoreFrom.RestoreMemory {
+				// The guest's clock continues from when the snapshot was taken.
+				markTimeSyncPending(vm, time.Now())
+			}
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeAvailableVirtualMachine,
 					Status:  metav1.ConditionTrue,
@@ -465,6 +595,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			}
 		case runnerSucceeded:
 			vm.Status.Phase = vmv1.VmSucceeded
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeAvailableVirtualMachine,
 					Status:  metav1.ConditionFalse,
@@ -472,6 +603,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) succeeded", vm.Status.PodName, vm.Name)})
 		case runnerFailed:
 			vm.Status.Phase = vmv1.VmFailed
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeDegradedVirtualMachine,
 					Status:  metav1.ConditionTrue,
@@ -491,6 +623,22 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		// Check if the runner pod exists
 		vmRunner := &corev1.Pod{}
 		err := r.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, vmRunner)
+
+		// If the runner pod was deleted for a rollout (see rollout.go), start a new one once the
+		// old one has stopped.
+		if rolloutRestartInProgress(vm) &&
+			(apierrors.IsNotFound(err) || (err == nil && vmRunner.DeletionTimestamp != nil)) {
+			if err == nil && !runnerContainerStopped(vmRunner) {
+				return nil
+			}
+			log.Info("Starting VM with new restart inputs after restart", "VirtualMachine", vm.Name)
+			vm.Cleanup()
+			vm.Status.Phase = vmv1.VmPending
+			vm.Status.RestartCount += 1
+			r.Metrics.vmRestartCounts.Inc()
+			return nil
+		}
+
 		if err != nil && apierrors.IsNotFound(err) {
 			// lost runner pod for running VirtualMachine ?
 			r.Recorder.Event(vm, "Warning", "NotFound",
@@ -513,15 +661,20 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			log.Error(err, "Failed to sync pod labels and annotations", "VirtualMachine", vm.Name)
 		}
 
+		// Surface any third-party changes to the runner pod that could break QEMU's assumptions
+		r.checkRunnerPodMutations(vm, vmRunner)
+
 		// runner pod found, check/update phase now
 		switch runnerStatus(vmRunner) {
 		case runnerRunning:
 			// update status by IP of runner pod
 			vm.Status.PodIP = vmRunner.Status.PodIP
+			vm.Status.ConsoleURL = consoleURL(vm.Status.PodIP)
 			// update phase
 			vm.Status.Phase = vmv1.VmRunning
 			// update Node name where runner working
 			vm.Status.Node = vmRunner.Spec.NodeName
+			resetRestartBackoff(vm, vmRunner, time.Now())
 
 			runnerVersion, err := getRunnerVersion(vmRunner)
 			if err != nil {
@@ -534,8 +687,20 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 				return err
 			}
 
+			if vm.Spec.RunPolicy == vmv1.RunPolicyPaused {
+				log.Info("Pausing VM because of runPolicy", "VirtualMachine", vm.Name)
+				if err := traceQMP(ctx, vm, "stop", func() error { return QmpStop(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
+					log.Error(err, "Failed to pause VirtualMachine", "VirtualMachine", vm.Name)
+					return err
+				}
+				r.Recorder.Event(vm, "Normal", "Paused",
+					fmt.Sprintf("VM %s was paused", vm.Name))
+				vm.Status.Phase = vmv1.VmPaused
+				return nil
+			}
+
 			// get CPU details from QEMU
-			cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(vm))
+			cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(vm, r.Config.QMPAuthToken))
 			if err != nil {
 				log.Error(err, "Failed to get CPU details from VirtualMachine", "VirtualMachine", vm.Name)
 				return err
@@ -553,7 +718,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			r.updateVMStatusCPU(ctx, vm, vmRunner, pluggedCPU, cgroupUsage)
 
 			// get Memory details from hypervisor and update VM status
-			memorySize, err := QmpGetMemorySize(QmpAddr(vm))
+			memorySize, err := QmpGetMemorySize(QmpAddr(vm, r.Config.QMPAuthToken))
 			if err != nil {
 				log.Error(err, "Failed to get Memory details from VirtualMachine", "VirtualMachine", vm.Name)
 				return err
@@ -561,6 +726,24 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			// update status by memory sizes used in the VM
 			r.updateVMStatusMemory(vm, memorySize)
 
+			// resize swap to match, if it's proportional to memory
+			if err := r.updateVMSwapSize(ctx, vm, memorySize); err != nil {
+				log.Error(err, "Failed to resize swap in VirtualMachine", "VirtualMachine", vm.Name)
+			}
+
+			// attach or detach hotpluggable disks, if they've changed
+			if err := r.syncHotplugDisks(ctx, vm); err != nil {
+				log.Error(err, "Failed to sync hotpluggable disks in VirtualMachine", "VirtualMachine", vm.Name)
+			}
+
+			// apply changes to the disks' I/O limits
+			if err := r.syncDiskIOLimits(ctx, vm); err != nil {
+				log.Error(err, "Failed to sync disk I/O limits in VirtualMachine", "VirtualMachine", vm.Name)
+			}
+
+			// synchronize the guest's clock, if it was resumed or migrated
+			r.syncGuestTimeIfPending(ctx, vm)
+
 			// check if need hotplug/unplug CPU or memory
 			// compare guest spec and count of plugged
 
@@ -583,8 +766,17 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 				vm.Status.Phase = vmv1.VmScaling
 			}
 
+			// roll out changes that require a restart, if the VM isn't being resized
+			if vm.Status.Phase == vmv1.VmRunning {
+				if err := r.checkRollout(ctx, vm, vmRunner); err != nil {
+					log.Error(err, "Failed to check whether VM needs a restart for rollout", "VirtualMachine", vm.Name)
+					return err
+				}
+			}
+
 		case runnerSucceeded:
 			vm.Status.Phase = vmv1.VmSucceeded
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeAvailableVirtualMachine,
 					Status:  metav1.ConditionFalse,
@@ -592,6 +784,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) succeeded", vm.Status.PodName, vm.Name)})
 		case runnerFailed:
 			vm.Status.Phase = vmv1.VmFailed
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeDegradedVirtualMachine,
 					Status:  metav1.ConditionTrue,
@@ -609,9 +802,31 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		}
 
 	case vmv1.VmScaling:
+		// Include the ID of the autoscaler-agent's scaling transaction that changed the VM, so
+		// that the resize can be matched up with the agent's logs.
+		if id := scalingCorrelationID(vm); id != "" {
+			log = log.WithValues(util.CorrelationIDLogKey, id)
+			ctx = ctrl.LoggerInto(ctx, log)
+		}
+
 		// Check that runner pod is still ok
 		vmRunner := &corev1.Pod{}
 		err := r.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, vmRunner)
+
+		// VMs booted via UEFI or with confidential compute are resized by restarting them (see
+		// doRestartScaling), so the runner pod is expected to go away while scaling. Once the old
+		// runner has stopped, start a new one with the updated resources.
+		if vm.Spec.ResizedByRestart() &&
+			(apierrors.IsNotFound(err) || (err == nil && vmRunner.DeletionTimestamp != nil)) {
+			if err == nil && !runnerContainerStopped(vmRunner) {
+				return nil
+			}
+			log.Info("Starting VM with new resources after restart", "VirtualMachine", vm.Name)
+			vm.Cleanup()
+			vm.Status.Phase = vmv1.VmPending
+			return nil
+		}
+
 		if err != nil && apierrors.IsNotFound(err) {
 			// lost runner pod for running VirtualMachine ?
 			r.Recorder.Event(vm, "Warning", "NotFound",
@@ -634,10 +849,14 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			log.Error(err, "Failed to sync pod labels and annotations", "VirtualMachine", vm.Name)
 		}
 
+		// Surface any third-party changes to the runner pod that could break QEMU's assumptions
+		r.checkRunnerPodMutations(vm, vmRunner)
+
 		// runner pod found, check that it's still up:
 		switch runnerStatus(vmRunner) {
 		case runnerSucceeded:
 			vm.Status.Phase = vmv1.VmSucceeded
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeAvailableVirtualMachine,
 					Status:  metav1.ConditionFalse,
@@ -646,6 +865,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			return nil
 		case runnerFailed:
 			vm.Status.Phase = vmv1.VmFailed
+			setLastShutdown(vm, vmRunner)
 			meta.SetStatusCondition(&vm.Status.Conditions,
 				metav1.Condition{Type: typeDegradedVirtualMachine,
 					Status:  metav1.ConditionTrue,
@@ -675,12 +895,33 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			return err
 		}
 
+		// Leave the resize for later if too many expensive operations are already in progress,
+		// so that cheaper reconciles aren't starved. See reconcile_concurrency.go for more.
+		if !r.expensiveOps.tryAcquire() {
+			log.Info("Deferring VM resize, too many expensive operations in progress", "VirtualMachine", vm.Name)
+			return nil
+		}
+		defer r.expensiveOps.release()
+
+		// Pause resizing on nodes where QMP operations keep failing, so that our retries don't
+		// make a node-level incident worse. See qmp_breaker.go for more.
+		if !r.qmpBreakers.allow(vm.Status.Node) {
+			log.Info("Pausing VM resize, QMP circuit breaker for node is open",
+				"VirtualMachine", vm.Name, "node", vm.Status.Node)
+			return nil
+		}
+		defer func() { r.qmpBreakers.record(vm.Status.Node, retErr) }()
+
+		if vm.Spec.ResizedByRestart() {
+			return r.doRestartScaling(ctx, vm, vmRunner)
+		}
+
 		cpuScaled := false
 		ramScaled := false
 
 		// do hotplug/unplug CPU
 		// firstly get current state from QEMU
-		cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(vm))
+		cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(vm, r.Config.QMPAuthToken))
 		if err != nil {
 			log.Error(err, "Failed to get CPU details from VirtualMachine", "VirtualMachine", vm.Name)
 			return err
@@ -694,23 +935,25 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			return err
 		}
 
-		// compare guest spec to count of plugged and runner pod cgroups
-		if specCPU.RoundedUp() > pluggedCPU {
+		// compare guest spec to count of plugged and runner pod cgroups. Outside of QMPHotplug,
+		// all CPUs are always plugged, and only the cgroup changes.
+		hotplug := cpusHotplugged(vm)
+		if hotplug && specCPU.RoundedUp() > pluggedCPU {
 			// going to plug one CPU
 			log.Info("Plug one more CPU into VM")
-			if err := QmpPlugCpu(QmpAddr(vm)); err != nil {
+			if err := traceQMP(ctx, vm, "device_add cpu", func() error { return QmpPlugCpu(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
 				return err
 			}
-			r.Recorder.Event(vm, "Normal", "ScaleUp",
+			r.recordScalingEvent(vm, "ScaleUp",
 				fmt.Sprintf("One more CPU was plugged into VM %s",
 					vm.Name))
-		} else if specCPU.RoundedUp() < pluggedCPU {
+		} else if hotplug && specCPU.RoundedUp() < pluggedCPU {
 			// going to unplug one CPU
 			log.Info("Unplug one CPU from VM")
-			if err := QmpUnplugCpu(QmpAddr(vm)); err != nil {
+			if err := traceQMP(ctx, vm, "device_del cpu", func() error { return QmpUnplugCpu(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
 				return err
 			}
-			r.Recorder.Event(vm, "Normal", "ScaleDown",
+			r.recordScalingEvent(vm, "ScaleDown",
 				fmt.Sprintf("One CPU was unplugged from VM %s",
 					vm.Name))
 		} else if specCPU != cgroupUsage.VCPUs {
@@ -722,7 +965,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			if specCPU > cgroupUsage.VCPUs {
 				reason = "ScaleUp"
 			}
-			r.Recorder.Event(vm, "Normal", reason,
+			r.recordScalingEvent(vm, reason,
 				fmt.Sprintf("Runner pod cgroups was updated on VM %s",
 					vm.Name))
 		} else {
@@ -735,7 +978,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 		// do hotplug/unplug Memory
 		switch *vm.Status.MemoryProvider {
 		case vmv1.MemoryProviderVirtioMem:
-			ramScaled, err = r.doVirtioMemScaling(vm)
+			ramScaled, err = r.doVirtioMemScaling(ctx, vm)
 			if err != nil {
 				return err
 			}
@@ -753,6 +996,87 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 			vm.Status.Phase = vmv1.VmRunning
 		}
 
+	case vmv1.VmPaused:
+		// Check that runner pod is still ok
+		vmRunner := &corev1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Name: vm.Status.PodName, Namespace: vm.Namespace}, vmRunner)
+		if err != nil && apierrors.IsNotFound(err) {
+			// lost runner pod for paused VirtualMachine ?
+			r.Recorder.Event(vm, "Warning", "NotFound",
+				fmt.Sprintf("runner pod %s not found",
+					vm.Status.PodName))
+			vm.Status.Phase = vmv1.VmFailed
+			meta.SetStatusCondition(&vm.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachine,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) not found", vm.Status.PodName, vm.Name)})
+			return nil
+		} else if err != nil {
+			log.Error(err, "Failed to get runner Pod")
+			return err
+		}
+
+		if err := updatePodMetadataIfNecessary(ctx, r.Client, vm, vmRunner); err != nil {
+			log.Error(err, "Failed to sync pod labels and annotations", "VirtualMachine", vm.Name)
+		}
+
+		switch runnerStatus(vmRunner) {
+		case runnerRunning:
+			if vm.Spec.RunPolicy == vmv1.RunPolicyPaused {
+				// Make sure the guest is still stopped, in case something resumed it behind our back.
+				running, err := QmpQueryStatus(QmpAddr(vm, r.Config.QMPAuthToken))
+				if err != nil {
+					log.Error(err, "Failed to get run status of VirtualMachine", "VirtualMachine", vm.Name)
+					return err
+				}
+				if running {
+					log.Info("Paused VM is running, pausing again", "VirtualMachine", vm.Name)
+					if err := traceQMP(ctx, vm, "stop", func() error { return QmpStop(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
+						log.Error(err, "Failed to pause VirtualMachine", "VirtualMachine", vm.Name)
+						return err
+					}
+				}
+				return nil
+			}
+
+			log.Info("Resuming VM because of runPolicy", "VirtualMachine", vm.Name)
+			if err := traceQMP(ctx, vm, "cont", func() error { return QmpCont(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
+				log.Error(err, "Failed to resume VirtualMachine", "VirtualMachine", vm.Name)
+				return err
+			}
+			r.Recorder.Event(vm, "Normal", "Resumed",
+				fmt.Sprintf("VM %s was resumed", vm.Name))
+			markTimeSyncPending(vm, time.Now())
+			// Go back through VmRunning, so that any scaling that happened while paused is applied.
+			vm.Status.Phase = vmv1.VmRunning
+		case runnerSucceeded:
+			vm.Status.Phase = vmv1.VmSucceeded
+			setLastShutdown(vm, vmRunner)
+			meta.SetStatusCondition(&vm.Status.Conditions,
+				metav1.Condition{Type: typeAvailableVirtualMachine,
+					Status:  metav1.ConditionFalse,
+					Reason:  "Reconciling",
+					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) succeeded", vm.Status.PodName, vm.Name)})
+		case runnerFailed:
+			vm.Status.Phase = vmv1.VmFailed
+			setLastShutdown(vm, vmRunner)
+			meta.SetStatusCondition(&vm.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachine,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) failed", vm.Status.PodName, vm.Name)})
+		case runnerUnknown:
+			vm.Status.Phase = vmv1.VmPending
+			meta.SetStatusCondition(&vm.Status.Conditions,
+				metav1.Condition{Type: typeAvailableVirtualMachine,
+					Status:  metav1.ConditionUnknown,
+					Reason:  "Reconciling",
+					Message: fmt.Sprintf("Pod (%s) for VirtualMachine (%s) in Unknown phase", vm.Status.PodName, vm.Name)})
+		default:
+			// do nothing
+		}
+
 	case vmv1.VmSucceeded, vmv1.VmFailed:
 		// Always delete runner pod. Otherwise, we could end up with one container succeeded/failed
 		// but the other one still running (meaning that the pod still ends up Running).
@@ -787,7 +1111,7 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 				shouldRestart = false
 			}
 
-			if shouldRestart {
+			if shouldRestart && r.restartAfterBackoff(vm, time.Now()) {
 				log.Info("Restarting VM runner pod", "VM.Phase", vm.Status.Phase, "RestartPolicy", vm.Spec.RestartPolicy)
 				vm.Status.Phase = vmv1.VmPending // reset to trigger restart
 				vm.Status.RestartCount += 1      // increment restart count
@@ -803,6 +1127,40 @@ func (r *VMReconciler) doReconcile(ctx context.Context, vm *vmv1.VirtualMachine)
 	return nil
 }
 
+// pickPortForwarding returns the port forwarding implementation to use for a new runner pod for the
+// VM
+func pickPortForwarding(config *ReconcilerConfig, vm *vmv1.VirtualMachine) vmv1.PortForwarding {
+	if pf := vm.Spec.Guest.PortForwarding; pf != nil {
+		return *pf
+	}
+	if config.DefaultPortForwarding != "" {
+		return config.DefaultPortForwarding
+	}
+	return vmv1.PortForwardingIPTables
+}
+
+// pickCPUScalingMode returns the CPU scaling mode to use for a new runner pod for the VM
+func pickCPUScalingMode(config *ReconcilerConfig, vm *vmv1.VirtualMachine) vmv1.CPUScalingMode {
+	// VMs that are resized by restart don't scale CPUs at runtime, and start with the CPUs they're
+	// using, exactly as with QMPHotplug.
+	if vm.Spec.ResizedByRestart() {
+		return vmv1.CPUScalingModeQMPHotplug
+	}
+	if m := vm.Spec.Guest.CPUScalingMode; m != nil {
+		return *m
+	}
+	if config.DefaultCPUScalingMode != "" {
+		return config.DefaultCPUScalingMode
+	}
+	return vmv1.CPUScalingModeQMPHotplug
+}
+
+// cpusHotplugged returns whether the VM's CPUs are scaled by hotplugging them with QMP, rather than
+// all being plugged in from the start
+func cpusHotplugged(vm *vmv1.VirtualMachine) bool {
+	return vm.Status.CPUScalingMode == nil || *vm.Status.CPUScalingMode == vmv1.CPUScalingModeQMPHotplug
+}
+
 func pickMemoryProvider(config *ReconcilerConfig, vm *vmv1.VirtualMachine) vmv1.MemoryProvider {
 	if p := vm.Spec.Guest.MemoryProvider; p != nil {
 		return *p
@@ -811,6 +1169,12 @@ func pickMemoryProvider(config *ReconcilerConfig, vm *vmv1.VirtualMachine) vmv1.
 		return *p
 	}
 
+	if config.MemoryProviderMigration {
+		if ok, _, _ := memoryProviderMigrationTarget(vm); ok {
+			return vmv1.MemoryProviderVirtioMem
+		}
+	}
+
 	// Not all configurations are valid for virtio-mem. Only switch to the default as long as it
 	// won't be invalid:
 	if err := vm.Spec.Guest.ValidateForMemoryProvider(config.DefaultMemoryProvider); err != nil {
@@ -820,11 +1184,91 @@ func pickMemoryProvider(config *ReconcilerConfig, vm *vmv1.VirtualMachine) vmv1.
 	return config.DefaultMemoryProvider
 }
 
-func (r *VMReconciler) doVirtioMemScaling(vm *vmv1.VirtualMachine) (done bool, _ error) {
+// doRestartScaling handles scaling for VMs that can't be hotplugged, i.e. with bootMethod UEFI or
+// with confidential compute.
+//
+// If the guest's CPUs or memory don't match the spec, the runner pod is deleted, and a new one is
+// created with the new resources once the old one has stopped. Fractional CPU changes only
+// require updating the runner's cgroup, so they are applied without a restart.
+func (r *VMReconciler) doRestartScaling(ctx context.Context, vm *vmv1.VirtualMachine, vmRunner *corev1.Pod) error {
+	log := log.FromContext(ctx)
+
+	cpuSlotsPlugged, _, err := QmpGetCpus(QmpAddr(vm, r.Config.QMPAuthToken))
+	if err != nil {
+		log.Error(err, "Failed to get CPU details from VirtualMachine", "VirtualMachine", vm.Name)
+		return err
+	}
+	pluggedCPU := uint32(len(cpuSlotsPlugged))
+	memorySize, err := QmpGetMemorySize(QmpAddr(vm, r.Config.QMPAuthToken))
+	if err != nil {
+		log.Error(err, "Failed to get Memory details from VirtualMachine", "VirtualMachine", vm.Name)
+		return err
+	}
+
+	specCPU := vm.Spec.Guest.CPUs.Use
+	specMemory := resource.NewQuantity(int64(vm.Spec.Guest.MemorySlots.Use)*vm.Spec.Guest.MemorySlotSize.Value(), resource.BinarySI)
+	if specCPU.RoundedUp() != pluggedCPU || !memorySize.Equal(*specMemory) {
+		log.Info("Restarting VM to resize",
+			"CPUs on board", pluggedCPU,
+			"CPUs in spec", specCPU,
+			"Memory on board", memorySize,
+			"Memory in spec", specMemory)
+		r.recordScalingEvent(vm, "RestartForResize",
+			fmt.Sprintf("VM %s is being restarted to resize to %v CPU and %v memory",
+				vm.Name, specCPU, specMemory))
+		return r.deleteRunnerPodIfEnabled(ctx, vm, vmRunner)
+	}
+
+	cgroupUsage, err := getRunnerCgroup(ctx, vm)
+	if err != nil {
+		log.Error(err, "Failed to get CPU details from runner", "VirtualMachine", vm.Name)
+		return err
+	}
+	if specCPU != cgroupUsage.VCPUs {
+		log.Info("Update runner pod cgroups", "runner", cgroupUsage.VCPUs, "spec", specCPU)
+		if err := setRunnerCgroup(ctx, vm, specCPU); err != nil {
+			return err
+		}
+		reason := "ScaleDown"
+		if specCPU > cgroupUsage.VCPUs {
+			reason = "ScaleUp"
+		}
+		r.recordScalingEvent(vm, reason,
+			fmt.Sprintf("Runner pod cgroups was updated on VM %s",
+				vm.Name))
+		return nil
+	}
+
+	r.updateVMStatusCPU(ctx, vm, vmRunner, pluggedCPU, cgroupUsage)
+	r.updateVMStatusMemory(vm, memorySize)
+	vm.Status.Phase = vmv1.VmRunning
+	return nil
+}
+
+// scalingCorrelationID returns the ID of the autoscaler-agent's scaling transaction that last
+// changed the VM's resources, or "" if there isn't one
+func scalingCorrelationID(vm *vmv1.VirtualMachine) string {
+	return vm.Annotations[vmv1.VirtualMachineScalingCorrelationIDAnnotation]
+}
+
+// recordScalingEvent records a normal event for a step in resizing the VM, including the
+// correlation ID of the scaling transaction if there is one.
+func (r *VMReconciler) recordScalingEvent(vm *vmv1.VirtualMachine, reason string, message string) {
+	if id := scalingCorrelationID(vm); id != "" {
+		message = fmt.Sprintf("%s (correlation ID: %s)", message, id)
+	}
+	r.Recorder.Event(vm, "Normal", reason, message)
+}
+
+func (r *VMReconciler) doVirtioMemScaling(ctx context.Context, vm *vmv1.VirtualMachine) (done bool, _ error) {
 	targetSlotCount := int(vm.Spec.Guest.MemorySlots.Use - vm.Spec.Guest.MemorySlots.Min)
 
 	targetVirtioMemSize := int64(targetSlotCount) * vm.Spec.Guest.MemorySlotSize.Value()
-	previousTarget, err := QmpSetVirtioMem(vm, targetVirtioMemSize)
+	var previousTarget int64
+	err := traceQMP(ctx, vm, "qom-set virtio-mem", func() (err error) {
+		previousTarget, err = QmpSetVirtioMem(vm, targetVirtioMemSize, r.Config.QMPAuthToken)
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
@@ -840,13 +1284,13 @@ func (r *VMReconciler) doVirtioMemScaling(vm *vmv1.VirtualMachine) (done bool, _
 		if targetVirtioMemSize < previousTarget {
 			reason = "ScaleDown"
 		}
-		r.Recorder.Eventf(vm, "Normal", reason, "Set virtio-mem size for %v total memory", goalTotalSize)
+		r.recordScalingEvent(vm, reason, fmt.Sprintf("Set virtio-mem size for %v total memory", goalTotalSize))
 	}
 
 	// Maybe we're already using the amount we want?
 	// Update the status to reflect the current size - and if it matches goalTotalSize, ram
 	// scaling is done.
-	currentTotalSize, err := QmpGetMemorySize(QmpAddr(vm))
+	currentTotalSize, err := QmpGetMemorySize(QmpAddr(vm, r.Config.QMPAuthToken))
 	if err != nil {
 		return false, err
 	}
@@ -862,7 +1306,11 @@ func (r *VMReconciler) doDIMMSlotsScaling(ctx context.Context, vm *vmv1.VirtualM
 	memSlotsMin := vm.Spec.Guest.MemorySlots.Min
 	targetSlotCount := int(vm.Spec.Guest.MemorySlots.Use - memSlotsMin)
 
-	realSlots, err := QmpSetMemorySlots(ctx, vm, targetSlotCount, r.Recorder)
+	var realSlots int
+	err := traceQMP(ctx, vm, "set memory slots", func() (err error) {
+		realSlots, err = QmpSetMemorySlots(ctx, vm, targetSlotCount, r.Recorder, r.Config.QMPAuthToken)
+		return err
+	})
 	if realSlots < 0 {
 		return false, err
 	}
@@ -887,7 +1335,7 @@ func (r *VMReconciler) doDIMMSlotsScaling(ctx context.Context, vm *vmv1.VirtualM
 		done = true
 	}
 	// get Memory details from hypervisor and update VM status
-	memorySize, err := QmpGetMemorySize(QmpAddr(vm))
+	memorySize, err := QmpGetMemorySize(QmpAddr(vm, r.Config.QMPAuthToken))
 	if err != nil {
 		log.Error(err, "Failed to get Memory details from VirtualMachine", "VirtualMachine", vm.Name)
 		return false, err
@@ -975,6 +1423,20 @@ func runnerStatus(pod *corev1.Pod) runnerStatusKind {
 	}
 }
 
+// setLastShutdown copies how the guest shut down from the exited runner pod into the VM's status,
+// if neonvm-runner recorded it
+func setLastShutdown(vm *vmv1.VirtualMachine, pod *corev1.Pod) {
+	for _, stat := range pod.Status.ContainerStatuses {
+		if stat.Name != "neonvm-runner" || stat.State.Terminated == nil {
+			continue
+		}
+		switch kind := vmv1.VmShutdownKind(strings.TrimSpace(stat.State.Terminated.Message)); kind {
+		case vmv1.VmShutdownGraceful, vmv1.VmShutdownForced:
+			vm.Status.LastShutdown = kind
+		}
+	}
+}
+
 // runnerContainerStopped returns true iff the neonvm-runner container has exited.
 //
 // The guarantee is simple: It is only safe to start a new runner pod for a VM if
@@ -1048,6 +1510,9 @@ func updatePodMetadataIfNecessary(ctx context.Context, c client.Client, vm *vmv1
 			expected:  annotationsForVirtualMachine(vm),
 			actual:    runnerPod.Annotations,
 			ignoreExtra: map[string]bool{
+				// Likewise, the restart inputs describe the pod as it was created.
+				vmv1.RunnerPodRestartInputsAnnotation: true,
+
 				"k8s.v1.cni.cncf.io/networks":        true,
 				"k8s.v1.cni.cncf.io/network-status":  true,
 				"k8s.v1.cni.cncf.io/networks-status": true,
@@ -1165,17 +1630,44 @@ func extractVirtualMachineResourcesJSON(spec vmv1.VirtualMachineSpec) string {
 	return string(resourcesJSON)
 }
 
+func extractRequiredCapabilitiesJSON(spec vmv1.VirtualMachineSpec) string {
+	capabilitiesJSON, err := json.Marshal(spec.NodeCapabilities())
+	if err != nil {
+		panic(fmt.Errorf("error marshalling JSON: %w", err))
+	}
+
+	return string(capabilitiesJSON)
+}
+
+func extractAutoscalingJSON(spec vmv1.VirtualMachineSpec) string {
+	autoscalingJSON, err := json.Marshal(spec.Autoscaling)
+	if err != nil {
+		panic(fmt.Errorf("error marshalling JSON: %w", err))
+	}
+
+	return string(autoscalingJSON)
+}
+
 // podForVirtualMachine returns a VirtualMachine Pod object
 func (r *VMReconciler) podForVirtualMachine(
 	vm *vmv1.VirtualMachine,
 	memoryProvider vmv1.MemoryProvider,
 	sshSecret *corev1.Secret,
+	restoreFrom *vmv1.VirtualMachineSnapshot,
 ) (*corev1.Pod, error) {
 	pod, err := podSpec(vm, memoryProvider, sshSecret, r.Config)
 	if err != nil {
 		return nil, err
 	}
 
+	// Only the VM's own runner pod is restored from the snapshot. Migration target pods receive
+	// their state from the source instead.
+	if restoreFrom != nil {
+		if err := addRestoreInitContainer(pod, vm, restoreFrom, r.Config); err != nil {
+			return nil, err
+		}
+	}
+
 	// Set the ownerRef for the Pod
 	// More info: https://kubernetes.io/docs/concepts/overview/working-with-objects/owners-dependents/
 	if err := ctrl.SetControllerReference(vm, pod, r.Scheme); err != nil {
@@ -1208,8 +1700,10 @@ func sshSecretSpec(vm *vmv1.VirtualMachine) (*corev1.Secret, error) {
 
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      vm.Status.SSHSecretName,
-			Namespace: vm.Namespace,
+			Name:        vm.Status.SSHSecretName,
+			Namespace:   vm.Namespace,
+			Labels:      labelsForGeneratedResource(vm),
+			Annotations: annotationsForGeneratedResource(vm),
 		},
 		Immutable: lo.ToPtr(true),
 		Type:      corev1.SecretTypeSSHAuth,
@@ -1238,6 +1732,23 @@ func labelsForVirtualMachine(vm *vmv1.VirtualMachine, runnerVersion *api.RunnerP
 	return l
 }
 
+// labelsForGeneratedResource returns the labels for the auxiliary resources generated for the VM,
+// which are used to find them if they're orphaned. See orphan_sweep.go.
+func labelsForGeneratedResource(vm *vmv1.VirtualMachine) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":             "NeonVM",
+		vmv1.VirtualMachineGeneratedForLabel: vm.Name,
+	}
+}
+
+// annotationsForGeneratedResource returns the annotations for the auxiliary resources generated for
+// the VM, recording which VM they were generated for. See orphan_sweep.go.
+func annotationsForGeneratedResource(vm *vmv1.VirtualMachine) map[string]string {
+	return map[string]string{
+		vmv1.VirtualMachineGeneratedForUIDAnnotation: string(vm.UID),
+	}
+}
+
 func annotationsForVirtualMachine(vm *vmv1.VirtualMachine) map[string]string {
 	// use bool here so `if ignored[key] { ... }` works
 	ignored := map[string]bool{
@@ -1254,6 +1765,18 @@ func annotationsForVirtualMachine(vm *vmv1.VirtualMachine) map[string]string {
 	a["kubectl.kubernetes.io/default-container"] = "neonvm-runner"
 	a[vmv1.VirtualMachineUsageAnnotation] = extractVirtualMachineUsageJSON(vm.Spec)
 	a[vmv1.VirtualMachineResourcesAnnotation] = extractVirtualMachineResourcesJSON(vm.Spec)
+	if len(vm.Spec.NodeCapabilities()) != 0 {
+		a[vmv1.VirtualMachineRequiredCapabilitiesAnnotation] = extractRequiredCapabilitiesJSON(vm.Spec)
+	}
+	if len(vm.Spec.Guest.Devices) != 0 {
+		a[vmv1.VirtualMachineDevicesAnnotation] = extractDevicesJSON(vm.Spec)
+	}
+	if vm.Spec.Priority != "" {
+		a[vmv1.VirtualMachinePriorityAnnotation] = string(vm.Spec.Priority)
+	}
+	if vm.Spec.Autoscaling != nil {
+		a[vmv1.VirtualMachineAutoscalingAnnotation] = extractAutoscalingJSON(vm.Spec)
+	}
 	return a
 }
 
@@ -1269,8 +1792,16 @@ func affinityForVirtualMachine(vm *vmv1.VirtualMachine) *corev1.Affinity {
 		a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
 	}
 
-	// if NodeSelectorTerms list is empty - add default values (arch==amd64 or os==linux)
+	// if NodeSelectorTerms list is empty - add default values (arch==amd64 or os==linux, or the
+	// root disk image's platform if it's declared)
 	if len(a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0 {
+		arch, osName := "amd64", "linux"
+		if p := vm.Spec.Guest.RootDisk.Platform; p != nil {
+			arch = p.Architecture
+			if p.OS != "" {
+				osName = p.OS
+			}
+		}
 		a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = append(
 			a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms,
 			corev1.NodeSelectorTerm{
@@ -1278,12 +1809,12 @@ func affinityForVirtualMachine(vm *vmv1.VirtualMachine) *corev1.Affinity {
 					{
 						Key:      "kubernetes.io/arch",
 						Operator: "In",
-						Values:   []string{"amd64"},
+						Values:   []string{arch},
 					},
 					{
 						Key:      "kubernetes.io/os",
 						Operator: "In",
-						Values:   []string{"linux"},
+						Values:   []string{osName},
 					},
 				},
 			})
@@ -1291,11 +1822,16 @@ func affinityForVirtualMachine(vm *vmv1.VirtualMachine) *corev1.Affinity {
 	return a
 }
 
+// consoleURL returns the URL of the guest's serial console output, served by the runner pod
+func consoleURL(podIP string) string {
+	return fmt.Sprintf("http://%s/console", net.JoinHostPort(podIP, fmt.Sprint(vmv1.ConsolePort)))
+}
+
 func setRunnerCgroup(ctx context.Context, vm *vmv1.VirtualMachine, cpu vmv1.MilliCPU) error {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s:%d/cpu_change", vm.Status.PodIP, vm.Spec.RunnerPort)
+	url := fmt.Sprintf("http://%s/cpu_change", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)))
 
 	update := api.VCPUChange{VCPUs: cpu}
 
@@ -1322,11 +1858,42 @@ func setRunnerCgroup(ctx context.Context, vm *vmv1.VirtualMachine, cpu vmv1.Mill
 	return nil
 }
 
+func setRunnerSwap(ctx context.Context, vm *vmv1.VirtualMachine, size resource.Quantity) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/swap_change", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)))
+
+	update := api.SwapChange{Size: size}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
 func getRunnerCgroup(ctx context.Context, vm *vmv1.VirtualMachine) (*api.VCPUCgroup, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s:%d/cpu_current", vm.Status.PodIP, vm.Spec.RunnerPort)
+	url := fmt.Sprintf("http://%s/cpu_current", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)))
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -1368,6 +1935,19 @@ func imageForVmRunner() (string, error) {
 	return image, nil
 }
 
+// ipForwardingCommand returns the shell command that the init container runs to enable IP
+// forwarding in the runner pod, for each of the VM's IP families
+func ipForwardingCommand(vm *vmv1.VirtualMachine) string {
+	var cmds []string
+	if vm.Spec.HasIPFamily(vmv1.IPFamilyIPv4) {
+		cmds = append(cmds, "sysctl -w net.ipv4.ip_forward=1")
+	}
+	if vm.Spec.HasIPFamily(vmv1.IPFamilyIPv6) {
+		cmds = append(cmds, "sysctl -w net.ipv6.conf.all.forwarding=1")
+	}
+	return strings.Join(cmds, " && ")
+}
+
 func podSpec(
 	vm *vmv1.VirtualMachine,
 	memoryProvider vmv1.MemoryProvider,
@@ -1384,6 +1964,7 @@ func podSpec(
 	if err != nil {
 		return nil, err
 	}
+	annotations[vmv1.RunnerPodRestartInputsAnnotation] = restartInputsHash(vm, image, config)
 
 	vmSpecJson, err := json.Marshal(vm.Spec)
 	if err != nil {
@@ -1416,19 +1997,36 @@ func podSpec(
 			InitContainers: []corev1.Container{
 				{
 					Image:           vm.Spec.Guest.RootDisk.Image,
-					Name:            "init",
+					Name:            rootDiskInitContainerName,
 					ImagePullPolicy: vm.Spec.Guest.RootDisk.ImagePullPolicy,
 					VolumeMounts: []corev1.VolumeMount{{
 						Name:      "virtualmachineimages",
 						MountPath: "/vm/images",
 					}},
-					Command: []string{
-						"sh", "-c",
-						"cp /disk.qcow2 /vm/images/rootdisk.qcow2 && " +
-							/* uid=36(qemu) gid=34(kvm) groups=34(kvm) */
-							"chown 36:34 /vm/images/rootdisk.qcow2 && " +
-							"sysctl -w net.ipv4.ip_forward=1",
-					},
+					Command: func() []string {
+						// Report the image's metadata first, so that it's reported however the
+						// disk is set up. See vm_image_metadata.go.
+						script := imageMetadataReportCommand() + "\n"
+						switch {
+						// With root disk streaming, the runner creates a local overlay backed by
+						// the remote image, so there's nothing to copy here.
+						case vm.Spec.Guest.RootDisk.Streaming != nil:
+							script += ipForwardingCommand(vm)
+						// With the base image cache, the runner creates a local overlay backed by
+						// the cached image. See rootdisk_base_images.go.
+						case vm.Spec.Guest.RootDisk.BaseImageCache != nil:
+							script += baseImageCacheInitScript(vm)
+						// Compressed images are copied as-is, and decompressed by the runner.
+						default:
+							image := vm.Spec.Guest.RootDisk.ImagePath()
+							dest := "/vm/images/rootdisk" + strings.TrimPrefix(image, "/disk")
+							script += fmt.Sprintf("cp %s %s && ", image, dest) +
+								/* uid=36(qemu) gid=34(kvm) groups=34(kvm) */
+								fmt.Sprintf("chown 36:34 %s && ", dest) +
+								ipForwardingCommand(vm)
+						}
+						return []string{"sh", "-c", script}
+					}(),
 					SecurityContext: &corev1.SecurityContext{
 						Privileged: lo.ToPtr(true),
 					},
@@ -1472,6 +2070,19 @@ func podSpec(
 						if memoryProvider == vmv1.MemoryProviderVirtioMem {
 							cmd = append(cmd, "-memhp-auto-movable-ratio", config.MemhpAutoMovableRatio)
 						}
+						if hash := qmpAuthTokenHash(config.QMPAuthToken); hash != "" {
+							cmd = append(cmd, "-qmp-auth-token-hash", hash)
+						}
+						// Only pass the flag if it's not the runner's default, so that runner pods
+						// for VMs using IPTables are unchanged.
+						if pf := pickPortForwarding(config, vm); pf != vmv1.PortForwardingIPTables {
+							cmd = append(cmd, "-port-forwarding", string(pf))
+						}
+						// Same for the CPU scaling mode. It's taken from the status so that the
+						// target pod of a migration is started with the same mode as the source.
+						if m := vm.Status.CPUScalingMode; m != nil && *m != vmv1.CPUScalingModeQMPHotplug {
+							cmd = append(cmd, "-cpu-scaling-mode", string(*m))
+						}
 						// put these last, so that the earlier args are easier to see (because these
 						// can get quite large)
 						cmd = append(
@@ -1481,14 +2092,26 @@ func podSpec(
 						)
 						return cmd
 					}(),
-					Env: []corev1.EnvVar{{
-						Name: "K8S_POD_NAME",
-						ValueFrom: &corev1.EnvVarSource{
-							FieldRef: &corev1.ObjectFieldSelector{
-								FieldPath: "metadata.name",
+					Env: []corev1.EnvVar{
+						{
+							Name: "K8S_POD_NAME",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									FieldPath: "metadata.name",
+								},
 							},
 						},
-					}},
+						{
+							Name: "K8S_POD_NAMESPACE",
+							ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{
+									FieldPath: "metadata.namespace",
+								},
+							},
+						},
+						// used to label the runner's metrics
+						{Name: "VM_NAME", Value: vm.Name},
+					},
 					VolumeMounts: func() []corev1.VolumeMount {
 						images := corev1.VolumeMount{
 							Name:      "virtualmachineimages",
@@ -1515,6 +2138,22 @@ func podSpec(
 					}(),
 					Resources: vm.Spec.PodResources,
 				}
+				if probe := vm.Spec.Guest.ReadinessProbe; probe != nil {
+					// neonvm-runner runs the probe against the guest and applies its thresholds, so
+					// the kubelet only needs to pick up each result.
+					runner.ReadinessProbe = &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/ready",
+								Port: intstr.FromInt(int(vmv1.ConsolePort)),
+							},
+						},
+						PeriodSeconds:    probe.PeriodSeconds,
+						TimeoutSeconds:   1,
+						SuccessThreshold: 1,
+						FailureThreshold: 1,
+					}
+				}
 				containerMgr := corev1.Container{
 					Image: image,
 					Name:  "neonvm-container-mgr",
@@ -1607,6 +2246,10 @@ func podSpec(
 		},
 	}
 
+	if vm.Spec.Guest.RootDisk.BaseImageCache != nil {
+		addBaseImageCacheVolume(pod, vm)
+	}
+
 	if sshSecret != nil {
 		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts,
 			corev1.VolumeMount{
@@ -1652,6 +2295,31 @@ func podSpec(
 		)
 	}
 
+	// The runner builds the guest's user-data from the Secret's key, mounted as 'user-data'.
+	if cloudInit := vm.Spec.Guest.CloudInit; cloudInit != nil && cloudInit.UserDataSecretRef != nil {
+		ref := cloudInit.UserDataSecretRef
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "cloud-init",
+			MountPath: "/vm/cloud-init",
+			ReadOnly:  true,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "cloud-init",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: ref.Name,
+					Items: []corev1.KeyToPath{
+						{
+							Key:  ref.Key,
+							Path: "user-data",
+						},
+					},
+					Optional: ref.Optional,
+				},
+			},
+		})
+	}
+
 	// If a custom neonvm-runner image is requested, use that instead:
 	if vm.Spec.RunnerImage != nil {
 		pod.Spec.Containers[0].Image = *vm.Spec.RunnerImage
@@ -1687,6 +2355,9 @@ func podSpec(
 	// Add any InitContainers that were specified by the spec
 	pod.Spec.InitContainers = append(pod.Spec.InitContainers, vm.Spec.ExtraInitContainers...)
 
+	// Add any sidecar containers that were specified by the spec
+	pod.Spec.Containers = append(pod.Spec.Containers, vm.Spec.ExtraContainers...)
+
 	// allow access to /dev/kvm and /dev/vhost-net devices by generic-device-plugin for kubelet
 	if pod.Spec.Containers[0].Resources.Limits == nil {
 		pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{}
@@ -1696,6 +2367,14 @@ func podSpec(
 	if *vm.Spec.EnableAcceleration {
 		pod.Spec.Containers[0].Resources.Limits["neonvm/kvm"] = resource.MustParse("1")
 	}
+	// ... and to /dev/sev, which QEMU needs to launch SEV-SNP guests
+	if vm.Spec.ConfidentialCompute() {
+		pod.Spec.Containers[0].Resources.Limits["neonvm/confidential-compute"] = resource.MustParse("1")
+	}
+	// ... and to the devices passed through to the guest
+	addDevices(pod, vm)
+	// ... and the hugepages backing the guest's memory
+	addHugepages(pod, vm)
 
 	for _, port := range vm.Spec.Guest.Ports {
 		cPort := corev1.ContainerPort{
@@ -1777,6 +2456,20 @@ func podSpec(
 					},
 				},
 			})
+		case disk.VolumeSnapshot != nil:
+			pod.Spec.Containers[0].VolumeDevices = append(pod.Spec.Containers[0].VolumeDevices, corev1.VolumeDevice{
+				Name:       disk.Name,
+				DevicePath: volumeSnapshotDiskDevicePath(disk),
+			})
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+				Name: disk.Name,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: volumeSnapshotDiskPVCName(vm, disk),
+						ReadOnly:  disk.ReadOnly != nil && *disk.ReadOnly,
+					},
+				},
+			})
 		default:
 			// do nothing
 		}
@@ -1809,6 +2502,17 @@ func podSpec(
 // desirable state on the cluster
 func (r *VMReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
 	cntrlName := "virtualmachine"
+	if err := registerVMPhaseMetrics(mgr.GetClient()); err != nil {
+		return nil, err
+	}
+	if r.Config.MemoryProviderMigration {
+		if err := registerMemoryProviderMigrationMetrics(mgr.GetClient()); err != nil {
+			return nil, err
+		}
+	}
+	r.qmpBreakers = newQMPNodeBreakers(r.Config.QMPBreaker, r.Metrics)
+	r.expensiveOps = newExpensiveOperationLimiter(cntrlName, r.Config.MaxConcurrentExpensiveOperations, r.Metrics)
+	r.rollout = newRolloutTracker(r.Config.Rollout, r.Metrics)
 	reconciler := WithMetrics(
 		withCatchPanic(r),
 		r.Metrics,
@@ -1819,9 +2523,13 @@ func (r *VMReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics
 	err := ctrl.NewControllerManagedBy(mgr).
 		For(&vmv1.VirtualMachine{}).
 		Owns(&corev1.Pod{}).
+		Owns(&vmv1.VirtualMachineSnapshot{}). // for .spec.cloneFrom
 		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
 		Named(cntrlName).
-		Complete(reconciler)
+		Complete(withObjectRateLimit(
+			withNamespaceRateLimit(reconciler, cntrlName, r.Config.NamespaceRateLimit, r.Metrics),
+			cntrlName, r.Config.ObjectRateLimit, r.Metrics,
+		))
 	return reconciler, err
 }
 
@@ -17,11 +17,15 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 
 	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 )
@@ -118,11 +122,32 @@ func newTestParams(t *testing.T) *testParams {
 			IsK3s:                   false,
 			UseContainerMgr:         false,
 			MaxConcurrentReconciles: 10,
+			NamespaceRateLimit:      NamespaceRateLimit{QPS: 0, Burst: 0},
+			ObjectRateLimit:         ObjectRateLimit{QPS: 0, Burst: 0},
 			QEMUDiskCacheSettings:   "",
 			DefaultMemoryProvider:   vmv1.MemoryProviderDIMMSlots,
+			MemoryProviderMigration: false,
 			MemhpAutoMovableRatio:   "301",
+			DefaultCPUScalingMode:   vmv1.CPUScalingModeQMPHotplug,
 			FailurePendingPeriod:    time.Minute,
 			FailingRefreshInterval:  time.Minute,
+			SnapshotExportImage:     "",
+			QMPBreaker:              QMPBreakerConfig{FailureThreshold: 0, OpenDuration: 0},
+			Rollout: RolloutConfig{
+				MaxUnavailable:      0,
+				BootSLO:             0,
+				MaxFailureRate:      0,
+				FailureWindow:       0,
+				MinRestartsForPause: 0,
+			},
+			Migration: MigrationConfig{
+				DowntimeLimit:           0,
+				MultifdChannels:         0,
+				Compression:             "",
+				PostCopyAfterIterations: 0,
+			},
+
+			MaxConcurrentExpensiveOperations: 0,
 		},
 		Metrics: reconcilerMetrics,
 	}
@@ -252,6 +277,535 @@ func TestRunningPod(t *testing.T) {
 
 	// VM is now running
 	assert.Equal(t, vmv1.VmRunning, vm.Status.Phase)
-	assert.Len(t, vm.Status.Conditions, 1)
 	assert.Equal(t, vm.Status.Conditions[0].Type, typeAvailableVirtualMachine)
+	for _, c := range []struct {
+		conditionType string
+		status        metav1.ConditionStatus
+	}{
+		{vmv1.VmConditionScheduled, metav1.ConditionFalse}, // the fake pod has no node
+		{vmv1.VmConditionGuestBooted, metav1.ConditionUnknown},
+		{vmv1.VmConditionAgentConnected, metav1.ConditionUnknown},
+		{vmv1.VmConditionScaling, metav1.ConditionFalse},
+		{vmv1.VmConditionMigrationInProgress, metav1.ConditionFalse},
+	} {
+		condition := meta.FindStatusCondition(vm.Status.Conditions, c.conditionType)
+		if assert.NotNil(t, condition, c.conditionType) {
+			assert.Equal(t, c.status, condition.Status, c.conditionType)
+		}
+	}
+}
+
+func TestRootDiskPlatformMismatch(t *testing.T) {
+	node := func(name, arch string, labels map[string]string) corev1.Node {
+		l := map[string]string{
+			corev1.LabelArchStable: arch,
+			corev1.LabelOSStable:   "linux",
+		}
+		for k, v := range labels {
+			l[k] = v
+		}
+		return corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: l}}
+	}
+	nodes := []corev1.Node{
+		node("amd-1", "amd64", map[string]string{"pool": "general"}),
+		node("amd-2", "amd64", map[string]string{"pool": "general"}),
+		node("arm-1", "arm64", map[string]string{"pool": "arm"}),
+	}
+
+	cases := []struct {
+		name         string
+		platform     *vmv1.RootDiskPlatform
+		nodeSelector map[string]string
+		mismatch     bool
+	}{
+		{"no platform", nil, map[string]string{"pool": "general"}, false},
+		{"any node matches", &vmv1.RootDiskPlatform{Architecture: "arm64"}, nil, false},
+		{"pool matches", &vmv1.RootDiskPlatform{Architecture: "arm64", OS: "linux"}, map[string]string{"pool": "arm"}, false},
+		{"pool mismatch", &vmv1.RootDiskPlatform{Architecture: "arm64"}, map[string]string{"pool": "general"}, true},
+		{"empty pool", &vmv1.RootDiskPlatform{Architecture: "arm64"}, map[string]string{"pool": "gpu"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := &vmv1.VirtualMachine{}
+			vm.Name = "vm"
+			vm.Spec.Guest.RootDisk.Platform = c.platform
+			vm.Spec.NodeSelector = c.nodeSelector
+
+			msg := rootDiskPlatformMismatch(vm, nodes)
+			assert.Equal(t, c.mismatch, msg != "", msg)
+		})
+	}
+}
+
+func TestOrphanSweep(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, vmv1.AddToScheme(scheme))
+
+	now := time.Now()
+	vm := defaultVm()
+	vm.UID = "vm-uid"
+
+	// ownerUID is the UID of the VM in the owner reference, and generatedFor the UID in the
+	// annotation. Either may be empty, if the owner reference was removed or the annotation is
+	// missing.
+	generated := func(obj client.Object, name string, vmName string, ownerUID, generatedFor types.UID, age time.Duration) {
+		obj.SetName(name)
+		obj.SetNamespace(vm.Namespace)
+		obj.SetUID(types.UID(name + "-uid"))
+		obj.SetCreationTimestamp(metav1.NewTime(now.Add(-age)))
+		obj.SetLabels(map[string]string{vmv1.VirtualMachineGeneratedForLabel: vmName})
+		if generatedFor != "" {
+			obj.SetAnnotations(map[string]string{vmv1.VirtualMachineGeneratedForUIDAnnotation: string(generatedFor)})
+		}
+		if ownerUID != "" {
+			obj.SetOwnerReferences([]metav1.OwnerReference{{
+				APIVersion:         vmv1.SchemeGroupVersion.String(),
+				Kind:               "VirtualMachine",
+				Name:               vmName,
+				UID:                ownerUID,
+				Controller:         lo.ToPtr(true),
+				BlockOwnerDeletion: lo.ToPtr(true),
+			}})
+		}
+	}
+	secret := func(name string, vmName string, ownerUID, generatedFor types.UID, age time.Duration) *corev1.Secret {
+		s := &corev1.Secret{}
+		generated(s, name, vmName, ownerUID, generatedFor, age)
+		return s
+	}
+	snapshot := func(name string, vmName string, ownerUID, generatedFor types.UID) *vmv1.VirtualMachineSnapshot {
+		s := &vmv1.VirtualMachineSnapshot{}
+		generated(s, name, vmName, ownerUID, generatedFor, time.Hour)
+		return s
+	}
+
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(
+			vm,
+			secret("owned", vm.Name, vm.UID, vm.UID, time.Hour),
+			secret("previous-vm", vm.Name, "old-uid", "old-uid", time.Hour),
+			secret("unowned", vm.Name, "", vm.UID, time.Hour),
+			secret("unowned-previous-vm", vm.Name, "", "old-uid", time.Hour),
+			secret("unowned-deleted-vm", "other-vm", "", "other-uid", time.Hour),
+			secret("unowned-unknown", vm.Name, "", "", time.Hour),
+			secret("unowned-unknown-deleted-vm", "other-vm", "", "", time.Hour),
+			secret("deleted-vm", "other-vm", "other-uid", "other-uid", time.Hour),
+			secret("new", "other-vm", "other-uid", "other-uid", time.Second),
+			snapshot("clone", vm.Name, "", vm.UID),
+			snapshot("clone-deleted-vm", "other-vm", "", "other-uid"),
+			&corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "pvc",
+					Namespace:         vm.Namespace,
+					CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+					Labels:            map[string]string{vmv1.VirtualMachineGeneratedForLabel: "other-vm"},
+				},
+			},
+		).
+		Build()
+
+	sweeper := OrphanSweeper{
+		Client:    c,
+		APIReader: c,
+		Scheme:    scheme,
+		Interval:  time.Minute,
+		Metrics:   reconcilerMetrics,
+	}
+	require.NoError(t, sweeper.sweep(context.Background(), now))
+
+	var secrets corev1.SecretList
+	require.NoError(t, c.List(context.Background(), &secrets))
+	names := lo.Map(secrets.Items, func(s corev1.Secret, _ int) string { return s.Name })
+	// Objects without an owner reference are deleted if they were annotated with a VM that no
+	// longer exists, but never if there's no annotation to prove where they came from.
+	assert.ElementsMatch(t, []string{"owned", "unowned", "unowned-unknown", "unowned-unknown-deleted-vm", "new"}, names)
+
+	for _, name := range []string{"unowned", "unowned-unknown"} {
+		adopted, _ := lo.Find(secrets.Items, func(s corev1.Secret) bool { return s.Name == name })
+		owner := metav1.GetControllerOf(&adopted)
+		require.NotNil(t, owner, name)
+		assert.Equal(t, vm.UID, owner.UID, name)
+	}
+
+	// Clone snapshots are checked the same way
+	var snapshots vmv1.VirtualMachineSnapshotList
+	require.NoError(t, c.List(context.Background(), &snapshots))
+	require.Len(t, snapshots.Items, 1)
+	assert.Equal(t, "clone", snapshots.Items[0].Name)
+	assert.NotNil(t, metav1.GetControllerOf(&snapshots.Items[0]))
+
+	// PVCs aren't touched, even if their VM is gone
+	var pvcs corev1.PersistentVolumeClaimList
+	require.NoError(t, c.List(context.Background(), &pvcs))
+	assert.Len(t, pvcs.Items, 1)
+}
+
+func TestRolloutTracker(t *testing.T) {
+	config := RolloutConfig{
+		MaxUnavailable:      2,
+		BootSLO:             time.Minute,
+		MaxFailureRate:      0.5,
+		FailureWindow:       15 * time.Minute,
+		MinRestartsForPause: 3,
+	}
+	tracker := newRolloutTracker(config, reconcilerMetrics)
+	tracker.restored = true
+	vm := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+
+	// At most MaxUnavailable VMs restart at once
+	for _, name := range []string{"a", "b"} {
+		ok, _, _ := tracker.tryStart(vm(name))
+		assert.True(t, ok)
+	}
+	ok, reason, _ := tracker.tryStart(vm("c"))
+	assert.False(t, ok)
+	assert.Equal(t, rolloutReasonWaiting, reason)
+
+	// A VM that's already restarting may continue
+	ok, _, _ = tracker.tryStart(vm("a"))
+	assert.True(t, ok)
+
+	// Once one has finished, the next can start
+	tracker.finished(vm("a"))
+	ok, _, _ = tracker.tryStart(vm("c"))
+	assert.True(t, ok)
+
+	// Restarts that exceed the BootSLO count as failures, and pause the rollout once there are
+	// enough of them
+	now := time.Now()
+	tracker.mu.Lock()
+	tracker.inFlight[vm("b")].startedAt = now.Add(-2 * time.Minute)
+	tracker.inFlight[vm("c")].startedAt = now.Add(-2 * time.Minute)
+	tracker.update(now)
+	tracker.mu.Unlock()
+
+	tracker.finished(vm("b"))
+	tracker.finished(vm("c"))
+	ok, reason, _ = tracker.tryStart(vm("d"))
+	assert.False(t, ok)
+	assert.Equal(t, rolloutReasonPaused, reason)
+
+	// ... until those failures are older than the FailureWindow
+	tracker.mu.Lock()
+	tracker.update(now.Add(config.FailureWindow + time.Second))
+	tracker.mu.Unlock()
+	ok, _, _ = tracker.tryStart(vm("d"))
+	assert.True(t, ok)
+}
+
+// The rollout's state must survive restarts of the controller
+func TestRolloutTrackerRestore(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, vmv1.AddToScheme(scheme))
+
+	withReason := func(name string, reason string) *vmv1.VirtualMachine {
+		vm := defaultVm()
+		vm.Name = name
+		vm.Status.Conditions = []metav1.Condition{{
+			Type:               typeRestartInputsUpToDate,
+			Status:             metav1.ConditionFalse,
+			Reason:             reason,
+			Message:            "",
+			LastTransitionTime: metav1.Now(),
+			ObservedGeneration: 0,
+		}}
+		return vm
+	}
+
+	config := RolloutConfig{
+		MaxUnavailable:      1,
+		BootSLO:             time.Minute,
+		MaxFailureRate:      0.5,
+		FailureWindow:       15 * time.Minute,
+		MinRestartsForPause: 3,
+	}
+	key := func(name string) types.NamespacedName {
+		return types.NamespacedName{Namespace: "default", Name: name}
+	}
+
+	t.Run("restarting", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			withReason("restarting", rolloutReasonRestarting),
+			withReason("waiting", rolloutReasonWaiting),
+		).Build()
+		tracker := newRolloutTracker(config, reconcilerMetrics)
+		require.NoError(t, tracker.restore(context.Background(), c))
+
+		// The VM that was restarting still counts towards MaxUnavailable
+		ok, reason, _ := tracker.tryStart(key("waiting"))
+		assert.False(t, ok)
+		assert.Equal(t, rolloutReasonWaiting, reason)
+
+		tracker.finished(key("restarting"))
+		ok, _, _ = tracker.tryStart(key("waiting"))
+		assert.True(t, ok)
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			withReason("paused", rolloutReasonPaused),
+		).Build()
+		tracker := newRolloutTracker(config, reconcilerMetrics)
+		require.NoError(t, tracker.restore(context.Background(), c))
+
+		ok, reason, _ := tracker.tryStart(key("paused"))
+		assert.False(t, ok)
+		assert.Equal(t, rolloutReasonPaused, reason)
+
+		// The pause ends once any failures from before the restart would have aged out
+		tracker.mu.Lock()
+		tracker.update(time.Now().Add(config.FailureWindow + time.Second))
+		tracker.mu.Unlock()
+		assert.False(t, tracker.paused)
+	})
+}
+
+func TestRestartBackoff(t *testing.T) {
+	expected := []time.Duration{
+		0,
+		10 * time.Second,
+		20 * time.Second,
+		40 * time.Second,
+		80 * time.Second,
+		160 * time.Second,
+		5 * time.Minute,
+		5 * time.Minute,
+	}
+	for i, backoff := range expected {
+		assert.Equal(t, backoff, restartBackoff(int32(i)), "consecutive restarts: %d", i)
+	}
+
+	recorder := &mockRecorder{}
+	recorder.On("Event", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	r := &VMReconciler{Recorder: recorder}
+
+	now := time.Now()
+	vm := defaultVm()
+	vm.Status.ConsecutiveRestarts = 2
+
+	// Not restarted until the backoff has passed
+	assert.False(t, r.restartAfterBackoff(vm, now))
+	require.NotNil(t, vm.Status.NextRestartTime)
+	assert.Equal(t, now.Add(20*time.Second), vm.Status.NextRestartTime.Time)
+	assert.False(t, r.restartAfterBackoff(vm, now.Add(19*time.Second)))
+
+	assert.True(t, r.restartAfterBackoff(vm, now.Add(20*time.Second)))
+	assert.Nil(t, vm.Status.NextRestartTime)
+	assert.Equal(t, int32(3), vm.Status.ConsecutiveRestarts)
+	assert.True(t, crashLooping(vm))
+
+	// Reset once the runner pod has been up for long enough
+	pod := &corev1.Pod{}
+	pod.Status.StartTime = &metav1.Time{Time: now}
+	resetRestartBackoff(vm, pod, now.Add(time.Minute))
+	assert.Equal(t, int32(3), vm.Status.ConsecutiveRestarts)
+	resetRestartBackoff(vm, pod, now.Add(restartBackoffResetAfter))
+	assert.Equal(t, int32(0), vm.Status.ConsecutiveRestarts)
+	assert.False(t, crashLooping(vm))
+}
+
+func TestAttachedDiskIOLimits(t *testing.T) {
+	limits := func(iops int64) *vmv1.DiskIOLimits {
+		return &vmv1.DiskIOLimits{TotalIOPS: &iops}
+	}
+
+	vm := defaultVm()
+	vm.Spec.Guest.RootDisk.IOLimits = limits(1000)
+	vm.Spec.Disks = []vmv1.Disk{
+		{Name: "cold", IOLimits: limits(500)},
+		{Name: "hot", Hotpluggable: true, IOLimits: limits(200)},
+		{Name: "unlimited"},
+	}
+
+	// Hotpluggable disks' limits only count once they're attached
+	assert.Equal(t, map[string]vmv1.DiskIOLimits{
+		"rootdisk": *limits(1000),
+		"cold":     *limits(500),
+	}, attachedDiskIOLimits(vm))
+	assert.False(t, diskAttached(vm, "hot"))
+
+	vm.Status.HotplugDisks = []string{"hot"}
+	assert.Equal(t, map[string]vmv1.DiskIOLimits{
+		"rootdisk": *limits(1000),
+		"cold":     *limits(500),
+		"hot":      *limits(200),
+	}, attachedDiskIOLimits(vm))
+	assert.True(t, diskAttached(vm, "hot"))
+	assert.False(t, diskAttached(vm, "removed"))
+}
+
+func TestQMPCommandName(t *testing.T) {
+	assert.Equal(t, "query-cpus-fast", qmpCommandName([]byte(`{"execute": "query-cpus-fast"}`)))
+	assert.Equal(t, "object-add", qmpCommandName([]byte(`{"execute": "object-add", "arguments": {"id": "memslot1"}}`)))
+	assert.Equal(t, "unknown", qmpCommandName([]byte(`{"arguments": {}}`)))
+	assert.Equal(t, "unknown", qmpCommandName([]byte(`not json`)))
+}
+
+func TestMarkTimeSyncPending(t *testing.T) {
+	now := time.Now()
+
+	// Without SSH or the guest agent, there's no way to synchronize the clock
+	vm := defaultVm()
+	vm.Spec.EnableSSH = lo.ToPtr(false)
+	markTimeSyncPending(vm, now)
+	assert.Nil(t, vm.Status.TimeSync)
+
+	vm.Spec.EnableSSH = lo.ToPtr(true)
+	markTimeSyncPending(vm, now)
+	require.NotNil(t, vm.Status.TimeSync)
+	require.NotNil(t, vm.Status.TimeSync.PendingSince)
+	assert.True(t, vm.Status.TimeSync.PendingSince.Time.Equal(now))
+
+	// UEFI guests need the guest agent, regardless of SSH
+	vm = defaultVm()
+	vm.Spec.EnableSSH = lo.ToPtr(true)
+	vm.Spec.Guest.BootMethod = vmv1.BootMethodUEFI
+	markTimeSyncPending(vm, now)
+	assert.Nil(t, vm.Status.TimeSync)
+
+	vm.Spec.Guest.EnableGuestAgent = lo.ToPtr(true)
+	assert.Equal(t, vmv1.TimeSyncMethodGuestAgent, *vm.Spec.TimeSyncMethod())
+	markTimeSyncPending(vm, now)
+	assert.NotNil(t, vm.Status.TimeSync)
+}
+
+func TestImageCompatibility(t *testing.T) {
+	podWithMessage := func(message string) *corev1.Pod {
+		return &corev1.Pod{Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{{
+				Name: rootDiskInitContainerName,
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{ExitCode: 0, Message: message},
+				},
+			}},
+		}}
+	}
+
+	vm := defaultVm()
+	vm.Status.MemoryProvider = lo.ToPtr(vmv1.MemoryProviderVirtioMem)
+
+	// Init container hasn't finished yet
+	status, reason, _ := imageCompatibility(vm, &corev1.Pod{})
+	assert.Equal(t, metav1.ConditionUnknown, status)
+	assert.Equal(t, "NotReported", reason)
+
+	status, reason, _ = imageCompatibility(vm, podWithMessage(""))
+	assert.Equal(t, metav1.ConditionUnknown, status)
+	assert.Equal(t, "NoMetadata", reason)
+	assert.Nil(t, vm.Status.ImageMetadata)
+
+	status, reason, _ = imageCompatibility(vm, podWithMessage(`{"kernelVersion": "6.1.92", "components": {"vector": "0.26.0"}}`))
+	assert.Equal(t, metav1.ConditionTrue, status)
+	assert.Equal(t, "Compatible", reason)
+	require.NotNil(t, vm.Status.ImageMetadata)
+	assert.Equal(t, "0.26.0", vm.Status.ImageMetadata.Components["vector"])
+
+	// Metadata is kept once the runner pod is gone
+	status, _, _ = imageCompatibility(vm, nil)
+	assert.Equal(t, metav1.ConditionTrue, status)
+
+	status, reason, message := imageCompatibility(vm, podWithMessage(`{"kernelVersion": "5.10.0", "platform": {"architecture": "arm64"}}`))
+	assert.Equal(t, metav1.ConditionFalse, status)
+	assert.Equal(t, "Incompatible", reason)
+	assert.Contains(t, message, "guest kernel 5.10.0 is too old")
+
+	// Old kernels are fine without virtio-mem, but the platform must match the declared one
+	vm.Status.MemoryProvider = lo.ToPtr(vmv1.MemoryProviderDIMMSlots)
+	vm.Spec.Guest.RootDisk.Platform = &vmv1.RootDiskPlatform{Architecture: "amd64", OS: "linux"}
+	status, _, message = imageCompatibility(vm, nil)
+	assert.Equal(t, metav1.ConditionFalse, status)
+	assert.Equal(t, "Root disk image is incompatible with the VM: image is built for linux/arm64, but .spec.guest.rootDisk.platform is linux/amd64", message)
+
+	status, reason, _ = imageCompatibility(vm, podWithMessage(`not json`))
+	assert.Equal(t, metav1.ConditionUnknown, status)
+	assert.Equal(t, "InvalidMetadata", reason)
+}
+
+func TestExecAPIRequiresAuthToken(t *testing.T) {
+	// Without a token, the runners would refuse every request, so the API must not start
+	server := ExecAPIServer{Addr: "127.0.0.1:0"}
+	err := server.Start(context.Background())
+	assert.ErrorContains(t, err, "requires a QMP auth token")
+
+	// ... but a disabled API doesn't need one
+	server = ExecAPIServer{}
+	assert.NoError(t, server.Start(context.Background()))
+}
+
+func runnerPodForMutations(vm *vmv1.VirtualMachine, extraContainers ...string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	pod.Name = vm.Name + "-runner"
+	pod.Namespace = vm.Namespace
+	pod.Labels = map[string]string{vmv1.VirtualMachineNameLabel: vm.Name}
+	pod.Spec.InitContainers = []corev1.Container{{Name: rootDiskInitContainerName}}
+	pod.Spec.Containers = []corev1.Container{{Name: "neonvm-runner"}}
+	for _, name := range extraContainers {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+	}
+	return pod
+}
+
+func TestRunnerPodMutations(t *testing.T) {
+	vm := defaultVm()
+	vm.Spec.ExtraContainers = []corev1.Container{{Name: "log-shipper"}}
+	vm.Spec.PodResources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+
+	pod := runnerPodForMutations(vm, "log-shipper")
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("4Gi")}
+	assert.Empty(t, runnerPodMutations(vm, pod))
+
+	// Containers are checked against the VM's spec, not anything on the pod
+	pod.Annotations = map[string]string{"vm.neon.tech/extra-containers": "istio-proxy"}
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "istio-proxy"})
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: "istio-init"})
+	pod.Spec.Containers[0].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("5Gi")
+	assert.Equal(t, []string{
+		`unexpected init container "istio-init"`,
+		"runner container limit memory changed from 4Gi to 5Gi",
+		`unexpected container "istio-proxy"`,
+	}, runnerPodMutations(vm, pod))
+}
+
+func TestRunnerPodValidator(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, vmv1.AddToScheme(scheme))
+
+	vm := defaultVm()
+	vm.Spec.ExtraContainers = []corev1.Container{{Name: "log-shipper"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(vm).Build()
+	validator := NewRunnerPodValidator(scheme, c)
+
+	handle := func(pod *corev1.Pod) admission.Response {
+		raw, err := json.Marshal(pod)
+		require.NoError(t, err)
+		return validator.Handle(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{
+				Namespace: pod.Namespace,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			},
+		})
+	}
+
+	assert.True(t, handle(runnerPodForMutations(vm, "log-shipper")).Allowed)
+
+	resp := handle(runnerPodForMutations(vm, "log-shipper", "istio-proxy"))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, `unexpected container "istio-proxy"`)
+
+	// A pod can't allow its own sidecar by claiming it in an annotation
+	pod := runnerPodForMutations(vm, "istio-proxy")
+	pod.Annotations = map[string]string{"vm.neon.tech/extra-containers": "istio-proxy"}
+	assert.False(t, handle(pod).Allowed)
+
+	// Pods that aren't runner pods are ignored
+	pod = runnerPodForMutations(vm, "istio-proxy")
+	pod.Labels = nil
+	assert.True(t, handle(pod).Allowed)
 }
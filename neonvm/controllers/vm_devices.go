@@ -0,0 +1,73 @@
+package controllers
+
+// Host devices passed through to the guest
+//
+// Devices in .spec.guest.devices are allocated to the runner pod by the node's device plugin, so
+// the runner container requests one of the device's extended resource for each. The device plugin
+// mounts the devices' /dev/vfio group files into the container, and tells the runner which devices
+// it got through environment variables - see neonvm/runner/devices.go.
+//
+// PCI devices that aren't already bound to vfio-pci are rebound by the runner, so it gets the
+// host's sysfs mounted read-write. The container's own /sys is read-only.
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/samber/lo"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	hostSysfsVolume = "host-sysfs"
+	// hostSysfsPath is where the host's /sys is mounted in the runner container. It must match
+	// neonvm/runner/devices.go.
+	hostSysfsPath = "/host/sys"
+)
+
+func extractDevicesJSON(spec vmv1.VirtualMachineSpec) string {
+	devicesJSON, err := json.Marshal(spec.DeviceResources())
+	if err != nil {
+		panic(fmt.Errorf("error marshalling JSON: %w", err))
+	}
+
+	return string(devicesJSON)
+}
+
+// addDevices requests the VM's devices for the runner container, and mounts the host's sysfs so
+// that the runner can bind them to vfio-pci
+func addDevices(pod *corev1.Pod, vm *vmv1.VirtualMachine) {
+	resources := vm.Spec.DeviceResources()
+	if len(resources) == 0 {
+		return
+	}
+
+	runner := &pod.Spec.Containers[0]
+	if runner.Resources.Requests == nil {
+		runner.Resources.Requests = corev1.ResourceList{}
+	}
+	// Extended resources can't be overcommitted, so the request must be equal to the limit.
+	for name, count := range resources {
+		q := *resource.NewQuantity(count, resource.DecimalSI)
+		runner.Resources.Requests[name] = q
+		runner.Resources.Limits[name] = q
+	}
+
+	runner.VolumeMounts = append(runner.VolumeMounts, corev1.VolumeMount{
+		Name:      hostSysfsVolume,
+		MountPath: hostSysfsPath,
+	})
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: hostSysfsVolume,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: "/sys",
+				Type: lo.ToPtr(corev1.HostPathDirectory),
+			},
+		},
+	})
+}
@@ -0,0 +1,109 @@
+package controllers
+
+// Disk I/O limits
+//
+// The root disk and disks in .spec.disks may have .ioLimits, which neonvm-runner applies with
+// QEMU's block throttling options when the VM starts. Changes while the VM is running are applied
+// over QMP, with block_set_io_throttle. The limits currently in effect are tracked in
+// .status.diskIOLimits, so that we only talk to QEMU when they change.
+//
+// Hotpluggable disks are attached without limits (see vm_hotplug_disks.go), so their limits are
+// applied here once they're attached.
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// attachedDiskIOLimits returns the I/O limits from the VM's spec for the disks that are currently
+// attached, by drive name
+func attachedDiskIOLimits(vm *vmv1.VirtualMachine) map[string]vmv1.DiskIOLimits {
+	limits := vm.Spec.DiskIOLimits()
+	for _, disk := range vm.Spec.Disks {
+		if disk.Hotpluggable && !slices.Contains(vm.Status.HotplugDisks, disk.Name) {
+			delete(limits, disk.Name)
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return limits
+}
+
+// syncDiskIOLimits applies changes to the I/O limits of the VM's disks
+func (r *VMReconciler) syncDiskIOLimits(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	log := log.FromContext(ctx)
+	addr := QmpAddr(vm, r.Config.QMPAuthToken)
+
+	wanted := attachedDiskIOLimits(vm)
+
+	// Applied limits for disks that aren't attached anymore go away with the disk.
+	for drive := range vm.Status.DiskIOLimits {
+		if _, ok := wanted[drive]; !ok && !diskAttached(vm, drive) {
+			delete(vm.Status.DiskIOLimits, drive)
+		}
+	}
+
+	drives := make(map[string]struct{})
+	for drive := range wanted {
+		drives[drive] = struct{}{}
+	}
+	for drive := range vm.Status.DiskIOLimits {
+		drives[drive] = struct{}{}
+	}
+
+	for drive := range drives {
+		limits, ok := wanted[drive]
+		current, applied := vm.Status.DiskIOLimits[drive]
+		if ok == applied && equality.Semantic.DeepEqual(limits, current) {
+			continue
+		}
+
+		hotpluggable := slices.ContainsFunc(vm.Spec.Disks, func(d vmv1.Disk) bool {
+			return d.Name == drive && d.Hotpluggable
+		})
+		err := traceQMP(ctx, vm, "set disk I/O limits", func() error {
+			return QmpSetDiskIOLimits(addr, drive, hotpluggable, limits.Throttle())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set I/O limits of disk %q: %w", drive, err)
+		}
+
+		if ok {
+			if vm.Status.DiskIOLimits == nil {
+				vm.Status.DiskIOLimits = make(map[string]vmv1.DiskIOLimits)
+			}
+			vm.Status.DiskIOLimits[drive] = *limits.DeepCopy()
+		} else {
+			delete(vm.Status.DiskIOLimits, drive)
+		}
+		if len(vm.Status.DiskIOLimits) == 0 {
+			vm.Status.DiskIOLimits = nil
+		}
+		log.Info("Updated disk I/O limits", "VirtualMachine", vm.Name, "disk", drive, "limits", limits.Throttle())
+		r.Recorder.Event(vm, "Normal", "DiskIOLimitsUpdated",
+			fmt.Sprintf("Updated I/O limits of disk %s in VirtualMachine %s", drive, vm.Name))
+	}
+
+	return nil
+}
+
+// diskAttached returns whether the drive is currently attached to the VM
+func diskAttached(vm *vmv1.VirtualMachine, drive string) bool {
+	if drive == vmv1.RootDiskDriveName {
+		return true
+	}
+	for _, disk := range vm.Spec.Disks {
+		if disk.Name == drive {
+			return !disk.Hotpluggable || slices.Contains(vm.Status.HotplugDisks, drive)
+		}
+	}
+	// Removed from the spec, so it's either detached or being detached.
+	return false
+}
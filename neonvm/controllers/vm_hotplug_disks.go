@@ -0,0 +1,172 @@
+package controllers
+
+// Hotpluggable disks
+//
+// Disks in .spec.disks with .hotpluggable set may be added and removed while the VM is running.
+// Those in the spec when the runner pod is created are attached at boot, like any other disk. After
+// that, we attach and detach them over QMP, tracking the disks that are currently attached in
+// .status.hotplugDisks:
+//
+//   - To attach a disk, we ask neonvm-runner to create its image (see neonvm/runner/hotplug_disks.go),
+//     then add it to QEMU with blockdev-add and device_add. The guest mounts it from a udev rule.
+//   - To detach a disk, we remove its device with device_del, which the guest must acknowledge.
+//     Once it's gone, we remove the block node and ask neonvm-runner to delete the image.
+//
+// Only emptyDisk disks can be hotpluggable: other kinds need volumes in the runner pod, which can't
+// be added after it's created.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// hotpluggableDiskNames returns the names of the VM's hotpluggable disks
+func hotpluggableDiskNames(vm *vmv1.VirtualMachine) []string {
+	var names []string
+	for _, disk := range vm.Spec.Disks {
+		if disk.Hotpluggable {
+			names = append(names, disk.Name)
+		}
+	}
+	return names
+}
+
+// syncHotplugDisks attaches and detaches the VM's hotpluggable disks to match its spec
+func (r *VMReconciler) syncHotplugDisks(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	log := log.FromContext(ctx)
+	addr := QmpAddr(vm, r.Config.QMPAuthToken)
+
+	for _, disk := range vm.Spec.Disks {
+		if !disk.Hotpluggable || slices.Contains(vm.Status.HotplugDisks, disk.Name) {
+			continue
+		}
+
+		image, err := createRunnerHotplugDisk(ctx, vm, disk)
+		if err != nil {
+			return fmt.Errorf("failed to create image for disk %q: %w", disk.Name, err)
+		} else if image == nil {
+			// Still being created. We'll check again on the next reconcile.
+			continue
+		}
+		err = traceQMP(ctx, vm, "attach disk", func() error {
+			return QmpAttachDisk(addr, disk.Name, image.Path, disk.EmptyDisk.Discard, r.Config.QEMUDiskCacheSettings)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to attach disk %q: %w", disk.Name, err)
+		}
+
+		vm.Status.HotplugDisks = append(vm.Status.HotplugDisks, disk.Name)
+		log.Info("Attached hotpluggable disk", "VirtualMachine", vm.Name, "disk", disk.Name)
+		r.Recorder.Event(vm, "Normal", "DiskAttached",
+			fmt.Sprintf("Attached disk %s to VirtualMachine %s", disk.Name, vm.Name))
+	}
+
+	wanted := hotpluggableDiskNames(vm)
+	for _, name := range slices.Clone(vm.Status.HotplugDisks) {
+		if slices.Contains(wanted, name) {
+			continue
+		}
+
+		var done bool
+		err := traceQMP(ctx, vm, "detach disk", func() (err error) {
+			done, err = QmpDetachDisk(addr, name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to detach disk %q: %w", name, err)
+		} else if !done {
+			// Waiting for the guest to release the device.
+			continue
+		}
+		if err := deleteRunnerHotplugDisk(ctx, vm, name); err != nil {
+			return fmt.Errorf("failed to delete image for disk %q: %w", name, err)
+		}
+
+		vm.Status.HotplugDisks = slices.DeleteFunc(vm.Status.HotplugDisks, func(n string) bool { return n == name })
+		log.Info("Detached hotpluggable disk", "VirtualMachine", vm.Name, "disk", name)
+		r.Recorder.Event(vm, "Normal", "DiskDetached",
+			fmt.Sprintf("Detached disk %s from VirtualMachine %s", name, vm.Name))
+	}
+
+	return nil
+}
+
+// createRunnerHotplugDisk asks the VM's runner to create the image for the disk, returning nil if
+// it's still being created
+func createRunnerHotplugDisk(ctx context.Context, vm *vmv1.VirtualMachine, disk vmv1.Disk) (*api.HotplugDiskImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/hotplug_disks/%s", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)), disk.Name)
+
+	data, err := json.Marshal(api.HotplugDisk{
+		Size:      disk.EmptyDisk.Size,
+		MountPath: disk.MountPath,
+		Discard:   disk.EmptyDisk.Discard,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case 202:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var image api.HotplugDiskImage
+	if err := json.NewDecoder(resp.Body).Decode(&image); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	return &image, nil
+}
+
+// deleteRunnerHotplugDisk asks the VM's runner to remove the image for the disk, after it's been
+// detached
+func deleteRunnerHotplugDisk(ctx context.Context, vm *vmv1.VirtualMachine, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/hotplug_disks/%s", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)), name)
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
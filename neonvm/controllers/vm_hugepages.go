@@ -0,0 +1,38 @@
+package controllers
+
+// Hugepage-backed guest memory
+//
+// With .spec.guest.memoryBacking hugepages, neonvm-runner allocates the guest's memory from
+// hugepages (see neonvm/runner/hugepages.go), so the runner container requests them as the
+// "hugepages-<size>" resource. Hugepages can't be overcommitted or resized while the pod is
+// running, so the request covers the guest's maximum memory, and the request must be equal to the
+// limit.
+//
+// Scheduling onto a node with enough free hugepages is handled by the scheduler plugin - see
+// pkg/plugin/topology.go.
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// addHugepages adds the hugepages that back the guest's memory to the runner container's
+// resources, if it's backed by hugepages
+func addHugepages(pod *corev1.Pod, vm *vmv1.VirtualMachine) {
+	name := vm.Spec.Guest.HugepagesResourceName()
+	if name == "" {
+		return
+	}
+
+	maxMemory := vm.Spec.Guest.MemorySlotSize.Value() * int64(vm.Spec.Guest.MemorySlots.Max)
+	q := *resource.NewQuantity(maxMemory, resource.BinarySI)
+
+	runner := &pod.Spec.Containers[0]
+	if runner.Resources.Requests == nil {
+		runner.Resources.Requests = corev1.ResourceList{}
+	}
+	runner.Resources.Requests[name] = q
+	runner.Resources.Limits[name] = q
+}
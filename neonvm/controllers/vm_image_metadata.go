@@ -0,0 +1,128 @@
+package controllers
+
+// Root disk image metadata
+//
+// vm-builder embeds metadata about each image it builds (see vmv1.VMImageMetadata) at
+// vmv1.VMImageMetadataPath. We can't read it from the registry, so the runner pod's init container,
+// which runs the root disk image anyway, copies it to its termination message. Once the init
+// container has finished, we store it in .status.imageMetadata, and check it against the VM for
+// the ImageCompatible condition.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// rootDiskInitContainerName is the name of the runner pod's init container that runs the root disk
+// image
+const rootDiskInitContainerName = "init"
+
+// virtio-mem needs the auto-movable memory online policy (see -memhp-auto-movable-ratio), which was
+// added in Linux 5.15.
+const (
+	virtioMemMinKernelMajor = 5
+	virtioMemMinKernelMinor = 15
+)
+
+// imageMetadataReportCommand is the shell command for the init container that reports the image's
+// metadata, if it has any.
+func imageMetadataReportCommand() string {
+	return fmt.Sprintf("if [ -f %[1]s ]; then cat %[1]s > /dev/termination-log; fi", vmv1.VMImageMetadataPath)
+}
+
+// imageMetadataFromPod returns the root disk image metadata reported by the runner pod's init
+// container, and whether it has reported yet. The metadata is nil if the image doesn't have any.
+func imageMetadataFromPod(pod *corev1.Pod) (_ *vmv1.VMImageMetadata, reported bool, _ error) {
+	for _, s := range pod.Status.InitContainerStatuses {
+		if s.Name != rootDiskInitContainerName {
+			continue
+		}
+		if s.State.Terminated == nil || s.State.Terminated.ExitCode != 0 {
+			return nil, false, nil
+		}
+
+		message := strings.TrimSpace(s.State.Terminated.Message)
+		if message == "" {
+			return nil, true, nil
+		}
+		var metadata vmv1.VMImageMetadata
+		if err := json.Unmarshal([]byte(message), &metadata); err != nil {
+			return nil, false, err
+		}
+		return &metadata, true, nil
+	}
+	return nil, false, nil
+}
+
+// imageCompatibility updates .status.imageMetadata from the runner pod, if it's reported it, and
+// returns the ImageCompatible condition's status, reason, and message.
+func imageCompatibility(vm *vmv1.VirtualMachine, pod *corev1.Pod) (metav1.ConditionStatus, string, string) {
+	reported := false
+	if pod != nil {
+		metadata, ok, err := imageMetadataFromPod(pod)
+		if err != nil {
+			return metav1.ConditionUnknown, "InvalidMetadata",
+				fmt.Sprintf("Failed to parse root disk image metadata: %s", err)
+		}
+		if ok {
+			reported = true
+			vm.Status.ImageMetadata = metadata
+		}
+	}
+
+	metadata := vm.Status.ImageMetadata
+	switch {
+	case metadata == nil && reported:
+		return metav1.ConditionUnknown, "NoMetadata", "Root disk image has no metadata"
+	case metadata == nil:
+		return metav1.ConditionUnknown, "NotReported", "Runner pod has not reported the root disk image's metadata"
+	}
+
+	if problems := imageIncompatibilities(vm, metadata); len(problems) != 0 {
+		return metav1.ConditionFalse, "Incompatible",
+			fmt.Sprintf("Root disk image is incompatible with the VM: %s", strings.Join(problems, "; "))
+	}
+	return metav1.ConditionTrue, "Compatible", "Root disk image is compatible with the VM"
+}
+
+// imageIncompatibilities returns the ways in which the root disk image is incompatible with the VM,
+// according to its metadata
+func imageIncompatibilities(vm *vmv1.VirtualMachine, metadata *vmv1.VMImageMetadata) []string {
+	var problems []string
+
+	if metadata.KernelVersion != "" && vm.Status.MemoryProvider != nil && *vm.Status.MemoryProvider == vmv1.MemoryProviderVirtioMem {
+		major, minor, err := vmv1.ParseKernelVersion(metadata.KernelVersion)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if major < virtioMemMinKernelMajor || (major == virtioMemMinKernelMajor && minor < virtioMemMinKernelMinor) {
+			problems = append(problems, fmt.Sprintf(
+				"guest kernel %s is too old for memory provider %s, which needs at least %d.%d",
+				metadata.KernelVersion, vmv1.MemoryProviderVirtioMem, virtioMemMinKernelMajor, virtioMemMinKernelMinor,
+			))
+		}
+	}
+
+	if declared := vm.Spec.Guest.RootDisk.Platform; declared != nil && metadata.Platform != nil {
+		platformString := func(p *vmv1.RootDiskPlatform) string {
+			osName := p.OS
+			if osName == "" {
+				osName = "linux"
+			}
+			return fmt.Sprintf("%s/%s", osName, p.Architecture)
+		}
+		if platformString(declared) != platformString(metadata.Platform) {
+			problems = append(problems, fmt.Sprintf(
+				"image is built for %s, but .spec.guest.rootDisk.platform is %s",
+				platformString(metadata.Platform), platformString(declared),
+			))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/neonvm/controllers/fakerunner"
+)
+
+// startFakeRunner starts a fakerunner.Runner for the VM, and points the VM at it
+func startFakeRunner(t *testing.T, vm *vmv1.VirtualMachine) *fakerunner.Runner {
+	runner, err := fakerunner.Start(fakerunner.ConfigForVM(vm))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = runner.Close() })
+
+	runner.ApplyTo(vm)
+	return runner
+}
+
+func TestFakeRunnerCPUHotplug(t *testing.T) {
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+
+	plugged, empty, err := QmpGetCpus(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.Len(t, plugged, 1)
+	assert.Len(t, empty, 1)
+
+	require.NoError(t, QmpPlugCpu(QmpAddr(vm, "")))
+	assert.Equal(t, 2, runner.CPUs())
+	assert.EqualError(t, QmpPlugCpu(QmpAddr(vm, "")), "no empty slots for CPU hotplug")
+
+	require.NoError(t, QmpUnplugCpu(QmpAddr(vm, "")))
+	assert.Equal(t, 1, runner.CPUs())
+	assert.EqualError(t, QmpUnplugCpu(QmpAddr(vm, "")), "there are no unpluggable CPUs")
+
+	runner.FailCommand("device_add", "CPU hotplug failed")
+	assert.Error(t, QmpPlugCpu(QmpAddr(vm, "")))
+	assert.Equal(t, 1, runner.CPUs())
+}
+
+func TestFakeRunnerRunnerCgroup(t *testing.T) {
+	params := newTestParams(t)
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+
+	cgroup, err := getRunnerCgroup(params.ctx, vm)
+	require.NoError(t, err)
+	assert.Equal(t, vm.Spec.Guest.CPUs.Min, cgroup.VCPUs)
+
+	require.NoError(t, setRunnerCgroup(params.ctx, vm, vmv1.MilliCPU(1500)))
+	assert.Equal(t, vmv1.MilliCPU(1500), runner.CgroupCPU())
+}
+
+func TestFakeRunnerMemoryHotplug(t *testing.T) {
+	params := newTestParams(t)
+	vm := defaultVm()
+	vm.Spec.Guest.MemorySlots.Max = 4
+	runner := startFakeRunner(t, vm)
+	slotSize := vm.Spec.Guest.MemorySlotSize.Value()
+	params.mockRecorder.On("Event", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// Plug 2 DIMMs, on top of the 1 slot at boot
+	count, err := QmpSetMemorySlots(params.ctx, vm, 2, params.mockRecorder, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 3*slotSize, runner.MemorySize())
+
+	size, err := QmpGetMemorySize(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.True(t, size.Equal(*resource.NewQuantity(3*slotSize, resource.BinarySI)), size.String())
+
+	devices, err := QmpQueryMemoryDevices(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.Len(t, devices, 2)
+
+	// ... and back down to 1
+	count, err = QmpSetMemorySlots(params.ctx, vm, 1, params.mockRecorder, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 2*slotSize, runner.MemorySize())
+}
+
+func TestFakeRunnerVirtioMem(t *testing.T) {
+	vm := defaultVm()
+	vm.Status.MemoryProvider = lo.ToPtr(vmv1.MemoryProviderVirtioMem)
+	runner := startFakeRunner(t, vm)
+	slotSize := vm.Spec.Guest.MemorySlotSize.Value()
+
+	previous, err := QmpSetVirtioMem(vm, slotSize, "")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), previous)
+	assert.Equal(t, 2*slotSize, runner.MemorySize())
+
+	previous, err = QmpSetVirtioMem(vm, slotSize, "")
+	require.NoError(t, err)
+	assert.Equal(t, slotSize, previous)
+	// no-op updates should only query the size
+	assert.Equal(t, 1, lo.Count(runner.Commands(), "qom-set"))
+}
+
+func TestFakeRunnerRunState(t *testing.T) {
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+
+	require.NoError(t, QmpStop(QmpAddr(vm, "")))
+	running, err := QmpQueryStatus(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.False(t, running)
+
+	require.NoError(t, QmpCont(QmpAddr(vm, "")))
+	assert.True(t, runner.Running())
+}
+
+func TestFakeRunnerMigration(t *testing.T) {
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+
+	info, err := QmpGetMigrationInfo(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "", info.Status)
+
+	runner.SetMigrationStatus("active")
+	require.NoError(t, QmpCancelMigration(QmpAddr(vm, "")))
+	info, err = QmpGetMigrationInfo(QmpAddr(vm, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "cancelled", info.Status)
+}
+
+// TestFakeRunnerReconcileScaling runs the full reconcile loop for a running VM against the fake
+// runner, checking that the controller scales it to .spec.guest.cpus.use and .memorySlots.use
+func TestFakeRunnerReconcileScaling(t *testing.T) {
+	params := newTestParams(t)
+	origVM := defaultVm()
+	origVM.Finalizers = append(origVM.Finalizers, virtualmachineFinalizer)
+	origVM.Status.Phase = vmv1.VmPending
+	runner := startFakeRunner(t, origVM)
+	origVM = params.initVM(origVM)
+
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(origVM)}
+	params.mockRecorder.On("Event", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	// Create the runner pod, and mark it as running on the fake runner's address
+	_, err := params.r.Reconcile(params.ctx, req)
+	require.NoError(t, err)
+
+	var pod corev1.Pod
+	podKey := client.ObjectKey{Namespace: origVM.Namespace, Name: params.getVM().Status.PodName}
+	require.NoError(t, params.client.Get(params.ctx, podKey, &pod))
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.PodIP = "127.0.0.1"
+	require.NoError(t, params.client.Update(params.ctx, &pod))
+
+	// CPUs are plugged one per reconcile, so scaling takes a few rounds
+	for i := 0; i < 10; i++ {
+		_, err = params.r.Reconcile(params.ctx, req)
+		require.NoError(t, err)
+
+		if vm := params.getVM(); vm.Status.Phase == vmv1.VmRunning && vm.Status.CPUs != nil &&
+			*vm.Status.CPUs == vm.Spec.Guest.CPUs.Use {
+			break
+		}
+	}
+
+	vm := params.getVM()
+	assert.Equal(t, vmv1.VmRunning, vm.Status.Phase)
+	assert.Equal(t, 2, runner.CPUs())
+	assert.Equal(t, vm.Spec.Guest.CPUs.Use, runner.CgroupCPU())
+	assert.Equal(t, int64(vm.Spec.Guest.MemorySlots.Use)*vm.Spec.Guest.MemorySlotSize.Value(), runner.MemorySize())
+	if assert.NotNil(t, vm.Status.CPUs) {
+		assert.Equal(t, vm.Spec.Guest.CPUs.Use, *vm.Status.CPUs)
+	}
+}
+
+func TestFakeRunnerSnapshotProgress(t *testing.T) {
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+	addr := QmpAddr(vm, "")
+	drives := []string{"rootdisk", "data"}
+
+	require.NoError(t, QmpStartSnapshot(addr, "snap", "/snapshots/snap", drives, true))
+	done, err := QmpSnapshotProgress(addr, "snap", drives, true)
+	require.NoError(t, err)
+	assert.False(t, done)
+
+	// The drive backups finishing isn't enough while memory is still being saved, and the jobs
+	// must not be dismissed yet.
+	runner.ConcludeJob(snapshotJobID("snap", "rootdisk"), "")
+	runner.ConcludeJob(snapshotJobID("snap", "data"), "")
+	done, err = QmpSnapshotProgress(addr, "snap", drives, true)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Len(t, runner.Jobs(), 2)
+
+	runner.SetMigrationStatus("completed")
+	done, err = QmpSnapshotProgress(addr, "snap", drives, true)
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Empty(t, runner.Jobs())
+
+	// Polling again, e.g. because the snapshot's status wasn't updated, still reports success
+	done, err = QmpSnapshotProgress(addr, "snap", drives, true)
+	require.NoError(t, err)
+	assert.True(t, done)
+}
+
+func TestFakeRunnerSnapshotFailure(t *testing.T) {
+	vm := defaultVm()
+	runner := startFakeRunner(t, vm)
+	addr := QmpAddr(vm, "")
+	drives := []string{"rootdisk"}
+
+	require.NoError(t, QmpStartSnapshot(addr, "snap", "/snapshots/snap", drives, false))
+	runner.ConcludeJob(snapshotJobID("snap", "rootdisk"), "No space left on device")
+
+	// Failed jobs are kept, so that the failure is reported every time
+	for i := 0; i < 2; i++ {
+		_, err := QmpSnapshotProgress(addr, "snap", drives, false)
+		assert.ErrorContains(t, err, "No space left on device")
+	}
+	assert.Len(t, runner.Jobs(), 1)
+}
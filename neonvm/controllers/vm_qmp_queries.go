@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/digitalocean/go-qemu/qmp"
 	"github.com/go-logr/logr"
+	"github.com/samber/lo"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -39,6 +41,25 @@ type QmpMemorySize struct {
 	} `json:"return"`
 }
 
+type QmpStatus struct {
+	Return struct {
+		Running bool   `json:"running"`
+		Status  string `json:"status"`
+	} `json:"return"`
+}
+
+type QmpJobs struct {
+	Return []QmpJob `json:"return"`
+}
+
+type QmpJob struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	// Error is set iff the job has concluded unsuccessfully
+	Error *string `json:"error,omitempty"`
+}
+
 type QmpCpuSlot struct {
 	Core int32  `json:"core"`
 	QOM  string `json:"qom"`
@@ -96,31 +117,48 @@ type MigrationInfo struct {
 	} `json:"compression"`
 }
 
-func QmpAddr(vm *vmv1.VirtualMachine) (ip string, port int32) {
-	return vm.Status.PodIP, vm.Spec.QMP
+// QmpEndpoint is the address of a runner pod's QMP server, and the token to authenticate to
+// neonvm-runner's QMP proxy with. See qmp_auth.go for more.
+type QmpEndpoint struct {
+	IP   string
+	Port int32
+	// AuthToken is empty if authentication is disabled.
+	AuthToken string
+}
+
+// QmpAddr returns the QMP endpoint of the VM's current runner pod
+func QmpAddr(vm *vmv1.VirtualMachine, authToken string) QmpEndpoint {
+	return QmpEndpoint{IP: vm.Status.PodIP, Port: vm.Spec.QMP, AuthToken: authToken}
 }
 
-func QmpConnect(ip string, port int32) (*qmp.SocketMonitor, error) {
-	mon, err := qmp.NewSocketMonitor("tcp", fmt.Sprintf("%s:%d", ip, port), 2*time.Second)
+func QmpConnect(addr QmpEndpoint) (_ *qmp.SocketMonitor, err error) {
+	start := time.Now()
+	defer func() { observeQMPCommand(qmpConnectCommand, time.Since(start), err) }()
+
+	mon, err := qmp.NewSocketMonitor("tcp", net.JoinHostPort(addr.IP, fmt.Sprint(addr.Port)), 2*time.Second)
 	if err != nil {
 		return nil, err
 	}
 	if err := mon.Connect(); err != nil {
 		return nil, err
 	}
+	if err := qmpAuthenticate(mon, addr.AuthToken); err != nil {
+		mon.Disconnect() //nolint:errcheck // already returning an error
+		return nil, err
+	}
 
 	return mon, nil
 }
 
-func QmpGetCpus(ip string, port int32) ([]QmpCpuSlot, []QmpCpuSlot, error) {
-	mon, err := QmpConnect(ip, port)
+func QmpGetCpus(addr QmpEndpoint) ([]QmpCpuSlot, []QmpCpuSlot, error) {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "query-hotpluggable-cpus"}`)
-	raw, err := mon.Run(qmpcmd)
+	raw, err := qmpRun(mon, qmpcmd)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -143,8 +181,8 @@ func QmpGetCpus(ip string, port int32) ([]QmpCpuSlot, []QmpCpuSlot, error) {
 	return plugged, empty, nil
 }
 
-func QmpPlugCpu(ip string, port int32) error {
-	_, empty, err := QmpGetCpus(ip, port)
+func QmpPlugCpu(addr QmpEndpoint) error {
+	_, empty, err := QmpGetCpus(addr)
 	if err != nil {
 		return err
 	}
@@ -152,7 +190,7 @@ func QmpPlugCpu(ip string, port int32) error {
 		return errors.New("no empty slots for CPU hotplug")
 	}
 
-	mon, err := QmpConnect(ip, port)
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
@@ -171,7 +209,7 @@ func QmpPlugCpu(ip string, port int32) error {
 		}
 	}`, slot.Core, slot.Type, slot.Core))
 
-	_, err = mon.Run(qmpcmd)
+	_, err = qmpRun(mon, qmpcmd)
 	if err != nil {
 		return err
 	}
@@ -179,8 +217,8 @@ func QmpPlugCpu(ip string, port int32) error {
 	return nil
 }
 
-func QmpUnplugCpu(ip string, port int32) error {
-	plugged, _, err := QmpGetCpus(ip, port)
+func QmpUnplugCpu(addr QmpEndpoint) error {
+	plugged, _, err := QmpGetCpus(addr)
 	if err != nil {
 		return err
 	}
@@ -198,14 +236,14 @@ func QmpUnplugCpu(ip string, port int32) error {
 		return errors.New("there are no unpluggable CPUs")
 	}
 
-	mon, err := QmpConnect(ip, port)
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	cmd := []byte(fmt.Sprintf(`{"execute": "device_del", "arguments": {"id": %q}}`, plugged[slot].QOM))
-	_, err = mon.Run(cmd)
+	_, err = qmpRun(mon, cmd)
 	if err != nil {
 		return err
 	}
@@ -215,12 +253,14 @@ func QmpUnplugCpu(ip string, port int32) error {
 	return nil
 }
 
-func QmpSyncCpuToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration) error {
-	plugged, _, err := QmpGetCpus(QmpAddr(vm))
+func QmpSyncCpuToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration, authToken string) error {
+	targetAddr := QmpEndpoint{IP: migration.Status.TargetPodIP, Port: vm.Spec.QMP, AuthToken: authToken}
+
+	plugged, _, err := QmpGetCpus(QmpAddr(vm, authToken))
 	if err != nil {
 		return err
 	}
-	pluggedInTarget, _, err := QmpGetCpus(migration.Status.TargetPodIP, vm.Spec.QMP)
+	pluggedInTarget, _, err := QmpGetCpus(targetAddr)
 	if err != nil {
 		return err
 	}
@@ -229,7 +269,7 @@ func QmpSyncCpuToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineM
 		return nil
 	}
 
-	target, err := QmpConnect(migration.Status.TargetPodIP, vm.Spec.QMP)
+	target, err := QmpConnect(targetAddr)
 	if err != nil {
 		return err
 	}
@@ -255,7 +295,7 @@ searchForEmpty:
 				"thread-id": 0
 			}
 		}`, slot.Core, slot.Type, slot.Core))
-		_, err = target.Run(qmpcmd)
+		_, err = qmpRun(target, qmpcmd)
 		if err != nil {
 			return err
 		}
@@ -264,8 +304,8 @@ searchForEmpty:
 	return nil
 }
 
-func QmpQueryMemoryDevices(ip string, port int32) ([]QmpMemoryDevice, error) {
-	mon, err := QmpConnect(ip, port)
+func QmpQueryMemoryDevices(addr QmpEndpoint) ([]QmpMemoryDevice, error) {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +316,7 @@ func QmpQueryMemoryDevices(ip string, port int32) ([]QmpMemoryDevice, error) {
 
 func QmpMonQueryMemoryDevices(mon *qmp.SocketMonitor) ([]QmpMemoryDevice, error) {
 	cmd := []byte(`{"execute": "query-memory-devices"}`)
-	raw, err := mon.Run(cmd)
+	raw, err := qmpRun(mon, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -302,7 +342,7 @@ func MemslotIdxFromName(name string) (int, error) {
 
 func QmpQueryMemoryBackendIds(mon *qmp.SocketMonitor) (map[int]struct{}, error) {
 	cmd := []byte(`{"execute": "qom-list", "arguments": {"path": "/objects"}}`)
-	raw, err := mon.Run(cmd)
+	raw, err := qmpRun(mon, cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -316,7 +356,8 @@ func QmpQueryMemoryBackendIds(mon *qmp.SocketMonitor) (map[int]struct{}, error)
 		if o.Name == "pc.ram" { // Non-hotplugged memory
 			continue
 		}
-		if o.Type != "child<memory-backend-ram>" {
+		// nb: hugepage-backed memory slots are memfd backends
+		if o.Type != "child<memory-backend-ram>" && o.Type != "child<memory-backend-memfd>" {
 			continue
 		}
 
@@ -337,7 +378,7 @@ type QMPRunner interface {
 //
 // If the new target size is equal to the previous one, this function does nothing but query the
 // target.
-func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64) (previous int64, _ error) {
+func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64, authToken string) (previous int64, _ error) {
 	// Note: The virtio-mem device only exists when max mem != min mem.
 	// So if min == max, we should just short-cut, skip the queries, and say it's all good.
 	// Refer to the instantiation in neonvm-runner for more.
@@ -353,7 +394,7 @@ func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64) (previo
 		return 0, nil
 	}
 
-	mon, err := QmpConnect(QmpAddr(vm))
+	mon, err := QmpConnect(QmpAddr(vm, authToken))
 	if err != nil {
 		return 0, err
 	}
@@ -362,7 +403,7 @@ func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64) (previo
 	// First, fetch current desired virtio-mem size. If it's the same as targetVirtioMemSize, then
 	// we can report that it was already the same.
 	cmd := []byte(`{"execute": "qom-get", "arguments": {"path": "vm0", "property": "requested-size"}}`)
-	raw, err := mon.Run(cmd)
+	raw, err := qmpRun(mon, cmd)
 	if err != nil {
 		return 0, err
 	}
@@ -384,7 +425,7 @@ func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64) (previo
 		`{"execute": "qom-set", "arguments": {"path": "vm0", "property": "requested-size", "value": %d}}`,
 		targetVirtioMemSize,
 	))
-	_, err = mon.Run(cmd)
+	_, err = qmpRun(mon, cmd)
 	if err != nil {
 		return 0, err
 	}
@@ -394,17 +435,33 @@ func QmpSetVirtioMem(vm *vmv1.VirtualMachine, targetVirtioMemSize int64) (previo
 
 // QmpAddMemoryBackend adds a single memory slot to the VM with the given size.
 //
+// If hugepageSize is not nil, the memory slot is allocated from hugepages of that size, matching
+// the guest's boot memory. See neonvm/runner/hugepages.go.
+//
 // The memory slot does nothing until a corresponding "device" is added to the VM for the same memory slot.
 // See QmpAddMemoryDevice for more.
 // When unplugging, QmpDelMemoryDevice must be called before QmpDelMemoryBackend.
-func QmpAddMemoryBackend(mon QMPRunner, idx int, sizeBytes int64) error {
-	cmd := []byte(fmt.Sprintf(
-		`{"execute": "object-add",
-		  "arguments": {"id": "memslot%d",
-						"size": %d,
-						"qom-type": "memory-backend-ram"}}`, idx, sizeBytes,
-	))
-	_, err := mon.Run(cmd)
+func QmpAddMemoryBackend(mon QMPRunner, idx int, sizeBytes int64, hugepageSize *resource.Quantity) error {
+	var cmd []byte
+	if hugepageSize == nil {
+		cmd = []byte(fmt.Sprintf(
+			`{"execute": "object-add",
+			  "arguments": {"id": "memslot%d",
+							"size": %d,
+							"qom-type": "memory-backend-ram"}}`, idx, sizeBytes,
+		))
+	} else {
+		cmd = []byte(fmt.Sprintf(
+			`{"execute": "object-add",
+			  "arguments": {"id": "memslot%d",
+							"size": %d,
+							"qom-type": "memory-backend-memfd",
+							"hugetlb": true,
+							"hugetlbsize": %d,
+							"prealloc": true}}`, idx, sizeBytes, hugepageSize.Value(),
+		))
+	}
+	_, err := qmpRun(mon, cmd)
 	return err
 }
 
@@ -413,7 +470,7 @@ func QmpDelMemoryBackend(mon *qmp.SocketMonitor, idx int) error {
 		`{"execute": "object-del",
 		  "arguments": {"id": "memslot%d"}}`, idx,
 	))
-	_, err := mon.Run(cmd)
+	_, err := qmpRun(mon, cmd)
 	return err
 }
 
@@ -424,7 +481,7 @@ func QmpAddMemoryDevice(mon *qmp.SocketMonitor, idx int) error {
 						"driver": "pc-dimm",
 						"memdev": "memslot%d"}}`, idx, idx,
 	))
-	_, err := mon.Run(cmd)
+	_, err := qmpRun(mon, cmd)
 	return err
 }
 
@@ -433,7 +490,7 @@ func QmpDelMemoryDevice(mon *qmp.SocketMonitor, idx int) error {
 		`{"execute": "device_del",
 		  "arguments": {"id": "dimm%d"}}`, idx,
 	))
-	_, err := mon.Run(cmd)
+	_, err := qmpRun(mon, cmd)
 	return err
 }
 
@@ -536,7 +593,7 @@ func (r *QmpMemorySetter) AddBackends() {
 			break
 		}
 
-		err := QmpAddMemoryBackend(r.mon, idx, r.vm.Spec.Guest.MemorySlotSize.Value())
+		err := QmpAddMemoryBackend(r.mon, idx, r.vm.Spec.Guest.MemorySlotSize.Value(), r.vm.Spec.Guest.HugepageSizeOrNil())
 		if err != nil {
 			r.errs = append(r.errs, err)
 			r.recorder.Event(r.vm, "Warning", "ScaleUp",
@@ -697,10 +754,11 @@ func QmpSetMemorySlots(
 	vm *vmv1.VirtualMachine,
 	targetCnt int,
 	recorder record.EventRecorder,
+	authToken string,
 ) (int, error) {
 	log := log.FromContext(ctx)
 
-	mon, err := QmpConnect(QmpAddr(vm))
+	mon, err := QmpConnect(QmpAddr(vm, authToken))
 	if err != nil {
 		return -1, err
 	}
@@ -729,17 +787,19 @@ func QmpSetMemorySlots(
 	return setter.run()
 }
 
-func QmpSyncMemoryToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration) error {
-	memoryDevices, err := QmpQueryMemoryDevices(QmpAddr(vm))
+func QmpSyncMemoryToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration, authToken string) error {
+	targetAddr := QmpEndpoint{IP: migration.Status.TargetPodIP, Port: vm.Spec.QMP, AuthToken: authToken}
+
+	memoryDevices, err := QmpQueryMemoryDevices(QmpAddr(vm, authToken))
 	if err != nil {
 		return err
 	}
-	memoryDevicesInTarget, err := QmpQueryMemoryDevices(migration.Status.TargetPodIP, vm.Spec.QMP)
+	memoryDevicesInTarget, err := QmpQueryMemoryDevices(targetAddr)
 	if err != nil {
 		return err
 	}
 
-	target, err := QmpConnect(migration.Status.TargetPodIP, vm.Spec.QMP)
+	target, err := QmpConnect(targetAddr)
 	if err != nil {
 		return err
 	}
@@ -763,7 +823,7 @@ func QmpSyncMemoryToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachi
 		if err != nil {
 			return err
 		}
-		err = QmpAddMemoryBackend(target, memdevIdx, m.Data.Size)
+		err = QmpAddMemoryBackend(target, memdevIdx, m.Data.Size, vm.Spec.Guest.HugepageSizeOrNil())
 		if err != nil {
 			return err
 		}
@@ -779,15 +839,15 @@ func QmpSyncMemoryToTarget(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachi
 	return nil
 }
 
-func QmpGetMemorySize(ip string, port int32) (*resource.Quantity, error) {
-	mon, err := QmpConnect(ip, port)
+func QmpGetMemorySize(addr QmpEndpoint) (*resource.Quantity, error) {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return nil, err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "query-memory-size-summary"}`)
-	raw, err := mon.Run(qmpcmd)
+	raw, err := qmpRun(mon, qmpcmd)
 	if err != nil {
 		return nil, err
 	}
@@ -800,133 +860,85 @@ func QmpGetMemorySize(ip string, port int32) (*resource.Quantity, error) {
 	return resource.NewQuantity(result.Return.BaseMemory+result.Return.PluggedMemory, resource.BinarySI), nil
 }
 
-func QmpStartMigration(virtualmachine *vmv1.VirtualMachine, virtualmachinemigration *vmv1.VirtualMachineMigration) error {
+func QmpStartMigration(virtualmachine *vmv1.VirtualMachine, virtualmachinemigration *vmv1.VirtualMachineMigration, params migrationParams, authToken string) error {
 
 	// QMP port
 	port := virtualmachine.Spec.QMP
 
 	// connect to source runner QMP
 	s_ip := virtualmachinemigration.Status.SourcePodIP
-	smon, err := qmp.NewSocketMonitor("tcp", fmt.Sprintf("%s:%d", s_ip, port), 2*time.Second)
+	smon, err := QmpConnect(QmpEndpoint{IP: s_ip, Port: port, AuthToken: authToken})
 	if err != nil {
 		return err
 	}
-	if err := smon.Connect(); err != nil {
-		return err
-	}
 	defer smon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	// connect to target runner QMP
 	t_ip := virtualmachinemigration.Status.TargetPodIP
-	tmon, err := qmp.NewSocketMonitor("tcp", fmt.Sprintf("%s:%d", t_ip, port), 2*time.Second)
+	tmon, err := QmpConnect(QmpEndpoint{IP: t_ip, Port: port, AuthToken: authToken})
 	if err != nil {
 		return err
 	}
-	if err := tmon.Connect(); err != nil {
-		return err
-	}
 	defer tmon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
-	cache := resource.MustParse("256Mi")
-	var qmpcmd []byte
-	// setup migration on source runner
-	qmpcmd = []byte(fmt.Sprintf(`{
-		"execute": "migrate-set-capabilities",
-		"arguments":
-		    {
-			"capabilities": [
-			    {"capability": "postcopy-ram",  "state": %t},
-			    {"capability": "xbzrle",        "state": true},
-			    {"capability": "compress",      "state": true},
-			    {"capability": "auto-converge", "state": %t},
-			    {"capability": "zero-blocks",   "state": true}
-			]
-		    }
-		}`, virtualmachinemigration.Spec.AllowPostCopy, virtualmachinemigration.Spec.AutoConverge))
-	_, err = smon.Run(qmpcmd)
+	// setup migration on source and target runners
+	qmpcmds, err := params.qmpCommands()
 	if err != nil {
 		return err
 	}
-	qmpcmd = []byte(fmt.Sprintf(`{
-		"execute": "migrate-set-parameters",
-		"arguments":
-		    {
-			"xbzrle-cache-size":   %d,
-			"max-bandwidth":       %d,
-			"multifd-compression": "zstd"
-		    }
-		}`, cache.Value(), virtualmachinemigration.Spec.MaxBandwidth.Value()))
-	_, err = smon.Run(qmpcmd)
-	if err != nil {
-		return err
+	for _, qmpcmd := range qmpcmds {
+		if _, err := qmpRun(smon, qmpcmd); err != nil {
+			return err
+		}
+		if _, err := qmpRun(tmon, qmpcmd); err != nil {
+			return err
+		}
 	}
 
-	// setup migration on target runner
-	qmpcmd = []byte(fmt.Sprintf(`{
-		"execute": "migrate-set-capabilities",
+	// trigger migration
+	qmpcmd := []byte(fmt.Sprintf(`{
+		"execute": "migrate",
 		"arguments":
 		    {
-			"capabilities": [
-			    {"capability": "postcopy-ram",  "state": %t},
-			    {"capability": "xbzrle",        "state": true},
-			    {"capability": "compress",      "state": true},
-			    {"capability": "auto-converge", "state": %t},
-			    {"capability": "zero-blocks",   "state": true}
-			]
+			"uri": "tcp:%s",
+			"inc": %t,
+			"blk": %t
 		    }
-		}`, virtualmachinemigration.Spec.AllowPostCopy, virtualmachinemigration.Spec.AutoConverge))
-	_, err = tmon.Run(qmpcmd)
+		}`, net.JoinHostPort(t_ip, fmt.Sprint(vmv1.MigrationPort)), virtualmachinemigration.Spec.Incremental, !virtualmachinemigration.Spec.Incremental))
+	_, err = qmpRun(smon, qmpcmd)
 	if err != nil {
 		return err
 	}
-	qmpcmd = []byte(fmt.Sprintf(`{
-		"execute": "migrate-set-parameters",
-		"arguments":
-		    {
-			"xbzrle-cache-size":   %d,
-			"max-bandwidth":       %d,
-			"multifd-compression": "zstd"
-		    }
-		}`, cache.Value(), virtualmachinemigration.Spec.MaxBandwidth.Value()))
-	_, err = tmon.Run(qmpcmd)
+
+	return nil
+}
+
+// QmpStartPostCopy switches an ongoing migration to post-copy. It must be run on the source.
+func QmpStartPostCopy(addr QmpEndpoint) error {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
-	// trigger migration
-	qmpcmd = []byte(fmt.Sprintf(`{
-		"execute": "migrate",
-		"arguments":
-		    {
-			"uri": "tcp:%s:%d",
-			"inc": %t,
-			"blk": %t
-		    }
-		}`, t_ip, vmv1.MigrationPort, virtualmachinemigration.Spec.Incremental, !virtualmachinemigration.Spec.Incremental))
-	_, err = smon.Run(qmpcmd)
+	qmpcmd := []byte(`{"execute": "migrate-start-postcopy"}`)
+	_, err = qmpRun(mon, qmpcmd)
 	if err != nil {
 		return err
 	}
-	if virtualmachinemigration.Spec.AllowPostCopy {
-		qmpcmd = []byte(`{"execute": "migrate-start-postcopy"}`)
-		_, err = smon.Run(qmpcmd)
-		if err != nil {
-			return err
-		}
-	}
 
 	return nil
 }
 
-func QmpGetMigrationInfo(ip string, port int32) (*MigrationInfo, error) {
-	mon, err := QmpConnect(ip, port)
+func QmpGetMigrationInfo(addr QmpEndpoint) (*MigrationInfo, error) {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return nil, err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "query-migrate"}`)
-	raw, err := mon.Run(qmpcmd)
+	raw, err := qmpRun(mon, qmpcmd)
 	if err != nil {
 		return nil, err
 	}
@@ -939,34 +951,462 @@ func QmpGetMigrationInfo(ip string, port int32) (*MigrationInfo, error) {
 	return &result.Return, nil
 }
 
-func QmpCancelMigration(ip string, port int32) error {
-	mon, err := QmpConnect(ip, port)
+func QmpCancelMigration(addr QmpEndpoint) error {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "migrate_cancel"}`)
-	_, err = mon.Run(qmpcmd)
+	_, err = qmpRun(mon, qmpcmd)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type QmpBlockNodes struct {
+	Return []struct {
+		NodeName string `json:"node-name"`
+	} `json:"return"`
+}
+
+// qmpHasBlockNode returns whether QEMU has a block node with the given name
+func qmpHasBlockNode(mon *qmp.SocketMonitor, nodeName string) (bool, error) {
+	raw, err := qmpRun(mon, []byte(`{"execute": "query-named-block-nodes", "arguments": {"flat": true}}`))
+	if err != nil {
+		return false, err
+	}
+	var result QmpBlockNodes
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+	for _, node := range result.Return {
+		if node.NodeName == nodeName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// qmpHasPeripheral returns whether QEMU has a device with the given ID
+func qmpHasPeripheral(mon *qmp.SocketMonitor, id string) (bool, error) {
+	raw, err := qmpRun(mon, []byte(`{"execute": "qom-list", "arguments": {"path": "/machine/peripheral"}}`))
+	if err != nil {
+		return false, err
+	}
+	var result QmpObjects
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+	for _, obj := range result.Return {
+		if obj.Name == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// QmpAttachDisk attaches the qcow2 image at path to the VM as the hotpluggable disk with the given
+// name, using cacheSettings (in the format of '-drive') like the disks attached at boot.
+//
+// Each step is skipped if it's already been done, so it's safe to retry after a partial failure.
+func QmpAttachDisk(addr QmpEndpoint, name string, path string, discard bool, cacheSettings string) error {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	cache := blockdevCacheOptionsFromSettings(cacheSettings)
+
+	hasNode, err := qmpHasBlockNode(mon, name)
+	if err != nil {
+		return fmt.Errorf("error querying block nodes: %w", err)
+	}
+	if !hasNode {
+		discardMode := "ignore"
+		if discard {
+			discardMode = "unmap"
+		}
+		args, err := json.Marshal(map[string]any{
+			"driver":    "qcow2",
+			"node-name": name,
+			"discard":   discardMode,
+			"cache": map[string]bool{
+				"direct":   cache.direct,
+				"no-flush": cache.noFlush,
+			},
+			"file": map[string]any{
+				"driver":   "file",
+				"filename": path,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling json: %w", err)
+		}
+		if _, err := qmpRun(mon, []byte(fmt.Sprintf(`{"execute": "blockdev-add", "arguments": %s}`, args))); err != nil {
+			return fmt.Errorf("error adding block node: %w", err)
+		}
+	}
+
+	deviceID := vmv1.HotplugDiskDeviceID(name)
+	hasDevice, err := qmpHasPeripheral(mon, deviceID)
+	if err != nil {
+		return fmt.Errorf("error querying devices: %w", err)
+	}
+	if !hasDevice {
+		args, err := json.Marshal(map[string]any{
+			"driver":      "virtio-blk-pci",
+			"id":          deviceID,
+			"drive":       name,
+			"serial":      vmv1.DiskSerial(name),
+			"write-cache": lo.Ternary(cache.writeCache, "on", "off"),
+		})
+		if err != nil {
+			return fmt.Errorf("error marshaling json: %w", err)
+		}
+		if _, err := qmpRun(mon, []byte(fmt.Sprintf(`{"execute": "device_add", "arguments": %s}`, args))); err != nil {
+			return fmt.Errorf("error adding device: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// QmpDetachDisk starts detaching the hotpluggable disk with the given name, returning whether it's
+// been fully removed.
+//
+// Removing the device requires the guest's cooperation, so it's done asynchronously. Once the
+// device is gone, its block node is removed too (if it was added by QmpAttachDisk - disks attached
+// at boot are removed along with the device).
+func QmpDetachDisk(addr QmpEndpoint, name string) (done bool, _ error) {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return false, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	deviceID := vmv1.HotplugDiskDeviceID(name)
+	hasDevice, err := qmpHasPeripheral(mon, deviceID)
+	if err != nil {
+		return false, fmt.Errorf("error querying devices: %w", err)
+	}
+	if hasDevice {
+		qmpcmd := []byte(fmt.Sprintf(`{"execute": "device_del", "arguments": {"id": %q}}`, deviceID))
+		if _, err := qmpRun(mon, qmpcmd); err != nil && !strings.Contains(err.Error(), "in the process of unplug") {
+			return false, fmt.Errorf("error removing device: %w", err)
+		}
+		return false, nil
+	}
+
+	hasNode, err := qmpHasBlockNode(mon, name)
+	if err != nil {
+		return false, fmt.Errorf("error querying block nodes: %w", err)
+	}
+	if hasNode {
+		qmpcmd := []byte(fmt.Sprintf(`{"execute": "blockdev-del", "arguments": {"node-name": %q}}`, name))
+		if _, err := qmpRun(mon, qmpcmd); err != nil {
+			return false, fmt.Errorf("error removing block node: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// blockdevCacheOptions are the equivalent of a '-drive' cache mode, for blockdev-add and device_add
+type blockdevCacheOptions struct {
+	direct     bool
+	noFlush    bool
+	writeCache bool
+}
+
+// blockdevCacheOptionsFromSettings converts the cache settings used with '-drive' for the disks
+// attached at boot (see ReconcilerConfig.QEMUDiskCacheSettings) into the options for hotplugged
+// disks. Other settings are ignored.
+func blockdevCacheOptionsFromSettings(settings string) blockdevCacheOptions {
+	// QEMU's default is cache=writeback
+	opts := blockdevCacheOptions{direct: false, noFlush: false, writeCache: true}
+	for _, setting := range strings.Split(settings, ",") {
+		key, value, _ := strings.Cut(setting, "=")
+		switch key {
+		case "cache":
+			switch value {
+			case "none":
+				opts = blockdevCacheOptions{direct: true, noFlush: false, writeCache: true}
+			case "writethrough":
+				opts = blockdevCacheOptions{direct: false, noFlush: false, writeCache: false}
+			case "directsync":
+				opts = blockdevCacheOptions{direct: true, noFlush: false, writeCache: false}
+			case "unsafe":
+				opts = blockdevCacheOptions{direct: false, noFlush: true, writeCache: true}
+			}
+		case "cache.direct":
+			opts.direct = value == "on"
+		case "cache.no-flush":
+			opts.noFlush = value == "on"
+		}
+	}
+	return opts
+}
+
+// QmpSetDiskIOLimits sets the I/O limits of one of the VM's disks, identified either by the name of
+// its drive or, for hotpluggable disks, the ID of its device. A zero throttle removes the limits.
+func QmpSetDiskIOLimits(addr QmpEndpoint, drive string, hotpluggable bool, t vmv1.DiskIOThrottle) error {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
+	args := map[string]any{
+		"iops":    t.IOPSTotal,
+		"iops_rd": t.IOPSRead,
+		"iops_wr": t.IOPSWrite,
+		"bps":     t.BPSTotal,
+		"bps_rd":  t.BPSRead,
+		"bps_wr":  t.BPSWrite,
+	}
+	// Hotplugged disks' drives don't have a name, only their device has an ID.
+	if hotpluggable {
+		args["id"] = vmv1.HotplugDiskDeviceID(drive)
+	} else {
+		args["device"] = drive
+	}
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("error marshaling json: %w", err)
+	}
+	if _, err := qmpRun(mon, []byte(fmt.Sprintf(`{"execute": "block_set_io_throttle", "arguments": %s}`, argsJSON))); err != nil {
+		return fmt.Errorf("error setting I/O throttle: %w", err)
+	}
 	return nil
 }
 
-func QmpQuit(ip string, port int32) error {
-	mon, err := QmpConnect(ip, port)
+func QmpQuit(addr QmpEndpoint) error {
+	mon, err := QmpConnect(addr)
 	if err != nil {
 		return err
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "quit"}`)
-	_, err = mon.Run(qmpcmd)
+	_, err = qmpRun(mon, qmpcmd)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// QmpStop pauses execution of the guest's CPUs
+func QmpStop(addr QmpEndpoint) error {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	qmpcmd := []byte(`{"execute": "stop"}`)
+	_, err = qmpRun(mon, qmpcmd)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// QmpCont resumes execution of the guest's CPUs after QmpStop
+func QmpCont(addr QmpEndpoint) error {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	qmpcmd := []byte(`{"execute": "cont"}`)
+	_, err = qmpRun(mon, qmpcmd)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// QmpQueryStatus returns whether the guest's CPUs are currently running
+func QmpQueryStatus(addr QmpEndpoint) (running bool, _ error) {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return false, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	qmpcmd := []byte(`{"execute": "query-status"}`)
+	raw, err := qmpRun(mon, qmpcmd)
+	if err != nil {
+		return false, err
+	}
+
+	var result QmpStatus
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return false, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	return result.Return.Running, nil
+}
+
+// QmpStartSnapshot begins saving the listed drives as qcow2 images in dir, along with the guest's
+// memory and device state iff includeMemory is true.
+//
+// The drive backups are started in a single transaction, so that they're consistent with each
+// other. If includeMemory is true, the guest is paused first, and remains paused until QmpCont is
+// called - this is what makes the saved memory consistent with the disks.
+//
+// Progress can be checked with QmpSnapshotProgress.
+func QmpStartSnapshot(addr QmpEndpoint, name string, dir string, drives []string, includeMemory bool) error {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	if includeMemory {
+		if _, err := qmpRun(mon, []byte(`{"execute": "stop"}`)); err != nil {
+			return fmt.Errorf("error pausing guest: %w", err)
+		}
+	}
+
+	type driveBackup struct {
+		JobID       string `json:"job-id"`
+		Device      string `json:"device"`
+		Target      string `json:"target"`
+		Sync        string `json:"sync"`
+		Format      string `json:"format"`
+		AutoDismiss bool   `json:"auto-dismiss"`
+	}
+	type action struct {
+		Type string      `json:"type"`
+		Data driveBackup `json:"data"`
+	}
+	var actions []action
+	for _, drive := range drives {
+		actions = append(actions, action{
+			Type: "drive-backup",
+			Data: driveBackup{
+				JobID:  snapshotJobID(name, drive),
+				Device: drive,
+				Target: fmt.Sprintf("%s/%s.qcow2", dir, drive),
+				Sync:   "full",
+				Format: "qcow2",
+				// Keep the job around after it finishes, so that we can see whether it failed.
+				AutoDismiss: false,
+			},
+		})
+	}
+	args, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("error marshaling json: %w", err)
+	}
+	qmpcmd := []byte(fmt.Sprintf(`{"execute": "transaction", "arguments": %s}`, args))
+	if _, err := qmpRun(mon, qmpcmd); err != nil {
+		return fmt.Errorf("error starting drive backups: %w", err)
+	}
+
+	if includeMemory {
+		// Saving memory is done with a migration to a local file. After it completes, the guest
+		// stays paused.
+		qmpcmd = []byte(fmt.Sprintf(`{
+			"execute": "migrate",
+			"arguments": {"uri": "exec:gzip -c > %s/memory.gz"}
+		}`, dir))
+		if _, err := qmpRun(mon, qmpcmd); err != nil {
+			return fmt.Errorf("error starting memory save: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// QmpSnapshotProgress returns whether the snapshot started by QmpStartSnapshot has completed,
+// returning error if any part of it failed.
+//
+// The drive backup jobs are only dismissed once the whole snapshot has completed successfully, so a
+// missing job means that it was dismissed by an earlier call (e.g. if updating the snapshot's status
+// afterwards failed), and is treated as completed. Failed jobs are left for later calls to report.
+func QmpSnapshotProgress(addr QmpEndpoint, name string, drives []string, includeMemory bool) (done bool, _ error) {
+	mon, err := QmpConnect(addr)
+	if err != nil {
+		return false, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	raw, err := qmpRun(mon, []byte(`{"execute": "query-jobs"}`))
+	if err != nil {
+		return false, err
+	}
+	var jobs QmpJobs
+	if err := json.Unmarshal(raw, &jobs); err != nil {
+		return false, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+	jobsByID := make(map[string]QmpJob)
+	for _, j := range jobs.Return {
+		jobsByID[j.ID] = j
+	}
+
+	var failures []error
+	var toDismiss []string
+	done = true
+	for _, drive := range drives {
+		id := snapshotJobID(name, drive)
+		job, ok := jobsByID[id]
+		if !ok {
+			continue // already dismissed
+		}
+		if job.Error != nil {
+			failures = append(failures, fmt.Errorf("backup of drive %q failed: %s", drive, *job.Error))
+		}
+		if job.Status == "concluded" {
+			toDismiss = append(toDismiss, id)
+		} else {
+			done = false
+		}
+	}
+	if len(failures) != 0 {
+		return false, errors.Join(failures...)
+	}
+
+	if includeMemory {
+		raw, err := qmpRun(mon, []byte(`{"execute": "query-migrate"}`))
+		if err != nil {
+			return false, err
+		}
+		var result QmpMigrationInfo
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return false, fmt.Errorf("error unmarshaling json: %w", err)
+		}
+		switch result.Return.Status {
+		case "completed":
+		case "failed", "cancelled":
+			return false, fmt.Errorf("saving memory %s", result.Return.Status)
+		default:
+			done = false
+		}
+	}
+
+	if done {
+		for _, id := range toDismiss {
+			qmpcmd := []byte(fmt.Sprintf(`{"execute": "job-dismiss", "arguments": {"id": %q}}`, id))
+			if _, err := qmpRun(mon, qmpcmd); err != nil {
+				return false, fmt.Errorf("error dismissing backup job %q: %w", id, err)
+			}
+		}
+	}
+
+	return done, nil
+}
+
+func snapshotJobID(snapshotName string, drive string) string {
+	return fmt.Sprintf("snapshot-%s-%s", snapshotName, drive)
+}
@@ -4,6 +4,8 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	"k8s.io/apimachinery/pkg/api/resource"
+
 	"github.com/neondatabase/autoscaling/neonvm/controllers"
 )
 
@@ -50,7 +52,23 @@ var _ = Describe("VM QMP interaction", func() {
 				 "arguments": {"id": "memslot1",
 						"size": 100,
 						"qom-type": "memory-backend-ram"}}`, `{}`)
-			err := controllers.QmpAddMemoryBackend(qmp, 1, 100)
+			err := controllers.QmpAddMemoryBackend(qmp, 1, 100, nil)
+			Expect(err).To(Not(HaveOccurred()))
+		})
+
+		It("should add hugepage-backed memslots", func() {
+			qmp := newQMPMock()
+			defer qmp.done()
+			qmp.expect(`
+				{"execute": "object-add",
+				 "arguments": {"id": "memslot2",
+						"size": 1073741824,
+						"qom-type": "memory-backend-memfd",
+						"hugetlb": true,
+						"hugetlbsize": 2097152,
+						"prealloc": true}}`, `{}`)
+			hugepageSize := resource.MustParse("2Mi")
+			err := controllers.QmpAddMemoryBackend(qmp, 2, 1073741824, &hugepageSize)
 			Expect(err).To(Not(HaveOccurred()))
 		})
 	})
@@ -0,0 +1,118 @@
+package controllers
+
+// Synchronizing the guest's clock after it was resumed or live migrated
+//
+// The guest's clock doesn't advance while it's paused, so after it's resumed (from runPolicy
+// Paused, after saving its memory for a snapshot, or after restoring memory from a snapshot) or
+// live migrated, we record that its clock needs to be synchronized in .status.timeSync. Once the
+// VM is running, we ask neonvm-runner to synchronize it via '/time_sync' (see
+// neonvm/runner/time_sync.go), and record when that succeeded.
+//
+// VMs without a way to synchronize their clock (see VirtualMachineSpec.TimeSyncMethod) are left
+// alone.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	// timeSyncDelay is how long to wait after the guest was resumed or migrated before
+	// synchronizing its clock, so that chronyd in the guest has measured its new offset.
+	timeSyncDelay = 5 * time.Second
+	// timeSyncGiveUpAfter is how long after the guest was resumed or migrated to stop retrying
+	// failed attempts to synchronize its clock.
+	timeSyncGiveUpAfter = time.Minute
+)
+
+// markTimeSyncPending records that the guest's clock needs to be synchronized, if it can be
+func markTimeSyncPending(vm *vmv1.VirtualMachine, now time.Time) {
+	if vm.Spec.TimeSyncMethod() == nil {
+		return
+	}
+	if vm.Status.TimeSync == nil {
+		vm.Status.TimeSync = &vmv1.TimeSyncStatus{PendingSince: nil, LastSyncTime: nil, Method: ""}
+	}
+	vm.Status.TimeSync.PendingSince = &metav1.Time{Time: now}
+}
+
+// syncGuestTimeIfPending synchronizes the guest's clock, if it's pending and the VM has been
+// running for long enough since it was resumed or migrated.
+//
+// Failures are retried on later reconciles, until timeSyncGiveUpAfter has passed.
+func (r *VMReconciler) syncGuestTimeIfPending(ctx context.Context, vm *vmv1.VirtualMachine) {
+	log := log.FromContext(ctx)
+
+	status := vm.Status.TimeSync
+	if status == nil || status.PendingSince == nil {
+		return
+	}
+	pendingFor := time.Since(status.PendingSince.Time)
+	if pendingFor < timeSyncDelay {
+		return
+	}
+
+	result, err := syncRunnerTime(ctx, vm)
+	if err != nil {
+		if pendingFor < timeSyncGiveUpAfter {
+			log.Error(err, "Failed to synchronize guest clock, will retry", "VirtualMachine", vm.Name)
+			return
+		}
+		log.Error(err, "Failed to synchronize guest clock, giving up", "VirtualMachine", vm.Name)
+		r.Recorder.Event(vm, corev1.EventTypeWarning, "TimeSyncFailed",
+			fmt.Sprintf("Failed to synchronize the clock of VM %s after %s: %s", vm.Name, timeSyncGiveUpAfter, err))
+		status.PendingSince = nil
+		return
+	}
+
+	status.PendingSince = nil
+	status.LastSyncTime = &metav1.Time{Time: time.Now()}
+	status.Method = result.Method
+	r.Recorder.Event(vm, corev1.EventTypeNormal, "TimeSynced",
+		fmt.Sprintf("Synchronized the clock of VM %s with %s", vm.Name, result.Method))
+}
+
+func syncRunnerTime(ctx context.Context, vm *vmv1.VirtualMachine) (*api.TimeSyncResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/time_sync", net.JoinHostPort(vm.Status.PodIP, fmt.Sprint(vm.Spec.RunnerPort)))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var result api.TimeSyncResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,142 @@
+package controllers
+
+// Disks provisioned from CSI VolumeSnapshots
+//
+// For each disk with a volumeSnapshot source, the controller creates a block-mode
+// PersistentVolumeClaim with the snapshot as its data source, owned by the VM. The runner pod isn't
+// created until every snapshot is ready to use, because a PVC can't be populated from a snapshot
+// that's still being taken.
+//
+// We don't wait for the PVCs to be bound: with a WaitForFirstConsumer storage class, they won't be
+// bound until the runner pod has been scheduled.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/samber/lo"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+const volumeSnapshotAPIGroup = "snapshot.storage.k8s.io"
+
+var volumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   volumeSnapshotAPIGroup,
+	Version: "v1",
+	Kind:    "VolumeSnapshot",
+}
+
+// volumeSnapshotDiskDevicePath returns the path of the block device for the disk in the runner
+// container
+func volumeSnapshotDiskDevicePath(disk vmv1.Disk) string {
+	return fmt.Sprintf("/vm/disks/%s", disk.Name)
+}
+
+// volumeSnapshotDiskPVCName returns the name of the PVC provisioned for the disk
+func volumeSnapshotDiskPVCName(vm *vmv1.VirtualMachine, disk vmv1.Disk) string {
+	return fmt.Sprintf("%s-%s", vm.Name, disk.Name)
+}
+
+// ensureVolumeSnapshotDisks creates the PVCs for the VM's volumeSnapshot disks, if they don't
+// already exist, and returns whether they're all ready to be used by the runner pod.
+func (r *VMReconciler) ensureVolumeSnapshotDisks(ctx context.Context, vm *vmv1.VirtualMachine) (ready bool, _ error) {
+	log := log.FromContext(ctx)
+
+	ready = true
+	for _, disk := range vm.Spec.Disks {
+		if disk.VolumeSnapshot == nil {
+			continue
+		}
+
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+		err := r.Get(ctx, types.NamespacedName{Name: disk.VolumeSnapshot.SnapshotName, Namespace: vm.Namespace}, snapshot)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				// Maybe the snapshot is just about to be created; keep waiting.
+				r.Recorder.AnnotatedEventf(vm, map[string]string{errclass.EventAnnotation: string(errclass.UserError)},
+					"Warning", "VolumeSnapshotNotFound", "VolumeSnapshot %s for disk %s not found",
+					disk.VolumeSnapshot.SnapshotName, disk.Name)
+				ready = false
+				continue
+			}
+			return false, fmt.Errorf("failed to get VolumeSnapshot %s for disk %s: %w", disk.VolumeSnapshot.SnapshotName, disk.Name, err)
+		}
+
+		snapshotReady, _, err := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		if err != nil {
+			return false, fmt.Errorf("failed to read status of VolumeSnapshot %s: %w", disk.VolumeSnapshot.SnapshotName, err)
+		}
+		if !snapshotReady {
+			log.Info("Waiting for VolumeSnapshot to be ready", "disk", disk.Name, "VolumeSnapshot.Name", disk.VolumeSnapshot.SnapshotName)
+			ready = false
+			continue
+		}
+
+		pvcName := volumeSnapshotDiskPVCName(vm, disk)
+		pvc := &corev1.PersistentVolumeClaim{}
+		err = r.Get(ctx, types.NamespacedName{Name: pvcName, Namespace: vm.Namespace}, pvc)
+		if err == nil {
+			if pvc.Status.Phase == corev1.ClaimLost {
+				return false, errclass.Errorf(errclass.UserError, "PersistentVolumeClaim %s for disk %s is lost", pvcName, disk.Name)
+			}
+			continue
+		} else if !apierrors.IsNotFound(err) {
+			return false, fmt.Errorf("failed to get PersistentVolumeClaim %s for disk %s: %w", pvcName, disk.Name, err)
+		}
+
+		pvc, err = r.pvcForVolumeSnapshotDisk(vm, disk)
+		if err != nil {
+			return false, err
+		}
+		log.Info("Creating PersistentVolumeClaim for disk", "disk", disk.Name, "PersistentVolumeClaim.Name", pvcName)
+		if err := r.Create(ctx, pvc); err != nil {
+			return false, fmt.Errorf("failed to create PersistentVolumeClaim %s for disk %s: %w", pvcName, disk.Name, err)
+		}
+	}
+
+	return ready, nil
+}
+
+func (r *VMReconciler) pvcForVolumeSnapshotDisk(vm *vmv1.VirtualMachine, disk vmv1.Disk) (*corev1.PersistentVolumeClaim, error) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        volumeSnapshotDiskPVCName(vm, disk),
+			Namespace:   vm.Namespace,
+			Labels:      labelsForGeneratedResource(vm),
+			Annotations: annotationsForGeneratedResource(vm),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			VolumeMode:  lo.ToPtr(corev1.PersistentVolumeBlock),
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: disk.VolumeSnapshot.Size,
+				},
+			},
+			StorageClassName: disk.VolumeSnapshot.StorageClassName,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: lo.ToPtr(volumeSnapshotAPIGroup),
+				Kind:     volumeSnapshotGVK.Kind,
+				Name:     disk.VolumeSnapshot.SnapshotName,
+			},
+		},
+	}
+
+	// Set the ownerRef for the PVC, so that it's deleted with the VM
+	if err := ctrl.SetControllerReference(vm, pvc, r.Scheme); err != nil {
+		return nil, err
+	}
+	return pvc, nil
+}
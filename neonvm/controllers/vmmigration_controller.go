@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"slices"
 	"time"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -60,6 +61,9 @@ type VirtualMachineMigrationReconciler struct {
 	Config   *ReconcilerConfig
 
 	Metrics ReconcilerMetrics
+
+	// expensiveOps is set by SetupWithManager
+	expensiveOps *expensiveOperationLimiter `exhaustruct:"optional"`
 }
 
 // The following markers are used to generate the rules permissions (RBAC) on config/rbac using controller-gen
@@ -101,6 +105,8 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 		return ctrl.Result{}, err
 	}
 
+	defer r.Metrics.reconcilePhaseTimer(ctx, "virtualmachinemigration", string(migration.Status.Phase))()
+
 	// examine DeletionTimestamp to determine if object is under deletion
 	if migration.ObjectMeta.DeletionTimestamp.IsZero() {
 		// The object is not being deleted, so if it does not have our finalizer,
@@ -165,6 +171,7 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 		// return err and try reconcile again
 		return ctrl.Result{}, err
 	}
+	setVMSpanAttributes(ctx, vm)
 
 	// Set owner for VM migration object
 	if !metav1.IsControlledBy(migration, vm) {
@@ -200,6 +207,57 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 	switch migration.Status.Phase {
 
 	case "":
+		// VolumeSnapshot disks are backed by ReadWriteOnce block volumes, which can't be attached
+		// to the source and target pods at the same time.
+		if slices.ContainsFunc(vm.Spec.Disks, func(d vmv1.Disk) bool { return d.VolumeSnapshot != nil }) {
+			message := fmt.Sprintf("VM (%s) has volumeSnapshot disks, which can't be migrated", vm.Name)
+			r.Recorder.Event(migration, "Warning", "Failed", message)
+			meta.SetStatusCondition(&migration.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: message})
+			migration.Status.Phase = vmv1.VmmFailed
+			return r.updateMigrationStatus(ctx, migration)
+		}
+		// The source's encrypted memory can't be read by QEMU to send to the target.
+		if vm.Spec.ConfidentialCompute() {
+			message := fmt.Sprintf("VM (%s) has confidential compute enabled, which can't be migrated", vm.Name)
+			r.Recorder.Event(migration, "Warning", "Failed", message)
+			meta.SetStatusCondition(&migration.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: message})
+			migration.Status.Phase = vmv1.VmmFailed
+			return r.updateMigrationStatus(ctx, migration)
+		}
+		// QEMU can't migrate the state of VFIO devices, and the target would need its own anyways.
+		if len(vm.Spec.Guest.Devices) != 0 {
+			message := fmt.Sprintf("VM (%s) has passthrough devices, which can't be migrated", vm.Name)
+			r.Recorder.Event(migration, "Warning", "Failed", message)
+			meta.SetStatusCondition(&migration.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: message})
+			migration.Status.Phase = vmv1.VmmFailed
+			return r.updateMigrationStatus(ctx, migration)
+		}
+		// Hotplugged devices are placed differently from those given on QEMU's command line, so
+		// the target's devices wouldn't match the source's.
+		if slices.ContainsFunc(vm.Spec.Disks, func(d vmv1.Disk) bool { return d.Hotpluggable }) {
+			message := fmt.Sprintf("VM (%s) has hotpluggable disks, which can't be migrated", vm.Name)
+			r.Recorder.Event(migration, "Warning", "Failed", message)
+			meta.SetStatusCondition(&migration.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: message})
+			migration.Status.Phase = vmv1.VmmFailed
+			return r.updateMigrationStatus(ctx, migration)
+		}
+
 		// need change VM status asap to prevent autoscler change CPU/RAM in VM
 		// but only if VM running
 		if vm.Status.Phase == vmv1.VmRunning {
@@ -307,9 +365,17 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			migration.Status.SourcePodIP = vm.Status.PodIP
 			migration.Status.TargetPodIP = targetRunner.Status.PodIP
 
+			// Syncing the target and starting the migration are expensive operations, so leave
+			// them for later if too many are already in progress. See reconcile_concurrency.go.
+			if !r.expensiveOps.tryAcquire() {
+				log.Info("Deferring migration start, too many expensive operations in progress")
+				return ctrl.Result{RequeueAfter: expensiveOperationRetryInterval}, nil
+			}
+			defer r.expensiveOps.release()
+
 			// do hotplugCPU in targetRunner before migration
 			log.Info("Syncing CPUs in Target runner", "TargetPod.Name", migration.Status.TargetPodName)
-			if err := QmpSyncCpuToTarget(vm, migration); err != nil {
+			if err := traceQMP(ctx, vm, "sync cpus to target", func() error { return QmpSyncCpuToTarget(vm, migration, r.Config.QMPAuthToken) }); err != nil {
 				return ctrl.Result{}, err
 			}
 			log.Info("CPUs in Target runner synced", "TargetPod.Name", migration.Status.TargetPodName)
@@ -324,7 +390,7 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 				)
 			case vmv1.MemoryProviderDIMMSlots:
 				log.Info("Syncing Memory in Target runner", "TargetPod.Name", migration.Status.TargetPodName)
-				if err := QmpSyncMemoryToTarget(vm, migration); err != nil {
+				if err := traceQMP(ctx, vm, "sync memory to target", func() error { return QmpSyncMemoryToTarget(vm, migration, r.Config.QMPAuthToken) }); err != nil {
 					return ctrl.Result{}, err
 				}
 				log.Info("Memory in Target runner synced", "TargetPod.Name", migration.Status.TargetPodName)
@@ -341,10 +407,18 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 					return ctrl.Result{}, err
 				}
 				// trigger migration
-				if err := QmpStartMigration(vm, migration); err != nil {
+				params := resolveMigrationParams(migration, r.Config.Migration)
+				if err := traceQMP(ctx, vm, "migrate", func() error { return QmpStartMigration(vm, migration, params, r.Config.QMPAuthToken) }); err != nil {
 					migration.Status.Phase = vmv1.VmmFailed
 					return ctrl.Result{}, err
 				}
+				if params.allowPostCopy && params.postCopyAfterIterations == 0 {
+					if err := traceQMP(ctx, vm, "migrate-start-postcopy", func() error { return QmpStartPostCopy(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
+						migration.Status.Phase = vmv1.VmmFailed
+						return ctrl.Result{}, err
+					}
+					migration.Status.PostCopyStarted = true
+				}
 				message := fmt.Sprintf("Migration was started to target runner (%s)", targetRunner.Name)
 				log.Info(message)
 				r.Recorder.Event(migration, "Normal", "Started", message)
@@ -404,6 +478,15 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			// lost target pod for running Migration ?
 			message := fmt.Sprintf("Target Pod (%s) disappeared", migration.Status.TargetPodName)
 			r.Recorder.Event(migration, "Error", "NotFound", message)
+			if migration.Status.PostCopyStarted {
+				// The VM's memory was split between the source and the target, so it can't continue
+				// on the source.
+				vm.Status.Phase = vmv1.VmFailed
+				if err := r.Status().Update(ctx, vm); err != nil {
+					log.Error(err, "Failed to update VM status to Failed after losing post-copy target")
+					return ctrl.Result{}, err
+				}
+			}
 			meta.SetStatusCondition(&migration.Status.Conditions,
 				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
 					Status:  metav1.ConditionTrue,
@@ -422,8 +505,10 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			log.Error(err, "Failed to sync pod labels and annotations", "TargetPod.Name", targetRunner.Name)
 		}
 
+		params := resolveMigrationParams(migration, r.Config.Migration)
+
 		// retrieve migration statistics
-		migrationInfo, err := QmpGetMigrationInfo(QmpAddr(vm))
+		migrationInfo, err := QmpGetMigrationInfo(QmpAddr(vm, r.Config.QMPAuthToken))
 		if err != nil {
 			log.Error(err, "Failed to get migration info")
 			return ctrl.Result{}, err
@@ -436,61 +521,34 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			log.Info(message)
 			r.Recorder.Event(migration, "Normal", "Finished", message)
 
-			// re-fetch the vm
-			err := r.Get(ctx, types.NamespacedName{Name: migration.Spec.VmName, Namespace: migration.Namespace}, vm)
-			if err != nil {
-				log.Error(err, "Failed to re-fetch VM", "VmName", migration.Spec.VmName)
-				return ctrl.Result{}, err
-			}
-			// Redefine runner Pod for VM
-			vm.Status.PodName = migration.Status.TargetPodName
-			vm.Status.PodIP = migration.Status.TargetPodIP
-			vm.Status.Phase = vmv1.VmRunning
-			// update VM status
-			if err := r.Status().Update(ctx, vm); err != nil {
-				log.Error(err, "Failed to redefine runner pod in VM")
+			if err := r.switchVMToTargetPod(ctx, migration, vm, targetRunner); err != nil {
 				return ctrl.Result{}, err
 			}
 
-			// Redefine ownerRef for the target Pod
-			targetRunner.OwnerReferences = []metav1.OwnerReference{}
-			if err := ctrl.SetControllerReference(vm, targetRunner, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			if err := r.Update(ctx, targetRunner); err != nil {
-				log.Error(err, "Failed to update ownerRef for target runner pod")
-				return ctrl.Result{}, err
-			}
+			// finally update migration phase to Succeeded
+			migration.Status.Phase = vmv1.VmmSucceeded
+			migration.Status.Info.Status = migrationInfo.Status
+			return r.updateMigrationStatus(ctx, migration)
+		}
 
-			// Redefine ownerRef for the source Pod
-			sourceRunner := &corev1.Pod{}
-			err = r.Get(ctx, types.NamespacedName{Name: migration.Status.SourcePodName, Namespace: migration.Namespace}, sourceRunner)
-			if err == nil {
-				sourceRunner.OwnerReferences = []metav1.OwnerReference{}
-				if err := ctrl.SetControllerReference(migration, sourceRunner, r.Scheme); err != nil {
-					return ctrl.Result{}, err
-				}
-				if err := r.Update(ctx, sourceRunner); err != nil {
-					log.Error(err, "Failed to update ownerRef for source runner pod")
-					return ctrl.Result{}, err
-				}
-			} else if !apierrors.IsNotFound(err) {
-				return ctrl.Result{}, err
-			}
+		// check if migration failed after switching to post-copy. The VM has been running on the
+		// target since then, so the source can't take over again: keep the target.
+		if migration.Status.PostCopyStarted && (migrationInfo.Status == "failed" || migrationInfo.Status == "postcopy-paused") {
+			message := fmt.Sprintf("Migration to target pod (%s) failed after switching to post-copy, keeping target pod",
+				targetRunner.Name)
+			log.Info(message)
+			r.Recorder.Event(migration, "Warning", "Failed", message)
 
-			// try to stop hypervisor in source runner if it running still
-			if sourceRunner.Status.Phase == corev1.PodRunning {
-				if err := QmpQuit(migration.Status.SourcePodIP, vm.Spec.QMP); err != nil {
-					log.Error(err, "Failed stop hypervisor in source runner pod")
-				} else {
-					log.Info("Hypervisor in source runner pod stopped")
-				}
-			} else {
-				log.Info("Skip stopping hypervisor in source runner pod", "pod.Status.Phase", sourceRunner.Status.Phase)
+			if err := r.switchVMToTargetPod(ctx, migration, vm, targetRunner); err != nil {
+				return ctrl.Result{}, err
 			}
 
-			// finally update migration phase to Succeeded
-			migration.Status.Phase = vmv1.VmmSucceeded
+			meta.SetStatusCondition(&migration.Status.Conditions,
+				metav1.Condition{Type: typeDegradedVirtualMachineMigration,
+					Status:  metav1.ConditionTrue,
+					Reason:  "Reconciling",
+					Message: message})
+			migration.Status.Phase = vmv1.VmmFailed
 			migration.Status.Info.Status = migrationInfo.Status
 			return r.updateMigrationStatus(ctx, migration)
 		}
@@ -505,7 +563,9 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 
 			// try to stop hypervisor in target runner
 			if targetRunner.Status.Phase == corev1.PodRunning {
-				if err := QmpQuit(migration.Status.TargetPodIP, vm.Spec.QMP); err != nil {
+				if err := traceQMP(ctx, vm, "quit target", func() error {
+					return QmpQuit(QmpEndpoint{IP: migration.Status.TargetPodIP, Port: vm.Spec.QMP, AuthToken: r.Config.QMPAuthToken})
+				}); err != nil {
 					log.Error(err, "Failed stop hypervisor in target runner pod")
 				} else {
 					log.Info("Hypervisor in target runner pod stopped")
@@ -524,10 +584,23 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 			migration.Status.Info.Status = migrationInfo.Status
 			return r.updateMigrationStatus(ctx, migration)
 		}
+		// switch to post-copy, if it's time to
+		if !migration.Status.PostCopyStarted && params.shouldStartPostCopy(migrationInfo) {
+			if err := traceQMP(ctx, vm, "migrate-start-postcopy", func() error { return QmpStartPostCopy(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
+				log.Error(err, "Failed to switch migration to post-copy")
+				return ctrl.Result{}, err
+			}
+			message := fmt.Sprintf("Migration switched to post-copy after %d iterations", migrationInfo.Ram.DirtySyncCount)
+			log.Info(message)
+			r.Recorder.Event(migration, "Normal", "PostCopyStarted", message)
+			migration.Status.PostCopyStarted = true
+			return r.updateMigrationStatus(ctx, migration)
+		}
+
 		// seems migration still going on, just update status with migration progress once per second
 		time.Sleep(time.Second)
 		// re-retrieve migration statistics
-		migrationInfo, err = QmpGetMigrationInfo(QmpAddr(vm))
+		migrationInfo, err = QmpGetMigrationInfo(QmpAddr(vm, r.Config.QMPAuthToken))
 		if err != nil {
 			log.Error(err, "Failed to re-get migration info")
 			return ctrl.Result{}, err
@@ -613,6 +686,78 @@ func (r *VirtualMachineMigrationReconciler) Reconcile(ctx context.Context, req c
 	return ctrl.Result{}, nil
 }
 
+// switchVMToTargetPod makes the migration's target runner pod the VM's runner pod, and stops the
+// hypervisor in the source runner pod. This is done when the migration completes, or when it fails
+// after switching to post-copy, because the target is authoritative from then on.
+func (r *VirtualMachineMigrationReconciler) switchVMToTargetPod(
+	ctx context.Context,
+	migration *vmv1.VirtualMachineMigration,
+	vm *vmv1.VirtualMachine,
+	targetRunner *corev1.Pod,
+) error {
+	log := log.FromContext(ctx)
+
+	// re-fetch the vm
+	err := r.Get(ctx, types.NamespacedName{Name: migration.Spec.VmName, Namespace: migration.Namespace}, vm)
+	if err != nil {
+		log.Error(err, "Failed to re-fetch VM", "VmName", migration.Spec.VmName)
+		return err
+	}
+	// Redefine runner Pod for VM
+	vm.Status.PodName = migration.Status.TargetPodName
+	vm.Status.PodIP = migration.Status.TargetPodIP
+	vm.Status.ConsoleURL = consoleURL(vm.Status.PodIP)
+	vm.Status.Phase = vmv1.VmRunning
+	// The guest's clock fell behind while it was paused for the end of the migration.
+	markTimeSyncPending(vm, time.Now())
+	// update VM status
+	if err := r.Status().Update(ctx, vm); err != nil {
+		log.Error(err, "Failed to redefine runner pod in VM")
+		return err
+	}
+
+	// Redefine ownerRef for the target Pod
+	targetRunner.OwnerReferences = []metav1.OwnerReference{}
+	if err := ctrl.SetControllerReference(vm, targetRunner, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Update(ctx, targetRunner); err != nil {
+		log.Error(err, "Failed to update ownerRef for target runner pod")
+		return err
+	}
+
+	// Redefine ownerRef for the source Pod
+	sourceRunner := &corev1.Pod{}
+	err = r.Get(ctx, types.NamespacedName{Name: migration.Status.SourcePodName, Namespace: migration.Namespace}, sourceRunner)
+	if err == nil {
+		sourceRunner.OwnerReferences = []metav1.OwnerReference{}
+		if err := ctrl.SetControllerReference(migration, sourceRunner, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Update(ctx, sourceRunner); err != nil {
+			log.Error(err, "Failed to update ownerRef for source runner pod")
+			return err
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	// try to stop hypervisor in source runner if it running still
+	if sourceRunner.Status.Phase == corev1.PodRunning {
+		if err := traceQMP(ctx, vm, "quit source", func() error {
+			return QmpQuit(QmpEndpoint{IP: migration.Status.SourcePodIP, Port: vm.Spec.QMP, AuthToken: r.Config.QMPAuthToken})
+		}); err != nil {
+			log.Error(err, "Failed stop hypervisor in source runner pod")
+		} else {
+			log.Info("Hypervisor in source runner pod stopped")
+		}
+	} else {
+		log.Info("Skip stopping hypervisor in source runner pod", "pod.Status.Phase", sourceRunner.Status.Phase)
+	}
+
+	return nil
+}
+
 func (r *VirtualMachineMigrationReconciler) updateMigrationStatus(ctx context.Context, migration *vmv1.VirtualMachineMigration) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
 	if err := r.Status().Update(ctx, migration); err != nil {
@@ -626,6 +771,24 @@ func (r *VirtualMachineMigrationReconciler) updateMigrationStatus(ctx context.Co
 func (r *VirtualMachineMigrationReconciler) doFinalizerOperationsForVirtualMachineMigration(ctx context.Context, migration *vmv1.VirtualMachineMigration, vm *vmv1.VirtualMachine) error {
 	log := log.FromContext(ctx)
 
+	if migration.Status.Phase == vmv1.VmmRunning && migration.Status.PostCopyStarted {
+		// The migration can't be canceled once it's switched to post-copy, and the VM is already
+		// running on the target - so keep the target instead.
+		message := fmt.Sprintf("Running Migration (%s) is being deleted after switching to post-copy, keeping target pod", migration.Name)
+		log.Info(message)
+		r.Recorder.Event(migration, "Warning", "Deleting", message)
+
+		targetRunner := &corev1.Pod{}
+		err := r.Get(ctx, types.NamespacedName{Name: migration.Status.TargetPodName, Namespace: migration.Namespace}, targetRunner)
+		if err == nil {
+			return r.switchVMToTargetPod(ctx, migration, vm, targetRunner)
+		} else if !apierrors.IsNotFound(err) {
+			log.Error(err, "Failed to get target runner Pod")
+			return err
+		}
+		// Otherwise, the target is already gone; handle it like any other running migration.
+	}
+
 	if migration.Status.Phase == vmv1.VmmRunning || vm.Status.Phase == vmv1.VmPreMigrating {
 		message := fmt.Sprintf("Running Migration (%s) is being deleted", migration.Name)
 		log.Info(message)
@@ -633,7 +796,7 @@ func (r *VirtualMachineMigrationReconciler) doFinalizerOperationsForVirtualMachi
 
 		// try to cancel migration
 		log.Info("Canceling migration")
-		if err := QmpCancelMigration(QmpAddr(vm)); err != nil {
+		if err := traceQMP(ctx, vm, "migrate_cancel", func() error { return QmpCancelMigration(QmpAddr(vm, r.Config.QMPAuthToken)) }); err != nil {
 			// inform about error but not return error to avoid stuckness in reconciliation cycle
 			log.Error(err, "Migration canceling failed")
 		}
@@ -681,6 +844,7 @@ func (r *VirtualMachineMigrationReconciler) doFinalizerOperationsForVirtualMachi
 // desirable state on the cluster
 func (r *VirtualMachineMigrationReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
 	cntrlName := "virtualmachinemigration"
+	r.expensiveOps = newExpensiveOperationLimiter(cntrlName, r.Config.MaxConcurrentExpensiveOperations, r.Metrics)
 	reconciler := WithMetrics(
 		withCatchPanic(r),
 		r.Metrics,
@@ -693,10 +857,30 @@ func (r *VirtualMachineMigrationReconciler) SetupWithManager(mgr ctrl.Manager) (
 		Owns(&corev1.Pod{}).
 		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
 		Named(cntrlName).
-		Complete(reconciler)
+		Complete(withObjectRateLimit(
+			withNamespaceRateLimit(reconciler, cntrlName, r.Config.NamespaceRateLimit, r.Metrics),
+			cntrlName, r.Config.ObjectRateLimit, r.Metrics,
+		))
 	return reconciler, err
 }
 
+// migrationSpreadDomains returns the failure domains that the migration's target pod must not share
+// with the source pod, from both the migration and the VM's .spec.migrationPolicy
+func migrationSpreadDomains(vm *vmv1.VirtualMachine, migration *vmv1.VirtualMachineMigration) []vmv1.FailureDomain {
+	var domains []vmv1.FailureDomain
+	if migration.Spec.PreventMigrationToSameHost {
+		domains = append(domains, vmv1.FailureDomainHost)
+	}
+	if vm.Spec.MigrationPolicy != nil {
+		for _, d := range vm.Spec.MigrationPolicy.SpreadAcross {
+			if !slices.Contains(domains, d) {
+				domains = append(domains, d)
+			}
+		}
+	}
+	return domains
+}
+
 // targetPodForVirtualMachine returns a VirtualMachine Pod object
 func (r *VirtualMachineMigrationReconciler) targetPodForVirtualMachine(
 	vm *vmv1.VirtualMachine,
@@ -725,8 +909,8 @@ func (r *VirtualMachineMigrationReconciler) targetPodForVirtualMachine(
 	// add env variable to turn on migration receiver
 	pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "RECEIVE_MIGRATION", Value: "true"})
 
-	// add podAntiAffinity to schedule target pod to another k8s node
-	if migration.Spec.PreventMigrationToSameHost {
+	// add podAntiAffinity to schedule target pod away from the source pod's failure domains
+	for _, domain := range migrationSpreadDomains(vm, migration) {
 		if pod.Spec.Affinity == nil {
 			pod.Spec.Affinity = &corev1.Affinity{}
 		}
@@ -742,7 +926,7 @@ func (r *VirtualMachineMigrationReconciler) targetPodForVirtualMachine(
 					vmv1.VirtualMachineNameLabel: migration.Spec.VmName,
 				},
 			},
-			TopologyKey: "kubernetes.io/hostname",
+			TopologyKey: domain.TopologyKey(),
 		})
 	}
 
@@ -0,0 +1,717 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/storage/names"
+	"k8s.io/client-go/tools/record"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+const virtualmachinesnapshotFinalizer = "vm.neon.tech/finalizer"
+
+// Definitions to manage status conditions
+const (
+	// typeAvailableVirtualMachineSnapshot represents the status of the snapshot once it can be
+	// restored from
+	typeAvailableVirtualMachineSnapshot = "Available"
+	// typeDegradedVirtualMachineSnapshot represents the status used when the snapshot has failed
+	typeDegradedVirtualMachineSnapshot = "Degraded"
+)
+
+// snapshotsPathInRunner is the directory within the runner pod that snapshots are saved into,
+// before being exported. It must match the path used by neonvm-runner.
+const snapshotsPathInRunner = "/vm/images/snapshots"
+
+// VirtualMachineSnapshotReconciler reconciles a VirtualMachineSnapshot object
+//
+// Snapshots go through the following phases:
+//
+//  1. Pending: waiting for the VM to be running
+//  2. Capturing: QEMU is saving the disks (and memory) into a directory in the runner pod
+//  3. Exporting: a Job is copying the files from the runner pod to the snapshot's target
+//  4. Succeeded or Failed
+//
+// Once the snapshot has finished, the files in the runner pod are removed.
+//
+// If there's a QMP auth token, the export Job downloads the files with a token derived from it for
+// that snapshot only, which is given to the runner when creating the directory and to the Job via
+// a Secret. See neonvm/runner/snapshots.go for more.
+type VirtualMachineSnapshotReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	Config   *ReconcilerConfig
+
+	Metrics ReconcilerMetrics
+}
+
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=vm.neon.tech,resources=virtualmachinesnapshots/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+func (r *VirtualMachineSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	snapshot := new(vmv1.VirtualMachineSnapshot)
+	if err := r.Get(ctx, req.NamespacedName, snapshot); err != nil {
+		// ignore error and stop reconcile loop if object not found (already deleted?)
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "Unable to fetch Snapshot")
+		return ctrl.Result{}, err
+	}
+
+	defer r.Metrics.reconcilePhaseTimer(ctx, "virtualmachinesnapshot", string(snapshot.Status.Phase))()
+
+	if snapshot.ObjectMeta.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(snapshot, virtualmachinesnapshotFinalizer) {
+			log.Info("Adding Finalizer to Snapshot")
+			if !controllerutil.AddFinalizer(snapshot, virtualmachinesnapshotFinalizer) {
+				return ctrl.Result{}, errors.New("Failed to add finalizer to Snapshot")
+			}
+			if err := r.Update(ctx, snapshot); err != nil {
+				return ctrl.Result{}, err
+			}
+			// stop this reconciliation cycle, new will be triggered as Snapshot updated
+			return ctrl.Result{}, nil
+		}
+	} else {
+		if controllerutil.ContainsFinalizer(snapshot, virtualmachinesnapshotFinalizer) {
+			log.Info("Performing Finalizer Operations for Snapshot")
+			r.doFinalizerOperationsForVirtualMachineSnapshot(ctx, snapshot)
+
+			log.Info("Removing Finalizer from Snapshot")
+			if !controllerutil.RemoveFinalizer(snapshot, virtualmachinesnapshotFinalizer) {
+				return ctrl.Result{}, errors.New("Failed to remove finalizer from Snapshot")
+			}
+			if err := r.Update(ctx, snapshot); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		// Stop reconciliation as the item is being deleted
+		return ctrl.Result{}, nil
+	}
+
+	switch snapshot.Status.Phase {
+	case "":
+		meta.SetStatusCondition(&snapshot.Status.Conditions, metav1.Condition{Type: typeAvailableVirtualMachineSnapshot, Status: metav1.ConditionUnknown, Reason: "Reconciling", Message: "Starting reconciliation"})
+		snapshot.Status.Phase = vmv1.VmsPending
+		snapshot.Status.StartTime = lo.ToPtr(metav1.Now())
+		return r.updateSnapshotStatus(ctx, snapshot)
+
+	case vmv1.VmsPending:
+		vm := new(vmv1.VirtualMachine)
+		err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.VmName, Namespace: snapshot.Namespace}, vm)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.UserError, "VM (%s) not found", snapshot.Spec.VmName))
+			}
+			log.Error(err, "Failed to get VM", "VmName", snapshot.Spec.VmName)
+			return ctrl.Result{}, err
+		}
+		// Only take snapshots of running VMs, so that we don't interfere with migrations or
+		// pausing.
+		if vm.Status.Phase != vmv1.VmRunning {
+			return ctrl.Result{RequeueAfter: time.Second}, nil
+		}
+
+		snapshot.Status.PodName = vm.Status.PodName
+		snapshot.Status.PodIP = vm.Status.PodIP
+		snapshot.Status.Restore = restoreInfoForSnapshot(snapshot, vm)
+
+		if err := r.runnerSnapshotRequest(ctx, snapshot, http.MethodPut); err != nil {
+			log.Error(err, "Failed to create snapshot directory in runner pod")
+			return ctrl.Result{}, err
+		}
+
+		drives := lo.Map(snapshot.Status.Restore.Disks, func(d vmv1.SnapshotDisk, _ int) string { return d.Name })
+		dir := path.Join(snapshotsPathInRunner, snapshot.Name)
+		err = traceQMP(ctx, vm, "start snapshot", func() error {
+			return QmpStartSnapshot(r.snapshotQmpAddr(snapshot, vm), snapshot.Name, dir, drives, snapshot.Spec.IncludeMemory)
+		})
+		if err != nil {
+			log.Error(err, "Failed to start snapshot")
+			r.resumeGuestIfNecessary(ctx, snapshot, vm)
+			return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.TransientInfra, "Failed to start snapshot: %w", err))
+		}
+
+		r.Recorder.Event(snapshot, "Normal", "Capturing",
+			fmt.Sprintf("Capturing VM (%s) in runner pod (%s)", vm.Name, snapshot.Status.PodName))
+		snapshot.Status.Phase = vmv1.VmsCapturing
+		return r.updateSnapshotStatus(ctx, snapshot)
+
+	case vmv1.VmsCapturing:
+		vm := new(vmv1.VirtualMachine)
+		err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.VmName, Namespace: snapshot.Namespace}, vm)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.UserError, "VM (%s) was deleted during capture", snapshot.Spec.VmName))
+			}
+			log.Error(err, "Failed to get VM", "VmName", snapshot.Spec.VmName)
+			return ctrl.Result{}, err
+		}
+		if vm.Status.PodName != snapshot.Status.PodName {
+			return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.TransientInfra, "VM runner pod changed from %s to %s during capture", snapshot.Status.PodName, vm.Status.PodName))
+		}
+
+		drives := lo.Map(snapshot.Status.Restore.Disks, func(d vmv1.SnapshotDisk, _ int) string { return d.Name })
+		done, err := QmpSnapshotProgress(r.snapshotQmpAddr(snapshot, vm), snapshot.Name, drives, snapshot.Spec.IncludeMemory)
+		if err != nil {
+			log.Error(err, "Snapshot capture failed")
+			r.resumeGuestIfNecessary(ctx, snapshot, vm)
+			r.removeRunnerFiles(ctx, snapshot)
+			return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.TransientInfra, "Capture failed: %w", err))
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: time.Second}, nil
+		}
+
+		if snapshot.Spec.IncludeMemory {
+			if err := traceQMP(ctx, vm, "cont", func() error { return QmpCont(r.snapshotQmpAddr(snapshot, vm)) }); err != nil {
+				log.Error(err, "Failed to resume guest after capturing memory")
+				return ctrl.Result{}, err
+			}
+			// The guest's clock fell behind while its memory was saved. This is best-effort: if the
+			// update fails, the clock is eventually corrected by chronyd anyway.
+			markTimeSyncPending(vm, time.Now())
+			if err := r.Status().Update(ctx, vm); err != nil {
+				log.Error(err, "Failed to mark VM clock for synchronization after capturing memory")
+			}
+		}
+
+		r.Recorder.Event(snapshot, "Normal", "Captured",
+			fmt.Sprintf("VM (%s) captured, exporting to %s", vm.Name, snapshot.Status.Restore.Location))
+		// The Job is created on the next reconcile, so that we don't lose track of it if updating
+		// the status fails.
+		snapshot.Status.ExportJobName = names.SimpleNameGenerator.GenerateName(fmt.Sprintf("%s-export-", snapshot.Name))
+		snapshot.Status.Phase = vmv1.VmsExporting
+		return r.updateSnapshotStatus(ctx, snapshot)
+
+	case vmv1.VmsExporting:
+		job := new(batchv1.Job)
+		err := r.Get(ctx, types.NamespacedName{Name: snapshot.Status.ExportJobName, Namespace: snapshot.Namespace}, job)
+		if err != nil && apierrors.IsNotFound(err) {
+			job, err := r.exportJobForSnapshot(snapshot)
+			if err != nil {
+				log.Error(err, "Failed to generate export Job spec")
+				return ctrl.Result{}, err
+			}
+			secret, err := r.exportTokenSecret(snapshot)
+			if err != nil {
+				log.Error(err, "Failed to generate export token Secret")
+				return ctrl.Result{}, err
+			}
+			if secret != nil {
+				if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
+					log.Error(err, "Failed to create export token Secret", "Secret.Name", secret.Name)
+					return ctrl.Result{}, err
+				}
+			}
+			log.Info("Creating export Job", "Job.Name", job.Name)
+			if err := r.Create(ctx, job); err != nil {
+				log.Error(err, "Failed to create export Job", "Job.Name", job.Name)
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{}, nil
+		} else if err != nil {
+			log.Error(err, "Failed to get export Job")
+			return ctrl.Result{}, err
+		}
+
+		for _, c := range job.Status.Conditions {
+			if c.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				r.removeRunnerFiles(ctx, snapshot)
+				message := fmt.Sprintf("Snapshot of VM (%s) exported to %s", snapshot.Spec.VmName, snapshot.Status.Restore.Location)
+				r.Recorder.Event(snapshot, "Normal", "Succeeded", message)
+				meta.SetStatusCondition(&snapshot.Status.Conditions,
+					metav1.Condition{Type: typeAvailableVirtualMachineSnapshot,
+						Status:  metav1.ConditionTrue,
+						Reason:  "Reconciling",
+						Message: message})
+				snapshot.Status.Phase = vmv1.VmsSucceeded
+				snapshot.Status.CompletionTime = lo.ToPtr(metav1.Now())
+				return r.updateSnapshotStatus(ctx, snapshot)
+			case batchv1.JobFailed:
+				r.removeRunnerFiles(ctx, snapshot)
+				return r.failSnapshot(ctx, snapshot, errclass.Errorf(errclass.TransientInfra, "Export Job (%s) failed: %s", job.Name, c.Message))
+			}
+		}
+		// Job still running. We'll be notified when it changes.
+		return ctrl.Result{}, nil
+
+	case vmv1.VmsSucceeded, vmv1.VmsFailed:
+		// nothing left to do
+		return ctrl.Result{}, nil
+
+	default:
+		log.Info("Unknown Snapshot phase", "Phase", snapshot.Status.Phase)
+		return ctrl.Result{}, nil
+	}
+}
+
+// snapshotQmpAddr returns the QMP endpoint of the runner pod the snapshot is taken from
+func (r *VirtualMachineSnapshotReconciler) snapshotQmpAddr(snapshot *vmv1.VirtualMachineSnapshot, vm *vmv1.VirtualMachine) QmpEndpoint {
+	return QmpEndpoint{IP: snapshot.Status.PodIP, Port: vm.Spec.QMP, AuthToken: r.Config.QMPAuthToken}
+}
+
+func (r *VirtualMachineSnapshotReconciler) updateSnapshotStatus(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+	if err := r.Status().Update(ctx, snapshot); err != nil {
+		log.Error(err, "Failed update Snapshot status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// failSnapshot marks the snapshot as failed, with an event and condition explaining why.
+//
+// The class of the error is given by the condition's reason, and the event's annotations.
+func (r *VirtualMachineSnapshotReconciler) failSnapshot(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot, err error) (ctrl.Result, error) {
+	class := errclass.Of(err)
+	r.Recorder.AnnotatedEventf(snapshot, map[string]string{errclass.EventAnnotation: string(class)},
+		"Warning", "Failed", "%s", err)
+	meta.SetStatusCondition(&snapshot.Status.Conditions,
+		metav1.Condition{Type: typeDegradedVirtualMachineSnapshot,
+			Status:  metav1.ConditionTrue,
+			Reason:  class.Reason(),
+			Message: err.Error()})
+	snapshot.Status.Phase = vmv1.VmsFailed
+	snapshot.Status.CompletionTime = lo.ToPtr(metav1.Now())
+	return r.updateSnapshotStatus(ctx, snapshot)
+}
+
+// doFinalizerOperationsForVirtualMachineSnapshot cleans up after a snapshot that's being deleted,
+// in case it was still in progress.
+//
+// Errors are logged but not returned, to avoid stuckness in the reconciliation cycle. The export
+// Job is owned by the snapshot, so it's deleted for us.
+func (r *VirtualMachineSnapshotReconciler) doFinalizerOperationsForVirtualMachineSnapshot(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot) {
+	log := log.FromContext(ctx)
+
+	if snapshot.Status.Phase == vmv1.VmsCapturing {
+		vm := new(vmv1.VirtualMachine)
+		err := r.Get(ctx, types.NamespacedName{Name: snapshot.Spec.VmName, Namespace: snapshot.Namespace}, vm)
+		if err != nil {
+			log.Error(err, "Failed to get VM", "VmName", snapshot.Spec.VmName)
+		} else if vm.Status.PodName == snapshot.Status.PodName {
+			r.resumeGuestIfNecessary(ctx, snapshot, vm)
+		}
+	}
+
+	if snapshot.Status.Phase == vmv1.VmsCapturing || snapshot.Status.Phase == vmv1.VmsExporting {
+		r.removeRunnerFiles(ctx, snapshot)
+	}
+}
+
+// resumeGuestIfNecessary resumes the VM if it was paused for capturing memory
+func (r *VirtualMachineSnapshotReconciler) resumeGuestIfNecessary(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot, vm *vmv1.VirtualMachine) {
+	if !snapshot.Spec.IncludeMemory {
+		return
+	}
+
+	if err := QmpCancelMigration(r.snapshotQmpAddr(snapshot, vm)); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to cancel saving memory")
+	}
+	if err := QmpCont(r.snapshotQmpAddr(snapshot, vm)); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to resume guest")
+		r.Recorder.Event(snapshot, "Warning", "ResumeFailed", fmt.Sprintf("Failed to resume VM (%s): %s", vm.Name, err))
+	}
+}
+
+// removeRunnerFiles asks neonvm-runner to remove the snapshot's local files, logging on failure
+func (r *VirtualMachineSnapshotReconciler) removeRunnerFiles(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot) {
+	if err := r.runnerSnapshotRequest(ctx, snapshot, http.MethodDelete); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to remove snapshot files from runner pod", "Pod.Name", snapshot.Status.PodName)
+	}
+}
+
+// runnerSnapshotRequest makes a request for the snapshot's directory to neonvm-runner
+func (r *VirtualMachineSnapshotReconciler) runnerSnapshotRequest(ctx context.Context, snapshot *vmv1.VirtualMachineSnapshot, method string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// When creating the directory, tell the runner which token the export Job will use
+	var body []byte
+	if token := r.exportToken(snapshot); method == http.MethodPut && token != "" {
+		body = []byte(api.QMPAuthTokenHash(token))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, runnerSnapshotURL(snapshot), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if r.Config.QMPAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Config.QMPAuthToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// exportToken returns the token that the snapshot's export Job uses to download its files from
+// neonvm-runner, or "" if authentication is disabled
+//
+// It's derived from the QMP auth token, so that it doesn't need to be stored anywhere, but only
+// grants access to this snapshot's files.
+func (r *VirtualMachineSnapshotReconciler) exportToken(snapshot *vmv1.VirtualMachineSnapshot) string {
+	if r.Config.QMPAuthToken == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(r.Config.QMPAuthToken))
+	mac.Write([]byte(snapshot.UID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportTokenSecret returns the Secret that gives the export Job the snapshot's export token, or
+// nil if authentication is disabled. It has the same name as the Job.
+func (r *VirtualMachineSnapshotReconciler) exportTokenSecret(snapshot *vmv1.VirtualMachineSnapshot) (*corev1.Secret, error) {
+	token := r.exportToken(snapshot)
+	if token == "" {
+		return nil, nil
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshot.Status.ExportJobName,
+			Namespace: snapshot.Namespace,
+			Labels:    map[string]string{vmv1.VirtualMachineNameLabel: snapshot.Spec.VmName},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{"token": token},
+	}
+	// Set the snapshot as the owner and controller, so the Secret is cleaned up with it
+	if err := ctrl.SetControllerReference(snapshot, secret, r.Scheme); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func runnerSnapshotURL(snapshot *vmv1.VirtualMachineSnapshot) string {
+	return fmt.Sprintf("http://%s/snapshots/%s", net.JoinHostPort(snapshot.Status.PodIP, fmt.Sprint(vmv1.SnapshotExportPort)), snapshot.Name)
+}
+
+// restoreInfoForSnapshot returns the information about the snapshot's contents that's recorded
+// in its status, to be used when restoring.
+//
+// Only the root disk and emptyDisks are saved. Other disks are either read-only, or recreated
+// from their source on restore.
+func restoreInfoForSnapshot(snapshot *vmv1.VirtualMachineSnapshot, vm *vmv1.VirtualMachine) *vmv1.SnapshotRestoreInfo {
+	disks := []vmv1.SnapshotDisk{{Name: "rootdisk", File: "rootdisk.qcow2"}}
+	for _, disk := range vm.Spec.Disks {
+		if disk.EmptyDisk != nil {
+			disks = append(disks, vmv1.SnapshotDisk{Name: disk.Name, File: fmt.Sprintf("%s.qcow2", disk.Name)})
+		}
+	}
+
+	var memoryFile string
+	if snapshot.Spec.IncludeMemory {
+		memoryFile = "memory.gz"
+	}
+
+	var location string
+	if t := snapshot.Spec.Target.ObjectStorage; t != nil {
+		location = fmt.Sprintf("s3://%s/%s", t.Bucket, snapshotObjectKeyPrefix(snapshot))
+	} else if t := snapshot.Spec.Target.PersistentVolumeClaim; t != nil {
+		location = fmt.Sprintf("pvc://%s/%s", t.ClaimName, snapshotPVCPath(snapshot))
+	}
+
+	return &vmv1.SnapshotRestoreInfo{
+		Location:       location,
+		Disks:          disks,
+		MemoryFile:     memoryFile,
+		Guest:          *vm.Spec.Guest.DeepCopy(),
+		MemoryProvider: vm.Status.MemoryProvider,
+		CPUScalingMode: vm.Status.CPUScalingMode,
+	}
+}
+
+func snapshotObjectKeyPrefix(snapshot *vmv1.VirtualMachineSnapshot) string {
+	prefix := strings.Trim(snapshot.Spec.Target.ObjectStorage.Prefix, "/")
+	return strings.TrimPrefix(fmt.Sprintf("%s/%s/%s", prefix, snapshot.Namespace, snapshot.Name), "/")
+}
+
+func snapshotPVCPath(snapshot *vmv1.VirtualMachineSnapshot) string {
+	if p := strings.Trim(snapshot.Spec.Target.PersistentVolumeClaim.Path, "/"); p != "" {
+		return p
+	}
+	return snapshot.Name
+}
+
+// exportJobForSnapshot returns the Job that copies the snapshot's files from the runner pod to the
+// snapshot's target
+func (r *VirtualMachineSnapshotReconciler) exportJobForSnapshot(snapshot *vmv1.VirtualMachineSnapshot) (*batchv1.Job, error) {
+	files := lo.Map(snapshot.Status.Restore.Disks, func(d vmv1.SnapshotDisk, _ int) string { return d.File })
+	if snapshot.Status.Restore.MemoryFile != "" {
+		files = append(files, snapshot.Status.Restore.MemoryFile)
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "SOURCE", Value: runnerSnapshotURL(snapshot)},
+		{Name: "FILES", Value: strings.Join(files, " ")},
+	}
+	if r.exportToken(snapshot) != "" {
+		env = append(env, corev1.EnvVar{
+			Name: "EXPORT_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: snapshot.Status.ExportJobName},
+					Key:                  "token",
+				},
+			},
+		})
+	}
+	// Without a token, the runner ignores the header.
+	curl := `curl -sSf -H "Authorization: Bearer ${EXPORT_TOKEN:-}"`
+	var envFrom []corev1.EnvFromSource
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	var script string
+
+	if t := snapshot.Spec.Target.ObjectStorage; t != nil {
+		env = append(env, corev1.EnvVar{Name: "DEST", Value: snapshot.Status.Restore.Location})
+		var extraArgs string
+		if t.Region != "" {
+			extraArgs += fmt.Sprintf(" --region %q", t.Region)
+		}
+		if t.Endpoint != "" {
+			extraArgs += fmt.Sprintf(" --endpoint-url %q", t.Endpoint)
+		}
+		script = fmt.Sprintf(`for f in $FILES; do %s "$SOURCE/$f" | aws s3 cp%s - "$DEST/$f"; done`, curl, extraArgs)
+		if t.CredentialsSecretName != "" {
+			envFrom = append(envFrom, corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: t.CredentialsSecretName},
+				},
+			})
+		}
+	} else if t := snapshot.Spec.Target.PersistentVolumeClaim; t != nil {
+		env = append(env, corev1.EnvVar{Name: "DEST", Value: path.Join("/snapshot", snapshotPVCPath(snapshot))})
+		script = fmt.Sprintf(`mkdir -p "$DEST"; for f in $FILES; do %s -o "$DEST/$f" "$SOURCE/$f"; done`, curl)
+		volumes = append(volumes, corev1.Volume{
+			Name: "snapshot",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: t.ClaimName},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: "snapshot", MountPath: "/snapshot"})
+	} else {
+		return nil, errors.New("snapshot has no target")
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshot.Status.ExportJobName,
+			Namespace: snapshot.Namespace,
+			Labels:    map[string]string{vmv1.VirtualMachineNameLabel: snapshot.Spec.VmName},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: lo.ToPtr[int32](3),
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:         "export",
+						Image:        r.Config.SnapshotExportImage,
+						Command:      []string{"/bin/bash", "-c", "set -euo pipefail; " + script},
+						Env:          env,
+						EnvFrom:      envFrom,
+						VolumeMounts: volumeMounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	// Set the snapshot as the owner and controller, so the Job is cleaned up with it
+	if err := ctrl.SetControllerReference(snapshot, job, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// restoreInitContainerName is the name of the runner pod's init container that downloads the
+// files of the VM's .spec.restoreFrom snapshot
+const restoreInitContainerName = "restore-snapshot"
+
+// addRestoreInitContainer adds an init container to the runner pod that copies the snapshot's
+// files from its target into the pod, overwriting the root disk copied by the "init" container.
+// The snapshot is either the VM's .spec.restoreFrom, or the snapshot of its .spec.cloneFrom source.
+//
+// Files are restored with the same names they were saved with, which are the paths that
+// neonvm-runner expects: "<disk name>.qcow2" for each disk, and "memory.gz" for the memory state.
+// Only the disks that are still present in the VM's spec are restored.
+func addRestoreInitContainer(
+	pod *corev1.Pod,
+	vm *vmv1.VirtualMachine,
+	snapshot *vmv1.VirtualMachineSnapshot,
+	config *ReconcilerConfig,
+) error {
+	restore := snapshot.Status.Restore
+	if snapshot.Status.Phase != vmv1.VmsSucceeded || restore == nil {
+		return fmt.Errorf("snapshot %s has not succeeded", snapshot.Name)
+	}
+
+	var files []string
+	for _, disk := range restore.Disks {
+		if disk.Name == "rootdisk" || slices.ContainsFunc(vm.Spec.Disks, func(d vmv1.Disk) bool {
+			return d.Name == disk.Name && d.EmptyDisk != nil
+		}) {
+			files = append(files, disk.File)
+		}
+	}
+	if vm.Spec.RestoreFrom != nil && vm.Spec.RestoreFrom.RestoreMemory {
+		if restore.MemoryFile == "" {
+			return fmt.Errorf("snapshot %s does not include memory", snapshot.Name)
+		}
+		files = append(files, restore.MemoryFile)
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "FILES", Value: strings.Join(files, " ")},
+	}
+	var envFrom []corev1.EnvFromSource
+	volumeMounts := []corev1.VolumeMount{{
+		Name:      "virtualmachineimages",
+		MountPath: "/vm/images",
+	}}
+	var script string
+
+	if t := snapshot.Spec.Target.ObjectStorage; t != nil {
+		env = append(env, corev1.EnvVar{Name: "SOURCE", Value: restore.Location})
+		var extraArgs string
+		if t.Region != "" {
+			extraArgs += fmt.Sprintf(" --region %q", t.Region)
+		}
+		if t.Endpoint != "" {
+			extraArgs += fmt.Sprintf(" --endpoint-url %q", t.Endpoint)
+		}
+		script = fmt.Sprintf(`for f in $FILES; do aws s3 cp%s "$SOURCE/$f" "/vm/images/$f"; done`, extraArgs)
+		if t.CredentialsSecretName != "" {
+			envFrom = append(envFrom, corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: t.CredentialsSecretName},
+				},
+			})
+		}
+	} else if t := snapshot.Spec.Target.PersistentVolumeClaim; t != nil {
+		env = append(env, corev1.EnvVar{Name: "SOURCE", Value: path.Join("/snapshot", snapshotPVCPath(snapshot))})
+		script = `for f in $FILES; do cp "$SOURCE/$f" "/vm/images/$f"; done`
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: restoreInitContainerName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: t.ClaimName,
+					ReadOnly:  true,
+				},
+			},
+		})
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{Name: restoreInitContainerName, MountPath: "/snapshot", ReadOnly: true})
+	} else {
+		return errors.New("snapshot has no target")
+	}
+
+	container := corev1.Container{
+		Name:  restoreInitContainerName,
+		Image: config.SnapshotExportImage,
+		Command: []string{
+			"/bin/bash", "-c",
+			"set -euo pipefail; " + script +
+				/* uid=36(qemu) gid=34(kvm) groups=34(kvm) */
+				`; for f in $FILES; do chown 36:34 "/vm/images/$f"; done`,
+		},
+		Env:          env,
+		EnvFrom:      envFrom,
+		VolumeMounts: volumeMounts,
+	}
+
+	// The restore must come after "init", which copies the root disk from the image.
+	pod.Spec.InitContainers = slices.Insert(pod.Spec.InitContainers, 1, container)
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+// Note that export Jobs are also watched, so that we notice when they finish.
+func (r *VirtualMachineSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) (ReconcilerWithMetrics, error) {
+	cntrlName := "virtualmachinesnapshot"
+	reconciler := WithMetrics(
+		withCatchPanic(r),
+		r.Metrics,
+		cntrlName,
+		r.Config.FailurePendingPeriod,
+		r.Config.FailingRefreshInterval,
+	)
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&vmv1.VirtualMachineSnapshot{}).
+		Owns(&batchv1.Job{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.Config.MaxConcurrentReconciles}).
+		Named(cntrlName).
+		Complete(withObjectRateLimit(
+			withNamespaceRateLimit(reconciler, cntrlName, r.Config.NamespaceRateLimit, r.Metrics),
+			cntrlName, r.Config.ObjectRateLimit, r.Metrics,
+		))
+	return reconciler, err
+}
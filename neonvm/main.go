@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -35,9 +36,12 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -64,7 +68,9 @@ func init() {
 	//+kubebuilder:scaffold:scheme
 }
 
-func run(mgr manager.Manager) error {
+// run starts the manager, alongside the debug server. getConfig returns the controller's effective
+// configuration, served by the debug server at /config.
+func run(mgr manager.Manager, getConfig func() any) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 	ctx = srv.SetShutdownSignal(ctx)
@@ -79,7 +85,19 @@ func run(mgr manager.Manager) error {
 		setupLog.Info("main loop returned, exiting")
 	}()
 
-	if err := orca.Add(srv.HTTP("pprof", time.Second, util.MakePPROF("0.0.0.0:7777"))); err != nil {
+	shutdownTracing, err := util.StartTracing(ctx, "neonvm-controller")
+	if err != nil {
+		return fmt.Errorf("failed to start tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			setupLog.Error(err, "failed to flush traces")
+		}
+	}()
+
+	if err := orca.Add(srv.HTTP("pprof", time.Second, util.MakePPROF("0.0.0.0:7777", getConfig))); err != nil {
 		return fmt.Errorf("failed to add pprof service: %w", err)
 	}
 
@@ -99,9 +117,27 @@ func main() {
 	var enableContainerMgr bool
 	var qemuDiskCacheSettings string
 	var defaultMemoryProvider vmv1.MemoryProvider
+	var memoryProviderMigration bool
 	var memhpAutoMovableRatio string
+	defaultPortForwarding := vmv1.PortForwardingIPTables
+	defaultCPUScalingMode := vmv1.CPUScalingModeQMPHotplug
 	var failurePendingPeriod time.Duration
 	var failingRefreshInterval time.Duration
+	var snapshotExportImage string
+	var namespaceRateLimit controllers.NamespaceRateLimit
+	var objectRateLimit controllers.ObjectRateLimit
+	var maxConcurrentExpensiveOperations int
+	var qmpAuthTokenFile string
+	var webhookCheckDiskReferences bool
+	var webhookCheckPodResources bool
+	var webhookPodResourcesOverhead vmv1.PodResourcesOverhead
+	var webhookPolicyConfigMap string
+	var qmpBreaker controllers.QMPBreakerConfig
+	var rollout controllers.RolloutConfig
+	var orphanSweepInterval time.Duration
+	var execAPIAddr string
+	var migration controllers.MigrationConfig
+	migration.Compression = vmv1.MigrationCompressionZlib
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -111,18 +147,90 @@ func main() {
 	flag.BoolVar(&enableContainerMgr, "enable-container-mgr", false, "Enable crictl-based container-mgr alongside each VM")
 	flag.StringVar(&qemuDiskCacheSettings, "qemu-disk-cache-settings", "cache=none", "Set neonvm-runner's QEMU disk cache settings")
 	flag.Func("default-memory-provider", "Set default memory provider to use for new VMs", defaultMemoryProvider.FlagFunc)
+	flag.BoolVar(&memoryProviderMigration, "memory-provider-migration", false,
+		"Switch VMs from DIMMSlots to VirtioMem on their next restart, unless they set .spec.guest.memoryProvider")
 	flag.StringVar(&memhpAutoMovableRatio, "memhp-auto-movable-ratio", "301", "For virtio-mem, set VM kernel's memory_hotplug.auto_movable_ratio")
+	flag.Func("default-port-forwarding", "Set default port forwarding implementation (IPTables or NFTables) for VMs that don't set .spec.guest.portForwarding", defaultPortForwarding.FlagFunc)
+	flag.Func("default-cpu-scaling-mode", "Set default CPU scaling mode (QMPHotplug, CgroupThrottling, or GuestCpuset) for VMs that don't set .spec.guest.cpuScalingMode", defaultCPUScalingMode.FlagFunc)
 	flag.DurationVar(&failurePendingPeriod, "failure-pending-period", 1*time.Minute,
 		"the period for the propagation of reconciliation failures to the observability instruments")
 	flag.DurationVar(&failingRefreshInterval, "failing-refresh-interval", 1*time.Minute,
 		"the interval between consecutive updates of metrics and logs, related to failing reconciliations")
+	flag.StringVar(&snapshotExportImage, "snapshot-export-image", "amazon/aws-cli:2.15.0",
+		"Image used for VirtualMachineSnapshot export jobs. Must contain bash, curl, and the aws CLI")
+	flag.Float64Var(&namespaceRateLimit.QPS, "namespace-reconcile-qps", 0,
+		"Sustained rate of reconciles allowed per namespace, for each controller. Zero disables per-namespace rate limiting")
+	flag.IntVar(&namespaceRateLimit.Burst, "namespace-reconcile-burst", 100,
+		"Number of reconciles allowed per namespace in a burst, above -namespace-reconcile-qps")
+	flag.Float64Var(&objectRateLimit.QPS, "object-reconcile-qps", 0,
+		"Sustained rate of reconciles allowed per object, for each controller. Zero disables per-object rate limiting")
+	flag.IntVar(&objectRateLimit.Burst, "object-reconcile-burst", 10,
+		"Number of reconciles allowed per object in a burst, above -object-reconcile-qps")
+	flag.IntVar(&maxConcurrentExpensiveOperations, "max-concurrent-expensive-operations", 0,
+		"Maximum number of reconciles for each controller performing expensive operations (QMP calls, migrations) at once. Zero means no limit")
+	flag.StringVar(&qmpAuthTokenFile, "qmp-auth-token-file", "",
+		"File containing the token to authenticate to QMP in new runner pods. If empty, QMP doesn't require authentication")
+	flag.BoolVar(&webhookCheckDiskReferences, "webhook-check-disk-references", false,
+		"Warn when creating VMs with disks that reference ConfigMaps, Secrets, or VolumeSnapshots that don't exist")
+	flag.BoolVar(&webhookCheckPodResources, "webhook-check-pod-resources", false,
+		"Reject new VMs with .spec.podResources limits below the guest's maximum CPU or memory, plus the overhead given by -webhook-pod-*-overhead*")
+	flag.Func("webhook-pod-memory-overhead", "Fixed memory overhead of the runner pod, for -webhook-check-pod-resources (default 0)", quantityFlag(&webhookPodResourcesOverhead.MemoryFixed))
+	flag.Float64Var(&webhookPodResourcesOverhead.MemoryFraction, "webhook-pod-memory-overhead-fraction", 0,
+		"Memory overhead of the runner pod as a fraction of the guest's maximum memory, for -webhook-check-pod-resources")
+	flag.Func("webhook-pod-cpu-overhead", "Fixed CPU overhead of the runner pod, for -webhook-check-pod-resources (default 0)", quantityFlag(&webhookPodResourcesOverhead.CPUFixed))
+	flag.StringVar(&webhookPolicyConfigMap, "webhook-policy-configmap", "",
+		"ConfigMap holding the cluster's VirtualMachinePolicy, as <namespace>/<name>. If empty, no policy is enforced")
+	flag.IntVar(&qmpBreaker.FailureThreshold, "qmp-breaker-failure-threshold", 0,
+		"Number of consecutive failed VM resizes on a node after which resizes on the node are paused. Zero disables pausing")
+	flag.DurationVar(&qmpBreaker.OpenDuration, "qmp-breaker-open-duration", 1*time.Minute,
+		"How long VM resizes on a node are paused for, after -qmp-breaker-failure-threshold consecutive failures")
+	flag.IntVar(&rollout.MaxUnavailable, "rollout-max-unavailable", 0,
+		"Maximum number of VMs restarted at once to roll out changes that require a restart (e.g. a new runner image). Zero disables rollouts")
+	flag.DurationVar(&rollout.BootSLO, "rollout-boot-slo", 2*time.Minute,
+		"How long a VM restarted for a rollout may take to be running again, before the restart counts as failed")
+	flag.Float64Var(&rollout.MaxFailureRate, "rollout-max-failure-rate", 0.2,
+		"Fraction of rollout restarts in -rollout-failure-window that may fail before the rollout is paused")
+	flag.DurationVar(&rollout.FailureWindow, "rollout-failure-window", 15*time.Minute,
+		"Period over which the failure rate of rollout restarts is calculated")
+	flag.IntVar(&rollout.MinRestartsForPause, "rollout-min-restarts-for-pause", 5,
+		"Minimum number of rollout restarts in -rollout-failure-window before the rollout may be paused")
+	flag.DurationVar(&orphanSweepInterval, "orphan-sweep-interval", 10*time.Minute,
+		"Interval between sweeps for generated resources (e.g. SSH secrets) whose VM no longer exists. Zero disables the sweeps")
+	flag.StringVar(&execAPIAddr, "exec-api-addr", "",
+		"The address to serve the aggregated exec.vm.neon.tech API on, for running commands in VMs. Empty disables the API. Requires -qmp-auth-token-file")
+	flag.DurationVar(&migration.DowntimeLimit, "migration-downtime-limit", 300*time.Millisecond,
+		"Default maximum time that VMs may be paused for at the end of live migration, for migrations that don't set .spec.downtimeLimitMilliseconds")
+	flag.IntVar(&migration.MultifdChannels, "migration-multifd-channels", 0,
+		"Default number of parallel connections for live migration, for migrations that don't set .spec.multifdChannels. Zero disables multifd")
+	flag.IntVar(&migration.PostCopyAfterIterations, "migration-postcopy-after-iterations", 0,
+		"Default number of pre-copy passes over VMs' memory after which migrations that allow post-copy switch to it, for migrations that don't set .spec.postCopyAfterIterations")
+	flag.Func("migration-compression", "Set default compression (None, Zlib, or Zstd) for migrations that don't set .spec.compression. Defaults to Zlib", migration.Compression.FlagFunc)
 	flag.Parse()
 
+	if migration.Compression == vmv1.MigrationCompressionZstd && migration.MultifdChannels == 0 {
+		fmt.Fprintln(os.Stderr, "'-migration-compression=Zstd' requires '-migration-multifd-channels' > 0")
+		os.Exit(1)
+	}
+
 	if defaultMemoryProvider == "" {
 		fmt.Fprintln(os.Stderr, "missing required flag '-default-memory-provider'")
 		os.Exit(1)
 	}
 
+	var qmpAuthToken string
+	if qmpAuthTokenFile != "" {
+		token, err := os.ReadFile(qmpAuthTokenFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read QMP auth token: %s\n", err)
+			os.Exit(1)
+		}
+		if strings.TrimSpace(string(token)) == "" {
+			fmt.Fprintln(os.Stderr, "QMP auth token file is empty")
+			os.Exit(1)
+		}
+		qmpAuthToken = strings.TrimSpace(string(token))
+	}
+
 	logConfig := zap.NewProductionConfig()
 	logConfig.Sampling = nil // Disabling sampling; it's enabled by default for zap's production configs.
 	logConfig.Level.SetLevel(zap.InfoLevel)
@@ -145,10 +253,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	webhookCertDir := filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
 	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "a3b22509.neon.tech",
@@ -163,6 +271,11 @@ func main() {
 		// if you are doing or is intended to do any operation such as perform cleanups
 		// after the manager stops then its usage might be unsafe.
 		// LeaderElectionReleaseOnCancel: true,
+
+		// Serve each admission request in a span. See controllers/tracing.go.
+		WebhookServer: controllers.TracingWebhookServer{
+			Server: webhook.NewServer(webhook.Options{Port: 9443, CertDir: webhookCertDir}),
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -170,16 +283,29 @@ func main() {
 	}
 
 	reconcilerMetrics := controllers.MakeReconcilerMetrics()
+	controllers.SetQMPMetrics(reconcilerMetrics)
 
 	rc := &controllers.ReconcilerConfig{
 		IsK3s:                   isK3s,
 		UseContainerMgr:         enableContainerMgr,
 		MaxConcurrentReconciles: concurrencyLimit,
+		NamespaceRateLimit:      namespaceRateLimit,
+		ObjectRateLimit:         objectRateLimit,
 		QEMUDiskCacheSettings:   qemuDiskCacheSettings,
+		QMPAuthToken:            qmpAuthToken,
 		DefaultMemoryProvider:   defaultMemoryProvider,
+		MemoryProviderMigration: memoryProviderMigration,
 		MemhpAutoMovableRatio:   memhpAutoMovableRatio,
+		DefaultPortForwarding:   defaultPortForwarding,
+		DefaultCPUScalingMode:   defaultCPUScalingMode,
 		FailurePendingPeriod:    failurePendingPeriod,
 		FailingRefreshInterval:  failingRefreshInterval,
+		SnapshotExportImage:     snapshotExportImage,
+		QMPBreaker:              qmpBreaker,
+		Rollout:                 rollout,
+		Migration:               migration,
+
+		MaxConcurrentExpensiveOperations: maxConcurrentExpensiveOperations,
 	}
 
 	vmReconciler := &controllers.VMReconciler{
@@ -194,11 +320,27 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachine")
 		os.Exit(1)
 	}
+	vmv1.SetWebhookCheckDiskReferences(webhookCheckDiskReferences)
+	if webhookCheckPodResources {
+		vmv1.SetWebhookPodResourcesOverhead(webhookPodResourcesOverhead)
+	}
+	if webhookPolicyConfigMap != "" {
+		namespace, name, ok := strings.Cut(webhookPolicyConfigMap, "/")
+		if !ok || namespace == "" || name == "" {
+			setupLog.Error(fmt.Errorf("expected <namespace>/<name>, got %q", webhookPolicyConfigMap), "invalid -webhook-policy-configmap")
+			os.Exit(1)
+		}
+		vmv1.SetWebhookPolicyConfigMap(types.NamespacedName{Namespace: namespace, Name: name})
+	}
 	if err = (&vmv1.VirtualMachine{}).SetupWebhookWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create webhook", "webhook", "VirtualMachine")
 		os.Exit(1)
 	}
 
+	mgr.GetWebhookServer().Register(controllers.RunnerPodWebhookPath, &webhook.Admission{
+		Handler: controllers.NewRunnerPodValidator(mgr.GetScheme(), mgr.GetAPIReader()),
+	})
+
 	migrationReconciler := &controllers.VirtualMachineMigrationReconciler{
 		Client:   mgr.GetClient(),
 		Scheme:   mgr.GetScheme(),
@@ -215,6 +357,23 @@ func main() {
 		setupLog.Error(err, "unable to create webhook", "webhook", "VirtualMachineMigration")
 		os.Exit(1)
 	}
+
+	snapshotReconciler := &controllers.VirtualMachineSnapshotReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("virtualmachinesnapshot-controller"),
+		Config:   rc,
+		Metrics:  reconcilerMetrics,
+	}
+	snapshotReconcilerMetrics, err := snapshotReconciler.SetupWithManager(mgr)
+	if err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachineSnapshot")
+		os.Exit(1)
+	}
+	if err = (&vmv1.VirtualMachineSnapshot{}).SetupWebhookWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create webhook", "webhook", "VirtualMachineSnapshot")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -226,7 +385,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	dbgSrv := debugServerFunc(vmReconcilerMetrics, migrationReconcilerMetrics)
+	dbgSrv := debugServerFunc(vmReconcilerMetrics, migrationReconcilerMetrics, snapshotReconcilerMetrics)
 	if err := mgr.Add(dbgSrv); err != nil {
 		setupLog.Error(err, "unable to set up debug server")
 		os.Exit(1)
@@ -237,12 +396,74 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := run(mgr); err != nil {
+	deprecatedFieldsRefresher := controllers.DeprecatedFieldsRefresher{
+		Client:  mgr.GetClient(),
+		Metrics: reconcilerMetrics,
+	}
+	if err := mgr.Add(deprecatedFieldsRefresher); err != nil {
+		setupLog.Error(err, "unable to set up deprecated fields refresher")
+		os.Exit(1)
+	}
+
+	orphanSweeper := controllers.OrphanSweeper{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Scheme:    mgr.GetScheme(),
+		Interval:  orphanSweepInterval,
+		Metrics:   reconcilerMetrics,
+	}
+	if err := mgr.Add(orphanSweeper); err != nil {
+		setupLog.Error(err, "unable to set up orphan sweeper")
+		os.Exit(1)
+	}
+
+	execAPIServer := controllers.ExecAPIServer{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Addr:      execAPIAddr,
+		CertDir:   webhookCertDir, // served with the same certificate as the webhooks
+
+		QMPAuthToken: qmpAuthToken,
+	}
+	if err := mgr.Add(execAPIServer); err != nil {
+		setupLog.Error(err, "unable to set up exec API server")
+		os.Exit(1)
+	}
+
+	// The effective configuration is the final value of every flag - including those that were left
+	// at their defaults - alongside the reconciler config that they're turned into.
+	getConfig := func() any {
+		flags := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) {
+			flags[f.Name] = f.Value.String()
+		})
+		return struct {
+			Flags      map[string]string             `json:"flags"`
+			Reconciler *controllers.ReconcilerConfig `json:"reconciler"`
+		}{
+			Flags:      flags,
+			Reconciler: rc,
+		}
+	}
+
+	if err := run(mgr, getConfig); err != nil {
 		setupLog.Error(err, "run manager error")
 		os.Exit(1)
 	}
 }
 
+// quantityFlag returns a flag.Func callback that parses a resource.Quantity into q
+func quantityFlag(q *resource.Quantity) func(string) error {
+	return func(value string) error {
+		parsed, err := resource.ParseQuantity(value)
+		if err != nil {
+			return err
+		}
+		*q = parsed
+		return nil
+	}
+}
+
 func checkIfRunningInK3sCluster(cfg *rest.Config) (bool, error) {
 	client, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
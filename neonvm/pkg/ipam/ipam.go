@@ -363,11 +363,14 @@ func (i *IPAM) getNeonvmIPPool(ctx context.Context, ipRange string) (*NeonvmIPPo
 	// for IP range 10.11.22.0/24 poll name will be
 	// "10.11.22.0-24" if no network name in ipam spec, or
 	// "samplenet-10.11.22.0-24" if nametwork name is `samplenet`
+	//
+	// For IPv6 ranges, colons are replaced as well, so fd00:1::/64 becomes "fd00-1---64".
+	rangeName := strings.NewReplacer("/", "-", ":", "-").Replace(ipRange)
 	var poolName string
 	if i.Config.NetworkName == UnnamedNetwork {
-		poolName = strings.ReplaceAll(ipRange, "/", "-")
+		poolName = rangeName
 	} else {
-		poolName = fmt.Sprintf("%s-%s", i.Config.NetworkName, strings.ReplaceAll(ipRange, "/", "-"))
+		poolName = fmt.Sprintf("%s-%s", i.Config.NetworkName, rangeName)
 	}
 
 	pool, err := i.vmClient.NeonvmV1().IPPools(i.Config.NetworkNamespace).Get(ctx, poolName, metav1.GetOptions{})
@@ -0,0 +1,51 @@
+package main
+
+// Architecture-specific settings for QEMU
+//
+// The runner image is built for both amd64 and arm64 (e.g. Graviton nodes). The guest always has
+// the same architecture as the host, so we pick everything based on the runner's own architecture.
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type archSettings struct {
+	// qemuBin is the QEMU system emulator for the architecture
+	qemuBin string
+	// machine is the value of QEMU's -machine argument
+	machine string
+	// cpuDriver is the QEMU device used when hotplugging CPUs
+	cpuDriver string
+	// firmwareCodePath and firmwareVarsTemplatePath are the UEFI firmware images used for VMs with
+	// bootMethod UEFI
+	firmwareCodePath         string
+	firmwareVarsTemplatePath string
+}
+
+var archs = map[string]archSettings{
+	"amd64": {
+		qemuBin:                  "qemu-system-x86_64",
+		machine:                  "q35",
+		cpuDriver:                "max-x86_64-cpu",
+		firmwareCodePath:         "/usr/share/OVMF/OVMF_CODE.fd",
+		firmwareVarsTemplatePath: "/usr/share/OVMF/OVMF_VARS.fd",
+	},
+	"arm64": {
+		qemuBin: "qemu-system-aarch64",
+		// gic-version=max picks the newest interrupt controller that the host supports
+		machine:                  "virt,gic-version=max",
+		cpuDriver:                "max-arm-cpu",
+		firmwareCodePath:         "/usr/share/AAVMF/QEMU_EFI.fd",
+		firmwareVarsTemplatePath: "/usr/share/AAVMF/QEMU_VARS.fd",
+	},
+}
+
+// hostArch returns the settings for the architecture that the runner was built for
+func hostArch() (archSettings, error) {
+	arch, ok := archs[runtime.GOARCH]
+	if !ok {
+		return archSettings{}, fmt.Errorf("unsupported architecture %q", runtime.GOARCH)
+	}
+	return arch, nil
+}
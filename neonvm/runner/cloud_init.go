@@ -0,0 +1,114 @@
+package main
+
+// User-data for cloud-init and Ignition
+//
+// With .spec.guest.cloudInit, the user-data is either given inline in the VM spec, or read from the
+// Secret that neonvm-controller mounts at cloudInitMountPoint. With the NoCloud format, it's put on
+// a seed disk - an ISO labelled 'cidata' with 'user-data' and 'meta-data' files - which cloud-init
+// finds by its label. With the Ignition format, it's passed through QEMU's firmware configuration
+// device, under the name that Ignition reads its config from on QEMU.
+//
+// The instance ID in the meta-data is the VM's namespace and name, so that cloud-init only runs its
+// once-per-instance modules the first time the VM boots, and not each time it's restarted. Clones
+// get their own instance ID, unless they preserve the identity of the VM they were cloned from.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	cloudInitMountPoint = "/vm/cloud-init"
+	cloudInitSeedDir    = "/vm/images/cloud-init"
+	cloudInitDiskPath   = "/vm/images/cloud-init.iso"
+	ignitionConfigPath  = "/vm/images/ignition.ign"
+
+	// cloudInitVolumeLabel is the label that cloud-init finds NoCloud seed disks by
+	cloudInitVolumeLabel = "cidata"
+	// ignitionFwCfgName is the name that Ignition reads its config from on QEMU
+	ignitionFwCfgName = "opt/com.coreos/config"
+)
+
+// cloudInitArgs writes the guest's user-data, and returns the QEMU arguments to provide it
+func cloudInitArgs(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) ([]string, error) {
+	cloudInit := vmSpec.Guest.CloudInit
+	if cloudInit == nil {
+		return nil, nil
+	}
+
+	userData, err := cloudInitUserData(cloudInit)
+	if err != nil {
+		return nil, fmt.Errorf("could not read user-data: %w", err)
+	}
+
+	switch cloudInit.Format {
+	case vmv1.CloudInitFormatIgnition:
+		logger.Info("writing Ignition config", zap.String("path", ignitionConfigPath))
+		if err := writeQEMUFile(ignitionConfigPath, userData); err != nil {
+			return nil, fmt.Errorf("could not write Ignition config: %w", err)
+		}
+		return []string{"-fw_cfg", fmt.Sprintf("name=%s,file=%s", ignitionFwCfgName, ignitionConfigPath)}, nil
+	default: // NoCloud, or empty for VMs from before the default was set
+		if err := os.RemoveAll(cloudInitSeedDir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(cloudInitSeedDir, 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(cloudInitSeedDir, "user-data"), userData, 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(cloudInitSeedDir, "meta-data"), []byte(cloudInitMetaData(vmSpec)), 0o600); err != nil {
+			return nil, err
+		}
+
+		logger.Info("creating cloud-init seed disk", zap.String("diskPath", cloudInitDiskPath))
+		if err := createISO9660FromPath(logger, cloudInitVolumeLabel, cloudInitDiskPath, cloudInitSeedDir); err != nil {
+			return nil, fmt.Errorf("Failed to create ISO9660 image: %w", err)
+		}
+		return []string{
+			"-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=cdrom,readonly=on,cache=none,serial=%s", cloudInitVolumeLabel, cloudInitDiskPath, cloudInitVolumeLabel),
+		}, nil
+	}
+}
+
+// cloudInitUserData returns the user-data, either from the VM spec or from the mounted Secret
+func cloudInitUserData(cloudInit *vmv1.CloudInit) ([]byte, error) {
+	if cloudInit.UserData != nil {
+		return []byte(*cloudInit.UserData), nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(cloudInitMountPoint, "user-data"))
+	if err != nil {
+		// An optional Secret that doesn't exist isn't mounted at all. Boot without user-data, the
+		// same as we would with empty user-data.
+		ref := cloudInit.UserDataSecretRef
+		if errors.Is(err, os.ErrNotExist) && ref != nil && ref.Optional != nil && *ref.Optional {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// cloudInitMetaData returns the contents of the NoCloud 'meta-data' file
+func cloudInitMetaData(vmSpec *vmv1.VirtualMachineSpec) string {
+	name := vmSpec.GuestIdentity(os.Getenv("VM_NAME"))
+	namespace := os.Getenv("K8S_POD_NAMESPACE")
+	return fmt.Sprintf("instance-id: %s.%s\nlocal-hostname: %s\n", namespace, name, name)
+}
+
+// writeQEMUFile writes the file so that only QEMU can read it
+func writeQEMUFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	return os.Chown(path, 36, 34)
+}
@@ -0,0 +1,195 @@
+package main
+
+// Confidential compute, with AMD SEV-SNP or Intel TDX
+//
+// VMs with .spec.enableConfidentialCompute have their memory encrypted by the CPU, so that the
+// host can't read it. The scheduler only places them on nodes with the "confidential-compute"
+// capability, and we pick whichever technology the node's KVM supports.
+//
+// Because the host can't touch the guest's memory, nothing that relies on it works: no hotplug
+// (the guest starts with the resources it's using, like UEFI guests), no live migration, and no
+// memory snapshots. The guest is booted by the technology's firmware, which measures the kernel
+// so that it's covered by the guest's attestation.
+//
+// The hardware-signed attestation report can only be requested from within the guest (so that it
+// can include the verifier's nonce). The /attestation endpoint exposes the launch parameters that
+// the report is checked against, as reported by QEMU.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	qmpUnixSocketForAttestation = "/vm/qmp-attestation.sock"
+
+	sevSNPFirmwarePath = "/usr/share/OVMF/OVMF.amdsev.fd"
+	tdxFirmwarePath    = "/usr/share/OVMF/OVMF.inteltdx.fd"
+
+	// sevCBitPos is the position of the page table bit that marks memory as encrypted. It's 51 on
+	// all AMD CPUs that support SEV-SNP (Milan and later).
+	sevCBitPos = 51
+)
+
+type confidentialComputeTechnology string
+
+const (
+	technologySEVSNP confidentialComputeTechnology = "sev-snp"
+	technologyTDX    confidentialComputeTechnology = "tdx"
+)
+
+type confidentialCompute struct {
+	technology confidentialComputeTechnology
+}
+
+// detectConfidentialCompute returns the confidential compute technology supported by the node's
+// KVM, or an error if there isn't one.
+func detectConfidentialCompute() (*confidentialCompute, error) {
+	candidates := []struct {
+		technology confidentialComputeTechnology
+		param      string
+		firmware   string
+	}{
+		{technologySEVSNP, "/sys/module/kvm_amd/parameters/sev_snp", sevSNPFirmwarePath},
+		{technologyTDX, "/sys/module/kvm_intel/parameters/tdx", tdxFirmwarePath},
+	}
+
+	for _, c := range candidates {
+		value, err := os.ReadFile(c.param)
+		if err != nil || strings.TrimSpace(string(value)) != "Y" {
+			continue
+		}
+		if _, err := os.Stat(c.firmware); err != nil {
+			return nil, fmt.Errorf("node supports %s, but runner image is missing its firmware: %w", c.technology, err)
+		}
+		return &confidentialCompute{technology: c.technology}, nil
+	}
+
+	return nil, errors.New("confidential compute is enabled, but the node supports neither SEV-SNP nor TDX")
+}
+
+// machineOptions returns the options to append to QEMU's -machine argument, or "" if cc is nil
+func (cc *confidentialCompute) machineOptions() string {
+	if cc == nil {
+		return ""
+	}
+
+	switch cc.technology {
+	case technologySEVSNP:
+		return ",confidential-guest-support=cc0,memory-backend=ram0"
+	case technologyTDX:
+		return ",kernel-irqchip=split,confidential-guest-support=cc0"
+	default:
+		panic(fmt.Errorf("unknown confidential compute technology %q", cc.technology))
+	}
+}
+
+// args returns the extra QEMU arguments to launch the confidential guest with memSize bytes of
+// memory, or nil if cc is nil
+func (cc *confidentialCompute) args(memSize int64) []string {
+	if cc == nil {
+		return nil
+	}
+
+	args := []string{"-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForAttestation)}
+
+	switch cc.technology {
+	case technologySEVSNP:
+		return append(
+			args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=ram0,size=%db,share=true", memSize),
+			"-object", fmt.Sprintf("sev-snp-guest,id=cc0,cbitpos=%d,reduced-phys-bits=1,kernel-hashes=on", sevCBitPos),
+			"-bios", sevSNPFirmwarePath,
+		)
+	case technologyTDX:
+		return append(
+			args,
+			"-object", "tdx-guest,id=cc0",
+			"-bios", tdxFirmwarePath,
+		)
+	default:
+		panic(fmt.Errorf("unknown confidential compute technology %q", cc.technology))
+	}
+}
+
+// queryAttestation returns the launch parameters of the running confidential guest
+func (cc *confidentialCompute) queryAttestation() (*api.Attestation, error) {
+	attestation := &api.Attestation{
+		Technology: string(cc.technology),
+		Launch:     nil,
+	}
+
+	// QEMU doesn't report anything about TDX guests' launch - all of it is in the guest's report.
+	if cc.technology != technologySEVSNP {
+		return attestation, nil
+	}
+
+	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForAttestation, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if err := mon.Connect(); err != nil {
+		return nil, err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred
+
+	raw, err := mon.Run([]byte(`{"execute": "query-sev"}`))
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("error unmarshaling json: %w", err)
+	}
+
+	attestation.Launch = result.Return
+	return attestation, nil
+}
+
+func handleAttestation(logger *zap.Logger, w http.ResponseWriter, r *http.Request, vmSpec *vmv1.VirtualMachineSpec) {
+	if r.Method != "GET" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	if !vmSpec.ConfidentialCompute() {
+		w.WriteHeader(404)
+		return
+	}
+
+	cc, err := detectConfidentialCompute()
+	if err != nil {
+		logger.Error("could not detect confidential compute technology", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	attestation, err := cc.queryAttestation()
+	if err != nil {
+		logger.Error("could not query attestation from QEMU", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	body, err := json.Marshal(attestation)
+	if err != nil {
+		logger.Error("could not marshal body", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck // Not much to do with the error here. TODO: log it?
+}
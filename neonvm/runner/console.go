@@ -0,0 +1,364 @@
+package main
+
+// Serving the guest's serial console
+//
+// The kernel's console (and so the guest's boot logs) is on the serial port connected to QEMU's
+// stdout. We pass it through to our own stdout as before, but also keep the most recent output in a
+// ring buffer, so that it can be fetched over HTTP - even if the container's logs have been rotated
+// away, or were never collected.
+//
+// GET /console returns the buffered output. With '?follow=true', the response continues streaming
+// new output until the client disconnects.
+//
+// If the runner was given '-qmp-auth-token-hash', requests must authenticate with the same token,
+// given as 'Authorization: Bearer <token>'.
+//
+// The runner also watches the output for the line that vm-builder's vminit prints once the guest
+// has booted, and reports it at GET /guest_status, for the VM's GuestBooted condition.
+//
+// The same server serves the result of the guest's readiness probe at GET /ready, which doesn't
+// require authentication. See readiness.go for more. It also runs commands in the guest with
+// POST /exec - see exec.go.
+//
+// QEMU's stdout is a pipe that we read from ourselves, rather than one managed by os/exec, so that
+// it can be handed off in an in-place upgrade (see upgrade.go): the previous runner stops reading,
+// and passes the read end of the pipe, along with the buffered output and whether the guest has
+// booted, to the new runner, which continues from there.
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// consoleBufferSize is the maximum amount of console output that we keep
+const consoleBufferSize = 1 << 20 // 1 MiB
+
+// guestBootedMarker is the line printed to the console by vm-builder's vminit once it's done
+var guestBootedMarker = []byte("neonvm: guest booted")
+
+// consoleBuffer is an io.Writer that keeps the last consoleBufferSize bytes written to it
+type consoleBuffer struct {
+	mu sync.Mutex
+	// buf stores the most recent output, at most consoleBufferSize bytes
+	buf []byte
+	// written is the total number of bytes ever written. It's used as the offset for streaming.
+	written uint64
+	// updated is closed (and replaced) on every write
+	updated chan struct{}
+	// guestBooted is set once guestBootedMarker has been written
+	guestBooted bool
+}
+
+func newConsoleBuffer() *consoleBuffer {
+	return &consoleBuffer{
+		mu:      sync.Mutex{},
+		buf:     nil,
+		written: 0,
+		updated: make(chan struct{}),
+
+		guestBooted: false,
+	}
+}
+
+func (b *consoleBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if !b.guestBooted {
+		// The marker may be split across writes, so also check the end of the previous output.
+		start := max(0, len(b.buf)-len(p)-len(guestBootedMarker))
+		b.guestBooted = bytes.Contains(b.buf[start:], guestBootedMarker)
+	}
+	if len(b.buf) > consoleBufferSize {
+		b.buf = slices.Clone(b.buf[len(b.buf)-consoleBufferSize:])
+	}
+	b.written += uint64(len(p))
+
+	close(b.updated)
+	b.updated = make(chan struct{})
+
+	return len(p), nil
+}
+
+// since returns the output written after offset (or as much of it as is still buffered), the offset
+// to use for the next call, and a channel that's closed when there's more output.
+func (b *consoleBuffer) since(offset uint64) ([]byte, uint64, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := b.written - uint64(len(b.buf))
+	offset = max(offset, start)
+	return slices.Clone(b.buf[offset-start:]), b.written, b.updated
+}
+
+func (b *consoleBuffer) isGuestBooted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.guestBooted
+}
+
+// consoleOutput forwards QEMU's stdout from the read end of a pipe to our own stdout and to the
+// buffer
+type consoleOutput struct {
+	pipe   *os.File
+	buffer *consoleBuffer
+
+	mu sync.Mutex
+	// done is closed once forwarding has stopped, either because it was paused or because QEMU
+	// closed its end of the pipe (in which case eof is set). It's replaced on resume.
+	done chan struct{}
+	eof  bool
+}
+
+// startConsoleOutput starts forwarding from the pipe in the background
+func startConsoleOutput(logger *zap.Logger, pipe *os.File, buffer *consoleBuffer) *consoleOutput {
+	c := &consoleOutput{pipe: pipe, buffer: buffer, mu: sync.Mutex{}, done: nil, eof: false}
+	c.start(logger)
+	return c
+}
+
+func (c *consoleOutput) start(logger *zap.Logger) {
+	done := make(chan struct{})
+	c.mu.Lock()
+	c.done = done
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+
+		_, err := io.Copy(io.MultiWriter(os.Stdout, c.buffer), c.pipe)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return // paused
+		} else if err != nil {
+			logger.Error("failed to read QEMU's output", zap.Error(err))
+		}
+		c.mu.Lock()
+		c.eof = true
+		c.mu.Unlock()
+	}()
+}
+
+// stopped returns a channel that's closed once forwarding has stopped
+func (c *consoleOutput) stopped() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+func (c *consoleOutput) ended() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.eof
+}
+
+// pause stops forwarding and waits for it to finish, so that nothing more is read from the pipe
+func (c *consoleOutput) pause() {
+	if c.pipe != nil {
+		_ = c.pipe.SetReadDeadline(time.Now())
+	}
+	<-c.stopped()
+}
+
+// resume restarts forwarding after pause, unless QEMU's output had already ended
+func (c *consoleOutput) resume(logger *zap.Logger) {
+	if c.ended() {
+		return
+	}
+	_ = c.pipe.SetReadDeadline(time.Time{})
+	c.start(logger)
+}
+
+// upgradeConsoleState is the state of the console handed off in an in-place upgrade
+type upgradeConsoleState struct {
+	// Fd is the inherited file descriptor of the read end of QEMU's stdout
+	Fd          uintptr `json:"fd"`
+	Output      []byte  `json:"output"`
+	GuestBooted bool    `json:"guestBooted"`
+}
+
+// handOff returns the state for the new runner, with a duplicate of the pipe's file descriptor that
+// will be inherited across exec. Forwarding must be paused first.
+//
+// It returns nil if QEMU's output has already ended.
+func (c *consoleOutput) handOff() (*upgradeConsoleState, error) {
+	if c.ended() {
+		return nil, nil
+	}
+
+	fd, err := dupForExec(c.pipe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate console pipe: %w", err)
+	}
+
+	c.buffer.mu.Lock()
+	defer c.buffer.mu.Unlock()
+	return &upgradeConsoleState{
+		Fd:          uintptr(fd),
+		Output:      slices.Clone(c.buffer.buf),
+		GuestBooted: c.buffer.guestBooted,
+	}, nil
+}
+
+// resumeConsoleOutput continues forwarding QEMU's output after an in-place upgrade
+func resumeConsoleOutput(logger *zap.Logger, state *upgradeConsoleState) *consoleOutput {
+	buffer := newConsoleBuffer()
+	if state == nil {
+		// QEMU's output had already ended
+		done := make(chan struct{})
+		close(done)
+		return &consoleOutput{pipe: nil, buffer: buffer, mu: sync.Mutex{}, done: done, eof: true}
+	}
+
+	buffer.buf = state.Output
+	buffer.written = uint64(len(state.Output))
+	buffer.guestBooted = state.GuestBooted
+	return startConsoleOutput(logger, os.NewFile(state.Fd, "qemu-stdout"), buffer)
+}
+
+// authenticateConsoleRequest returns whether the request may proceed, writing the error response
+// if not
+func authenticateConsoleRequest(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config) bool {
+	if cfg.qmpAuthTokenHash == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	hash := api.QMPAuthTokenHash(token)
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(cfg.qmpAuthTokenHash)) != 1 {
+		logger.Warn("denied unauthenticated console request", zap.String("remoteAddr", r.RemoteAddr))
+		w.WriteHeader(401)
+		return false
+	}
+	return true
+}
+
+func handleConsole(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config, console *consoleBuffer) {
+	if r.Method != http.MethodGet {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	if !authenticateConsoleRequest(logger, w, r, cfg) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	data, offset, updated := console.since(0)
+	if _, err := w.Write(data); err != nil {
+		return
+	}
+	if r.URL.Query().Get("follow") != "true" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updated:
+		}
+		data, offset, updated = console.since(offset)
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func handleGuestStatus(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config, console *consoleBuffer) {
+	if r.Method != http.MethodGet {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	if !authenticateConsoleRequest(logger, w, r, cfg) {
+		return
+	}
+
+	body, err := json.Marshal(api.GuestStatus{Booted: console.isGuestBooted()})
+	if err != nil {
+		logger.Error("could not marshal body", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck // Not much to do with the error here.
+}
+
+func listenForConsoleRequests(
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg *Config,
+	vmSpec *vmv1.VirtualMachineSpec,
+	console *consoleBuffer,
+	readiness *guestReadiness,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	consoleLogger := logger.Named("http-handlers").Named("console")
+	mux.HandleFunc("/console", func(w http.ResponseWriter, r *http.Request) {
+		handleConsole(consoleLogger, w, r, cfg, console)
+	})
+	guestStatusLogger := logger.Named("http-handlers").Named("guest_status")
+	mux.HandleFunc("/guest_status", func(w http.ResponseWriter, r *http.Request) {
+		handleGuestStatus(guestStatusLogger, w, r, cfg, console)
+	})
+	// nb: not authenticated, because it's used by the kubelet for the pod's readiness.
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		handleReady(w, r, readiness)
+	})
+	// nb: also served here because of the lack of WriteTimeout - commands may take a while.
+	execLogger := logger.Named("http-handlers").Named("exec")
+	mux.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
+		handleExec(execLogger, w, r, cfg, vmSpec)
+	})
+	server := http.Server{
+		Addr:              listenAddr(vmSpec, vmv1.ConsolePort),
+		Handler:           mux,
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		// no WriteTimeout: following the console can take arbitrarily long.
+	}
+	l, err := listen(server.Addr)
+	if err != nil {
+		logger.Error("console server failed to listen", zap.Error(err))
+		return
+	}
+	errChan := make(chan error)
+	go func() {
+		errChan <- server.Serve(l)
+	}()
+	select {
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			logger.Info("console server closed")
+		} else if err != nil {
+			logger.Error("console server exited with error", zap.Error(err))
+		}
+	case <-ctx.Done():
+		// Shutdown waits for active connections, which followers never end on their own.
+		err := server.Close()
+		logger.Info("shut down console server", zap.Error(err))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// waitForOutput waits until everything in expected has been forwarded to the buffer
+func waitForOutput(t *testing.T, buffer *consoleBuffer, expected string) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		data, _, _ := buffer.since(0)
+		return string(data) == expected
+	}, time.Second, 10*time.Millisecond)
+	data, _, _ := buffer.since(0)
+	assert.Equal(t, expected, string(data))
+}
+
+// The console must keep working after an in-place upgrade: the new runner takes over the pipe from
+// QEMU, along with the output so far.
+func TestConsoleOutputUpgrade(t *testing.T) {
+	logger := zap.NewNop()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer w.Close()
+
+	old := startConsoleOutput(logger, r, newConsoleBuffer())
+	_, err = w.WriteString("booting\nneonvm: guest booted\n")
+	require.NoError(t, err)
+	waitForOutput(t, old.buffer, "booting\nneonvm: guest booted\n")
+
+	old.pause()
+	console, err := old.handOff()
+	require.NoError(t, err)
+	require.NotNil(t, console)
+
+	// Written while the upgrade is in progress: this must be left in the pipe for the new runner.
+	_, err = w.WriteString("during upgrade\n")
+	require.NoError(t, err)
+
+	// The state goes through the state file, and the previous runner's fds are closed by exec.
+	data, err := json.Marshal(upgradeState{
+		ProtocolVersion: upgradeProtocolVersion,
+		QEMUPid:         1,
+		CgroupPath:      "",
+		Listeners:       nil,
+		Console:         console,
+	})
+	require.NoError(t, err)
+	var state upgradeState
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.NoError(t, r.Close())
+
+	resumed := resumeConsoleOutput(logger, state.Console)
+	assert.True(t, resumed.buffer.isGuestBooted())
+	_, err = w.WriteString("after upgrade\n")
+	require.NoError(t, err)
+	waitForOutput(t, resumed.buffer, "booting\nneonvm: guest booted\nduring upgrade\nafter upgrade\n")
+
+	// Once QEMU exits, forwarding stops
+	require.NoError(t, w.Close())
+	select {
+	case <-resumed.stopped():
+	case <-time.After(time.Second):
+		t.Fatal("forwarding did not stop when the pipe was closed")
+	}
+	assert.True(t, resumed.ended())
+}
+
+// If the upgrade fails, the current runner continues forwarding output
+func TestConsoleOutputUpgradeFailed(t *testing.T) {
+	logger := zap.NewNop()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer w.Close()
+	defer r.Close()
+
+	console := startConsoleOutput(logger, r, newConsoleBuffer())
+	console.pause()
+	state, err := console.handOff()
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	require.NoError(t, os.NewFile(state.Fd, "qemu-stdout").Close())
+
+	_, err = w.WriteString("still here\n")
+	require.NoError(t, err)
+	console.resume(logger)
+	waitForOutput(t, console.buffer, "still here\n")
+}
+
+// If QEMU's output has already ended, there's nothing to hand off
+func TestConsoleOutputUpgradeAfterEOF(t *testing.T) {
+	logger := zap.NewNop()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+
+	console := startConsoleOutput(logger, r, newConsoleBuffer())
+	require.NoError(t, w.Close())
+	<-console.stopped()
+
+	console.pause()
+	state, err := console.handOff()
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	resumed := resumeConsoleOutput(logger, state)
+	<-resumed.stopped()
+	assert.True(t, resumed.ended())
+}
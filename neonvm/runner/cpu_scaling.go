@@ -0,0 +1,74 @@
+package main
+
+// CPU scaling modes
+//
+// With QMPHotplug (the default), the guest starts with .spec.guest.cpus.min CPUs, and the
+// controller hotplugs or unplugs vCPUs through QMP to match ceil(.cpus.use). The other modes start
+// the guest with all .cpus.max CPUs, so the controller only changes the cgroup limit via
+// '/cpu_change':
+//
+//   - With CgroupThrottling, that's all - the guest always sees all of its CPUs.
+//   - With GuestCpuset, the guest boots with only ceil(.cpus.use) CPUs online (via the kernel's
+//     'maxcpus' parameter), and on each change we send the new count to the guest over a
+//     virtio-serial port, where it's read by the cpu-scaler script (see vm-builder), which onlines
+//     or offlines CPUs to match.
+//
+// Because '/cpu_change' is only served when the runner manages the cgroup itself, GuestCpuset
+// can't be used with -skip-cgroup-management.
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	cpuScalerSerialSocket = "/vm/cpu-scaler.sock"
+	cpuScalerSerialPort   = "tech.neon.cpus.0"
+)
+
+// smpArgs returns the value of QEMU's -smp argument for a VM that isn't resized by restart
+func smpArgs(cfg *Config, vmSpec *vmv1.VirtualMachineSpec) string {
+	cpus := vmSpec.Guest.CPUs.Min.RoundedUp()
+	if cfg.cpuScalingMode != vmv1.CPUScalingModeQMPHotplug {
+		cpus = vmSpec.Guest.CPUs.Max.RoundedUp()
+	}
+	return fmt.Sprintf(
+		"cpus=%d,maxcpus=%d,sockets=1,cores=%d,threads=1",
+		cpus,
+		vmSpec.Guest.CPUs.Max.RoundedUp(),
+		vmSpec.Guest.CPUs.Max.RoundedUp(),
+	)
+}
+
+// cpuScalerArgs returns the QEMU arguments for the virtio-serial port used to set the number of
+// online CPUs, if the CPU scaling mode is GuestCpuset
+func cpuScalerArgs(cfg *Config) []string {
+	if cfg.cpuScalingMode != vmv1.CPUScalingModeGuestCpuset {
+		return nil
+	}
+	return []string{
+		"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=cpus", cpuScalerSerialSocket),
+		"-device", fmt.Sprintf("virtserialport,chardev=cpus,name=%s", cpuScalerSerialPort),
+	}
+}
+
+// sendOnlineCPUs sends the number of CPUs that should be online to the guest. The guest onlines or
+// offlines its CPUs asynchronously, so this doesn't wait for that to complete.
+func sendOnlineCPUs(count uint32) error {
+	conn, err := net.DialTimeout("unix", cpuScalerSerialSocket, time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to serial port: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%d\n", count); err != nil {
+		return fmt.Errorf("failed to write to serial port: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+// Time-sliced CPU bursting above .spec.guest.cpus.use
+//
+// When the VM has .spec.guest.cpuBurst set, we periodically check whether QEMU's cgroup is being
+// throttled at its current limit. If it is, and the host has enough idle CPU, we raise the limit to
+// .spec.guest.cpuBurst.limit for up to .maxDurationSeconds, and then wait .cooldownSeconds before
+// bursting again. The burst is ended early if the host runs low on idle CPU, or if the VM is scaled
+// to at least the burst limit.
+//
+// The CPU allowed above .spec.guest.cpus.use while bursting is accumulated and reported with
+// /cpu_current, so that it can be billed separately from the VM's allocation.
+//
+// Because the cgroup's quota is raised while bursting, /cpu_current reports the base CPU (i.e.
+// whatever the controller last set) instead of reading it from the cgroup.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/cgroups/v3"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	// cpuBurstCheckInterval is how often we check whether to start or stop bursting
+	cpuBurstCheckInterval = time.Second
+	// cpuBurstThrottledThreshold is the fraction of cgroup periods that must have been throttled
+	// since the last check for us to start bursting.
+	cpuBurstThrottledThreshold = 0.2
+	// cpuBurstHostIdleReserve is the idle CPU on the host that we leave for everything else. We
+	// only start bursting if there's at least this much idle CPU in addition to the burst, and stop
+	// bursting if the host's idle CPU drops below it.
+	cpuBurstHostIdleReserve = vmv1.MilliCPU(500)
+)
+
+// cpuBurster owns QEMU's cgroup CPU limit, raising it above the VM's allocation while bursting.
+type cpuBurster struct {
+	cgroupPath string
+	// config is .spec.guest.cpuBurst, or nil if bursting is disabled
+	config  *vmv1.CPUBurst
+	metrics *runnerMetrics
+
+	mu sync.Mutex
+	// base is the CPU allocated to the VM, as last set by the controller
+	base      vmv1.MilliCPU
+	bursting  bool
+	burstEnd  time.Time
+	coolUntil time.Time
+	// burstMilliCPUSeconds is the total CPU allowed above base while bursting
+	burstMilliCPUSeconds float64
+}
+
+func newCPUBurster(vmSpec *vmv1.VirtualMachineSpec, cgroupPath string, metrics *runnerMetrics) (*cpuBurster, error) {
+	// Use the cgroup's current limit as the base, rather than the spec: after an in-place upgrade,
+	// the VM may have been scaled since it started.
+	base, err := getCgroupQuota(cgroupPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not get cgroup quota: %w", err)
+	}
+
+	return &cpuBurster{
+		cgroupPath:           cgroupPath,
+		config:               vmSpec.Guest.CPUBurst,
+		metrics:              metrics,
+		mu:                   sync.Mutex{},
+		base:                 *base,
+		bursting:             false,
+		burstEnd:             time.Time{},
+		coolUntil:            time.Time{},
+		burstMilliCPUSeconds: 0,
+	}, nil
+}
+
+// setBase sets the CPU allocated to the VM, ending any burst that's no longer above it.
+func (b *cpuBurster) setBase(logger *zap.Logger, cpu vmv1.MilliCPU) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.base = cpu
+	if b.bursting && b.config.Limit <= cpu {
+		b.stopBurst(logger, "VM scaled to at least the burst limit")
+	}
+	return setCgroupLimit(logger, b.limit(), b.cgroupPath)
+}
+
+// current returns the state to report to the controller.
+func (b *cpuBurster) current() api.VCPUCgroup {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var burst *vmv1.CPUBurstStatus
+	if b.config != nil {
+		burst = &vmv1.CPUBurstStatus{
+			Active:               b.bursting,
+			MilliCPUSecondsTotal: int64(b.burstMilliCPUSeconds),
+		}
+	}
+	return api.VCPUCgroup{VCPUs: b.base, Burst: burst}
+}
+
+// limit returns the CPU that the cgroup should be limited to. b.mu must be held.
+func (b *cpuBurster) limit() vmv1.MilliCPU {
+	if b.bursting {
+		return max(b.base, b.config.Limit)
+	}
+	return b.base
+}
+
+// stopBurst ends the current burst, without updating the cgroup. b.mu must be held.
+func (b *cpuBurster) stopBurst(logger *zap.Logger, reason string) {
+	logger.Info("Stopping CPU burst", zap.String("reason", reason))
+	b.bursting = false
+	b.coolUntil = time.Now().Add(time.Duration(b.config.CooldownSeconds) * time.Second)
+	b.metrics.cpuBurstActive.Set(0)
+}
+
+// run periodically checks whether to start or stop bursting, until the context is canceled.
+func (b *cpuBurster) run(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger = logger.Named("cpu-burst")
+
+	if b.config == nil {
+		return
+	}
+
+	ticker := time.NewTicker(cpuBurstCheckInterval)
+	defer ticker.Stop()
+
+	lastCheck := time.Now()
+	lastThrottling, err := getCgroupThrottling(b.cgroupPath)
+	if err != nil {
+		logger.Error("Could not get cgroup throttling stats, CPU bursting disabled", zap.Error(err))
+		return
+	}
+	lastHost, err := getHostCPUTimes()
+	if err != nil {
+		logger.Error("Could not get host CPU stats, CPU bursting disabled", zap.Error(err))
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		throttling, err := getCgroupThrottling(b.cgroupPath)
+		if err != nil {
+			logger.Error("Could not get cgroup throttling stats", zap.Error(err))
+			continue
+		}
+		host, err := getHostCPUTimes()
+		if err != nil {
+			logger.Error("Could not get host CPU stats", zap.Error(err))
+			continue
+		}
+
+		throttledFraction := throttling.throttledFractionSince(lastThrottling)
+		hostIdle := host.idleSince(lastHost)
+		elapsed := now.Sub(lastCheck)
+		lastThrottling, lastHost, lastCheck = throttling, host, now
+
+		b.check(logger, now, elapsed, throttledFraction, hostIdle)
+	}
+}
+
+func (b *cpuBurster) check(
+	logger *zap.Logger,
+	now time.Time,
+	elapsed time.Duration,
+	throttledFraction float64,
+	hostIdle vmv1.MilliCPU,
+) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.bursting {
+		extra := b.config.Limit - b.base
+		b.burstMilliCPUSeconds += float64(extra) * elapsed.Seconds()
+		b.metrics.cpuBurstCPUSecondsTotal.Add(extra.AsFloat64() * elapsed.Seconds())
+
+		var reason string
+		if now.After(b.burstEnd) {
+			reason = "reached maximum duration"
+		} else if hostIdle < cpuBurstHostIdleReserve {
+			reason = "host is low on idle CPU"
+		}
+		if reason == "" {
+			return
+		}
+
+		b.stopBurst(logger, reason)
+		if err := setCgroupLimit(logger, b.limit(), b.cgroupPath); err != nil {
+			logger.Error("Could not reset cgroup limit after CPU burst", zap.Error(err))
+		}
+		return
+	}
+
+	if b.config.Limit <= b.base || throttledFraction < cpuBurstThrottledThreshold {
+		return
+	} else if now.Before(b.coolUntil) {
+		b.metrics.cpuBurstsDeniedTotal.WithLabelValues("cooldown").Inc()
+		return
+	} else if hostIdle < b.config.Limit-b.base+cpuBurstHostIdleReserve {
+		b.metrics.cpuBurstsDeniedTotal.WithLabelValues("host_headroom").Inc()
+		return
+	}
+
+	logger.Info(
+		"Starting CPU burst",
+		zap.Float64("throttledFraction", throttledFraction),
+		zap.Any("base", b.base),
+		zap.Any("limit", b.config.Limit),
+		zap.Any("hostIdle", hostIdle),
+	)
+	b.bursting = true
+	b.burstEnd = now.Add(time.Duration(b.config.MaxDurationSeconds) * time.Second)
+	if err := setCgroupLimit(logger, b.limit(), b.cgroupPath); err != nil {
+		logger.Error("Could not set cgroup limit for CPU burst", zap.Error(err))
+		b.bursting = false
+		return
+	}
+	b.metrics.cpuBurstActive.Set(1)
+	b.metrics.cpuBurstsTotal.Inc()
+}
+
+// cgroupThrottling is the CFS bandwidth statistics for a cgroup, from its cpu.stat
+type cgroupThrottling struct {
+	periods   uint64
+	throttled uint64
+}
+
+func (t cgroupThrottling) throttledFractionSince(prev cgroupThrottling) float64 {
+	if t.periods <= prev.periods || t.throttled < prev.throttled {
+		return 0
+	}
+	return float64(t.throttled-prev.throttled) / float64(t.periods-prev.periods)
+}
+
+func getCgroupThrottling(cgroupPath string) (cgroupThrottling, error) {
+	var path string
+	if cgroups.Mode() == cgroups.Unified {
+		path = filepath.Join(cgroupMountPoint, cgroupPath, "cpu.stat")
+	} else {
+		path = filepath.Join(cgroupMountPoint, "cpu", cgroupPath, "cpu.stat")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cgroupThrottling{}, err
+	}
+
+	var stats cgroupThrottling
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "nr_periods":
+			dst = &stats.periods
+		case "nr_throttled":
+			dst = &stats.throttled
+		default:
+			continue
+		}
+		if *dst, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return cgroupThrottling{}, fmt.Errorf("could not parse %s: %w", fields[0], err)
+		}
+	}
+	return stats, nil
+}
+
+// hostCPUTimes is the aggregate CPU time on the host, from /proc/stat, in jiffies
+type hostCPUTimes struct {
+	total uint64
+	idle  uint64
+	cpus  int
+}
+
+// idleSince returns the average idle CPU on the host since prev
+func (t hostCPUTimes) idleSince(prev hostCPUTimes) vmv1.MilliCPU {
+	if t.total <= prev.total || t.idle < prev.idle {
+		return 0
+	}
+	fraction := float64(t.idle-prev.idle) / float64(t.total-prev.total)
+	return vmv1.MilliCPU(fraction * float64(t.cpus) * 1000)
+}
+
+func getHostCPUTimes() (hostCPUTimes, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return hostCPUTimes{}, err
+	}
+
+	var times hostCPUTimes
+	foundTotal := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "cpu" {
+			if strings.HasPrefix(fields[0], "cpu") {
+				times.cpus += 1
+			}
+			continue
+		}
+
+		// cpu  user nice system idle iowait irq softirq steal guest guest_nice
+		//
+		// guest time is already included in user time, so we only sum the first 8 values.
+		if len(fields) < 9 {
+			return hostCPUTimes{}, fmt.Errorf("unexpected /proc/stat cpu line: %q", scanner.Text())
+		}
+		for i, f := range fields[1:9] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return hostCPUTimes{}, fmt.Errorf("could not parse /proc/stat: %w", err)
+			}
+			times.total += v
+			if i == 3 || i == 4 { // idle, iowait
+				times.idle += v
+			}
+		}
+		foundTotal = true
+	}
+	if !foundTotal {
+		return hostCPUTimes{}, errors.New("no aggregate cpu line in /proc/stat")
+	}
+	return times, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+// Host devices passed through to the guest with VFIO
+//
+// Each of .spec.guest.devices is allocated to the runner container by the node's device plugin,
+// which mounts the device's /dev/vfio group into the container and tells us which devices we got
+// through an environment variable named after the resource, in the same format as KubeVirt's
+// device plugins:
+//
+//   - PCI_RESOURCE_<resource>: a comma-separated list of PCI addresses
+//   - MDEV_PCI_RESOURCE_<resource>: a comma-separated list of mediated device UUIDs
+//
+// where <resource> is the resource name in uppercase, with '.', '/', and '-' replaced by '_'. If
+// there's more than one device of the same resource, they're assigned in order.
+//
+// PCI devices that are still bound to their host driver are rebound to vfio-pci before QEMU starts,
+// and given back to the host driver once it exits. We tell which devices we rebound by their
+// driver_override, so that this also works for devices bound by a runner from before an in-place
+// upgrade. Devices that the node already bound to vfio-pci are left alone. Mediated devices are
+// always bound to vfio_mdev by the kernel, so there's nothing to do for them.
+//
+// The container's own /sys is read-only, so binding goes through the host's sysfs, which
+// neonvm-controller mounts at /host/sys.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	hostSysfsPath = "/host/sys"
+
+	vfioPCIDriver = "vfio-pci"
+)
+
+// passthroughDevice is one of .spec.guest.devices, as allocated by the device plugin
+type passthroughDevice struct {
+	name string
+	typ  vmv1.GuestDeviceType
+	// address is the PCI address of PCI devices, or the UUID of mediated devices
+	address string
+}
+
+// deviceResourceEnv returns the name of the environment variable that the device plugin lists the
+// allocated devices of the resource in
+func deviceResourceEnv(typ vmv1.GuestDeviceType, resourceName string) string {
+	name := strings.ToUpper(strings.NewReplacer(".", "_", "/", "_", "-", "_").Replace(resourceName))
+	if typ == vmv1.GuestDeviceTypeMediated {
+		return "MDEV_PCI_RESOURCE_" + name
+	}
+	return "PCI_RESOURCE_" + name
+}
+
+// allocatedDevices returns the devices that the device plugin allocated for each of the VM's
+// .spec.guest.devices
+func allocatedDevices(vmSpec *vmv1.VirtualMachineSpec) ([]passthroughDevice, error) {
+	available := make(map[string][]string)
+
+	var devices []passthroughDevice
+	for _, d := range vmSpec.Guest.Devices {
+		typ := d.Type
+		if typ == "" {
+			typ = vmv1.GuestDeviceTypePCI
+		}
+		env := deviceResourceEnv(typ, string(d.ResourceName))
+		if _, ok := available[env]; !ok {
+			value, ok := os.LookupEnv(env)
+			if !ok {
+				return nil, fmt.Errorf("device %q: environment variable %s missing, was %s allocated by a device plugin?", d.Name, env, d.ResourceName)
+			}
+			available[env] = strings.Split(value, ",")
+		}
+		if len(available[env]) == 0 || available[env][0] == "" {
+			return nil, fmt.Errorf("device %q: not enough devices in %s", d.Name, env)
+		}
+
+		devices = append(devices, passthroughDevice{
+			name:    d.Name,
+			typ:     typ,
+			address: strings.TrimSpace(available[env][0]),
+		})
+		available[env] = available[env][1:]
+	}
+	return devices, nil
+}
+
+// sysfsPath returns the path of the device in the host's sysfs
+func (d passthroughDevice) sysfsPath() string {
+	if d.typ == vmv1.GuestDeviceTypeMediated {
+		return filepath.Join(hostSysfsPath, "bus/mdev/devices", d.address)
+	}
+	return filepath.Join(hostSysfsPath, "bus/pci/devices", d.address)
+}
+
+// qemuArgs returns the QEMU arguments to pass the device through to the guest
+func (d passthroughDevice) qemuArgs() []string {
+	device := fmt.Sprintf("vfio-pci,id=dev-%s,host=%s", d.name, d.address)
+	if d.typ == vmv1.GuestDeviceTypeMediated {
+		// QEMU is given the path in the container's sysfs, which it can read.
+		device = fmt.Sprintf("vfio-pci,id=dev-%s,sysfsdev=/sys/bus/mdev/devices/%s", d.name, d.address)
+	}
+	return []string{"-device", device}
+}
+
+// bind rebinds the device to vfio-pci if it isn't already, and makes its VFIO group accessible to
+// QEMU
+func (d passthroughDevice) bind(logger *zap.Logger) error {
+	if d.typ == vmv1.GuestDeviceTypePCI {
+		driver, err := d.driver()
+		if err != nil {
+			return err
+		}
+		if driver != vfioPCIDriver {
+			logger.Info("binding device to vfio-pci", zap.String("device", d.name), zap.String("address", d.address), zap.String("driver", driver))
+			if err := writeSysfs(filepath.Join(d.sysfsPath(), "driver_override"), vfioPCIDriver); err != nil {
+				return err
+			}
+			if driver != "" {
+				if err := writeSysfs(filepath.Join(d.sysfsPath(), "driver/unbind"), d.address); err != nil {
+					return err
+				}
+			}
+			if err := writeSysfs(filepath.Join(hostSysfsPath, "bus/pci/drivers_probe"), d.address); err != nil {
+				return err
+			}
+			if driver, err := d.driver(); err != nil {
+				return err
+			} else if driver != vfioPCIDriver {
+				return fmt.Errorf("device %q is bound to %q after probing, expected %s", d.name, driver, vfioPCIDriver)
+			}
+		}
+	}
+
+	group, err := os.Readlink(filepath.Join(d.sysfsPath(), "iommu_group"))
+	if err != nil {
+		return fmt.Errorf("failed to get IOMMU group of device %q: %w", d.name, err)
+	}
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := os.Chown(filepath.Join("/dev/vfio", filepath.Base(group)), 36, 34); err != nil {
+		return fmt.Errorf("failed to chown VFIO group of device %q: %w", d.name, err)
+	}
+	return nil
+}
+
+// release gives the device back to its host driver, if it was rebound by bind
+func (d passthroughDevice) release(logger *zap.Logger) error {
+	if d.typ != vmv1.GuestDeviceTypePCI {
+		return nil
+	}
+
+	override, err := os.ReadFile(filepath.Join(d.sysfsPath(), "driver_override"))
+	if err != nil {
+		return fmt.Errorf("failed to read driver_override of device %q: %w", d.name, err)
+	}
+	if strings.TrimSpace(string(override)) != vfioPCIDriver {
+		return nil
+	}
+
+	logger.Info("releasing device from vfio-pci", zap.String("device", d.name), zap.String("address", d.address))
+	if driver, err := d.driver(); err != nil {
+		return err
+	} else if driver != "" {
+		if err := writeSysfs(filepath.Join(d.sysfsPath(), "driver/unbind"), d.address); err != nil {
+			return err
+		}
+	}
+	// Writing a newline clears the override.
+	if err := writeSysfs(filepath.Join(d.sysfsPath(), "driver_override"), "\n"); err != nil {
+		return err
+	}
+	return writeSysfs(filepath.Join(hostSysfsPath, "bus/pci/drivers_probe"), d.address)
+}
+
+// driver returns the name of the driver that the PCI device is bound to, or "" if there isn't one
+func (d passthroughDevice) driver() (string, error) {
+	link, err := os.Readlink(filepath.Join(d.sysfsPath(), "driver"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get driver of device %q: %w", d.name, err)
+	}
+	return filepath.Base(link), nil
+}
+
+func writeSysfs(path string, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %w", value, path, err)
+	}
+	return nil
+}
+
+// setupDevices binds the VM's devices for VFIO, and returns the QEMU arguments to pass them through
+// to the guest
+func setupDevices(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) ([]string, error) {
+	devices, err := allocatedDevices(vmSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, d := range devices {
+		if err := d.bind(logger); err != nil {
+			return nil, err
+		}
+		args = append(args, d.qemuArgs()...)
+	}
+
+	// VFIO pins all of the guest's memory, which is charged against QEMU's RLIMIT_MEMLOCK. QEMU
+	// inherits our limit, so raise it as far as it goes.
+	unlimited := &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, unlimited); err != nil {
+		return nil, fmt.Errorf("failed to raise RLIMIT_MEMLOCK: %w", err)
+	}
+
+	return args, nil
+}
+
+// releaseDevices gives the VM's devices back to their host drivers, after QEMU has exited
+func releaseDevices(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) {
+	devices, err := allocatedDevices(vmSpec)
+	if err != nil {
+		logger.Error("failed to get devices to release", zap.Error(err))
+		return
+	}
+	for _, d := range devices {
+		if err := d.release(logger); err != nil {
+			logger.Error("failed to release device", zap.String("device", d.name), zap.Error(err))
+		}
+	}
+}
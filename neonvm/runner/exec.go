@@ -0,0 +1,143 @@
+package main
+
+// Running commands in the guest
+//
+// POST /exec on the console server runs the api.ExecRequest's command in the guest over SSH, as
+// 'ssh guest-vm' would from inside the container, and responds with an api.ExecResult once the
+// command has finished. It's used by the controller's exec API (see controllers/exec_api.go), so
+// that users can run commands in VMs with access controlled by RBAC, rather than by holding the
+// VM's SSH key.
+//
+// Requests must authenticate with the QMP auth token. Unlike /console, the endpoint is refused
+// entirely if the runner wasn't given one, because it would otherwise run commands for anyone that
+// can reach the pod. Because commands are run over SSH, this only works for VMs with
+// .spec.enableSSH.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// guestSSHCommand returns the command to run the given command in the guest over SSH
+func guestSSHCommand(ctx context.Context, command []string) *exec.Cmd {
+	// ssh passes the command to the guest's shell as a single string, so each argument needs to
+	// be quoted to be kept as-is.
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = fmt.Sprintf("'%s'", strings.ReplaceAll(arg, "'", `'\''`))
+	}
+	return exec.CommandContext(ctx, "ssh", "-o", "BatchMode=yes", guestHostname, strings.Join(quoted, " "))
+}
+
+// limitedBuffer is an io.Writer that keeps only the first limit bytes written to it
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.buf.Len(); len(p) > remaining {
+		b.truncated = true
+		b.buf.Write(p[:remaining])
+	} else {
+		b.buf.Write(p)
+	}
+	// Report everything as written, so that the command isn't stopped by a short write.
+	return len(p), nil
+}
+
+func handleExec(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config, vmSpec *vmv1.VirtualMachineSpec) {
+	if r.Method != http.MethodPost {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	if cfg.qmpAuthTokenHash == "" {
+		logger.Warn("denied exec request: no QMP auth token configured", zap.String("remoteAddr", r.RemoteAddr))
+		w.WriteHeader(403)
+		_, _ = w.Write([]byte("exec is disabled without a QMP auth token"))
+		return
+	}
+	if !authenticateConsoleRequest(logger, w, r, cfg) {
+		return
+	}
+	if vmSpec.EnableSSH == nil || !*vmSpec.EnableSSH {
+		w.WriteHeader(409)
+		_, _ = w.Write([]byte("VM does not have .spec.enableSSH"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		logger.Error("could not read body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+	var req api.ExecRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Error("could not unmarshal body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+	if len(req.Command) == 0 {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("command must not be empty"))
+		return
+	}
+
+	timeoutSeconds := req.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = api.ExecDefaultTimeoutSeconds
+	}
+	timeoutSeconds = min(timeoutSeconds, api.ExecMaxTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(timeoutSeconds))
+	defer cancel()
+
+	logger.Info("running command in guest", zap.Strings("command", req.Command))
+
+	stdout := &limitedBuffer{buf: bytes.Buffer{}, limit: api.ExecMaxOutputBytes, truncated: false}
+	stderr := &limitedBuffer{buf: bytes.Buffer{}, limit: api.ExecMaxOutputBytes, truncated: false}
+	cmd := guestSSHCommand(ctx, req.Command)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			logger.Error("could not run command", zap.Error(err))
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	resp, err := json.Marshal(api.ExecResult{
+		ExitCode:  exitCode,
+		Stdout:    stdout.buf.String(),
+		Stderr:    stderr.buf.String(),
+		Truncated: stdout.truncated || stderr.truncated,
+	})
+	if err != nil {
+		logger.Error("could not marshal response", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resp) //nolint:errcheck // Not much to do with the error here.
+}
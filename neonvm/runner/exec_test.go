@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestExecAuthentication(t *testing.T) {
+	spec := &vmv1.VirtualMachineSpec{EnableSSH: lo.ToPtr(true)}
+	// The body isn't a valid request, so any request that gets through authentication fails with
+	// 400 instead of trying to run the command.
+	doExec := func(cfg *Config, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/exec", strings.NewReader("not json"))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handleExec(zap.NewNop(), w, req, cfg, spec)
+		return w.Code
+	}
+
+	// Without a token configured, /exec is refused for everyone
+	assert.Equal(t, 403, doExec(&Config{}, ""))
+	assert.Equal(t, 403, doExec(&Config{}, "some-token"))
+
+	cfg := &Config{qmpAuthTokenHash: api.QMPAuthTokenHash("secret")}
+	assert.Equal(t, 401, doExec(cfg, ""))
+	assert.Equal(t, 401, doExec(cfg, "wrong"))
+	assert.Equal(t, 400, doExec(cfg, "secret"))
+}
@@ -0,0 +1,167 @@
+package main
+
+// Images for hotpluggable disks
+//
+// Hotpluggable disks that are in the VM's spec when the runner starts are created like any other
+// emptyDisk. Disks added later are attached by neonvm-controller over QMP, but QEMU can only open
+// an image that already exists in the runner pod, so the controller first asks us to create it:
+//
+//   - PUT /hotplug_disks/<name> starts creating the disk's image, if it doesn't exist yet. It
+//     responds with 202 while the image is being created, and 200 with the image's path once it's
+//     ready. Creating large images can take longer than the server's write timeout, hence the
+//     polling.
+//   - DELETE /hotplug_disks/<name> removes the image, after the controller has detached the disk.
+//
+// The guest needs to know where to mount disks that are attached after it's booted, so we store
+// the mount path in the "last mounted on" field of the filesystem's superblock (see mke2fs -M).
+// The guest's udev rule for hotplugged disks reads it from there.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// hotplugDiskCreations tracks the images that are being created, by disk name. Once creation has
+// finished, the entry stores the error, if any, until it's returned to the controller.
+var hotplugDiskCreations = struct {
+	sync.Mutex
+	inProgress map[string]bool
+	errors     map[string]error
+}{
+	Mutex:      sync.Mutex{},
+	inProgress: make(map[string]bool),
+	errors:     make(map[string]error),
+}
+
+func hotplugDiskPath(name string) string {
+	return fmt.Sprintf("%s/%s.qcow2", mountedDiskPath, name)
+}
+
+func handleHotplugDisk(logger *zap.Logger, w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/hotplug_disks/")
+	if len(validation.IsDNS1123Label(name)) != 0 {
+		logger.Error("invalid disk name", zap.String("path", r.URL.Path))
+		w.WriteHeader(400)
+		return
+	}
+	logger = logger.With(zap.String("diskName", name))
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("could not read body", zap.Error(err))
+			w.WriteHeader(400)
+			return
+		}
+		var disk api.HotplugDisk
+		if err := json.Unmarshal(body, &disk); err != nil {
+			logger.Error("could not parse body", zap.Error(err))
+			w.WriteHeader(400)
+			return
+		}
+		handleCreateHotplugDisk(logger, w, name, disk)
+	case http.MethodDelete:
+		if err := os.Remove(hotplugDiskPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("could not remove hotplug disk image", zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		logger.Info("removed hotplug disk image")
+		w.WriteHeader(200)
+	default:
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+	}
+}
+
+func handleCreateHotplugDisk(logger *zap.Logger, w http.ResponseWriter, name string, disk api.HotplugDisk) {
+	path := hotplugDiskPath(name)
+
+	hotplugDiskCreations.Lock()
+	defer hotplugDiskCreations.Unlock()
+
+	if hotplugDiskCreations.inProgress[name] {
+		w.WriteHeader(202)
+		return
+	}
+	if err, ok := hotplugDiskCreations.errors[name]; ok {
+		// Report the error once, so that the next request tries again.
+		delete(hotplugDiskCreations.errors, name)
+		if err != nil {
+			logger.Error("could not create hotplug disk image", zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+	} else if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		logger.Info("creating QCOW2 image for hotplug disk", zap.String("size", disk.Size.String()))
+		hotplugDiskCreations.inProgress[name] = true
+		go func() {
+			err := createHotplugQCOW2(name, path, disk)
+			hotplugDiskCreations.Lock()
+			defer hotplugDiskCreations.Unlock()
+			delete(hotplugDiskCreations.inProgress, name)
+			hotplugDiskCreations.errors[name] = err
+		}()
+		w.WriteHeader(202)
+		return
+	} else if err != nil {
+		logger.Error("could not check for hotplug disk image", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	body, err := json.Marshal(api.HotplugDiskImage{Path: path})
+	if err != nil {
+		logger.Error("could not marshal body", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck // Not much to do with the error here.
+}
+
+// createHotplugQCOW2 creates the image for a hotpluggable disk, like createQCOW2, but with the
+// disk's mount path stored in the filesystem for the guest.
+func createHotplugQCOW2(name string, path string, disk api.HotplugDisk) error {
+	ext4blockSize := int64(4096)
+	ext4blockCount := disk.Size.Value() / ext4blockSize
+	rawPath := path + ".raw"
+	defer os.Remove(rawPath)
+
+	if err := execFg("mkfs.ext4", "-q", "-L", name, "-M", disk.MountPath, "-b", fmt.Sprint(ext4blockSize), rawPath, fmt.Sprint(ext4blockCount)); err != nil {
+		return err
+	}
+	if disk.Discard {
+		// Store "discard" in the filesystem's default mount options, since the guest doesn't
+		// otherwise know about it.
+		if err := execFg("tune2fs", "-o", "discard", rawPath); err != nil {
+			return err
+		}
+	}
+
+	// Convert to a temporary path first, so that a partially written image is never attached.
+	tmpPath := path + ".tmp"
+	if err := execFg(QEMU_IMG_BIN, "convert", "-q", "-f", "raw", "-O", "qcow2", "-o", "cluster_size=2M,lazy_refcounts=on", rawPath, tmpPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := execFg("chown", "36:34", tmpPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,68 @@
+package main
+
+// Hugepage-backed guest memory
+//
+// With .spec.guest.memoryBacking hugepages, all of the guest's memory - the boot memory, plus any
+// DIMM slots or the virtio-mem device - is allocated from memfd backends with hugetlb enabled,
+// rather than ordinary anonymous memory. memfd doesn't need a hugetlbfs mount in the container; the
+// hugepages are charged to the pod's hugetlb cgroup, which is sized by the pod's "hugepages-<size>"
+// request.
+//
+// Memory that's plugged in is preallocated, so that QEMU fails cleanly if the node runs out of
+// hugepages, rather than the guest being killed by SIGBUS when it first touches the memory.
+//
+// nb: hotplugged DIMM slots are added by neonvm-controller, which creates matching backends over
+// QMP. See QmpAddMemoryBackend.
+
+import (
+	"fmt"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// bootMemoryBackendID is the ID of the memory backend used for the guest's boot memory, when it's
+// backed by hugepages
+const bootMemoryBackendID = "ram0"
+
+// hugepagesMachineOptions returns the options to append to QEMU's -machine argument to use the
+// hugepage-backed boot memory, or "" if the guest's memory isn't backed by hugepages
+func hugepagesMachineOptions(guest *vmv1.Guest) string {
+	if guest.HugepageSizeOrNil() == nil {
+		return ""
+	}
+	return fmt.Sprintf(",memory-backend=%s", bootMemoryBackendID)
+}
+
+// hugepagesBootMemoryArgs returns the extra QEMU arguments for the guest's boot memory of memSize
+// bytes, or nil if the guest's memory isn't backed by hugepages
+func hugepagesBootMemoryArgs(guest *vmv1.Guest, memSize int64) []string {
+	if guest.HugepageSizeOrNil() == nil {
+		return nil
+	}
+	return []string{"-object", memoryBackendObject(guest, bootMemoryBackendID, memSize, true)}
+}
+
+// memoryBackendObject returns the value of QEMU's -object argument for a memory backend with the
+// given ID and size, allocated from hugepages if the guest's memory is backed by them
+func memoryBackendObject(guest *vmv1.Guest, id string, size int64, prealloc bool) string {
+	pageSize := guest.HugepageSizeOrNil()
+	if pageSize == nil {
+		return fmt.Sprintf("memory-backend-ram,id=%s,size=%db", id, size)
+	}
+
+	opts := fmt.Sprintf("memory-backend-memfd,id=%s,size=%db,hugetlb=on,hugetlbsize=%d", id, size, pageSize.Value())
+	if prealloc {
+		opts += ",prealloc=on"
+	}
+	return opts
+}
+
+// virtioMemBlockSize returns the block size for the guest's virtio-mem device, which must be at
+// least the size of the pages backing it
+func virtioMemBlockSize(guest *vmv1.Guest) int64 {
+	const defaultBlockSize = 8 * 1024 * 1024 // 8 MiB
+	if pageSize := guest.HugepageSizeOrNil(); pageSize != nil && pageSize.Value() > defaultBlockSize {
+		return pageSize.Value()
+	}
+	return defaultBlockSize
+}
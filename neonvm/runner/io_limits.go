@@ -0,0 +1,165 @@
+package main
+
+// I/O limits for the VM's disks
+//
+// Disks with .ioLimits (and the root disk, with .spec.guest.rootDisk.ioLimits) are attached with
+// QEMU's block throttling options, so that the limits are in effect from boot. After that, changes
+// are applied by neonvm-controller over QMP, with block_set_io_throttle.
+//
+// QEMU doesn't count how often requests are throttled, so runner_vm_block_throttled_seconds_total
+// is an approximation: on each scrape, a disk is counted as throttled for the time since the last
+// scrape if its average rate of I/O over that time was close to one of its limits.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// throttledRatio is the fraction of a limit above which a disk is counted as throttled
+const throttledRatio = 0.95
+
+// throttleDriveOptions returns the options to add to a disk's -drive argument for its I/O limits,
+// which may be nil
+func throttleDriveOptions(limits *vmv1.DiskIOLimits) string {
+	t := limits.Throttle()
+
+	opts := ""
+	for _, o := range []struct {
+		name  string
+		value int64
+	}{
+		{"iops-total", t.IOPSTotal},
+		{"iops-read", t.IOPSRead},
+		{"iops-write", t.IOPSWrite},
+		{"bps-total", t.BPSTotal},
+		{"bps-read", t.BPSRead},
+		{"bps-write", t.BPSWrite},
+	} {
+		if o.value != 0 {
+			opts += fmt.Sprintf(",throttling.%s=%d", o.name, o.value)
+		}
+	}
+	return opts
+}
+
+// blockIOSample is a block device's cumulative I/O counters at a point in time
+type blockIOSample struct {
+	at      time.Time
+	rdOps   int64
+	wrOps   int64
+	rdBytes int64
+	wrBytes int64
+}
+
+// throttledLimits returns the names of the device's limits that its average rate of I/O between
+// the two samples was close to
+func throttledLimits(prev, cur blockIOSample, t vmv1.DiskIOThrottle) []string {
+	elapsed := cur.at.Sub(prev.at).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	rate := func(before, after int64) float64 {
+		return float64(after-before) / elapsed
+	}
+	rdOps, wrOps := rate(prev.rdOps, cur.rdOps), rate(prev.wrOps, cur.wrOps)
+	rdBytes, wrBytes := rate(prev.rdBytes, cur.rdBytes), rate(prev.wrBytes, cur.wrBytes)
+
+	var limits []string
+	for _, l := range []struct {
+		name  string
+		rate  float64
+		limit int64
+	}{
+		{"iops-total", rdOps + wrOps, t.IOPSTotal},
+		{"iops-read", rdOps, t.IOPSRead},
+		{"iops-write", wrOps, t.IOPSWrite},
+		{"bps-total", rdBytes + wrBytes, t.BPSTotal},
+		{"bps-read", rdBytes, t.BPSRead},
+		{"bps-write", wrBytes, t.BPSWrite},
+	} {
+		if l.limit != 0 && l.rate >= throttledRatio*float64(l.limit) {
+			limits = append(limits, l.name)
+		}
+	}
+	return limits
+}
+
+// blockLimit identifies one of a block device's limits, for runner_vm_block_throttled_seconds_total
+type blockLimit struct {
+	device string
+	limit  string
+}
+
+// collectIOLimits reports the I/O limits of each block device, and the time each has spent at
+// them, given the current samples of each device's counters.
+//
+// Failures aren't fatal, so that the rest of the block device stats are still reported.
+func (c *qemuStatsCollector) collectIOLimits(mon *qmp.SocketMonitor, samples map[string]blockIOSample, ch chan<- prometheus.Metric) {
+	var blocks []struct {
+		Device   string `json:"device"`
+		QDev     string `json:"qdev"`
+		Inserted *struct {
+			BPS    int64 `json:"bps"`
+			BPSRd  int64 `json:"bps_rd"`
+			BPSWr  int64 `json:"bps_wr"`
+			IOPS   int64 `json:"iops"`
+			IOPSRd int64 `json:"iops_rd"`
+			IOPSWr int64 `json:"iops_wr"`
+		} `json:"inserted"`
+	}
+	if err := qmpQuery(mon, "query-block", &blocks); err != nil {
+		c.logger.Warn("failed to query block device I/O limits", zap.Error(err))
+		return
+	}
+
+	for _, b := range blocks {
+		device := b.Device
+		if device == "" {
+			device = b.QDev
+		}
+		cur, ok := samples[device]
+		if b.Inserted == nil || !ok {
+			continue
+		}
+		t := vmv1.DiskIOThrottle{
+			IOPSTotal: b.Inserted.IOPS,
+			IOPSRead:  b.Inserted.IOPSRd,
+			IOPSWrite: b.Inserted.IOPSWr,
+			BPSTotal:  b.Inserted.BPS,
+			BPSRead:   b.Inserted.BPSRd,
+			BPSWrite:  b.Inserted.BPSWr,
+		}
+		if prev, ok := c.prevBlockSamples[device]; ok {
+			for _, limit := range throttledLimits(prev, cur, t) {
+				c.throttledSeconds[blockLimit{device: device, limit: limit}] += cur.at.Sub(prev.at).Seconds()
+			}
+		}
+
+		for _, l := range []struct {
+			name  string
+			value int64
+		}{
+			{"iops-total", t.IOPSTotal},
+			{"iops-read", t.IOPSRead},
+			{"iops-write", t.IOPSWrite},
+			{"bps-total", t.BPSTotal},
+			{"bps-read", t.BPSRead},
+			{"bps-write", t.BPSWrite},
+		} {
+			if l.value == 0 {
+				continue
+			}
+			seconds := c.throttledSeconds[blockLimit{device: device, limit: l.name}]
+			ch <- prometheus.MustNewConstMetric(c.blockIOLimit, prometheus.GaugeValue, float64(l.value), device, l.name)
+			ch <- prometheus.MustNewConstMetric(c.blockThrottled, prometheus.CounterValue, seconds, device, l.name)
+		}
+	}
+
+	c.prevBlockSamples = samples
+}
@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -36,6 +37,7 @@ import (
 	"github.com/jpillora/backoff"
 	"github.com/kdomanski/iso9660"
 	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 
@@ -47,15 +49,17 @@ import (
 )
 
 const (
-	QEMU_BIN          = "qemu-system-x86_64"
 	QEMU_IMG_BIN      = "qemu-img"
 	defaultKernelPath = "/vm/kernel/vmlinuz"
 
+	// rootDiskPath is the root disk if it's a qcow2 overlay, or restored from a snapshot. See
+	// rootDiskImage for the general case.
 	rootDiskPath                   = "/vm/images/rootdisk.qcow2"
 	runtimeDiskPath                = "/vm/images/runtime.iso"
 	mountedDiskPath                = "/vm/images"
 	qmpUnixSocketForSigtermHandler = "/vm/qmp-sigterm.sock"
 	logSerialSocket                = "/vm/log.sock"
+	terminationMessagePath         = "/dev/termination-log"
 	bufferedReaderSize             = 4096
 
 	sshAuthorizedKeysDiskPath   = "/vm/images/ssh-authorized-keys.iso"
@@ -66,6 +70,9 @@ const (
 	defaultNetworkBridgeName = "br-def"
 	defaultNetworkTapName    = "tap-def"
 	defaultNetworkCIDR       = "169.254.254.252/30"
+	// defaultNetworkCIDR6 is the unique local IPv6 prefix for the default network, used if the VM
+	// has IPv6 enabled. The guest gets its address with SLAAC, so the prefix must be a /64.
+	defaultNetworkCIDR6 = "fd00:6e65:6f6e::/64"
 
 	overlayNetworkBridgeName = "br-overlay"
 	overlayNetworkTapName    = "tap-overlay"
@@ -212,6 +219,7 @@ func createISO9660runtime(
 	disks []vmv1.Disk,
 	enableSSH bool,
 	swapInfo *vmv1.SwapInfo,
+	initialSwapSize resource.Quantity,
 	shmsize *resource.Quantity,
 ) error {
 	writer, err := iso9660.NewWriter()
@@ -262,7 +270,7 @@ func createISO9660runtime(
 	}
 
 	if swapInfo != nil && (swapInfo.SkipSwapon == nil || !*swapInfo.SkipSwapon) {
-		mounts = append(mounts, fmt.Sprintf("/neonvm/bin/sh /neonvm/runtime/resize-swap-internal.sh %d", swapInfo.Size.Value()))
+		mounts = append(mounts, fmt.Sprintf("/neonvm/bin/sh /neonvm/runtime/resize-swap-internal.sh %d", initialSwapSize.Value()))
 	}
 
 	if len(disks) != 0 {
@@ -282,6 +290,24 @@ func createISO9660runtime(
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/chmod 0777 %s`, disk.MountPath))
 			case disk.ConfigMap != nil || disk.Secret != nil:
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount -t iso9660 -o ro,mode=0644 $(/neonvm/bin/blkid -L %s) %s`, disk.Name, disk.MountPath))
+			case disk.VolumeSnapshot != nil:
+				// We don't control the filesystem's label, so find the device by its virtio serial
+				// number instead.
+				var opts []string
+				if disk.ReadOnly != nil && *disk.ReadOnly {
+					opts = append(opts, "ro")
+				}
+				if disk.VolumeSnapshot.Discard {
+					opts = append(opts, "discard")
+				}
+				optsFlag := ""
+				if len(opts) != 0 {
+					optsFlag = "-o " + strings.Join(opts, ",")
+				}
+				mounts = append(mounts, fmt.Sprintf(
+					`/neonvm/bin/mount %s /dev/$(/neonvm/bin/grep -lx %s /sys/block/vd*/serial | /neonvm/bin/cut -d/ -f4) %s`,
+					optsFlag, vmv1.DiskSerial(disk.Name), disk.MountPath,
+				))
 			case disk.Tmpfs != nil:
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/chmod 0777 %s`, disk.MountPath))
 				mounts = append(mounts, fmt.Sprintf(`/neonvm/bin/mount -t tmpfs -o size=%d %s %s`, disk.Tmpfs.Size.Value(), disk.Name, disk.MountPath))
@@ -597,6 +623,11 @@ type Config struct {
 	diskCacheSettings    string
 	memoryProvider       vmv1.MemoryProvider
 	autoMovableRatio     string
+	upgradeBinaryPath    string
+	resumeFrom           string
+	qmpAuthTokenHash     string
+	portForwarding       vmv1.PortForwarding
+	cpuScalingMode       vmv1.CPUScalingMode
 }
 
 func newConfig(logger *zap.Logger) *Config {
@@ -609,7 +640,13 @@ func newConfig(logger *zap.Logger) *Config {
 		diskCacheSettings:    "cache=none",
 		memoryProvider:       "", // Require that this is explicitly set. We'll check later.
 		autoMovableRatio:     "", // Require that this is explicitly set IFF memoryProvider is VirtioMem. We'll check later.
+		upgradeBinaryPath:    defaultUpgradeBinaryPath,
+		resumeFrom:           "",
+		qmpAuthTokenHash:     "",
+		portForwarding:       vmv1.PortForwardingIPTables,
+		cpuScalingMode:       vmv1.CPUScalingModeQMPHotplug,
 	}
+	printUpgradeProtocolVersion := false
 	flag.StringVar(&cfg.vmSpecDump, "vmspec", cfg.vmSpecDump,
 		"Base64 encoded VirtualMachine json specification")
 	flag.StringVar(&cfg.vmStatusDump, "vmstatus", cfg.vmStatusDump,
@@ -626,15 +663,35 @@ func newConfig(logger *zap.Logger) *Config {
 	flag.Func("memory-provider", "Set provider for memory hotplug", cfg.memoryProvider.FlagFunc)
 	flag.StringVar(&cfg.autoMovableRatio, "memhp-auto-movable-ratio",
 		cfg.autoMovableRatio, "Set value of kernel's memory_hotplug.auto_movable_ratio [virtio-mem only]")
+	flag.StringVar(&cfg.upgradeBinaryPath, "upgrade-binary", cfg.upgradeBinaryPath,
+		"Path of the new runner binary to re-execute on SIGUSR2")
+	flag.StringVar(&cfg.resumeFrom, strings.TrimPrefix(resumeFromArg, "-"), cfg.resumeFrom,
+		"Take over a running VM, using the state left by the previous runner [set during upgrades]")
+	flag.StringVar(&cfg.qmpAuthTokenHash, "qmp-auth-token-hash", cfg.qmpAuthTokenHash,
+		"If set, proxy the QMP ports and require clients (including of the console endpoint) to authenticate with the token with this SHA-256 hash")
+	flag.Func("port-forwarding", "Set the implementation used to forward the VM's ports (IPTables or NFTables)",
+		cfg.portForwarding.FlagFunc)
+	flag.Func("cpu-scaling-mode", "Set how the VM's CPUs are scaled (QMPHotplug, CgroupThrottling, or GuestCpuset)",
+		cfg.cpuScalingMode.FlagFunc)
+	flag.BoolVar(&printUpgradeProtocolVersion, strings.TrimPrefix(upgradeProtocolVersionArg, "-"), false,
+		"Print the supported version of the in-place upgrade protocol, and exit")
 
 	flag.Parse()
 
+	if printUpgradeProtocolVersion {
+		fmt.Println(upgradeProtocolVersion)
+		os.Exit(0)
+	}
+
 	if cfg.memoryProvider == "" {
 		logger.Fatal("missing required flag '-memory-provider'")
 	}
 	if cfg.memoryProvider == vmv1.MemoryProviderVirtioMem && cfg.autoMovableRatio == "" {
 		logger.Fatal("missing required flag '-memhp-auto-movable-ratio'")
 	}
+	if cfg.cpuScalingMode == vmv1.CPUScalingModeGuestCpuset && cfg.skipCgroupManagement {
+		logger.Fatal("'-cpu-scaling-mode GuestCpuset' cannot be used with '-skip-cgroup-management'")
+	}
 
 	return cfg
 }
@@ -668,6 +725,21 @@ func run(logger *zap.Logger) error {
 		return fmt.Errorf("failed to unmarshal VM Status: %w", err)
 	}
 
+	if cfg.resumeFrom != "" {
+		state, err := readUpgradeState(cfg.resumeFrom)
+		if err != nil {
+			return err
+		}
+		logger.Info("resuming after in-place upgrade", state.logFields()...)
+		// QEMU is still our child, and everything else it needs was set up by the previous runner.
+		qemu, err := os.FindProcess(state.QEMUPid)
+		if err != nil {
+			return fmt.Errorf("failed to find QEMU process: %w", err)
+		}
+		console := resumeConsoleOutput(logger, state.Console)
+		return superviseQEMU(cfg, logger, vmSpec, qemu, console, state.CgroupPath, true)
+	}
+
 	enableSSH := false
 	if vmSpec.EnableSSH != nil && *vmSpec.EnableSSH {
 		enableSSH = true
@@ -680,6 +752,7 @@ func run(logger *zap.Logger) error {
 	}
 	var shmSize *resource.Quantity
 	var swapInfo *vmv1.SwapInfo
+	var initialSwap resource.Quantity
 	if vmSpec.Guest.Settings != nil {
 		sysctl = append(sysctl, vmSpec.Guest.Settings.Sysctl...)
 		swapInfo, err = vmSpec.Guest.Settings.GetSwapInfo()
@@ -696,6 +769,9 @@ func run(logger *zap.Logger) error {
 		if swapInfo != nil && swapInfo.Size.Value() > initialMemorySize/2 {
 			shmSize = &swapInfo.Size
 		}
+		if swapInfo != nil {
+			initialSwap = initialSwapSize(vmSpec, *swapInfo)
+		}
 	}
 
 	tg := taskgroup.NewGroup(logger)
@@ -704,6 +780,10 @@ func run(logger *zap.Logger) error {
 	})
 
 	tg.Go("iso9660-runtime", func(logger *zap.Logger) error {
+		// UEFI guests don't run our init, so there's nothing to read the runtime disk.
+		if bootingUEFI(vmSpec) {
+			return nil
+		}
 		return createISO9660runtime(
 			runtimeDiskPath,
 			vmSpec.Guest.Command,
@@ -713,11 +793,24 @@ func run(logger *zap.Logger) error {
 			vmSpec.Disks,
 			enableSSH,
 			swapInfo,
+			initialSwap,
 			shmSize,
 		)
 	})
 
 	tg.Go("rootDisk", func(logger *zap.Logger) error {
+		if vmSpec.Guest.RootDisk.Streaming != nil {
+			// the overlay is created with the requested size, so no need to resize.
+			return createStreamingRootDisk(logger, vmSpec)
+		}
+		if vmSpec.Guest.RootDisk.BaseImageCache != nil {
+			if err := createRootDiskOverlay(logger, vmSpec); err != nil {
+				return err
+			}
+		}
+		if err := decompressRootDisk(logger, vmSpec); err != nil {
+			return err
+		}
 		// resize rootDisk image of size specified and new size more than current
 		return resizeRootDisk(logger, vmSpec)
 	})
@@ -746,8 +839,9 @@ func resizeRootDisk(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
 	type QemuImgOutputPartial struct {
 		VirtualSize int64 `json:"virtual-size"`
 	}
+	path, format := rootDiskImage(vmSpec)
 	// get current disk size by qemu-img info command
-	qemuImgOut, err := exec.Command(QEMU_IMG_BIN, "info", "--output=json", rootDiskPath).Output()
+	qemuImgOut, err := exec.Command(QEMU_IMG_BIN, "info", "--output=json", "-f", string(format), path).Output()
 	if err != nil {
 		return fmt.Errorf("could not get root image size: %w", err)
 	}
@@ -761,7 +855,7 @@ func resizeRootDisk(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
 	if !vmSpec.Guest.RootDisk.Size.IsZero() {
 		if vmSpec.Guest.RootDisk.Size.Cmp(*imageSizeQuantity) == 1 {
 			logger.Info(fmt.Sprintf("resizing rootDisk from %s to %s", imageSizeQuantity.String(), vmSpec.Guest.RootDisk.Size.String()))
-			if err := execFg(QEMU_IMG_BIN, "resize", rootDiskPath, fmt.Sprintf("%d", vmSpec.Guest.RootDisk.Size.Value())); err != nil {
+			if err := execFg(QEMU_IMG_BIN, "resize", "-f", string(format), path, fmt.Sprintf("%d", vmSpec.Guest.RootDisk.Size.Value())); err != nil {
 				return fmt.Errorf("failed to resize rootDisk: %w", err)
 			}
 		} else {
@@ -779,36 +873,74 @@ func buildQEMUCmd(
 	enableSSH bool,
 	swapInfo *vmv1.SwapInfo,
 ) ([]string, error) {
+	arch, err := hostArch()
+	if err != nil {
+		return nil, err
+	}
+
+	var cc *confidentialCompute
+	if vmSpec.ConfidentialCompute() {
+		if cc, err = detectConfidentialCompute(); err != nil {
+			return nil, err
+		}
+		logger.Info("launching confidential guest", zap.String("technology", string(cc.technology)))
+	}
+
 	// prepare qemu command line
 	qemuCmd := []string{
 		"-runas", "qemu",
-		"-machine", "q35",
+		"-machine", arch.machine + cc.machineOptions() + hugepagesMachineOptions(&vmSpec.Guest),
 		"-nographic",
 		"-no-reboot",
 		"-nodefaults",
-		"-only-migratable",
+	}
+	// Confidential guests and VFIO devices register migration blockers, so QEMU would refuse to
+	// start with -only-migratable. They're never migrated anyways.
+	if cc == nil && len(vmSpec.Guest.Devices) == 0 {
+		qemuCmd = append(qemuCmd, "-only-migratable")
+	}
+	qemuCmd = append(qemuCmd,
 		"-audiodev", "none,id=noaudio",
 		"-serial", "pty",
 		"-serial", "stdio",
 		"-msg", "timestamp=on",
-		"-qmp", fmt.Sprintf("tcp:0.0.0.0:%d,server,wait=off", vmSpec.QMP),
-		"-qmp", fmt.Sprintf("tcp:0.0.0.0:%d,server,wait=off", vmSpec.QMPManual),
 		"-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForSigtermHandler),
 		"-device", "virtio-serial",
 		"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=log", logSerialSocket),
 		"-device", "virtserialport,chardev=log,name=tech.neon.log.0",
+	)
+	qemuCmd = append(qemuCmd, swapResizeArgs(swapInfo)...)
+	qemuCmd = append(qemuCmd, cpuScalerArgs(cfg)...)
+
+	qemuCmd = append(qemuCmd, qmpArgs(cfg, vmSpec, vmSpec.QMP, qmpUnixSocketForProxy)...)
+	qemuCmd = append(qemuCmd, qmpArgs(cfg, vmSpec, vmSpec.QMPManual, qmpUnixSocketForManualProxy)...)
+
+	qemuCmd = append(qemuCmd, "-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForStats))
+	if vmSpec.Guest.RootDisk.Streaming != nil {
+		qemuCmd = append(qemuCmd, "-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForRootDiskStreaming))
+	}
+	restoreMemory := restoringMemory(vmSpec)
+	if restoreMemory {
+		qemuCmd = append(qemuCmd, "-qmp", fmt.Sprintf("unix:%s,server,wait=off", qmpUnixSocketForRestore))
 	}
 
 	// disk details
-	qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=rootdisk,file=%s,if=virtio,media=disk,index=0,%s", rootDiskPath, cfg.diskCacheSettings))
-	qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=runtime,file=%s,if=virtio,media=cdrom,readonly=on,cache=none", runtimeDiskPath))
+	//
+	// Every disk gets a virtio serial number, so that the guest can find it (and create
+	// /dev/disk/by-id symlinks for it) regardless of the order it was attached in.
+	rootDisk, rootDiskFormat := rootDiskImage(vmSpec)
+	qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=rootdisk,file=%s,if=virtio,media=disk,format=%s,index=0,serial=rootdisk,%s%s", rootDisk, rootDiskFormat, cfg.diskCacheSettings, throttleDriveOptions(vmSpec.Guest.RootDisk.IOLimits)))
+	uefi := bootingUEFI(vmSpec)
+	if !uefi {
+		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=runtime,file=%s,if=virtio,media=cdrom,readonly=on,cache=none,serial=runtime", runtimeDiskPath))
+	}
 
-	if enableSSH {
+	if enableSSH && !uefi {
 		name := "ssh-authorized-keys"
 		if err := createISO9660FromPath(logger, name, sshAuthorizedKeysDiskPath, sshAuthorizedKeysMountPoint); err != nil {
 			return nil, fmt.Errorf("Failed to create ISO9660 image: %w", err)
 		}
-		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=cdrom,cache=none", name, sshAuthorizedKeysDiskPath))
+		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=cdrom,cache=none,serial=%s", name, sshAuthorizedKeysDiskPath, name))
 	}
 
 	if swapInfo != nil {
@@ -817,22 +949,33 @@ func buildQEMUCmd(
 		if err := createSwap(dPath, *swapInfo); err != nil {
 			return nil, fmt.Errorf("Failed to create swap disk: %w", err)
 		}
-		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=disk,%s,discard=unmap", swapName, dPath, cfg.diskCacheSettings))
+		qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=disk,serial=%s,%s,discard=unmap", swapName, dPath, swapName, cfg.diskCacheSettings))
 	}
 
 	for _, disk := range vmSpec.Disks {
 		switch {
 		case disk.EmptyDisk != nil:
-			logger.Info("creating QCOW2 image with empty ext4 filesystem", zap.String("diskName", disk.Name))
 			dPath := fmt.Sprintf("%s/%s.qcow2", mountedDiskPath, disk.Name)
-			if err := createQCOW2(disk.Name, dPath, &disk.EmptyDisk.Size, nil); err != nil {
-				return nil, fmt.Errorf("Failed to create QCOW2 image: %w", err)
+			if restoredDiskExists(vmSpec, dPath) {
+				logger.Info("using QCOW2 image restored from snapshot", zap.String("diskName", disk.Name))
+			} else {
+				logger.Info("creating QCOW2 image with empty ext4 filesystem", zap.String("diskName", disk.Name))
+				if err := createQCOW2(disk.Name, dPath, &disk.EmptyDisk.Size, nil); err != nil {
+					return nil, fmt.Errorf("Failed to create QCOW2 image: %w", err)
+				}
 			}
-			discard := ""
+			opts := ""
 			if disk.EmptyDisk.Discard {
-				discard = ",discard=unmap"
+				opts += ",discard=unmap"
+			}
+			opts += throttleDriveOptions(disk.IOLimits)
+			if disk.Hotpluggable {
+				// Add the device separately, with an ID, so that the controller can remove it later.
+				qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=none,media=disk,%s%s", disk.Name, dPath, cfg.diskCacheSettings, opts))
+				qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("virtio-blk-pci,id=%s,drive=%s,serial=%s", vmv1.HotplugDiskDeviceID(disk.Name), disk.Name, vmv1.DiskSerial(disk.Name)))
+			} else {
+				qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=disk,serial=%s,%s%s", disk.Name, dPath, vmv1.DiskSerial(disk.Name), cfg.diskCacheSettings, opts))
 			}
-			qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=disk,%s%s", disk.Name, dPath, cfg.diskCacheSettings, discard))
 		case disk.ConfigMap != nil || disk.Secret != nil:
 			dPath := fmt.Sprintf("%s/%s.iso", mountedDiskPath, disk.Name)
 			mnt := fmt.Sprintf("/vm/mounts%s", disk.MountPath)
@@ -840,37 +983,67 @@ func buildQEMUCmd(
 			if err := createISO9660FromPath(logger, disk.Name, dPath, mnt); err != nil {
 				return nil, fmt.Errorf("Failed to create ISO9660 image: %w", err)
 			}
-			qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=cdrom,cache=none", disk.Name, dPath))
+			qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=cdrom,cache=none,serial=%s", disk.Name, dPath, vmv1.DiskSerial(disk.Name)))
+		case disk.VolumeSnapshot != nil:
+			// The block device for the PVC is added to the container by neonvm-controller.
+			dPath := fmt.Sprintf("/vm/disks/%s", disk.Name)
+			opts := ""
+			if disk.ReadOnly != nil && *disk.ReadOnly {
+				opts += ",readonly=on"
+			}
+			if disk.VolumeSnapshot.Discard {
+				opts += ",discard=unmap"
+			}
+			opts += throttleDriveOptions(disk.IOLimits)
+			qemuCmd = append(qemuCmd, "-drive", fmt.Sprintf("id=%s,file=%s,if=virtio,media=disk,format=raw,serial=%s,%s%s", disk.Name, dPath, vmv1.DiskSerial(disk.Name), cfg.diskCacheSettings, opts))
 		default:
 			// do nothing
 		}
 	}
 
+	cloudInit, err := cloudInitArgs(logger, vmSpec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set up cloud-init: %w", err)
+	}
+	qemuCmd = append(qemuCmd, cloudInit...)
+
 	// cpu details
 	// NB: EnableAcceleration guaranteed non-nil because the k8s API server sets the default for us.
 	if *vmSpec.EnableAcceleration && checkKVM() {
 		logger.Info("using KVM acceleration")
 		qemuCmd = append(qemuCmd, "-enable-kvm")
+	} else if cc != nil {
+		return nil, errors.New("confidential guests require KVM, but /dev/kvm is not available")
 	} else {
 		logger.Warn("not using KVM acceleration")
 	}
 	qemuCmd = append(qemuCmd, "-cpu", "max")
-	qemuCmd = append(qemuCmd, "-smp", fmt.Sprintf(
-		"cpus=%d,maxcpus=%d,sockets=1,cores=%d,threads=1",
-		vmSpec.Guest.CPUs.Min.RoundedUp(),
-		vmSpec.Guest.CPUs.Max.RoundedUp(),
-		vmSpec.Guest.CPUs.Max.RoundedUp(),
-	))
-
-	// memory details
-	logger.Info(fmt.Sprintf("Using memory provider %s", cfg.memoryProvider))
-	qemuCmd = append(qemuCmd, "-m", fmt.Sprintf(
-		"size=%db,slots=%d,maxmem=%db",
-		vmSpec.Guest.MemorySlotSize.Value()*int64(vmSpec.Guest.MemorySlots.Min),
-		vmSpec.Guest.MemorySlots.Max-vmSpec.Guest.MemorySlots.Min,
-		vmSpec.Guest.MemorySlotSize.Value()*int64(vmSpec.Guest.MemorySlots.Max),
-	))
-	if cfg.memoryProvider == vmv1.MemoryProviderVirtioMem {
+	fixedResources := vmSpec.ResizedByRestart()
+	if fixedResources {
+		// UEFI and confidential guests can't be hotplugged, so they start with what they're
+		// using, and are restarted to resize.
+		cpus := vmSpec.Guest.CPUs.Use.RoundedUp()
+		memSize := vmSpec.Guest.MemorySlotSize.Value() * int64(vmSpec.Guest.MemorySlots.Use)
+		qemuCmd = append(qemuCmd, "-smp", fmt.Sprintf("cpus=%d,maxcpus=%d,sockets=1,cores=%d,threads=1", cpus, cpus, cpus))
+		qemuCmd = append(qemuCmd, "-m", fmt.Sprintf("size=%db", memSize))
+		qemuCmd = append(qemuCmd, hugepagesBootMemoryArgs(&vmSpec.Guest, memSize)...)
+		qemuCmd = append(qemuCmd, cc.args(memSize)...)
+	} else {
+		logger.Info(fmt.Sprintf("Using CPU scaling mode %s", cfg.cpuScalingMode))
+		qemuCmd = append(qemuCmd, "-smp", smpArgs(cfg, vmSpec))
+
+		// memory details
+		logger.Info(fmt.Sprintf("Using memory provider %s", cfg.memoryProvider))
+		bootMemSize := vmSpec.Guest.MemorySlotSize.Value() * int64(vmSpec.Guest.MemorySlots.Min)
+		qemuCmd = append(qemuCmd, "-m", fmt.Sprintf(
+			"size=%db,slots=%d,maxmem=%db",
+			bootMemSize,
+			vmSpec.Guest.MemorySlots.Max-vmSpec.Guest.MemorySlots.Min,
+			vmSpec.Guest.MemorySlotSize.Value()*int64(vmSpec.Guest.MemorySlots.Max),
+		))
+		qemuCmd = append(qemuCmd, hugepagesBootMemoryArgs(&vmSpec.Guest, bootMemSize)...)
+	}
+	if cfg.memoryProvider == vmv1.MemoryProviderVirtioMem && !fixedResources {
 		// we don't actually have any slots because it's virtio-mem, but we're still using the API
 		// designed around DIMM slots, so we need to use them to calculate how much memory we expect
 		// to be able to plug in.
@@ -880,18 +1053,28 @@ func buildQEMUCmd(
 		// Otherwise, QEMU fails with:
 		//   property 'size' of memory-backend-ram doesn't take value '0'
 		if virtioMemSize != 0 {
-			qemuCmd = append(qemuCmd, "-object", fmt.Sprintf("memory-backend-ram,id=vmem0,size=%db", virtioMemSize))
-			qemuCmd = append(qemuCmd, "-device", "virtio-mem-pci,id=vm0,memdev=vmem0,block-size=8M,requested-size=0")
+			// nb: the backend isn't preallocated, because it covers the maximum size. With
+			// hugepages, the device preallocates memory as it's plugged in instead.
+			qemuCmd = append(qemuCmd, "-object", memoryBackendObject(&vmSpec.Guest, "vmem0", virtioMemSize, false))
+			// When restoring memory, the amount plugged in must match the snapshot.
+			var requestedSize int64
+			if restoreMemory {
+				requestedSize = int64(vmSpec.Guest.MemorySlots.Use-vmSpec.Guest.MemorySlots.Min) * vmSpec.Guest.MemorySlotSize.Value()
+			}
+			device := fmt.Sprintf("virtio-mem-pci,id=vm0,memdev=vmem0,block-size=%d,requested-size=%d", virtioMemBlockSize(&vmSpec.Guest), requestedSize)
+			if vmSpec.Guest.HugepageSizeOrNil() != nil {
+				device += ",prealloc=on"
+			}
+			qemuCmd = append(qemuCmd, "-device", device)
 		}
 	}
 
 	// default (pod) net details
-	macDefault, err := defaultNetwork(logger, defaultNetworkCIDR, vmSpec.Guest.Ports)
+	macDefault, err := defaultNetwork(logger, defaultNetworkCIDR, defaultNetworkCIDR6, vmSpec, cfg.portForwarding)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to set up default network: %w", err)
 	}
-	qemuCmd = append(qemuCmd, "-netdev", fmt.Sprintf("tap,id=default,ifname=%s,script=no,downscript=no,vhost=on", defaultNetworkTapName))
-	qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("virtio-net-pci,netdev=default,mac=%s", macDefault.String()))
+	qemuCmd = append(qemuCmd, getGuestNetworkTuning(vmSpec).qemuArgs("default", defaultNetworkTapName, macDefault.String())...)
 
 	// overlay (multus) net details
 	if vmSpec.ExtraNetwork != nil && vmSpec.ExtraNetwork.Enable {
@@ -903,16 +1086,37 @@ func buildQEMUCmd(
 		qemuCmd = append(qemuCmd, "-device", fmt.Sprintf("virtio-net-pci,netdev=overlay,mac=%s", macOverlay.String()))
 	}
 
+	// passthrough devices
+	if len(vmSpec.Guest.Devices) != 0 {
+		args, err := setupDevices(logger, vmSpec)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up devices: %w", err)
+		}
+		qemuCmd = append(qemuCmd, args...)
+	}
+
 	// kernel details
-	qemuCmd = append(
-		qemuCmd,
-		"-kernel", cfg.kernelPath,
-		"-append", makeKernelCmdline(cfg, vmSpec, vmStatus),
-	)
+	if uefi {
+		logger.Info("booting root disk via UEFI")
+		args, err := uefiArgs(logger, arch, vmSpec)
+		if err != nil {
+			return nil, err
+		}
+		qemuCmd = append(qemuCmd, args...)
+	} else {
+		qemuCmd = append(
+			qemuCmd,
+			"-kernel", cfg.kernelPath,
+			"-append", makeKernelCmdline(cfg, vmSpec, vmStatus),
+		)
+	}
 
 	// should runner receive migration ?
 	if os.Getenv("RECEIVE_MIGRATION") == "true" {
-		qemuCmd = append(qemuCmd, "-incoming", fmt.Sprintf("tcp:0:%d", vmv1.MigrationPort))
+		qemuCmd = append(qemuCmd, "-incoming", migrationIncomingArg(vmSpec))
+	} else if restoreMemory {
+		logger.Info("restoring memory from snapshot", zap.String("snapshot", vmSpec.RestoreFrom.SnapshotName))
+		qemuCmd = append(qemuCmd, restoreMemoryArgs(cfg, arch, vmSpec)...)
 	}
 
 	return qemuCmd, nil
@@ -936,11 +1140,30 @@ func makeKernelCmdline(cfg *Config, vmSpec *vmv1.VirtualMachineSpec, vmStatus *v
 		panic(fmt.Errorf("unknown memory provider %s", cfg.memoryProvider))
 	}
 
+	if cfg.cpuScalingMode == vmv1.CPUScalingModeGuestCpuset {
+		// the remaining CPUs are onlined later by the guest's cpu-scaler. See cpu_scaling.go.
+		cmdlineParts = append(cmdlineParts, fmt.Sprintf("maxcpus=%d", vmSpec.Guest.CPUs.Use.RoundedUp()))
+	}
+
+	if vmSpec.HasIPFamily(vmv1.IPFamilyIPv6) {
+		// tells the guest to get IPv6 DNS servers with DHCPv6. See vm-builder's ipv6-setup.sh.
+		cmdlineParts = append(cmdlineParts, "neonvm.ipv6=1")
+	}
+
 	if vmSpec.ExtraNetwork != nil && vmSpec.ExtraNetwork.Enable {
-		netDetails := fmt.Sprintf("ip=%s:::%s:%s:eth1:off", vmStatus.ExtraNetIP, vmStatus.ExtraNetMask, vmStatus.PodName)
+		var netDetails string
+		if ip := net.ParseIP(vmStatus.ExtraNetIP); ip != nil && ip.To4() == nil {
+			// The kernel's ip= parameter is IPv4-only, so IPv6 overlay addresses are set up by
+			// the guest instead. The mask is the prefix length for IPv6.
+			netDetails = fmt.Sprintf("neonvm.overlay_ip6=%s/%s", vmStatus.ExtraNetIP, vmStatus.ExtraNetMask)
+		} else {
+			netDetails = fmt.Sprintf("ip=%s:::%s:%s:eth1:off", vmStatus.ExtraNetIP, vmStatus.ExtraNetMask, vmStatus.PodName)
+		}
 		cmdlineParts = append(cmdlineParts, netDetails)
 	}
 
+	cmdlineParts = append(cmdlineParts, vmSpec.Guest.KernelCmdline...)
+
 	if cfg.appendKernelCmdline != "" {
 		cmdlineParts = append(cmdlineParts, cfg.appendKernelCmdline)
 	}
@@ -986,45 +1209,137 @@ func runQEMU(
 		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	wg := sync.WaitGroup{}
-
-	wg.Add(1)
-	go terminateQemuOnSigterm(ctx, logger, &wg)
-	if !cfg.skipCgroupManagement {
-		wg.Add(1)
-		go listenForCPUChanges(ctx, logger, vmSpec.RunnerPort, cgroupPath, &wg)
+	arch, err := hostArch()
+	if err != nil {
+		return err
 	}
-	wg.Add(1)
-	go forwardLogs(ctx, logger, &wg)
 
 	var bin string
 	var cmd []string
 	if !cfg.skipCgroupManagement {
 		bin = "cgexec"
-		cmd = append([]string{"-g", fmt.Sprintf("cpu:%s", cgroupPath), QEMU_BIN}, qemuCmd...)
+		cmd = append([]string{"-g", fmt.Sprintf("cpu:%s", cgroupPath), arch.qemuBin}, qemuCmd...)
 	} else {
-		bin = QEMU_BIN
+		bin = arch.qemuBin
 		cmd = qemuCmd
 	}
 
 	logger.Info(fmt.Sprintf("calling %s", bin), zap.Strings("args", cmd))
-	err := execFg(bin, cmd...)
+	// Start QEMU directly instead of with execFg, so that after an in-place upgrade, the new runner
+	// can supervise it in the same way.
+	//
+	// For the same reason, QEMU's stdout is a pipe that we read from ourselves. See console.go.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe for QEMU's output: %w", err)
+	}
+	qemu := exec.Command(bin, cmd...)
+	qemu.Stdout = stdoutW
+	qemu.Stderr = os.Stderr
+	err = qemu.Start()
+	// QEMU has its own copy of the write end now, so that we see EOF once it exits.
+	_ = stdoutW.Close()
+	if err != nil {
+		_ = stdoutR.Close()
+		return fmt.Errorf("failed to start QEMU: %w", err)
+	}
+	console := startConsoleOutput(logger, stdoutR, newConsoleBuffer())
+
+	return superviseQEMU(cfg, logger, vmSpec, qemu.Process, console, cgroupPath, false)
+}
+
+// superviseQEMU runs everything alongside QEMU until it exits.
+//
+// If resumed is true, QEMU was started by a previous runner, before an in-place upgrade.
+func superviseQEMU(
+	cfg *Config,
+	logger *zap.Logger,
+	vmSpec *vmv1.VirtualMachineSpec,
+	qemu *os.Process,
+	console *consoleOutput,
+	cgroupPath string,
+	resumed bool,
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	metrics := makeRunnerMetrics(logger)
+
+	wg.Add(1)
+	go terminateQemuOnSigterm(ctx, logger, vmSpec, qemu, &wg)
+	wg.Add(1)
+	go watchForUpgrades(ctx, logger, cfg, qemu, cgroupPath, console, &wg)
+	if !cfg.skipCgroupManagement {
+		burster, err := newCPUBurster(vmSpec, cgroupPath, metrics)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("failed to set up CPU bursting: %w", err)
+		}
+		wg.Add(2)
+		go listenForCPUChanges(ctx, logger, cfg, vmSpec, burster, metrics, &wg)
+		go burster.run(ctx, logger, &wg)
+	}
+	if streaming := vmSpec.Guest.RootDisk.Streaming; streaming != nil {
+		wg.Add(1)
+		go watchRootDiskStreaming(ctx, logger, streaming, metrics, &wg)
+	}
+	if vmSpec.Guest.RootDisk.BaseImageCache != nil {
+		wg.Add(1)
+		go maintainBaseImageCache(ctx, logger, &wg)
+	}
+	wg.Add(1)
+	go forwardLogs(ctx, logger, &wg)
+	wg.Add(1)
+	go listenForSnapshotRequests(ctx, logger, cfg, vmSpec, &wg)
+	readiness := &guestReadiness{ready: atomic.Bool{}}
+	if probe := vmSpec.Guest.ReadinessProbe; probe != nil {
+		wg.Add(1)
+		go runReadinessProbe(ctx, logger, probe, readiness, &wg)
+	}
+	wg.Add(1)
+	go listenForConsoleRequests(ctx, logger, cfg, vmSpec, console.buffer, readiness, &wg)
+	if cfg.qmpAuthTokenHash != "" {
+		wg.Add(2)
+		go listenForQMP(ctx, logger, cfg, vmSpec, vmSpec.QMP, qmpUnixSocketForProxy, &wg)
+		go listenForQMP(ctx, logger, cfg, vmSpec, vmSpec.QMPManual, qmpUnixSocketForManualProxy, &wg)
+	}
+	// After an upgrade, the previous runner already resumed the VM.
+	if restoringMemory(vmSpec) && !resumed {
+		wg.Add(1)
+		go resumeAfterRestore(ctx, logger, vmSpec.RunPolicy, &wg)
+	}
+
+	var err error
+	if state, waitErr := qemu.Wait(); waitErr != nil {
+		err = waitErr
+	} else if !state.Success() {
+		err = errors.New(state.String())
+	}
 	if err != nil {
-		msg := "QEMU exited with error" // TODO: technically this might not be accurate. This can also happen if it fails to start.
+		msg := "QEMU exited with error"
 		logger.Error(msg, zap.Error(err))
 		err = fmt.Errorf("%s: %w", msg, err)
 	} else {
 		logger.Info("QEMU exited without error")
 	}
 
+	// Give the last of QEMU's output a chance to be forwarded. os/exec would normally wait for this.
+	select {
+	case <-console.stopped():
+	case <-time.After(time.Second):
+	}
+
+	if len(vmSpec.Guest.Devices) != 0 {
+		releaseDevices(logger, vmSpec)
+	}
+
 	cancel()
 	wg.Wait()
 
 	return err
 }
 
-func handleCPUChange(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cgroupPath string) {
+func handleCPUChange(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config, burster *cpuBurster) {
 	if r.Method != "POST" {
 		logger.Error("unexpected method", zap.String("method", r.Method))
 		w.WriteHeader(400)
@@ -1046,30 +1361,32 @@ func handleCPUChange(logger *zap.Logger, w http.ResponseWriter, r *http.Request,
 
 	// update cgroup
 	logger.Info("got CPU update", zap.Float64("CPU", parsed.VCPUs.AsFloat64()))
-	err = setCgroupLimit(logger, parsed.VCPUs, cgroupPath)
+	err = burster.setBase(logger, parsed.VCPUs)
 	if err != nil {
 		logger.Error("could not set cgroup limit", zap.Error(err))
 		w.WriteHeader(500)
 		return
 	}
 
+	if cfg.cpuScalingMode == vmv1.CPUScalingModeGuestCpuset {
+		if err := sendOnlineCPUs(parsed.VCPUs.RoundedUp()); err != nil {
+			logger.Error("could not send online CPUs to guest", zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+	}
+
 	w.WriteHeader(200)
 }
 
-func handleCPUCurrent(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cgroupPath string) {
+func handleCPUCurrent(logger *zap.Logger, w http.ResponseWriter, r *http.Request, burster *cpuBurster) {
 	if r.Method != "GET" {
 		logger.Error("unexpected method", zap.String("method", r.Method))
 		w.WriteHeader(400)
 		return
 	}
 
-	cpus, err := getCgroupQuota(cgroupPath)
-	if err != nil {
-		logger.Error("could not get cgroup quota", zap.Error(err))
-		w.WriteHeader(500)
-		return
-	}
-	resp := api.VCPUCgroup{VCPUs: *cpus}
+	resp := burster.current()
 	body, err := json.Marshal(resp)
 	if err != nil {
 		logger.Error("could not marshal body", zap.Error(err))
@@ -1081,28 +1398,63 @@ func handleCPUCurrent(logger *zap.Logger, w http.ResponseWriter, r *http.Request
 	w.Write(body) //nolint:errcheck // Not much to do with the error here. TODO: log it?
 }
 
-func listenForCPUChanges(ctx context.Context, logger *zap.Logger, port int32, cgroupPath string, wg *sync.WaitGroup) {
+func listenForCPUChanges(
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg *Config,
+	vmSpec *vmv1.VirtualMachineSpec,
+	burster *cpuBurster,
+	metrics *runnerMetrics,
+	wg *sync.WaitGroup,
+) {
 	defer wg.Done()
+	var swapInfo *vmv1.SwapInfo
+	if vmSpec.Guest.Settings != nil {
+		// already checked for errors at startup
+		swapInfo, _ = vmSpec.Guest.Settings.GetSwapInfo()
+	}
+
 	mux := http.NewServeMux()
 	loggerHandlers := logger.Named("http-handlers")
 	cpuChangeLogger := loggerHandlers.Named("cpu_change")
 	mux.HandleFunc("/cpu_change", func(w http.ResponseWriter, r *http.Request) {
-		handleCPUChange(cpuChangeLogger, w, r, cgroupPath)
+		handleCPUChange(cpuChangeLogger, w, r, cfg, burster)
 	})
 	cpuCurrentLogger := loggerHandlers.Named("cpu_current")
 	mux.HandleFunc("/cpu_current", func(w http.ResponseWriter, r *http.Request) {
-		handleCPUCurrent(cpuCurrentLogger, w, r, cgroupPath)
+		handleCPUCurrent(cpuCurrentLogger, w, r, burster)
+	})
+	swapChangeLogger := loggerHandlers.Named("swap_change")
+	mux.HandleFunc("/swap_change", func(w http.ResponseWriter, r *http.Request) {
+		handleSwapChange(swapChangeLogger, w, r, swapInfo)
+	})
+	hotplugDisksLogger := loggerHandlers.Named("hotplug_disks")
+	mux.HandleFunc("/hotplug_disks/", func(w http.ResponseWriter, r *http.Request) {
+		handleHotplugDisk(hotplugDisksLogger, w, r)
+	})
+	timeSyncLogger := loggerHandlers.Named("time_sync")
+	mux.HandleFunc("/time_sync", func(w http.ResponseWriter, r *http.Request) {
+		handleTimeSync(timeSyncLogger, w, r, vmSpec)
 	})
+	attestationLogger := loggerHandlers.Named("attestation")
+	mux.HandleFunc("/attestation", func(w http.ResponseWriter, r *http.Request) {
+		handleAttestation(attestationLogger, w, r, vmSpec)
+	})
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
 	server := http.Server{
-		Addr:              fmt.Sprintf("0.0.0.0:%d", port),
+		Addr:              listenAddr(vmSpec, vmSpec.RunnerPort),
 		Handler:           mux,
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
 		WriteTimeout:      5 * time.Second,
 	}
+	l, err := listen(server.Addr)
+	if err != nil {
+		logger.Fatal("cpu_change failed to listen", zap.Error(err))
+	}
 	errChan := make(chan error)
 	go func() {
-		errChan <- server.ListenAndServe()
+		errChan <- server.Serve(l)
 	}()
 	select {
 	case err := <-errChan:
@@ -1402,7 +1754,17 @@ func getCgroupQuota(cgroupPath string) (*vmv1.MilliCPU, error) {
 	return &cpu, nil
 }
 
-func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+// forcedShutdownMargin is how long before the end of the pod's termination grace period we kill
+// QEMU, if the guest hasn't powered off by itself. This leaves time to record how the VM shut down
+// before the kubelet kills the container.
+const forcedShutdownMargin = time.Second
+
+// terminateQemuOnSigterm asks the guest to power off (via ACPI) when we get SIGTERM, and kills QEMU
+// if it hasn't exited shortly before the end of .spec.terminationGracePeriodSeconds.
+//
+// Whether the shutdown was graceful is written to the container's termination message, for the
+// controller to copy into the VM's .status.lastShutdown.
+func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec, qemu *os.Process, wg *sync.WaitGroup) {
 	logger = logger.Named("terminate-qemu-on-sigterm")
 
 	defer wg.Done()
@@ -1416,28 +1778,57 @@ func terminateQemuOnSigterm(ctx context.Context, logger *zap.Logger, wg *sync.Wa
 		return
 	}
 
+	gracePeriod := 5 * time.Second
+	if vmSpec.TerminationGracePeriodSeconds != nil {
+		gracePeriod = time.Duration(*vmSpec.TerminationGracePeriodSeconds) * time.Second
+	}
+	deadline := time.After(max(gracePeriod-forcedShutdownMargin, 0))
+
 	logger.Info("got signal, sending powerdown command to QEMU")
+	if err := sendPowerdown(); err != nil {
+		logger.Error("failed to send powerdown command to QEMU", zap.Error(err))
+	} else {
+		logger.Info("system_powerdown command sent to QEMU")
+	}
+
+	select {
+	case <-ctx.Done():
+		logger.Info("QEMU exited after powerdown")
+		writeTerminationMessage(logger, string(vmv1.VmShutdownGraceful))
+	case <-deadline:
+		logger.Warn("guest did not power off within the termination grace period, killing QEMU",
+			zap.Duration("gracePeriod", gracePeriod))
+		if err := qemu.Kill(); err != nil {
+			logger.Error("failed to kill QEMU", zap.Error(err))
+		}
+		writeTerminationMessage(logger, string(vmv1.VmShutdownForced))
+	}
+}
 
+func sendPowerdown() error {
 	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForSigtermHandler, 2*time.Second)
 	if err != nil {
-		logger.Error("failed to connect to QEMU monitor", zap.Error(err))
-		return
+		return fmt.Errorf("failed to connect to QEMU monitor: %w", err)
 	}
 
 	if err := mon.Connect(); err != nil {
-		logger.Error("failed to start monitor connection", zap.Error(err))
-		return
+		return fmt.Errorf("failed to start monitor connection: %w", err)
 	}
 	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
 
 	qmpcmd := []byte(`{"execute": "system_powerdown"}`)
-	_, err = mon.Run(qmpcmd)
-	if err != nil {
-		logger.Error("failed to execute system_powerdown command", zap.Error(err))
-		return
+	if _, err := mon.Run(qmpcmd); err != nil {
+		return fmt.Errorf("failed to execute system_powerdown command: %w", err)
 	}
+	return nil
+}
 
-	logger.Info("system_powerdown command sent to QEMU")
+// writeTerminationMessage sets the message that the kubelet includes in the neonvm-runner
+// container's status once it exits
+func writeTerminationMessage(logger *zap.Logger, msg string) {
+	if err := os.WriteFile(terminationMessagePath, []byte(msg), 0o644); err != nil {
+		logger.Warn("failed to write termination message", zap.Error(err))
+	}
 }
 
 func calcIPs(cidr string) (net.IP, net.IP, net.IPMask, error) {
@@ -1457,6 +1848,42 @@ func calcIPs(cidr string) (net.IP, net.IP, net.IPMask, error) {
 	return ip1, ip2, mask, nil
 }
 
+// eui64IP returns the address that the guest's interface with the MAC address gets with SLAAC in
+// the /64 prefix
+func eui64IP(prefix net.IP, mac net.HardwareAddr) net.IP {
+	ip := append(net.IP{}, prefix.To16()...)
+	ip[8] = mac[0] ^ 0x02
+	ip[9] = mac[1]
+	ip[10] = mac[2]
+	ip[11] = 0xff
+	ip[12] = 0xfe
+	ip[13] = mac[3]
+	ip[14] = mac[4]
+	ip[15] = mac[5]
+	return ip
+}
+
+// listenAddr returns the address for servers in the runner to listen on the port: all IPv4
+// addresses, or all IPv4 and IPv6 addresses if the VM has IPv6 enabled.
+//
+// IPv4-only addresses are unchanged from before IPv6 support, so that listeners can still be
+// handed over in place upgrades.
+func listenAddr(vmSpec *vmv1.VirtualMachineSpec, port int32) string {
+	if vmSpec.HasIPFamily(vmv1.IPFamilyIPv6) {
+		return fmt.Sprintf("[::]:%d", port)
+	}
+	return fmt.Sprintf("0.0.0.0:%d", port)
+}
+
+// migrationIncomingArg returns the value of QEMU's -incoming flag to receive a migration
+func migrationIncomingArg(vmSpec *vmv1.VirtualMachineSpec) string {
+	if vmSpec.HasIPFamily(vmv1.IPFamilyIPv6) {
+		// QEMU listens on both IPv4 and IPv6 with [::], unless told otherwise.
+		return fmt.Sprintf("tcp:[::]:%d", vmv1.MigrationPort)
+	}
+	return fmt.Sprintf("tcp:0:%d", vmv1.MigrationPort)
+}
+
 //lint:ignore U1000 the function is not in use right now, but it's good to have for the future
 func execBg(name string, arg ...string) error {
 	cmd := exec.Command(name, arg...)
@@ -1478,7 +1905,13 @@ func execFg(name string, arg ...string) error {
 	return nil
 }
 
-func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC, error) {
+func defaultNetwork(
+	logger *zap.Logger,
+	cidr string,
+	cidr6 string,
+	vmSpec *vmv1.VirtualMachineSpec,
+	portForwarding vmv1.PortForwarding,
+) (mac.MAC, error) {
 	// gerenare random MAC for default Guest interface
 	mac, err := mac.GenerateRandMAC()
 	if err != nil {
@@ -1512,6 +1945,35 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		logger.Fatal("could not parse IP", zap.Error(err))
 		return nil, err
 	}
+
+	// With IPv6, the guest gets its address in cidr6 with SLAAC, so we know it in advance from the
+	// MAC address.
+	ipv6 := vmSpec.HasIPFamily(vmv1.IPFamilyIPv6)
+	var ipPod6, ipVm6 net.IP
+	if ipv6 {
+		_, net6, err := net.ParseCIDR(cidr6)
+		if err != nil {
+			logger.Fatal("could not parse IPv6 CIDR", zap.Error(err))
+			return nil, err
+		}
+		ipPod6 = append(net.IP{}, net6.IP...)
+		ipPod6[15]++
+		ipVm6 = eui64IP(net6.IP, net.HardwareAddr(mac))
+		bridgeAddr6 := &netlink.Addr{
+			IPNet: &net.IPNet{
+				IP:   ipPod6,
+				Mask: net6.Mask,
+			},
+			// skip duplicate address detection, so that dnsmasq can send router advertisements
+			// from the address straight away
+			Flags: syscall.IFA_F_NODAD,
+		}
+		if err := netlink.AddrAdd(bridge, bridgeAddr6); err != nil {
+			logger.Fatal("could not add IPv6 address to bridge", zap.Error(err))
+			return nil, err
+		}
+	}
+
 	if err := netlink.LinkSetUp(bridge); err != nil {
 		logger.Fatal("could not set up bridge", zap.Error(err))
 		return nil, err
@@ -1531,18 +1993,25 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		}
 	}
 
-	logger.Info("setup tap interface", zap.String("name", defaultNetworkTapName))
+	tuning := getGuestNetworkTuning(vmSpec)
+	logger.Info("setup tap interface", zap.String("name", defaultNetworkTapName), zap.Int("queues", tuning.queues))
 	tap := &netlink.Tuntap{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: defaultNetworkTapName,
 		},
 		Mode:  netlink.TUNTAP_MODE_TAP,
-		Flags: netlink.TUNTAP_DEFAULTS,
+		Flags: tuning.tapFlags(),
 	}
 	if err := netlink.LinkAdd(tap); err != nil {
 		logger.Error("could not add tap device", zap.Error(err))
 		return nil, err
 	}
+	if tuning.mtu != 0 {
+		if err := netlink.LinkSetMTU(tap, tuning.mtu); err != nil {
+			logger.Error("could not set tap device MTU", zap.Error(err))
+			return nil, err
+		}
+	}
 	if err := netlink.LinkSetMaster(tap, bridge); err != nil {
 		logger.Error("could not set up tap as master", zap.Error(err))
 		return nil, err
@@ -1552,59 +2021,19 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		return nil, err
 	}
 
-	// setup masquerading outgoing (from VM) traffic
-	logger.Info("setup masquerading for outgoing traffic")
-	if err := execFg("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"); err != nil {
-		logger.Error("could not setup masquerading for outgoing traffic", zap.Error(err))
-		return nil, err
-	}
-
-	// pass incoming traffic to .Guest.Spec.Ports into VM
-	var iptablesArgs []string
-	for _, port := range ports {
-		logger.Info(fmt.Sprintf("setup DNAT rule for incoming traffic to port %d", port.Port))
-		iptablesArgs = []string{
-			"-t", "nat", "-A", "PREROUTING",
-			"-i", "eth0", "-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
-			"-j", "DNAT", "--to", fmt.Sprintf("%s:%d", ipVm.String(), port.Port),
-		}
-		if err := execFg("iptables", iptablesArgs...); err != nil {
-			logger.Error("could not set up DNAT rule for incoming traffic", zap.Error(err))
+	// The guest always has an IPv4 address on the bridge, so that it can be reached from inside the
+	// runner pod. Traffic is only forwarded to and from the pod's network for the VM's IP families.
+	iptables, ip6tables := iptablesCommands(portForwarding)
+	if vmSpec.HasIPFamily(vmv1.IPFamilyIPv4) {
+		if err := setupNAT(logger, iptables, ipVm, net.IPv4(127, 0, 0, 1), vmSpec.Guest.Ports); err != nil {
 			return nil, err
 		}
-		logger.Info(fmt.Sprintf("setup DNAT rule for traffic originating from localhost to port %d", port.Port))
-		iptablesArgs = []string{
-			"-t", "nat", "-A", "OUTPUT",
-			"-m", "addrtype", "--src-type", "LOCAL", "--dst-type", "LOCAL",
-			"-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
-			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", ipVm.String(), port.Port),
-		}
-		if err := execFg("iptables", iptablesArgs...); err != nil {
-			logger.Error("could not set up DNAT rule for traffic from localhost", zap.Error(err))
-			return nil, err
-		}
-		logger.Info(fmt.Sprintf("setup ACCEPT rule for traffic originating from localhost to port %d", port.Port))
-		iptablesArgs = []string{
-			"-A", "OUTPUT",
-			"-s", "127.0.0.1", "-d", ipVm.String(),
-			"-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
-			"-j", "ACCEPT",
-		}
-		if err := execFg("iptables", iptablesArgs...); err != nil {
-			logger.Error("could not set up ACCEPT rule for traffic from localhost", zap.Error(err))
+	}
+	if ipv6 {
+		if err := setupNAT(logger, ip6tables, ipVm6, net.IPv6loopback, vmSpec.Guest.Ports); err != nil {
 			return nil, err
 		}
 	}
-	logger.Info("setup MASQUERADE rule for traffic originating from localhost")
-	iptablesArgs = []string{
-		"-t", "nat", "-A", "POSTROUTING",
-		"-m", "addrtype", "--src-type", "LOCAL", "--dst-type", "UNICAST",
-		"-j", "MASQUERADE",
-	}
-	if err := execFg("iptables", iptablesArgs...); err != nil {
-		logger.Error("could not set up MASQUERADE rule for traffic from localhost", zap.Error(err))
-		return nil, err
-	}
 
 	// get dns details from /etc/resolv.conf
 	resolvConf, err := getResolvConf()
@@ -1612,7 +2041,6 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		logger.Error("could not get DNS details", zap.Error(err))
 		return nil, err
 	}
-	dns := getNameservers(resolvConf.Content, types.IP)[0]
 	dnsSearch := strings.Join(getSearchDomains(resolvConf.Content), ",")
 
 	// prepare dnsmask command line (instead of config file)
@@ -1632,10 +2060,26 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		fmt.Sprintf("--dhcp-range=%s,static,%d.%d.%d.%d", ipVm.String(), mask[0], mask[1], mask[2], mask[3]),
 		fmt.Sprintf("--dhcp-host=%s,%s,infinite", mac.String(), ipVm.String()),
 		fmt.Sprintf("--dhcp-option=option:router,%s", ipPod.String()),
-		fmt.Sprintf("--dhcp-option=option:dns-server,%s", dns),
 		fmt.Sprintf("--dhcp-option=option:domain-search,%s", dnsSearch),
 		fmt.Sprintf("--shared-network=%s,%s", defaultNetworkBridgeName, ipVm.String()),
 	}
+	// IPv6-only pods may not have an IPv4 nameserver, in which case the guest gets its DNS servers
+	// with DHCPv6 instead.
+	if dns := getNameservers(resolvConf.Content, types.IPv4); len(dns) != 0 {
+		dnsMaskCmd = append(dnsMaskCmd, fmt.Sprintf("--dhcp-option=option:dns-server,%s", dns[0]))
+	}
+	if ipv6 {
+		// Router advertisements for SLAAC, and stateless DHCPv6 for the DNS details.
+		dnsMaskCmd = append(
+			dnsMaskCmd,
+			"--enable-ra",
+			fmt.Sprintf("--dhcp-range=%s,ra-stateless,64", ipPod6.Mask(net.CIDRMask(64, 128)).String()),
+			fmt.Sprintf("--dhcp-option=option6:domain-search,%s", dnsSearch),
+		)
+		if dns := getNameservers(resolvConf.Content, types.IPv6); len(dns) != 0 {
+			dnsMaskCmd = append(dnsMaskCmd, fmt.Sprintf("--dhcp-option=option6:dns-server,[%s]", dns[0]))
+		}
+	}
 
 	// run dnsmasq for default Guest interface
 	if err := execFg("dnsmasq", dnsMaskCmd...); err != nil {
@@ -1651,7 +2095,7 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 		return nil, err
 	}
 	defer f.Close()
-	record := fmt.Sprintf("%v guest-vm\n", ipVm)
+	record := fmt.Sprintf("%v %s\n", ipVm, guestHostname)
 	if _, err := f.WriteString(record); err != nil {
 		return nil, err
 	}
@@ -1659,6 +2103,84 @@ func defaultNetwork(logger *zap.Logger, cidr string, ports []vmv1.Port) (mac.MAC
 	return mac, nil
 }
 
+// iptablesCommands returns the commands to use for IPv4 and IPv6 rules with the given port
+// forwarding implementation
+func iptablesCommands(pf vmv1.PortForwarding) (iptables string, ip6tables string) {
+	switch pf {
+	case vmv1.PortForwardingIPTables:
+		return "iptables", "ip6tables"
+	case vmv1.PortForwardingNFTables:
+		return "iptables-nft", "ip6tables-nft"
+	default:
+		panic(fmt.Errorf("unknown port forwarding implementation %q", pf))
+	}
+}
+
+// setupNAT sets up masquerading for traffic from the VM, and forwarding of traffic to the VM's
+// ports, using iptables or ip6tables.
+func setupNAT(logger *zap.Logger, iptables string, ipVm net.IP, loopback net.IP, ports []vmv1.Port) error {
+	logger = logger.With(zap.String("iptables", iptables))
+
+	// setup masquerading outgoing (from VM) traffic
+	logger.Info("setup masquerading for outgoing traffic")
+	if err := execFg(iptables, "-t", "nat", "-A", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE"); err != nil {
+		logger.Error("could not setup masquerading for outgoing traffic", zap.Error(err))
+		return err
+	}
+
+	// pass incoming traffic to .Guest.Spec.Ports into VM
+	var iptablesArgs []string
+	for _, port := range ports {
+		// formats as [ip]:port for IPv6
+		dest := net.JoinHostPort(ipVm.String(), fmt.Sprint(port.Port))
+
+		logger.Info(fmt.Sprintf("setup DNAT rule for incoming traffic to port %d", port.Port))
+		iptablesArgs = []string{
+			"-t", "nat", "-A", "PREROUTING",
+			"-i", "eth0", "-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
+			"-j", "DNAT", "--to", dest,
+		}
+		if err := execFg(iptables, iptablesArgs...); err != nil {
+			logger.Error("could not set up DNAT rule for incoming traffic", zap.Error(err))
+			return err
+		}
+		logger.Info(fmt.Sprintf("setup DNAT rule for traffic originating from localhost to port %d", port.Port))
+		iptablesArgs = []string{
+			"-t", "nat", "-A", "OUTPUT",
+			"-m", "addrtype", "--src-type", "LOCAL", "--dst-type", "LOCAL",
+			"-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
+			"-j", "DNAT", "--to-destination", dest,
+		}
+		if err := execFg(iptables, iptablesArgs...); err != nil {
+			logger.Error("could not set up DNAT rule for traffic from localhost", zap.Error(err))
+			return err
+		}
+		logger.Info(fmt.Sprintf("setup ACCEPT rule for traffic originating from localhost to port %d", port.Port))
+		iptablesArgs = []string{
+			"-A", "OUTPUT",
+			"-s", loopback.String(), "-d", ipVm.String(),
+			"-p", fmt.Sprint(port.Protocol), "--dport", fmt.Sprint(port.Port),
+			"-j", "ACCEPT",
+		}
+		if err := execFg(iptables, iptablesArgs...); err != nil {
+			logger.Error("could not set up ACCEPT rule for traffic from localhost", zap.Error(err))
+			return err
+		}
+	}
+	logger.Info("setup MASQUERADE rule for traffic originating from localhost")
+	iptablesArgs = []string{
+		"-t", "nat", "-A", "POSTROUTING",
+		"-m", "addrtype", "--src-type", "LOCAL", "--dst-type", "UNICAST",
+		"-j", "MASQUERADE",
+	}
+	if err := execFg(iptables, iptablesArgs...); err != nil {
+		logger.Error("could not set up MASQUERADE rule for traffic from localhost", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
 func overlayNetwork(iface string) (mac.MAC, error) {
 	// gerenare random MAC for overlay Guest interface
 	mac, err := mac.GenerateRandMAC()
@@ -1705,8 +2227,8 @@ func overlayNetwork(iface string) (mac.MAC, error) {
 	if err != nil {
 		return nil, err
 	}
-	// firsly delete IP address(es) (it it exist) from overlay interface
-	overlayAddrs, err := netlink.AddrList(overlayLink, netlink.FAMILY_V4)
+	// firsly delete IP address(es) (it it exist) from overlay interface, for both IPv4 and IPv6
+	overlayAddrs, err := netlink.AddrList(overlayLink, netlink.FAMILY_ALL)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,90 @@
+package main
+
+// Prometheus metrics for the runner, served at /metrics on the runner's HTTP server.
+//
+// All metrics are labeled with the VM's name and namespace (from the VM_NAME and K8S_POD_NAMESPACE
+// environment variables set by neonvm-controller), so that they can be scraped directly from each
+// runner pod without relabeling.
+
+import (
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type runnerMetrics struct {
+	registry *prometheus.Registry
+
+	rootDiskReadLatency      prometheus.Histogram
+	rootDiskPrefetchProgress prometheus.Gauge
+	rootDiskPrefetchFailures prometheus.Counter
+
+	cpuBurstActive          prometheus.Gauge
+	cpuBurstsTotal          prometheus.Counter
+	cpuBurstsDeniedTotal    *prometheus.CounterVec
+	cpuBurstCPUSecondsTotal prometheus.Counter
+}
+
+func makeRunnerMetrics(logger *zap.Logger) *runnerMetrics {
+	registry := prometheus.NewRegistry()
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{
+		"vm_name":      os.Getenv("VM_NAME"),
+		"vm_namespace": os.Getenv("K8S_POD_NAMESPACE"),
+	}, registry)
+	// Collected on each scrape. See netstats.go and qemustats.go.
+	reg.MustRegister(newNetworkStatsCollector(defaultNetworkTapName, overlayNetworkTapName))
+	reg.MustRegister(newQEMUStatsCollector(logger))
+
+	return &runnerMetrics{
+		registry: registry,
+
+		rootDiskReadLatency: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "runner_rootdisk_streaming_read_latency_seconds",
+				Help:    "Average latency of root disk reads while the root disk is still being streamed from its remote source",
+				Buckets: []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+			},
+		)),
+		rootDiskPrefetchProgress: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "runner_rootdisk_streaming_prefetch_progress_ratio",
+				Help: "Fraction of the streamed root disk that has been copied to local storage by background prefetch",
+			},
+		)),
+		rootDiskPrefetchFailures: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "runner_rootdisk_streaming_prefetch_failures_total",
+				Help: "Number of times that background prefetch of the streamed root disk failed, leaving the VM dependent on the remote source",
+			},
+		)),
+
+		cpuBurstActive: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "runner_cpu_burst_active",
+				Help: "Whether the VM is currently bursting above its CPU allocation (1 if so, 0 otherwise)",
+			},
+		)),
+		cpuBurstsTotal: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "runner_cpu_bursts_total",
+				Help: "Number of CPU bursts started",
+			},
+		)),
+		cpuBurstsDeniedTotal: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "runner_cpu_bursts_denied_total",
+				Help: "Number of times the VM was throttled but a CPU burst was not started, by reason",
+			},
+			[]string{"reason"},
+		)),
+		cpuBurstCPUSecondsTotal: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "runner_cpu_burst_cpu_seconds_total",
+				Help: "Total CPU allowed above the VM's allocation while bursting, integrated over time",
+			},
+		)),
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+// Tuning of the guest's default network interface
+//
+// By default, the guest's default network interface is a single-queue virtio-net device, backed by
+// vhost-net, with the tap device's default MTU. That caps the VM's network throughput at what one
+// of the guest's CPUs can process, no matter how many it has.
+//
+// With .spec.guest.network, the device can have multiple queue pairs (for which the tap device is
+// created with IFF_MULTI_QUEUE, and QEMU opens it once per queue), vhost-net can be turned off, and
+// the MTU can be changed. The MTU is set on the tap device and advertised to the guest through
+// virtio-net's host_mtu, so that the guest's interface picks it up without any configuration.
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// guestNetworkTuning is the effective tuning of the guest's default network interface, after
+// defaults
+type guestNetworkTuning struct {
+	queues int
+	vhost  bool
+	// mtu is the MTU of the interface, or zero to use the default
+	mtu int
+}
+
+func getGuestNetworkTuning(vmSpec *vmv1.VirtualMachineSpec) guestNetworkTuning {
+	tuning := guestNetworkTuning{
+		queues: 1,
+		vhost:  true,
+		mtu:    0,
+	}
+
+	network := vmSpec.Guest.Network
+	if network == nil {
+		return tuning
+	}
+	if network.Queues > 1 {
+		tuning.queues = int(network.Queues)
+	}
+	if network.Vhost != nil {
+		tuning.vhost = *network.Vhost
+	}
+	if network.MTU != nil {
+		tuning.mtu = int(*network.MTU)
+	}
+	return tuning
+}
+
+// tapFlags returns the flags to create the interface's tap device with
+func (t guestNetworkTuning) tapFlags() netlink.TuntapFlag {
+	if t.queues > 1 {
+		return netlink.TUNTAP_MULTI_QUEUE_DEFAULTS
+	}
+	return netlink.TUNTAP_DEFAULTS
+}
+
+// qemuArgs returns the QEMU arguments for the interface, with the given netdev id, tap device,
+// and MAC address
+func (t guestNetworkTuning) qemuArgs(id string, tapName string, macAddr string) []string {
+	vhost := "off"
+	if t.vhost {
+		vhost = "on"
+	}
+	netdev := fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no,vhost=%s", id, tapName, vhost)
+	device := fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", id, macAddr)
+
+	if t.queues > 1 {
+		netdev += fmt.Sprintf(",queues=%d", t.queues)
+		// One MSI-X vector for each of the RX and TX queues, plus one for config changes and one
+		// for the control queue.
+		device += fmt.Sprintf(",mq=on,vectors=%d", 2*t.queues+2)
+	}
+	if t.mtu != 0 {
+		device += fmt.Sprintf(",host_mtu=%d", t.mtu)
+	}
+
+	return []string{"-netdev", netdev, "-device", device}
+}
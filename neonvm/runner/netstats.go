@@ -0,0 +1,298 @@
+package main
+
+// Network statistics from the runner's forwarding path
+//
+// All of the VM's traffic goes through the runner pod's network namespace: the guest's tap device
+// is bridged there, and connections to the VM's ports are DNAT'ed to it (see setupNAT). If that
+// path is saturated - e.g. the conntrack table is full, or the tap device is dropping packets -
+// the guest sees failed or slow connections with no indication of why.
+//
+// networkStatsCollector reports the relevant kernel counters for the pod's network namespace on
+// each scrape of /metrics, along with the VM's network throughput through its tap devices. Counters that can't be read (e.g. because the kernel doesn't have
+// conntrack's procfs interface) are skipped.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+	conntrackMaxPath   = "/proc/sys/net/netfilter/nf_conntrack_max"
+	conntrackStatPath  = "/proc/net/stat/nf_conntrack"
+	conntrackTablePath = "/proc/net/nf_conntrack"
+	procNetSNMPPath    = "/proc/net/snmp"
+	procNetNetstatPath = "/proc/net/netstat"
+)
+
+// conntrackDropStats are the columns of /proc/net/stat/nf_conntrack reported as drops
+var conntrackDropStats = []string{"drop", "early_drop", "insert_failed", "invalid"}
+
+type networkStatsCollector struct {
+	taps []string
+
+	conntrackEntries     *prometheus.Desc
+	conntrackMax         *prometheus.Desc
+	conntrackEstablished *prometheus.Desc
+	conntrackDrops       *prometheus.Desc
+	ipForwarded          *prometheus.Desc
+	ipDiscarded          *prometheus.Desc
+	tcpEstablished       *prometheus.Desc
+	tcpListenOverflows   *prometheus.Desc
+	tcpListenDrops       *prometheus.Desc
+	tapDroppedPackets    *prometheus.Desc
+	tapBytes             *prometheus.Desc
+	tapPackets           *prometheus.Desc
+}
+
+func newNetworkStatsCollector(taps ...string) *networkStatsCollector {
+	return &networkStatsCollector{
+		taps: taps,
+
+		conntrackEntries: prometheus.NewDesc(
+			"runner_conntrack_entries",
+			"Number of entries in the runner's conntrack table",
+			nil, nil,
+		),
+		conntrackMax: prometheus.NewDesc(
+			"runner_conntrack_max_entries",
+			"Maximum number of entries in the runner's conntrack table",
+			nil, nil,
+		),
+		conntrackEstablished: prometheus.NewDesc(
+			"runner_conntrack_established_connections",
+			"Number of established TCP connections tracked by the runner's conntrack table, including those forwarded to the VM",
+			nil, nil,
+		),
+		conntrackDrops: prometheus.NewDesc(
+			"runner_conntrack_dropped_packets_total",
+			"Number of packets dropped by conntrack in the runner, by reason",
+			[]string{"reason"}, nil,
+		),
+		ipForwarded: prometheus.NewDesc(
+			"runner_ip_forwarded_packets_total",
+			"Number of IPv4 packets forwarded by the runner",
+			nil, nil,
+		),
+		ipDiscarded: prometheus.NewDesc(
+			"runner_ip_discarded_packets_total",
+			"Number of IPv4 packets discarded by the runner without an error in the packet, by direction",
+			[]string{"direction"}, nil,
+		),
+		tcpEstablished: prometheus.NewDesc(
+			"runner_tcp_established_connections",
+			"Number of TCP connections in the ESTABLISHED or CLOSE-WAIT state on the runner's own sockets",
+			nil, nil,
+		),
+		tcpListenOverflows: prometheus.NewDesc(
+			"runner_tcp_listen_overflows_total",
+			"Number of times the accept queue of a listening socket in the runner was full",
+			nil, nil,
+		),
+		tcpListenDrops: prometheus.NewDesc(
+			"runner_tcp_listen_drops_total",
+			"Number of SYNs to listening sockets in the runner that were dropped",
+			nil, nil,
+		),
+		tapDroppedPackets: prometheus.NewDesc(
+			"runner_tap_dropped_packets_total",
+			"Number of packets dropped by the VM's tap devices, by interface and direction",
+			[]string{"interface", "direction"}, nil,
+		),
+		// nb: directions are from the host's side of the tap device, so "rx" is sent by the guest.
+		tapBytes: prometheus.NewDesc(
+			"runner_tap_bytes_total",
+			"Number of bytes passed through the VM's tap devices, by interface and direction",
+			[]string{"interface", "direction"}, nil,
+		),
+		tapPackets: prometheus.NewDesc(
+			"runner_tap_packets_total",
+			"Number of packets passed through the VM's tap devices, by interface and direction",
+			[]string{"interface", "direction"}, nil,
+		),
+	}
+}
+
+func (c *networkStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.conntrackEntries
+	ch <- c.conntrackMax
+	ch <- c.conntrackEstablished
+	ch <- c.conntrackDrops
+	ch <- c.ipForwarded
+	ch <- c.ipDiscarded
+	ch <- c.tcpEstablished
+	ch <- c.tcpListenOverflows
+	ch <- c.tcpListenDrops
+	ch <- c.tapDroppedPackets
+	ch <- c.tapBytes
+	ch <- c.tapPackets
+}
+
+func (c *networkStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	if n, err := readUintFile(conntrackCountPath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.conntrackEntries, prometheus.GaugeValue, float64(n))
+	}
+	if n, err := readUintFile(conntrackMaxPath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.conntrackMax, prometheus.GaugeValue, float64(n))
+	}
+	if n, err := countEstablishedConntrack(conntrackTablePath); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.conntrackEstablished, prometheus.GaugeValue, float64(n))
+	}
+	if stats, err := readConntrackStats(conntrackStatPath); err == nil {
+		for _, reason := range conntrackDropStats {
+			if n, ok := stats[reason]; ok {
+				ch <- prometheus.MustNewConstMetric(c.conntrackDrops, prometheus.CounterValue, float64(n), reason)
+			}
+		}
+	}
+
+	if snmp, err := readProcNetStats(procNetSNMPPath); err == nil {
+		if n, ok := snmp["Ip"]["ForwDatagrams"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.ipForwarded, prometheus.CounterValue, float64(n))
+		}
+		if n, ok := snmp["Ip"]["InDiscards"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.ipDiscarded, prometheus.CounterValue, float64(n), "in")
+		}
+		if n, ok := snmp["Ip"]["OutDiscards"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.ipDiscarded, prometheus.CounterValue, float64(n), "out")
+		}
+		if n, ok := snmp["Tcp"]["CurrEstab"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.tcpEstablished, prometheus.GaugeValue, float64(n))
+		}
+	}
+	if netstat, err := readProcNetStats(procNetNetstatPath); err == nil {
+		if n, ok := netstat["TcpExt"]["ListenOverflows"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.tcpListenOverflows, prometheus.CounterValue, float64(n))
+		}
+		if n, ok := netstat["TcpExt"]["ListenDrops"]; ok {
+			ch <- prometheus.MustNewConstMetric(c.tcpListenDrops, prometheus.CounterValue, float64(n))
+		}
+	}
+
+	for _, tap := range c.taps {
+		for _, direction := range []string{"rx", "tx"} {
+			for _, stat := range []struct {
+				name string
+				desc *prometheus.Desc
+			}{
+				{"dropped", c.tapDroppedPackets},
+				{"bytes", c.tapBytes},
+				{"packets", c.tapPackets},
+			} {
+				path := filepath.Join("/sys/class/net", tap, "statistics", direction+"_"+stat.name)
+				if n, err := readUintFile(path); err == nil {
+					ch <- prometheus.MustNewConstMetric(stat.desc, prometheus.CounterValue, float64(n), tap, direction)
+				}
+			}
+		}
+	}
+}
+
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// countEstablishedConntrack returns the number of TCP connections in the ESTABLISHED state in the
+// conntrack table at path, which is in the format of /proc/net/nf_conntrack.
+func countEstablishedConntrack(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Lines look like: 'ipv4 2 tcp 6 431999 ESTABLISHED src=...'
+		if len(fields) > 5 && fields[2] == "tcp" && fields[5] == "ESTABLISHED" {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// readConntrackStats reads the per-CPU conntrack statistics at path, which is in the format of
+// /proc/net/stat/nf_conntrack, returning the totals across all CPUs.
+//
+// The first line gives the column names, which vary between kernel versions. Each following line
+// has the hex-encoded values for one CPU.
+func readConntrackStats(path string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+
+	names := strings.Fields(lines[0])
+	totals := make(map[string]uint64, len(names))
+	for _, line := range lines[1:] {
+		values := strings.Fields(line)
+		if len(values) != len(names) {
+			return nil, fmt.Errorf("expected %d values in %s, got %d", len(names), path, len(values))
+		}
+		for i, v := range values {
+			n, err := strconv.ParseUint(v, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s in %s: %w", v, names[i], path, err)
+			}
+			// The "entries" column is the same for every CPU, not a per-CPU count.
+			if names[i] == "entries" {
+				totals[names[i]] = n
+			} else {
+				totals[names[i]] += n
+			}
+		}
+	}
+	return totals, nil
+}
+
+// readProcNetStats reads the statistics at path, which is in the format of /proc/net/snmp or
+// /proc/net/netstat, returning the values by section and name - e.g. stats["Tcp"]["CurrEstab"].
+//
+// Each section is a pair of lines: the first with the names of its values, the second with the
+// values themselves, both prefixed by the section name.
+func readProcNetStats(path string) (map[string]map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines)%2 != 0 {
+		return nil, fmt.Errorf("expected an even number of lines in %s, got %d", path, len(lines))
+	}
+
+	stats := make(map[string]map[string]uint64)
+	for i := 0; i < len(lines); i += 2 {
+		names := strings.Fields(lines[i])
+		values := strings.Fields(lines[i+1])
+		if len(names) == 0 || len(names) != len(values) || names[0] != values[0] {
+			return nil, fmt.Errorf("mismatched lines %d and %d in %s", i+1, i+2, path)
+		}
+		section := strings.TrimSuffix(names[0], ":")
+		stats[section] = make(map[string]uint64, len(names)-1)
+		for j := 1; j < len(names); j++ {
+			// Some values (e.g. Tcp MaxConn) may be negative. We don't report any of them.
+			n, err := strconv.ParseUint(values[j], 10, 64)
+			if err != nil {
+				continue
+			}
+			stats[section][names[j]] = n
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+// Statistics about the VM, from QEMU
+//
+// qemuStatsCollector queries QEMU over a dedicated QMP socket on each scrape of /metrics, so that
+// per-VM stats are available without a separate exporter. Everything is reported as QEMU sees it:
+// the CPUs and memory currently plugged in, and the cumulative I/O counters for each block device.
+//
+// The dirty page rate is measured in the background by QEMU ('calc-dirty-rate'), which takes a
+// second of sampling. Each scrape reports the last measurement and starts the next one, so the
+// value is from around the time of the previous scrape.
+//
+// Each block device's I/O limits are reported too, along with an approximation of the time it's
+// spent at them - see io_limits.go.
+//
+// If QEMU can't be queried (e.g. because it hasn't started yet), only runner_qemu_stats_up is
+// reported, as 0.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	qmpUnixSocketForStats = "/vm/qmp-stats.sock"
+	qemuStatsTimeout      = 2 * time.Second
+)
+
+type qemuStatsCollector struct {
+	logger *zap.Logger
+	// mu ensures only one scrape talks to QEMU at a time. QEMU only accepts a single client on
+	// each QMP socket.
+	mu sync.Mutex
+	// prevBlockSamples are the block devices' counters from the previous scrape, by device
+	prevBlockSamples map[string]blockIOSample
+	// throttledSeconds is the cumulative time each block device has spent at each of its limits
+	throttledSeconds map[blockLimit]float64
+
+	up                 *prometheus.Desc
+	vcpus              *prometheus.Desc
+	memory             *prometheus.Desc
+	virtioMemSize      *prometheus.Desc
+	virtioMemRequested *prometheus.Desc
+	blockOperations    *prometheus.Desc
+	blockBytes         *prometheus.Desc
+	blockTime          *prometheus.Desc
+	blockIOLimit       *prometheus.Desc
+	blockThrottled     *prometheus.Desc
+	dirtyPageRate      *prometheus.Desc
+}
+
+func newQEMUStatsCollector(logger *zap.Logger) *qemuStatsCollector {
+	return &qemuStatsCollector{
+		logger: logger.Named("qemu-stats"),
+		mu:     sync.Mutex{},
+
+		prevBlockSamples: make(map[string]blockIOSample),
+		throttledSeconds: make(map[blockLimit]float64),
+
+		up: prometheus.NewDesc(
+			"runner_qemu_stats_up",
+			"Whether the VM's stats could be queried from QEMU on this scrape (1 if so, 0 otherwise)",
+			nil, nil,
+		),
+		vcpus: prometheus.NewDesc(
+			"runner_vm_vcpus",
+			"Number of vCPUs currently plugged into the VM",
+			nil, nil,
+		),
+		memory: prometheus.NewDesc(
+			"runner_vm_memory_bytes",
+			"Total memory currently plugged into the VM, including boot memory",
+			nil, nil,
+		),
+		virtioMemSize: prometheus.NewDesc(
+			"runner_vm_virtio_mem_size_bytes",
+			"Memory currently plugged into the VM's virtio-mem device",
+			nil, nil,
+		),
+		virtioMemRequested: prometheus.NewDesc(
+			"runner_vm_virtio_mem_requested_size_bytes",
+			"Memory requested from the guest for the VM's virtio-mem device",
+			nil, nil,
+		),
+		blockOperations: prometheus.NewDesc(
+			"runner_vm_block_operations_total",
+			"Number of operations completed by each of the VM's block devices, by operation",
+			[]string{"device", "operation"}, nil,
+		),
+		blockBytes: prometheus.NewDesc(
+			"runner_vm_block_bytes_total",
+			"Number of bytes transferred by each of the VM's block devices, by operation",
+			[]string{"device", "operation"}, nil,
+		),
+		blockTime: prometheus.NewDesc(
+			"runner_vm_block_operation_seconds_total",
+			"Total time spent on completed operations by each of the VM's block devices, by operation",
+			[]string{"device", "operation"}, nil,
+		),
+		blockIOLimit: prometheus.NewDesc(
+			"runner_vm_block_io_limit",
+			"I/O limit of each of the VM's block devices, by limit (in operations or bytes per second)",
+			[]string{"device", "limit"}, nil,
+		),
+		blockThrottled: prometheus.NewDesc(
+			"runner_vm_block_throttled_seconds_total",
+			"Approximate time each of the VM's block devices has spent at each of its I/O limits",
+			[]string{"device", "limit"}, nil,
+		),
+		dirtyPageRate: prometheus.NewDesc(
+			"runner_vm_dirty_page_rate_bytes_per_second",
+			"Rate at which the guest is writing to its memory, from QEMU's last measurement",
+			nil, nil,
+		),
+	}
+}
+
+func (c *qemuStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.vcpus
+	ch <- c.memory
+	ch <- c.virtioMemSize
+	ch <- c.virtioMemRequested
+	ch <- c.blockOperations
+	ch <- c.blockBytes
+	ch <- c.blockTime
+	ch <- c.blockIOLimit
+	ch <- c.blockThrottled
+	ch <- c.dirtyPageRate
+}
+
+func (c *qemuStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.collect(ch); err != nil {
+		c.logger.Warn("failed to query stats from QEMU", zap.Error(err))
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+}
+
+func (c *qemuStatsCollector) collect(ch chan<- prometheus.Metric) error {
+	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForStats, qemuStatsTimeout)
+	if err != nil {
+		return err
+	}
+	if err := mon.Connect(); err != nil {
+		return err
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	// Gather everything before sending any metrics, so that we don't report partial results on
+	// failure.
+	var cpus []struct{}
+	if err := qmpQuery(mon, "query-cpus-fast", &cpus); err != nil {
+		return err
+	}
+	var memory struct {
+		BaseMemory    int64 `json:"base-memory"`
+		PluggedMemory int64 `json:"plugged-memory"`
+	}
+	if err := qmpQuery(mon, "query-memory-size-summary", &memory); err != nil {
+		return err
+	}
+	var memoryDevices []struct {
+		Type string `json:"type"`
+		Data struct {
+			Size          int64 `json:"size"`
+			RequestedSize int64 `json:"requested-size"`
+		} `json:"data"`
+	}
+	if err := qmpQuery(mon, "query-memory-devices", &memoryDevices); err != nil {
+		return err
+	}
+	var blockStats []struct {
+		Device string `json:"device"`
+		QDev   string `json:"qdev"`
+		Stats  struct {
+			RdOperations     int64 `json:"rd_operations"`
+			WrOperations     int64 `json:"wr_operations"`
+			FlushOperations  int64 `json:"flush_operations"`
+			RdBytes          int64 `json:"rd_bytes"`
+			WrBytes          int64 `json:"wr_bytes"`
+			RdTotalTimeNs    int64 `json:"rd_total_time_ns"`
+			WrTotalTimeNs    int64 `json:"wr_total_time_ns"`
+			FlushTotalTimeNs int64 `json:"flush_total_time_ns"`
+		} `json:"stats"`
+	}
+	if err := qmpQuery(mon, "query-blockstats", &blockStats); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	ch <- prometheus.MustNewConstMetric(c.vcpus, prometheus.GaugeValue, float64(len(cpus)))
+	ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(memory.BaseMemory+memory.PluggedMemory))
+	for _, d := range memoryDevices {
+		if d.Type == "virtio-mem" {
+			ch <- prometheus.MustNewConstMetric(c.virtioMemSize, prometheus.GaugeValue, float64(d.Data.Size))
+			ch <- prometheus.MustNewConstMetric(c.virtioMemRequested, prometheus.GaugeValue, float64(d.Data.RequestedSize))
+		}
+	}
+	samples := make(map[string]blockIOSample)
+	for _, b := range blockStats {
+		// Drives added with -drive have a name, but hotplugged ones are only identified by
+		// their device.
+		device := b.Device
+		if device == "" {
+			device = b.QDev
+		}
+		s := b.Stats
+		samples[device] = blockIOSample{
+			at:      now,
+			rdOps:   s.RdOperations,
+			wrOps:   s.WrOperations,
+			rdBytes: s.RdBytes,
+			wrBytes: s.WrBytes,
+		}
+		for _, op := range []struct {
+			name       string
+			operations int64
+			bytes      int64
+			timeNs     int64
+		}{
+			{"read", s.RdOperations, s.RdBytes, s.RdTotalTimeNs},
+			{"write", s.WrOperations, s.WrBytes, s.WrTotalTimeNs},
+			{"flush", s.FlushOperations, 0, s.FlushTotalTimeNs},
+		} {
+			ch <- prometheus.MustNewConstMetric(c.blockOperations, prometheus.CounterValue, float64(op.operations), device, op.name)
+			ch <- prometheus.MustNewConstMetric(c.blockTime, prometheus.CounterValue, float64(op.timeNs)/1e9, device, op.name)
+			if op.name != "flush" {
+				ch <- prometheus.MustNewConstMetric(c.blockBytes, prometheus.CounterValue, float64(op.bytes), device, op.name)
+			}
+		}
+	}
+
+	c.collectIOLimits(mon, samples, ch)
+	c.collectDirtyPageRate(mon, ch)
+	return nil
+}
+
+// collectDirtyPageRate reports the last measurement of the dirty page rate, if there is one, and
+// starts the next.
+//
+// Failures aren't fatal, because not all guests support it - e.g. confidential guests.
+func (c *qemuStatsCollector) collectDirtyPageRate(mon *qmp.SocketMonitor, ch chan<- prometheus.Metric) {
+	var dirtyRate struct {
+		Status    string `json:"status"`
+		DirtyRate *int64 `json:"dirty-rate"` // in MiB/s
+	}
+	if err := qmpQuery(mon, "query-dirty-rate", &dirtyRate); err != nil {
+		c.logger.Debug("failed to query dirty page rate", zap.Error(err))
+		return
+	}
+
+	if dirtyRate.Status == "measured" && dirtyRate.DirtyRate != nil {
+		ch <- prometheus.MustNewConstMetric(c.dirtyPageRate, prometheus.GaugeValue, float64(*dirtyRate.DirtyRate*(1<<20)))
+	}
+
+	// Start the next measurement, unless there's already one in progress.
+	if dirtyRate.Status != "measuring" {
+		if _, err := mon.Run([]byte(`{"execute": "calc-dirty-rate", "arguments": {"calc-time": 1}}`)); err != nil {
+			c.logger.Debug("failed to start dirty page rate measurement", zap.Error(err))
+		}
+	}
+}
+
+// qmpQuery runs the QMP command without arguments, unmarshaling its result into the value pointed
+// to by result
+func qmpQuery(mon *qmp.SocketMonitor, command string, result any) error {
+	raw, err := mon.Run([]byte(fmt.Sprintf(`{"execute": %q}`, command)))
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+	resp := struct {
+		Return any `json:"return"`
+	}{Return: result}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return fmt.Errorf("error unmarshaling json for %s: %w", command, err)
+	}
+	return nil
+}
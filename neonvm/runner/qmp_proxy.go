@@ -0,0 +1,239 @@
+package main
+
+// Authenticated QMP proxy
+//
+// By default, QEMU listens for QMP directly on the VM's QMP ports, so anything that can reach the
+// pod can drive the hypervisor. When the runner is given '-qmp-auth-token-hash', QEMU instead
+// listens on unix sockets inside the container, and the runner proxies the QMP ports to them:
+//
+//   - Clients must send the api.QMPAuthenticateCommand command with the token (whose hash we were
+//     given) before anything other than 'qmp_capabilities'. This fits in with existing QMP clients,
+//     which send 'qmp_capabilities' as part of connecting.
+//   - Only commands in the allowlist are forwarded to QEMU.
+//   - Every command is logged by the "qmp-audit" logger, along with whether it was forwarded.
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	qmpUnixSocketForProxy       = "/vm/qmp.sock"
+	qmpUnixSocketForManualProxy = "/vm/qmp-manual.sock"
+)
+
+// qmpAllowedCommands are the commands that authenticated clients may send, in addition to any
+// 'query-*' commands. This is the set used by the controller.
+var qmpAllowedCommands = map[string]struct{}{
+	"qmp_capabilities":         {},
+	"block-stream":             {},
+	"cont":                     {},
+	"device_add":               {},
+	"device_del":               {},
+	"job-dismiss":              {},
+	"migrate":                  {},
+	"migrate-set-capabilities": {},
+	"migrate-set-parameters":   {},
+	"migrate-start-postcopy":   {},
+	"migrate_cancel":           {},
+	"object-add":               {},
+	"object-del":               {},
+	"qom-get":                  {},
+	"qom-list":                 {},
+	"qom-set":                  {},
+	"quit":                     {},
+	"stop":                     {},
+	"system_powerdown":         {},
+	"transaction":              {},
+}
+
+func qmpCommandAllowed(command string) bool {
+	_, ok := qmpAllowedCommands[command]
+	return ok || strings.HasPrefix(command, "query-")
+}
+
+// qmpArgs returns the QEMU arguments for the QMP server at the port, which listens on the socket
+// instead if the proxy is enabled
+func qmpArgs(cfg *Config, vmSpec *vmv1.VirtualMachineSpec, port int32, socket string) []string {
+	if cfg.qmpAuthTokenHash != "" {
+		return []string{"-qmp", fmt.Sprintf("unix:%s,server,wait=off", socket)}
+	}
+	return []string{"-qmp", fmt.Sprintf("tcp:%s,server,wait=off", listenAddr(vmSpec, port))}
+}
+
+// qmpMessage is the part of a QMP command that the proxy looks at
+type qmpMessage struct {
+	Execute   string          `json:"execute"`
+	ExecOOB   string          `json:"exec-oob"`
+	Arguments json.RawMessage `json:"arguments"`
+	ID        json.RawMessage `json:"id,omitempty"`
+}
+
+// listenForQMP proxies authenticated QMP connections on the port to QEMU's unix socket, until the
+// context is canceled
+func listenForQMP(
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg *Config,
+	vmSpec *vmv1.VirtualMachineSpec,
+	port int32,
+	socket string,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	logger = logger.Named("qmp-proxy").With(zap.Int32("port", port))
+	auditLogger := logger.Named("qmp-audit")
+
+	l, err := listen(listenAddr(vmSpec, port))
+	if err != nil {
+		logger.Fatal("QMP proxy failed to listen", zap.Error(err))
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("QMP proxy failed to accept connection", zap.Error(err))
+			}
+			return
+		}
+		go proxyQMPConnection(logger, auditLogger, cfg, conn, socket)
+	}
+}
+
+func proxyQMPConnection(logger, auditLogger *zap.Logger, cfg *Config, client net.Conn, socket string) {
+	defer client.Close()
+	clientAddr := client.RemoteAddr().String()
+	logger = logger.With(zap.String("client", clientAddr))
+	auditLogger = auditLogger.With(zap.String("client", clientAddr))
+
+	backend, err := net.Dial("unix", socket)
+	if err != nil {
+		logger.Error("failed to connect to QEMU", zap.Error(err))
+		return
+	}
+	defer backend.Close()
+
+	var writeLock sync.Mutex
+	write := func(msg []byte) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_, err := client.Write(msg)
+		return err
+	}
+	reply := func(msg qmpMessage, resp map[string]any) error {
+		if msg.ID != nil {
+			resp["id"] = msg.ID
+		}
+		content, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		return write(append(content, '\r', '\n'))
+	}
+	replyError := func(msg qmpMessage, desc string) error {
+		return reply(msg, map[string]any{
+			"error": map[string]string{"class": "GenericError", "desc": desc},
+		})
+	}
+
+	// QEMU -> client. QMP messages from QEMU are always newline-terminated.
+	go func() {
+		// Make sure the other side doesn't wait forever if QEMU closes the connection.
+		defer client.Close()
+		r := bufio.NewReader(backend)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) != 0 {
+				if err := write(line); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// client -> QEMU
+	authenticated := false
+	dec := json.NewDecoder(client)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Info("QMP client disconnected", zap.Error(err))
+			}
+			return
+		}
+
+		var msg qmpMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			auditLogger.Warn("Denied malformed QMP command", zap.Error(err))
+			if err := replyError(msg, "malformed command"); err != nil {
+				return
+			}
+			continue
+		}
+		command := msg.Execute
+		if command == "" {
+			command = msg.ExecOOB
+		}
+
+		var denyReason string
+		switch {
+		case command == api.QMPAuthenticateCommand:
+			var args api.QMPAuthenticateArguments
+			_ = json.Unmarshal(msg.Arguments, &args)
+			hash := api.QMPAuthTokenHash(args.Token)
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(cfg.qmpAuthTokenHash)) != 1 {
+				auditLogger.Warn("QMP authentication failed")
+				_ = replyError(msg, "authentication failed")
+				return
+			}
+			auditLogger.Info("QMP client authenticated")
+			authenticated = true
+			if err := reply(msg, map[string]any{"return": struct{}{}}); err != nil {
+				return
+			}
+			continue
+		case command == "qmp_capabilities":
+			// always allowed, because QMP clients send this before anything else
+		case !authenticated:
+			denyReason = "authentication required"
+		case !qmpCommandAllowed(command):
+			denyReason = "command not allowed"
+		}
+
+		if denyReason != "" {
+			auditLogger.Warn("Denied QMP command", zap.String("command", command), zap.String("reason", denyReason))
+			if err := replyError(msg, denyReason); err != nil {
+				return
+			}
+			continue
+		}
+
+		auditLogger.Info("Forwarding QMP command", zap.String("command", command), zap.ByteString("arguments", msg.Arguments))
+		if _, err := backend.Write(raw); err != nil {
+			logger.Error("failed to forward QMP command to QEMU", zap.Error(err))
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+// Guest readiness probe
+//
+// With .spec.guest.readinessProbe, we periodically run the probe against the guest, and serve the
+// result at GET /ready on the console server. The controller sets that as the runner container's
+// readiness probe, so the pod - and so the Services that select it - is only ready while the
+// guest's workload is actually up.
+//
+// The probe is run from the runner container: HTTP and TCP probes connect to the guest directly,
+// and exec probes run the command over SSH, as 'ssh guest-vm' would from inside the container.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// guestHostname is the name that the guest's IP address is given in the container's /etc/hosts
+const guestHostname = "guest-vm"
+
+// guestReadiness is the latest result of the readiness probe
+type guestReadiness struct {
+	ready atomic.Bool
+}
+
+func runReadinessProbe(
+	ctx context.Context,
+	logger *zap.Logger,
+	probe *vmv1.GuestProbe,
+	readiness *guestReadiness,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	logger = logger.Named("readiness-probe")
+	timeout := time.Second * time.Duration(probe.TimeoutSeconds)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second * time.Duration(probe.InitialDelaySeconds)):
+	}
+
+	var successes, failures int32
+	for {
+		err := runGuestProbe(ctx, probe, timeout)
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		ready := readiness.ready.Load()
+		if !ready && successes >= probe.SuccessThreshold {
+			logger.Info("guest is ready")
+			readiness.ready.Store(true)
+		} else if ready && failures >= probe.FailureThreshold {
+			logger.Warn("guest is no longer ready", zap.Error(err))
+			readiness.ready.Store(false)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * time.Duration(probe.PeriodSeconds)):
+		}
+	}
+}
+
+// runGuestProbe runs the probe once, returning an error if it failed
+func runGuestProbe(ctx context.Context, probe *vmv1.GuestProbe, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case probe.HTTPGet != nil:
+		path := probe.HTTPGet.Path
+		if path == "" {
+			path = "/"
+		}
+		url := fmt.Sprintf("http://%s%s", net.JoinHostPort(guestHostname, fmt.Sprint(probe.HTTPGet.Port)), path)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	case probe.TCPSocket != nil:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(guestHostname, fmt.Sprint(probe.TCPSocket.Port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case probe.Exec != nil:
+		cmd := guestSSHCommand(ctx, probe.Exec.Command)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	default:
+		return errors.New("probe has no handler")
+	}
+}
+
+// handleReady serves the result of the readiness probe: 200 if the guest is ready, 503 otherwise
+func handleReady(w http.ResponseWriter, r *http.Request, readiness *guestReadiness) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(400)
+		return
+	}
+	if !readiness.ready.Load() {
+		w.WriteHeader(503)
+		_, _ = w.Write([]byte("guest is not ready"))
+		return
+	}
+	_, _ = w.Write([]byte("guest is ready"))
+}
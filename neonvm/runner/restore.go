@@ -0,0 +1,158 @@
+package main
+
+// Restoring a VM from a VirtualMachineSnapshot
+//
+// The runner pod's "restore-snapshot" init container copies the snapshot's disks (and optionally
+// its memory state) into /vm/images before we start. Restored disks are used in place of fresh
+// ones, and the memory state is loaded by QEMU as an incoming migration from the file.
+//
+// Loading the memory state requires that QEMU has exactly the same devices as the snapshotted VM,
+// so we plug in the CPUs and memory that it was using from the start. This relies on hotplugged
+// devices being numbered contiguously from the first free slot, which is what neonvm-controller
+// does when scaling.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	qmpUnixSocketForRestore = "/vm/qmp-restore.sock"
+	restoredMemoryPath      = "/vm/images/memory.gz"
+	restorePollInterval     = time.Second
+)
+
+// restoringMemory returns whether QEMU should load the memory state from the VM's snapshot
+func restoringMemory(vmSpec *vmv1.VirtualMachineSpec) bool {
+	if vmSpec.RestoreFrom == nil || !vmSpec.RestoreFrom.RestoreMemory {
+		return false
+	}
+	// Migration target pods receive their state from the source VM instead.
+	if os.Getenv("RECEIVE_MIGRATION") == "true" {
+		return false
+	}
+	_, err := os.Stat(restoredMemoryPath)
+	return err == nil
+}
+
+// restoredDiskExists returns whether the disk at the path was restored from the VM's snapshot (or
+// the snapshot of the VM it was cloned from), in which case it must not be recreated.
+func restoredDiskExists(vmSpec *vmv1.VirtualMachineSpec, diskPath string) bool {
+	if !vmSpec.RestoresDisks() {
+		return false
+	}
+	_, err := os.Stat(diskPath)
+	return err == nil
+}
+
+// restoreMemoryArgs returns the extra QEMU arguments required to load the snapshot's memory state:
+// the hotplugged CPUs and DIMM slots that were in use, and the incoming migration itself.
+//
+// For virtio-mem, the amount of plugged memory is set by the device's requested-size instead. CPUs
+// are only hotplugged with the QMPHotplug CPU scaling mode - otherwise, they're all plugged already.
+func restoreMemoryArgs(cfg *Config, arch archSettings, vmSpec *vmv1.VirtualMachineSpec) []string {
+	guest := vmSpec.Guest
+
+	var args []string
+	if cfg.cpuScalingMode == vmv1.CPUScalingModeQMPHotplug {
+		for core := guest.CPUs.Min.RoundedUp(); core < guest.CPUs.Use.RoundedUp(); core++ {
+			args = append(args, "-device", fmt.Sprintf("%s,id=cpu%d,core-id=%d,socket-id=0,thread-id=0", arch.cpuDriver, core, core))
+		}
+	}
+
+	if cfg.memoryProvider == vmv1.MemoryProviderDIMMSlots {
+		for idx := 1; idx <= int(guest.MemorySlots.Use-guest.MemorySlots.Min); idx++ {
+			args = append(
+				args,
+				"-object", memoryBackendObject(&guest, fmt.Sprintf("memslot%d", idx), guest.MemorySlotSize.Value(), true),
+				"-device", fmt.Sprintf("pc-dimm,id=dimm%d,memdev=memslot%d", idx, idx),
+			)
+		}
+	}
+
+	args = append(args, "-incoming", fmt.Sprintf("exec:gzip -dc %s", restoredMemoryPath))
+	return args
+}
+
+type qmpStatus struct {
+	Return struct {
+		Status string `json:"status"`
+	} `json:"return"`
+}
+
+// resumeAfterRestore waits for QEMU to finish loading the snapshot's memory state, and then resumes
+// the guest, which was paused when the snapshot was taken.
+//
+// If the VM's runPolicy is Paused, the guest is left paused.
+func resumeAfterRestore(ctx context.Context, logger *zap.Logger, runPolicy vmv1.RunPolicy, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger = logger.Named("restore")
+
+	// Wait a bit to reduce the chance we attempt connecting before QEMU is started
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return
+	}
+
+	mon, err := qmp.NewSocketMonitor("unix", qmpUnixSocketForRestore, 2*time.Second)
+	if err != nil {
+		logger.Error("failed to connect to QEMU monitor", zap.Error(err))
+		return
+	}
+	if err := mon.Connect(); err != nil {
+		logger.Error("failed to start monitor connection", zap.Error(err))
+		return
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	ticker := time.NewTicker(restorePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		raw, err := mon.Run([]byte(`{"execute": "query-status"}`))
+		if err != nil {
+			logger.Error("failed to query status", zap.Error(err))
+			continue
+		}
+		var status qmpStatus
+		if err := json.Unmarshal(raw, &status); err != nil {
+			logger.Error("failed to unmarshal status", zap.Error(err))
+			continue
+		}
+
+		switch status.Return.Status {
+		case "inmigrate":
+			continue
+		case "running":
+			logger.Info("guest is already running after restore")
+			return
+		}
+
+		if runPolicy == vmv1.RunPolicyPaused {
+			logger.Info("restored memory from snapshot, leaving guest paused because of runPolicy")
+			return
+		}
+		if _, err := mon.Run([]byte(`{"execute": "cont"}`)); err != nil {
+			logger.Error("failed to resume guest after restore", zap.Error(err))
+			return
+		}
+		logger.Info("restored memory from snapshot and resumed guest")
+		return
+	}
+}
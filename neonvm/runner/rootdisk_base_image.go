@@ -0,0 +1,184 @@
+package main
+
+// Root disks as overlays on top of a shared base image
+//
+// With .spec.guest.rootDisk.baseImageCache, the init container makes sure the root disk image is
+// in a cache shared between VMs (see neonvm/controllers/rootdisk_base_images.go), and tells us its
+// path. We create the root disk as a local qcow2 overlay with the base image as its backing file.
+// If the image is compressed, the init container only copies the compressed image into the cache,
+// and the first runner to use it decompresses it (see decompressBaseImage).
+//
+// Unused base images are garbage collected by the runners themselves: the modification time of a
+// base image is used as a lease, which each runner renews periodically while its VM is using the
+// image. Every runner also periodically removes base images whose lease has expired - i.e. that no
+// running VM has renewed for baseImageUnusedTTL.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	rootDiskBaseImagesPath = "/vm/base-images"
+	rootDiskBasePathFile   = "/vm/images/rootdisk.base"
+
+	// baseImageRenewInterval is how often we renew the lease on the base image our VM is using, and
+	// remove expired base images.
+	baseImageRenewInterval = time.Hour
+	// baseImageUnusedTTL is how long after the last renewal a base image is removed. It must be
+	// much longer than baseImageRenewInterval, so that base images in use are never removed.
+	baseImageUnusedTTL = 24 * time.Hour
+)
+
+// createRootDiskOverlay creates the root disk as an overlay on top of the base image from the
+// cache.
+//
+// The overlay has the same size as the base image; it's resized afterwards by resizeRootDisk.
+func createRootDiskOverlay(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
+	content, err := os.ReadFile(rootDiskBasePathFile)
+	if err != nil {
+		return fmt.Errorf("failed to read path of root disk base image: %w", err)
+	}
+	base := strings.TrimSpace(string(content))
+
+	if vmSpec.Guest.RootDisk.ImageCompressed() {
+		if err := decompressBaseImage(logger, base); err != nil {
+			return err
+		}
+	}
+
+	format := string(vmSpec.Guest.RootDisk.ImageFormat())
+	logger.Info("creating root disk overlay on top of cached base image", zap.String("base", base), zap.String("format", format))
+	if err := execFg(QEMU_IMG_BIN, "create", "-f", "qcow2", "-F", format, "-b", base, rootDiskPath); err != nil {
+		return fmt.Errorf("failed to create root disk overlay: %w", err)
+	}
+
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := os.Chown(rootDiskPath, 36, 34); err != nil {
+		return fmt.Errorf("failed to chown root disk overlay: %w", err)
+	}
+
+	return nil
+}
+
+// decompressBaseImage decompresses the base image from "<base>.zst" in the cache, unless another
+// runner already has.
+//
+// Like the init container, we decompress into a temporary file first, so that other VMs never see
+// a partially-decompressed base image. Concurrent runners may both decompress it; whichever
+// finishes last replaces the other's identical copy.
+func decompressBaseImage(logger *zap.Logger, base string) error {
+	if _, err := os.Stat(base); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat base image: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(rootDiskBaseImagesPath, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for base image: %w", err)
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name()) //nolint:errcheck // already renamed, if everything went well
+
+	logger.Info("decompressing cached base image", zap.String("base", base))
+	if err := execFg(zstdBin, "-d", "-q", "-f", "-o", tmp.Name(), base+".zst"); err != nil {
+		// another runner may have finished decompressing it (and removed the compressed image)
+		// since we checked
+		if _, statErr := os.Stat(base); statErr == nil {
+			return nil
+		}
+		return fmt.Errorf("failed to decompress base image: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return fmt.Errorf("failed to chmod base image: %w", err)
+	}
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := os.Chown(tmp.Name(), 36, 34); err != nil {
+		return fmt.Errorf("failed to chown base image: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), base); err != nil {
+		return fmt.Errorf("failed to move decompressed base image into place: %w", err)
+	}
+
+	if err := os.Remove(base + ".zst"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("failed to remove compressed base image", zap.String("base", base), zap.Error(err))
+	}
+	return nil
+}
+
+// maintainBaseImageCache renews the lease on the base image our VM is using and removes expired
+// base images, until the context is canceled
+func maintainBaseImageCache(ctx context.Context, logger *zap.Logger, wg *sync.WaitGroup) {
+	defer wg.Done()
+	logger = logger.Named("base-image-cache")
+
+	content, err := os.ReadFile(rootDiskBasePathFile)
+	if err != nil {
+		logger.Error("failed to read path of root disk base image", zap.Error(err))
+		return
+	}
+	base := strings.TrimSpace(string(content))
+
+	ticker := time.NewTicker(baseImageRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if err := os.Chtimes(base, now, now); err != nil {
+			logger.Error("failed to renew lease on base image", zap.String("base", base), zap.Error(err))
+		}
+		gcBaseImages(logger, now)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// gcBaseImages removes base images, and leftover temporary files from copying them, that haven't
+// been used for baseImageUnusedTTL
+func gcBaseImages(logger *zap.Logger, now time.Time) {
+	entries, err := os.ReadDir(rootDiskBaseImagesPath)
+	if err != nil {
+		logger.Error("failed to list base images", zap.Error(err))
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed by another runner since we listed the directory
+			if !errors.Is(err, fs.ErrNotExist) {
+				logger.Error("failed to get base image info", zap.String("name", entry.Name()), zap.Error(err))
+			}
+			continue
+		}
+		if now.Sub(info.ModTime()) < baseImageUnusedTTL {
+			continue
+		}
+
+		path := filepath.Join(rootDiskBaseImagesPath, entry.Name())
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Error("failed to remove unused base image", zap.String("path", path), zap.Error(err))
+			continue
+		}
+		logger.Info("removed unused base image", zap.String("path", path), zap.Time("lastUsed", info.ModTime()))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+// Root disk image formats
+//
+// The root disk image may be qcow2 or raw (.spec.guest.rootDisk.format), and may be compressed
+// with zstd (.spec.guest.rootDisk.compression). Uncompressed images are attached in their own
+// format, without any conversion. Compressed images are copied into the pod as-is by the init
+// container, and we decompress them before QEMU starts.
+//
+// With streaming or the base image cache, the VM boots from a local qcow2 overlay regardless of
+// the image's format - see rootdisk_streaming.go and rootdisk_base_image.go. Compressed base
+// images are decompressed into the cache, so that other VMs using them don't have to.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const zstdBin = "zstd"
+
+// rootDiskImage returns the path and format of the root disk that the VM boots from
+func rootDiskImage(vmSpec *vmv1.VirtualMachineSpec) (string, vmv1.DiskImageFormat) {
+	rootDisk := &vmSpec.Guest.RootDisk
+	if rootDisk.Streaming != nil || rootDisk.BaseImageCache != nil {
+		return rootDiskPath, vmv1.DiskImageFormatQCOW2
+	}
+	// Snapshots always save the root disk as qcow2, whatever the format of the original image.
+	if restoredDiskExists(vmSpec, rootDiskPath) {
+		return rootDiskPath, vmv1.DiskImageFormatQCOW2
+	}
+
+	format := rootDisk.ImageFormat()
+	return fmt.Sprintf("%s/rootdisk.%s", mountedDiskPath, format), format
+}
+
+// decompressRootDisk decompresses the root disk image copied into the pod by the init container,
+// if it's compressed.
+//
+// Root disks that are overlays are handled separately, because their compressed image (if any) is
+// in the base image cache.
+func decompressRootDisk(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
+	rootDisk := &vmSpec.Guest.RootDisk
+	if !rootDisk.ImageCompressed() || rootDisk.Streaming != nil || rootDisk.BaseImageCache != nil {
+		return nil
+	}
+
+	compressed := fmt.Sprintf("%s/rootdisk.%s.zst", mountedDiskPath, rootDisk.ImageFormat())
+	path, _ := rootDiskImage(vmSpec)
+	if path == rootDiskPath && restoredDiskExists(vmSpec, rootDiskPath) {
+		logger.Info("using root disk restored from snapshot instead of compressed image")
+		if err := os.Remove(compressed); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove compressed root disk image: %w", err)
+		}
+		return nil
+	}
+
+	logger.Info("decompressing root disk image", zap.String("path", compressed))
+	if err := execFg(zstdBin, "-d", "-q", "--rm", "-o", path, compressed); err != nil {
+		return fmt.Errorf("failed to decompress root disk image: %w", err)
+	}
+
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := os.Chown(path, 36, 34); err != nil {
+		return fmt.Errorf("failed to chown root disk: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+// Lazy streaming of the root disk from a remote HTTP(S) source.
+//
+// Instead of the init container copying the full image into the pod before we start, we create a
+// local qcow2 overlay whose backing file is the remote image (via QEMU's curl block driver). Reads
+// of blocks that aren't present locally are fetched on demand, so the VM can boot before the image
+// is fully downloaded.
+//
+// If prefetch is enabled, we additionally start a QMP 'block-stream' job once QEMU is running,
+// which copies the rest of the image into the overlay in the background. Once the job completes,
+// QEMU drops the remote backing file and the VM no longer depends on it. After an in-place upgrade
+// of the runner, QEMU is still running the job, so the new runner tracks it instead of starting
+// another.
+//
+// The job isn't dismissed automatically, so that we can tell whether it succeeded: if it fails (e.g.
+// the remote source became unavailable), the VM keeps reading missing blocks from the remote image,
+// and we report the failure instead of treating it as finished.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	qmpUnixSocketForRootDiskStreaming = "/vm/qmp-rootdisk.sock"
+	rootDiskStreamJobID               = "rootdisk-stream"
+	rootDiskStreamPollInterval        = 5 * time.Second
+)
+
+// createStreamingRootDisk creates the local overlay for the root disk, backed by the remote image
+func createStreamingRootDisk(logger *zap.Logger, vmSpec *vmv1.VirtualMachineSpec) error {
+	streaming := vmSpec.Guest.RootDisk.Streaming
+
+	u, err := url.Parse(streaming.URL)
+	if err != nil {
+		return fmt.Errorf("failed to parse root disk streaming URL: %w", err)
+	}
+
+	// See https://www.qemu.org/docs/master/system/device-url-syntax.html for the options accepted
+	// by the curl block driver.
+	backing, err := json.Marshal(map[string]any{
+		"driver": string(vmSpec.Guest.RootDisk.ImageFormat()),
+		"file": map[string]any{
+			"driver":    u.Scheme,
+			"url":       streaming.URL,
+			"readahead": "1M",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal root disk backing file options: %w", err)
+	}
+
+	args := []string{"create", "-f", "qcow2", "-F", string(vmSpec.Guest.RootDisk.ImageFormat()), "-b", fmt.Sprintf("json:%s", backing), rootDiskPath}
+	if !vmSpec.Guest.RootDisk.Size.IsZero() {
+		args = append(args, fmt.Sprintf("%d", vmSpec.Guest.RootDisk.Size.Value()))
+	}
+
+	logger.Info("creating local overlay for streamed root disk", zap.String("url", streaming.URL))
+	if err := execFg(QEMU_IMG_BIN, args...); err != nil {
+		return fmt.Errorf("failed to create root disk overlay: %w", err)
+	}
+
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	if err := os.Chown(rootDiskPath, 36, 34); err != nil {
+		return fmt.Errorf("failed to chown root disk overlay: %w", err)
+	}
+
+	return nil
+}
+
+type qmpBlockStats struct {
+	Return []struct {
+		Device string `json:"device"`
+		Stats  struct {
+			RdTotalTimeNs int64 `json:"rd_total_time_ns"`
+			RdOperations  int64 `json:"rd_operations"`
+		} `json:"stats"`
+	} `json:"return"`
+}
+
+type qmpJobs struct {
+	Return []struct {
+		ID              string `json:"id"`
+		Status          string `json:"status"`
+		CurrentProgress int64  `json:"current-progress"`
+		TotalProgress   int64  `json:"total-progress"`
+		// Error is set iff the job has concluded unsuccessfully
+		Error *string `json:"error,omitempty"`
+	} `json:"return"`
+}
+
+// errPrefetchJobMissing is returned by pollRootDiskPrefetch if the job disappeared without us
+// seeing it conclude, so we can't tell whether it succeeded
+var errPrefetchJobMissing = errors.New("prefetch job disappeared before concluding")
+
+// pollRootDiskPrefetch checks on the root disk prefetch job, updating the progress metric and
+// dismissing the job once it has concluded.
+//
+// It returns done = true once the job has concluded, with an error if it failed. If done is false,
+// any error is from checking the job, and it's still running as far as we know.
+func pollRootDiskPrefetch(mon qmp.Monitor, progress prometheus.Gauge) (done bool, _ error) {
+	raw, err := mon.Run([]byte(`{"execute": "query-jobs"}`))
+	if err != nil {
+		return false, fmt.Errorf("failed to query jobs: %w", err)
+	}
+	var jobs qmpJobs
+	if err := json.Unmarshal(raw, &jobs); err != nil {
+		return false, fmt.Errorf("failed to unmarshal jobs: %w", err)
+	}
+
+	for _, j := range jobs.Return {
+		if j.ID != rootDiskStreamJobID {
+			continue
+		}
+		if j.Status != "concluded" {
+			if j.TotalProgress != 0 {
+				progress.Set(float64(j.CurrentProgress) / float64(j.TotalProgress))
+			}
+			return false, nil
+		}
+
+		qmpcmd := []byte(fmt.Sprintf(`{"execute": "job-dismiss", "arguments": {"id": %q}}`, rootDiskStreamJobID))
+		if _, err := mon.Run(qmpcmd); err != nil {
+			return false, fmt.Errorf("failed to dismiss concluded job: %w", err)
+		}
+		if j.Error != nil {
+			return true, errors.New(*j.Error)
+		}
+		progress.Set(1)
+		return true, nil
+	}
+
+	return true, errPrefetchJobMissing
+}
+
+// connectRootDiskMonitor connects to QEMU's monitor on socketPath, retrying with backoff until it
+// succeeds or ctx is canceled, because QEMU may take a while to start.
+func connectRootDiskMonitor(ctx context.Context, logger *zap.Logger, socketPath string) (*qmp.SocketMonitor, error) {
+	b := &backoff.Backoff{
+		Min:    200 * time.Millisecond,
+		Max:    5 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for {
+		// Wait before each attempt, to reduce the chance we attempt connecting before QEMU is started
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		mon, err := qmp.NewSocketMonitor("unix", socketPath, 2*time.Second)
+		if err != nil {
+			logger.Warn("failed to connect to QEMU monitor, retrying", zap.Error(err))
+			continue
+		}
+		if err := mon.Connect(); err != nil {
+			logger.Warn("failed to start monitor connection, retrying", zap.Error(err))
+			continue
+		}
+		return mon, nil
+	}
+}
+
+// startRootDiskPrefetch starts the root disk prefetch job, unless it's already running - e.g.
+// because it was started before an in-place upgrade of the runner (see upgrade.go) - in which case
+// it returns adopted = true.
+func startRootDiskPrefetch(mon qmp.Monitor) (adopted bool, _ error) {
+	raw, err := mon.Run([]byte(`{"execute": "query-jobs"}`))
+	if err != nil {
+		return false, fmt.Errorf("failed to query jobs: %w", err)
+	}
+	var jobs qmpJobs
+	if err := json.Unmarshal(raw, &jobs); err != nil {
+		return false, fmt.Errorf("failed to unmarshal jobs: %w", err)
+	}
+	for _, j := range jobs.Return {
+		if j.ID == rootDiskStreamJobID {
+			return true, nil
+		}
+	}
+
+	qmpcmd := []byte(fmt.Sprintf(
+		`{"execute": "block-stream", "arguments": {"device": "rootdisk", "job-id": %q, "auto-dismiss": false}}`,
+		rootDiskStreamJobID,
+	))
+	if _, err := mon.Run(qmpcmd); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// watchRootDiskStreaming starts the background prefetch (if enabled) and records root disk read
+// latency until streaming has finished or ctx is canceled.
+func watchRootDiskStreaming(
+	ctx context.Context,
+	logger *zap.Logger,
+	streaming *vmv1.RootDiskStreaming,
+	metrics *runnerMetrics,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	logger = logger.Named("rootdisk-streaming")
+
+	mon, err := connectRootDiskMonitor(ctx, logger, qmpUnixSocketForRootDiskStreaming)
+	if err != nil {
+		return // context was canceled
+	}
+	defer mon.Disconnect() //nolint:errcheck // nothing to do with error when deferred. TODO: log it?
+
+	prefetch := streaming.Prefetch == nil || *streaming.Prefetch
+	if prefetch {
+		adopted, err := startRootDiskPrefetch(mon)
+		if err != nil {
+			logger.Error("failed to start root disk prefetch", zap.Error(err))
+			metrics.rootDiskPrefetchFailures.Inc()
+			prefetch = false
+		} else if adopted {
+			logger.Info("root disk prefetch already running, resuming tracking")
+		} else {
+			logger.Info("started root disk prefetch")
+		}
+	}
+
+	var lastTotalTimeNs, lastOps int64
+
+	ticker := time.NewTicker(rootDiskStreamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		raw, err := mon.Run([]byte(`{"execute": "query-blockstats"}`))
+		if err != nil {
+			logger.Error("failed to query block stats", zap.Error(err))
+			continue
+		}
+		var stats qmpBlockStats
+		if err := json.Unmarshal(raw, &stats); err != nil {
+			logger.Error("failed to unmarshal block stats", zap.Error(err))
+			continue
+		}
+		for _, s := range stats.Return {
+			if s.Device != "rootdisk" {
+				continue
+			}
+			ops := s.Stats.RdOperations - lastOps
+			if ops > 0 {
+				avgNs := (s.Stats.RdTotalTimeNs - lastTotalTimeNs) / ops
+				metrics.rootDiskReadLatency.Observe(time.Duration(avgNs).Seconds())
+			}
+			lastTotalTimeNs, lastOps = s.Stats.RdTotalTimeNs, s.Stats.RdOperations
+		}
+
+		if !prefetch {
+			continue
+		}
+
+		done, err := pollRootDiskPrefetch(mon, metrics.rootDiskPrefetchProgress)
+		switch {
+		case !done && err != nil:
+			logger.Error("failed to check root disk prefetch", zap.Error(err))
+		case done && err != nil:
+			// The VM still works, but keeps depending on the remote image, so keep measuring.
+			logger.Error("root disk prefetch failed", zap.Error(err))
+			metrics.rootDiskPrefetchFailures.Inc()
+			prefetch = false
+		case done:
+			// The image is fully local, and there's nothing left to measure.
+			logger.Info("root disk prefetch finished")
+			return
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeJobsMonitor is a qmp.Monitor that reports the given jobs, and records started and dismissed
+// jobs
+type fakeJobsMonitor struct {
+	jobs      []map[string]any
+	started   []string
+	dismissed []string
+}
+
+func (m *fakeJobsMonitor) Connect() error    { return nil }
+func (m *fakeJobsMonitor) Disconnect() error { return nil }
+func (m *fakeJobsMonitor) Events(context.Context) (<-chan qmp.Event, error) {
+	return nil, nil
+}
+
+func (m *fakeJobsMonitor) Run(command []byte) ([]byte, error) {
+	var cmd struct {
+		Execute   string         `json:"execute"`
+		Arguments map[string]any `json:"arguments"`
+	}
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		return nil, err
+	}
+	switch cmd.Execute {
+	case "query-jobs":
+		return json.Marshal(map[string]any{"return": m.jobs})
+	case "block-stream":
+		id := cmd.Arguments["job-id"].(string)
+		for _, j := range m.jobs {
+			if j["id"] == id {
+				return nil, fmt.Errorf("Job ID '%s' already in use", id)
+			}
+		}
+		m.started = append(m.started, id)
+		return []byte(`{"return": {}}`), nil
+	case "job-dismiss":
+		m.dismissed = append(m.dismissed, cmd.Arguments["id"].(string))
+		return []byte(`{"return": {}}`), nil
+	default:
+		return json.Marshal(map[string]any{"error": map[string]string{"class": "CommandNotFound"}})
+	}
+}
+
+func TestPollRootDiskPrefetch(t *testing.T) {
+	job := func(status string, current, total int64) map[string]any {
+		return map[string]any{
+			"id":               rootDiskStreamJobID,
+			"type":             "stream",
+			"status":           status,
+			"current-progress": current,
+			"total-progress":   total,
+		}
+	}
+
+	t.Run("running", func(t *testing.T) {
+		progress := prometheus.NewGauge(prometheus.GaugeOpts{Name: "progress"})
+		mon := &fakeJobsMonitor{jobs: []map[string]any{job("running", 1, 4)}}
+		done, err := pollRootDiskPrefetch(mon, progress)
+		require.NoError(t, err)
+		assert.False(t, done)
+		assert.Equal(t, 0.25, testutil.ToFloat64(progress))
+		assert.Empty(t, mon.dismissed)
+	})
+
+	t.Run("succeeded", func(t *testing.T) {
+		progress := prometheus.NewGauge(prometheus.GaugeOpts{Name: "progress"})
+		mon := &fakeJobsMonitor{jobs: []map[string]any{job("concluded", 4, 4)}}
+		done, err := pollRootDiskPrefetch(mon, progress)
+		require.NoError(t, err)
+		assert.True(t, done)
+		assert.Equal(t, 1.0, testutil.ToFloat64(progress))
+		assert.Equal(t, []string{rootDiskStreamJobID}, mon.dismissed)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		progress := prometheus.NewGauge(prometheus.GaugeOpts{Name: "progress"})
+		failed := job("concluded", 2, 4)
+		failed["error"] = "Could not read image: HTTP 503"
+		mon := &fakeJobsMonitor{jobs: []map[string]any{failed}}
+		done, err := pollRootDiskPrefetch(mon, progress)
+		assert.True(t, done)
+		assert.EqualError(t, err, "Could not read image: HTTP 503")
+		assert.Equal(t, 0.0, testutil.ToFloat64(progress), "failed prefetch must not be reported as complete")
+		assert.Equal(t, []string{rootDiskStreamJobID}, mon.dismissed)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		progress := prometheus.NewGauge(prometheus.GaugeOpts{Name: "progress"})
+		mon := &fakeJobsMonitor{jobs: nil}
+		done, err := pollRootDiskPrefetch(mon, progress)
+		assert.True(t, done)
+		assert.ErrorIs(t, err, errPrefetchJobMissing)
+		assert.Equal(t, 0.0, testutil.ToFloat64(progress))
+	})
+}
+
+func TestStartRootDiskPrefetch(t *testing.T) {
+	t.Run("new", func(t *testing.T) {
+		mon := &fakeJobsMonitor{jobs: nil}
+		adopted, err := startRootDiskPrefetch(mon)
+		require.NoError(t, err)
+		assert.False(t, adopted)
+		assert.Equal(t, []string{rootDiskStreamJobID}, mon.started)
+	})
+
+	// After an in-place upgrade, the job started by the previous runner is still running in QEMU
+	t.Run("already running", func(t *testing.T) {
+		mon := &fakeJobsMonitor{jobs: []map[string]any{{
+			"id":               rootDiskStreamJobID,
+			"type":             "stream",
+			"status":           "running",
+			"current-progress": 1,
+			"total-progress":   4,
+		}}}
+		adopted, err := startRootDiskPrefetch(mon)
+		require.NoError(t, err)
+		assert.True(t, adopted)
+		assert.Empty(t, mon.started)
+	})
+}
+
+// serveFakeQMP starts listening on the socket after the delay, and completes the QMP handshake on
+// the first connection. The returned function stops it.
+func serveFakeQMP(t *testing.T, socketPath string, delay time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return
+		}
+
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Errorf("failed to listen: %v", err)
+			return
+		}
+		go func() {
+			<-done
+			_ = listener.Close()
+		}()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+		var cmd map[string]any
+		if err := json.NewDecoder(conn).Decode(&cmd); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte(`{"return": {}}` + "\n"))
+		<-done
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestConnectRootDiskMonitor(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "qmp.sock")
+
+	// QEMU only starts listening after a while
+	stop := serveFakeQMP(t, socketPath, 500*time.Millisecond)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mon, err := connectRootDiskMonitor(ctx, zap.NewNop(), socketPath)
+	require.NoError(t, err)
+	_ = mon.Disconnect()
+
+	// ... and it gives up once the context is canceled
+	cancel()
+	_, err = connectRootDiskMonitor(ctx, zap.NewNop(), filepath.Join(t.TempDir(), "missing.sock"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,168 @@
+package main
+
+// Serving VirtualMachineSnapshot files
+//
+// The neonvm-controller saves a snapshot's disks (and optionally memory) via QMP into a directory
+// within the runner pod, and then starts a Job that downloads the files from us and copies them to
+// the snapshot's target. Once that's done, the controller asks us to remove the directory.
+//
+// Like /console, requests are authenticated if we were given the QMP auth token's hash: the
+// controller's requests use the QMP auth token itself. The export Job doesn't have that, so when
+// creating the directory, the controller also gives us the hash of a token for that snapshot only,
+// which downloads of its files must use instead.
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const snapshotsPath = "/vm/images/snapshots"
+
+// handleSnapshot serves requests on /snapshots/<name>[/<file>]:
+//
+//   - PUT /snapshots/<name> creates the snapshot's directory, so QEMU can write into it. The body
+//     is the hash of the snapshot's export token, if there is one.
+//   - GET /snapshots/<name>/<file> downloads one of the snapshot's files
+//   - DELETE /snapshots/<name> removes the snapshot's directory and everything in it
+func handleSnapshot(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config) {
+	name, file, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/snapshots/"), "/")
+	if !validSnapshotPathElement(name) || (file != "" && !validSnapshotPathElement(file)) {
+		logger.Error("invalid snapshot path", zap.String("path", r.URL.Path))
+		w.WriteHeader(400)
+		return
+	}
+	dir := filepath.Join(snapshotsPath, name)
+	// The token hash is kept next to the directory rather than in it, so that it can't be
+	// downloaded.
+	tokenHashPath := dir + ".export-token-hash"
+
+	switch {
+	case r.Method == http.MethodPut && file == "":
+		if !authenticateConsoleRequest(logger, w, r, cfg) {
+			return
+		}
+		tokenHash, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			logger.Error("could not read body", zap.Error(err))
+			w.WriteHeader(400)
+			return
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			logger.Error("could not create snapshot directory", zap.String("snapshot", name), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		if err := os.WriteFile(tokenHashPath, tokenHash, 0o600); err != nil {
+			logger.Error("could not save export token hash", zap.String("snapshot", name), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(200)
+	case r.Method == http.MethodGet && file != "":
+		if !authenticateExportRequest(logger, w, r, cfg, tokenHashPath) {
+			return
+		}
+		// ServeFile handles range requests for us, so that partial downloads can be resumed.
+		http.ServeFile(w, r, filepath.Join(dir, file))
+	case r.Method == http.MethodDelete && file == "":
+		if !authenticateConsoleRequest(logger, w, r, cfg) {
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Error("could not remove snapshot directory", zap.String("snapshot", name), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		if err := os.Remove(tokenHashPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("could not remove export token hash", zap.String("snapshot", name), zap.Error(err))
+			w.WriteHeader(500)
+			return
+		}
+		logger.Info("removed snapshot files", zap.String("snapshot", name))
+		w.WriteHeader(200)
+	default:
+		logger.Error("unexpected method", zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		w.WriteHeader(400)
+	}
+}
+
+// authenticateExportRequest returns whether the download may proceed, writing the error response
+// if not. Downloads use the snapshot's export token, whose hash is stored at tokenHashPath.
+func authenticateExportRequest(logger *zap.Logger, w http.ResponseWriter, r *http.Request, cfg *Config, tokenHashPath string) bool {
+	if cfg.qmpAuthTokenHash == "" {
+		return true
+	}
+	expected, err := os.ReadFile(tokenHashPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("could not read export token hash", zap.Error(err))
+		w.WriteHeader(500)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	hash := api.QMPAuthTokenHash(token)
+	if !ok || len(expected) == 0 || subtle.ConstantTimeCompare([]byte(hash), expected) != 1 {
+		logger.Warn("denied unauthenticated snapshot download", zap.String("remoteAddr", r.RemoteAddr))
+		w.WriteHeader(401)
+		return false
+	}
+	return true
+}
+
+func validSnapshotPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+func listenForSnapshotRequests(ctx context.Context, logger *zap.Logger, cfg *Config, vmSpec *vmv1.VirtualMachineSpec, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if err := os.MkdirAll(snapshotsPath, 0o755); err != nil {
+		logger.Error("could not create snapshots directory", zap.Error(err))
+		return
+	}
+
+	mux := http.NewServeMux()
+	snapshotLogger := logger.Named("http-handlers").Named("snapshots")
+	mux.HandleFunc("/snapshots/", func(w http.ResponseWriter, r *http.Request) {
+		handleSnapshot(snapshotLogger, w, r, cfg)
+	})
+	server := http.Server{
+		Addr:              listenAddr(vmSpec, vmv1.SnapshotExportPort),
+		Handler:           mux,
+		ReadTimeout:       5 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		// no WriteTimeout: downloading a disk image can take a long time.
+	}
+	l, err := listen(server.Addr)
+	if err != nil {
+		logger.Error("snapshots server failed to listen", zap.Error(err))
+		return
+	}
+	errChan := make(chan error)
+	go func() {
+		errChan <- server.Serve(l)
+	}()
+	select {
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			logger.Info("snapshots server closed")
+		} else if err != nil {
+			logger.Error("snapshots server exited with error", zap.Error(err))
+		}
+	case <-ctx.Done():
+		err := server.Shutdown(context.Background())
+		logger.Info("shut down snapshots server", zap.Error(err))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestSnapshotAuthentication(t *testing.T) {
+	cfg := &Config{qmpAuthTokenHash: api.QMPAuthTokenHash("qmp-token")}
+
+	doRequest := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handleSnapshot(zap.NewNop(), w, req, cfg)
+		return w.Code
+	}
+
+	// Creating and removing the directory requires the QMP auth token
+	assert.Equal(t, 401, doRequest(http.MethodPut, "/snapshots/snap", ""))
+	assert.Equal(t, 401, doRequest(http.MethodDelete, "/snapshots/snap", "export-token"))
+	// Downloads require the snapshot's export token, and there isn't one for this snapshot
+	assert.Equal(t, 401, doRequest(http.MethodGet, "/snapshots/snap/rootdisk.qcow2", "qmp-token"))
+
+	tokenHashPath := filepath.Join(t.TempDir(), "snap.export-token-hash")
+	require.NoError(t, os.WriteFile(tokenHashPath, []byte(api.QMPAuthTokenHash("export-token")), 0o600))
+	authenticate := func(token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/snapshots/snap/rootdisk.qcow2", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return authenticateExportRequest(zap.NewNop(), httptest.NewRecorder(), req, cfg, tokenHashPath)
+	}
+	assert.True(t, authenticate("export-token"))
+	assert.False(t, authenticate("qmp-token"))
+	assert.False(t, authenticate(""))
+
+	// Without a QMP auth token, nothing is authenticated, like /console
+	assert.True(t, authenticateExportRequest(zap.NewNop(), httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/snapshots/snap/rootdisk.qcow2", nil), &Config{}, tokenHashPath))
+}
@@ -0,0 +1,111 @@
+package main
+
+// Online resizing of swap that's proportional to memory
+//
+// With swap policy ProportionalToMemory, the controller tells us the new size of the swap on each
+// change to the VM's memory, via '/swap_change'. We pass it on to the guest over a virtio-serial
+// port, where it's read by the swap-resizer script (see vm-builder), which runs the
+// resize-swap-internal.sh script from the runtime disk.
+//
+// The swap disk is always created with the maximum size, so it never needs to be resized itself.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	swapResizeSerialSocket = "/vm/swap-resize.sock"
+	swapResizeSerialPort   = "tech.neon.swap.0"
+)
+
+// initialSwapSize returns the size that the swap is enabled with on boot
+func initialSwapSize(vmSpec *vmv1.VirtualMachineSpec, swapInfo vmv1.SwapInfo) resource.Quantity {
+	memory := resource.NewQuantity(
+		vmSpec.Guest.MemorySlotSize.Value()*int64(vmSpec.Guest.MemorySlots.Use),
+		resource.BinarySI,
+	)
+	return swapInfo.SizeForMemory(*memory)
+}
+
+// swapResizeArgs returns the QEMU arguments for the virtio-serial port used to resize the swap, if
+// it's proportional to memory
+func swapResizeArgs(swapInfo *vmv1.SwapInfo) []string {
+	if swapInfo == nil || !swapInfo.IsProportional() {
+		return nil
+	}
+	return []string{
+		"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=swap", swapResizeSerialSocket),
+		"-device", fmt.Sprintf("virtserialport,chardev=swap,name=%s", swapResizeSerialPort),
+	}
+}
+
+func handleSwapChange(logger *zap.Logger, w http.ResponseWriter, r *http.Request, swapInfo *vmv1.SwapInfo) {
+	if r.Method != "POST" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	if swapInfo == nil || !swapInfo.IsProportional() {
+		logger.Error("got swap update, but swap is not proportional to memory")
+		w.WriteHeader(400)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("could not read body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+
+	var parsed api.SwapChange
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		logger.Error("could not parse body", zap.Error(err))
+		w.WriteHeader(400)
+		return
+	}
+	if parsed.Size.Cmp(swapInfo.Size) > 0 {
+		logger.Error("requested swap size is larger than the swap disk",
+			zap.String("size", parsed.Size.String()), zap.String("max", swapInfo.Size.String()))
+		w.WriteHeader(400)
+		return
+	}
+
+	logger.Info("got swap update", zap.String("size", parsed.Size.String()))
+	if err := sendSwapSize(parsed.Size); err != nil {
+		logger.Error("could not send swap size to guest", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// sendSwapSize sends the new size of the swap to the guest. The guest resizes its swap
+// asynchronously, so this doesn't wait for the resize to complete.
+func sendSwapSize(size resource.Quantity) error {
+	conn, err := net.DialTimeout("unix", swapResizeSerialSocket, time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to serial port: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%d\n", size.Value()); err != nil {
+		return fmt.Errorf("failed to write to serial port: %w", err)
+	}
+	return nil
+}
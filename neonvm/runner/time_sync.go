@@ -0,0 +1,143 @@
+package main
+
+// Synchronizing the guest's clock
+//
+// The guest's clock stops while it's paused, and falls behind during the final pause of a live
+// migration. On POST '/time_sync', after the guest has been resumed or migrated, we bring it back in
+// line with the host's, in one of two ways (see vmv1.TimeSyncMethod):
+//
+//   - With GuestAgent, the QEMU guest agent's guest-set-time command sets it to our clock.
+//   - With NTP, we run 'chronyc makestep' in the guest over SSH, so that chronyd steps the clock by
+//     the offset it's measured from the host's (via the KVM PTP device), instead of slowly slewing
+//     it. chronyd samples the PTP device every few seconds, so the controller waits a little after
+//     the guest was resumed before asking us to do this.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const timeSyncTimeout = 4 * time.Second
+
+func handleTimeSync(logger *zap.Logger, w http.ResponseWriter, r *http.Request, vmSpec *vmv1.VirtualMachineSpec) {
+	if r.Method != "POST" {
+		logger.Error("unexpected method", zap.String("method", r.Method))
+		w.WriteHeader(400)
+		return
+	}
+	method := vmSpec.TimeSyncMethod()
+	if method == nil {
+		logger.Error("got time sync request, but the guest's clock can't be synchronized")
+		w.WriteHeader(400)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeSyncTimeout)
+	defer cancel()
+
+	var err error
+	switch *method {
+	case vmv1.TimeSyncMethodGuestAgent:
+		err = guestAgentSetTime(ctx, time.Now())
+	case vmv1.TimeSyncMethodNTP:
+		err = chronyMakeStep(ctx)
+	}
+	if err != nil {
+		logger.Error("could not synchronize guest clock", zap.String("method", string(*method)), zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+
+	logger.Info("synchronized guest clock", zap.String("method", string(*method)))
+	body, err := json.Marshal(api.TimeSyncResult{Method: *method})
+	if err != nil {
+		logger.Error("could not marshal response", zap.Error(err))
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	_, _ = w.Write(body)
+}
+
+// guestAgentResponse is a response from the QEMU guest agent
+type guestAgentResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// guestAgentSetTime sets the guest's clock to now, with the QEMU guest agent
+func guestAgentSetTime(ctx context.Context, now time.Time) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", guestAgentSocket)
+	if err != nil {
+		return fmt.Errorf("failed to connect to guest agent: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	// The guest agent may still have a response queued for a previous client, so we start with
+	// guest-sync and skip everything before its response.
+	syncID := now.UnixNano()
+	if err := enc.Encode(map[string]any{"execute": "guest-sync", "arguments": map[string]any{"id": syncID}}); err != nil {
+		return fmt.Errorf("failed to send guest-sync: %w", err)
+	}
+	for {
+		var resp guestAgentResponse
+		if err := dec.Decode(&resp); err != nil {
+			return fmt.Errorf("failed to read guest-sync response: %w", err)
+		}
+		var id int64
+		if json.Unmarshal(resp.Return, &id) == nil && id == syncID {
+			break
+		}
+	}
+
+	// Use the time from just before sending, rather than from when the request was received.
+	cmd := map[string]any{"execute": "guest-set-time", "arguments": map[string]any{"time": time.Now().UnixNano()}}
+	if err := enc.Encode(cmd); err != nil {
+		return fmt.Errorf("failed to send guest-set-time: %w", err)
+	}
+	var resp guestAgentResponse
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("failed to read guest-set-time response: %w", err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("guest-set-time failed: %s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+	return nil
+}
+
+// chronyMakeStep tells the guest's chronyd to step its clock to its time source
+func chronyMakeStep(ctx context.Context) error {
+	output, err := guestSSHCommand(ctx, []string{"/neonvm/bin/chronyc", "makestep"}).CombinedOutput()
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %s", timeSyncTimeout)
+		}
+		return fmt.Errorf("chronyc makestep failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
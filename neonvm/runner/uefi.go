@@ -0,0 +1,71 @@
+package main
+
+// Booting opaque disk images via UEFI
+//
+// VMs with bootMethod UEFI don't use our kernel or the runtime disk - the root disk is booted by
+// the OVMF firmware, like on a regular machine. Because there's nothing in the guest that we can
+// rely on, the guest starts with exactly the CPUs and memory it's using, without any room for
+// hotplug: neonvm-controller resizes these VMs by restarting them.
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+const (
+	// the firmware images themselves depend on the architecture; see arch.go.
+	//
+	// the UEFI variable store is writable, so each VM needs its own copy
+	ovmfVarsPath = "/vm/images/OVMF_VARS.fd"
+
+	guestAgentSocket = "/vm/qga.sock"
+)
+
+// bootingUEFI returns whether the guest should be booted by UEFI firmware instead of directly
+// loading the kernel
+func bootingUEFI(vmSpec *vmv1.VirtualMachineSpec) bool {
+	return vmSpec.Guest.BootMethod == vmv1.BootMethodUEFI
+}
+
+// uefiArgs returns the QEMU arguments to boot from the root disk via UEFI firmware, and optionally
+// to add the channel for the QEMU guest agent.
+func uefiArgs(logger *zap.Logger, arch archSettings, vmSpec *vmv1.VirtualMachineSpec) ([]string, error) {
+	// Keep the variables from a previous run (e.g. boot order changes), if there are any.
+	if _, err := os.Stat(ovmfVarsPath); os.IsNotExist(err) {
+		logger.Info("creating UEFI variable store", zap.String("path", ovmfVarsPath))
+		if err := createUEFIVars(arch); err != nil {
+			return nil, fmt.Errorf("failed to create UEFI variable store: %w", err)
+		}
+	}
+
+	args := []string{
+		"-drive", fmt.Sprintf("if=pflash,format=raw,unit=0,readonly=on,file=%s", arch.firmwareCodePath),
+		"-drive", fmt.Sprintf("if=pflash,format=raw,unit=1,file=%s", ovmfVarsPath),
+	}
+
+	if vmSpec.Guest.EnableGuestAgent != nil && *vmSpec.Guest.EnableGuestAgent {
+		args = append(
+			args,
+			"-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=qga0", guestAgentSocket),
+			"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		)
+	}
+
+	return args, nil
+}
+
+func createUEFIVars(arch archSettings) error {
+	data, err := os.ReadFile(arch.firmwareVarsTemplatePath)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ovmfVarsPath, data, 0644); err != nil {
+		return err
+	}
+	// uid=36(qemu) gid=34(kvm) groups=34(kvm)
+	return os.Chown(ovmfVarsPath, 36, 34)
+}
@@ -0,0 +1,277 @@
+package main
+
+// In-place upgrades of the runner
+//
+// QEMU runs as a child of the runner, so normally the only way to get a fix into the runner is to
+// restart or migrate the VM. Instead, on SIGUSR2 the runner re-executes itself from the binary at
+// '-upgrade-binary', handing off its state to the new process:
+//
+//   - execve keeps our PID, so QEMU remains our child and the new process can wait on it.
+//   - The HTTP listeners are passed as inherited file descriptors, so that connections made during
+//     the upgrade are queued instead of refused.
+//   - So is the read end of the pipe that QEMU's stdout (the guest's serial console) is written
+//     to, along with the output buffered so far. See console.go.
+//   - Network setup (bridge, tap device, iptables rules, dnsmasq) is done once, in the pod's network
+//     namespace, so it persists as-is.
+//   - Our QMP connections are short-lived or re-established by the new process.
+//
+// Before re-executing, we check that the new binary supports the same version of the handoff
+// protocol, so an incompatible binary can't take over from us. If anything fails before the exec,
+// we keep running as before.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// upgradeProtocolVersion is the version of upgradeState. It must be incremented on any
+	// incompatible change to the handoff between runners.
+	upgradeProtocolVersion = 2
+
+	upgradeStatePath          = "/vm/upgrade-state.json"
+	defaultUpgradeBinaryPath  = "/vm/runner-upgrade"
+	upgradeProtocolVersionArg = "-upgrade-protocol-version"
+	resumeFromArg             = "-resume-from"
+)
+
+// upgradeState is the state handed off from the old runner to the new one
+type upgradeState struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	QEMUPid         int    `json:"qemuPid"`
+	CgroupPath      string `json:"cgroupPath"`
+	// Listeners maps the address of each HTTP listener to its inherited file descriptor
+	Listeners map[string]uintptr `json:"listeners"`
+	// Console is nil if QEMU's output had already ended
+	Console *upgradeConsoleState `json:"console"`
+}
+
+// logFields returns the fields to log the state with, leaving out the console output
+func (s *upgradeState) logFields() []zap.Field {
+	return []zap.Field{
+		zap.Int("qemuPid", s.QEMUPid),
+		zap.String("cgroupPath", s.CgroupPath),
+		zap.Any("listeners", s.Listeners),
+		zap.Bool("console", s.Console != nil),
+	}
+}
+
+// listeners tracks the HTTP listeners that are handed off in an upgrade
+var listeners = struct {
+	mu sync.Mutex
+	// active are the listeners currently in use, by address
+	active map[string]net.Listener
+	// inherited are the file descriptors of listeners from the previous runner, by address
+	inherited map[string]uintptr
+}{
+	mu:        sync.Mutex{},
+	active:    make(map[string]net.Listener),
+	inherited: make(map[string]uintptr),
+}
+
+// listen returns a TCP listener for the address, reusing the one from the previous runner, if
+// there was one
+func listen(addr string) (net.Listener, error) {
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+
+	var l net.Listener
+	if fd, ok := listeners.inherited[addr]; ok {
+		delete(listeners.inherited, addr)
+		f := os.NewFile(fd, addr)
+		var err error
+		l, err = net.FileListener(f)
+		// FileListener duplicates the file descriptor, so we can close the original either way.
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited listener for %s: %w", addr, err)
+		}
+	} else {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listeners.active[addr] = l
+	return l, nil
+}
+
+// readUpgradeState reads and removes the state left by the previous runner
+func readUpgradeState(path string) (*upgradeState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upgrade state: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("failed to remove upgrade state: %w", err)
+	}
+
+	var state upgradeState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upgrade state: %w", err)
+	}
+	if state.ProtocolVersion != upgradeProtocolVersion {
+		return nil, fmt.Errorf(
+			"unsupported upgrade protocol version %d, expected %d",
+			state.ProtocolVersion, upgradeProtocolVersion,
+		)
+	}
+
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	for addr, fd := range state.Listeners {
+		listeners.inherited[addr] = fd
+	}
+
+	return &state, nil
+}
+
+// watchForUpgrades upgrades the runner in place each time we receive SIGUSR2, until the context
+// is canceled.
+func watchForUpgrades(
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg *Config,
+	qemu *os.Process,
+	cgroupPath string,
+	console *consoleOutput,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+	logger = logger.Named("upgrade")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+		}
+
+		logger.Info("got SIGUSR2, upgrading runner in place", zap.String("binary", cfg.upgradeBinaryPath))
+		// upgrade only returns if it failed.
+		err := upgrade(logger, cfg, qemu, cgroupPath, console)
+		logger.Error("failed to upgrade runner, continuing with current binary", zap.Error(err))
+	}
+}
+
+// upgrade re-executes the runner from the upgrade binary. It only returns on failure.
+func upgrade(logger *zap.Logger, cfg *Config, qemu *os.Process, cgroupPath string, console *consoleOutput) error {
+	out, err := exec.Command(cfg.upgradeBinaryPath, upgradeProtocolVersionArg).Output()
+	if err != nil {
+		return fmt.Errorf("failed to get upgrade protocol version of new binary: %w", err)
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return fmt.Errorf("failed to parse upgrade protocol version of new binary: %w", err)
+	}
+	if version != upgradeProtocolVersion {
+		return fmt.Errorf("new binary has upgrade protocol version %d, expected %d", version, upgradeProtocolVersion)
+	}
+
+	state := upgradeState{
+		ProtocolVersion: upgradeProtocolVersion,
+		QEMUPid:         qemu.Pid,
+		CgroupPath:      cgroupPath,
+		Listeners:       make(map[string]uintptr),
+		Console:         nil,
+	}
+
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+
+	var fds []int
+	defer func() {
+		// only reached if we didn't exec
+		for _, fd := range fds {
+			_ = syscall.Close(fd)
+		}
+	}()
+
+	// Stop reading QEMU's output, so that everything we've read is in the buffer we hand off, and
+	// everything after is left in the pipe for the new runner.
+	console.pause()
+	defer console.resume(logger) // only reached if we didn't exec
+	consoleState, err := console.handOff()
+	if err != nil {
+		return err
+	}
+	if consoleState != nil {
+		fds = append(fds, int(consoleState.Fd))
+		state.Console = consoleState
+	}
+	for addr, l := range listeners.active {
+		sc, ok := l.(syscall.Conn)
+		if !ok {
+			return fmt.Errorf("listener for %s does not support syscall.Conn", addr)
+		}
+		fd, err := dupForExec(sc)
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener for %s: %w", addr, err)
+		}
+		fds = append(fds, fd)
+		state.Listeners[addr] = uintptr(fd)
+	}
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgrade state: %w", err)
+	}
+	if err := os.WriteFile(upgradeStatePath, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write upgrade state: %w", err)
+	}
+
+	// Keep all our original arguments (they contain the VM spec), replacing any '-resume-from' from
+	// a previous upgrade.
+	args := []string{cfg.upgradeBinaryPath}
+	for _, arg := range os.Args[1:] {
+		if !strings.HasPrefix(arg, resumeFromArg+"=") {
+			args = append(args, arg)
+		}
+	}
+	args = append(args, fmt.Sprintf("%s=%s", resumeFromArg, upgradeStatePath))
+
+	logger.Info("executing new runner binary", state.logFields()...)
+	_ = logger.Sync()
+
+	err = syscall.Exec(cfg.upgradeBinaryPath, args, os.Environ())
+	_ = os.Remove(upgradeStatePath)
+	return fmt.Errorf("failed to exec new binary: %w", err)
+}
+
+// dupForExec returns a duplicate of the listener's (or file's) file descriptor that will be
+// inherited across exec
+func dupForExec(sc syscall.Conn) (int, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	var dupErr error
+	err = rc.Control(func(orig uintptr) {
+		// Unlike os.File.Fd() or net.TCPListener.File(), dup(2) doesn't set close-on-exec, and
+		// doesn't change the blocking mode of the original.
+		fd, dupErr = syscall.Dup(int(orig))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fd, dupErr
+}
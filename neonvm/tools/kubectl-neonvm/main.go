@@ -0,0 +1,420 @@
+package main
+
+// kubectl-neonvm is a kubectl plugin for day-to-day operation of NeonVM VirtualMachines.
+//
+// Installed somewhere on $PATH, it's run as 'kubectl neonvm <command>'. It uses the same
+// kubeconfig as kubectl, and so the same credentials and RBAC.
+//
+// Commands:
+//
+//	list                 list VMs with their phase, node, size, and autoscaling state
+//	units <vm>           show the VM's current compute units against its bounds
+//	migrate <vm>         live-migrate the VM to another node
+//	pause <vm>           pause the VM's guest (sets .spec.runPolicy)
+//	resume <vm>          resume a paused VM's guest
+//	console <vm>         print the guest's serial console output
+//	decisions <vm>       print the autoscaler-agent's scaling decisions for the VM
+//	exec <vm> -- <cmd>   run a command in the VM's guest, via the exec.vm.neon.tech API
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const usage = `Usage: kubectl neonvm [flags] <command> [args]
+
+Commands:
+  list                 list VMs with their phase, node, size, and autoscaling state
+  units <vm>           show the VM's current compute units against its bounds
+  migrate <vm>         live-migrate the VM to another node
+  pause <vm>           pause the VM's guest
+  resume <vm>          resume a paused VM's guest
+  console <vm>         print the guest's serial console output
+  decisions <vm>       print the autoscaler-agent's scaling decisions for the VM
+  exec <vm> -- <cmd>   run a command in the VM's guest
+
+Flags:
+`
+
+var (
+	kubeconfig     = flag.String("kubeconfig", "", `Path to the kubeconfig file. Defaults to kubectl's`)
+	kubeContext    = flag.String("context", "", `The kubeconfig context to use`)
+	namespace      = flag.String("n", "", `The namespace of the VMs. Defaults to the context's namespace`)
+	allNamespaces  = flag.Bool("A", false, `For 'list', list VMs in all namespaces`)
+	follow         = flag.Bool("f", false, `For 'console' and 'decisions', keep streaming new output`)
+	timeoutSeconds = flag.Uint("timeout", 0, `For 'exec', the maximum duration of the command, in seconds`)
+
+	agentNamespace = flag.String("agent-namespace", "kube-system", `The namespace of the autoscaler-agent pods and config`)
+	agentSelector  = flag.String("agent-selector", "name=autoscaler-agent", `The label selector for autoscaler-agent pods`)
+	agentConfigMap = flag.String("agent-config", "autoscaler-agent-config", `The name of the autoscaler-agent's ConfigMap, for its compute unit`)
+)
+
+type clients struct {
+	kube      *kubernetes.Clientset
+	vm        *vmclient.Clientset
+	namespace string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClients()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	var vmName string
+	if cmd != "list" {
+		if len(args) == 0 {
+			fmt.Fprintf(os.Stderr, "error: %s requires the name of a VM\n", cmd)
+			os.Exit(2)
+		}
+		vmName, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "list":
+		err = c.list(ctx)
+	case "units":
+		err = c.units(ctx, vmName)
+	case "migrate":
+		err = c.migrate(ctx, vmName)
+	case "pause":
+		err = c.setRunPolicy(ctx, vmName, vmv1.RunPolicyPaused)
+	case "resume":
+		err = c.setRunPolicy(ctx, vmName, vmv1.RunPolicyRunning)
+	case "console":
+		err = c.console(ctx, vmName)
+	case "decisions":
+		err = c.decisions(ctx, vmName)
+	case "exec":
+		if len(args) != 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		var exitCode int
+		exitCode, err = c.exec(ctx, vmName, args)
+		if err == nil {
+			os.Exit(exitCode)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func newClients() (*clients, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = *kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: *kubeContext}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	ns := *namespace
+	if ns == "" {
+		if ns, _, err = clientConfig.Namespace(); err != nil {
+			return nil, fmt.Errorf("failed to get namespace from kubeconfig: %w", err)
+		}
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make K8s client: %w", err)
+	}
+	vmClient, err := vmclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make VM client: %w", err)
+	}
+	return &clients{kube: kubeClient, vm: vmClient, namespace: ns}, nil
+}
+
+func (c *clients) getVM(ctx context.Context, name string) (*vmv1.VirtualMachine, error) {
+	vm, err := c.vm.NeonvmV1().VirtualMachines(c.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VirtualMachine: %w", err)
+	}
+	return vm, nil
+}
+
+// autoscalingState returns a short description of whether autoscaling is in effect for the VM
+func autoscalingState(vm *vmv1.VirtualMachine) string {
+	if vm.Spec.Autoscaling != nil && vm.Spec.Autoscaling.Pause != nil {
+		return fmt.Sprintf("Paused (%s)", vm.Spec.Autoscaling.Pause.Reason)
+	} else if vm.Spec.Autoscaling.IsEnabled(api.HasAutoscalingEnabled(vm)) {
+		return "Enabled"
+	}
+	return "Disabled"
+}
+
+func (c *clients) list(ctx context.Context) error {
+	ns := c.namespace
+	if *allNamespaces {
+		ns = metav1.NamespaceAll
+	}
+	vms, err := c.vm.NeonvmV1().VirtualMachines(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list VirtualMachines: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tPHASE\tNODE\tCPUS\tMEMORY\tAUTOSCALING\tSCALING")
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		cpus, mem := "-", "-"
+		if vm.Status.CPUs != nil {
+			cpus = fmt.Sprint(*vm.Status.CPUs)
+		}
+		if vm.Status.MemorySize != nil {
+			mem = vm.Status.MemorySize.String()
+		}
+		scaling := "-"
+		if cond := meta.FindStatusCondition(vm.Status.Conditions, vmv1.VmConditionScaling); cond != nil && cond.Status == metav1.ConditionTrue {
+			scaling = cond.Reason
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			vm.Namespace, vm.Name, vm.Status.Phase, vm.Status.Node, cpus, mem, autoscalingState(vm), scaling)
+	}
+	return w.Flush()
+}
+
+// computeUnit fetches the autoscaler-agent's compute unit from its config
+func (c *clients) computeUnit(ctx context.Context) (*api.Resources, error) {
+	cm, err := c.kube.CoreV1().ConfigMaps(*agentNamespace).Get(ctx, *agentConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get autoscaler-agent ConfigMap: %w", err)
+	}
+	var config struct {
+		Scaling struct {
+			ComputeUnit api.Resources `json:"computeUnit"`
+		} `json:"scaling"`
+	}
+	if err := json.Unmarshal([]byte(cm.Data["config.json"]), &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal autoscaler-agent config: %w", err)
+	}
+	if err := config.Scaling.ComputeUnit.ValidateNonZero(); err != nil {
+		return nil, fmt.Errorf("invalid compute unit in autoscaler-agent config: %w", err)
+	}
+	return &config.Scaling.ComputeUnit, nil
+}
+
+// computeUnits returns the number of compute units needed for the resources, i.e. the larger of
+// the two ratios with the compute unit
+func computeUnits(r api.Resources, cu api.Resources) float64 {
+	return max(r.VCPU.AsFloat64()/cu.VCPU.AsFloat64(), r.Mem.AsFloat64()/cu.Mem.AsFloat64())
+}
+
+func (c *clients) units(ctx context.Context, name string) error {
+	vm, err := c.getVM(ctx, name)
+	if err != nil {
+		return err
+	}
+	info, err := api.ExtractVmInfo(zap.NewNop(), vm)
+	if err != nil {
+		return fmt.Errorf("failed to get VM info: %w", err)
+	}
+	cu, err := c.computeUnit(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Compute unit:\t%v vCPU, %v\n", cu.VCPU, cu.Mem)
+	fmt.Fprintf(w, "Autoscaling:\t%s\n\n", autoscalingState(vm))
+	fmt.Fprintln(w, "\tCU\tVCPU\tMEMORY")
+	for _, row := range []struct {
+		name string
+		r    api.Resources
+	}{
+		{"Min", info.Min()},
+		{"Using", info.Using()},
+		{"Max", info.Max()},
+	} {
+		fmt.Fprintf(w, "%s\t%.2f\t%v\t%v\n", row.name, computeUnits(row.r, *cu), row.r.VCPU, row.r.Mem)
+	}
+	return w.Flush()
+}
+
+func (c *clients) migrate(ctx context.Context, name string) error {
+	vm, err := c.getVM(ctx, name)
+	if err != nil {
+		return err
+	}
+	migration := &vmv1.VirtualMachineMigration{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: vm.Name + "-",
+			Namespace:    vm.Namespace,
+		},
+		Spec: vmv1.VirtualMachineMigrationSpec{
+			VmName: vm.Name,
+		},
+	}
+	created, err := c.vm.NeonvmV1().VirtualMachineMigrations(vm.Namespace).Create(ctx, migration, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create VirtualMachineMigration: %w", err)
+	}
+	fmt.Printf("virtualmachinemigration/%s created\n", created.Name)
+	return nil
+}
+
+func (c *clients) setRunPolicy(ctx context.Context, name string, policy vmv1.RunPolicy) error {
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{"runPolicy": policy},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.vm.NeonvmV1().VirtualMachines(c.namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch VirtualMachine: %w", err)
+	}
+	fmt.Printf("virtualmachine/%s runPolicy set to %s\n", name, policy)
+	return nil
+}
+
+// console prints the logs of the VM's runner container, which passes through the guest's serial
+// console.
+func (c *clients) console(ctx context.Context, name string) error {
+	vm, err := c.getVM(ctx, name)
+	if err != nil {
+		return err
+	}
+	if vm.Status.PodName == "" {
+		return fmt.Errorf("VirtualMachine %s has no runner pod", name)
+	}
+	opts := &corev1.PodLogOptions{Container: "neonvm-runner", Follow: *follow}
+	logs, err := c.kube.CoreV1().Pods(vm.Namespace).GetLogs(vm.Status.PodName, opts).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get logs of runner pod: %w", err)
+	}
+	defer logs.Close()
+	_, err = io.Copy(os.Stdout, logs)
+	return err
+}
+
+// decisions prints the log lines from the autoscaler-agent on the VM's node that are about the
+// VM.
+func (c *clients) decisions(ctx context.Context, name string) error {
+	vm, err := c.getVM(ctx, name)
+	if err != nil {
+		return err
+	}
+	if vm.Status.Node == "" {
+		return fmt.Errorf("VirtualMachine %s is not on a node", name)
+	}
+	pods, err := c.kube.CoreV1().Pods(*agentNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: *agentSelector,
+		FieldSelector: "spec.nodeName=" + vm.Status.Node,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list autoscaler-agent pods: %w", err)
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no autoscaler-agent pod found on node %s", vm.Status.Node)
+	}
+
+	opts := &corev1.PodLogOptions{Follow: *follow}
+	logs, err := c.kube.CoreV1().Pods(*agentNamespace).GetLogs(pods.Items[0].Name, opts).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get logs of autoscaler-agent pod: %w", err)
+	}
+	defer logs.Close()
+
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var fields map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			continue
+		}
+		vmField, _ := fields["virtualmachine"].(map[string]any)
+		if vmField["namespace"] != vm.Namespace || vmField["name"] != vm.Name {
+			continue
+		}
+
+		ts, _ := fields["ts"].(float64)
+		level, _ := fields["level"].(string)
+		msg, _ := fields["msg"].(string)
+		for _, key := range []string{"ts", "level", "msg", "logger", "caller", "virtualmachine", "pod"} {
+			delete(fields, key)
+		}
+		extra, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		timestamp := time.Unix(0, int64(ts*float64(time.Second))).UTC().Format(time.RFC3339)
+		fmt.Printf("%s %-5s %s %s\n", timestamp, strings.ToUpper(level), msg, extra)
+	}
+	return scanner.Err()
+}
+
+// exec runs the command in the VM's guest with the exec API, and returns its exit code
+func (c *clients) exec(ctx context.Context, name string, command []string) (int, error) {
+	if len(command) == 0 {
+		return 0, errors.New("exec requires a command, e.g. 'kubectl neonvm exec my-vm -- uname -a'")
+	}
+	body, err := json.Marshal(api.ExecRequest{Command: command, TimeoutSeconds: *timeoutSeconds})
+	if err != nil {
+		return 0, err
+	}
+
+	raw, err := c.kube.CoreV1().RESTClient().Post().
+		AbsPath("/apis/exec.vm.neon.tech/v1", "namespaces", c.namespace, "virtualmachines", name, "exec").
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("exec request failed: %w", err)
+	}
+
+	var result api.ExecResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal exec result: %w", err)
+	}
+	fmt.Fprint(os.Stdout, result.Stdout)
+	fmt.Fprint(os.Stderr, result.Stderr)
+	if result.Truncated {
+		fmt.Fprintf(os.Stderr, "warning: output was truncated to %d bytes\n", api.ExecMaxOutputBytes)
+	}
+	return result.ExitCode, nil
+}
@@ -0,0 +1,41 @@
+#!/neonvm/bin/sh
+
+# Onlines or offlines CPUs to match each count sent by neonvm-runner over the virtio-serial port.
+# The port only exists if the VM's CPU scaling mode is GuestCpuset.
+
+set -uo pipefail
+
+port=/dev/virtio-ports/tech.neon.cpus.0
+
+if [ ! -e "$port" ]; then
+    exit 0
+fi
+
+set_online_cpus() {
+    count="$1"
+    for dir in /sys/devices/system/cpu/cpu[0-9]*; do
+        # cpu0 usually can't be offlined, so it has no 'online' file
+        if [ ! -e "$dir/online" ]; then
+            continue
+        fi
+        id="${dir##*/cpu}"
+        if [ "$id" -lt "$count" ]; then
+            online=1
+        else
+            online=0
+        fi
+        if [ "$(/neonvm/bin/cat "$dir/online")" != "$online" ]; then
+            echo "$online" > "$dir/online" || echo "failed to set cpu$id online=$online" >&2
+        fi
+    done
+}
+
+while true; do
+    # Each connection from neonvm-runner sends a single count. Reading from the port returns EOF
+    # when it disconnects, so we just open it again.
+    while read -r count; do
+        echo "setting online CPUs to $count"
+        set_online_cpus "$count"
+    done < "$port"
+    /neonvm/bin/sleep 1
+done
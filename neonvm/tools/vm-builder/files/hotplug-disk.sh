@@ -0,0 +1,34 @@
+#!/neonvm/bin/sh
+
+# Mounts disks that neonvm-controller attaches while the VM is running (hotpluggable disks in
+# .spec.disks), and cleans up after they're detached. Run by udev, with the action and the name of
+# the block device.
+#
+# Disks attached at boot are mounted by /neonvm/runtime/mounts.sh instead. neonvm-runner stores
+# the mount path of hotplugged disks in the "last mounted on" field of the ext4 superblock, because
+# the runtime disk can't change after boot.
+
+export PATH=/neonvm/bin
+
+action="$1"
+dev="/dev/$2"
+
+case "$action" in
+add)
+    # The superblock starts at byte 1024, and "last mounted on" is 64 bytes at offset 0x88 in it.
+    mountpath="$(dd if="$dev" bs=1 skip=1160 count=64 2>/dev/null | tr -d '\0')"
+    test -n "$mountpath" || exit 0
+    grep -q "^$dev " /proc/mounts && exit 0
+    mkdir -p "$mountpath"
+    mount "$dev" "$mountpath"
+    # Note: chmod must be after mount, otherwise it gets overwritten by mount.
+    chmod 0777 "$mountpath"
+    ;;
+remove)
+    # The device is already gone, so all we can do is detach its filesystem.
+    mountpath="$(awk -v dev="$dev" '$1 == dev { print $2 }' /proc/mounts)"
+    test -n "$mountpath" && umount -l "$mountpath"
+    ;;
+esac
+
+exit 0
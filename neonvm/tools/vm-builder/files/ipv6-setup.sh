@@ -0,0 +1,45 @@
+#!/neonvm/bin/sh
+
+# Sets up IPv6 in the guest, from the settings that neonvm-runner passes on the kernel command line:
+#
+#   neonvm.ipv6=1               .spec.ipFamilies includes IPv6. eth0 gets its address with SLAAC,
+#                               and we get the DNS servers with stateless DHCPv6.
+#   neonvm.overlay_ip6=ADDR/LEN the overlay network's IPv6 address for eth1, which the kernel's ip=
+#                               parameter can't configure.
+#
+# This script is also udhcpc6's event script, called with the event name as its first argument.
+
+export PATH=/neonvm/bin
+
+if [ $# -gt 0 ]; then
+    case "$1" in
+        bound|updated)
+            # Add the DHCPv6 nameservers and search domains, keeping those from udhcpc for IPv4.
+            for ns in ${dns:-}; do
+                grep -q "^nameserver $ns\$" /etc/resolv.conf 2>/dev/null || echo "nameserver $ns" >> /etc/resolv.conf
+            done
+            if [ -n "${search:-}" ] && ! grep -q '^search ' /etc/resolv.conf 2>/dev/null; then
+                echo "search $search" >> /etc/resolv.conf
+            fi
+            ;;
+    esac
+    exit 0
+fi
+
+ipv6=
+overlay=
+for arg in $(cat /proc/cmdline); do
+    case "$arg" in
+        neonvm.ipv6=1) ipv6=1 ;;
+        neonvm.overlay_ip6=*) overlay="${arg#neonvm.overlay_ip6=}" ;;
+    esac
+done
+
+if [ -n "$overlay" ]; then
+    ip link set eth1 up
+    ip -6 addr add "$overlay" dev eth1 || echo "failed to add $overlay to eth1" >&2
+fi
+
+if [ -n "$ipv6" ]; then
+    exec udhcpc6 -f -o -O dns -O search -i eth0 -s /neonvm/bin/ipv6-setup
+fi
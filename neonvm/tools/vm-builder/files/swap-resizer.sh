@@ -0,0 +1,22 @@
+#!/neonvm/bin/sh
+
+# Resizes the swap to each size sent by neonvm-runner over the virtio-serial port. The port only
+# exists if the VM's swap is proportional to its memory.
+
+set -uo pipefail
+
+port=/dev/virtio-ports/tech.neon.swap.0
+
+if [ ! -e "$port" ]; then
+    exit 0
+fi
+
+while true; do
+    # Each connection from neonvm-runner sends a single size. Reading from the port returns EOF
+    # when it disconnects, so we just open it again.
+    while read -r size; do
+        echo "resizing swap to $size bytes"
+        /neonvm/bin/sh /neonvm/runtime/resize-swap-internal.sh "$size" || echo "failed to resize swap to $size bytes" >&2
+    done < "$port"
+    /neonvm/bin/sleep 1
+done
@@ -13,3 +13,13 @@
 chmod 666 /dev/vport0p1
 mkdir -p /dev/virtio-ports
 ln -s /dev/vport0p1 /dev/virtio-ports/tech.neon.log.0
+
+# Same for the disks: neonvm-runner gives each one a virtio serial number derived from its name, so
+# that it can be referred to as /dev/disk/by-id/virtio-<serial> regardless of attach order.
+mkdir -p /dev/disk/by-id
+for serial in /sys/block/vd*/serial; do
+    test -f "$serial" || continue
+    id="$(cat "$serial")"
+    test -n "$id" || continue
+    ln -sf "../../$(echo "$serial" | cut -d/ -f4)" "/dev/disk/by-id/virtio-$id"
+done
@@ -5,13 +5,16 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 
@@ -22,6 +25,10 @@ import (
 	"github.com/docker/docker/pkg/jsonmessage"
 	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 )
 
 // vm-builder --src alpine:3.16 --dst vm-alpine:dev --file vm-alpine.qcow2
@@ -43,6 +50,14 @@ var (
 	scriptUdevInit string
 	//go:embed files/resize-swap.sh
 	scriptResizeSwap string
+	//go:embed files/swap-resizer.sh
+	scriptSwapResizer string
+	//go:embed files/cpu-scaler.sh
+	scriptCPUScaler string
+	//go:embed files/ipv6-setup.sh
+	scriptIPv6Setup string
+	//go:embed files/hotplug-disk.sh
+	scriptHotplugDisk string
 	//go:embed files/vector.yaml
 	configVector string
 	//go:embed files/chrony.conf
@@ -61,7 +76,11 @@ var (
 	specFile  = flag.String("spec", "", `File containing additional customization: --spec=spec.yaml`)
 	quiet     = flag.Bool("quiet", false, `Show less output from the docker build process`)
 	forcePull = flag.Bool("pull", false, `Pull src image even if already present locally`)
+	noCache   = flag.Bool("no-cache", false, `Rebuild every layer, instead of reusing layers cached by previous builds`)
 	version   = flag.Bool("version", false, `Print vm-builder version`)
+
+	platformsList = flag.String("platforms", "linux/amd64", `Comma-separated platforms to build for; with more than one, each image is tagged with its architecture as a suffix: --platforms=linux/amd64,linux/arm64`)
+	push          = flag.Bool("push", false, `Push the resulting image, combining the images for multiple platforms into a multi-arch manifest`)
 )
 
 func AddTemplatedFileToTar(tw *tar.Writer, tmplArgs any, filename string, tmplString string) error {
@@ -95,12 +114,16 @@ func addFileToTar(tw *tar.Writer, filename string, contents []byte) error {
 	return nil
 }
 
+// vectorVersion is the version of vector.dev installed in the image
+const vectorVersion = "0.26.0"
+
 type TemplatesContext struct {
 	User          string
 	Entrypoint    []string
 	Cmd           []string
 	Env           []string
 	RootDiskImage string
+	VectorVersion string
 
 	SpecBuild       string
 	SpecMerge       string
@@ -135,6 +158,11 @@ func main() {
 		dstIm = *dstImage
 	}
 
+	platforms, err := parsePlatforms(*platformsList)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	var spec *imageSpec
 	if *specFile != "" {
 		var err error
@@ -154,50 +182,107 @@ func main() {
 	}
 	defer cli.Close()
 
-	hostContainsSrcImage := false
-	if !*forcePull {
-		hostImages, err := cli.ImageList(ctx, types.ImageListOptions{})
-		if err != nil {
+	// With a single platform, the image is built directly as dstIm. Otherwise, each platform's image
+	// is tagged with the architecture as a suffix, and then combined into a multi-arch manifest
+	// under dstIm when pushing.
+	var archTags []string
+	for _, p := range platforms {
+		tag, file := dstIm, *outFile
+		if len(platforms) > 1 {
+			tag = fmt.Sprintf("%s-%s", dstIm, p.arch)
+			if file != "" {
+				ext := filepath.Ext(file)
+				file = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(file, ext), p.arch, ext)
+			}
+			archTags = append(archTags, tag)
+		}
+
+		if err := buildImage(ctx, cli, spec, p, tag, file); err != nil {
 			log.Fatalln(err) //nolint:gocritic // linter complains that Fatalln circumvents deferred cli.Close(). Too much work to fix in #721, leaving for later.
 		}
+	}
 
-		for _, img := range hostImages {
-			for _, name := range img.RepoTags {
-				if name == *srcImage {
-					hostContainsSrcImage = true
-					break
-				}
-			}
-			if hostContainsSrcImage {
-				break
-			}
+	if *push {
+		if err := pushImage(dstIm, archTags); err != nil {
+			log.Fatalln(err)
 		}
+	} else if len(archTags) != 0 {
+		log.Printf("Built %s; use -push to publish them as the multi-arch image %s", strings.Join(archTags, ", "), dstIm)
 	}
+}
 
-	if !hostContainsSrcImage {
-		// pull source image
-		// use a closure so deferred close is closer
-		err := func() error {
-			log.Printf("Pull source docker image: %s", *srcImage)
-			pull, err := cli.ImagePull(ctx, *srcImage, types.ImagePullOptions{})
-			if err != nil {
-				return err
-			}
-			defer pull.Close()
-			// do quiet pull - discard output
-			_, err = io.Copy(io.Discard, pull)
+// platform is a target platform for the VM image, in the form used by docker, e.g. linux/arm64
+type platform struct {
+	os   string
+	arch string
+}
+
+func (p platform) String() string {
+	return fmt.Sprintf("%s/%s", p.os, p.arch)
+}
+
+// supportedArchitectures are the architectures that the files in the VM image support
+var supportedArchitectures = []string{"amd64", "arm64"}
+
+func parsePlatforms(list string) ([]platform, error) {
+	var platforms []platform
+	for _, s := range strings.Split(list, ",") {
+		osName, arch, ok := strings.Cut(strings.TrimSpace(s), "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid platform %q: expected <os>/<arch>", s)
+		}
+		if osName != "linux" {
+			return nil, fmt.Errorf("unsupported OS %q in platform %q", osName, s)
+		}
+		if !slices.Contains(supportedArchitectures, arch) {
+			return nil, fmt.Errorf("unsupported architecture %q in platform %q, must be one of %v", arch, s, supportedArchitectures)
+		}
+
+		p := platform{os: osName, arch: arch}
+		if slices.Contains(platforms, p) {
+			return nil, fmt.Errorf("duplicate platform %q", s)
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// ensureSourceImage pulls the source image for the platform, unless it's already present locally.
+//
+// The local image store only holds a single platform per tag, so when building for multiple
+// platforms, this will typically replace the image pulled for the previous one.
+func ensureSourceImage(ctx context.Context, cli *client.Client, p platform) error {
+	if !*forcePull {
+		img, _, err := cli.ImageInspectWithRaw(ctx, *srcImage)
+		if err == nil && img.Os == p.os && img.Architecture == p.arch {
+			return nil
+		} else if err != nil && !client.IsErrNotFound(err) {
 			return err
-		}()
-		if err != nil {
-			log.Fatalln(err)
 		}
+	}
 
+	log.Printf("Pull source docker image: %s (%s)", *srcImage, p)
+	pull, err := cli.ImagePull(ctx, *srcImage, types.ImagePullOptions{Platform: p.String()})
+	if err != nil {
+		return err
 	}
+	defer pull.Close()
+	// do quiet pull - discard output
+	_, err = io.Copy(io.Discard, pull)
+	return err
+}
 
-	log.Printf("Build docker image for virtual machine (disk size %s): %s\n", *size, dstIm)
+// buildImage builds the VM image for a single platform, tagging it as dstTag and, if outFile is
+// not empty, saving the disk image there
+func buildImage(ctx context.Context, cli *client.Client, spec *imageSpec, p platform, dstTag string, outFile string) error {
+	if err := ensureSourceImage(ctx, cli, p); err != nil {
+		return err
+	}
+
+	log.Printf("Build docker image for virtual machine (disk size %s, platform %s): %s\n", *size, p, dstTag)
 	imageSpec, _, err := cli.ImageInspectWithRaw(ctx, *srcImage)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
 	// Shell-escape all the command pieces, twice. We need to do it twice because we're generating
@@ -215,6 +300,7 @@ func main() {
 		Cmd:           imageSpec.Config.Cmd,
 		Env:           imageSpec.Config.Env,
 		RootDiskImage: *srcImage,
+		VectorVersion: vectorVersion,
 
 		SpecBuild:       "",  // overridden below if spec != nil
 		SpecMerge:       "",  // overridden below if spec != nil
@@ -256,13 +342,12 @@ func main() {
 				var err error
 				contents, err = os.ReadFile(path)
 				if err != nil {
-					err = fmt.Errorf("failed to read file %q: %w", path, err)
-					log.Fatalln(err)
+					return fmt.Errorf("failed to read file %q: %w", path, err)
 				}
 			}
 
 			if err := addFileToTar(tw, f.Filename, contents); err != nil {
-				log.Fatalln(err)
+				return err
 			}
 		}
 	}
@@ -282,31 +367,47 @@ func main() {
 		{"sshd_config", configSshd},
 		{"udev-init.sh", scriptUdevInit},
 		{"resize-swap.sh", scriptResizeSwap},
+		{"swap-resizer.sh", scriptSwapResizer},
+		{"cpu-scaler.sh", scriptCPUScaler},
+		{"ipv6-setup.sh", scriptIPv6Setup},
+		{"hotplug-disk.sh", scriptHotplugDisk},
 	}
 
 	for _, f := range files {
 		if err := AddTemplatedFileToTar(tw, tmplArgs, f.filename, f.tmpl); err != nil {
-			log.Fatalln(err)
+			return err
 		}
 	}
 
+	metadata, err := json.Marshal(imageMetadata(spec, p, imageSpec))
+	if err != nil {
+		return fmt.Errorf("failed to marshal image metadata: %w", err)
+	}
+	if err := addFileToTar(tw, "vm-image.json", metadata); err != nil {
+		return err
+	}
+
 	buildArgs := make(map[string]*string)
 	buildArgs["DISK_SIZE"] = size
 	opt := types.ImageBuildOptions{
 		Tags: []string{
-			dstIm,
+			dstTag,
+		},
+		Labels: map[string]string{
+			vmv1.VMImageMetadataLabel: string(metadata),
 		},
 		BuildArgs:      buildArgs,
 		SuppressOutput: *quiet,
-		NoCache:        false,
+		NoCache:        *noCache,
 		Context:        tarBuffer,
 		Dockerfile:     "Dockerfile",
 		Remove:         true,
 		ForceRemove:    true,
+		Platform:       p.String(),
 	}
 	buildResp, err := cli.ImageBuild(ctx, tarBuffer, opt)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
 	defer buildResp.Body.Close()
@@ -317,20 +418,20 @@ func main() {
 	}
 	err = jsonmessage.DisplayJSONMessagesStream(buildResp.Body, out, os.Stdout.Fd(), term.IsTerminal(int(os.Stdout.Fd())), nil)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	if len(*outFile) != 0 {
-		log.Printf("Save disk image as %s", *outFile)
+	if len(outFile) != 0 {
+		log.Printf("Save disk image as %s", outFile)
 		// create container from docker image we just built
 		containerResp, err := cli.ContainerCreate(ctx, &container.Config{
-			Image:      dstIm,
+			Image:      dstTag,
 			Tty:        false,
 			Entrypoint: imageSpec.Config.Entrypoint,
 			Cmd:        imageSpec.Config.Cmd,
 		}, nil, nil, nil, "")
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 		if len(containerResp.Warnings) > 0 {
 			log.Println(containerResp.Warnings)
@@ -339,7 +440,7 @@ func main() {
 		// copy file from container as tar archive
 		fromContainer, _, err := cli.CopyFromContainer(ctx, containerResp.ID, "/disk.qcow2")
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 
 		// untar file from tar archive
@@ -349,14 +450,14 @@ func main() {
 			if errors.Is(err, io.EOF) {
 				break
 			} else if err != nil {
-				log.Fatalln(err)
+				return err
 			}
 
 			if header.Name != "disk.qcow2" {
 				log.Printf("skip file %s", header.Name)
 				continue
 			}
-			path := filepath.Join(*outFile) //nolint:gocritic // FIXME: this is probably incorrect, intended to join with header.Name ?
+			path := filepath.Join(outFile) //nolint:gocritic // FIXME: this is probably incorrect, intended to join with header.Name ?
 			info := header.FileInfo()
 
 			// Open and write to the file inside a closure, so we can defer close
@@ -370,7 +471,7 @@ func main() {
 				return err
 			}()
 			if err != nil {
-				log.Fatalln(err)
+				return err
 			}
 		}
 		// remove container
@@ -380,14 +481,98 @@ func main() {
 
 	}
 
+	return nil
+}
+
+// imageMetadata returns the metadata to embed in the image built for the platform, from the source
+// image and the spec's metadata
+func imageMetadata(spec *imageSpec, p platform, src types.ImageInspect) vmv1.VMImageMetadata {
+	metadata := vmv1.VMImageMetadata{
+		BuilderVersion:  Version,
+		BaseImage:       *srcImage,
+		BaseImageDigest: src.ID,
+		Platform:        &vmv1.RootDiskPlatform{Architecture: p.arch, OS: p.os},
+		KernelVersion:   "",
+		MemorySlotSize:  nil,
+		Components: map[string]string{
+			"vector": vectorVersion,
+		},
+	}
+	// Prefer the digest in the registry, so that the base image can be found from it.
+	for _, d := range src.RepoDigests {
+		if _, digest, ok := strings.Cut(d, "@"); ok {
+			metadata.BaseImageDigest = digest
+			break
+		}
+	}
+
+	if spec != nil && spec.Metadata != nil {
+		metadata.KernelVersion = spec.Metadata.KernelVersion
+		if spec.Metadata.MemorySlotSize != "" {
+			// Already validated by readImageSpec
+			size := resource.MustParse(spec.Metadata.MemorySlotSize)
+			metadata.MemorySlotSize = &size
+		}
+		for name, version := range spec.Metadata.Components {
+			metadata.Components[name] = version
+		}
+	}
+
+	return metadata
+}
+
+// pushImage pushes the built image(s) to the registry. If archTags is not empty, those images are
+// pushed and then combined into a multi-arch manifest list, pushed as dstIm.
+//
+// We use the docker CLI for this because the engine API has no support for manifest lists, and so
+// that the CLI's registry credentials are used.
+func pushImage(dstIm string, archTags []string) error {
+	if len(archTags) == 0 {
+		log.Printf("Push docker image: %s", dstIm)
+		return runDocker("push", dstIm)
+	}
+
+	for _, tag := range archTags {
+		log.Printf("Push docker image: %s", tag)
+		if err := runDocker("push", tag); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Push multi-arch manifest: %s", dstIm)
+	if err := runDocker(append([]string{"manifest", "create", "--amend", dstIm}, archTags...)...); err != nil {
+		return err
+	}
+	return runDocker("manifest", "push", "--purge", dstIm)
+}
+
+func runDocker(args ...string) error {
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if !*quiet {
+		log.Printf("Running: docker %s", strings.Join(args, " "))
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("'docker %s' failed: %w", strings.Join(args, " "), err)
+	}
+	return nil
 }
 
 type imageSpec struct {
-	Commands     []command `yaml:"commands"`
-	ShutdownHook string    `yaml:"shutdownHook,omitempty"`
-	Build        string    `yaml:"build"`
-	Merge        string    `yaml:"merge"`
-	Files        []file    `yaml:"files"`
+	Commands     []command          `yaml:"commands"`
+	ShutdownHook string             `yaml:"shutdownHook,omitempty"`
+	Build        string             `yaml:"build"`
+	Merge        string             `yaml:"merge"`
+	Files        []file             `yaml:"files"`
+	Metadata     *imageSpecMetadata `yaml:"metadata,omitempty"`
+}
+
+// imageSpecMetadata is the metadata that the spec adds to the image's vmv1.VMImageMetadata
+type imageSpecMetadata struct {
+	KernelVersion  string            `yaml:"kernelVersion,omitempty"`
+	MemorySlotSize string            `yaml:"memorySlotSize,omitempty"`
+	Components     map[string]string `yaml:"components,omitempty"`
 }
 
 type command struct {
@@ -429,6 +614,11 @@ func readImageSpec(path string) (*imageSpec, error) {
 			errs = append(errs, fmt.Errorf("error in files[%d]: %w", i, e))
 		}
 	}
+	if spec.Metadata != nil {
+		for _, e := range spec.Metadata.validate() {
+			errs = append(errs, fmt.Errorf("error in metadata: %w", e))
+		}
+	}
 
 	if err := errors.Join(errs...); err != nil {
 		return nil, fmt.Errorf("invalid image spec: %w", err)
@@ -469,3 +659,25 @@ func (f file) validate() []error {
 
 	return errs
 }
+
+func (m imageSpecMetadata) validate() []error {
+	var errs []error
+
+	if m.KernelVersion != "" {
+		if _, _, err := vmv1.ParseKernelVersion(m.KernelVersion); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if m.MemorySlotSize != "" {
+		if _, err := resource.ParseQuantity(m.MemorySlotSize); err != nil {
+			errs = append(errs, fmt.Errorf("invalid memorySlotSize %q: %w", m.MemorySlotSize, err))
+		}
+	}
+	for name, version := range m.Components {
+		if name == "" || version == "" {
+			errs = append(errs, fmt.Errorf("components must have non-empty names and versions, got %q: %q", name, version))
+		}
+	}
+
+	return errs
+}
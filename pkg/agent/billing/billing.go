@@ -24,12 +24,18 @@ type Config struct {
 	ActiveTimeMetricName   string        `json:"activeTimeMetricName"`
 	CollectEverySeconds    uint          `json:"collectEverySeconds"`
 	AccumulateEverySeconds uint          `json:"accumulateEverySeconds"`
+	// BurstCPUMetricName, if not empty, is the metric that CPU allowed above a VM's allocation
+	// while bursting (see .spec.guest.cpuBurst) is reported under, separately from CPUMetricName.
+	BurstCPUMetricName string `json:"burstCPUMetricName,omitempty"`
+	// Spill, if not nil, enables writing events to disk when they can't be sent. See spill.go.
+	Spill *SpillConfig `json:"spill,omitempty"`
 }
 
 type ClientsConfig struct {
 	AzureBlob *AzureBlobStorageConfig `json:"azureBlob"`
 	HTTP      *HTTPClientConfig       `json:"http"`
 	S3        *S3ClientConfig         `json:"s3"`
+	Kafka     *KafkaClientConfig      `json:"kafka"`
 }
 
 type AzureBlobStorageConfig struct {
@@ -47,6 +53,11 @@ type S3ClientConfig struct {
 	billing.S3ClientConfig
 }
 
+type KafkaClientConfig struct {
+	BaseClientConfig
+	billing.KafkaClientConfig
+}
+
 type BaseClientConfig struct {
 	PushEverySeconds          uint `json:"pushEverySeconds"`
 	PushRequestTimeoutSeconds uint `json:"pushRequestTimeoutSeconds"`
@@ -54,8 +65,11 @@ type BaseClientConfig struct {
 }
 
 type metricsState struct {
-	historical      map[metricsKey]vmMetricsHistory
-	present         map[metricsKey]vmMetricsInstant
+	historical map[metricsKey]vmMetricsHistory
+	present    map[metricsKey]vmMetricsInstant
+	// presentBurst stores the last value of each VM's .status.cpuBurst.milliCPUSecondsTotal, so
+	// that we can find how much it's increased by.
+	presentBurst    map[metricsKey]int64
 	lastCollectTime *time.Time
 	pushWindowStart time.Time
 }
@@ -90,6 +104,8 @@ type vmMetricsSeconds struct {
 	cpu float64
 	// activeTime stores the total time that the VM was active
 	activeTime time.Duration
+	// burstCPU stores the CPU seconds allowed above the VM's allocation while bursting
+	burstCPU float64
 }
 
 type MetricsCollector struct {
@@ -138,6 +154,13 @@ func NewMetricsCollector(
 			config: c.BaseClientConfig,
 		})
 	}
+	if c := conf.Clients.Kafka; c != nil {
+		mc.clients = append(mc.clients, clientInfo{
+			client: billing.NewKafkaClient(c.KafkaClientConfig, http.DefaultClient),
+			name:   "kafka",
+			config: c.BaseClientConfig,
+		})
+	}
 
 	return mc, nil
 }
@@ -159,6 +182,7 @@ func (mc *MetricsCollector) Run(
 	state := metricsState{
 		historical:      make(map[metricsKey]vmMetricsHistory),
 		present:         make(map[metricsKey]vmMetricsInstant),
+		presentBurst:    make(map[metricsKey]int64),
 		lastCollectTime: nil,
 		pushWindowStart: time.Now(),
 	}
@@ -166,6 +190,14 @@ func (mc *MetricsCollector) Run(
 	var queueWriters []eventQueuePusher[*billing.IncrementalEvent]
 
 	for _, c := range mc.clients {
+		spill, err := newSpillDir(mc.conf.Spill, c.name, metrics)
+		if err != nil {
+			return fmt.Errorf("failed to set up spilling events for client %q: %w", c.name, err)
+		}
+		if spill != nil {
+			spill.updateSize()
+		}
+
 		qw, queueReader := newEventQueue[*billing.IncrementalEvent](metrics.queueSizeCurrent.WithLabelValues(c.name))
 		queueWriters = append(queueWriters, qw)
 
@@ -176,6 +208,7 @@ func (mc *MetricsCollector) Run(
 			clientInfo:        c,
 			metrics:           metrics,
 			queue:             queueReader,
+			spill:             spill,
 			collectorFinished: thisThreadFinished,
 			lastSendDuration:  0,
 		}
@@ -214,6 +247,8 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 
 	old := s.present
 	s.present = make(map[metricsKey]vmMetricsInstant)
+	oldBurst := s.presentBurst
+	s.presentBurst = make(map[metricsKey]int64)
 	var vmsOnThisNode []*vmapi.VirtualMachine
 	if store.Failing() {
 		logger.Error("VM store is currently stopped. No events will be recorded")
@@ -224,7 +259,7 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 	}
 	for _, vm := range vmsOnThisNode {
 		endpointID, isEndpoint := vm.Annotations[api.AnnotationBillingEndpointID]
-		metricsBatch.inc(isEndpointFlag(isEndpoint), autoscalingEnabledFlag(api.HasAutoscalingEnabled(vm)), vm.Status.Phase)
+		metricsBatch.inc(isEndpointFlag(isEndpoint), autoscalingEnabledFlag(api.VmHasAutoscalingEnabled(vm)), vm.Status.Phase)
 		if !isEndpoint {
 			// we're only reporting metrics for VMs with endpoint IDs, and this VM doesn't have one
 			continue
@@ -257,15 +292,28 @@ func (s *metricsState) collect(logger *zap.Logger, store VMStoreForNode, metrics
 			if !ok {
 				vmHistory = vmMetricsHistory{
 					lastSlice: nil,
-					total:     vmMetricsSeconds{cpu: 0, activeTime: time.Duration(0)},
+					total:     vmMetricsSeconds{cpu: 0, activeTime: time.Duration(0), burstCPU: 0},
 				}
 			}
 			// append the slice, merging with the previous if the resource usage was the same
 			vmHistory.appendSlice(timeSlice)
+			if burst := vm.Status.CPUBurst; burst != nil {
+				if oldBurst, ok := oldBurst[key]; ok {
+					delta := burst.MilliCPUSecondsTotal - oldBurst
+					if delta < 0 {
+						// The counter was reset because the runner pod was recreated.
+						delta = burst.MilliCPUSecondsTotal
+					}
+					vmHistory.total.burstCPU += float64(delta) / 1000
+				}
+			}
 			s.historical[key] = vmHistory
 		}
 
 		s.present[key] = presentMetrics
+		if burst := vm.Status.CPUBurst; burst != nil {
+			s.presentBurst[key] = burst.MilliCPUSecondsTotal
+		}
 	}
 
 	s.lastCollectTime = &now
@@ -301,6 +349,7 @@ func (h *vmMetricsHistory) finalizeCurrentTimeSlice() {
 	metricsSeconds := vmMetricsSeconds{
 		cpu:        duration.Seconds() * h.lastSlice.metrics.cpu.AsFloat64(),
 		activeTime: duration,
+		burstCPU:   0, // not tracked by time slices; see metricsState.collect()
 	}
 	h.total.cpu += metricsSeconds.cpu
 	h.total.activeTime += metricsSeconds.activeTime
@@ -336,7 +385,11 @@ func (s *metricsState) drainEnqueue(logger *zap.Logger, conf *Config, hostname s
 	now := time.Now()
 
 	countInBatch := 0
-	batchSize := 2 * len(s.historical)
+	eventsPerVM := 2
+	if conf.BurstCPUMetricName != "" {
+		eventsPerVM += 1
+	}
+	batchSize := eventsPerVM * len(s.historical)
 
 	// Helper function that adds an event to all queues
 	enqueue := func(event *billing.IncrementalEvent) {
@@ -370,6 +423,18 @@ func (s *metricsState) drainEnqueue(logger *zap.Logger, conf *Config, hostname s
 			StopTime:       now,
 			Value:          int(math.Round(history.total.activeTime.Seconds())),
 		})))
+		if conf.BurstCPUMetricName != "" {
+			countInBatch += 1
+			enqueue(logAddedEvent(logger, billing.Enrich(now, hostname, countInBatch, batchSize, &billing.IncrementalEvent{
+				MetricName:     conf.BurstCPUMetricName,
+				Type:           "", // set by billing.Enrich
+				IdempotencyKey: "", // set by billing.Enrich
+				EndpointID:     key.endpointID,
+				StartTime:      s.pushWindowStart,
+				StopTime:       now,
+				Value:          int(math.Round(history.total.burstCPU)),
+			})))
+		}
 	}
 
 	s.pushWindowStart = now
@@ -16,6 +16,10 @@ type PromMetrics struct {
 	queueSizeCurrent  *prometheus.GaugeVec
 	lastSendDuration  *prometheus.GaugeVec
 	sendErrorsTotal   *prometheus.CounterVec
+
+	spilledEventsTotal     *prometheus.CounterVec
+	spillBytesCurrent      *prometheus.GaugeVec
+	spillDroppedFilesTotal *prometheus.CounterVec
 }
 
 func NewPromMetrics() PromMetrics {
@@ -55,6 +59,27 @@ func NewPromMetrics() PromMetrics {
 			},
 			[]string{"client", "cause"},
 		),
+		spilledEventsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_spilled_events_total",
+				Help: "Total billing events written to disk because they couldn't be sent",
+			},
+			[]string{"client"},
+		),
+		spillBytesCurrent: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_billing_spill_size_bytes",
+				Help: "Total size of the billing events currently spilled to disk",
+			},
+			[]string{"client"},
+		),
+		spillDroppedFilesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_billing_spill_dropped_files_total",
+				Help: "Total files of spilled billing events removed because the spill size limit was reached",
+			},
+			[]string{"client"},
+		),
 	}
 }
 
@@ -64,6 +89,9 @@ func (m PromMetrics) MustRegister(reg *prometheus.Registry) {
 	reg.MustRegister(m.queueSizeCurrent)
 	reg.MustRegister(m.lastSendDuration)
 	reg.MustRegister(m.sendErrorsTotal)
+	reg.MustRegister(m.spilledEventsTotal)
+	reg.MustRegister(m.spillBytesCurrent)
+	reg.MustRegister(m.spillDroppedFilesTotal)
 }
 
 type batchMetrics struct {
@@ -26,6 +26,9 @@ type eventSender struct {
 	queue             eventQueuePuller[*billing.IncrementalEvent]
 	collectorFinished util.CondChannelReceiver
 
+	// spill, if not nil, is where events are written when they can't be sent. See spill.go.
+	spill *spillDir
+
 	// lastSendDuration tracks the "real" last full duration of (eventSender).sendAllCurrentEvents().
 	//
 	// It's separate from metrics.lastSendDuration because (a) we'd like to include the duration of
@@ -75,6 +78,13 @@ func (s eventSender) senderLoop(logger *zap.Logger) {
 func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
 	logger.Info("Pushing all available events")
 
+	// Spilled events are older than the ones in the queue, so they must be sent first. If that
+	// fails, the sink is still unavailable - so we'll spill the queue as well.
+	if s.spill != nil && !s.sendSpilledEvents(logger) {
+		s.spillQueue(logger)
+		return
+	}
+
 	if s.queue.size() == 0 {
 		logger.Info("No billing events to push")
 		s.lastSendDuration = 0
@@ -144,24 +154,14 @@ func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
 				zap.Error(err),
 			)
 
-			var rootErr string
-			//nolint:errorlint // The type switch (instead of errors.As) is ok; billing.Send() guarantees the error types.
-			switch e := err.(type) {
-			case billing.JSONError:
-				rootErr = "JSON marshaling"
-			case billing.UnexpectedStatusCodeError:
-				rootErr = fmt.Sprintf("HTTP code %d", e.StatusCode)
-			case billing.S3Error:
-				rootErr = "S3 error"
-			case billing.AzureError:
-				rootErr = "Azure Blob error"
-			default:
-				rootErr = util.RootError(err).Error()
-			}
-			s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, rootErr).Inc()
+			s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, sendErrorCause(err)).Inc()
 
 			s.lastSendDuration = 0
 			s.metrics.lastSendDuration.WithLabelValues(s.clientInfo.name).Set(0.0) // use 0 as a flag that something went wrong; there's no valid time here.
+
+			if s.spill != nil {
+				s.spillQueue(logger)
+			}
 			return
 		}
 
@@ -185,3 +185,103 @@ func (s eventSender) sendAllCurrentEvents(logger *zap.Logger) {
 		}
 	}
 }
+
+// sendErrorCause returns a short description of the error returned by billing.Send, for metrics
+func sendErrorCause(err error) string {
+	//nolint:errorlint // The type switch (instead of errors.As) is ok; billing.Send() guarantees the error types.
+	switch e := err.(type) {
+	case billing.JSONError:
+		return "JSON marshaling"
+	case billing.UnexpectedStatusCodeError:
+		return fmt.Sprintf("HTTP code %d", e.StatusCode)
+	case billing.S3Error:
+		return "S3 error"
+	case billing.AzureError:
+		return "Azure Blob error"
+	case billing.KafkaError:
+		return "Kafka error"
+	default:
+		return util.RootError(err).Error()
+	}
+}
+
+// sendSpilledEvents sends all events that were previously spilled to disk, returning false if
+// any of them couldn't be sent.
+func (s eventSender) sendSpilledEvents(logger *zap.Logger) (ok bool) {
+	files, err := s.spill.files()
+	if err != nil {
+		logger.Error("Failed to list spilled billing events", zap.Error(err))
+		return false
+	}
+
+	for _, f := range files {
+		events, err := s.spill.read(f.name)
+		if err != nil {
+			logger.Error("Failed to read spilled billing events, marking as corrupt", zap.String("file", f.name), zap.Error(err))
+			if err := s.spill.markCorrupt(f.name); err != nil {
+				logger.Error("Failed to mark spilled billing events as corrupt", zap.String("file", f.name), zap.Error(err))
+				return false
+			}
+			continue
+		}
+
+		traceID := billing.GenerateTraceID()
+		err = func() error {
+			reqCtx, cancel := context.WithTimeout(context.TODO(), time.Second*time.Duration(s.config.PushRequestTimeoutSeconds))
+			defer cancel()
+
+			return billing.Send(reqCtx, s.client, traceID, events)
+		}()
+		if err != nil {
+			logger.Error(
+				"Failed to push spilled billing events",
+				zap.String("file", f.name),
+				zap.Int("count", len(events)),
+				zap.String("traceID", string(traceID)),
+				s.client.LogFields(),
+				zap.Error(err),
+			)
+			s.metrics.sendErrorsTotal.WithLabelValues(s.clientInfo.name, sendErrorCause(err)).Inc()
+			return false
+		}
+
+		logger.Info(
+			"Successfully pushed spilled billing events",
+			zap.String("file", f.name),
+			zap.Int("count", len(events)),
+			zap.String("traceID", string(traceID)),
+			s.client.LogFields(),
+		)
+		if err := s.spill.remove(f.name); err != nil {
+			// We'll send these events again, which is ok because they're idempotent.
+			logger.Error("Failed to remove spilled billing events after sending", zap.String("file", f.name), zap.Error(err))
+		}
+	}
+
+	return true
+}
+
+// spillQueue writes all events in the queue to disk, in batches of at most MaxBatchSize, and removes
+// them from the queue.
+func (s eventSender) spillQueue(logger *zap.Logger) {
+	total := 0
+	for {
+		chunk := s.queue.get(int(s.config.MaxBatchSize))
+		if len(chunk) == 0 {
+			break
+		}
+
+		if err := s.spill.write(logger, chunk); err != nil {
+			// Keep the events in memory; we'll try again on the next push.
+			logger.Error("Failed to spill billing events to disk", zap.Int("count", len(chunk)), zap.Error(err))
+			break
+		}
+
+		s.queue.drop(len(chunk))
+		total += len(chunk)
+	}
+
+	if total != 0 {
+		logger.Warn("Spilled unsent billing events to disk", zap.Int("count", total))
+	}
+}
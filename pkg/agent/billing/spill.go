@@ -0,0 +1,196 @@
+package billing
+
+// Spilling unsent events to disk
+//
+// When a client fails to push events (e.g. because the sink is down), the sender writes everything
+// in its in-memory queue to files in the spill directory and removes it from the queue. This
+// bounds the agent's memory usage during long outages, and means that the events aren't lost if the
+// agent restarts before the sink recovers.
+//
+// Before each push, spilled files are sent first - oldest first - and each file is only removed
+// once it's been sent, so delivery is at-least-once. Events have idempotency keys, so any
+// duplicates are handled by the sinks.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lithammer/shortuuid"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+type SpillConfig struct {
+	// Directory is where unsent events are written. Each client uses its own subdirectory.
+	Directory string `json:"directory"`
+	// MaxBytes is the maximum total size of the spilled events for each client. Once it's
+	// exceeded, the oldest files are removed.
+	MaxBytes uint64 `json:"maxBytes"`
+}
+
+const (
+	spillFileSuffix = ".json"
+	// spillCorruptSuffix is added to spilled files that can't be read, so that they're kept for
+	// manual recovery without blocking the files after them.
+	spillCorruptSuffix = ".corrupt"
+)
+
+type spillDir struct {
+	dir      string
+	maxBytes uint64
+	client   string
+	metrics  PromMetrics
+}
+
+type spillFile struct {
+	name string
+	size int64
+}
+
+// newSpillDir returns the spill directory for the client, or nil if spilling is disabled
+func newSpillDir(conf *SpillConfig, client string, metrics PromMetrics) (*spillDir, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	dir := filepath.Join(conf.Directory, client)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spill directory: %w", err)
+	}
+
+	return &spillDir{
+		dir:      dir,
+		maxBytes: conf.MaxBytes,
+		client:   client,
+		metrics:  metrics,
+	}, nil
+}
+
+// files returns the spilled files, oldest first
+func (d *spillDir) files() ([]spillFile, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []spillFile
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spillFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, spillFile{name: entry.Name(), size: info.Size()})
+	}
+
+	// Names start with a fixed-width timestamp, so sorting by name sorts by age.
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// write spills the events to a new file. The file is written to a temporary path first, so that
+// partially-written files are never read.
+func (d *spillDir) write(logger *zap.Logger, events []*billing.IncrementalEvent) error {
+	content, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), shortuuid.New(), spillFileSuffix)
+	tmpPath := filepath.Join(d.dir, name+".tmp")
+	if err := os.WriteFile(tmpPath, content, 0o600); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(d.dir, name)); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	d.metrics.spilledEventsTotal.WithLabelValues(d.client).Add(float64(len(events)))
+	d.enforceLimit(logger)
+	return nil
+}
+
+// read returns the events in the spilled file
+func (d *spillDir) read(name string) ([]*billing.IncrementalEvent, error) {
+	content, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*billing.IncrementalEvent
+	if err := json.Unmarshal(content, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (d *spillDir) remove(name string) error {
+	err := os.Remove(filepath.Join(d.dir, name))
+	d.updateSize()
+	return err
+}
+
+// markCorrupt renames the file so that it's no longer read, but kept for manual recovery
+func (d *spillDir) markCorrupt(name string) error {
+	path := filepath.Join(d.dir, name)
+	err := os.Rename(path, path+spillCorruptSuffix)
+	d.updateSize()
+	return err
+}
+
+// enforceLimit removes the oldest files while the total size is over the limit
+func (d *spillDir) enforceLimit(logger *zap.Logger) {
+	defer d.updateSize()
+
+	files, err := d.files()
+	if err != nil {
+		logger.Error("Failed to list spilled billing events", zap.Error(err))
+		return
+	}
+
+	var total uint64
+	for _, f := range files {
+		total += uint64(f.size)
+	}
+
+	for _, f := range files {
+		if total <= d.maxBytes {
+			return
+		}
+		if err := os.Remove(filepath.Join(d.dir, f.name)); err != nil {
+			logger.Error("Failed to remove spilled billing events", zap.String("file", f.name), zap.Error(err))
+			return
+		}
+		logger.Warn("Removed oldest spilled billing events, over size limit", zap.String("file", f.name), zap.Uint64("maxBytes", d.maxBytes))
+		d.metrics.spillDroppedFilesTotal.WithLabelValues(d.client).Inc()
+		total -= uint64(f.size)
+	}
+}
+
+func (d *spillDir) updateSize() {
+	files, err := d.files()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	d.metrics.spillBytesCurrent.WithLabelValues(d.client).Set(float64(total))
+}
@@ -0,0 +1,179 @@
+package billing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/billing"
+)
+
+// fakeSink is an HTTP billing sink that records the values of the events in each batch it receives
+type fakeSink struct {
+	mu      sync.Mutex
+	batches [][]int
+	status  int
+}
+
+func (s *fakeSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status != http.StatusOK {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	var body struct {
+		Events []billing.IncrementalEvent `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var values []int
+	for _, e := range body.Events {
+		values = append(values, e.Value)
+	}
+	s.batches = append(s.batches, values)
+}
+
+func (s *fakeSink) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *fakeSink) received() [][]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func newTestSender(t *testing.T, sink *fakeSink, maxBytes uint64) (eventSender, eventQueuePusher[*billing.IncrementalEvent]) {
+	server := httptest.NewServer(sink)
+	t.Cleanup(server.Close)
+
+	metrics := NewPromMetrics()
+	spill, err := newSpillDir(&SpillConfig{Directory: t.TempDir(), MaxBytes: maxBytes}, "http", metrics)
+	require.NoError(t, err)
+
+	push, pull := newEventQueue[*billing.IncrementalEvent](prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_size"}))
+	return eventSender{
+		clientInfo: clientInfo{
+			client: billing.NewHTTPClient(server.URL, server.Client()),
+			name:   "http",
+			config: BaseClientConfig{
+				PushEverySeconds:          1,
+				PushRequestTimeoutSeconds: 5,
+				MaxBatchSize:              2,
+			},
+		},
+		metrics: metrics,
+		queue:   pull,
+		spill:   spill,
+	}, push
+}
+
+func testEvents(values ...int) []*billing.IncrementalEvent {
+	var events []*billing.IncrementalEvent
+	for _, v := range values {
+		events = append(events, &billing.IncrementalEvent{
+			IdempotencyKey: "key",
+			MetricName:     "effective_compute_seconds",
+			Type:           "incremental",
+			EndpointID:     "ep",
+			Value:          v,
+		})
+	}
+	return events
+}
+
+func spillFileNames(t *testing.T, d *spillDir) []string {
+	files, err := d.files()
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+func TestSpillAndReplayOldestFirst(t *testing.T) {
+	logger := zap.NewNop()
+	sink := &fakeSink{status: http.StatusInternalServerError}
+	sender, push := newTestSender(t, sink, 1<<20)
+
+	push.enqueue(testEvents(1, 2, 3, 4, 5)...)
+	sender.spillQueue(logger)
+	assert.Equal(t, 0, sender.queue.size())
+	// MaxBatchSize is 2, so the events are spilled over 3 files
+	require.Len(t, spillFileNames(t, sender.spill), 3)
+
+	// While the sink is down, nothing is removed.
+	assert.False(t, sender.sendSpilledEvents(logger))
+	assert.Len(t, spillFileNames(t, sender.spill), 3)
+	assert.Equal(t, 1.0, testutil.ToFloat64(sender.metrics.sendErrorsTotal.WithLabelValues("http", "HTTP code 500")))
+
+	sink.setStatus(http.StatusOK)
+	assert.True(t, sender.sendSpilledEvents(logger))
+	assert.Equal(t, [][]int{{1, 2}, {3, 4}, {5}}, sink.received())
+	assert.Empty(t, spillFileNames(t, sender.spill))
+	assert.Equal(t, 0.0, testutil.ToFloat64(sender.metrics.spillBytesCurrent.WithLabelValues("http")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(sender.metrics.spilledEventsTotal.WithLabelValues("http")))
+}
+
+func TestSpillEnforceLimit(t *testing.T) {
+	logger := zap.NewNop()
+	sender, _ := newTestSender(t, &fakeSink{status: http.StatusOK}, 0)
+
+	// Work out how big a single file is, so that the limit fits exactly two of them.
+	require.NoError(t, sender.spill.write(logger, testEvents(1)))
+	size, err := json.Marshal(testEvents(1))
+	require.NoError(t, err)
+	assert.Empty(t, spillFileNames(t, sender.spill), "a limit of zero should drop every file")
+
+	sender.spill.maxBytes = uint64(2 * len(size))
+	for i := 2; i <= 4; i++ {
+		require.NoError(t, sender.spill.write(logger, testEvents(i)))
+	}
+
+	names := spillFileNames(t, sender.spill)
+	require.Len(t, names, 2)
+	var kept []int
+	for _, name := range names {
+		events, err := sender.spill.read(name)
+		require.NoError(t, err)
+		kept = append(kept, events[0].Value)
+	}
+	assert.Equal(t, []int{3, 4}, kept, "oldest files should be dropped first")
+	assert.Equal(t, 2.0, testutil.ToFloat64(sender.metrics.spillDroppedFilesTotal.WithLabelValues("http")))
+	assert.Equal(t, float64(2*len(size)), testutil.ToFloat64(sender.metrics.spillBytesCurrent.WithLabelValues("http")))
+}
+
+func TestSpillCorruptFile(t *testing.T) {
+	logger := zap.NewNop()
+	sink := &fakeSink{status: http.StatusOK}
+	sender, push := newTestSender(t, sink, 1<<20)
+
+	// Sorts before any file written by spillDir.write
+	corrupt := "00000000000000000000-corrupt" + spillFileSuffix
+	require.NoError(t, os.WriteFile(filepath.Join(sender.spill.dir, corrupt), []byte("{not json"), 0o600))
+	push.enqueue(testEvents(1)...)
+	sender.spillQueue(logger)
+
+	assert.True(t, sender.sendSpilledEvents(logger), "corrupt files should not block the rest")
+	assert.Equal(t, [][]int{{1}}, sink.received())
+	assert.Empty(t, spillFileNames(t, sender.spill))
+	assert.FileExists(t, filepath.Join(sender.spill.dir, corrupt+spillCorruptSuffix))
+}
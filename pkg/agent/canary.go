@@ -0,0 +1,44 @@
+package agent
+
+// Canary rollouts of scaling config changes
+//
+// With .scaling.canary set, a percentage of VMs use a variant of the default scaling config, so
+// that changes can be evaluated against the rest of the fleet before applying them everywhere.
+//
+// VMs are assigned to the canary by a hash of their name, so that their assignment is stable
+// across restarts of the autoscaler-agent, and increasing the percentage only adds VMs to the
+// canary. Metrics about scaling decisions are labeled with each VM's variant.
+
+import (
+	"hash/fnv"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// defaultScalingVariant is the name of the variant for VMs that aren't in the canary
+const defaultScalingVariant = "default"
+
+// scalingVariant returns the name of the scaling variant that the VM is assigned to
+func (c ScalingConfig) scalingVariant(vm util.NamespacedName) string {
+	if c.Canary == nil {
+		return defaultScalingVariant
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(vm.Namespace + "/" + vm.Name))
+	// Use buckets of 0.01%, so that the percentage can be fractional.
+	bucket := float64(hash.Sum32()%10000) / 100
+	if bucket < c.Canary.Percent {
+		return c.Canary.Name
+	}
+	return defaultScalingVariant
+}
+
+// defaultConfigFor returns the default scaling config for VMs in the variant
+func (c ScalingConfig) defaultConfigFor(variant string) api.ScalingConfig {
+	if c.Canary != nil && variant == c.Canary.Name {
+		return c.DefaultConfig.WithOverrides(&c.Canary.Config)
+	}
+	return c.DefaultConfig
+}
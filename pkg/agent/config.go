@@ -8,7 +8,10 @@ import (
 	"github.com/tychoish/fun/erc"
 
 	"github.com/neondatabase/autoscaling/pkg/agent/billing"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/dumpstore"
 )
 
 type Config struct {
@@ -21,6 +24,21 @@ type Config struct {
 	NeonVM    NeonVMConfig     `json:"neonvm"`
 	Billing   billing.Config   `json:"billing"`
 	DumpState *DumpStateConfig `json:"dumpState"`
+	// DumpStateUpload, if provided, enables periodically uploading the internal state to object
+	// storage. See pkg/util/dumpstore for more.
+	DumpStateUpload *dumpstore.Config `json:"dumpStateUpload"`
+	// Resync, if provided, enables the endpoint to trigger immediately fetching a VM's metrics.
+	Resync *ResyncConfig `json:"resync,omitempty"`
+	// Ownership, if provided, requires the agent to claim each VM before managing it, so that
+	// multiple agents (e.g. during a rollout) never manage the same VM at once.
+	Ownership *OwnershipConfig `json:"ownership,omitempty"`
+	// ScalingEvents, if provided, enables emitting Kubernetes Events on each VirtualMachine for
+	// its scaling decisions. See events.go for more.
+	ScalingEvents *ScalingEventsConfig `json:"scalingEvents,omitempty"`
+
+	// ScalingJournal, if provided, enables keeping a journal of each VM's recent scaling
+	// decisions, retrievable over HTTP. See journal.go for more.
+	ScalingJournal *ScalingJournalConfig `json:"scalingJournal,omitempty"`
 }
 
 type RateThresholdConfig struct {
@@ -61,6 +79,70 @@ type MonitorConfig struct {
 	// RequestedUpscaleValidSeconds gives the duration, in seconds, that requested upscaling should
 	// be respected for, before allowing re-downscaling.
 	RequestedUpscaleValidSeconds uint `json:"requestedUpscaleValidSeconds"`
+	// UpscaleComputeUnitsBySeverity, if provided, gives the number of compute units to upscale by
+	// for each severity of upscale request from the vm-monitor - e.g. so that an OOM kill in the
+	// guest adds more memory than a gradual increase in usage. Severities that aren't present
+	// upscale by one compute unit.
+	UpscaleComputeUnitsBySeverity map[api.UpscaleSeverity]uint32 `json:"upscaleComputeUnitsBySeverity,omitempty"`
+
+	// DegradedMode, if provided, enables scaling VMs whose vm-monitor never connects, using only
+	// the externally scraped metrics. See MonitorDegradedModeConfig for more.
+	DegradedMode *MonitorDegradedModeConfig `json:"degradedMode,omitempty"`
+
+	// Classes, if provided, defines named sets of overrides for the settings above. VMs select a
+	// class with the api.AnnotationMonitorClass annotation, and can override individual settings
+	// with api.AnnotationMonitorConfig.
+	Classes map[string]api.MonitorConfigOverrides `json:"classes,omitempty"`
+}
+
+// MonitorDegradedModeConfig configures the "degraded" autoscaling mode, for VMs that don't run a
+// vm-monitor (e.g. non-Neon guests).
+//
+// Without a vm-monitor, the autoscaler-agent can't ask the guest whether it's ok to downscale, so
+// normally these VMs are never downscaled. In degraded mode, CPU is scaled freely based on the
+// VM's metrics, and memory may be downscaled, but never below a floor.
+type MonitorDegradedModeConfig struct {
+	// AfterSeconds gives the duration, in seconds, that the vm-monitor must fail to connect for,
+	// from when we start handling the VM, before the VM enters degraded mode.
+	//
+	// If the vm-monitor connects later, the VM leaves degraded mode.
+	AfterSeconds uint `json:"afterSeconds"`
+	// MemoryFloorFraction is the fraction of the VM's maximum memory, between 0 and 1, that
+	// memory will not be downscaled below while in degraded mode. The VM's minimum memory is
+	// always respected.
+	MemoryFloorFraction float64 `json:"memoryFloorFraction"`
+}
+
+// ForVM returns the MonitorConfig to use for the VM, with the overrides from its class and its own
+// annotation applied, in that order.
+//
+// Unknown classes are ignored, so that VMs don't fail to start if the class is removed.
+func (c MonitorConfig) ForVM(vmConfig api.VmConfig) MonitorConfig {
+	if class, ok := c.Classes[vmConfig.MonitorClass]; ok {
+		c = c.withOverrides(class)
+	}
+	if vmConfig.MonitorConfig != nil {
+		c = c.withOverrides(*vmConfig.MonitorConfig)
+	}
+	return c
+}
+
+func (c MonitorConfig) withOverrides(o api.MonitorConfigOverrides) MonitorConfig {
+	override := func(field *uint, value *uint) {
+		if value != nil {
+			*field = *value
+		}
+	}
+
+	override(&c.ResponseTimeoutSeconds, o.ResponseTimeoutSeconds)
+	override(&c.ConnectionTimeoutSeconds, o.ConnectionTimeoutSeconds)
+	override(&c.ConnectionRetryMinWaitSeconds, o.ConnectionRetryMinWaitSeconds)
+	override(&c.UnhealthyAfterSilenceDurationSeconds, o.UnhealthyAfterSilenceDurationSeconds)
+	override(&c.UnhealthyStartupGracePeriodSeconds, o.UnhealthyStartupGracePeriodSeconds)
+	override(&c.MaxHealthCheckSequentialFailuresSeconds, o.MaxHealthCheckSequentialFailuresSeconds)
+	override(&c.RetryFailedRequestSeconds, o.RetryFailedRequestSeconds)
+
+	return c
 }
 
 // DumpStateConfig configures the endpoint to dump all internal state
@@ -72,6 +154,54 @@ type DumpStateConfig struct {
 	TimeoutSeconds uint `json:"timeoutSeconds"`
 }
 
+// ResyncConfig configures the endpoint to trigger immediately fetching a VM's metrics
+type ResyncConfig struct {
+	// Port is the port to serve on
+	Port uint16 `json:"port"`
+	// MinSecondsBetweenResyncs gives the minimum duration, in seconds, between resyncs for the
+	// same VM. Requests more frequent than this are rejected.
+	MinSecondsBetweenResyncs uint `json:"minSecondsBetweenResyncs"`
+}
+
+// OwnershipConfig configures the per-VM ownership claims that agents must hold to manage a VM
+//
+// Each claim is a coordination.k8s.io Lease in the VM's namespace, named "autoscaler-agent-<vm>".
+type OwnershipConfig struct {
+	// LeaseDurationSeconds gives the duration, in seconds, after which a claim that hasn't been
+	// renewed may be taken over by another agent. An agent that can't renew its claim within this
+	// duration stops managing the VM.
+	LeaseDurationSeconds uint `json:"leaseDurationSeconds"`
+	// RenewDeadlineSeconds gives the duration, in seconds, after the last successful renewal of a
+	// claim at which the agent stops managing the VM if it still hasn't been able to renew it. It
+	// must be less than LeaseDurationSeconds, so that the agent has stopped before any other agent
+	// may take over.
+	RenewDeadlineSeconds uint `json:"renewDeadlineSeconds"`
+	// RenewEverySeconds gives the interval, in seconds, between renewals of a held claim (or
+	// attempts to acquire one). It must be less than RenewDeadlineSeconds.
+	RenewEverySeconds uint `json:"renewEverySeconds"`
+}
+
+// ScalingEventsConfig configures the Events emitted for scaling decisions
+type ScalingEventsConfig struct {
+	// MinIntervalSeconds gives the minimum duration, in seconds, between Events with the same
+	// reason for the same VM. More frequent Events are dropped.
+	MinIntervalSeconds uint `json:"minIntervalSeconds"`
+}
+
+// ScalingJournalConfig configures the journal of each VM's recent scaling decisions
+type ScalingJournalConfig struct {
+	// Port is the port to serve the journal from
+	Port uint16 `json:"port"`
+	// MaxEntriesPerVM gives the number of most recent scaling transactions to keep for each VM
+	MaxEntriesPerVM uint `json:"maxEntriesPerVM"`
+	// Directory, if not empty, gives the directory to write the journal to, so that it's kept
+	// across restarts of the autoscaler-agent
+	Directory string `json:"directory,omitempty"`
+	// MaxFileBytes gives the size, in bytes, after which the journal file is rotated. It's required
+	// if Directory is set.
+	MaxFileBytes uint `json:"maxFileBytes,omitempty"`
+}
+
 // ScalingConfig defines the scheduling we use for scaling up and down
 type ScalingConfig struct {
 	// ComputeUnit is the desired ratio between CPU and memory that the autoscaler-agent should
@@ -80,12 +210,85 @@ type ScalingConfig struct {
 	// DefaultConfig gives the default scaling config, to be used if there is no configuration
 	// supplied with the "autoscaling.neon.tech/config" annotation.
 	DefaultConfig api.ScalingConfig `json:"defaultConfig"`
+	// Canary, if provided, assigns a percentage of VMs to a variant of DefaultConfig, so that
+	// changes can be evaluated on some VMs before rolling them out to all. See canary.go for more.
+	Canary *ScalingCanaryConfig `json:"canary,omitempty"`
+}
+
+// ScalingCanaryConfig configures the canary variant of the default scaling config
+type ScalingCanaryConfig struct {
+	// Name identifies the canary in metrics. It must not be "default".
+	Name string `json:"name"`
+	// Percent is the percentage of VMs, from 0 to 100, that use the canary
+	Percent float64 `json:"percent"`
+	// Config overrides fields from DefaultConfig for VMs in the canary. Settings from VMs' own
+	// "autoscaling.neon.tech/config" annotation still take precedence.
+	Config api.ScalingConfig `json:"config"`
 }
 
 // MetricsConfig defines a few parameters for metrics requests to the VM
 type MetricsConfig struct {
 	System MetricsSourceConfig `json:"system"`
 	LFC    MetricsSourceConfig `json:"lfc"`
+	// Sources, if not nil, enables alternative sources of system metrics, which VMs can select with
+	// the "autoscaling.neon.tech/metrics-source" annotation. VMs without the annotation always use
+	// vector.dev, as configured by System.
+	Sources *MetricsSourcesConfig `json:"sources,omitempty"`
+	// Scraping, if not nil, limits the metrics requests to VMs across the node, so that a surge of
+	// slow requests can't delay scaling for every VM. See scrapepool.go for more.
+	Scraping *ScrapingConfig `json:"scraping,omitempty"`
+}
+
+// ScrapingConfig configures the limits on metrics requests to VMs across the node
+type ScrapingConfig struct {
+	// MaxConcurrentRequests is the maximum number of metrics requests to VMs in flight at once
+	MaxConcurrentRequests uint `json:"maxConcurrentRequests"`
+	// MaxIntervalMultiplier is the maximum factor by which the time between each VM's metrics
+	// requests is stretched while requests are waiting for a worker. It must be at least 1.
+	MaxIntervalMultiplier float64 `json:"maxIntervalMultiplier"`
+	// StaleAfterSeconds gives the duration, in seconds, since a VM's system metrics were last
+	// fetched after which they're considered stale.
+	StaleAfterSeconds uint `json:"staleAfterSeconds"`
+}
+
+// MetricsSourcesConfig configures the alternative sources of system metrics. Sources that are nil
+// are disabled.
+type MetricsSourcesConfig struct {
+	// Prometheus scrapes any prometheus endpoint in the VM, with configurable metric names.
+	//
+	// It's selected with the "prometheus" annotation value.
+	Prometheus *PrometheusMetricsSourceConfig `json:"prometheus,omitempty"`
+	// NodeExporter scrapes prometheus' node-exporter running in the VM.
+	//
+	// It's selected with the "node-exporter" annotation value.
+	NodeExporter *MetricsSourceConfig `json:"nodeExporter,omitempty"`
+	// Push uses metrics that are pushed to the autoscaler-agent over HTTP.
+	//
+	// It's selected with the "push" annotation value.
+	Push *PushMetricsSourceConfig `json:"push,omitempty"`
+}
+
+type PrometheusMetricsSourceConfig struct {
+	MetricsSourceConfig
+	// Path is the HTTP path that metrics are served on, e.g. "/metrics"
+	Path string `json:"path"`
+	// MetricNames gives the names of the metrics that system metrics are read from
+	MetricNames core.SystemMetricNames `json:"metricNames"`
+}
+
+type PushMetricsSourceConfig struct {
+	// Port is the port that the autoscaler-agent accepts pushed metrics on.
+	//
+	// Metrics are pushed with a POST request to "/metrics", in prometheus text format, using the
+	// names from vector.dev. Requests are matched to VMs by their source IP, so they must come
+	// from the VM's runner pod.
+	Port uint16 `json:"port"`
+	// SecondsBetweenRequests sets the number of seconds to wait between reading the latest pushed
+	// metrics for each VM
+	SecondsBetweenRequests uint `json:"secondsBetweenRequests"`
+	// MaxAgeSeconds gives the duration, in seconds, after which pushed metrics are considered
+	// stale and are no longer used.
+	MaxAgeSeconds uint `json:"maxAgeSeconds"`
 }
 
 type MetricsSourceConfig struct {
@@ -118,11 +321,55 @@ type SchedulerConfig struct {
 	// RetryDeniedUpscaleSeconds gives the duration, in seconds, that we must wait before resending
 	// a request for resources that were not approved
 	RetryDeniedUpscaleSeconds uint `json:"retryDeniedUpscaleSeconds"`
+	// RetryDeniedUpscaleSecondsBatch, if not zero, replaces RetryDeniedUpscaleSeconds for VMs with
+	// Batch priority, so that they back off for longer when their node is contended.
+	RetryDeniedUpscaleSecondsBatch uint `json:"retryDeniedUpscaleSecondsBatch,omitempty"`
+	// RenewLeaseBeforeExpirySeconds gives the duration, in seconds, before an upscale lease from the
+	// scheduler expires that we should make another request to renew it. If zero, the lease is only
+	// renewed once it's expired.
+	RenewLeaseBeforeExpirySeconds uint `json:"renewLeaseBeforeExpirySeconds,omitempty"`
 	// RequestPort defines the port to access the scheduler's ✨special✨ API with
 	RequestPort uint16 `json:"requestPort"`
 	// MaxFailedRequestRate defines the maximum rate of failed scheduler requests, above which
 	// a VM is considered stuck.
 	MaxFailedRequestRate RateThresholdConfig `json:"maxFailedRequestRate"`
+	// GRPC, if not nil, enables using the scheduler plugin's gRPC API, with the HTTP API on
+	// RequestPort as a fallback.
+	GRPC *SchedulerGRPCConfig `json:"grpc,omitempty"`
+	// Failover, if not nil, enables following the scheduler's leader election lease, so that
+	// requests fail over to whichever scheduler replica currently holds it, instead of only using
+	// the newest scheduler pod. See SchedulerFailoverConfig.
+	Failover *SchedulerFailoverConfig `json:"failover,omitempty"`
+}
+
+// SchedulerFailoverConfig defines how requests fail over between scheduler pods
+//
+// Requests are only sent to the ready scheduler pod holding the scheduler's leader election lease:
+// the other replicas aren't scheduling pods, so they can't approve resources for them. If a request
+// fails with a transient error and the lease has moved to another ready scheduler pod in the
+// meantime, the request is retried with the new holder.
+//
+// This requires the scheduler to run with leader election enabled, as in
+// deploy/scheduler/config_map.yaml. The autoscaler-agent checks that the lease exists when it
+// starts.
+//
+// Requests aren't hedged across replicas, and there's no separate health tracking of scheduler
+// pods: with only one replica able to answer, there's nothing to hedge or choose between. The
+// lease itself serves as the health check, because a scheduler that stops renewing it loses it.
+type SchedulerFailoverConfig struct {
+	// LeaseName is the name of the scheduler's leader election Lease, in the scheduler's namespace.
+	// It's the leaderElection.resourceName in the scheduler's configuration.
+	LeaseName string `json:"leaseName"`
+}
+
+// SchedulerGRPCConfig defines the parameters for connecting to the scheduler plugin's gRPC API
+type SchedulerGRPCConfig struct {
+	// Port is the port that the scheduler plugin serves its gRPC API on
+	Port uint16 `json:"port"`
+	// TLS gives the certificates to use for mutual TLS with the scheduler plugin
+	TLS util.MutualTLSConfig `json:"tls"`
+	// ServerName is the name that the scheduler plugin's certificate is expected to have
+	ServerName string `json:"serverName"`
 }
 
 // NeonVMConfig defines a few parameters for NeonVM requests
@@ -192,8 +439,37 @@ func (c *Config) validate() error {
 		erc.Whenf(ec, c.Billing.Clients.S3.Region == "", emptyTmpl, ".billing.clients.s3.region")
 		erc.Whenf(ec, c.Billing.Clients.S3.PrefixInBucket == "", emptyTmpl, ".billing.clients.s3.prefixInBucket")
 	}
+	if c.Billing.Clients.Kafka != nil {
+		validateBaseBillingConfig(&c.Billing.Clients.Kafka.BaseClientConfig, ".billing.clients.kafka")
+		erc.Whenf(ec, c.Billing.Clients.Kafka.RESTProxyURL == "", emptyTmpl, ".billing.clients.kafka.restProxyURL")
+		erc.Whenf(ec, c.Billing.Clients.Kafka.Topic == "", emptyTmpl, ".billing.clients.kafka.topic")
+	}
+	if c.Billing.Spill != nil {
+		erc.Whenf(ec, c.Billing.Spill.Directory == "", emptyTmpl, ".billing.spill.directory")
+		erc.Whenf(ec, c.Billing.Spill.MaxBytes == 0, zeroTmpl, ".billing.spill.maxBytes")
+	}
 	erc.Whenf(ec, c.DumpState != nil && c.DumpState.Port == 0, zeroTmpl, ".dumpState.port")
 	erc.Whenf(ec, c.DumpState != nil && c.DumpState.TimeoutSeconds == 0, zeroTmpl, ".dumpState.timeoutSeconds")
+	erc.Whenf(ec, c.Resync != nil && c.Resync.Port == 0, zeroTmpl, ".resync.port")
+	erc.Whenf(ec, c.Resync != nil && c.Resync.MinSecondsBetweenResyncs == 0, zeroTmpl, ".resync.minSecondsBetweenResyncs")
+	if c.Ownership != nil {
+		erc.Whenf(ec, c.Ownership.LeaseDurationSeconds == 0, zeroTmpl, ".ownership.leaseDurationSeconds")
+		erc.Whenf(ec, c.Ownership.RenewDeadlineSeconds == 0, zeroTmpl, ".ownership.renewDeadlineSeconds")
+		erc.Whenf(ec, c.Ownership.RenewEverySeconds == 0, zeroTmpl, ".ownership.renewEverySeconds")
+		erc.Whenf(ec, c.Ownership.RenewDeadlineSeconds >= c.Ownership.LeaseDurationSeconds,
+			"%s must be less than %s", ".ownership.renewDeadlineSeconds", ".ownership.leaseDurationSeconds")
+		erc.Whenf(ec, c.Ownership.RenewEverySeconds >= c.Ownership.RenewDeadlineSeconds,
+			"%s must be less than %s", ".ownership.renewEverySeconds", ".ownership.renewDeadlineSeconds")
+	}
+	erc.Whenf(ec, c.ScalingEvents != nil && c.ScalingEvents.MinIntervalSeconds == 0, zeroTmpl, ".scalingEvents.minIntervalSeconds")
+	erc.Whenf(ec, c.ScalingJournal != nil && c.ScalingJournal.Port == 0, zeroTmpl, ".scalingJournal.port")
+	erc.Whenf(ec, c.ScalingJournal != nil && c.ScalingJournal.MaxEntriesPerVM == 0, zeroTmpl, ".scalingJournal.maxEntriesPerVM")
+	erc.Whenf(ec, c.ScalingJournal != nil && c.ScalingJournal.Directory != "" && c.ScalingJournal.MaxFileBytes == 0, zeroTmpl, ".scalingJournal.maxFileBytes")
+	if c.DumpStateUpload != nil {
+		if err := c.DumpStateUpload.Validate(); err != nil {
+			ec.Add(fmt.Errorf("%s: %w", ".dumpStateUpload", err))
+		}
+	}
 
 	validateMetricsConfig := func(cfg MetricsSourceConfig, key string) {
 		erc.Whenf(ec, cfg.Port == 0, zeroTmpl, fmt.Sprintf(".metrics.%s.port", key))
@@ -202,6 +478,28 @@ func (c *Config) validate() error {
 	}
 	validateMetricsConfig(c.Metrics.System, "system")
 	validateMetricsConfig(c.Metrics.LFC, "lfc")
+	if sources := c.Metrics.Sources; sources != nil {
+		if sources.Prometheus != nil {
+			validateMetricsConfig(sources.Prometheus.MetricsSourceConfig, "sources.prometheus")
+			erc.Whenf(ec, sources.Prometheus.Path == "", emptyTmpl, ".metrics.sources.prometheus.path")
+			erc.Whenf(ec, sources.Prometheus.MetricNames.Load1 == "", emptyTmpl, ".metrics.sources.prometheus.metricNames.load1")
+			erc.Whenf(ec, sources.Prometheus.MetricNames.MemoryTotal == "", emptyTmpl, ".metrics.sources.prometheus.metricNames.memoryTotal")
+			erc.Whenf(ec, sources.Prometheus.MetricNames.MemoryAvailable == "", emptyTmpl, ".metrics.sources.prometheus.metricNames.memoryAvailable")
+		}
+		if sources.NodeExporter != nil {
+			validateMetricsConfig(*sources.NodeExporter, "sources.nodeExporter")
+		}
+		if sources.Push != nil {
+			erc.Whenf(ec, sources.Push.Port == 0, zeroTmpl, ".metrics.sources.push.port")
+			erc.Whenf(ec, sources.Push.SecondsBetweenRequests == 0, zeroTmpl, ".metrics.sources.push.secondsBetweenRequests")
+			erc.Whenf(ec, sources.Push.MaxAgeSeconds == 0, zeroTmpl, ".metrics.sources.push.maxAgeSeconds")
+		}
+	}
+	if scraping := c.Metrics.Scraping; scraping != nil {
+		erc.Whenf(ec, scraping.MaxConcurrentRequests == 0, zeroTmpl, ".metrics.scraping.maxConcurrentRequests")
+		erc.Whenf(ec, scraping.MaxIntervalMultiplier < 1, "field %q must be at least 1", ".metrics.scraping.maxIntervalMultiplier")
+		erc.Whenf(ec, scraping.StaleAfterSeconds == 0, zeroTmpl, ".metrics.scraping.staleAfterSeconds")
+	}
 	erc.Whenf(ec, c.Scaling.ComputeUnit.VCPU == 0, zeroTmpl, ".scaling.computeUnit.vCPUs")
 	erc.Whenf(ec, c.Scaling.ComputeUnit.Mem == 0, zeroTmpl, ".scaling.computeUnit.mem")
 	erc.Whenf(ec, c.NeonVM.RequestTimeoutSeconds == 0, zeroTmpl, ".scaling.requestTimeoutSeconds")
@@ -217,9 +515,30 @@ func (c *Config) validate() error {
 	erc.Whenf(ec, c.Monitor.RetryFailedRequestSeconds == 0, zeroTmpl, ".monitor.retryFailedRequestSeconds")
 	erc.Whenf(ec, c.Monitor.RetryDeniedDownscaleSeconds == 0, zeroTmpl, ".monitor.retryDeniedDownscaleSeconds")
 	erc.Whenf(ec, c.Monitor.RequestedUpscaleValidSeconds == 0, zeroTmpl, ".monitor.requestedUpscaleValidSeconds")
+	for severity, cus := range c.Monitor.UpscaleComputeUnitsBySeverity {
+		erc.Whenf(ec, cus == 0, zeroTmpl, fmt.Sprintf(".monitor.upscaleComputeUnitsBySeverity[%q]", severity))
+	}
 	erc.Whenf(ec, c.Monitor.MaxFailedRequestRate.IntervalSeconds == 0, zeroTmpl, ".monitor.maxFailedRequestRate.intervalSeconds")
+	if c.Monitor.DegradedMode != nil {
+		erc.Whenf(ec, c.Monitor.DegradedMode.AfterSeconds == 0, zeroTmpl, ".monitor.degradedMode.afterSeconds")
+		erc.Whenf(ec, c.Monitor.DegradedMode.MemoryFloorFraction < 0 || c.Monitor.DegradedMode.MemoryFloorFraction > 1, "field %q must be between 0 and 1", ".monitor.degradedMode.memoryFloorFraction")
+	}
+	for name, class := range c.Monitor.Classes {
+		erc.Whenf(ec, name == "", emptyTmpl, ".monitor.classes key")
+		if err := class.Validate(); err != nil {
+			ec.Add(fmt.Errorf("%s: %w", fmt.Sprintf(".monitor.classes[%q]", name), err))
+		}
+	}
 	// add all errors if there are any: https://github.com/neondatabase/autoscaling/pull/195#discussion_r1170893494
 	ec.Add(c.Scaling.DefaultConfig.ValidateDefaults())
+	if c.Scaling.Canary != nil {
+		erc.Whenf(ec, c.Scaling.Canary.Name == "", emptyTmpl, ".scaling.canary.name")
+		erc.Whenf(ec, c.Scaling.Canary.Name == defaultScalingVariant, "field %q cannot be %q", ".scaling.canary.name", defaultScalingVariant)
+		erc.Whenf(ec, c.Scaling.Canary.Percent < 0 || c.Scaling.Canary.Percent > 100, "field %q must be between 0 and 100", ".scaling.canary.percent")
+		if err := c.Scaling.Canary.Config.ValidateOverrides(); err != nil {
+			ec.Add(fmt.Errorf(".scaling.canary.config: %w", err))
+		}
+	}
 	erc.Whenf(ec, c.Scheduler.RequestPort == 0, zeroTmpl, ".scheduler.requestPort")
 	erc.Whenf(ec, c.Scheduler.RequestTimeoutSeconds == 0, zeroTmpl, ".scheduler.requestTimeoutSeconds")
 	erc.Whenf(ec, c.Scheduler.RequestAtLeastEverySeconds == 0, zeroTmpl, ".scheduler.requestAtLeastEverySeconds")
@@ -227,6 +546,16 @@ func (c *Config) validate() error {
 	erc.Whenf(ec, c.Scheduler.RetryDeniedUpscaleSeconds == 0, zeroTmpl, ".scheduler.retryDeniedUpscaleSeconds")
 	erc.Whenf(ec, c.Scheduler.SchedulerName == "", emptyTmpl, ".scheduler.schedulerName")
 	erc.Whenf(ec, c.Scheduler.MaxFailedRequestRate.IntervalSeconds == 0, zeroTmpl, ".monitor.maxFailedRequestRate.intervalSeconds")
+	if c.Scheduler.GRPC != nil {
+		erc.Whenf(ec, c.Scheduler.GRPC.Port == 0, zeroTmpl, ".scheduler.grpc.port")
+		erc.Whenf(ec, c.Scheduler.GRPC.ServerName == "", emptyTmpl, ".scheduler.grpc.serverName")
+		if err := c.Scheduler.GRPC.TLS.Validate(); err != nil {
+			ec.Add(fmt.Errorf("%s: %w", ".scheduler.grpc.tls", err))
+		}
+	}
+	if c.Scheduler.Failover != nil {
+		erc.Whenf(ec, c.Scheduler.Failover.LeaseName == "", emptyTmpl, ".scheduler.failover.leaseName")
+	}
 
 	return ec.Resolve()
 }
@@ -0,0 +1,106 @@
+package core
+
+// Scale-down delay and scale-up stabilization window
+//
+// If a VM's load oscillates around the threshold between two compute units, scaling for the latest
+// metrics alone would make the VM flap between them. With ScaleDownDelaySeconds and
+// ScaleUpStabilizationWindowSeconds in api.ScalingConfig, we only scale in each direction once the
+// metrics have continuously called for it for the configured duration.
+//
+// Each direction has a timer, started by the first metrics sample that calls for scaling that way,
+// and stopped by the first sample that doesn't. Until the timer expires, the desired resources are
+// held at the VM's current resources in that direction. The timers are also stopped whenever the
+// VM is rescaled, so that there's a delay after each change.
+//
+// Upscaling requested by the vm-monitor and downscaling requested by the scheduler plugin aren't
+// held back, because both are needed promptly.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type cooldownState struct {
+	// Downscale, if not nil, is the timer for downscaling, running while the metrics call for fewer
+	// resources than the VM is using
+	Downscale *cooldownTimer
+	// Upscale, if not nil, is the timer for upscaling, running while the metrics call for more
+	// resources than the VM is using
+	Upscale *cooldownTimer
+}
+
+type cooldownTimer struct {
+	// Since is the time of the first metrics sample that called for scaling in this direction
+	Since time.Time
+	// Until is the time from which scaling in this direction is allowed
+	Until time.Time
+}
+
+// updateCooldownTimer returns the timer updated for a new metrics sample, or nil if the sample
+// doesn't call for scaling in the timer's direction
+func updateCooldownTimer(timer *cooldownTimer, now time.Time, duration time.Duration, wanted bool) *cooldownTimer {
+	if duration == 0 || !wanted {
+		return nil
+	}
+	since := now
+	if timer != nil {
+		since = timer.Since
+	}
+	// nb: recalculate Until every time, in case the duration has changed.
+	return &cooldownTimer{Since: since, Until: since.Add(duration)}
+}
+
+// updateCooldown updates the timers with the resources that the latest metrics call for
+func (s *state) updateCooldown(now time.Time) {
+	config := s.scalingConfig()
+
+	goalCU := s.goalCUForMetrics(s.predictedMetrics())
+	goal := s.Config.ComputeUnit.Mul(uint16(goalCU)).Min(s.VM.Max()).Max(s.VM.Min())
+	using := s.VM.Using()
+
+	s.Cooldown = cooldownState{
+		Downscale: updateCooldownTimer(s.Cooldown.Downscale, now, config.ScaleDownDelay(), goal.HasFieldLessThan(using)),
+		Upscale:   updateCooldownTimer(s.Cooldown.Upscale, now, config.ScaleUpStabilizationWindow(), goal.HasFieldGreaterThan(using)),
+	}
+}
+
+// applyCooldown holds the desired resources at the VM's current resources in each direction that
+// scaling isn't yet allowed in, returning whether that changed them, and if so, how long until the
+// earliest timer expires (or nil if no timer is running yet).
+//
+// If requestedUpscaling is true, upscaling is never held back.
+func (s *state) applyCooldown(
+	now time.Time,
+	desired api.Resources,
+	requestedUpscaling bool,
+) (_ api.Resources, affected bool, wait *time.Duration) {
+	config := s.scalingConfig()
+	using := s.VM.Using()
+
+	hold := func(timer *cooldownTimer) bool {
+		if timer != nil && !now.Before(timer.Until) {
+			return false
+		}
+		affected = true
+		if timer != nil {
+			remaining := timer.Until.Sub(now)
+			if wait != nil {
+				remaining = util.Min(remaining, *wait)
+			}
+			wait = &remaining
+		}
+		return true
+	}
+
+	if config.ScaleDownDelay() != 0 && desired.HasFieldLessThan(using) && hold(s.Cooldown.Downscale) {
+		// nb: using may be greater than the maximum, if the bounds changed. We shouldn't hold that.
+		desired = desired.Max(using.Min(s.VM.Max()))
+	}
+	if config.ScaleUpStabilizationWindow() != 0 && !requestedUpscaling && desired.HasFieldGreaterThan(using) && hold(s.Cooldown.Upscale) {
+		desired = desired.Min(using.Max(s.VM.Min()))
+	}
+
+	return desired, affected, wait
+}
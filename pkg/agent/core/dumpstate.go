@@ -4,6 +4,7 @@ package core
 
 import (
 	"encoding/json"
+	"slices"
 	"time"
 
 	"github.com/neondatabase/autoscaling/pkg/api"
@@ -40,6 +41,9 @@ func (s *State) Dump() StateDump {
 			Monitor: s.internal.Monitor.deepCopy(),
 			NeonVM:  s.internal.NeonVM.deepCopy(),
 			Metrics: shallowCopy[SystemMetrics](s.internal.Metrics),
+
+			Forecast: s.internal.Forecast.deepCopy(),
+			Cooldown: s.internal.Cooldown.deepCopy(),
 		},
 	}
 }
@@ -50,6 +54,10 @@ func (s *pluginState) deepCopy() pluginState {
 		LastRequest:    shallowCopy[pluginRequested](s.LastRequest),
 		LastFailureAt:  shallowCopy[time.Time](s.LastFailureAt),
 		Permit:         shallowCopy[api.Resources](s.Permit),
+		Ballast:        shallowCopy[api.BallastGrant](s.Ballast),
+		Lease:          shallowCopy[pluginLease](s.Lease),
+		Downscale:      shallowCopy[api.PluginDownscaleRequest](s.Downscale),
+		RetryAfter:     s.RetryAfter,
 	}
 }
 
@@ -61,6 +69,26 @@ func (s *monitorState) deepCopy() monitorState {
 		Approved:           shallowCopy[api.Resources](s.Approved),
 		DownscaleFailureAt: shallowCopy[time.Time](s.DownscaleFailureAt),
 		UpscaleFailureAt:   shallowCopy[time.Time](s.UpscaleFailureAt),
+		Degraded:           s.Degraded,
+	}
+}
+
+func (s *forecastState) deepCopy() *forecastState {
+	if s == nil {
+		return nil
+	}
+	return &forecastState{
+		LastSampleAt:     s.LastSampleAt,
+		LoadAverage1Min:  s.LoadAverage1Min,
+		MemoryUsageBytes: s.MemoryUsageBytes,
+		Pending:          slices.Clone(s.Pending),
+	}
+}
+
+func (s *cooldownState) deepCopy() cooldownState {
+	return cooldownState{
+		Downscale: shallowCopy[cooldownTimer](s.Downscale),
+		Upscale:   shallowCopy[cooldownTimer](s.Upscale),
 	}
 }
 
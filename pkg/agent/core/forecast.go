@@ -0,0 +1,147 @@
+package core
+
+// Short-horizon load forecasting, for predictive scaling
+//
+// When predictive scaling is enabled for a VM (see api.PredictiveScalingConfig), we fit a Holt
+// linear trend model - i.e. double exponential smoothing - to each of the VM's load average and
+// memory usage. The desired resources are then based on the greater of the current metrics and the
+// values forecast HorizonSeconds ahead, so that we can start upscaling while load is still ramping
+// up, instead of after it's arrived.
+//
+// Samples don't arrive at exactly regular intervals, so the trend is tracked per second, and each
+// update accounts for the time since the previous sample.
+//
+// To evaluate the model, each forecast is kept until the first sample at or after the time it was
+// made for, and then both are passed to Config.ObserveForecast.
+
+import (
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const (
+	// minForecastSamples is the number of samples required before forecasts are used. With fewer,
+	// the trend is mostly noise.
+	minForecastSamples = 3
+	// maxPendingForecasts bounds the number of forecasts waiting to be compared against actual
+	// metrics, in case samples are much more frequent than the horizon.
+	maxPendingForecasts = 64
+)
+
+type forecastState struct {
+	// LastSampleAt is the time of the most recent sample
+	LastSampleAt time.Time
+
+	LoadAverage1Min  holtModel
+	MemoryUsageBytes holtModel
+
+	// Pending stores the forecasts that are waiting to be compared against the actual metrics, in
+	// order of the time they were made for
+	Pending []pendingForecast
+}
+
+type pendingForecast struct {
+	For     time.Time
+	Metrics SystemMetrics
+}
+
+// holtModel is the state of Holt's linear trend method for a single value
+type holtModel struct {
+	Level float64
+	// Trend is the smoothed rate of change of Level, per second
+	Trend float64
+	// Samples is the number of samples that the model has been updated with
+	Samples int
+}
+
+func (m *holtModel) update(value float64, elapsed time.Duration, config api.PredictiveScalingConfig) {
+	if m.Samples == 0 || elapsed <= 0 {
+		// Nothing to derive a trend from (yet), so just follow the value.
+		m.Level = value
+		m.Samples += 1
+		return
+	}
+
+	dt := elapsed.Seconds()
+	prevLevel := m.Level
+	m.Level = config.LevelSmoothing*value + (1-config.LevelSmoothing)*(m.Level+m.Trend*dt)
+	m.Trend = config.TrendSmoothing*(m.Level-prevLevel)/dt + (1-config.TrendSmoothing)*m.Trend
+	m.Samples += 1
+}
+
+func (m holtModel) forecast(ahead time.Duration) float64 {
+	return util.Max(0, m.Level+m.Trend*ahead.Seconds())
+}
+
+// updateForecast resolves any pending forecasts for the new metrics, and then updates the models
+// with them
+func (s *state) updateForecast(now time.Time, metrics SystemMetrics) {
+	config := s.scalingConfig().Predictive
+	if config == nil {
+		s.Forecast = nil
+		return
+	}
+	if s.Forecast == nil {
+		s.Forecast = &forecastState{
+			LastSampleAt:     now,
+			LoadAverage1Min:  holtModel{Level: 0, Trend: 0, Samples: 0},
+			MemoryUsageBytes: holtModel{Level: 0, Trend: 0, Samples: 0},
+			Pending:          nil,
+		}
+	}
+	f := s.Forecast
+
+	for len(f.Pending) != 0 && !f.Pending[0].For.After(now) {
+		if s.Config.ObserveForecast != nil {
+			s.Config.ObserveForecast(f.Pending[0].Metrics, metrics)
+		}
+		f.Pending = f.Pending[1:]
+	}
+
+	elapsed := now.Sub(f.LastSampleAt)
+	f.LastSampleAt = now
+	f.LoadAverage1Min.update(metrics.LoadAverage1Min, elapsed, *config)
+	f.MemoryUsageBytes.update(metrics.MemoryUsageBytes, elapsed, *config)
+
+	horizon := time.Second * time.Duration(config.HorizonSeconds)
+	if forecast := s.forecastMetrics(horizon); forecast != nil {
+		if len(f.Pending) == maxPendingForecasts {
+			f.Pending = f.Pending[1:]
+		}
+		f.Pending = append(f.Pending, pendingForecast{For: now.Add(horizon), Metrics: *forecast})
+	}
+}
+
+// forecastMetrics returns the metrics forecast for the given duration after the most recent sample,
+// or nil if predictive scaling isn't enabled or there aren't enough samples yet
+func (s *state) forecastMetrics(ahead time.Duration) *SystemMetrics {
+	if s.Forecast == nil || s.Forecast.LoadAverage1Min.Samples < minForecastSamples {
+		return nil
+	}
+
+	return &SystemMetrics{
+		LoadAverage1Min:  s.Forecast.LoadAverage1Min.forecast(ahead),
+		MemoryUsageBytes: s.Forecast.MemoryUsageBytes.forecast(ahead),
+	}
+}
+
+// predictedMetrics returns the metrics to scale for: the current metrics, raised to the forecast
+// values if predictive scaling is enabled
+func (s *state) predictedMetrics() SystemMetrics {
+	metrics := *s.Metrics
+
+	config := s.scalingConfig().Predictive
+	if config == nil {
+		return metrics
+	}
+	forecast := s.forecastMetrics(time.Second * time.Duration(config.HorizonSeconds))
+	if forecast == nil {
+		return metrics
+	}
+
+	metrics.LoadAverage1Min = util.Max(metrics.LoadAverage1Min, forecast.LoadAverage1Min)
+	metrics.MemoryUsageBytes = util.Max(metrics.MemoryUsageBytes, forecast.MemoryUsageBytes)
+	return metrics
+}
@@ -1,6 +1,7 @@
 package core
 
 // Definition of the Metrics type, plus reading it from vector.dev's prometheus format host metrics
+// (or other sources, with the metrics renamed)
 
 import (
 	"fmt"
@@ -42,12 +43,26 @@ type FromPrometheus interface {
 // ParseMetrics reads the prometheus text-format content, parses it, and uses M's implementation of
 // FromPrometheus to populate it before returning.
 func ParseMetrics(content io.Reader, metrics FromPrometheus) error {
+	return ParseMetricsRenamed(content, metrics, nil)
+}
+
+// ParseMetricsRenamed is like ParseMetrics, but first renames the metrics in the content according
+// to 'renames', which maps from the name in the content to the name that M expects.
+//
+// This allows reading metrics from sources that use different names for the same values.
+func ParseMetricsRenamed(content io.Reader, metrics FromPrometheus, renames map[string]string) error {
 	var parser promfmt.TextParser
 	mfs, err := parser.TextToMetricFamilies(content)
 	if err != nil {
 		return fmt.Errorf("failed to parse content as prometheus text format: %w", err)
 	}
 
+	for from, to := range renames {
+		if mf, ok := mfs[from]; ok {
+			mfs[to] = mf
+		}
+	}
+
 	if err := metrics.fromPrometheus(mfs); err != nil {
 		return fmt.Errorf("failed to extract metrics: %w", err)
 	}
@@ -55,6 +70,43 @@ func ParseMetrics(content io.Reader, metrics FromPrometheus) error {
 	return nil
 }
 
+// SystemMetricNames gives the names of the prometheus metrics that SystemMetrics are read from
+type SystemMetricNames struct {
+	// Load1 is the name of the 1-minute load average gauge
+	Load1 string `json:"load1"`
+	// MemoryTotal is the name of the total memory gauge, in bytes
+	MemoryTotal string `json:"memoryTotal"`
+	// MemoryAvailable is the name of the available memory gauge, in bytes
+	MemoryAvailable string `json:"memoryAvailable"`
+}
+
+var (
+	// VectorSystemMetricNames are the names of the metrics exposed by vector.dev's host metrics,
+	// which is what SystemMetrics expects by default.
+	VectorSystemMetricNames = SystemMetricNames{
+		Load1:           "host_load1",
+		MemoryTotal:     "host_memory_total_bytes",
+		MemoryAvailable: "host_memory_available_bytes",
+	}
+	// NodeExporterSystemMetricNames are the names of the equivalent metrics exposed by prometheus'
+	// node-exporter.
+	NodeExporterSystemMetricNames = SystemMetricNames{
+		Load1:           "node_load1",
+		MemoryTotal:     "node_memory_MemTotal_bytes",
+		MemoryAvailable: "node_memory_MemAvailable_bytes",
+	}
+)
+
+// Renames returns the renames to pass to ParseMetricsRenamed so that SystemMetrics are read from
+// metrics with these names.
+func (n SystemMetricNames) Renames() map[string]string {
+	return map[string]string{
+		n.Load1:           VectorSystemMetricNames.Load1,
+		n.MemoryTotal:     VectorSystemMetricNames.MemoryTotal,
+		n.MemoryAvailable: VectorSystemMetricNames.MemoryAvailable,
+	}
+}
+
 func extractFloatGauge(mf *promtypes.MetricFamily) (float64, error) {
 	if mf.GetType() != promtypes.MetricType_GAUGE {
 		return 0, fmt.Errorf("wrong metric type: expected %s but got %s", promtypes.MetricType_GAUGE, mf.GetType())
@@ -85,9 +137,9 @@ func (m *SystemMetrics) fromPrometheus(mfs map[string]*promtypes.MetricFamily) e
 		}
 	}
 
-	load1 := getFloat("host_load1")
-	memTotal := getFloat("host_memory_total_bytes")
-	memAvailable := getFloat("host_memory_available_bytes")
+	load1 := getFloat(VectorSystemMetricNames.Load1)
+	memTotal := getFloat(VectorSystemMetricNames.MemoryTotal)
+	memAvailable := getFloat(VectorSystemMetricNames.MemoryAvailable)
 
 	tmp := SystemMetrics{
 		LoadAverage1Min: load1,
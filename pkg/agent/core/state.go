@@ -30,6 +30,7 @@ import (
 	"github.com/samber/lo"
 	"go.uber.org/zap"
 
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
 )
@@ -58,6 +59,15 @@ type Config struct {
 	// that were not fully granted.
 	PluginDeniedRetryWait time.Duration
 
+	// PluginDeniedRetryWaitBatch, if not zero, replaces PluginDeniedRetryWait for VMs with Batch
+	// priority, so that they back off for longer when the node is contended, leaving freed
+	// resources for higher priority VMs.
+	PluginDeniedRetryWaitBatch time.Duration
+
+	// PluginLeaseRenewBefore gives the amount of time before an upscale lease from the scheduler
+	// plugin expires that we should make another request to renew it.
+	PluginLeaseRenewBefore time.Duration
+
 	// MonitorDeniedDownscaleCooldown gives the time we must wait between making duplicate
 	// downscale requests to the vm-monitor where the previous failed.
 	MonitorDeniedDownscaleCooldown time.Duration
@@ -66,12 +76,26 @@ type Config struct {
 	// vm-monitor must be respected.
 	MonitorRequestedUpscaleValidPeriod time.Duration
 
+	// MonitorUpscaleComputeUnitsBySeverity gives the number of compute units to add to the VM for
+	// requested upscaling from the vm-monitor with each severity. Severities that aren't present
+	// (including the empty severity, from vm-monitors that don't send one) add one compute unit.
+	MonitorUpscaleComputeUnitsBySeverity map[api.UpscaleSeverity]uint32
+
 	// MonitorRetryWait gives the amount of time to wait to retry after a *failed* request.
 	MonitorRetryWait time.Duration
 
+	// DegradedMemoryFloorFraction gives the fraction of the VM's maximum memory that we won't
+	// downscale below while in degraded mode, i.e. without a vm-monitor to approve downscaling.
+	// See MonitorHandle.Degraded() for more.
+	DegradedMemoryFloorFraction float64
+
 	// Log provides an outlet for (*State).NextActions() to give informative messages or warnings
 	// about conditions that are impeding its ability to execute.
 	Log LogConfig `json:"-"`
+
+	// ObserveForecast, if not nil, is called with each forecast made for predictive scaling, along
+	// with the actual metrics from the time it was made for. See forecast.go for more.
+	ObserveForecast func(predicted, actual SystemMetrics) `json:"-"`
 }
 
 type LogConfig struct {
@@ -114,6 +138,13 @@ type state struct {
 	NeonVM neonvmState
 
 	Metrics *SystemMetrics
+
+	// Forecast, if not nil, stores the models used for predictive scaling. It's only set if
+	// predictive scaling is enabled for the VM.
+	Forecast *forecastState
+
+	// Cooldown stores the timers for the scale-down delay and scale-up stabilization window
+	Cooldown cooldownState
 }
 
 type pluginState struct {
@@ -127,6 +158,20 @@ type pluginState struct {
 	// Permit, if not nil, stores the Permit in the most recent PluginResponse. This field will be
 	// nil if we have not been able to contact *any* scheduler.
 	Permit *api.Resources
+	// Ballast, if not nil, stores the BallastGrant in the most recent PluginResponse, giving the
+	// additional memory above Permit that we may immediately upscale into. The grant is only valid
+	// until the next request is started.
+	Ballast *api.BallastGrant
+	// Lease, if not nil, stores the UpscaleLease in the most recent PluginResponse, giving the
+	// additional resources above Permit that we may immediately upscale into until it expires. Like
+	// Ballast, the lease is only valid until the next request is started.
+	Lease *pluginLease
+	// Downscale, if not nil, stores the PluginDownscaleRequest in the most recent PluginResponse. While
+	// set, its target acts as an upper bound on our desired resources.
+	Downscale *api.PluginDownscaleRequest
+	// RetryAfter stores the RetryAfterSeconds in the most recent PluginResponse. If the plugin
+	// deferred our increase, we wait at least this long before requesting it again.
+	RetryAfter time.Duration
 }
 
 type pluginRequested struct {
@@ -134,6 +179,18 @@ type pluginRequested struct {
 	Resources api.Resources
 }
 
+type pluginLease struct {
+	Resources api.Resources
+	// ExpiresAt is measured from when we started the request, so that it's never later than when
+	// the plugin considers the lease expired.
+	ExpiresAt time.Time
+}
+
+// valid returns whether the lease may be used at the given time
+func (l *pluginLease) valid(now time.Time) bool {
+	return l != nil && now.Before(l.ExpiresAt)
+}
+
 type monitorState struct {
 	OngoingRequest *ongoingMonitorRequest
 
@@ -155,6 +212,12 @@ type monitorState struct {
 	// UpscaleFailureAt, if not nil, stores the time at which an upscale request most recently
 	// failed
 	UpscaleFailureAt *time.Time
+
+	// Degraded is true if the vm-monitor never connected and we should scale the VM without it.
+	//
+	// Unlike the other fields, this is preserved across Reset(), and only cleared once the
+	// vm-monitor becomes active.
+	Degraded bool
 }
 
 func (ms *monitorState) active() bool {
@@ -177,6 +240,7 @@ type requestedUpscale struct {
 	At        time.Time
 	Base      api.Resources
 	Requested api.MoreResources
+	Severity  api.UpscaleSeverity
 }
 
 type deniedDownscale struct {
@@ -207,6 +271,10 @@ func NewState(vm api.VmInfo, config Config) *State {
 				LastRequest:    nil,
 				LastFailureAt:  nil,
 				Permit:         nil,
+				Ballast:        nil,
+				Lease:          nil,
+				Downscale:      nil,
+				RetryAfter:     0,
 			},
 			Monitor: monitorState{
 				OngoingRequest:     nil,
@@ -215,13 +283,19 @@ func NewState(vm api.VmInfo, config Config) *State {
 				Approved:           nil,
 				DownscaleFailureAt: nil,
 				UpscaleFailureAt:   nil,
+				Degraded:           false,
 			},
 			NeonVM: neonvmState{
 				LastSuccess:      nil,
 				OngoingRequested: nil,
 				RequestFailedAt:  nil,
 			},
-			Metrics: nil,
+			Metrics:  nil,
+			Forecast: nil,
+			Cooldown: cooldownState{
+				Downscale: nil,
+				Upscale:   nil,
+			},
 		},
 	}
 }
@@ -319,6 +393,15 @@ func (s *state) nextActions(now time.Time) ActionSet {
 	return actions
 }
 
+// pluginDeniedRetryWait returns the amount of time we must wait before re-requesting resources
+// from the plugin that were not fully granted, based on the VM's priority
+func (s *state) pluginDeniedRetryWait() time.Duration {
+	if s.VM.Config.EffectivePriority() == vmapi.PriorityBatch && s.Config.PluginDeniedRetryWaitBatch != 0 {
+		return s.Config.PluginDeniedRetryWaitBatch
+	}
+	return s.Config.PluginDeniedRetryWait
+}
+
 func (s *state) calculatePluginAction(
 	now time.Time,
 	desiredResources api.Resources,
@@ -351,6 +434,11 @@ func (s *state) calculatePluginAction(
 	if s.Plugin.LastRequest != nil {
 		timeUntilNextRequestTick = s.Config.PluginRequestTick - now.Sub(s.Plugin.LastRequest.At)
 	}
+	// Also make a request in time to renew any upscale lease, so that it's available when we need it.
+	if s.Plugin.Lease != nil {
+		timeUntilLeaseRenewal := s.Plugin.Lease.ExpiresAt.Add(-s.Config.PluginLeaseRenewBefore).Sub(now)
+		timeUntilNextRequestTick = util.Min(timeUntilNextRequestTick, timeUntilLeaseRenewal)
+	}
 
 	timeForRequest := timeUntilNextRequestTick <= 0
 
@@ -360,7 +448,8 @@ func (s *state) calculatePluginAction(
 		s.Plugin.Permit != nil &&
 		s.Plugin.LastRequest.Resources.HasFieldGreaterThan(*s.Plugin.Permit)
 	if requestPreviouslyDenied {
-		timeUntilRetryBackoffExpires = s.Plugin.LastRequest.At.Add(s.Config.PluginDeniedRetryWait).Sub(now)
+		retryWait := util.Max(s.pluginDeniedRetryWait(), s.Plugin.RetryAfter)
+		timeUntilRetryBackoffExpires = s.Plugin.LastRequest.At.Add(retryWait).Sub(now)
 	}
 
 	waitingOnRetryBackoff := timeUntilRetryBackoffExpires > 0
@@ -399,7 +488,7 @@ func (s *state) calculatePluginAction(
 	// The rest of the complication is just around accurate logging.
 	if timeForRequest || shouldRequestNewResources {
 		return &ActionPluginRequest{
-			LastPermit: s.Plugin.Permit,
+			LastPermit: s.pluginLastPermit(currentResources),
 			Target:     permittedRequestResources,
 			// convert maybe-nil '*Metrics' to maybe-nil '*core.Metrics'
 			Metrics: func() *api.Metrics {
@@ -432,10 +521,10 @@ func (s *state) calculateNeonVMAction(
 ) (*ActionNeonVMRequest, *time.Duration) {
 	// clamp desiredResources to what we're allowed to make a request for
 	desiredResources = s.clampResources(
-		s.VM.Using(),                       // current: what we're using already
-		desiredResources,                   // target: desired resources
-		ptr(s.monitorApprovedLowerBound()), // lower bound: downscaling that the monitor has approved
-		ptr(s.pluginApprovedUpperBound()),  // upper bound: upscaling that the plugin has approved
+		s.VM.Using(),                         // current: what we're using already
+		desiredResources,                     // target: desired resources
+		ptr(s.monitorApprovedLowerBound()),   // lower bound: downscaling that the monitor has approved
+		ptr(s.pluginApprovedUpperBound(now)), // upper bound: upscaling that the plugin has approved
 	)
 
 	// If we're already using the desired resources, then no need to make a request
@@ -552,8 +641,10 @@ func (s *state) calculateMonitorDownscaleAction(
 	plannedUpscaleRequest bool,
 ) (*ActionMonitorDownscale, *time.Duration) {
 	// can't do anything if we don't have an active connection to the vm-monitor
+	//
+	// In degraded mode, that's expected: downscaling doesn't need the vm-monitor's approval.
 	if !s.Monitor.active() {
-		if desiredResources.HasFieldLessThan(s.VM.Using()) {
+		if desiredResources.HasFieldLessThan(s.VM.Using()) && !s.Monitor.Degraded {
 			s.warn("Wanted to send vm-monitor downscale request, but there's no active connection")
 		}
 		return nil, nil
@@ -642,6 +733,37 @@ func (s *State) DesiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 	return s.internal.desiredResourcesFromMetricsOrRequestedUpscaling(now)
 }
 
+// ScalingInputs is a snapshot of the values that scaling decisions are based on, for debugging
+type ScalingInputs struct {
+	// Metrics are the most recent metrics from the VM, or nil if there aren't any yet
+	Metrics *SystemMetrics `json:"metrics"`
+	// PredictedMetrics are the metrics used to calculate GoalCU, which may be higher than Metrics
+	// with predictive scaling. It's nil if Metrics is nil.
+	PredictedMetrics *SystemMetrics `json:"predictedMetrics"`
+	// GoalCU is the number of compute units that the metrics call for, before any other
+	// constraints are applied. It's nil if Metrics is nil.
+	GoalCU *uint32 `json:"goalCU"`
+	// Using gives the VM's current resources
+	Using api.Resources `json:"using"`
+}
+
+// ScalingInputs returns a snapshot of the current values that scaling decisions are based on
+func (s *State) ScalingInputs() ScalingInputs {
+	inputs := ScalingInputs{
+		Metrics:          shallowCopy[SystemMetrics](s.internal.Metrics),
+		PredictedMetrics: nil,
+		GoalCU:           nil,
+		Using:            s.internal.VM.Using(),
+	}
+	if s.internal.Metrics != nil {
+		predicted := s.internal.predictedMetrics()
+		goalCU := s.internal.goalCUForMetrics(predicted)
+		inputs.PredictedMetrics = &predicted
+		inputs.GoalCU = &goalCU
+	}
+	return inputs
+}
+
 func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (api.Resources, func(ActionSet) *time.Duration) {
 	// There's some annoying edge cases that this function has to be able to handle properly. For
 	// the sake of completeness, they are:
@@ -669,23 +791,8 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 
 	var goalCU uint32
 	if s.Metrics != nil {
-		// For CPU:
-		// Goal compute unit is at the point where (CPUs) × (LoadAverageFractionTarget) == (load
-		// average),
-		// which we can get by dividing LA by LAFT, and then dividing by the number of CPUs per CU
-		goalCPUs := s.Metrics.LoadAverage1Min / *s.scalingConfig().LoadAverageFractionTarget
-		cpuGoalCU := uint32(math.Round(goalCPUs / s.Config.ComputeUnit.VCPU.AsFloat64()))
-
-		// For Mem:
-		// Goal compute unit is at the point where (Mem) * (MemoryUsageFractionTarget) == (Mem Usage)
-		// We can get the desired memory allocation in bytes by dividing MU by MUFT, and then convert
-		// that to CUs
-		//
-		// NOTE: use uint64 for calculations on bytes as uint32 can overflow
-		memGoalBytes := api.Bytes(math.Round(s.Metrics.MemoryUsageBytes / *s.scalingConfig().MemoryUsageFractionTarget))
-		memGoalCU := uint32(memGoalBytes / s.Config.ComputeUnit.Mem)
-
-		goalCU = util.Max(cpuGoalCU, memGoalCU)
+		// With predictive scaling, use the forecast metrics if they're higher. See forecast.go.
+		goalCU = s.goalCUForMetrics(s.predictedMetrics())
 	}
 
 	// Copy the initial value of the goal CU so that we can accurately track whether either
@@ -736,6 +843,17 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 	// bound goalResources by the minimum and maximum resource amounts for the VM
 	result := goalResources.Min(s.VM.Max()).Max(s.VM.Min())
 
+	// Hold back scaling in either direction until the metrics have called for it for long enough.
+	// See cooldown.go.
+	result, cooldownAffectedResult, timeUntilCooldownExpired := s.applyCooldown(now, result, requestedUpscalingAffectedResult)
+
+	// If the scheduler plugin asked us to downscale to make room for other VMs on the node, then
+	// treat its target as an upper bound - unless the vm-monitor's requested upscaling is in effect,
+	// in which case the VM's own needs take priority.
+	if s.Plugin.Downscale != nil && !requestedUpscalingAffectedResult {
+		result = result.Min(s.Plugin.Downscale.Target).Max(s.VM.Min())
+	}
+
 	// ... but if we aren't allowed to downscale, then we *must* make sure that the VM's usage value
 	// won't decrease to the previously denied amount, even if it's greater than the maximum.
 	//
@@ -784,6 +902,10 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 			waitTime = util.Min(waitTime, timeUntilRequestedUpscalingExpired)
 			waiting = true
 		}
+		if cooldownAffectedResult && timeUntilCooldownExpired != nil {
+			waitTime = util.Min(waitTime, *timeUntilCooldownExpired)
+			waiting = true
+		}
 
 		if waiting {
 			return &waitTime
@@ -797,6 +919,27 @@ func (s *state) desiredResourcesFromMetricsOrRequestedUpscaling(now time.Time) (
 	return result, calculateWaitTime
 }
 
+// goalCUForMetrics returns the number of compute units that the metrics call for
+func (s *state) goalCUForMetrics(metrics SystemMetrics) uint32 {
+	// For CPU:
+	// Goal compute unit is at the point where (CPUs) × (LoadAverageFractionTarget) == (load
+	// average),
+	// which we can get by dividing LA by LAFT, and then dividing by the number of CPUs per CU
+	goalCPUs := metrics.LoadAverage1Min / *s.scalingConfig().LoadAverageFractionTarget
+	cpuGoalCU := uint32(math.Round(goalCPUs / s.Config.ComputeUnit.VCPU.AsFloat64()))
+
+	// For Mem:
+	// Goal compute unit is at the point where (Mem) * (MemoryUsageFractionTarget) == (Mem Usage)
+	// We can get the desired memory allocation in bytes by dividing MU by MUFT, and then convert
+	// that to CUs
+	//
+	// NOTE: use uint64 for calculations on bytes as uint32 can overflow
+	memGoalBytes := api.Bytes(math.Round(metrics.MemoryUsageBytes / *s.scalingConfig().MemoryUsageFractionTarget))
+	memGoalCU := uint32(memGoalBytes / s.Config.ComputeUnit.Mem)
+
+	return util.Max(cpuGoalCU, memGoalCU)
+}
+
 func (s *state) timeUntilRequestedUpscalingExpired(now time.Time) time.Duration {
 	if s.Monitor.RequestedUpscale != nil {
 		return s.Monitor.RequestedUpscale.At.Add(s.Config.MonitorRequestedUpscaleValidPeriod).Sub(now)
@@ -813,13 +956,19 @@ func (s *state) requiredCUForRequestedUpscaling(computeUnit api.Resources, reque
 	requested := requestedUpscale.Requested
 	base := requestedUpscale.Base
 
-	// note: 1 + floor(x / M) gives the minimum integer value greater than x / M.
+	step, ok := s.Config.MonitorUpscaleComputeUnitsBySeverity[requestedUpscale.Severity]
+	if !ok || step == 0 {
+		step = 1
+	}
+
+	// note: 1 + floor(x / M) gives the minimum integer value greater than x / M, and so
+	// step + floor(x / M) is that plus (step - 1) more compute units.
 
 	if requested.Cpu {
-		required = util.Max(required, 1+uint32(base.VCPU/computeUnit.VCPU))
+		required = util.Max(required, step+uint32(base.VCPU/computeUnit.VCPU))
 	}
 	if requested.Memory {
-		required = util.Max(required, 1+uint32(base.Mem/computeUnit.Mem))
+		required = util.Max(required, step+uint32(base.Mem/computeUnit.Mem))
 	}
 
 	return required
@@ -898,19 +1047,62 @@ func (s *state) clampResources(
 func (s *state) monitorApprovedLowerBound() api.Resources {
 	if s.Monitor.Approved != nil {
 		return *s.Monitor.Approved
+	} else if s.Monitor.Degraded {
+		return s.degradedLowerBound()
 	} else {
 		return s.VM.Using()
 	}
 }
 
-func (s *state) pluginApprovedUpperBound() api.Resources {
+// degradedLowerBound returns the lower bound on downscaling while in degraded mode: CPU may be
+// decreased freely, but memory not below the configured fraction of the VM's maximum.
+func (s *state) degradedLowerBound() api.Resources {
+	floor := api.Bytes(s.Config.DegradedMemoryFloorFraction * float64(s.VM.Max().Mem))
+	using := s.VM.Using()
+	return api.Resources{
+		VCPU: util.Min(using.VCPU, s.VM.Min().VCPU),
+		Mem:  util.Min(using.Mem, util.Max(floor, s.VM.Min().Mem)),
+	}
+}
+
+func (s *state) pluginApprovedUpperBound(now time.Time) api.Resources {
 	if s.Plugin.Permit != nil {
-		return *s.Plugin.Permit
+		bound := *s.Plugin.Permit
+		if s.Plugin.Ballast != nil {
+			bound.Mem += s.Plugin.Ballast.Mem
+		}
+		if s.Plugin.Lease.valid(now) {
+			bound = bound.Add(s.Plugin.Lease.Resources)
+		}
+		// Any ballast or lease we've already used is no longer part of the bound once we start the next
+		// request, but we mustn't go below what the VM is using in the meantime.
+		return bound.Max(s.VM.Using())
 	} else {
 		return s.VM.Using()
 	}
 }
 
+// pluginLastPermit returns the value of LastPermit to send in the next request to the plugin,
+// which includes any part of the current ballast grant or upscale lease that's in use.
+func (s *state) pluginLastPermit(currentResources api.Resources) *api.Resources {
+	if s.Plugin.Permit == nil || (s.Plugin.Ballast == nil && s.Plugin.Lease == nil) {
+		return s.Plugin.Permit
+	}
+
+	// Note: we include the lease even if it's expired, because we may have started using it before
+	// then.
+	bound := *s.Plugin.Permit
+	if s.Plugin.Ballast != nil {
+		bound.Mem += s.Plugin.Ballast.Mem
+	}
+	if s.Plugin.Lease != nil {
+		bound = bound.Add(s.Plugin.Lease.Resources)
+	}
+
+	permit := s.Plugin.Permit.Max(currentResources.Min(bound))
+	return &permit
+}
+
 //////////////////////////////////////////
 // PUBLIC FUNCTIONS TO UPDATE THE STATE //
 //////////////////////////////////////////
@@ -934,8 +1126,10 @@ func (s *State) UpdatedVM(vm api.VmInfo) {
 	s.internal.VM = vm
 }
 
-func (s *State) UpdateSystemMetrics(metrics SystemMetrics) {
+func (s *State) UpdateSystemMetrics(now time.Time, metrics SystemMetrics) {
 	s.internal.Metrics = &metrics
+	s.internal.updateForecast(now, metrics)
+	s.internal.updateCooldown(now)
 }
 
 func (s *State) UpdateLFCMetrics(metrics LFCMetrics) {
@@ -957,6 +1151,9 @@ func (h PluginHandle) StartingRequest(now time.Time, resources api.Resources) {
 		Resources: resources,
 	}
 	h.s.Plugin.OngoingRequest = true
+	// the plugin revokes any ballast grant or lease when it receives a new request
+	h.s.Plugin.Ballast = nil
+	h.s.Plugin.Lease = nil
 }
 
 func (h PluginHandle) RequestFailed(now time.Time) {
@@ -995,6 +1192,16 @@ func (h PluginHandle) RequestSuccessful(now time.Time, resp api.PluginResponse)
 	// the process of moving the source of truth for ComputeUnit from the scheduler plugin to the
 	// autoscaler-agent.
 	h.s.Plugin.Permit = &resp.Permit
+	h.s.Plugin.Ballast = resp.Ballast
+	h.s.Plugin.Lease = nil
+	if resp.Lease != nil {
+		h.s.Plugin.Lease = &pluginLease{
+			Resources: resp.Lease.Resources,
+			ExpiresAt: h.s.Plugin.LastRequest.At.Add(time.Second * time.Duration(resp.Lease.ValidSeconds)),
+		}
+	}
+	h.s.Plugin.Downscale = resp.Downscale
+	h.s.Plugin.RetryAfter = time.Second * time.Duration(resp.RetryAfterSeconds)
 	return nil
 }
 
@@ -1015,6 +1222,7 @@ func (h MonitorHandle) Reset() {
 		Approved:           nil,
 		DownscaleFailureAt: nil,
 		UpscaleFailureAt:   nil,
+		Degraded:           h.s.Monitor.Degraded,
 	}
 }
 
@@ -1022,16 +1230,32 @@ func (h MonitorHandle) Active(active bool) {
 	if active {
 		approved := h.s.VM.Using()
 		h.s.Monitor.Approved = &approved // TODO: this is racy
+		h.s.Monitor.Degraded = false
 	} else {
 		h.s.Monitor.Approved = nil
 	}
 }
 
-func (h MonitorHandle) UpscaleRequested(now time.Time, resources api.MoreResources) {
+// Degraded marks that the vm-monitor never connected, so we should scale the VM without it, based
+// only on its metrics.
+//
+// While degraded and without an active vm-monitor, downscaling doesn't need approval, but memory
+// is never decreased below Config.DegradedMemoryFloorFraction of the VM's maximum.
+func (h MonitorHandle) Degraded() {
+	if h.s.Monitor.active() {
+		return
+	}
+	h.s.Monitor.Degraded = true
+}
+
+// UpscaleRequested records requested upscaling from the vm-monitor. The severity may be empty, if
+// the vm-monitor didn't send one.
+func (h MonitorHandle) UpscaleRequested(now time.Time, resources api.MoreResources, severity api.UpscaleSeverity) {
 	h.s.Monitor.RequestedUpscale = &requestedUpscale{
 		At:        now,
 		Base:      *h.s.Monitor.Approved,
 		Requested: resources,
+		Severity:  severity,
 	}
 }
 
@@ -1106,6 +1330,9 @@ func (h NeonVMHandle) RequestSuccessful(now time.Time) {
 	// necessary changes.
 	// See the comments in (*State).UpdatedVM() for more info.
 	h.s.VM.SetUsing(resources)
+	// Restart the scale-down delay and scale-up stabilization window after each change, from the
+	// next metrics.
+	h.s.Cooldown = cooldownState{Downscale: nil, Upscale: nil}
 
 	h.s.NeonVM.OngoingRequested = nil
 }
@@ -103,6 +103,8 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 					AlwaysMigrate:        false,
 					ScalingEnabled:       true,
 					ScalingConfig:        nil,
+					DownscalePriority:    0,
+					MetricsSource:        "",
 				},
 			},
 			core.Config{
@@ -111,30 +113,40 @@ func Test_DesiredResourcesFromMetricsOrRequestedUpscaling(t *testing.T) {
 					LoadAverageFractionTarget: lo.ToPtr(0.5),
 					MemoryUsageFractionTarget: lo.ToPtr(0.5),
 					EnableLFCMetrics:          nil,
+					FileCache:                 nil,
+					Predictive:                nil,
+
+					ScaleDownDelaySeconds:             nil,
+					ScaleUpStabilizationWindowSeconds: nil,
 				},
 				// these don't really matter, because we're not using (*State).NextActions()
-				NeonVMRetryWait:                    time.Second,
-				PluginRequestTick:                  time.Second,
-				PluginRetryWait:                    time.Second,
-				PluginDeniedRetryWait:              time.Second,
-				MonitorDeniedDownscaleCooldown:     time.Second,
-				MonitorRequestedUpscaleValidPeriod: time.Second,
-				MonitorRetryWait:                   time.Second,
+				NeonVMRetryWait:                      time.Second,
+				PluginRequestTick:                    time.Second,
+				PluginRetryWait:                      time.Second,
+				PluginDeniedRetryWait:                time.Second,
+				PluginDeniedRetryWaitBatch:           0,
+				PluginLeaseRenewBefore:               0,
+				MonitorDeniedDownscaleCooldown:       time.Second,
+				MonitorRequestedUpscaleValidPeriod:   time.Second,
+				MonitorUpscaleComputeUnitsBySeverity: nil,
+				MonitorRetryWait:                     time.Second,
+				DegradedMemoryFloorFraction:          0,
 				Log: core.LogConfig{
 					Info: nil,
 					Warn: func(msg string, fields ...zap.Field) {
 						warnings = append(warnings, msg)
 					},
 				},
+				ObserveForecast: nil,
 			},
 		)
 
 		t.Run(c.name, func(t *testing.T) {
-			// set the metrics
-			state.UpdateSystemMetrics(c.metrics)
-
 			now := time.Now()
 
+			// set the metrics
+			state.UpdateSystemMetrics(now, c.metrics)
+
 			// set lastApproved by simulating a scheduler request/response
 			state.Plugin().StartingRequest(now, c.schedulerApproved)
 			err := state.Plugin().RequestSuccessful(now, api.PluginResponse{
@@ -182,18 +194,28 @@ var DefaultInitialStateConfig = helpers.InitialStateConfig{
 			LoadAverageFractionTarget: lo.ToPtr(0.5),
 			MemoryUsageFractionTarget: lo.ToPtr(0.5),
 			EnableLFCMetrics:          nil,
+			FileCache:                 nil,
+			Predictive:                nil,
+
+			ScaleDownDelaySeconds:             nil,
+			ScaleUpStabilizationWindowSeconds: nil,
 		},
-		NeonVMRetryWait:                    5 * time.Second,
-		PluginRequestTick:                  5 * time.Second,
-		PluginRetryWait:                    3 * time.Second,
-		PluginDeniedRetryWait:              2 * time.Second,
-		MonitorDeniedDownscaleCooldown:     5 * time.Second,
-		MonitorRequestedUpscaleValidPeriod: 10 * time.Second,
-		MonitorRetryWait:                   3 * time.Second,
+		NeonVMRetryWait:                      5 * time.Second,
+		PluginRequestTick:                    5 * time.Second,
+		PluginRetryWait:                      3 * time.Second,
+		PluginDeniedRetryWait:                2 * time.Second,
+		PluginDeniedRetryWaitBatch:           0,
+		PluginLeaseRenewBefore:               0,
+		MonitorDeniedDownscaleCooldown:       5 * time.Second,
+		MonitorRequestedUpscaleValidPeriod:   10 * time.Second,
+		MonitorUpscaleComputeUnitsBySeverity: nil,
+		MonitorRetryWait:                     3 * time.Second,
+		DegradedMemoryFloorFraction:          0,
 		Log: core.LogConfig{
 			Info: nil,
 			Warn: nil,
 		},
+		ObserveForecast: nil,
 	},
 }
 
@@ -263,7 +285,7 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 		LoadAverage1Min:  0.3,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, lastMetrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
 	// double-check that we agree about the desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -339,7 +361,7 @@ func TestBasicScaleUpAndDownFlow(t *testing.T) {
 		LoadAverage1Min:  0.0,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, lastMetrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
 	// double-check that we agree about the new desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(1))
@@ -418,7 +440,7 @@ func TestPeriodicPluginRequest(t *testing.T) {
 	}
 	resources := DefaultComputeUnit
 
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 
 	base := duration("0s")
 	clock.Elapsed().AssertEquals(base)
@@ -497,7 +519,7 @@ func TestDeniedDownscalingIncreaseAndRetry(t *testing.T) {
 		LoadAverage1Min:  0.0,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 	// double-check that we agree about the desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(1))
@@ -757,7 +779,7 @@ func TestRequestedUpscale(t *testing.T) {
 		LoadAverage1Min:  0.0,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, lastMetrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
 
 	// Check we're not supposed to do anything
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -765,7 +787,7 @@ func TestRequestedUpscale(t *testing.T) {
 	})
 
 	// Have the vm-monitor request upscaling:
-	a.Do(state.Monitor().UpscaleRequested, clock.Now(), api.MoreResources{Cpu: false, Memory: true})
+	a.Do(state.Monitor().UpscaleRequested, clock.Now(), api.MoreResources{Cpu: false, Memory: true}, api.UpscaleSeverity(""))
 	// First need to check with the scheduler plugin to get approval for upscaling:
 	a.Call(nextActions).Equals(core.ActionSet{
 		Wait: &core.ActionWait{Duration: duration("6s")}, // if nothing else happens, requested upscale expires.
@@ -1018,7 +1040,7 @@ func TestDownscalePivotBack(t *testing.T) {
 		clockTick().AssertEquals(duration("0.2s"))
 		pluginWait := duration("4.8s")
 
-		a.Do(state.UpdateSystemMetrics, initialMetrics)
+		a.Do(state.UpdateSystemMetrics, clock.Now(), initialMetrics)
 		// double-check that we agree about the desired resources
 		a.Call(getDesiredResources, state, clock.Now()).
 			Equals(resForCU(1))
@@ -1029,7 +1051,7 @@ func TestDownscalePivotBack(t *testing.T) {
 				// at the midpoint, start backtracking by setting the metrics
 				midRequest = func() {
 					t.Log(" > > updating metrics mid-request")
-					a.Do(state.UpdateSystemMetrics, newMetrics)
+					a.Do(state.UpdateSystemMetrics, clock.Now(), newMetrics)
 					a.Call(getDesiredResources, state, clock.Now()).
 						Equals(resForCU(2))
 				}
@@ -1076,7 +1098,7 @@ func TestBoundsChangeRequiresDownsale(t *testing.T) {
 		LoadAverage1Min:  0.3,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 	// Check that we agree about desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -1170,7 +1192,7 @@ func TestBoundsChangeRequiresUpscale(t *testing.T) {
 		LoadAverage1Min:  0.3,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 	// Check that we agree about desired resources
 	a.Call(getDesiredResources, state, clock.Now()).
 		Equals(resForCU(2))
@@ -1265,7 +1287,7 @@ func TestFailedRequestRetry(t *testing.T) {
 		LoadAverage1Min:  0.3,
 		MemoryUsageBytes: 0.0,
 	}
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 
 	// We should be asking the scheduler for upscaling
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1407,7 +1429,7 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 		LoadAverage1Min:  0.0,
 		MemoryUsageBytes: 150589570, // 143.6 MiB
 	}
-	a.Do(state.UpdateSystemMetrics, metrics)
+	a.Do(state.UpdateSystemMetrics, clock.Now(), metrics)
 
 	// nothing to do yet, until the existing vm-monitor request finishes
 	a.Call(nextActions).Equals(core.ActionSet{
@@ -1507,3 +1529,383 @@ func TestMetricsConcurrentUpdatedDuringDownscale(t *testing.T) {
 		Wait: &core.ActionWait{Duration: duration("4.9s")}, // plugin request tick wait
 	})
 }
+
+// Checks that in degraded mode (without a vm-monitor), we downscale CPU freely but not memory below
+// the floor, and go back to requiring approval once the vm-monitor connects.
+func TestDegradedModeDownscale(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+		helpers.WithCurrentCU(4),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.DegradedMemoryFloorFraction = 0.5
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(4))
+
+	lastMetrics := core.SystemMetrics{
+		LoadAverage1Min:  0.0,
+		MemoryUsageBytes: 0.0,
+	}
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
+	a.Call(getDesiredResources, state, clock.Now()).
+		Equals(resForCU(1))
+
+	// Without a vm-monitor, and not degraded, we can't downscale at all
+	a.WithWarnings("Wanted to send vm-monitor downscale request, but there's no active connection").
+		Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.9s")},
+	})
+
+	// Once degraded, we can downscale CPU to the minimum, but memory only to half the maximum
+	a.Do(state.Monitor().Degraded)
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.9s")},
+		NeonVMRequest: &core.ActionNeonVMRequest{
+			Current: resForCU(4),
+			Target:  api.Resources{VCPU: resForCU(1).VCPU, Mem: resForCU(2).Mem},
+		},
+	})
+
+	// If the vm-monitor connects, we're no longer degraded, and so need its approval again
+	a.Do(state.Monitor().Active, true)
+	a.Do(state.Monitor().Reset)
+	a.WithWarnings("Wanted to send vm-monitor downscale request, but there's no active connection").
+		Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("4.9s")},
+	})
+}
+
+// Checks that with predictive scaling, we scale for the forecast load once there are enough samples,
+// and that forecasts are compared against the actual metrics from the time they were made for.
+func TestPredictiveScaling(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	type observation struct {
+		predicted core.SystemMetrics
+		actual    core.SystemMetrics
+	}
+	var observed []observation
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			// Smoothing of 1 means the model follows the samples exactly, which keeps the expected
+			// values simple.
+			c.DefaultScalingConfig.Predictive = &api.PredictiveScalingConfig{
+				HorizonSeconds: 10,
+				LevelSmoothing: 1,
+				TrendSmoothing: 1,
+			}
+			c.ObserveForecast = func(predicted, actual core.SystemMetrics) {
+				observed = append(observed, observation{predicted: predicted, actual: actual})
+			}
+		}),
+	)
+
+	loadMetrics := func(load float64) core.SystemMetrics {
+		return core.SystemMetrics{LoadAverage1Min: load, MemoryUsageBytes: 0.0}
+	}
+
+	// Until there's enough samples, only the current load is used: 0.2 load => 0.4 CPU => 2 CU
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.1))
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.2))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// With the third sample, the forecast is used: 0.3 load, rising by 0.02/s => 0.5 load in 10s
+	// => 1 CPU => 4 CU. Without it, we'd only want 2 CU.
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+
+	// The scaling inputs include both the current and forecast metrics, with the goal CU from the
+	// forecast.
+	inputs := state.ScalingInputs()
+	if inputs.Metrics == nil || inputs.Metrics.LoadAverage1Min != 0.3 {
+		t.Errorf("expected scaling inputs to have load 0.3, got %+v", inputs.Metrics)
+	}
+	if inputs.PredictedMetrics == nil || inputs.PredictedMetrics.LoadAverage1Min < 0.499 || inputs.PredictedMetrics.LoadAverage1Min > 0.501 {
+		t.Errorf("expected scaling inputs to have predicted load 0.5, got %+v", inputs.PredictedMetrics)
+	}
+	if inputs.GoalCU == nil || *inputs.GoalCU != 4 {
+		t.Errorf("expected scaling inputs to have goal CU 4, got %v", inputs.GoalCU)
+	}
+
+	// Once the load stops rising, so does the forecast: 0.3 load => 0.6 CPU => 2 CU
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.3))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// The forecasts aren't compared until we get a sample for the time they were made for.
+	if len(observed) != 0 {
+		t.Fatalf("expected no observed forecasts yet, got %+v", observed)
+	}
+
+	// A falling trend never scales below the current load: 0.2 load => 0.4 CPU => 2 CU
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.2))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// The forecast made with the sample at 10s is for now, so it's been compared.
+	if len(observed) != 1 {
+		t.Fatalf("expected 1 observed forecast, got %+v", observed)
+	}
+	if predicted := observed[0].predicted.LoadAverage1Min; predicted < 0.499 || predicted > 0.501 {
+		t.Errorf("expected forecast load to be 0.5, got %v", predicted)
+	}
+	if actual := observed[0].actual.LoadAverage1Min; actual != 0.2 {
+		t.Errorf("expected actual load for forecast to be 0.2, got %v", actual)
+	}
+}
+
+// Test that with a scale-down delay and scale-up stabilization window, we only scale once the
+// metrics have called for it for long enough
+func TestScalingCooldown(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+		helpers.WithCurrentCU(2),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.DefaultScalingConfig.ScaleDownDelaySeconds = lo.ToPtr[uint](10)
+			c.DefaultScalingConfig.ScaleUpStabilizationWindowSeconds = lo.ToPtr[uint](5)
+		}),
+	)
+
+	loadMetrics := func(load float64) core.SystemMetrics {
+		return core.SystemMetrics{LoadAverage1Min: load, MemoryUsageBytes: 0.0}
+	}
+
+	// 0.1 load => 0.2 CPU => 1 CU, but we only downscale once that's been the case for 10s
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.1))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(1))
+
+	// 0.4 load => 0.8 CPU => 3 CU, but we only upscale once that's been the case for 5s. Load
+	// dipping back in between restarts the window.
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.4))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("3s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.25))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("3s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.4))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+	clock.Inc(duration("5s"))
+	a.Do(state.UpdateSystemMetrics, clock.Now(), loadMetrics(0.4))
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+}
+
+// Test that requested upscaling from the vm-monitor adds more compute units for higher severities,
+// as configured.
+func TestRequestedUpscaleSeverity(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+		helpers.WithCurrentCU(2),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.MonitorUpscaleComputeUnitsBySeverity = map[api.UpscaleSeverity]uint32{
+				api.UpscaleSeverityCritical: 2,
+			}
+		}),
+	)
+	state.Monitor().Active(true)
+
+	a.Do(state.UpdateSystemMetrics, clock.Now(), core.SystemMetrics{LoadAverage1Min: 0.3, MemoryUsageBytes: 0.0})
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(2))
+
+	// Severities without configuration add one CU:
+	a.Do(state.Monitor().UpscaleRequested, clock.Now(), api.MoreResources{Cpu: false, Memory: true}, api.UpscaleSeverityMedium)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(3))
+
+	// ... and configured ones add as many as given:
+	a.Do(state.Monitor().UpscaleRequested, clock.Now(), api.MoreResources{Cpu: false, Memory: true}, api.UpscaleSeverityCritical)
+	a.Call(getDesiredResources, state, clock.Now()).Equals(resForCU(4))
+}
+
+// Test that upscale leases from the scheduler plugin are renewed in the background, and can be used
+// to upscale without waiting for the plugin's approval.
+func TestUpscaleLease(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+		helpers.WithConfigSetting(func(c *core.Config) {
+			c.PluginLeaseRenewBefore = duration("1s")
+		}),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	state.Monitor().Active(true)
+
+	lease := &api.UpscaleLease{
+		Resources:    resForCU(1),
+		ValidSeconds: 3,
+	}
+
+	// Initial request, which gives us a lease:
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: nil,
+			Target:     resForCU(1),
+			Metrics:    nil,
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(1))
+	clock.Inc(duration("0.1s"))
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit: resForCU(1),
+		Lease:  lease,
+	})
+
+	// The lease expires 3s after the request started, so we should renew it 1s before that - well
+	// before the usual 5s between requests.
+	a.Call(nextActions).Equals(core.ActionSet{
+		Wait: &core.ActionWait{Duration: duration("1.9s")},
+	})
+	clock.Inc(duration("1.9s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(1)),
+			Target:     resForCU(1),
+			Metrics:    nil,
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(1))
+	clock.Inc(duration("0.1s"))
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit: resForCU(1),
+		Lease:  lease,
+	})
+
+	// Set metrics so that we want to upscale to 2 CU. Because that's within the lease, we can
+	// upscale at the same time as telling the plugin about it.
+	lastMetrics := core.SystemMetrics{
+		LoadAverage1Min:  0.3,
+		MemoryUsageBytes: 0.0,
+	}
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(1)),
+			Target:     resForCU(2),
+			Metrics:    lo.ToPtr(lastMetrics.ToAPI()),
+		},
+		NeonVMRequest: &core.ActionNeonVMRequest{
+			Current: resForCU(1),
+			Target:  resForCU(2),
+		},
+	})
+
+	// Once the NeonVM request has started, the lease that's in use is included in the LastPermit
+	// we'd send to the plugin.
+	a.Do(state.NeonVM().StartingRequest, clock.Now(), resForCU(2))
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(2)),
+			Target:     resForCU(2),
+			Metrics:    lo.ToPtr(lastMetrics.ToAPI()),
+		},
+	})
+
+	// ... but if the lease expired, we'd have to wait for the plugin instead.
+	a.Do(state.NeonVM().RequestFailed, clock.Now())
+	clock.Inc(duration("3s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(1)),
+			Target:     resForCU(2),
+			Metrics:    lo.ToPtr(lastMetrics.ToAPI()),
+		},
+	})
+}
+
+// Test that when the scheduler plugin defers an increase with RetryAfterSeconds, we wait at least
+// that long before requesting it again.
+func TestPluginRetryAfter(t *testing.T) {
+	a := helpers.NewAssert(t)
+	clock := helpers.NewFakeClock(t)
+	resForCU := DefaultComputeUnit.Mul
+
+	state := helpers.CreateInitialState(
+		DefaultInitialStateConfig,
+		helpers.WithStoredWarnings(a.StoredWarnings()),
+		helpers.WithTestingLogfWarnings(t),
+	)
+	nextActions := func() core.ActionSet {
+		return state.NextActions(clock.Now())
+	}
+
+	state.Monitor().Active(true)
+
+	doInitialPluginRequest(a, state, clock, duration("0.1s"), nil, resForCU(1))
+
+	// Set metrics so that we want to upscale to 2 CU
+	lastMetrics := core.SystemMetrics{
+		LoadAverage1Min:  0.3,
+		MemoryUsageBytes: 0.0,
+	}
+	a.Do(state.UpdateSystemMetrics, clock.Now(), lastMetrics)
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(1)),
+			Target:     resForCU(2),
+			Metrics:    lo.ToPtr(lastMetrics.ToAPI()),
+		},
+	})
+	a.Do(state.Plugin().StartingRequest, clock.Now(), resForCU(2))
+	clock.Inc(duration("0.1s"))
+	a.NoError(state.Plugin().RequestSuccessful, clock.Now(), api.PluginResponse{
+		Permit:            resForCU(1),
+		RetryAfterSeconds: 4,
+	})
+
+	// The usual wait after being denied is 2s, but the plugin asked us to wait 4s.
+	a.WithWarnings("Wanted to make a request to the scheduler plugin, but but previous request for more resources was denied too recently").
+		Call(nextActions).
+		Equals(core.ActionSet{
+			Wait: &core.ActionWait{Duration: duration("3.9s")},
+		})
+	clock.Inc(duration("3.9s"))
+	a.Call(nextActions).Equals(core.ActionSet{
+		PluginRequest: &core.ActionPluginRequest{
+			LastPermit: lo.ToPtr(resForCU(1)),
+			Target:     resForCU(2),
+			Metrics:    lo.ToPtr(lastMetrics.ToAPI()),
+		},
+	})
+}
@@ -22,18 +22,28 @@ import (
 
 const (
 	MinMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_0
-	MaxMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_0
+	MaxMonitorProtocolVersion api.MonitorProtoVersion = api.MonitorProtoV1_1
 )
 
+// agentMonitorCapabilities are the optional features of the agent<->monitor protocol that the
+// autoscaler-agent supports. Features are only used if the vm-monitor supports them as well.
+const agentMonitorCapabilities = api.MonitorCapUpscaleRequests |
+	api.MonitorCapFileCacheResize |
+	api.MonitorCapSwapResize |
+	api.MonitorCapCorrelationIDs |
+	api.MonitorCapFileCacheTarget |
+	api.MonitorCapUpscaleSeverity
+
 // This struct represents the result of a dispatcher.Call. Because the SignalSender
 // passed in can only be generic over one type - we have this mock enum. Only
 // one field should ever be non-nil, and it should always be clear which field
 // is readable. For example, the caller of dispatcher.call(HealthCheck { .. })
 // should only read the healthcheck field.
 type MonitorResult struct {
-	Result       *api.DownscaleResult
-	Confirmation *api.UpscaleConfirmation
-	HealthCheck  *api.HealthCheck
+	Result          *api.DownscaleResult
+	Confirmation    *api.UpscaleConfirmation
+	HealthCheck     *api.HealthCheck
+	FileCacheResult *api.FileCacheTargetResult
 }
 
 // The Dispatcher is the main object managing the websocket connection to the
@@ -50,7 +60,7 @@ type Dispatcher struct {
 
 	// lock guards mutating the waiters, exitError, and (closing) exitSignal field.
 	// conn and lastTransactionID are all thread safe.
-	// runner, exit, and protoVersion are never modified.
+	// runner, exit, protoVersion, and capabilities are never modified.
 	lock sync.Mutex
 
 	// The runner that this dispatcher is part of
@@ -70,6 +80,8 @@ type Dispatcher struct {
 	lastTransactionID atomic.Uint64
 
 	protoVersion api.MonitorProtoVersion
+	// capabilities is the set of optional protocol features supported by both us and the monitor
+	capabilities api.MonitorCapabilities
 }
 
 type waiterResult struct {
@@ -84,7 +96,7 @@ func NewDispatcher(
 	logger *zap.Logger,
 	addr string,
 	runner *Runner,
-	sendUpscaleRequested func(request api.MoreResources, withLock func()),
+	sendUpscaleRequested func(request api.MoreResources, severity api.UpscaleSeverity, withLock func()),
 ) (_finalDispatcher *Dispatcher, _ error) {
 	// Create a new root-level context for this Dispatcher so that we can cancel if need be
 	ctx, cancelRootContext := context.WithCancel(ctx)
@@ -95,8 +107,8 @@ func NewDispatcher(
 		}
 	}()
 
-	connectTimeout := time.Second * time.Duration(runner.global.config.Monitor.ConnectionTimeoutSeconds)
-	conn, protoVersion, err := connectToMonitor(ctx, logger, addr, connectTimeout)
+	connectTimeout := time.Second * time.Duration(runner.monitorConfig().ConnectionTimeoutSeconds)
+	conn, protoVersion, capabilities, err := connectToMonitor(ctx, logger, addr, connectTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +123,7 @@ func NewDispatcher(
 		exitSignal:        make(chan struct{}),
 		lastTransactionID: atomic.Uint64{}, // Note: initialized to 0, so it's even, as required.
 		protoVersion:      *protoVersion,
+		capabilities:      capabilities,
 	}
 	disp.exit = func(status websocket.StatusCode, err error, transformErr func(error) error) {
 		disp.lock.Lock()
@@ -156,14 +169,14 @@ func NewDispatcher(
 		disp.run(c, l, sendUpscaleRequested)
 	})
 	runner.spawnBackgroundWorker(ctx, logger.Named("health-checks"), "vm-monitor health checks", func(ctx context.Context, logger *zap.Logger) {
-		timeout := time.Second * time.Duration(runner.global.config.Monitor.ResponseTimeoutSeconds)
+		timeout := time.Second * time.Duration(runner.monitorConfig().ResponseTimeoutSeconds)
 		// FIXME: make this duration configurable
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 
 		// if we've had sequential failures for more than
 		var firstSequentialFailure *time.Time
-		continuedFailureAbortTimeout := time.Second * time.Duration(runner.global.config.Monitor.MaxHealthCheckSequentialFailuresSeconds)
+		continuedFailureAbortTimeout := time.Second * time.Duration(runner.monitorConfig().MaxHealthCheckSequentialFailuresSeconds)
 
 		for {
 			select {
@@ -204,7 +217,7 @@ func connectToMonitor(
 	logger *zap.Logger,
 	addr string,
 	timeout time.Duration,
-) (_ *websocket.Conn, _ *api.MonitorProtoVersion, finalErr error) {
+) (_ *websocket.Conn, _ *api.MonitorProtoVersion, _ api.MonitorCapabilities, finalErr error) {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
@@ -214,7 +227,7 @@ func connectToMonitor(
 	// Doing so causes memory bugs.
 	c, _, err := websocket.Dial(ctx, addr, nil) //nolint:bodyclose // see comment above
 	if err != nil {
-		return nil, nil, fmt.Errorf("error establishing websocket connection to %s: %w", addr, err)
+		return nil, nil, 0, fmt.Errorf("error establishing websocket connection to %s: %w", addr, err)
 	}
 
 	// If we return early, make sure we close the websocket
@@ -237,7 +250,7 @@ func connectToMonitor(
 	// Figure out protocol version
 	err = wsjson.Write(ctx, c, versionRange)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error sending protocol range to monitor: %w", err)
+		return nil, nil, 0, fmt.Errorf("error sending protocol range to monitor: %w", err)
 	}
 
 	logger.Info("Reading monitor version response")
@@ -246,18 +259,43 @@ func connectToMonitor(
 	if err != nil {
 		logger.Error("Failed to read monitor response", zap.Error(err))
 		failureReason = websocket.StatusProtocolError
-		return nil, nil, fmt.Errorf("Error reading vm-monitor response during protocol handshake: %w", err)
+		return nil, nil, 0, fmt.Errorf("Error reading vm-monitor response during protocol handshake: %w", err)
 	}
 
 	logger.Info("Got monitor version response", zap.Any("response", resp))
 	if resp.Error != nil {
 		logger.Error("Got error response from vm-monitor", zap.Any("response", resp), zap.String("error", *resp.Error))
 		failureReason = websocket.StatusProtocolError
-		return nil, nil, fmt.Errorf("Monitor returned error during protocol handshake: %q", *resp.Error)
+		return nil, nil, 0, fmt.Errorf("Monitor returned error during protocol handshake: %q", *resp.Error)
 	}
 
 	logger.Info("negotiated protocol version with monitor", zap.Any("response", resp), zap.String("version", resp.Version.String()))
-	return c, &resp.Version, nil
+
+	capabilities := api.MonitorCapabilitiesV1_0 & agentMonitorCapabilities
+	if resp.Version.SupportsCapabilityExchange() {
+		ours := api.MonitorCapabilitiesMessage{Capabilities: agentMonitorCapabilities}
+		logger.Info("Sending capabilities to monitor", zap.Strings("capabilities", ours.Capabilities.Names()))
+		if err := wsjson.Write(ctx, c, ours); err != nil {
+			return nil, nil, 0, fmt.Errorf("error sending capabilities to monitor: %w", err)
+		}
+
+		var theirs api.MonitorCapabilitiesMessage
+		if err := wsjson.Read(ctx, c, &theirs); err != nil {
+			failureReason = websocket.StatusProtocolError
+			return nil, nil, 0, fmt.Errorf("Error reading vm-monitor capabilities during protocol handshake: %w", err)
+		}
+		logger.Info("Got monitor capabilities", zap.Strings("capabilities", theirs.Capabilities.Names()))
+
+		capabilities = theirs.Capabilities & agentMonitorCapabilities
+	}
+
+	logger.Info("negotiated capabilities with monitor", zap.Strings("capabilities", capabilities.Names()))
+	return c, &resp.Version, capabilities, nil
+}
+
+// Supports returns whether both we and the monitor support the optional protocol feature
+func (disp *Dispatcher) Supports(capability api.MonitorCapabilities) bool {
+	return disp.capabilities.Has(capability)
 }
 
 // ExitSignal returns a channel that is closed when the Dispatcher is no longer running
@@ -386,11 +424,12 @@ func extractField[T any](data map[string]interface{}, key string) (*T, error) {
 }
 
 type messageHandlerFuncs struct {
-	handleUpscaleRequest      func(api.UpscaleRequest)
-	handleUpscaleConfirmation func(api.UpscaleConfirmation, uint64) error
-	handleDownscaleResult     func(api.DownscaleResult, uint64) error
-	handleMonitorError        func(api.InternalError, uint64) error
-	handleHealthCheck         func(api.HealthCheck, uint64) error
+	handleUpscaleRequest        func(api.UpscaleRequest)
+	handleUpscaleConfirmation   func(api.UpscaleConfirmation, uint64) error
+	handleDownscaleResult       func(api.DownscaleResult, uint64) error
+	handleFileCacheTargetResult func(api.FileCacheTargetResult, uint64) error
+	handleMonitorError          func(api.InternalError, uint64) error
+	handleHealthCheck           func(api.HealthCheck, uint64) error
 }
 
 // Handle messages from the monitor. Make sure that all message types the monitor
@@ -507,6 +546,12 @@ func (disp *Dispatcher) HandleMessage(
 			return err
 		}
 		return handlers.handleDownscaleResult(res, id)
+	case "FileCacheTargetResult":
+		var res api.FileCacheTargetResult
+		if err := unmarshal(&res); err != nil {
+			return err
+		}
+		return handlers.handleFileCacheTargetResult(res, id)
 	case "InternalError":
 		var monitorErr api.InternalError
 		if err := unmarshal(&monitorErr); err != nil {
@@ -538,7 +583,7 @@ func (disp *Dispatcher) HandleMessage(
 }
 
 // Long running function that orchestrates all requests/responses.
-func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequester func(_ api.MoreResources, withLock func())) {
+func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequester func(_ api.MoreResources, _ api.UpscaleSeverity, withLock func())) {
 	logger.Info("Starting message handler")
 
 	// Utility for logging + returning an error when we get a message with an
@@ -554,6 +599,12 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 	// upscale. The monitor will get the result back as a NotifyUpscale message
 	// from us, with a new id.
 	handleUpscaleRequest := func(req api.UpscaleRequest) {
+		if !disp.Supports(api.MonitorCapUpscaleRequests) {
+			logger.Warn("Ignoring UpscaleRequest from vm-monitor, because the capability was not negotiated")
+			disp.runner.global.metrics.monitorRequestsInbound.WithLabelValues("UpscaleRequest", "unsupported").Inc()
+			return
+		}
+
 		// TODO: it shouldn't be this function's responsibility to update metrics.
 		defer func() {
 			disp.runner.global.metrics.monitorRequestsInbound.WithLabelValues("UpscaleRequest", "ok").Inc()
@@ -564,8 +615,22 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			Memory: true,
 		}
 
-		upscaleRequester(resourceReq, func() {
-			logger.Info("Updating requested upscale", zap.Any("requested", resourceReq))
+		// Ignore the severity and reason if the vm-monitor isn't supposed to send them, so that a
+		// misbehaving vm-monitor can't upscale faster than it otherwise would.
+		if !disp.Supports(api.MonitorCapUpscaleSeverity) {
+			req.Severity = ""
+			req.Reason = ""
+		}
+		disp.runner.global.metrics.monitorUpscaleRequests.
+			WithLabelValues(string(req.Severity), string(req.Reason)).Inc()
+
+		upscaleRequester(resourceReq, req.Severity, func() {
+			logger.Info(
+				"Updating requested upscale",
+				zap.Any("requested", resourceReq),
+				zap.String("severity", string(req.Severity)),
+				zap.String("reason", string(req.Reason)),
+			)
 		})
 	}
 	handleUpscaleConfirmation := func(_ api.UpscaleConfirmation, id uint64) error {
@@ -578,9 +643,10 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					Confirmation: &api.UpscaleConfirmation{},
-					Result:       nil,
-					HealthCheck:  nil,
+					Confirmation:    &api.UpscaleConfirmation{},
+					Result:          nil,
+					HealthCheck:     nil,
+					FileCacheResult: nil,
 				},
 			})
 			// Don't forget to delete the waiter
@@ -600,9 +666,10 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					Result:       &res,
-					Confirmation: nil,
-					HealthCheck:  nil,
+					Result:          &res,
+					Confirmation:    nil,
+					HealthCheck:     nil,
+					FileCacheResult: nil,
 				},
 			})
 			// Don't forget to delete the waiter
@@ -612,6 +679,29 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			return handleUnkownMessage("DownscaleResult", id)
 		}
 	}
+	handleFileCacheTargetResult := func(res api.FileCacheTargetResult, id uint64) error {
+		disp.lock.Lock()
+		defer disp.lock.Unlock()
+
+		sender, ok := disp.waiters[id]
+		if ok {
+			logger.Info("vm-monitor returned file cache target result", zap.Uint64("id", id), zap.Any("result", res))
+			sender.Send(waiterResult{
+				err: nil,
+				res: &MonitorResult{
+					FileCacheResult: &res,
+					Result:          nil,
+					Confirmation:    nil,
+					HealthCheck:     nil,
+				},
+			})
+			// Don't forget to delete the waiter
+			delete(disp.waiters, id)
+			return nil
+		} else {
+			return handleUnkownMessage("FileCacheTargetResult", id)
+		}
+	}
 	handleMonitorError := func(err api.InternalError, id uint64) error {
 		disp.lock.Lock()
 		defer disp.lock.Unlock()
@@ -646,9 +736,10 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 			sender.Send(waiterResult{
 				err: nil,
 				res: &MonitorResult{
-					HealthCheck:  &api.HealthCheck{},
-					Result:       nil,
-					Confirmation: nil,
+					HealthCheck:     &api.HealthCheck{},
+					Result:          nil,
+					Confirmation:    nil,
+					FileCacheResult: nil,
 				},
 			})
 			// Don't forget to delete the waiter
@@ -660,11 +751,12 @@ func (disp *Dispatcher) run(ctx context.Context, logger *zap.Logger, upscaleRequ
 	}
 
 	handlers := messageHandlerFuncs{
-		handleUpscaleRequest:      handleUpscaleRequest,
-		handleUpscaleConfirmation: handleUpscaleConfirmation,
-		handleDownscaleResult:     handleDownscaleResult,
-		handleMonitorError:        handleMonitorError,
-		handleHealthCheck:         handleHealthCheck,
+		handleUpscaleRequest:        handleUpscaleRequest,
+		handleUpscaleConfirmation:   handleUpscaleConfirmation,
+		handleDownscaleResult:       handleDownscaleResult,
+		handleFileCacheTargetResult: handleFileCacheTargetResult,
+		handleMonitorError:          handleMonitorError,
+		handleHealthCheck:           handleHealthCheck,
 	}
 
 	for {
@@ -16,6 +16,7 @@ import (
 	"golang.org/x/exp/slices"
 
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 type StateDump struct {
@@ -45,7 +46,7 @@ func (s *agentState) StartDumpStateServer(shutdownCtx context.Context, logger *z
 			if err != nil {
 				if ctx.Err() != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
 					totalDuration := time.Since(startTime)
-					return nil, 500, fmt.Errorf("timed out after %s while getting state", totalDuration)
+					return nil, 500, errclass.Errorf(errclass.TransientInfra, "timed out after %s while getting state", totalDuration)
 				} else {
 					// some other type of cancel; 400 is a little weird, but there isn't a great
 					// option here.
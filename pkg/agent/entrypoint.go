@@ -13,6 +13,7 @@ import (
 	"github.com/neondatabase/autoscaling/pkg/agent/billing"
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/dumpstore"
 	"github.com/neondatabase/autoscaling/pkg/util/taskgroup"
 	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
@@ -45,13 +46,17 @@ func (r MainRunner) Run(logger *zap.Logger, ctx context.Context) error {
 	defer vmWatchStore.Stop()
 	logger.Info("VM watcher started")
 
-	schedTracker, err := schedwatch.StartSchedulerWatcher(ctx, logger, r.KubeClient, watchMetrics, r.Config.Scheduler.SchedulerName)
+	var schedLeaseName string
+	if r.Config.Scheduler.Failover != nil {
+		schedLeaseName = r.Config.Scheduler.Failover.LeaseName
+	}
+	schedTracker, err := schedwatch.StartSchedulerWatcher(ctx, logger, r.KubeClient, watchMetrics, r.Config.Scheduler.SchedulerName, schedLeaseName)
 	if err != nil {
 		return fmt.Errorf("Starting scheduler watch server: %w", err)
 	}
 	defer schedTracker.Stop()
 
-	globalState, globalPromReg := r.newAgentState(logger, r.EnvArgs.K8sPodIP, schedTracker)
+	globalState, globalPromReg := r.newAgentState(logger, r.EnvArgs.K8sPodIP, schedTracker, perVMMetrics)
 	watchMetrics.MustRegister(globalPromReg)
 
 	logger.Info("Starting billing metrics collector")
@@ -75,6 +80,37 @@ func (r MainRunner) Run(logger *zap.Logger, ctx context.Context) error {
 		}
 	}
 
+	if r.Config.Resync != nil {
+		logger.Info("Starting resync server")
+		if err := globalState.StartResyncServer(ctx, logger.Named("resync"), r.Config.Resync); err != nil {
+			return fmt.Errorf("Error starting resync server: %w", err)
+		}
+	}
+
+	if r.Config.ScalingJournal != nil {
+		logger.Info("Starting scaling journal server")
+		if err := globalState.StartScalingJournalServer(ctx, logger.Named("scaling-journal"), r.Config.ScalingJournal); err != nil {
+			return fmt.Errorf("Error starting scaling journal server: %w", err)
+		}
+	}
+
+	if globalState.pushedMetrics != nil {
+		logger.Info("Starting metrics push server")
+		if err := globalState.StartMetricsPushServer(ctx, logger.Named("metrics-push")); err != nil {
+			return fmt.Errorf("Error starting metrics push server: %w", err)
+		}
+	}
+
+	if r.Config.DumpStateUpload != nil {
+		logger.Info("Starting 'dump state' uploader")
+		dump := func(ctx context.Context) (*StateDump, error) {
+			return globalState.DumpState(ctx, false)
+		}
+		if err := dumpstore.Start(ctx, logger.Named("dump-state-upload"), *r.Config.DumpStateUpload, "autoscaler-agent", dump); err != nil {
+			return fmt.Errorf("Error starting dump state uploader: %w", err)
+		}
+	}
+
 	mc, err := billing.NewMetricsCollector(ctx, logger, &r.Config.Billing)
 	if err != nil {
 		return fmt.Errorf("error creating billing metrics collector: %w", err)
@@ -0,0 +1,153 @@
+package agent
+
+// Kubernetes Events for scaling decisions
+//
+// So that 'kubectl describe vm' shows why a VM is (or isn't) at a given size, we emit an Event on
+// the VirtualMachine object for each step of a scaling decision: when we request resources from the
+// scheduler plugin, when it approves or denies them, when the change is applied through NeonVM, and
+// when the vm-monitor denies a downscale.
+//
+// Events are rate limited per VM and reason, so that a VM that's repeatedly denied doesn't flood
+// the API server. Events that are rate limited are dropped, not delayed.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// Reasons for the scaling Events that we emit
+const (
+	eventReasonScaleRequested  = "ScaleRequested"
+	eventReasonScaleApproved   = "ScaleApproved"
+	eventReasonScaleDenied     = "ScaleDenied"
+	eventReasonScaleApplied    = "ScaleApplied"
+	eventReasonScaleFailed     = "ScaleFailed"
+	eventReasonDownscaleDenied = "DownscaleDenied"
+)
+
+// scalingEventRecorder emits rate limited Events about scaling decisions
+type scalingEventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	minInterval time.Duration
+
+	mu       sync.Mutex
+	lastSent map[scalingEventKey]time.Time
+}
+
+type scalingEventKey struct {
+	vmName util.NamespacedName
+	reason string
+}
+
+func newScalingEventRecorder(
+	logger *zap.Logger,
+	kubeClient *kubernetes.Clientset,
+	nodeName string,
+	config *ScalingEventsConfig,
+) *scalingEventRecorder {
+	if config == nil {
+		return nil
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	broadcaster.StartLogging(func(format string, args ...any) {
+		logger.Debug(fmt.Sprintf(format, args...))
+	})
+	source := corev1.EventSource{Component: "autoscaler-agent", Host: nodeName}
+
+	return &scalingEventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, source),
+		minInterval: time.Second * time.Duration(config.MinIntervalSeconds),
+		mu:          sync.Mutex{},
+		lastSent:    make(map[scalingEventKey]time.Time),
+	}
+}
+
+// record emits an Event on the VM, unless there was already an Event with the same reason for the
+// VM within the minimum interval.
+//
+// The recorder may be nil, in which case nothing is emitted.
+func (r *scalingEventRecorder) record(
+	vmName util.NamespacedName,
+	vmUID types.UID,
+	eventType string,
+	reason string,
+	messageFmt string,
+	args ...any,
+) {
+	if r == nil {
+		return
+	}
+
+	key := scalingEventKey{vmName: vmName, reason: reason}
+	now := time.Now()
+	if !func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if last, ok := r.lastSent[key]; ok && now.Sub(last) < r.minInterval {
+			return false
+		}
+		r.lastSent[key] = now
+		return true
+	}() {
+		return
+	}
+
+	ref := &corev1.ObjectReference{
+		Kind:       "VirtualMachine",
+		APIVersion: vmapi.SchemeGroupVersion.String(),
+		Namespace:  vmName.Namespace,
+		Name:       vmName.Name,
+		UID:        vmUID,
+	}
+	r.recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// forget removes the rate limiting state for the VM, once it's no longer on this node
+func (r *scalingEventRecorder) forget(vmName util.NamespacedName) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.lastSent {
+		if key.vmName == vmName {
+			delete(r.lastSent, key)
+		}
+	}
+}
+
+func (r *scalingEventRecorder) shutdown() {
+	if r != nil {
+		r.broadcaster.Shutdown()
+	}
+}
+
+// formatResources formats the resources for the message of an Event
+func formatResources(r api.Resources) string {
+	return fmt.Sprintf("%v vCPU, %v memory", r.VCPU, r.Mem)
+}
+
+// recordScalingEvent emits a rate limited Event on the Runner's VM, if scaling Events are enabled
+func (r *Runner) recordScalingEvent(eventType, reason, messageFmt string, args ...any) {
+	r.global.scalingEvents.record(r.vmName, r.vmUID, eventType, reason, messageFmt, args...)
+}
@@ -8,9 +8,12 @@ package agent
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"go.uber.org/zap"
 
+	corev1 "k8s.io/api/core/v1"
+
 	"github.com/neondatabase/autoscaling/pkg/agent/executor"
 	"github.com/neondatabase/autoscaling/pkg/api"
 )
@@ -44,8 +47,27 @@ func (iface *execPluginInterface) Request(
 	if lastPermit != nil {
 		iface.runner.recordResourceChange(*lastPermit, target, iface.runner.global.metrics.schedulerRequestedChange)
 	}
+	// Requests are also made periodically without any change, which aren't worth an Event.
+	changing := lastPermit == nil || *lastPermit != target
+	if changing {
+		iface.runner.recordScalingEvent(
+			corev1.EventTypeNormal, eventReasonScaleRequested,
+			"Requested %s from the scheduler", formatResources(target),
+		)
+	}
 
+	start := time.Now()
 	resp, err := iface.runner.DoSchedulerRequest(ctx, logger, target, lastPermit, metrics)
+	iface.runner.observeRequestDuration(ctx, "scheduler", start)
+	iface.runner.recordJournalStep(ctx, ScalingJournalStep{
+		Time:           start,
+		Kind:           journalStepPlugin,
+		Current:        lastPermit,
+		Target:         target,
+		PluginResponse: resp,
+		MonitorResult:  nil,
+		Error:          journalError(err),
+	})
 
 	if err == nil && lastPermit != nil {
 		iface.runner.recordResourceChange(*lastPermit, resp.Permit, iface.runner.global.metrics.schedulerApprovedChange)
@@ -63,10 +85,25 @@ func (iface *execPluginInterface) Request(
 		}
 		return false // scheduler denied the request
 	}()
+	if err == nil && resp.Permit != target {
+		iface.runner.recordScalingEvent(
+			corev1.EventTypeWarning, eventReasonScaleDenied,
+			"Scheduler approved %s, instead of the requested %s", formatResources(resp.Permit), formatResources(target),
+		)
+	} else if err == nil && changing {
+		iface.runner.recordScalingEvent(
+			corev1.EventTypeNormal, eventReasonScaleApproved,
+			"Scheduler approved %s", formatResources(target),
+		)
+	}
 	iface.runner.status.update(iface.runner.global, func(ps podStatus) podStatus {
 		if !successful {
 			ps.failedSchedulerRequestCounter.Inc()
 		}
+		if err == nil {
+			permit := resp.Permit
+			ps.approved = &permit
+		}
 		return ps
 	})
 
@@ -88,16 +125,39 @@ func makeNeonVMInterface(r *Runner) *execNeonVMInterface {
 // Request implements executor.NeonVMInterface
 func (iface *execNeonVMInterface) Request(ctx context.Context, logger *zap.Logger, current, target api.Resources) error {
 	iface.runner.recordResourceChange(current, target, iface.runner.global.metrics.neonvmRequestedChange)
+	iface.runner.recordResourceChange(
+		current, target,
+		iface.runner.global.metrics.scalingVariantRequestedChange.forVariant(iface.runner.scalingVariant),
+	)
 
+	start := time.Now()
 	err := iface.runner.doNeonVMRequest(ctx, target)
+	iface.runner.observeRequestDuration(ctx, "neonvm", start)
+	iface.runner.recordJournalStep(ctx, ScalingJournalStep{
+		Time:           start,
+		Kind:           journalStepNeonVM,
+		Current:        &current,
+		Target:         target,
+		PluginResponse: nil,
+		MonitorResult:  nil,
+		Error:          journalError(err),
+	})
 	if err != nil {
 		iface.runner.status.update(iface.runner.global, func(ps podStatus) podStatus {
 			ps.failedNeonVMRequestCounter.Inc()
 			return ps
 		})
+		iface.runner.recordScalingEvent(
+			corev1.EventTypeWarning, eventReasonScaleFailed,
+			"Failed to change from %s to %s: %s", formatResources(current), formatResources(target), err,
+		)
 		return fmt.Errorf("Error making VM patch request: %w", err)
 	}
 
+	iface.runner.recordScalingEvent(
+		corev1.EventTypeNormal, eventReasonScaleApplied,
+		"Changed from %s to %s", formatResources(current), formatResources(target),
+	)
 	return nil
 }
 
@@ -167,11 +227,27 @@ func (h *execMonitorHandle) Downscale(
 
 	h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorRequestedChange)
 
+	start := time.Now()
 	result, err := doMonitorDownscale(ctx, logger, h.monitor.dispatcher, target)
+	h.runner.observeRequestDuration(ctx, "monitor", start)
+	h.runner.recordJournalStep(ctx, ScalingJournalStep{
+		Time:           start,
+		Kind:           journalStepMonitorDownscale,
+		Current:        &current,
+		Target:         target,
+		PluginResponse: nil,
+		MonitorResult:  result,
+		Error:          journalError(err),
+	})
 
 	if err == nil {
 		if result.Ok {
 			h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorApprovedChange)
+		} else {
+			h.runner.recordScalingEvent(
+				corev1.EventTypeWarning, eventReasonDownscaleDenied,
+				"vm-monitor denied downscale to %s: %s", formatResources(target), result.Status,
+			)
 		}
 	} else {
 		h.runner.status.update(h.runner.global, func(ps podStatus) podStatus {
@@ -192,7 +268,18 @@ func (h *execMonitorHandle) Upscale(ctx context.Context, logger *zap.Logger, cur
 
 	h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorRequestedChange)
 
+	start := time.Now()
 	err := doMonitorUpscale(ctx, logger, h.monitor.dispatcher, target)
+	h.runner.observeRequestDuration(ctx, "monitor", start)
+	h.runner.recordJournalStep(ctx, ScalingJournalStep{
+		Time:           start,
+		Kind:           journalStepMonitorUpscale,
+		Current:        &current,
+		Target:         target,
+		PluginResponse: nil,
+		MonitorResult:  nil,
+		Error:          journalError(err),
+	})
 
 	if err == nil {
 		h.runner.recordResourceChange(current, target, h.runner.global.metrics.monitorApprovedChange)
@@ -10,6 +10,11 @@ package executor
 // is held. In general, this is used for logging, so that the log output strictly matches the
 // ordering of the changes to the underlying core.State, which should help with debugging.
 //
+// Each scaling attempt is assigned a correlation ID, which is kept from the first action that
+// changes resources until there's nothing left to do and no requests are in flight. The executors
+// add it to their loggers and to the context passed to the clients, so that it's propagated to the
+// scheduler plugin, vm-monitor, and NeonVM controller.
+//
 // For more, see pkg/agent/ARCHITECTURE.md.
 
 import (
@@ -30,6 +35,17 @@ type Config struct {
 	// In practice, this value is set to a callback that increments a metric.
 	OnNextActions func()
 
+	// OnScalingStarted, if not nil, is called when a new scaling transaction starts, with the
+	// inputs to the scaling decision and the actions that started it.
+	//
+	// It's called while holding the ExecutorCore's lock, so it MUST NOT block.
+	OnScalingStarted func(correlationID string, inputs core.ScalingInputs, actions core.ActionSet)
+	// OnScalingFinished, if not nil, is called when the scaling transaction with the correlation ID
+	// finishes.
+	//
+	// It's called while holding the ExecutorCore's lock, so it MUST NOT block.
+	OnScalingFinished func(correlationID string)
+
 	Core core.Config
 }
 
@@ -44,6 +60,15 @@ type ExecutorCore struct {
 	lastActionsID timedActionsID
 	onNextActions func()
 
+	onScalingStarted  func(correlationID string, inputs core.ScalingInputs, actions core.ActionSet)
+	onScalingFinished func(correlationID string)
+
+	// correlationID is the ID of the current scaling transaction, or "" if there isn't one.
+	correlationID string
+	// requestsInFlight is the number of requests started by the executors that haven't yet
+	// completed. The current scaling transaction isn't finished until this is zero.
+	requestsInFlight int
+
 	updates *util.Broadcaster
 }
 
@@ -61,7 +86,14 @@ func NewExecutorCore(stateLogger *zap.Logger, vm api.VmInfo, config Config) *Exe
 		actions:       nil, // (*ExecutorCore).getActions() checks if this is nil
 		lastActionsID: -1,
 		onNextActions: config.OnNextActions,
-		updates:       util.NewBroadcaster(),
+
+		onScalingStarted:  config.OnScalingStarted,
+		onScalingFinished: config.OnScalingFinished,
+
+		correlationID:    "",
+		requestsInFlight: 0,
+
+		updates: util.NewBroadcaster(),
 	}
 }
 
@@ -88,6 +120,9 @@ type timedActions struct {
 	// id is exclusively used by (*ExecutorCore).updateIfActionsUnchanged().
 	id      timedActionsID
 	actions core.ActionSet
+	// correlationID is the ID of the scaling transaction that the actions are part of, or "" if
+	// they aren't part of one.
+	correlationID string
 }
 
 type timedActionsID int64
@@ -104,7 +139,9 @@ func (c *ExecutorCore) getActions() timedActions {
 		// NOTE: Even though we cache the actions generated using time.Now(), it's *generally* ok.
 		now := time.Now()
 		c.stateLogger.Debug("Recalculating ActionSet", zap.Time("now", now), zap.Any("state", c.core.Dump()))
-		c.actions = &timedActions{id: id, actions: c.core.NextActions(now)}
+		actions := c.core.NextActions(now)
+		c.updateCorrelationID(actions)
+		c.actions = &timedActions{id: id, actions: actions, correlationID: c.correlationID}
 		c.lastActionsID = id
 		c.stateLogger.Debug("New ActionSet", zap.Time("now", now), zap.Any("actions", c.actions.actions))
 	}
@@ -112,6 +149,58 @@ func (c *ExecutorCore) getActions() timedActions {
 	return *c.actions
 }
 
+// updateCorrelationID starts a new scaling transaction if the actions change resources and there
+// isn't one already, or finishes the current one if there's nothing left to do.
+//
+// This method MUST be called while holding c.mu.
+func (c *ExecutorCore) updateCorrelationID(actions core.ActionSet) {
+	if isScaling(actions) {
+		if c.correlationID == "" {
+			c.correlationID = util.NewCorrelationID()
+			c.stateLogger.Info("Starting scaling transaction", zap.String(util.CorrelationIDLogKey, c.correlationID))
+			if c.onScalingStarted != nil {
+				c.onScalingStarted(c.correlationID, c.core.ScalingInputs(), actions)
+			}
+		}
+	} else if c.correlationID != "" && c.requestsInFlight == 0 {
+		c.stateLogger.Info("Finished scaling transaction", zap.String(util.CorrelationIDLogKey, c.correlationID))
+		if c.onScalingFinished != nil {
+			c.onScalingFinished(c.correlationID)
+		}
+		c.correlationID = ""
+	}
+}
+
+// isScaling returns whether the actions are part of changing the VM's resources
+func isScaling(actions core.ActionSet) bool {
+	// Plugin requests are made periodically even when the VM isn't scaling, so only count them if
+	// they request a change from the last permit.
+	pluginScaling := actions.PluginRequest != nil &&
+		actions.PluginRequest.LastPermit != nil &&
+		*actions.PluginRequest.LastPermit != actions.PluginRequest.Target
+
+	return pluginScaling ||
+		actions.NeonVMRequest != nil ||
+		actions.MonitorDownscale != nil ||
+		actions.MonitorUpscale != nil
+}
+
+// startingRequest records that an executor is starting a request, so that the current scaling
+// transaction isn't finished until it's done.
+//
+// This method MUST be called while holding c.mu - typically in the callback to
+// updateIfActionsUnchanged.
+func (c *ExecutorCore) startingRequest() {
+	c.requestsInFlight += 1
+}
+
+// requestDone records that a request previously passed to startingRequest has completed.
+//
+// This method MUST be called while holding c.mu - typically in the callback to update.
+func (c *ExecutorCore) requestDone() {
+	c.requestsInFlight -= 1
+}
+
 func (c *ExecutorCore) update(with func(*core.State)) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -164,7 +253,7 @@ type ExecutorCoreUpdater struct {
 // withLock while holding the lock.
 func (c ExecutorCoreUpdater) UpdateSystemMetrics(metrics core.SystemMetrics, withLock func()) {
 	c.core.update(func(state *core.State) {
-		state.UpdateSystemMetrics(metrics)
+		state.UpdateSystemMetrics(time.Now(), metrics)
 		withLock()
 	})
 }
@@ -198,9 +287,9 @@ func (c ExecutorCoreUpdater) ResetMonitor(withLock func()) {
 
 // UpscaleRequested calls (*core.State).Monitor().UpscaleRequested(...) on the inner core.State and
 // runs withLock while holding the lock.
-func (c ExecutorCoreUpdater) UpscaleRequested(resources api.MoreResources, withLock func()) {
+func (c ExecutorCoreUpdater) UpscaleRequested(resources api.MoreResources, severity api.UpscaleSeverity, withLock func()) {
 	c.core.update(func(state *core.State) {
-		state.Monitor().UpscaleRequested(time.Now(), resources)
+		state.Monitor().UpscaleRequested(time.Now(), resources, severity)
 		withLock()
 	})
 }
@@ -213,3 +302,12 @@ func (c ExecutorCoreUpdater) MonitorActive(active bool, withLock func()) {
 		withLock()
 	})
 }
+
+// MonitorDegraded calls (*core.State).Monitor().Degraded() on the inner core.State and runs
+// withLock while holding the lock.
+func (c ExecutorCoreUpdater) MonitorDegraded(withLock func()) {
+	c.core.update(func(state *core.State) {
+		state.Monitor().Degraded()
+		withLock()
+	})
+}
@@ -53,10 +53,14 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 		var startTime time.Time
 		var monitorIface MonitorHandle
 		action := *last.actions.MonitorDownscale
+		reqCtx := util.WithCorrelationID(ctx, last.correlationID)
+		reqLogger := util.LoggerWithCorrelationID(logger, last.correlationID)
+		reqIfaceLogger := util.LoggerWithCorrelationID(ifaceLogger, last.correlationID)
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
-			logger.Info("Starting vm-monitor downscale request", zap.Object("action", action))
+			reqLogger.Info("Starting vm-monitor downscale request", zap.Object("action", action))
 			startTime = time.Now()
+			c.startingRequest()
 			monitorIface = c.clients.Monitor.GetHandle()
 			state.Monitor().StartingDownscaleRequest(startTime, action.Target)
 
@@ -69,10 +73,11 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 			continue // state has changed, retry.
 		}
 
-		result, err := monitorIface.Downscale(ctx, ifaceLogger, action.Current, action.Target)
+		result, err := monitorIface.Downscale(reqCtx, reqIfaceLogger, action.Current, action.Target)
 		endTime := time.Now()
 
 		c.update(func(state *core.State) {
+			c.requestDone()
 			unchanged := generationUnchanged(monitorIface)
 			logFields := []zap.Field{
 				zap.Object("action", action),
@@ -81,11 +86,11 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 			}
 
 			warnSkipBecauseChanged := func() {
-				logger.Warn("Skipping state update after vm-monitor downscale request because MonitorHandle changed")
+				reqLogger.Warn("Skipping state update after vm-monitor downscale request because MonitorHandle changed")
 			}
 
 			if err != nil {
-				logger.Error("vm-monitor downscale request failed", append(logFields, zap.Error(err))...)
+				reqLogger.Error("vm-monitor downscale request failed", append(logFields, zap.Error(err))...)
 				if unchanged {
 					state.Monitor().DownscaleRequestFailed(endTime)
 				} else {
@@ -97,14 +102,14 @@ func (c *ExecutorCoreWithClients) DoMonitorDownscales(ctx context.Context, logge
 			logFields = append(logFields, zap.Any("response", result))
 
 			if !result.Ok {
-				logger.Warn("vm-monitor denied downscale", logFields...)
+				reqLogger.Warn("vm-monitor denied downscale", logFields...)
 				if unchanged {
 					state.Monitor().DownscaleRequestDenied(endTime)
 				} else {
 					warnSkipBecauseChanged()
 				}
 			} else {
-				logger.Info("vm-monitor approved downscale", logFields...)
+				reqLogger.Info("vm-monitor approved downscale", logFields...)
 				if unchanged {
 					state.Monitor().DownscaleRequestAllowed(endTime)
 				} else {
@@ -143,10 +148,14 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 		var startTime time.Time
 		var monitorIface MonitorHandle
 		action := *last.actions.MonitorUpscale
+		reqCtx := util.WithCorrelationID(ctx, last.correlationID)
+		reqLogger := util.LoggerWithCorrelationID(logger, last.correlationID)
+		reqIfaceLogger := util.LoggerWithCorrelationID(ifaceLogger, last.correlationID)
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
-			logger.Info("Starting vm-monitor upscale request", zap.Object("action", action))
+			reqLogger.Info("Starting vm-monitor upscale request", zap.Object("action", action))
 			startTime = time.Now()
+			c.startingRequest()
 			monitorIface = c.clients.Monitor.GetHandle()
 			state.Monitor().StartingUpscaleRequest(startTime, action.Target)
 
@@ -159,10 +168,11 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 			continue // state has changed, retry.
 		}
 
-		err := monitorIface.Upscale(ctx, ifaceLogger, action.Current, action.Target)
+		err := monitorIface.Upscale(reqCtx, reqIfaceLogger, action.Current, action.Target)
 		endTime := time.Now()
 
 		c.update(func(state *core.State) {
+			c.requestDone()
 			unchanged := generationUnchanged(monitorIface)
 			logFields := []zap.Field{
 				zap.Object("action", action),
@@ -171,11 +181,11 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 			}
 
 			warnSkipBecauseChanged := func() {
-				logger.Warn("Skipping state update after vm-monitor upscale request because MonitorHandle changed")
+				reqLogger.Warn("Skipping state update after vm-monitor upscale request because MonitorHandle changed")
 			}
 
 			if err != nil {
-				logger.Error("vm-monitor upscale request failed", append(logFields, zap.Error(err))...)
+				reqLogger.Error("vm-monitor upscale request failed", append(logFields, zap.Error(err))...)
 				if unchanged {
 					state.Monitor().UpscaleRequestFailed(endTime)
 				} else {
@@ -184,7 +194,7 @@ func (c *ExecutorCoreWithClients) DoMonitorUpscales(ctx context.Context, logger
 				return
 			}
 
-			logger.Info("vm-monitor upscale request successful", logFields...)
+			reqLogger.Info("vm-monitor upscale request successful", logFields...)
 			if unchanged {
 				state.Monitor().UpscaleRequestSuccessful(endTime)
 			} else {
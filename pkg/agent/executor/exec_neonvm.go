@@ -37,25 +37,30 @@ func (c *ExecutorCoreWithClients) DoNeonVMRequests(ctx context.Context, logger *
 
 		var startTime time.Time
 		action := *last.actions.NeonVMRequest
+		reqCtx := util.WithCorrelationID(ctx, last.correlationID)
+		reqLogger := util.LoggerWithCorrelationID(logger, last.correlationID)
+		reqIfaceLogger := util.LoggerWithCorrelationID(ifaceLogger, last.correlationID)
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
-			logger.Info("Starting NeonVM request", zap.Object("action", action))
+			reqLogger.Info("Starting NeonVM request", zap.Object("action", action))
 			startTime = time.Now()
+			c.startingRequest()
 			state.NeonVM().StartingRequest(startTime, action.Target)
 		}); !updated {
 			continue // state has changed, retry.
 		}
 
-		err := c.clients.NeonVM.Request(ctx, ifaceLogger, action.Current, action.Target)
+		err := c.clients.NeonVM.Request(reqCtx, reqIfaceLogger, action.Current, action.Target)
 		endTime := time.Now()
 		logFields := []zap.Field{zap.Object("action", action), zap.Duration("duration", endTime.Sub(startTime))}
 
 		c.update(func(state *core.State) {
+			c.requestDone()
 			if err != nil {
-				logger.Error("NeonVM request failed", append(logFields, zap.Error(err))...)
+				reqLogger.Error("NeonVM request failed", append(logFields, zap.Error(err))...)
 				state.NeonVM().RequestFailed(endTime)
 			} else /* err == nil */ {
-				logger.Info("NeonVM request successful", logFields...)
+				reqLogger.Info("NeonVM request successful", logFields...)
 				state.NeonVM().RequestSuccessful(endTime)
 			}
 		})
@@ -37,32 +37,37 @@ func (c *ExecutorCoreWithClients) DoPluginRequests(ctx context.Context, logger *
 
 		var startTime time.Time
 		action := *last.actions.PluginRequest
+		reqCtx := util.WithCorrelationID(ctx, last.correlationID)
+		reqLogger := util.LoggerWithCorrelationID(logger, last.correlationID)
+		reqIfaceLogger := util.LoggerWithCorrelationID(ifaceLogger, last.correlationID)
 
 		if updated := c.updateIfActionsUnchanged(last, func(state *core.State) {
-			logger.Info("Starting plugin request", zap.Object("action", action))
+			reqLogger.Info("Starting plugin request", zap.Object("action", action))
 			startTime = time.Now()
+			c.startingRequest()
 			state.Plugin().StartingRequest(startTime, action.Target)
 		}); !updated {
 			continue // state has changed, retry.
 		}
 
-		resp, err := c.clients.Plugin.Request(ctx, ifaceLogger, action.LastPermit, action.Target, action.Metrics)
+		resp, err := c.clients.Plugin.Request(reqCtx, reqIfaceLogger, action.LastPermit, action.Target, action.Metrics)
 		endTime := time.Now()
 
 		c.update(func(state *core.State) {
+			c.requestDone()
 			logFields := []zap.Field{
 				zap.Object("action", action),
 				zap.Duration("duration", endTime.Sub(startTime)),
 			}
 
 			if err != nil {
-				logger.Error("Plugin request failed", append(logFields, zap.Error(err))...)
+				reqLogger.Error("Plugin request failed", append(logFields, zap.Error(err))...)
 				state.Plugin().RequestFailed(endTime)
 			} else {
 				logFields = append(logFields, zap.Any("response", resp))
-				logger.Info("Plugin request successful", logFields...)
+				reqLogger.Info("Plugin request successful", logFields...)
 				if err := state.Plugin().RequestSuccessful(endTime, *resp); err != nil {
-					logger.Error("Plugin response validation failed", append(logFields, zap.Error(err))...)
+					reqLogger.Error("Plugin response validation failed", append(logFields, zap.Error(err))...)
 				}
 			}
 		})
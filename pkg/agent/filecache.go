@@ -0,0 +1,243 @@
+package agent
+
+// Dynamic sizing of the Postgres Local File Cache (LFC)
+//
+// By default, the vm-monitor sizes the LFC as a fixed fraction of the VM's memory. When the VM's
+// scaling config sets .fileCache (see api.FileCacheConfig), we instead choose the size based on the
+// LFC's hit rate and estimated working set - both from the LFC metrics - and send it to the
+// vm-monitor with a FileCacheTarget message.
+//
+// A new target is calculated each time we get new LFC metrics. It's only sent to the vm-monitor if
+// it differs from the last one by at least fileCacheMinChangeFraction of the VM's memory, so that
+// small fluctuations in the inputs don't cause constant resizing. The target is always re-sent
+// after reconnecting to the vm-monitor, or when the VM's memory changes.
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/agent/executor"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const (
+	// lfcPageSize is the size of the pages that the LFC's working set size is measured in.
+	lfcPageSize = 8192
+	// fileCacheHitRateStep is the fraction of the VM's memory that the LFC is grown or shrunk by on
+	// each new set of metrics, with api.FileCachePolicyHitRate.
+	fileCacheHitRateStep = 0.05
+	// fileCacheMinChangeFraction is the minimum change in the target size, as a fraction of the
+	// VM's memory, for a new target to be sent to the vm-monitor.
+	fileCacheMinChangeFraction = 0.02
+)
+
+// fileCacheInputs are the values that the target size of the LFC is calculated from
+type fileCacheInputs struct {
+	// hitRate is the fraction of LFC reads that were hits since the previous metrics, or nil if
+	// that's not known (e.g., there were no reads).
+	hitRate         *float64
+	workingSetBytes float64
+	memoryBytes     float64
+}
+
+// fileCacheTarget returns the target size of the LFC in bytes, given the previous target (which is
+// zero if there wasn't one).
+//
+// It returns zero if the size of the LFC shouldn't be set by the autoscaler-agent, i.e. with
+// api.FileCachePolicyFixedFraction.
+func fileCacheTarget(config api.FileCacheConfig, inputs fileCacheInputs, previous uint64) uint64 {
+	mem := inputs.memoryBytes
+	workingSetTarget := inputs.workingSetBytes * config.WorkingSetHeadroom
+
+	var target float64
+	switch config.Policy {
+	case api.FileCachePolicyWorkingSet:
+		target = workingSetTarget
+	case api.FileCachePolicyHitRate:
+		prev := float64(previous)
+		if previous == 0 {
+			prev = workingSetTarget
+		}
+
+		if inputs.hitRate == nil {
+			target = prev
+		} else if *inputs.hitRate < config.TargetHitRate {
+			target = prev + fileCacheHitRateStep*mem
+		} else {
+			// The hit rate is good enough - gradually shrink towards the working set, but don't
+			// grow to reach it.
+			target = min(prev, max(workingSetTarget, prev-fileCacheHitRateStep*mem))
+		}
+	default:
+		return 0
+	}
+
+	target = max(config.MinMemoryFraction*mem, min(config.MaxMemoryFraction*mem, target))
+	return uint64(target)
+}
+
+// fileCacheSizer tracks the target size of the LFC for a single VM, and whether it's been sent to
+// the vm-monitor.
+type fileCacheSizer struct {
+	mu sync.Mutex
+
+	lastMetrics *core.LFCMetrics
+	// target is the current target size, or zero if there isn't one
+	target uint64
+	// memory is the VM's memory at the time target was calculated
+	memory api.Bytes
+
+	// sent is the last target that was successfully sent to the vm-monitor, and sentTo is the
+	// generation of the vm-monitor connection it was sent on. sent is zero if nothing has been sent
+	// on the current connection.
+	sent   uint64
+	sentTo executor.GenerationNumber
+
+	updated util.CondChannelSender
+}
+
+// update calculates a new target from the LFC metrics, recording the decision inputs in the
+// metrics, and notifies sendFileCacheTargets if there's a target.
+func (s *fileCacheSizer) update(r *Runner, logger *zap.Logger, vm api.VmInfo, metrics core.LFCMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	memory := vm.Using().Mem
+	inputs := fileCacheInputs{
+		hitRate:         nil,
+		workingSetBytes: metrics.ApproximateWorkingSetSizeTotal * lfcPageSize,
+		memoryBytes:     float64(memory),
+	}
+	if s.lastMetrics != nil {
+		hits := metrics.CacheHitsTotal - s.lastMetrics.CacheHitsTotal
+		misses := metrics.CacheMissesTotal - s.lastMetrics.CacheMissesTotal
+		// If the counters went backwards, postgres restarted, so we don't know the hit rate.
+		if hits >= 0 && misses >= 0 && hits+misses > 0 {
+			inputs.hitRate = lo.ToPtr(hits / (hits + misses))
+		}
+	}
+	s.lastMetrics = &metrics
+
+	if inputs.hitRate != nil {
+		r.global.metrics.lfcHitRate.Observe(*inputs.hitRate)
+	}
+	if inputs.memoryBytes != 0 {
+		r.global.metrics.lfcWorkingSetFraction.Observe(inputs.workingSetBytes / inputs.memoryBytes)
+	}
+
+	config := r.global.config.Scaling.DefaultConfig.WithOverrides(vm.Config.ScalingConfig)
+	if config.FileCache == nil || inputs.memoryBytes == 0 {
+		s.target = 0
+		return
+	}
+
+	previous := s.target
+	if memory != s.memory {
+		previous = 0 // base the decision only on the current inputs if memory changed.
+	}
+	target := fileCacheTarget(*config.FileCache, inputs, previous)
+	if target == 0 {
+		s.target = 0
+		return
+	}
+
+	policy := string(config.FileCache.Policy)
+	r.global.metrics.lfcTargetFraction.WithLabelValues(policy).Observe(float64(target) / inputs.memoryBytes)
+
+	// Notify the sender even if the target is unchanged, so that it's re-sent if the vm-monitor
+	// reconnected or the last attempt failed.
+	defer s.updated.Send()
+
+	minChange := fileCacheMinChangeFraction * inputs.memoryBytes
+	if memory == s.memory && math.Abs(float64(target)-float64(s.target)) < minChange {
+		return // not enough of a change
+	}
+
+	if target != s.target {
+		direction := directionValueInc
+		if target < s.target {
+			direction = directionValueDec
+		}
+		r.global.metrics.lfcTargetChanges.WithLabelValues(policy, direction).Inc()
+		logger.Info(
+			"Updated file cache target",
+			zap.Uint64("target", target),
+			zap.Uint64("previous", s.target),
+			zap.Float64p("hitRate", inputs.hitRate),
+			zap.Float64("workingSetBytes", inputs.workingSetBytes),
+			zap.Uint64("memory", uint64(memory)),
+		)
+	}
+
+	s.target = target
+	s.memory = memory
+}
+
+// sendFileCacheTargets sends new file cache targets to the vm-monitor, each time they're updated by
+// the sizer.
+func (r *Runner) sendFileCacheTargets(
+	ctx context.Context,
+	logger *zap.Logger,
+	sizer *fileCacheSizer,
+	updated util.CondChannelReceiver,
+) {
+	// the generation of the vm-monitor connection we last warned about not supporting
+	// MonitorCapFileCacheTarget, so that we only warn once per connection.
+	var warnedUnsupported executor.GenerationNumber
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updated.Recv():
+		}
+
+		sizer.mu.Lock()
+		target := sizer.target
+		sent, sentTo := sizer.sent, sizer.sentTo
+		sizer.mu.Unlock()
+
+		var monitor *monitorInfo
+		func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			monitor = r.monitor
+		}()
+
+		if target == 0 || monitor == nil {
+			continue
+		} else if !monitor.dispatcher.Supports(api.MonitorCapFileCacheTarget) {
+			if warnedUnsupported != monitor.generation {
+				logger.Warn("Not sending file cache target, because the vm-monitor doesn't support it")
+				warnedUnsupported = monitor.generation
+			}
+			continue
+		} else if sent == target && sentTo == monitor.generation {
+			continue
+		}
+
+		timeout := time.Second * time.Duration(r.monitorConfig().ResponseTimeoutSeconds)
+		res, err := monitor.dispatcher.Call(ctx, logger, timeout, "FileCacheTarget", api.FileCacheTarget{
+			Size: target,
+		})
+		if err != nil {
+			logger.Error("Failed to send file cache target to vm-monitor", zap.Uint64("target", target), zap.Error(err))
+			continue
+		} else if res.FileCacheResult == nil || !res.FileCacheResult.Ok {
+			logger.Warn("vm-monitor failed to apply file cache target", zap.Uint64("target", target), zap.Any("result", res))
+			continue
+		}
+
+		logger.Info("vm-monitor applied file cache target", zap.Uint64("target", target))
+		sizer.mu.Lock()
+		sizer.sent, sizer.sentTo = target, monitor.generation
+		sizer.mu.Unlock()
+	}
+}
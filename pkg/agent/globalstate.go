@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,11 +13,14 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
@@ -40,25 +44,60 @@ type agentState struct {
 	vmClient     *vmclient.Clientset
 	schedTracker *schedwatch.SchedulerTracker
 	metrics      GlobalMetrics
+	vmMetrics    PerVMMetrics
+
+	// schedGRPC is the client for the scheduler plugin's gRPC API. It's nil if gRPC isn't enabled.
+	schedGRPC *schedulerGRPCClient
+	// pushedMetrics stores metrics pushed for the "push" metrics source. It's nil if the source
+	// isn't enabled.
+	pushedMetrics *pushedMetricsStore
+	// resyncLimiter rate limits requests to resync each VM's metrics. It's nil if the resync
+	// endpoint isn't enabled.
+	resyncLimiter *resyncLimiter
+	// scrapePool limits the metrics requests to VMs across the node. It's nil if
+	// .metrics.scraping isn't configured.
+	scrapePool *scrapePool
+	// scalingEvents emits Events about scaling decisions. It's nil if .scalingEvents isn't
+	// configured. See events.go.
+	scalingEvents *scalingEventRecorder
+	// scalingJournal records each VM's recent scaling transactions. It's nil if .scalingJournal
+	// isn't configured. See journal.go.
+	scalingJournal *scalingJournal
 }
 
 func (r MainRunner) newAgentState(
 	baseLogger *zap.Logger,
 	podIP string,
 	schedTracker *schedwatch.SchedulerTracker,
+	vmMetrics PerVMMetrics,
 ) (*agentState, *prometheus.Registry) {
 	metrics, promReg := makeGlobalMetrics()
 
 	state := &agentState{
-		lock:         util.NewChanMutex(),
-		pods:         make(map[util.NamespacedName]*podState),
-		baseLogger:   baseLogger,
-		config:       r.Config,
-		kubeClient:   r.KubeClient,
-		vmClient:     r.VMClient,
-		podIP:        podIP,
-		schedTracker: schedTracker,
-		metrics:      metrics,
+		lock:           util.NewChanMutex(),
+		pods:           make(map[util.NamespacedName]*podState),
+		baseLogger:     baseLogger,
+		config:         r.Config,
+		kubeClient:     r.KubeClient,
+		vmClient:       r.VMClient,
+		podIP:          podIP,
+		schedTracker:   schedTracker,
+		metrics:        metrics,
+		vmMetrics:      vmMetrics,
+		schedGRPC:      newSchedulerGRPCClient(r.Config.Scheduler.GRPC),
+		pushedMetrics:  newPushedMetricsStore(r.Config.Metrics.Sources),
+		resyncLimiter:  nil, // set below, maybe
+		scrapePool:     newScrapePool(r.Config.Metrics.Scraping, metrics),
+		scalingEvents:  newScalingEventRecorder(baseLogger.Named("events"), r.KubeClient, r.EnvArgs.K8sNodeName, r.Config.ScalingEvents),
+		scalingJournal: newScalingJournal(baseLogger.Named("journal"), r.Config.ScalingJournal),
+	}
+
+	if r.Config.Resync != nil {
+		state.resyncLimiter = &resyncLimiter{
+			mu:       sync.Mutex{},
+			lastSent: make(map[util.NamespacedName]time.Time),
+			minWait:  time.Second * time.Duration(r.Config.Resync.MinSecondsBetweenResyncs),
+		}
 	}
 
 	return state, promReg
@@ -68,7 +107,10 @@ func vmIsOurResponsibility(vm *vmapi.VirtualMachine, config *Config, nodeName st
 	return vm.Status.Node == nodeName &&
 		(vm.Status.Phase.IsAlive() && vm.Status.Phase != vmapi.VmMigrating) &&
 		vm.Status.PodIP != "" &&
-		api.HasAutoscalingEnabled(vm) &&
+		api.VmHasAutoscalingEnabled(vm) &&
+		// UEFI and confidential guests can only be resized by restarting them, so they aren't
+		// autoscaled.
+		!vm.Spec.ResizedByRestart() &&
 		vm.Spec.SchedulerName == config.Scheduler.SchedulerName
 }
 
@@ -79,6 +121,8 @@ func (s *agentState) Stop() {
 	for _, pod := range s.pods {
 		pod.stop()
 	}
+	s.scalingEvents.shutdown()
+	s.scalingJournal.shutdown()
 }
 
 func (s *agentState) handleEvent(ctx context.Context, logger *zap.Logger, event vmEvent) {
@@ -110,6 +154,8 @@ func (s *agentState) handleEvent(ctx context.Context, logger *zap.Logger, event
 	switch event.kind {
 	case vmEventDeleted:
 		state.stop()
+		s.scalingEvents.forget(event.vmInfo.NamespacedName())
+		s.scalingJournal.forget(event.vmInfo.NamespacedName())
 		// mark the status as deleted, so that it gets removed from metrics.
 		state.status.update(s, func(stat podStatus) podStatus {
 			stat.deleted = true
@@ -153,9 +199,12 @@ func (s *agentState) handleVMEventAdded(
 			endpointAssignedAt: &now,
 			state:              "", // Explicitly set state to empty so that the initial state update does no decrement
 			stateUpdatedAt:     now,
+			approved:           nil,
+			usage:              nil,
 
 			startTime:                     now,
 			lastSuccessfulMonitorComm:     nil,
+			degraded:                      false,
 			failedMonitorRequestCounter:   util.NewRecentCounter(time.Duration(s.config.Monitor.MaxFailedRequestRate.IntervalSeconds) * time.Second),
 			failedNeonVMRequestCounter:    util.NewRecentCounter(time.Duration(s.config.NeonVM.MaxFailedRequestRate.IntervalSeconds) * time.Second),
 			failedSchedulerRequestCounter: util.NewRecentCounter(time.Duration(s.config.Scheduler.MaxFailedRequestRate.IntervalSeconds) * time.Second),
@@ -165,13 +214,14 @@ func (s *agentState) handleVMEventAdded(
 	// Empty update to trigger updating metrics and state.
 	status.update(s, func(s podStatus) podStatus { return s })
 
-	runner := s.newRunner(event.vmInfo, podName, event.podIP)
+	runner := s.newRunner(event.vmInfo, event.vmUID, podName, event.podIP)
 	runner.status = status
 
 	txVMUpdate, rxVMUpdate := util.NewCondChannelPair()
 
 	s.pods[podName] = &podState{
 		podName:       podName,
+		vmUID:         event.vmUID,
 		stop:          cancelRunnerContext,
 		runner:        runner,
 		status:        status,
@@ -316,7 +366,7 @@ func (s *agentState) TriggerRestartIfNecessary(runnerCtx context.Context, logger
 			s.metrics.runnerRestarts.Inc()
 
 			restartCount := len(status.previousEndStates) + 1
-			runner := s.newRunner(status.vmInfo, podName, podIP)
+			runner := s.newRunner(status.vmInfo, pod.vmUID, podName, podIP)
 			runner.status = pod.status
 
 			txVMUpdate, rxVMUpdate := util.NewCondChannelPair()
@@ -344,22 +394,30 @@ func (s *agentState) loggerForRunner(restartCount int, vmName, podName util.Name
 }
 
 // NB: caller must set Runner.status after creation
-func (s *agentState) newRunner(vmInfo api.VmInfo, podName util.NamespacedName, podIP string) *Runner {
+func (s *agentState) newRunner(vmInfo api.VmInfo, vmUID types.UID, podName util.NamespacedName, podIP string) *Runner {
 	return &Runner{
 		global: s,
 		status: nil, // set by caller
 
 		shutdown:    nil, // set by (*Runner).Run
 		vmName:      vmInfo.NamespacedName(),
+		vmUID:       vmUID,
 		podName:     podName,
 		podIP:       podIP,
 		memSlotSize: vmInfo.Mem.SlotSize,
-		lock:        util.NewChanMutex(),
+
+		scalingVariant: s.config.Scaling.scalingVariant(vmInfo.NamespacedName()),
+
+		lock: util.NewChanMutex(),
 
 		executorStateDump: nil, // set by (*Runner).Run
 
 		monitor: nil,
 
+		schedStreams: schedulerStreams{mu: sync.Mutex{}, byIP: make(map[string]*schedulerStream)},
+
+		metricsResync: newMetricsResync(),
+
 		backgroundWorkerCount: atomic.Int64{},
 		backgroundPanic:       make(chan error),
 	}
@@ -367,6 +425,7 @@ func (s *agentState) newRunner(vmInfo api.VmInfo, podName util.NamespacedName, p
 
 type podState struct {
 	podName util.NamespacedName
+	vmUID   types.UID
 
 	stop   context.CancelFunc
 	runner *Runner
@@ -414,6 +473,10 @@ type podStatus struct {
 
 	lastSuccessfulMonitorComm *time.Time
 
+	// degraded is true if the VM is in degraded mode, i.e. being scaled without a vm-monitor,
+	// because it never connected.
+	degraded bool
+
 	failedMonitorRequestCounter   *util.RecentCounter
 	failedNeonVMRequestCounter    *util.RecentCounter
 	failedSchedulerRequestCounter *util.RecentCounter
@@ -432,6 +495,16 @@ type podStatus struct {
 
 	state          runnerMetricState
 	stateUpdatedAt time.Time
+
+	// approved is the most recent Permit from the scheduler plugin, if we've received one
+	approved *api.Resources
+	// usage is the most recent system metrics from the VM, if we've fetched them
+	usage *core.SystemMetrics
+	// lastMetricsAt is the time that usage was last fetched
+	lastMetricsAt *time.Time
+	// staleMetrics is the value of metricsStale as of the last update, i.e. whether the Runner is
+	// currently counted in the runnersStaleMetrics metric
+	staleMetrics bool
 }
 
 type podStatusDump struct {
@@ -441,6 +514,9 @@ type podStatusDump struct {
 	PreviousEndStates []podStatusEndState `json:"previousEndStates"`
 
 	LastSuccessfulMonitorComm     *time.Time `json:"lastSuccessfulMonitorComm"`
+	LastMetricsAt                 *time.Time `json:"lastMetricsAt"`
+	StaleMetrics                  bool       `json:"staleMetrics"`
+	Degraded                      bool       `json:"degraded"`
 	FailedMonitorRequestCounter   uint       `json:"failedMonitorRequestCounter"`
 	FailedNeonVMRequestCounter    uint       `json:"failedNeonVMRequestCounter"`
 	FailedSchedulerRequestCounter uint       `json:"failedSchedulerRequestCounter"`
@@ -493,6 +569,8 @@ func (s *lockedPodStatus) update(global *agentState, with func(podStatus) podSta
 		}
 	} else if isStuck, _ := newStatus.isStuck(global, now); isStuck {
 		newState = runnerMetricStateStuck
+	} else if newStatus.degraded {
+		newState = runnerMetricStateDegraded
 	} else {
 		newState = runnerMetricStateOk
 	}
@@ -515,12 +593,74 @@ func (s *lockedPodStatus) update(global *agentState, with func(podStatus) podSta
 		global.metrics.runnersCount.WithLabelValues(newIsEndpoint, string(newStatus.state)).Inc()
 	}
 
+	newStatus.staleMetrics = newStatus.metricsStale(global.config, now)
+	if s.staleMetrics && !newStatus.staleMetrics {
+		global.metrics.runnersStaleMetrics.Dec()
+	} else if !s.staleMetrics && newStatus.staleMetrics {
+		global.metrics.runnersStaleMetrics.Inc()
+	}
+
+	oldSlack, hadSlack := s.slack()
+	newSlack, hasSlack := newStatus.slack()
+	if hadSlack {
+		global.metrics.nodeCPUSlack.Sub(oldSlack.cpu)
+		global.metrics.nodeMemSlack.Sub(oldSlack.mem)
+		if !hasSlack || !slices.Equal(s.slackLabels(), newStatus.slackLabels()) {
+			global.vmMetrics.cpuSlack.DeleteLabelValues(s.slackLabels()...)
+			global.vmMetrics.memorySlack.DeleteLabelValues(s.slackLabels()...)
+		}
+	}
+	if hasSlack {
+		global.metrics.nodeCPUSlack.Add(newSlack.cpu)
+		global.metrics.nodeMemSlack.Add(newSlack.mem)
+		global.vmMetrics.cpuSlack.WithLabelValues(newStatus.slackLabels()...).Set(newSlack.cpu)
+		global.vmMetrics.memorySlack.WithLabelValues(newStatus.slackLabels()...).Set(newSlack.mem)
+	}
+
 	s.podStatus = newStatus
 }
 
+type slackValues struct {
+	cpu float64
+	mem float64
+}
+
+// slack returns the resources approved by the scheduler plugin that the VM isn't currently using,
+// if that's known. Negative values (i.e. using more than approved) are reported as zero.
+func (s podStatus) slack() (slackValues, bool) {
+	if s.deleted || s.endState != nil || s.approved == nil || s.usage == nil {
+		return slackValues{cpu: 0, mem: 0}, false
+	}
+
+	return slackValues{
+		cpu: math.Max(0, s.approved.VCPU.AsFloat64()-s.usage.LoadAverage1Min),
+		mem: math.Max(0, s.approved.Mem.AsFloat64()-s.usage.MemoryUsageBytes),
+	}, true
+}
+
+// metricsStale returns whether the VM's system metrics haven't been fetched within the configured
+// .metrics.scraping.staleAfterSeconds, as of now. Staleness is only tracked for running Runners,
+// and only if .metrics.scraping is configured.
+func (s podStatus) metricsStale(config *Config, now time.Time) bool {
+	if s.deleted || s.endState != nil || config.Metrics.Scraping == nil {
+		return false
+	}
+
+	since := s.startTime
+	if s.lastMetricsAt != nil {
+		since = *s.lastMetricsAt
+	}
+	return now.Sub(since) > time.Second*time.Duration(config.Metrics.Scraping.StaleAfterSeconds)
+}
+
+func (s podStatus) slackLabels() []string {
+	return []string{s.vmInfo.Namespace, s.vmInfo.Name, s.endpointID}
+}
+
 func (s podStatus) isStuck(global *agentState, now time.Time) (bool, []string) {
 	var reasons []string
-	if s.monitorStuckAt(global.config).Before(now) {
+	// In degraded mode, we aren't expecting the vm-monitor to connect at all.
+	if !s.degraded && s.monitorStuckAt(global.config).Before(now) {
 		reasons = append(reasons, "monitor health check failed")
 	}
 	if s.failedMonitorRequestCounter.Get() > global.config.Monitor.MaxFailedRequestRate.Threshold {
@@ -537,8 +677,9 @@ func (s podStatus) isStuck(global *agentState, now time.Time) (bool, []string) {
 
 // monitorStuckAt returns the time at which the Runner will be marked "stuck"
 func (s podStatus) monitorStuckAt(config *Config) time.Time {
-	startupGracePeriod := time.Second * time.Duration(config.Monitor.UnhealthyStartupGracePeriodSeconds)
-	unhealthySilencePeriod := time.Second * time.Duration(config.Monitor.UnhealthyAfterSilenceDurationSeconds)
+	monitorConfig := config.Monitor.ForVM(s.vmInfo.Config)
+	startupGracePeriod := time.Second * time.Duration(monitorConfig.UnhealthyStartupGracePeriodSeconds)
+	unhealthySilencePeriod := time.Second * time.Duration(monitorConfig.UnhealthyAfterSilenceDurationSeconds)
 
 	if s.lastSuccessfulMonitorComm == nil {
 		start := s.startTime
@@ -612,6 +753,9 @@ func (s *lockedPodStatus) dump() podStatusDump {
 		StateUpdatedAt: s.stateUpdatedAt,
 
 		LastSuccessfulMonitorComm:     s.lastSuccessfulMonitorComm,
+		LastMetricsAt:                 s.lastMetricsAt,
+		StaleMetrics:                  s.staleMetrics,
+		Degraded:                      s.degraded,
 		FailedMonitorRequestCounter:   s.failedMonitorRequestCounter.Get(),
 		FailedNeonVMRequestCounter:    s.failedNeonVMRequestCounter.Get(),
 		FailedSchedulerRequestCounter: s.failedSchedulerRequestCounter.Get(),
@@ -0,0 +1,461 @@
+package agent
+
+// Journal of scaling decisions
+//
+// To answer questions like "why did my VM downscale at 3am?", the autoscaler-agent can keep a
+// journal of each VM's recent scaling transactions. Each entry covers a single transaction (see the
+// correlation IDs in executor/core.go), with the inputs to the decision - the VM's metrics and the
+// goal CU they call for - followed by each request made to the scheduler plugin, vm-monitor, and
+// NeonVM, and their responses.
+//
+// The most recent entries for each VM are kept in memory, and can be fetched from the journal
+// server. If a directory is configured, finished entries are also appended to a file there, which
+// is read back on startup so that the journal survives restarts of the autoscaler-agent. Once the
+// file reaches the configured size, it's rotated, keeping only a single previous file.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+const (
+	// journalFileName is the name of the journal file, within the configured directory
+	journalFileName = "scaling-journal.jsonl"
+	// maxJournalSteps is the maximum number of steps recorded for a single entry. Later steps are
+	// counted in DroppedSteps.
+	maxJournalSteps = 64
+	// journalPersistQueueSize is the number of finished entries that may be waiting to be written
+	// to the journal file, before more are dropped.
+	journalPersistQueueSize = 256
+)
+
+// Kinds of steps in a scaling journal entry
+const (
+	journalStepPlugin           = "plugin"
+	journalStepNeonVM           = "neonvm"
+	journalStepMonitorDownscale = "monitorDownscale"
+	journalStepMonitorUpscale   = "monitorUpscale"
+)
+
+// ScalingJournalEntry is the record of a single scaling transaction for a VM
+type ScalingJournalEntry struct {
+	CorrelationID string              `json:"correlationID"`
+	VM            util.NamespacedName `json:"vm"`
+	StartedAt     time.Time           `json:"startedAt"`
+	// FinishedAt is the time that the scaling transaction finished, or nil if it's still ongoing
+	FinishedAt *time.Time `json:"finishedAt"`
+
+	// Inputs are the values that the decision to start scaling was based on
+	Inputs core.ScalingInputs `json:"inputs"`
+	// Actions are the actions that started the scaling transaction
+	Actions core.ActionSet `json:"actions"`
+
+	Steps []ScalingJournalStep `json:"steps"`
+	// DroppedSteps is the number of steps that weren't recorded, because there were already too
+	// many
+	DroppedSteps int `json:"droppedSteps,omitempty"`
+}
+
+// ScalingJournalStep is a single request made as part of a scaling transaction, and its result
+type ScalingJournalStep struct {
+	Time time.Time `json:"time"`
+	// Kind is the type of request: one of "plugin", "neonvm", "monitorDownscale", or
+	// "monitorUpscale"
+	Kind    string         `json:"kind"`
+	Current *api.Resources `json:"current"`
+	Target  api.Resources  `json:"target"`
+
+	PluginResponse *api.PluginResponse  `json:"pluginResponse,omitempty"`
+	MonitorResult  *api.DownscaleResult `json:"monitorResult,omitempty"`
+	// Error is the error from the request, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+func (e *ScalingJournalEntry) deepCopy() ScalingJournalEntry {
+	entry := *e
+	entry.FinishedAt = shallowCopy(e.FinishedAt)
+	entry.Steps = slices.Clone(e.Steps)
+	return entry
+}
+
+func shallowCopy[T any](ptr *T) *T {
+	if ptr == nil {
+		return nil
+	}
+	x := *ptr
+	return &x
+}
+
+// scalingJournal stores the recent scaling transactions for each VM
+type scalingJournal struct {
+	logger     *zap.Logger
+	maxEntries int
+
+	// persist is the queue of finished entries to write to the journal file. It's nil if the
+	// journal isn't persisted.
+	persist chan ScalingJournalEntry
+
+	mu sync.Mutex
+	// entries stores the entries for each VM, oldest first
+	entries map[util.NamespacedName][]*ScalingJournalEntry
+	// ongoing stores the entries for the scaling transactions that haven't finished yet, by
+	// correlation ID
+	ongoing map[string]*ScalingJournalEntry
+}
+
+func newScalingJournal(logger *zap.Logger, config *ScalingJournalConfig) *scalingJournal {
+	if config == nil {
+		return nil
+	}
+
+	j := &scalingJournal{
+		logger:     logger,
+		maxEntries: int(config.MaxEntriesPerVM),
+		persist:    nil, // set below, maybe
+		mu:         sync.Mutex{},
+		entries:    make(map[util.NamespacedName][]*ScalingJournalEntry),
+		ongoing:    make(map[string]*ScalingJournalEntry),
+	}
+
+	if config.Directory != "" {
+		path := filepath.Join(config.Directory, journalFileName)
+		// Load the previous file first, so that the entries are in order.
+		for _, p := range []string{rotatedJournalPath(path), path} {
+			if err := j.load(p); err != nil {
+				logger.Warn("Failed to load scaling journal file", zap.String("path", p), zap.Error(err))
+			}
+		}
+
+		writer, err := openJournalWriter(path, int64(config.MaxFileBytes))
+		if err != nil {
+			// Keep the in-memory journal, even though it won't be persisted.
+			logger.Error("Failed to open scaling journal file", zap.String("path", path), zap.Error(err))
+		} else {
+			j.persist = make(chan ScalingJournalEntry, journalPersistQueueSize)
+			go writer.run(logger, j.persist)
+		}
+	}
+
+	return j
+}
+
+// load reads the entries from the journal file at the path, if it exists
+func (j *scalingJournal) load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry ScalingJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line may be partially written if the autoscaler-agent was killed. Skip it
+			// and anything else that's invalid.
+			continue
+		}
+		j.append(&entry)
+	}
+	return scanner.Err()
+}
+
+// append adds the entry to the VM's entries, removing the oldest if there's too many.
+//
+// This method MUST be called while holding j.mu, or before the journal is shared.
+func (j *scalingJournal) append(entry *ScalingJournalEntry) {
+	entries := append(j.entries[entry.VM], entry)
+	if len(entries) > j.maxEntries {
+		entries = slices.Clone(entries[len(entries)-j.maxEntries:])
+	}
+	j.entries[entry.VM] = entries
+}
+
+// start records the start of a new scaling transaction for the VM
+//
+// The journal may be nil, in which case nothing is recorded.
+func (j *scalingJournal) start(
+	vmName util.NamespacedName,
+	correlationID string,
+	inputs core.ScalingInputs,
+	actions core.ActionSet,
+) {
+	if j == nil {
+		return
+	}
+
+	entry := &ScalingJournalEntry{
+		CorrelationID: correlationID,
+		VM:            vmName,
+		StartedAt:     time.Now(),
+		FinishedAt:    nil,
+		Inputs:        inputs,
+		Actions:       actions,
+		Steps:         nil,
+		DroppedSteps:  0,
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.append(entry)
+	j.ongoing[correlationID] = entry
+}
+
+// step records a request made as part of the scaling transaction with the correlation ID, if the
+// transaction is in the journal.
+//
+// The journal may be nil, in which case nothing is recorded.
+func (j *scalingJournal) step(correlationID string, step ScalingJournalStep) {
+	if j == nil || correlationID == "" {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.ongoing[correlationID]
+	if !ok {
+		return
+	}
+	if len(entry.Steps) == maxJournalSteps {
+		entry.DroppedSteps += 1
+		return
+	}
+	entry.Steps = append(entry.Steps, step)
+}
+
+// finish records the end of the scaling transaction with the correlation ID, and queues it to be
+// written to the journal file.
+//
+// The journal may be nil, in which case nothing is recorded.
+func (j *scalingJournal) finish(correlationID string) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.ongoing[correlationID]
+	if !ok {
+		return
+	}
+	delete(j.ongoing, correlationID)
+
+	now := time.Now()
+	entry.FinishedAt = &now
+
+	if j.persist != nil {
+		select {
+		case j.persist <- entry.deepCopy():
+		default:
+			j.logger.Warn(
+				"Dropping scaling journal entry because too many are waiting to be written",
+				zap.Object("virtualmachine", entry.VM),
+				zap.String(util.CorrelationIDLogKey, correlationID),
+			)
+		}
+	}
+}
+
+// get returns a copy of the VM's entries, oldest first
+func (j *scalingJournal) get(vmName util.NamespacedName) []ScalingJournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]ScalingJournalEntry, 0, len(j.entries[vmName]))
+	for _, e := range j.entries[vmName] {
+		entries = append(entries, e.deepCopy())
+	}
+	return entries
+}
+
+// forget removes the in-memory entries for the VM, once it's no longer on this node. Entries that
+// have been written to the journal file are kept there.
+func (j *scalingJournal) forget(vmName util.NamespacedName) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.entries, vmName)
+	for id, entry := range j.ongoing {
+		if entry.VM == vmName {
+			delete(j.ongoing, id)
+		}
+	}
+}
+
+func (j *scalingJournal) shutdown() {
+	if j == nil || j.persist == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	close(j.persist)
+	j.persist = nil
+}
+
+func rotatedJournalPath(path string) string {
+	return path + ".1"
+}
+
+// journalWriter appends entries to the journal file, rotating it once it's too large
+type journalWriter struct {
+	path     string
+	maxBytes int64
+
+	file *os.File
+	size int64
+}
+
+func openJournalWriter(path string, maxBytes int64) (*journalWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &journalWriter{
+		path:     path,
+		maxBytes: maxBytes,
+		file:     file,
+		size:     info.Size(),
+	}, nil
+}
+
+func (w *journalWriter) run(logger *zap.Logger, entries <-chan ScalingJournalEntry) {
+	defer w.file.Close()
+
+	for entry := range entries {
+		if err := w.write(entry); err != nil {
+			logger.Error(
+				"Failed to write scaling journal entry",
+				zap.Object("virtualmachine", entry.VM),
+				zap.String(util.CorrelationIDLogKey, entry.CorrelationID),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+func (w *journalWriter) write(entry ScalingJournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not marshal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if w.size != 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return fmt.Errorf("could not rotate journal file: %w", err)
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *journalWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, rotatedJournalPath(w.path)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.size = 0
+	return nil
+}
+
+// ScalingJournalRequest is the body of a request to the scaling journal server
+type ScalingJournalRequest struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// ScalingJournalResponse is the body of a successful response from the scaling journal server
+type ScalingJournalResponse struct {
+	// Entries are the VM's recent scaling transactions, oldest first
+	Entries []ScalingJournalEntry `json:"entries"`
+}
+
+// StartScalingJournalServer starts the HTTP server that returns VMs' recent scaling transactions
+func (s *agentState) StartScalingJournalServer(shutdownCtx context.Context, logger *zap.Logger, config *ScalingJournalConfig) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	util.AddHandler(logger, mux, "/journal", http.MethodPost, "ScalingJournalRequest", func(ctx context.Context, logger *zap.Logger, body *ScalingJournalRequest) (*ScalingJournalResponse, int, error) {
+		if body.Namespace == "" || body.Name == "" {
+			return nil, 400, errclass.Errorf(errclass.UserError, "both namespace and name must be provided")
+		}
+		entries := s.scalingJournal.get(util.NamespacedName{Namespace: body.Namespace, Name: body.Name})
+		return &ScalingJournalResponse{Entries: entries}, 200, nil
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-shutdownCtx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Error("Error shutting down scaling journal server", zap.Error(err))
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("scaling journal server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// recordJournalStep records a step of the current scaling transaction in the journal, if the
+// journal is enabled
+func (r *Runner) recordJournalStep(ctx context.Context, step ScalingJournalStep) {
+	r.global.scalingJournal.step(util.CorrelationIDFromContext(ctx), step)
+}
+
+// journalError returns the message of the error for a ScalingJournalStep, or "" if it's nil
+func journalError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,319 @@
+package agent
+
+// Sources of metrics for VMs
+//
+// By default, system metrics are scraped from vector.dev, which vm-builder installs in the VM, and
+// LFC metrics are scraped from the postgres exporter. VMs can select a different source of system
+// metrics with the "autoscaling.neon.tech/metrics-source" annotation, as long as it's enabled in
+// the autoscaler-agent's config.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/core"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+const (
+	metricsSourceVector       = "vector"
+	metricsSourcePrometheus   = "prometheus"
+	metricsSourceNodeExporter = "node-exporter"
+	metricsSourcePush         = "push"
+
+	// maxPushedMetricsSize is the maximum size of the body of a request to push metrics
+	maxPushedMetricsSize = 1 << 20 // 1 MiB
+)
+
+// metricsSource is a way of fetching metrics for a single VM
+type metricsSource interface {
+	// name returns the name of the source, as used in the annotation
+	name() string
+	// interval returns the duration to wait between fetching metrics
+	interval() time.Duration
+	// fetch gets the current metrics, writing the result into 'metrics'
+	fetch(ctx context.Context, logger *zap.Logger, metrics core.FromPrometheus) error
+}
+
+// scrapeMetricsSource fetches metrics with an HTTP request to an endpoint in the VM
+type scrapeMetricsSource struct {
+	sourceName string
+	podIP      string
+	path       string
+	config     MetricsSourceConfig
+	// renames, if not nil, is passed to core.ParseMetricsRenamed
+	renames map[string]string
+	// pool, if not nil, limits the requests in flight across all VMs. See scrapepool.go.
+	pool *scrapePool
+}
+
+func (s *scrapeMetricsSource) name() string {
+	return s.sourceName
+}
+
+func (s *scrapeMetricsSource) interval() time.Duration {
+	return s.pool.interval(s.baseInterval())
+}
+
+func (s *scrapeMetricsSource) baseInterval() time.Duration {
+	return time.Second * time.Duration(s.config.SecondsBetweenRequests)
+}
+
+func (s *scrapeMetricsSource) fetch(ctx context.Context, logger *zap.Logger, metrics core.FromPrometheus) error {
+	// Requests that can't finish before the next one is due aren't worth waiting for.
+	return s.pool.do(ctx, s.baseInterval(), func(ctx context.Context) error {
+		return s.doFetch(ctx, logger, metrics)
+	})
+}
+
+func (s *scrapeMetricsSource) doFetch(ctx context.Context, logger *zap.Logger, metrics core.FromPrometheus) error {
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(s.podIP, fmt.Sprint(s.config.Port)), s.path)
+
+	timeout := time.Second * time.Duration(s.config.RequestTimeoutSeconds)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, bytes.NewReader(nil))
+	if err != nil {
+		panic(fmt.Errorf("Error constructing metrics request to %q: %w", url, err))
+	}
+
+	logger.Info("Making metrics request to VM", zap.String("url", url))
+
+	resp, err := http.DefaultClient.Do(req)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		return fmt.Errorf("Error making request to %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unsuccessful response status %d", resp.StatusCode)
+	}
+
+	if err := core.ParseMetricsRenamed(resp.Body, metrics, s.renames); err != nil {
+		return fmt.Errorf("Error parsing metrics from prometheus output: %w", err)
+	}
+
+	return nil
+}
+
+// pushedMetricsSource reads the latest metrics that were pushed to the autoscaler-agent for the VM
+type pushedMetricsSource struct {
+	store  *pushedMetricsStore
+	podIP  string
+	config PushMetricsSourceConfig
+}
+
+func (s *pushedMetricsSource) name() string {
+	return metricsSourcePush
+}
+
+func (s *pushedMetricsSource) interval() time.Duration {
+	return time.Second * time.Duration(s.config.SecondsBetweenRequests)
+}
+
+func (s *pushedMetricsSource) fetch(ctx context.Context, logger *zap.Logger, metrics core.FromPrometheus) error {
+	content, receivedAt, ok := s.store.get(s.podIP)
+	if !ok {
+		return fmt.Errorf("No metrics have been pushed for pod IP %s", s.podIP)
+	}
+
+	maxAge := time.Second * time.Duration(s.config.MaxAgeSeconds)
+	if age := time.Since(receivedAt); age > maxAge {
+		return fmt.Errorf("Pushed metrics are stale: received %s ago, max age is %s", age, maxAge)
+	}
+
+	if err := core.ParseMetrics(bytes.NewReader(content), metrics); err != nil {
+		return fmt.Errorf("Error parsing pushed metrics: %w", err)
+	}
+
+	return nil
+}
+
+// systemMetricsSource returns the source of system metrics selected by the VM.
+//
+// If the VM selects a source that doesn't exist or isn't enabled, the default vector.dev source is
+// returned, alongside an error.
+func (r *Runner) systemMetricsSource(vm api.VmInfo) (metricsSource, error) {
+	config := r.global.config.Metrics
+
+	vector := &scrapeMetricsSource{
+		sourceName: metricsSourceVector,
+		podIP:      r.podIP,
+		path:       "/metrics",
+		config:     config.System,
+		renames:    nil,
+		pool:       r.global.scrapePool,
+	}
+
+	var sources MetricsSourcesConfig
+	if config.Sources != nil {
+		sources = *config.Sources
+	}
+
+	switch vm.Config.MetricsSource {
+	case "", metricsSourceVector:
+		return vector, nil
+	case metricsSourcePrometheus:
+		if sources.Prometheus != nil {
+			return &scrapeMetricsSource{
+				sourceName: metricsSourcePrometheus,
+				podIP:      r.podIP,
+				path:       sources.Prometheus.Path,
+				config:     sources.Prometheus.MetricsSourceConfig,
+				renames:    sources.Prometheus.MetricNames.Renames(),
+				pool:       r.global.scrapePool,
+			}, nil
+		}
+	case metricsSourceNodeExporter:
+		if sources.NodeExporter != nil {
+			return &scrapeMetricsSource{
+				sourceName: metricsSourceNodeExporter,
+				podIP:      r.podIP,
+				path:       "/metrics",
+				config:     *sources.NodeExporter,
+				renames:    core.NodeExporterSystemMetricNames.Renames(),
+				pool:       r.global.scrapePool,
+			}, nil
+		}
+	case metricsSourcePush:
+		if sources.Push != nil {
+			return &pushedMetricsSource{
+				store:  r.global.pushedMetrics,
+				podIP:  r.podIP,
+				config: *sources.Push,
+			}, nil
+		}
+	default:
+		return vector, fmt.Errorf("Unknown metrics source %q in annotation %q", vm.Config.MetricsSource, api.AnnotationMetricsSource)
+	}
+
+	return vector, fmt.Errorf("Metrics source %q is not enabled", vm.Config.MetricsSource)
+}
+
+// pushedMetricsStore holds the latest metrics pushed for each VM, keyed by the IP of the VM's
+// runner pod.
+type pushedMetricsStore struct {
+	mu      sync.Mutex
+	byPodIP map[string]pushedMetrics
+
+	// maxAge is the duration after which entries can be removed
+	maxAge time.Duration
+}
+
+type pushedMetrics struct {
+	content    []byte
+	receivedAt time.Time
+}
+
+func newPushedMetricsStore(config *MetricsSourcesConfig) *pushedMetricsStore {
+	if config == nil || config.Push == nil {
+		return nil
+	}
+	return &pushedMetricsStore{
+		mu:      sync.Mutex{},
+		byPodIP: make(map[string]pushedMetrics),
+		maxAge:  time.Second * time.Duration(config.Push.MaxAgeSeconds),
+	}
+}
+
+func (s *pushedMetricsStore) get(podIP string) (content []byte, receivedAt time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.byPodIP[podIP]
+	return m.content, m.receivedAt, ok
+}
+
+func (s *pushedMetricsStore) put(podIP string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.byPodIP[podIP] = pushedMetrics{content: content, receivedAt: now}
+
+	// Remove stale entries while we're here, so that VMs that are gone don't stick around forever.
+	for ip, m := range s.byPodIP {
+		if now.Sub(m.receivedAt) > s.maxAge {
+			delete(s.byPodIP, ip)
+		}
+	}
+}
+
+// StartMetricsPushServer starts the HTTP server that accepts pushed metrics, if the "push" metrics
+// source is enabled.
+func (s *agentState) StartMetricsPushServer(shutdownCtx context.Context, logger *zap.Logger) error {
+	if s.pushedMetrics == nil {
+		return nil
+	}
+	config := s.config.Metrics.Sources.Push
+
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		podIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			logger.Warn("Failed to parse remote address of pushed metrics", zap.String("remoteAddr", req.RemoteAddr), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		content, err := io.ReadAll(io.LimitReader(req.Body, maxPushedMetricsSize+1))
+		if err != nil {
+			logger.Warn("Failed to read pushed metrics", zap.String("podIP", podIP), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if len(content) > maxPushedMetricsSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// Check the content now, so that the client finds out if it's invalid.
+		var metrics core.SystemMetrics
+		if err := core.ParseMetrics(bytes.NewReader(content), &metrics); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+
+		s.pushedMetrics.put(podIP, content)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-shutdownCtx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Error("Error shutting down metrics push server", zap.Error(err))
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics push server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package agent
+
+// Per-VM ownership claims
+//
+// During a rollout of the autoscaler-agent DaemonSet, the old and new agent pods on a node may run
+// at the same time. Without any coordination, both would manage the same VMs, making conflicting
+// requests to NeonVM, the scheduler plugin, and the vm-monitor.
+//
+// When .ownership is set in the config, each Runner must first claim its VM by acquiring a
+// coordination.k8s.io Lease for it, in the VM's namespace, with the agent's pod IP as the holder.
+// The Runner doesn't start managing the VM until it holds the lease, renews it periodically, and
+// releases it when it stops. Other agents may only take over the lease once it has expired.
+//
+// Leases are updated with the resourceVersion they were read at, so that two agents can't both
+// succeed in taking over the same lease. Each lease is owned by its VM, so it's deleted along with
+// the VM.
+//
+// If renewals keep failing (e.g. because the API server is unreachable), the Runner can't tell
+// whether another agent is about to take over, so it gives up the VM once the renew deadline has
+// passed since its last successful renewal. The deadline is shorter than the lease duration, so
+// that the Runner has stopped before the lease expires and any other agent may claim it.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+var errLostOwnership = errors.New("VM was claimed by another autoscaler-agent")
+
+var errOwnershipExpired = errors.New("could not renew claim on VM before the renew deadline")
+
+// vmClaim is the Lease that an autoscaler-agent must hold to manage a particular VM
+type vmClaim struct {
+	leases coordinationv1client.LeaseInterface
+	// name is the name of the Lease
+	name string
+	// vm is the owner reference to the VM, so that the Lease is deleted with it
+	vm metav1.OwnerReference
+	// identity is the holder identity for this autoscaler-agent: its pod IP
+	identity string
+	// duration is how long the Lease is valid for after each renewal
+	duration time.Duration
+	// renewDeadline is how long after the last successful renewal we stop managing the VM, if we
+	// haven't been able to renew the Lease since. It's less than duration.
+	renewDeadline time.Duration
+}
+
+func (r *Runner) vmClaim(config OwnershipConfig) vmClaim {
+	return vmClaim{
+		leases: r.global.kubeClient.CoordinationV1().Leases(r.vmName.Namespace),
+		name:   fmt.Sprintf("autoscaler-agent-%s", r.vmName.Name),
+		vm: metav1.OwnerReference{
+			APIVersion: vmapi.SchemeGroupVersion.String(),
+			Kind:       "VirtualMachine",
+			Name:       r.vmName.Name,
+			UID:        r.vmUID,
+			// The lease doesn't block the VM's deletion, nor does the VM control it.
+			Controller:         nil,
+			BlockOwnerDeletion: nil,
+		},
+		identity:      r.global.podIP,
+		duration:      time.Second * time.Duration(config.LeaseDurationSeconds),
+		renewDeadline: time.Second * time.Duration(config.RenewDeadlineSeconds),
+	}
+}
+
+// holder returns the current holder of the lease, or "" if it isn't held or has expired
+func (c vmClaim) holder(lease *coordinationv1.Lease, now time.Time) string {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return ""
+	}
+	expiresAt := spec.RenewTime.Add(time.Second * time.Duration(*spec.LeaseDurationSeconds))
+	if !now.Before(expiresAt) {
+		return ""
+	}
+	return *spec.HolderIdentity
+}
+
+// tryClaim attempts to acquire the lease, or renew our existing claim, returning whether we now own
+// the VM. If another agent holds an unexpired claim, it returns false and the current owner.
+func (c vmClaim) tryClaim(ctx context.Context, now time.Time) (_ bool, owner string, _ error) {
+	durationSeconds := int32(c.duration / time.Second)
+	renewTime := metav1.NewMicroTime(now)
+
+	lease, err := c.leases.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			TypeMeta: metav1.TypeMeta{},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            c.name,
+				OwnerReferences: []metav1.OwnerReference{c.vm},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &c.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+				LeaseTransitions:     nil,
+			},
+		}
+		if _, err := c.leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return false, "", fmt.Errorf("Error creating lease: %w", err)
+		}
+		return true, c.identity, nil
+	} else if err != nil {
+		return false, "", fmt.Errorf("Error getting lease: %w", err)
+	}
+
+	holder := c.holder(lease, now)
+	if holder != "" && holder != c.identity {
+		return false, holder, nil
+	}
+
+	if holder != c.identity {
+		lease.Spec.AcquireTime = &renewTime
+		lease.Spec.LeaseTransitions = lo.ToPtr(lo.FromPtr(lease.Spec.LeaseTransitions) + 1)
+	}
+	lease.Spec.HolderIdentity = &c.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &renewTime
+
+	// The update includes the resourceVersion we read, so it fails if another agent changed the
+	// lease in the meantime.
+	if _, err := c.leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return false, "", fmt.Errorf("Error updating lease: %w", err)
+	}
+	return true, c.identity, nil
+}
+
+// release gives up our claim on the VM, if we still hold it, so that another agent can take over
+// without waiting for it to expire.
+func (c vmClaim) release(ctx context.Context) (released bool, _ error) {
+	lease, err := c.leases.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("Error getting lease: %w", err)
+	}
+
+	if lo.FromPtr(lease.Spec.HolderIdentity) != c.identity {
+		return false, nil
+	}
+
+	err = c.leases.Delete(ctx, c.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return false, fmt.Errorf("Error deleting lease: %w", err)
+	}
+	return true, nil
+}
+
+// tryClaimVM attempts to claim the VM, or renew our existing claim. See vmClaim.tryClaim.
+func (r *Runner) tryClaimVM(ctx context.Context, claim vmClaim, now time.Time) (_ bool, owner string, _ error) {
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return claim.tryClaim(ctx, now)
+}
+
+// waitForOwnership blocks until this Runner holds the claim on its VM, or the context is canceled,
+// returning the time the claim was made.
+func (r *Runner) waitForOwnership(ctx context.Context, logger *zap.Logger, config OwnershipConfig) (claimedAt time.Time, _ error) {
+	claim := r.vmClaim(config)
+	retryWait := time.Second * time.Duration(config.RenewEverySeconds)
+
+	for {
+		now := time.Now()
+		owns, owner, err := r.tryClaimVM(ctx, claim, now)
+		if err != nil {
+			logger.Warn("Failed to claim VM", zap.Error(err))
+		} else if owns {
+			logger.Info("Claimed VM")
+			return now, nil
+		} else {
+			logger.Info("VM is claimed by another autoscaler-agent, waiting", zap.String("owner", owner))
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-time.After(retryWait):
+		}
+	}
+}
+
+// renewOwnership periodically renews the claim on the VM, until the context is canceled.
+//
+// It sends errLostOwnership on lost if another agent has taken over the claim, or
+// errOwnershipExpired as soon as the renew deadline passes without a successful renewal. In both
+// cases, the Runner must stop managing the VM.
+func renewOwnership(
+	ctx context.Context,
+	logger *zap.Logger,
+	claim vmClaim,
+	renewEvery time.Duration,
+	timeout time.Duration,
+	lastRenewed time.Time,
+	lost chan<- error,
+) {
+	ticker := time.NewTicker(renewEvery)
+	defer ticker.Stop()
+
+	// The deadline is checked with a timer, rather than only after each failed renewal, so that we
+	// stop in time even if the renewal interval doesn't line up with it.
+	deadline := lastRenewed.Add(claim.renewDeadline)
+	deadlineTimer := time.NewTimer(time.Until(deadline))
+	defer deadlineTimer.Stop()
+
+	expired := func(err error) {
+		// Another agent may take over soon, and we wouldn't know.
+		logger.Error("Failed to renew claim on VM before the renew deadline", zap.Time("lastRenewed", lastRenewed), zap.Error(err))
+		lost <- errOwnershipExpired
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadlineTimer.C:
+			expired(nil)
+			return
+		case <-ticker.C:
+		}
+
+		// The lease is valid from when we sent the request, not when it was accepted.
+		now := time.Now()
+		owns, owner, err := func() (bool, string, error) {
+			// Don't let a slow request run past the deadline either.
+			requestDeadline := now.Add(timeout)
+			if deadline.Before(requestDeadline) {
+				requestDeadline = deadline
+			}
+			ctx, cancel := context.WithDeadline(ctx, requestDeadline)
+			defer cancel()
+			return claim.tryClaim(ctx, now)
+		}()
+
+		if err == nil && owns {
+			lastRenewed = now
+			deadline = lastRenewed.Add(claim.renewDeadline)
+			if !deadlineTimer.Stop() {
+				<-deadlineTimer.C
+			}
+			deadlineTimer.Reset(time.Until(deadline))
+		} else if err == nil /* && !owns */ {
+			logger.Error("Claim on VM was taken by another autoscaler-agent", zap.String("owner", owner))
+			lost <- errLostOwnership
+			return
+		} else if !time.Now().Before(deadline) {
+			expired(err)
+			return
+		} else {
+			// We'll retry on the next tick, until the deadline.
+			logger.Warn("Failed to renew claim on VM", zap.Time("lastRenewed", lastRenewed), zap.Error(err))
+		}
+	}
+}
+
+// releaseVMClaim removes our claim on the VM, if we still hold it, so that another agent can take
+// over without waiting for it to expire.
+func (r *Runner) releaseVMClaim(logger *zap.Logger, config OwnershipConfig) {
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	released, err := r.vmClaim(config).release(ctx)
+	if err != nil {
+		logger.Warn("Failed to release claim on VM", zap.Error(err))
+	} else if released {
+		logger.Info("Released claim on VM")
+	}
+}
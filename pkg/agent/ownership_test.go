@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestClaim(client *fake.Clientset, identity string) vmClaim {
+	return vmClaim{
+		leases:        client.CoordinationV1().Leases("default"),
+		name:          "autoscaler-agent-vm",
+		vm:            metav1.OwnerReference{APIVersion: "vm.neon.tech/v1", Kind: "VirtualMachine", Name: "vm", UID: "vm-uid"},
+		identity:      identity,
+		duration:      10 * time.Second,
+		renewDeadline: 8 * time.Second,
+	}
+}
+
+func getTestLease(t *testing.T, claim vmClaim) *coordinationv1.Lease {
+	lease, err := claim.leases.Get(context.Background(), claim.name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return lease
+}
+
+func TestTryClaim(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	ours := newTestClaim(client, "10.0.0.1")
+	theirs := newTestClaim(client, "10.0.0.2")
+	start := time.Now()
+
+	// Nobody holds the VM yet: the lease is created
+	owns, owner, err := ours.tryClaim(ctx, start)
+	require.NoError(t, err)
+	assert.True(t, owns)
+	assert.Equal(t, "10.0.0.1", owner)
+	lease := getTestLease(t, ours)
+	assert.Equal(t, "10.0.0.1", lo.FromPtr(lease.Spec.HolderIdentity))
+	assert.Equal(t, int32(10), lo.FromPtr(lease.Spec.LeaseDurationSeconds))
+	assert.Equal(t, []metav1.OwnerReference{ours.vm}, lease.OwnerReferences)
+
+	// Another agent can't take over while our claim is valid
+	owns, owner, err = theirs.tryClaim(ctx, start.Add(9*time.Second))
+	require.NoError(t, err)
+	assert.False(t, owns)
+	assert.Equal(t, "10.0.0.1", owner)
+
+	// Renewing extends our claim without counting as a transition
+	owns, _, err = ours.tryClaim(ctx, start.Add(5*time.Second))
+	require.NoError(t, err)
+	assert.True(t, owns)
+	lease = getTestLease(t, ours)
+	assert.True(t, lease.Spec.RenewTime.Time.Equal(start.Add(5*time.Second)))
+	assert.Zero(t, lo.FromPtr(lease.Spec.LeaseTransitions))
+
+	owns, _, err = theirs.tryClaim(ctx, start.Add(14*time.Second))
+	require.NoError(t, err)
+	assert.False(t, owns, "renewed claim should still be valid")
+
+	// Once our claim expires, the other agent can take over
+	owns, owner, err = theirs.tryClaim(ctx, start.Add(15*time.Second))
+	require.NoError(t, err)
+	assert.True(t, owns)
+	assert.Equal(t, "10.0.0.2", owner)
+	lease = getTestLease(t, ours)
+	assert.Equal(t, "10.0.0.2", lo.FromPtr(lease.Spec.HolderIdentity))
+	assert.True(t, lease.Spec.AcquireTime.Time.Equal(start.Add(15*time.Second)))
+	assert.Equal(t, int32(1), lo.FromPtr(lease.Spec.LeaseTransitions))
+}
+
+func TestTryClaimConflict(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	claim := newTestClaim(client, "10.0.0.1")
+
+	client.PrependReactor("create", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("lease already exists")
+	})
+
+	owns, _, err := claim.tryClaim(context.Background(), time.Now())
+	assert.Error(t, err)
+	assert.False(t, owns, "failing to write the lease must not count as owning the VM")
+}
+
+func TestReleaseClaim(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	ours := newTestClaim(client, "10.0.0.1")
+	theirs := newTestClaim(client, "10.0.0.2")
+	start := time.Now()
+
+	released, err := ours.release(ctx)
+	require.NoError(t, err)
+	assert.False(t, released, "nothing to release without a lease")
+
+	_, _, err = theirs.tryClaim(ctx, start)
+	require.NoError(t, err)
+
+	// We must not delete another agent's claim
+	released, err = ours.release(ctx)
+	require.NoError(t, err)
+	assert.False(t, released)
+	getTestLease(t, ours)
+
+	released, err = theirs.release(ctx)
+	require.NoError(t, err)
+	assert.True(t, released)
+
+	// With the lease gone, we can claim the VM immediately
+	owns, _, err := ours.tryClaim(ctx, start)
+	require.NoError(t, err)
+	assert.True(t, owns)
+}
+
+func TestRenewOwnership(t *testing.T) {
+	const renewEvery = 10 * time.Millisecond
+
+	runRenewEvery := func(t *testing.T, claim vmClaim, renewEvery time.Duration, lastRenewed time.Time) (<-chan error, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lost := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			renewOwnership(ctx, zap.NewNop(), claim, renewEvery, time.Second, lastRenewed, lost)
+		}()
+		return lost, func() {
+			cancel()
+			<-done
+		}
+	}
+	runRenew := func(t *testing.T, claim vmClaim, lastRenewed time.Time) (<-chan error, func()) {
+		return runRenewEvery(t, claim, renewEvery, lastRenewed)
+	}
+
+	t.Run("keeps renewing", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		claim := newTestClaim(client, "10.0.0.1")
+		start := time.Now()
+		_, _, err := claim.tryClaim(context.Background(), start)
+		require.NoError(t, err)
+
+		lost, stop := runRenew(t, claim, start)
+		time.Sleep(5 * renewEvery)
+		stop()
+
+		assert.Empty(t, lost)
+		assert.True(t, getTestLease(t, claim).Spec.RenewTime.Time.After(start))
+	})
+
+	t.Run("taken over", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		ours := newTestClaim(client, "10.0.0.1")
+		theirs := newTestClaim(client, "10.0.0.2")
+		_, _, err := theirs.tryClaim(context.Background(), time.Now())
+		require.NoError(t, err)
+
+		lost, stop := runRenew(t, ours, time.Now())
+		defer stop()
+
+		select {
+		case err := <-lost:
+			assert.ErrorIs(t, err, errLostOwnership)
+		case <-time.After(time.Second):
+			t.Fatal("expected the lost claim to be reported")
+		}
+	})
+
+	failingClaim := func(t *testing.T) vmClaim {
+		client := fake.NewSimpleClientset()
+		claim := newTestClaim(client, "10.0.0.1")
+		_, _, err := claim.tryClaim(context.Background(), time.Now())
+		require.NoError(t, err)
+		client.PrependReactor("get", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, errors.New("API server unreachable")
+		})
+		return claim
+	}
+
+	t.Run("retries while the claim is valid", func(t *testing.T) {
+		claim := failingClaim(t)
+
+		lost, stop := runRenew(t, claim, time.Now())
+		time.Sleep(5 * renewEvery)
+		stop()
+
+		assert.Empty(t, lost)
+	})
+
+	t.Run("gives up at the renew deadline", func(t *testing.T) {
+		claim := failingClaim(t)
+
+		lost, stop := runRenew(t, claim, time.Now().Add(-claim.renewDeadline+3*renewEvery))
+		defer stop()
+
+		select {
+		case err := <-lost:
+			assert.ErrorIs(t, err, errOwnershipExpired)
+		case <-time.After(time.Second):
+			t.Fatal("expected the expired claim to be reported")
+		}
+	})
+
+	// With renewals far apart, a failed renewal just before the deadline must not leave us managing
+	// the VM until the next one - by then, another agent may already have taken over.
+	t.Run("gives up at the renew deadline between renewals", func(t *testing.T) {
+		claim := failingClaim(t)
+
+		// The renewal at 200ms fails, and the next one would be at 400ms, after the deadline.
+		lastRenewed := time.Now().Add(-claim.renewDeadline + 250*time.Millisecond)
+		lost, stop := runRenewEvery(t, claim, 200*time.Millisecond, lastRenewed)
+		defer stop()
+
+		select {
+		case err := <-lost:
+			assert.ErrorIs(t, err, errOwnershipExpired)
+			stoppedAt := time.Since(lastRenewed)
+			assert.GreaterOrEqual(t, stoppedAt, claim.renewDeadline)
+			assert.Less(t, stoppedAt, claim.renewDeadline+100*time.Millisecond, "should stop at the deadline, not the next renewal")
+		case <-time.After(time.Second):
+			t.Fatal("expected the expired claim to be reported")
+		}
+
+		// ... and well before the lease itself expires
+		assert.Less(t, time.Since(lastRenewed), claim.duration)
+	})
+}
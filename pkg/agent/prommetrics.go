@@ -9,6 +9,8 @@ import (
 
 type GlobalMetrics struct {
 	schedulerRequests        *prometheus.CounterVec
+	schedulerRequestErrors   *prometheus.CounterVec
+	schedulerFailovers       prometheus.Counter
 	schedulerRequestedChange resourceChangePair
 	schedulerApprovedChange  resourceChangePair
 
@@ -17,15 +19,51 @@ type GlobalMetrics struct {
 	monitorRequestedChange  resourceChangePair
 	monitorApprovedChange   resourceChangePair
 
+	// monitorUpscaleRequests counts the UpscaleRequests from vm-monitors, labeled by severity and
+	// reason (both empty if the vm-monitor doesn't send them).
+	monitorUpscaleRequests *prometheus.CounterVec
+
 	neonvmRequestsOutbound *prometheus.CounterVec
 	neonvmRequestedChange  resourceChangePair
 
+	// lfcHitRate, lfcWorkingSetFraction, and lfcTargetFraction are the inputs and outputs of
+	// file cache sizing decisions. See filecache.go.
+	lfcHitRate            prometheus.Histogram
+	lfcWorkingSetFraction prometheus.Histogram
+	lfcTargetFraction     *prometheus.HistogramVec
+	lfcTargetChanges      *prometheus.CounterVec
+
+	// forecastErrorRatio compares the forecasts made for predictive scaling against the actual
+	// metrics, labeled by resource. See core/forecast.go.
+	forecastErrorRatio *prometheus.HistogramVec
+
+	// requestDuration is the duration of requests made as part of scaling, labeled by target
+	// ("scheduler", "monitor", or "neonvm")
+	requestDuration *prometheus.HistogramVec
+
+	// scalingVariantRunners and scalingVariantRequestedChange separate metrics by scaling variant,
+	// for canary rollouts. See canary.go.
+	scalingVariantRunners         *prometheus.GaugeVec
+	scalingVariantRequestedChange resourceChangePair
+
 	runnersCount       *prometheus.GaugeVec
 	runnerFatalErrors  prometheus.Counter
 	runnerThreadPanics prometheus.Counter
 	runnerStarts       prometheus.Counter
 	runnerRestarts     prometheus.Counter
 	runnerNextActions  prometheus.Counter
+
+	nodeCPUSlack prometheus.Gauge
+	nodeMemSlack prometheus.Gauge
+
+	// metricsRequests* and runnersStaleMetrics track the limits on metrics requests to VMs. See
+	// scrapepool.go.
+	metricsRequestsInFlight   prometheus.Gauge
+	metricsRequestsWaiting    prometheus.Gauge
+	metricsRequestWait        prometheus.Histogram
+	metricsRequestsAbandoned  prometheus.Counter
+	metricsIntervalMultiplier prometheus.Gauge
+	runnersStaleMetrics       prometheus.Gauge
 }
 
 type resourceChangePair struct {
@@ -33,6 +71,16 @@ type resourceChangePair struct {
 	mem *prometheus.CounterVec
 }
 
+// forVariant returns the pair with the "variant" label set, for metrics partitioned by scaling
+// variant
+func (p resourceChangePair) forVariant(variant string) resourceChangePair {
+	labels := prometheus.Labels{"variant": variant}
+	return resourceChangePair{
+		cpu: p.cpu.MustCurryWith(labels),
+		mem: p.mem.MustCurryWith(labels),
+	}
+}
+
 const (
 	directionLabel    = "direction"
 	directionValueInc = "inc"
@@ -46,6 +94,9 @@ const (
 	runnerMetricStateStuck    runnerMetricState = "stuck"
 	runnerMetricStateErrored  runnerMetricState = "errored"
 	runnerMetricStatePanicked runnerMetricState = "panicked"
+	// runnerMetricStateDegraded is for runners scaling their VM without a vm-monitor. See
+	// MonitorDegradedModeConfig for more.
+	runnerMetricStateDegraded runnerMetricState = "degraded"
 )
 
 func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
@@ -70,6 +121,19 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 			},
 			[]string{"code"},
 		)),
+		schedulerRequestErrors: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_scheduler_plugin_request_errors_total",
+				Help: "Number of failed requests to the scheduler plugin by autoscaler-agents, by error class",
+			},
+			[]string{"class"},
+		)),
+		schedulerFailovers: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_scheduler_plugin_failovers_total",
+				Help: "Number of failed scheduler plugin requests that were retried with the new holder of the scheduler's leader election lease",
+			},
+		)),
 		schedulerRequestedChange: resourceChangePair{
 			cpu: util.RegisterMetric(reg, prometheus.NewCounterVec(
 				prometheus.CounterOpts{
@@ -118,6 +182,13 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 			},
 			[]string{"endpoint", "code"},
 		)),
+		monitorUpscaleRequests: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_monitor_upscale_requests_total",
+				Help: "Number of upscale requests from vm-monitors, by severity and reason",
+			},
+			[]string{"severity", "reason"},
+		)),
 		monitorRequestedChange: resourceChangePair{
 			cpu: util.RegisterMetric(reg, prometheus.NewCounterVec(
 				prometheus.CounterOpts{
@@ -178,13 +249,89 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 			)),
 		},
 
+		// ---- FILE CACHE ----
+		lfcHitRate: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_lfc_hit_rate",
+				Help:    "Fraction of LFC reads that were hits, between successive fetches of LFC metrics",
+				Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+			},
+		)),
+		lfcWorkingSetFraction: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_lfc_working_set_memory_fraction",
+				Help:    "Estimated LFC working set size, as a fraction of the VM's memory",
+				Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 1.5, 2, 4},
+			},
+		)),
+		lfcTargetFraction: util.RegisterMetric(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_lfc_target_memory_fraction",
+				Help:    "Target LFC size chosen by the autoscaler-agent, as a fraction of the VM's memory",
+				Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+			},
+			[]string{"policy"},
+		)),
+		lfcTargetChanges: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_lfc_target_changes_total",
+				Help: "Number of times the autoscaler-agent changed the target LFC size",
+			},
+			[]string{"policy", directionLabel},
+		)),
+
+		// ---- PREDICTIVE SCALING ----
+		forecastErrorRatio: util.RegisterMetric(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_forecast_error_ratio",
+				Help:    "Error of forecasts for predictive scaling, as (forecast - actual) / actual, by resource",
+				Buckets: []float64{-1, -0.5, -0.25, -0.1, -0.05, 0, 0.05, 0.1, 0.25, 0.5, 1, 2},
+			},
+			[]string{"resource"},
+		)),
+
+		// ---- REQUEST LATENCY ----
+		requestDuration: util.RegisterMetric(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_scaling_request_duration_seconds",
+				Help:    "How long in seconds requests made while scaling took, by target",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+			},
+			[]string{"target"},
+		)),
+
+		// ---- SCALING VARIANTS ----
+		scalingVariantRunners: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_scaling_variant_runners_current",
+				Help: "Number of per-VM runners using each scaling variant",
+			},
+			[]string{"variant"},
+		)),
+		scalingVariantRequestedChange: resourceChangePair{
+			cpu: util.RegisterMetric(reg, prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "autoscaling_agent_scaling_variant_requested_cpu_change_total",
+					Help: "Total change in CPU requested for VMs, by scaling variant",
+				},
+				[]string{"variant", directionLabel},
+			)),
+			mem: util.RegisterMetric(reg, prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "autoscaling_agent_scaling_variant_requested_mem_change_total",
+					Help: "Total change in memory (in MiB) requested for VMs, by scaling variant",
+				},
+				[]string{"variant", directionLabel},
+			)),
+		},
+
 		// ---- RUNNER LIFECYCLE ----
 		runnersCount: util.RegisterMetric(reg, prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "autoscaling_agent_runners_current",
 				Help: "Number of per-VM runners, with associated metadata",
 			},
-			// NB: is_endpoint ∈ ("true", "false"), state ∈ runnerMetricState = ("ok", "stuck", "errored", "panicked")
+			// NB: is_endpoint ∈ ("true", "false"), state ∈ runnerMetricState = ("ok", "stuck", "errored", "panicked", "degraded")
 			[]string{"is_endpoint", "state"},
 		)),
 		runnerFatalErrors: util.RegisterMetric(reg, prometheus.NewCounter(
@@ -217,6 +364,59 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 				Help: "Number of times (*core.State).NextActions() has been called",
 			},
 		)),
+
+		// ---- SLACK ----
+		nodeCPUSlack: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_node_cpu_slack_cores",
+				Help: "Total CPU approved by the scheduler for VMs on this node, but not used by them",
+			},
+		)),
+		nodeMemSlack: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_node_memory_slack_bytes",
+				Help: "Total memory approved by the scheduler for VMs on this node, but not used by them",
+			},
+		)),
+
+		// ---- METRICS REQUESTS ----
+		metricsRequestsInFlight: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_vm_metrics_requests_in_flight",
+				Help: "Number of metrics requests to VMs currently in flight",
+			},
+		)),
+		metricsRequestsWaiting: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_vm_metrics_requests_waiting",
+				Help: "Number of metrics requests to VMs waiting for a worker",
+			},
+		)),
+		metricsRequestWait: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_agent_vm_metrics_request_wait_seconds",
+				Help:    "Time that metrics requests to VMs spent waiting for a worker",
+				Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+			},
+		)),
+		metricsRequestsAbandoned: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_agent_vm_metrics_requests_abandoned_total",
+				Help: "Number of metrics requests to VMs abandoned because their deadline passed while waiting for a worker",
+			},
+		)),
+		metricsIntervalMultiplier: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_vm_metrics_interval_multiplier",
+				Help: "Current factor by which the time between metrics requests to each VM is stretched, due to load",
+			},
+		)),
+		runnersStaleMetrics: util.RegisterMetric(reg, prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_agent_runners_stale_metrics",
+				Help: "Number of per-VM runners whose system metrics haven't been fetched recently",
+			},
+		)),
 	}
 
 	// Some of of the metrics should have default keys set to zero. Otherwise, these won't be filled
@@ -244,6 +444,7 @@ func makeGlobalMetrics() (GlobalMetrics, *prometheus.Registry) {
 		runnerMetricStateStuck,
 		runnerMetricStateErrored,
 		runnerMetricStatePanicked,
+		runnerMetricStateDegraded,
 	}
 	for _, s := range runnerStates {
 		metrics.runnersCount.WithLabelValues("true", string(s)).Set(0.0)
@@ -257,6 +458,8 @@ type PerVMMetrics struct {
 	cpu          *prometheus.GaugeVec
 	memory       *prometheus.GaugeVec
 	restartCount *prometheus.GaugeVec
+	cpuSlack     *prometheus.GaugeVec
+	memorySlack  *prometheus.GaugeVec
 }
 
 type vmResourceValueType string
@@ -312,6 +515,28 @@ func makePerVMMetrics() (PerVMMetrics, *prometheus.Registry) {
 				"project_id",   // .metadata.labels["neon/project-id"]
 			},
 		)),
+		cpuSlack: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_cpu_slack_cores",
+				Help: "CPU approved by the scheduler for a VM, minus its 1-minute load average",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+			},
+		)),
+		memorySlack: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_vm_memory_slack_bytes",
+				Help: "Memory approved by the scheduler for a VM, minus its current memory usage",
+			},
+			[]string{
+				"vm_namespace", // .metadata.namespace
+				"vm_name",      // .metadata.name
+				"endpoint_id",  // .metadata.labels["neon/endpoint-id"]
+			},
+		)),
 	}
 
 	return metrics, reg
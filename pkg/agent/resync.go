@@ -0,0 +1,155 @@
+package agent
+
+// On-demand metrics resync
+//
+// Normally, metrics are fetched from each VM periodically. After a change in a VM's workload, it
+// can be useful to fetch new metrics immediately (and so re-evaluate the VM's desired resources),
+// instead of waiting for the next periodic request.
+//
+// The resync server accepts requests naming a VM. If the VM is on this node, both of its metrics
+// loops are woken up. Requests are rate limited per VM.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// ResyncRequest is the body of a request to the resync server
+type ResyncRequest struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// ResyncResponse is the body of a successful response from the resync server
+type ResyncResponse struct {
+	// PodName is the name of the VM's runner pod
+	PodName util.NamespacedName `json:"podName"`
+}
+
+// metricsResync holds the signals used to wake up a Runner's metrics loops
+type metricsResync struct {
+	txSystem util.CondChannelSender
+	rxSystem util.CondChannelReceiver
+	txLFC    util.CondChannelSender
+	rxLFC    util.CondChannelReceiver
+}
+
+func newMetricsResync() metricsResync {
+	txSystem, rxSystem := util.NewCondChannelPair()
+	txLFC, rxLFC := util.NewCondChannelPair()
+	return metricsResync{
+		txSystem: txSystem,
+		rxSystem: rxSystem,
+		txLFC:    txLFC,
+		rxLFC:    rxLFC,
+	}
+}
+
+func (m *metricsResync) send() {
+	m.txSystem.Send()
+	m.txLFC.Send()
+}
+
+// resyncLimiter tracks the last resync for each VM, so that resyncs can be rate limited
+type resyncLimiter struct {
+	mu       sync.Mutex
+	lastSent map[util.NamespacedName]time.Time
+	minWait  time.Duration
+}
+
+// allow returns whether a resync for the VM is allowed now, and if so, records it.
+//
+// If not allowed, it also returns how long until the next resync will be.
+func (l *resyncLimiter) allow(vmName util.NamespacedName) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := l.lastSent[vmName]; ok {
+		if wait := l.minWait - now.Sub(last); wait > 0 {
+			return false, wait
+		}
+	}
+
+	l.lastSent[vmName] = now
+
+	// Remove old entries while we're here, so that VMs that are gone don't stick around forever.
+	for name, last := range l.lastSent {
+		if now.Sub(last) > l.minWait {
+			delete(l.lastSent, name)
+		}
+	}
+
+	return true, 0
+}
+
+// Resync triggers immediately fetching metrics for the VM, if it's on this node
+func (s *agentState) Resync(ctx context.Context, vmName util.NamespacedName) (*ResyncResponse, int, error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, 500, errclass.Wrap(errclass.TransientInfra, err)
+	}
+	defer s.lock.Unlock()
+
+	var runner *Runner
+	var podName util.NamespacedName
+	for name, pod := range s.pods {
+		if pod.runner.vmName == vmName {
+			runner = pod.runner
+			podName = name
+			break
+		}
+	}
+	if runner == nil {
+		return nil, 404, errclass.Errorf(errclass.UserError, "VM %v is not managed by this autoscaler-agent", vmName)
+	}
+
+	if ok, wait := s.resyncLimiter.allow(vmName); !ok {
+		return nil, 429, errclass.Errorf(errclass.TransientInfra, "VM %v was resynced too recently, try again in %s", vmName, wait)
+	}
+
+	runner.metricsResync.send()
+	return &ResyncResponse{PodName: podName}, 200, nil
+}
+
+// StartResyncServer starts the HTTP server that accepts requests to resync a VM's metrics
+func (s *agentState) StartResyncServer(shutdownCtx context.Context, logger *zap.Logger, config *ResyncConfig) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	util.AddHandler(logger, mux, "/resync", http.MethodPost, "ResyncRequest", func(ctx context.Context, logger *zap.Logger, body *ResyncRequest) (*ResyncResponse, int, error) {
+		if body.Namespace == "" || body.Name == "" {
+			return nil, 400, errclass.Errorf(errclass.UserError, "both namespace and name must be provided")
+		}
+		return s.Resync(ctx, util.NamespacedName{Namespace: body.Namespace, Name: body.Name})
+	})
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-shutdownCtx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Error("Error shutting down resync server", zap.Error(err))
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("resync server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
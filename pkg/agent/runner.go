@@ -17,26 +17,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ktypes "k8s.io/apimachinery/pkg/types"
 
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/agent/core"
 	"github.com/neondatabase/autoscaling/pkg/agent/executor"
 	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
-	"github.com/neondatabase/autoscaling/pkg/util/patch"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 // PluginProtocolVersion is the current version of the agent<->scheduler plugin in use by this
@@ -44,7 +47,11 @@ import (
 //
 // Currently, each autoscaler-agent supports only one version at a time. In the future, this may
 // change.
-const PluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_0
+const PluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_3
+
+// schedulerHTTPClient is the client for HTTP requests to the scheduler plugin, propagating the
+// trace of each request so that the plugin's handling of it is part of the same trace.
+var schedulerHTTPClient = util.InstrumentHTTPClient(http.DefaultClient)
 
 // Runner is per-VM Pod god object responsible for handling everything
 //
@@ -61,11 +68,15 @@ type Runner struct {
 	shutdown context.CancelFunc
 
 	vmName  util.NamespacedName
+	vmUID   ktypes.UID
 	podName util.NamespacedName
 	podIP   string
 
 	memSlotSize api.Bytes
 
+	// scalingVariant is the name of the scaling variant that the VM is assigned to. See canary.go.
+	scalingVariant string
+
 	// lock guards the values of all mutable fields - namely, scheduler and monitor (which may be
 	// read without the lock, but the lock must be acquired to lock them).
 	lock util.ChanMutex
@@ -81,6 +92,14 @@ type Runner struct {
 	// which means that it may be read when EITHER holding lock OR the executor's lock.
 	monitor *monitorInfo
 
+	// schedStreams are the gRPC streams used for scheduler requests, if the scheduler's gRPC API is
+	// enabled. They're only used by DoSchedulerRequest.
+	schedStreams schedulerStreams
+
+	// metricsResync is used to wake up the metrics loops to fetch metrics immediately. See
+	// resync.go.
+	metricsResync metricsResync
+
 	// backgroundWorkerCount tracks the current number of background workers. It is exclusively
 	// updated by r.spawnBackgroundWorker
 	backgroundWorkerCount atomic.Int64
@@ -90,6 +109,7 @@ type Runner struct {
 // RunnerState is the serializable state of the Runner, extracted by its State method
 type RunnerState struct {
 	PodIP                 string             `json:"podIP"`
+	ScalingVariant        string             `json:"scalingVariant"`
 	ExecutorState         executor.StateDump `json:"executorState"`
 	Monitor               *MonitorState      `json:"monitor"`
 	BackgroundWorkerCount int64              `json:"backgroundWorkerCount"`
@@ -126,6 +146,7 @@ func (r *Runner) State(ctx context.Context) (*RunnerState, error) {
 
 	return &RunnerState{
 		PodIP:                 r.podIP,
+		ScalingVariant:        r.scalingVariant,
 		ExecutorState:         *executorState,
 		Monitor:               monitorState,
 		BackgroundWorkerCount: r.backgroundWorkerCount.Load(),
@@ -180,11 +201,43 @@ func (r *Runner) Spawn(ctx context.Context, logger *zap.Logger, vmInfoUpdated ut
 func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util.CondChannelReceiver) error {
 	ctx, r.shutdown = context.WithCancel(ctx)
 	defer r.shutdown()
+	defer r.schedStreams.close()
+
+	variantRunners := r.global.metrics.scalingVariantRunners.WithLabelValues(r.scalingVariant)
+	variantRunners.Inc()
+	defer variantRunners.Dec()
+
+	// If required, wait until we've claimed the VM before doing anything with it, so that we don't
+	// conflict with another autoscaler-agent that's still managing it (e.g. during a rollout).
+	// See ownership.go for more.
+	ownershipLost := make(chan error, 1)
+	if ownershipConfig := r.global.config.Ownership; ownershipConfig != nil {
+		claimedAt, err := r.waitForOwnership(ctx, logger, *ownershipConfig)
+		if err != nil {
+			return nil // context was canceled
+		}
+		defer func() {
+			r.shutdown() // stop all background workers before releasing the claim
+			r.releaseVMClaim(logger, *ownershipConfig)
+		}()
+		r.spawnBackgroundWorker(ctx, logger, "ownership renewal", func(ctx2 context.Context, logger2 *zap.Logger) {
+			renewOwnership(
+				ctx2,
+				logger2,
+				r.vmClaim(*ownershipConfig),
+				time.Second*time.Duration(ownershipConfig.RenewEverySeconds),
+				time.Second*time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds),
+				claimedAt,
+				ownershipLost,
+			)
+		})
+	}
 
 	getVmInfo := func() api.VmInfo {
 		r.status.mu.Lock()
 		defer r.status.mu.Unlock()
-		return r.status.vmInfo
+		vmInfo, _ := r.status.vmInfo.WithScalingSchedule(time.Now())
+		return vmInfo
 	}
 
 	execLogger := logger.Named("exec")
@@ -193,23 +246,49 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 	// tend to become distribted randomly over time.
 	pluginRequestJitter := util.NewTimeRange(time.Millisecond, 0, 100).Random()
 
+	monitorConfig := r.monitorConfig()
+
 	coreExecLogger := execLogger.Named("core")
 	executorCore := executor.NewExecutorCore(coreExecLogger, getVmInfo(), executor.Config{
 		OnNextActions: r.global.metrics.runnerNextActions.Inc,
+		OnScalingStarted: func(correlationID string, inputs core.ScalingInputs, actions core.ActionSet) {
+			r.global.scalingJournal.start(r.vmName, correlationID, inputs, actions)
+		},
+		OnScalingFinished: r.global.scalingJournal.finish,
 		Core: core.Config{
-			ComputeUnit:                        r.global.config.Scaling.ComputeUnit,
-			DefaultScalingConfig:               r.global.config.Scaling.DefaultConfig,
-			NeonVMRetryWait:                    time.Second * time.Duration(r.global.config.NeonVM.RetryFailedRequestSeconds),
-			PluginRequestTick:                  time.Second*time.Duration(r.global.config.Scheduler.RequestAtLeastEverySeconds) - pluginRequestJitter,
-			PluginRetryWait:                    time.Second * time.Duration(r.global.config.Scheduler.RetryFailedRequestSeconds),
-			PluginDeniedRetryWait:              time.Second * time.Duration(r.global.config.Scheduler.RetryDeniedUpscaleSeconds),
-			MonitorDeniedDownscaleCooldown:     time.Second * time.Duration(r.global.config.Monitor.RetryDeniedDownscaleSeconds),
-			MonitorRequestedUpscaleValidPeriod: time.Second * time.Duration(r.global.config.Monitor.RequestedUpscaleValidSeconds),
-			MonitorRetryWait:                   time.Second * time.Duration(r.global.config.Monitor.RetryFailedRequestSeconds),
+			ComputeUnit:                          r.global.config.Scaling.ComputeUnit,
+			DefaultScalingConfig:                 r.global.config.Scaling.defaultConfigFor(r.scalingVariant),
+			NeonVMRetryWait:                      time.Second * time.Duration(r.global.config.NeonVM.RetryFailedRequestSeconds),
+			PluginRequestTick:                    time.Second*time.Duration(r.global.config.Scheduler.RequestAtLeastEverySeconds) - pluginRequestJitter,
+			PluginRetryWait:                      time.Second * time.Duration(r.global.config.Scheduler.RetryFailedRequestSeconds),
+			PluginDeniedRetryWait:                time.Second * time.Duration(r.global.config.Scheduler.RetryDeniedUpscaleSeconds),
+			PluginDeniedRetryWaitBatch:           time.Second * time.Duration(r.global.config.Scheduler.RetryDeniedUpscaleSecondsBatch),
+			PluginLeaseRenewBefore:               time.Second * time.Duration(r.global.config.Scheduler.RenewLeaseBeforeExpirySeconds),
+			MonitorDeniedDownscaleCooldown:       time.Second * time.Duration(monitorConfig.RetryDeniedDownscaleSeconds),
+			MonitorRequestedUpscaleValidPeriod:   time.Second * time.Duration(monitorConfig.RequestedUpscaleValidSeconds),
+			MonitorUpscaleComputeUnitsBySeverity: monitorConfig.UpscaleComputeUnitsBySeverity,
+			MonitorRetryWait:                     time.Second * time.Duration(monitorConfig.RetryFailedRequestSeconds),
+			DegradedMemoryFloorFraction: func() float64 {
+				if monitorConfig.DegradedMode != nil {
+					return monitorConfig.DegradedMode.MemoryFloorFraction
+				}
+				return 0
+			}(),
 			Log: core.LogConfig{
 				Info: coreExecLogger.Info,
 				Warn: coreExecLogger.Warn,
 			},
+			ObserveForecast: func(predicted, actual core.SystemMetrics) {
+				// Without any load, the relative error isn't meaningful.
+				if actual.LoadAverage1Min > 0 {
+					r.global.metrics.forecastErrorRatio.WithLabelValues("cpu").
+						Observe((predicted.LoadAverage1Min - actual.LoadAverage1Min) / actual.LoadAverage1Min)
+				}
+				if actual.MemoryUsageBytes > 0 {
+					r.global.metrics.forecastErrorRatio.WithLabelValues("memory").
+						Observe((predicted.MemoryUsageBytes - actual.MemoryUsageBytes) / actual.MemoryUsageBytes)
+				}
+			},
 		},
 	})
 
@@ -228,6 +307,17 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 		Monitor: monitorIface,
 	})
 
+	fileCacheUpdatedSender, fileCacheUpdated := util.NewCondChannelPair()
+	fileCache := &fileCacheSizer{
+		mu:          sync.Mutex{},
+		lastMetrics: nil,
+		target:      0,
+		memory:      0,
+		sent:        0,
+		sentTo:      executor.GenerationNumber{},
+		updated:     fileCacheUpdatedSender,
+	}
+
 	logger.Info("Starting background workers")
 
 	// FIXME: make this timeout/delay a separately defined constant, or configurable
@@ -250,54 +340,91 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 			}
 		}
 	})
+	r.spawnBackgroundWorker(ctx, logger, "scaling schedule watcher", func(ctx2 context.Context, logger2 *zap.Logger) {
+		r.watchScalingSchedule(ctx2, logger2, func() {
+			vm := getVmInfo()
+			ecwc.Updater().UpdatedVM(vm, func() {
+				logger2.Info("VmInfo updated for scaling schedule", zap.Any("vmInfo", vm))
+			})
+		})
+	})
 	r.spawnBackgroundWorker(ctx, logger, "get system metrics", func(ctx2 context.Context, logger2 *zap.Logger) {
 		getMetricsLoop(
-			r,
 			ctx2,
 			logger2,
-			r.global.config.Metrics.System,
 			metricsMgr[*core.SystemMetrics]{
 				kind:         "system",
 				emptyMetrics: func() *core.SystemMetrics { return new(core.SystemMetrics) },
-				isActive:     func() bool { return true },
+				source: func() (metricsSource, error) {
+					return r.systemMetricsSource(getVmInfo())
+				},
+				isActive: func() bool { return true },
+				resync:   r.metricsResync.rxSystem,
 				updateMetrics: func(metrics *core.SystemMetrics, withLock func()) {
 					ecwc.Updater().UpdateSystemMetrics(*metrics, withLock)
+
+					usage := *metrics
+					now := time.Now()
+					r.status.update(r.global, func(ps podStatus) podStatus {
+						ps.usage = &usage
+						ps.lastMetricsAt = &now
+						return ps
+					})
 				},
 			},
 		)
 	})
 	r.spawnBackgroundWorker(ctx, logger, "get LFC metrics", func(ctx2 context.Context, logger2 *zap.Logger) {
+		lfcSource := &scrapeMetricsSource{
+			sourceName: "lfc",
+			podIP:      r.podIP,
+			path:       "/metrics",
+			config:     r.global.config.Metrics.LFC,
+			renames:    nil,
+			pool:       r.global.scrapePool,
+		}
 		getMetricsLoop(
-			r,
 			ctx2,
 			logger2,
-			r.global.config.Metrics.LFC,
 			metricsMgr[*core.LFCMetrics]{
 				kind:         "LFC",
 				emptyMetrics: func() *core.LFCMetrics { return new(core.LFCMetrics) },
+				source:       func() (metricsSource, error) { return lfcSource, nil },
 				isActive: func() bool {
 					scalingConfig := r.global.config.Scaling.DefaultConfig.WithOverrides(getVmInfo().Config.ScalingConfig)
 					return *scalingConfig.EnableLFCMetrics // guaranteed non-nil as a required field.
 				},
+				resync: r.metricsResync.rxLFC,
 				updateMetrics: func(metrics *core.LFCMetrics, withLock func()) {
 					ecwc.Updater().UpdateLFCMetrics(*metrics, withLock)
+					fileCache.update(r, logger2, getVmInfo(), *metrics)
 				},
 			},
 		)
 	})
+	r.spawnBackgroundWorker(ctx, logger.Named("file-cache"), "file cache target sender", func(ctx2 context.Context, logger2 *zap.Logger) {
+		r.sendFileCacheTargets(ctx2, logger2, fileCache, fileCacheUpdated)
+	})
 	r.spawnBackgroundWorker(ctx, logger.Named("vm-monitor"), "vm-monitor reconnection loop", func(ctx2 context.Context, logger2 *zap.Logger) {
 		r.connectToMonitorLoop(ctx2, logger2, monitorGeneration, monitorStateCallbacks{
 			reset: func(withLock func()) {
 				ecwc.Updater().ResetMonitor(withLock)
 			},
-			upscaleRequested: func(request api.MoreResources, withLock func()) {
-				ecwc.Updater().UpscaleRequested(request, withLock)
+			upscaleRequested: func(request api.MoreResources, severity api.UpscaleSeverity, withLock func()) {
+				ecwc.Updater().UpscaleRequested(request, severity, withLock)
 			},
 			setActive: func(active bool, withLock func()) {
 				ecwc.Updater().MonitorActive(active, withLock)
 			},
 		})
 	})
+	if monitorConfig.DegradedMode != nil {
+		r.spawnBackgroundWorker(ctx, logger.Named("vm-monitor"), "vm-monitor degraded mode timer", func(ctx2 context.Context, logger2 *zap.Logger) {
+			r.enterDegradedModeAfter(ctx2, logger2, *monitorConfig.DegradedMode, func(withLock func()) {
+				ecwc.Updater().MonitorDegraded(withLock)
+			})
+		})
+	}
 	r.spawnBackgroundWorker(ctx, execLogger.Named("sleeper"), "executor: sleeper", ecwc.DoSleeper)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("plugin"), "executor: plugin", ecwc.DoPluginRequests)
 	r.spawnBackgroundWorker(ctx, execLogger.Named("neonvm"), "executor: neonvm", ecwc.DoNeonVMRequests)
@@ -305,10 +432,13 @@ func (r *Runner) Run(ctx context.Context, logger *zap.Logger, vmInfoUpdated util
 	r.spawnBackgroundWorker(ctx, execLogger.Named("vm-monitor-upscale"), "executor: vm-monitor upscale", ecwc.DoMonitorUpscales)
 
 	// Note: Run doesn't terminate unless the parent context is cancelled - either because the VM
-	// pod was deleted, or the autoscaler-agent is exiting.
+	// pod was deleted, or the autoscaler-agent is exiting - or another autoscaler-agent has taken
+	// over the VM.
 	select {
 	case <-ctx.Done():
 		return nil
+	case err := <-ownershipLost:
+		return err
 	case err := <-r.backgroundPanic:
 		panic(err)
 	}
@@ -385,6 +515,10 @@ type metricsMgr[M core.FromPrometheus] struct {
 	// but at the time we decided this is the least convoluted way.
 	emptyMetrics func() M
 
+	// source returns where the metrics should currently be fetched from. If there's an error, a
+	// fallback source must still be returned.
+	source func() (metricsSource, error)
+
 	// isActive returns whether these metrics should currently be collected for the VM.
 	//
 	// For example, with LFC metrics, we return false if they are not enabled for the VM.
@@ -392,21 +526,27 @@ type metricsMgr[M core.FromPrometheus] struct {
 
 	// updateMetrics is a callback to update the internal state with new values for these metrics.
 	updateMetrics func(metrics M, withLock func())
+
+	// resync is notified when metrics should be fetched immediately, instead of waiting for the
+	// next periodic request.
+	resync util.CondChannelReceiver
 }
 
 // getMetricsLoop repeatedly attempts to fetch metrics from the VM
 //
 // Every time metrics are successfully fetched, the value is recorded with mgr.updateMetrics().
 func getMetricsLoop[M core.FromPrometheus](
-	r *Runner,
 	ctx context.Context,
 	logger *zap.Logger,
-	config MetricsSourceConfig,
 	mgr metricsMgr[M],
 ) {
-	waitBetweenDuration := time.Second * time.Duration(config.SecondsBetweenRequests)
+	source, err := mgr.source()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error selecting %s metrics source", mgr.kind), zap.Error(err))
+	}
+	lastSourceName := source.name()
 
-	randomStartWait := util.NewTimeRange(time.Second, 0, int(config.SecondsBetweenRequests)).Random()
+	randomStartWait := util.NewTimeRange(time.Second, 0, int(source.interval().Seconds())).Random()
 
 	lastActive := mgr.isActive()
 
@@ -418,6 +558,7 @@ func getMetricsLoop[M core.FromPrometheus](
 		logger.Info(
 			fmt.Sprintf("Sleeping for random delay before making first %s metrics request", mgr.kind),
 			zap.Duration("delay", randomStartWait),
+			zap.String("source", lastSourceName),
 		)
 	}
 
@@ -428,6 +569,20 @@ func getMetricsLoop[M core.FromPrometheus](
 	}
 
 	for {
+		// The source may change if the VM's annotations are updated.
+		source, err = mgr.source()
+		if source.name() != lastSourceName {
+			if err != nil {
+				logger.Error(fmt.Sprintf("Error selecting %s metrics source", mgr.kind), zap.Error(err))
+			}
+			logger.Info(
+				fmt.Sprintf("Switched %s metrics source", mgr.kind),
+				zap.String("previous", lastSourceName),
+				zap.String("source", source.name()),
+			)
+			lastSourceName = source.name()
+		}
+
 		if !mgr.isActive() {
 			if lastActive {
 				logger.Info(fmt.Sprintf("VM is no longer active for %s metrics requests", mgr.kind))
@@ -440,9 +595,9 @@ func getMetricsLoop[M core.FromPrometheus](
 			lastActive = true
 
 			metrics := mgr.emptyMetrics()
-			err := doMetricsRequest(r, ctx, logger, metrics, config)
+			err := source.fetch(ctx, logger, metrics)
 			if err != nil {
-				logger.Error("Error making metrics request", zap.Error(err))
+				logger.Error("Error making metrics request", zap.String("source", source.name()), zap.Error(err))
 				goto next
 			}
 
@@ -455,7 +610,9 @@ func getMetricsLoop[M core.FromPrometheus](
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(waitBetweenDuration):
+		case <-time.After(source.interval()):
+		case <-mgr.resync.Recv():
+			logger.Info(fmt.Sprintf("Fetching %s metrics early because of resync request", mgr.kind))
 		}
 	}
 }
@@ -467,10 +624,18 @@ type monitorInfo struct {
 
 type monitorStateCallbacks struct {
 	reset            func(withLock func())
-	upscaleRequested func(request api.MoreResources, withLock func())
+	upscaleRequested func(request api.MoreResources, severity api.UpscaleSeverity, withLock func())
 	setActive        func(active bool, withLock func())
 }
 
+// monitorConfig returns the configuration for the connection to the vm-monitor, with any overrides
+// for the VM applied
+func (r *Runner) monitorConfig() MonitorConfig {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+	return r.global.config.Monitor.ForVM(r.status.vmInfo.Config)
+}
+
 // connectToMonitorLoop does lifecycle management of the (re)connection to the vm-monitor
 func (r *Runner) connectToMonitorLoop(
 	ctx context.Context,
@@ -478,9 +643,9 @@ func (r *Runner) connectToMonitorLoop(
 	generation *executor.StoredGenerationNumber,
 	callbacks monitorStateCallbacks,
 ) {
-	addr := fmt.Sprintf("ws://%s:%d/monitor", r.podIP, r.global.config.Monitor.ServerPort)
+	addr := fmt.Sprintf("ws://%s/monitor", net.JoinHostPort(r.podIP, fmt.Sprint(r.global.config.Monitor.ServerPort)))
 
-	minWait := time.Second * time.Duration(r.global.config.Monitor.ConnectionRetryMinWaitSeconds)
+	minWait := time.Second * time.Duration(r.monitorConfig().ConnectionRetryMinWaitSeconds)
 	var lastStart time.Time
 
 	for i := 0; ; i += 1 {
@@ -570,6 +735,11 @@ func (r *Runner) connectToMonitorLoop(
 				logger.Info("Connected to vm-monitor")
 			})
 		}()
+		r.status.update(r.global, func(stat podStatus) podStatus {
+			stat.degraded = false
+			return stat
+		})
+		r.setAgentConnectedAnnotation(logger, true)
 
 		// Wait until the dispatcher is no longer running, either due to error or because the
 		// root-level Runner context was canceled.
@@ -578,67 +748,122 @@ func (r *Runner) connectToMonitorLoop(
 		if err := dispatcher.ExitError(); err != nil {
 			logger.Error("Dispatcher for vm-monitor connection exited due to error", zap.Error(err))
 		}
+		r.setAgentConnectedAnnotation(logger, false)
 	}
 }
 
-//////////////////////////////////////////
-// Lower-level implementation functions //
-//////////////////////////////////////////
-
-// doMetricsRequest makes a single metrics request to the VM, writing the result into 'metrics'
-func doMetricsRequest(
-	r *Runner,
+// enterDegradedModeAfter waits for the configured duration and then, if the vm-monitor has never
+// connected, switches the VM to degraded mode - scaling it without the vm-monitor.
+//
+// If the vm-monitor connects later, connectToMonitorLoop takes the VM out of degraded mode.
+func (r *Runner) enterDegradedModeAfter(
 	ctx context.Context,
 	logger *zap.Logger,
-	metrics core.FromPrometheus,
-	config MetricsSourceConfig,
-) error {
-	url := fmt.Sprintf("http://%s:%d/metrics", r.podIP, config.Port)
+	config MonitorDegradedModeConfig,
+	setDegraded func(withLock func()),
+) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second * time.Duration(config.AfterSeconds)):
+	}
 
-	timeout := time.Second * time.Duration(config.RequestTimeoutSeconds)
-	reqCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, bytes.NewReader(nil))
-	if err != nil {
-		panic(fmt.Errorf("Error constructing metrics request to %q: %w", url, err))
+	r.status.mu.Lock()
+	everConnected := r.monitor != nil || r.status.lastSuccessfulMonitorComm != nil
+	r.status.mu.Unlock()
+	if everConnected {
+		return
 	}
 
-	logger.Info("Making metrics request to VM", zap.String("url", url))
+	setDegraded(func() {
+		logger.Warn(
+			"vm-monitor has not connected, entering degraded mode",
+			zap.Duration("after", time.Second*time.Duration(config.AfterSeconds)),
+		)
+	})
+	r.status.update(r.global, func(stat podStatus) podStatus {
+		stat.degraded = true
+		return stat
+	})
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if ctx.Err() != nil {
-		return ctx.Err()
-	} else if err != nil {
-		return fmt.Errorf("Error making request to %q: %w", url, err)
+// setAgentConnectedAnnotation records whether we're connected to the vm-monitor on the VM object,
+// for the NeonVM controller's AgentConnected condition.
+//
+// Failures are only logged: the annotation is informational, and will be corrected on the next
+// change in the connection.
+func (r *Runner) setAgentConnectedAnnotation(logger *zap.Logger, connected bool) {
+	patchPayload, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				vmapi.VirtualMachineAgentConnectedAnnotation: strconv.FormatBool(connected),
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling JSON merge patch: %w", err))
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Unsuccessful response status %d", resp.StatusCode)
+	// Use a fresh context, so that we can still record the disconnect while the Runner is exiting.
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err = r.global.vmClient.NeonvmV1().VirtualMachines(r.vmName.Namespace).
+		Patch(ctx, r.vmName.Name, ktypes.MergePatchType, patchPayload, metav1.PatchOptions{})
+	if err != nil {
+		logger.Warn("Failed to update VM agent-connected annotation", zap.Bool("connected", connected), zap.Error(err))
 	}
+}
+
+//////////////////////////////////////////
+// Lower-level implementation functions //
+//////////////////////////////////////////
 
-	if err := core.ParseMetrics(resp.Body, metrics); err != nil {
-		return fmt.Errorf("Error parsing metrics from prometheus output: %w", err)
+func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) (err error) {
+	ctx, span := util.StartSpan(ctx, "NeonVM request",
+		attribute.String("k8s.pod.name", fmt.Sprint(r.podName)),
+		attribute.String("vm.name", r.vmName.Name),
+		attribute.String("autoscaling.correlation_id", util.CorrelationIDFromContext(ctx)),
+	)
+	defer func() { util.EndSpan(span, err) }()
+
+	// Record the scaling transaction alongside the change, so that the NeonVM controller can
+	// include it in its logs and events, and its trace, so that the controller's spans can refer
+	// to it. Setting the annotations to null removes any stale values.
+	//
+	// We use a JSON merge patch here (rather than a JSON patch) because the VM may not have any
+	// annotations, in which case adding one with a JSON patch would fail.
+	var correlationID any = nil
+	if id := util.CorrelationIDFromContext(ctx); id != "" {
+		correlationID = id
+	}
+	var traceParent any = nil
+	if tp := util.TraceParentFromContext(ctx); tp != "" {
+		traceParent = tp
 	}
 
-	return nil
-}
+	patchData := map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{
+				vmapi.VirtualMachineScalingCorrelationIDAnnotation: correlationID,
+				vmapi.VirtualMachineScalingTraceParentAnnotation:   traceParent,
+			},
+		},
+		"spec": map[string]any{
+			"guest": map[string]any{
+				"cpus":        map[string]any{"use": target.VCPU.ToResourceQuantity()},
+				"memorySlots": map[string]any{"use": uint32(target.Mem / r.memSlotSize)},
+			},
+		},
+	}
 
-func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) error {
-	patches := []patch.Operation{{
-		Op:    patch.OpReplace,
-		Path:  "/spec/guest/cpus/use",
-		Value: target.VCPU.ToResourceQuantity(),
-	}, {
-		Op:    patch.OpReplace,
-		Path:  "/spec/guest/memorySlots/use",
-		Value: uint32(target.Mem / r.memSlotSize),
-	}}
-
-	patchPayload, err := json.Marshal(patches)
+	patchPayload, err := json.Marshal(patchData)
 	if err != nil {
-		panic(fmt.Errorf("Error marshalling JSON patch: %w", err))
+		panic(fmt.Errorf("Error marshalling JSON merge patch: %w", err))
 	}
 
 	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
@@ -649,7 +874,7 @@ func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) erro
 	//
 	// Also relevant: <https://github.com/neondatabase/autoscaling/issues/23>
 	_, err = r.global.vmClient.NeonvmV1().VirtualMachines(r.vmName.Namespace).
-		Patch(requestCtx, r.vmName.Name, ktypes.JSONPatchType, patchPayload, metav1.PatchOptions{})
+		Patch(requestCtx, r.vmName.Name, ktypes.MergePatchType, patchPayload, metav1.PatchOptions{})
 
 	if err != nil {
 		r.global.metrics.neonvmRequestsOutbound.WithLabelValues(fmt.Sprintf("[error: %s]", util.RootError(err))).Inc()
@@ -660,6 +885,12 @@ func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) erro
 	return nil
 }
 
+// observeRequestDuration records the duration of a request to the target that started at start,
+// linked to the trace in ctx, if there is one
+func (r *Runner) observeRequestDuration(ctx context.Context, target string, start time.Time) {
+	util.ObserveWithTrace(ctx, r.global.metrics.requestDuration.WithLabelValues(target), time.Since(start).Seconds())
+}
+
 func (r *Runner) recordResourceChange(current, target api.Resources, metrics resourceChangePair) {
 	getDirection := func(targetIsGreater bool) string {
 		if targetIsGreater {
@@ -700,10 +931,17 @@ func doMonitorDownscale(
 	r := dispatcher.runner
 	rawResources := target.ConvertToAllocation()
 
-	timeout := time.Second * time.Duration(r.global.config.Monitor.ResponseTimeoutSeconds)
+	timeout := time.Second * time.Duration(r.monitorConfig().ResponseTimeoutSeconds)
+
+	// Older monitors may reject unknown fields, so only send the correlation ID if supported.
+	var correlationID string
+	if dispatcher.Supports(api.MonitorCapCorrelationIDs) {
+		correlationID = util.CorrelationIDFromContext(ctx)
+	}
 
 	res, err := dispatcher.Call(ctx, logger, timeout, "DownscaleRequest", api.DownscaleRequest{
-		Target: rawResources,
+		Target:        rawResources,
+		CorrelationID: correlationID,
 	})
 	if err != nil {
 		return nil, err
@@ -721,10 +959,17 @@ func doMonitorUpscale(
 	r := dispatcher.runner
 	rawResources := target.ConvertToAllocation()
 
-	timeout := time.Second * time.Duration(r.global.config.Monitor.ResponseTimeoutSeconds)
+	timeout := time.Second * time.Duration(r.monitorConfig().ResponseTimeoutSeconds)
+
+	// Older monitors may reject unknown fields, so only send the correlation ID if supported.
+	var correlationID string
+	if dispatcher.Supports(api.MonitorCapCorrelationIDs) {
+		correlationID = util.CorrelationIDFromContext(ctx)
+	}
 
 	_, err := dispatcher.Call(ctx, logger, timeout, "UpscaleNotification", api.UpscaleNotification{
-		Granted: rawResources,
+		Granted:       rawResources,
+		CorrelationID: correlationID,
 	})
 	return err
 }
@@ -738,39 +983,90 @@ func (r *Runner) DoSchedulerRequest(
 	metrics *api.Metrics,
 ) (_ *api.PluginResponse, err error) {
 	reqData := &api.AgentRequest{
-		ProtoVersion: PluginProtocolVersion,
-		Pod:          r.podName,
-		ComputeUnit:  r.global.config.Scaling.ComputeUnit,
-		Resources:    resources,
-		LastPermit:   lastPermit,
-		Metrics:      metrics,
+		ProtoVersion:  PluginProtocolVersion,
+		Pod:           r.podName,
+		ComputeUnit:   r.global.config.Scaling.ComputeUnit,
+		Resources:     resources,
+		LastPermit:    lastPermit,
+		Metrics:       metrics,
+		CorrelationID: util.CorrelationIDFromContext(ctx),
 	}
 
-	// make sure we log any error we're returning:
+	ctx, span := util.StartSpan(ctx, "Scheduler request",
+		attribute.String("k8s.pod.name", fmt.Sprint(r.podName)),
+		attribute.String("autoscaling.correlation_id", reqData.CorrelationID),
+	)
+	defer func() { util.EndSpan(span, err) }()
+
+	// make sure we log and count any error we're returning:
 	defer func() {
 		if err != nil {
-			logger.Error("Scheduler request failed", zap.Error(err))
+			class := errclass.Of(err)
+			r.global.metrics.schedulerRequestErrors.WithLabelValues(string(class)).Inc()
+			logger.Error("Scheduler request failed", zap.String("errorClass", string(class)), zap.Error(err))
 		}
 	}()
 
-	sched := r.global.schedTracker.Get()
+	sched := r.global.currentScheduler(time.Now())
 	if sched == nil {
-		err := errors.New("no known ready scheduler to send request to")
+		var err error
+		if failover := r.global.config.Scheduler.Failover; failover != nil {
+			err = errclass.Errorf(errclass.TransientInfra, "no ready scheduler holds the lease %q to send request to", failover.LeaseName)
+		} else {
+			err = errclass.Errorf(errclass.TransientInfra, "no known ready scheduler to send request to")
+		}
 		description := fmt.Sprintf("[error doing request: %s]", err)
 		r.global.metrics.schedulerRequests.WithLabelValues(description).Inc()
 		return nil, err
 	}
 
+	ips := []string{sched.IP}
+	if r.global.schedGRPC != nil {
+		r.global.schedGRPC.retain(logger, ips)
+	}
+	r.schedStreams.retain(ips)
+
+	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
+
+	return r.doSchedulerRequestWithFailover(ctx, logger, *sched, timeout, reqData)
+}
+
+// doSchedulerRequestTo sends the request to a single scheduler pod, over gRPC if enabled (falling
+// back to HTTP if we can't connect), and does not validate the response.
+func (r *Runner) doSchedulerRequestTo(
+	ctx context.Context,
+	logger *zap.Logger,
+	sched schedwatch.SchedulerInfo,
+	timeout time.Duration,
+	reqData *api.AgentRequest,
+) (*api.PluginResponse, error) {
+	if r.global.schedGRPC != nil {
+		logger.Info("Sending request to scheduler over gRPC", zap.Any("request", reqData))
+
+		resp, err := r.doGRPCSchedulerRequest(ctx, logger, r.global.schedGRPC, sched.IP, timeout, reqData)
+		if err == nil {
+			r.global.metrics.schedulerRequests.WithLabelValues("200").Inc()
+			logger.Info("Received response from scheduler", zap.Any("response", resp))
+			return resp, nil
+		}
+
+		r.global.metrics.schedulerRequests.WithLabelValues(grpcRequestErrorDescription(err)).Inc()
+		schedErr, fallback := grpcSchedulerError(err)
+		if !fallback {
+			return nil, schedErr
+		}
+		logger.Warn("Could not connect to scheduler over gRPC, falling back to HTTP", zap.Error(err))
+	}
+
 	reqBody, err := json.Marshal(reqData)
 	if err != nil {
 		return nil, fmt.Errorf("Error encoding request JSON: %w", err)
 	}
 
-	timeout := time.Second * time.Duration(r.global.config.NeonVM.RequestTimeoutSeconds)
 	reqCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s:%d/", sched.IP, r.global.config.Scheduler.RequestPort)
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(sched.IP, fmt.Sprint(r.global.config.Scheduler.RequestPort)))
 
 	request, err := http.NewRequestWithContext(reqCtx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
@@ -780,7 +1076,7 @@ func (r *Runner) DoSchedulerRequest(
 
 	logger.Info("Sending request to scheduler", zap.Any("request", reqData))
 
-	response, err := http.DefaultClient.Do(request)
+	response, err := schedulerHTTPClient.Do(request)
 	if err != nil {
 		description := fmt.Sprintf("[error doing request: %s]", util.RootError(err))
 		r.global.metrics.schedulerRequests.WithLabelValues(description).Inc()
@@ -795,16 +1091,24 @@ func (r *Runner) DoSchedulerRequest(
 		return nil, fmt.Errorf("Error reading body for response: %w", err)
 	}
 
-	if response.StatusCode != 200 {
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errclass.Errorf(
+			errclass.FromHTTPResponse(response),
+			"Received response status %d body %q: %w", response.StatusCode, string(respBody), errSchedulerDoesNotKnowPod,
+		)
+	} else if response.StatusCode != 200 {
 		// Fatal because 4XX implies our state doesn't match theirs, 5XX means we can't assume
 		// current contents of the state, and anything other than 200, 4XX, or 5XX shouldn't happen
-		return nil, fmt.Errorf("Received response status %d body %q", response.StatusCode, string(respBody))
+		return nil, errclass.Errorf(
+			errclass.FromHTTPResponse(response),
+			"Received response status %d body %q", response.StatusCode, string(respBody),
+		)
 	}
 
 	var respData api.PluginResponse
 	if err := json.Unmarshal(respBody, &respData); err != nil {
 		// Fatal because invalid JSON might also be semantically invalid
-		return nil, fmt.Errorf("Bad JSON response: %w", err)
+		return nil, errclass.Errorf(errclass.Bug, "Bad JSON response: %w", err)
 	}
 
 	logger.Info("Received response from scheduler", zap.Any("response", respData))
@@ -0,0 +1,101 @@
+package agent
+
+// Failover between scheduler pods, with .scheduler.failover. See SchedulerFailoverConfig for more.
+//
+// Only the scheduler pod holding the scheduler's leader election lease is sent requests. The other
+// replicas aren't scheduling pods, so they don't know about the pod (or only have a stale view of
+// its node), and approvals from them could overcommit the node.
+//
+// If a request to the lease holder fails with a transient error and the lease has since moved to
+// another ready scheduler pod, we retry the request with the new holder. A scheduler responding
+// that it doesn't know about the pod never triggers failover: it means the scheduler is up, just
+// not the one we should be talking to, and the next request will go to the new holder anyway.
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// errSchedulerDoesNotKnowPod is wrapped by the error returned when the scheduler responds with 404,
+// meaning that it doesn't know about the pod.
+var errSchedulerDoesNotKnowPod = errors.New("scheduler does not know about the pod")
+
+// currentScheduler returns the scheduler pod to send requests to, or nil if there isn't one.
+//
+// With failover enabled, that's the ready scheduler pod holding the leader election lease.
+// Otherwise, it's the newest ready scheduler pod.
+func (s *agentState) currentScheduler(now time.Time) *schedwatch.SchedulerInfo {
+	if s.config.Scheduler.Failover != nil {
+		return s.schedTracker.GetLeaseHolder(now)
+	}
+	return s.schedTracker.Get()
+}
+
+// doSchedulerRequestWithFailover sends the request to the scheduler pod, failing over to the new
+// lease holder if the request fails with a transient error and the lease has moved.
+func (r *Runner) doSchedulerRequestWithFailover(
+	ctx context.Context,
+	logger *zap.Logger,
+	sched schedwatch.SchedulerInfo,
+	timeout time.Duration,
+	reqData *api.AgentRequest,
+) (*api.PluginResponse, error) {
+	return doWithFailover(
+		logger,
+		sched,
+		func() *schedwatch.SchedulerInfo {
+			if r.global.config.Scheduler.Failover == nil {
+				return nil
+			}
+			return r.global.currentScheduler(time.Now())
+		},
+		func(sched schedwatch.SchedulerInfo) (*api.PluginResponse, error) {
+			return r.doSchedulerRequestTo(ctx, logger.With(zap.Object("scheduler", sched)), sched, timeout, reqData)
+		},
+		r.global.metrics.schedulerFailovers.Inc,
+	)
+}
+
+// doWithFailover calls send with sched, and then with each new scheduler returned by current, for
+// as long as the request fails with a transient error (other than the scheduler not knowing about
+// the pod). Each scheduler pod is tried at most once.
+func doWithFailover(
+	logger *zap.Logger,
+	sched schedwatch.SchedulerInfo,
+	current func() *schedwatch.SchedulerInfo,
+	send func(schedwatch.SchedulerInfo) (*api.PluginResponse, error),
+	onFailover func(),
+) (*api.PluginResponse, error) {
+	var tried []types.UID
+	for {
+		resp, err := send(sched)
+		if err == nil || errclass.Of(err) != errclass.TransientInfra || errors.Is(err, errSchedulerDoesNotKnowPod) {
+			return resp, err
+		}
+
+		tried = append(tried, sched.UID)
+		next := current()
+		if next == nil || slices.Contains(tried, next.UID) {
+			return nil, err
+		}
+
+		logger.Warn(
+			"Scheduler request failed, failing over to new scheduler lease holder",
+			zap.Object("scheduler", sched),
+			zap.Object("newScheduler", *next),
+			zap.Error(err),
+		)
+		onFailover()
+		sched = *next
+	}
+}
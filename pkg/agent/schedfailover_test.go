@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/neondatabase/autoscaling/pkg/agent/schedwatch"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+func TestDoWithFailover(t *testing.T) {
+	schedA := schedwatch.SchedulerInfo{UID: "a", IP: "10.0.0.1"}
+	schedB := schedwatch.SchedulerInfo{UID: "b", IP: "10.0.0.2"}
+
+	errTransient := errclass.Errorf(errclass.TransientInfra, "connection refused")
+	errNotFound := errclass.Errorf(errclass.TransientInfra, "Received response status 404: %w", errSchedulerDoesNotKnowPod)
+	errBug := errclass.Errorf(errclass.Bug, "Received response status 400")
+	resp := &api.PluginResponse{}
+
+	cases := []struct {
+		name string
+		// results gives the result of the request to each scheduler
+		results map[types.UID]error
+		// holders gives the lease holder after each failed request
+		holders []*schedwatch.SchedulerInfo
+
+		expectedErr       error
+		expectedSentTo    []types.UID
+		expectedFailovers int
+	}{
+		{
+			name:           "success",
+			results:        map[types.UID]error{"a": nil},
+			expectedSentTo: []types.UID{"a"},
+		},
+		{
+			name:              "transient error, lease moved",
+			results:           map[types.UID]error{"a": errTransient, "b": nil},
+			holders:           []*schedwatch.SchedulerInfo{&schedB},
+			expectedSentTo:    []types.UID{"a", "b"},
+			expectedFailovers: 1,
+		},
+		{
+			name:           "transient error, lease not moved",
+			results:        map[types.UID]error{"a": errTransient},
+			holders:        []*schedwatch.SchedulerInfo{&schedA},
+			expectedErr:    errTransient,
+			expectedSentTo: []types.UID{"a"},
+		},
+		{
+			name:           "transient error, no lease holder",
+			results:        map[types.UID]error{"a": errTransient},
+			holders:        []*schedwatch.SchedulerInfo{nil},
+			expectedErr:    errTransient,
+			expectedSentTo: []types.UID{"a"},
+		},
+		{
+			name:           "scheduler does not know pod",
+			results:        map[types.UID]error{"a": errNotFound, "b": nil},
+			holders:        []*schedwatch.SchedulerInfo{&schedB},
+			expectedErr:    errNotFound,
+			expectedSentTo: []types.UID{"a"},
+		},
+		{
+			name:           "non-transient error",
+			results:        map[types.UID]error{"a": errBug, "b": nil},
+			holders:        []*schedwatch.SchedulerInfo{&schedB},
+			expectedErr:    errBug,
+			expectedSentTo: []types.UID{"a"},
+		},
+		{
+			name:              "lease moved back",
+			results:           map[types.UID]error{"a": errTransient, "b": errTransient},
+			holders:           []*schedwatch.SchedulerInfo{&schedB, &schedA},
+			expectedErr:       errTransient,
+			expectedSentTo:    []types.UID{"a", "b"},
+			expectedFailovers: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sentTo []types.UID
+			failovers := 0
+			holders := c.holders
+
+			gotResp, err := doWithFailover(
+				zap.NewNop(),
+				schedA,
+				func() *schedwatch.SchedulerInfo {
+					if len(holders) == 0 {
+						panic(errors.New("unexpected check for lease holder"))
+					}
+					h := holders[0]
+					holders = holders[1:]
+					return h
+				},
+				func(sched schedwatch.SchedulerInfo) (*api.PluginResponse, error) {
+					sentTo = append(sentTo, sched.UID)
+					err, ok := c.results[sched.UID]
+					if !ok {
+						panic(fmt.Errorf("unexpected request to scheduler %q", sched.UID))
+					}
+					if err != nil {
+						return nil, err
+					}
+					return resp, nil
+				},
+				func() { failovers += 1 },
+			)
+
+			if c.expectedErr != nil {
+				assert.Equal(t, c.expectedErr, err)
+				assert.Nil(t, gotResp)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, resp, gotResp)
+			}
+			assert.Equal(t, c.expectedSentTo, sentTo)
+			assert.Equal(t, c.expectedFailovers, failovers)
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package agent
+
+// gRPC client for the scheduler plugin. See pkg/api/grpc.go for more.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// errGRPCDial is wrapped by errors from setting up a new connection to a scheduler, before any
+// request could reach it
+var errGRPCDial = errors.New("could not dial scheduler")
+
+// schedulerGRPCClient manages the gRPC connections to the scheduler pods
+//
+// The connections are shared by all Runners. There's normally only one, to the current scheduler,
+// but with .scheduler.failover there may be one for each scheduler pod that requests are sent to.
+// Connections to schedulers that are no longer in use are closed by retain.
+type schedulerGRPCClient struct {
+	config *SchedulerGRPCConfig
+	// creds returns the transport credentials for a new connection. They're loaded for each
+	// connection, so that rotated certificates are picked up.
+	creds func() (credentials.TransportCredentials, error)
+
+	mu    sync.Mutex
+	conns map[string]*schedulerGRPCConn // by IP
+}
+
+type schedulerGRPCConn struct {
+	ip      string
+	conn    *grpc.ClientConn
+	version api.PluginProtoVersion
+}
+
+func newSchedulerGRPCClient(config *SchedulerGRPCConfig) *schedulerGRPCClient {
+	if config == nil {
+		return nil
+	}
+	creds := func() (credentials.TransportCredentials, error) {
+		tlsConfig, err := config.TLS.ClientConfig(config.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading TLS config: %w", err)
+		}
+		return credentials.NewTLS(tlsConfig), nil
+	}
+	return &schedulerGRPCClient{config: config, creds: creds, mu: sync.Mutex{}, conns: make(map[string]*schedulerGRPCConn)}
+}
+
+// retain closes the connections to any schedulers that don't have one of the IPs
+func (c *schedulerGRPCClient) retain(logger *zap.Logger, ips []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ip, conn := range c.conns {
+		if !slices.Contains(ips, ip) {
+			logger.Info("Scheduler no longer in use, closing old gRPC connection", zap.String("ip", ip))
+			_ = conn.conn.Close()
+			delete(c.conns, ip)
+		}
+	}
+}
+
+// get returns a connection to the scheduler at ip, creating one and negotiating the protocol
+// version if necessary.
+//
+// New connections are made without holding c.mu, so that a slow scheduler can't hold up requests
+// from every other Runner.
+func (c *schedulerGRPCClient) get(
+	ctx context.Context,
+	logger *zap.Logger,
+	ip string,
+	timeout time.Duration,
+) (*schedulerGRPCConn, error) {
+	c.mu.Lock()
+	conn, ok := c.conns[ip]
+	c.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := c.connect(ctx, logger, ip, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another Runner may have connected to the same scheduler in the meantime. Only keep one.
+	if existing, ok := c.conns[ip]; ok {
+		_ = conn.conn.Close()
+		return existing, nil
+	}
+	c.conns[ip] = conn
+	return conn, nil
+}
+
+// connect makes a new connection to the scheduler at ip and negotiates the protocol version,
+// taking at most timeout for the negotiation
+func (c *schedulerGRPCClient) connect(
+	ctx context.Context,
+	logger *zap.Logger,
+	ip string,
+	timeout time.Duration,
+) (*schedulerGRPCConn, error) {
+	creds, err := c.creds()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errGRPCDial, err)
+	}
+
+	addr := net.JoinHostPort(ip, strconv.Itoa(int(c.config.Port)))
+	conn, err := grpc.DialContext(
+		ctx,
+		addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(api.JSONCodec{})),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", errGRPCDial, addr, err)
+	}
+
+	// Dialing doesn't wait for the connection, so this is where an unresponsive scheduler would
+	// block us.
+	negotiateCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var resp api.PluginNegotiateResponse
+	req := api.PluginNegotiateRequest{
+		Range: api.VersionRange[api.PluginProtoVersion]{Min: PluginProtocolVersion, Max: PluginProtocolVersion},
+	}
+	if err := conn.Invoke(negotiateCtx, api.PluginGRPCMethodNegotiate, &req, &resp); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("Error negotiating protocol version: %w", err)
+	}
+	if resp.Version != PluginProtocolVersion {
+		_ = conn.Close()
+		return nil, fmt.Errorf("Scheduler negotiated unexpected protocol version %v", resp.Version)
+	}
+
+	logger.Info("Connected to scheduler over gRPC", zap.String("addr", addr), zap.Stringer("version", resp.Version))
+
+	return &schedulerGRPCConn{ip: ip, conn: conn, version: resp.Version}, nil
+}
+
+// invalidate closes conn, if it's still the current connection to its scheduler
+func (c *schedulerGRPCClient) invalidate(conn *schedulerGRPCConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conns[conn.ip] == conn {
+		_ = conn.conn.Close()
+		delete(c.conns, conn.ip)
+	}
+}
+
+// schedulerStreams are a Runner's ResourceUpdates streams, one for each scheduler that it sends
+// requests to.
+type schedulerStreams struct {
+	mu   sync.Mutex
+	byIP map[string]*schedulerStream
+}
+
+// get returns the stream for the scheduler at ip, which may not have been opened yet
+func (s *schedulerStreams) get(ip string) *schedulerStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.byIP[ip]; !ok {
+		s.byIP[ip] = &schedulerStream{mu: sync.Mutex{}, conn: nil, stream: nil, cancel: nil}
+	}
+	return s.byIP[ip]
+}
+
+// retain closes the streams to any schedulers that don't have one of the IPs
+func (s *schedulerStreams) retain(ips []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ip, stream := range s.byIP {
+		if !slices.Contains(ips, ip) {
+			stream.close()
+			delete(s.byIP, ip)
+		}
+	}
+}
+
+// close shuts down all of the streams
+func (s *schedulerStreams) close() {
+	s.retain(nil)
+}
+
+// schedulerStream is a Runner's ResourceUpdates stream to a single scheduler, reused across
+// requests
+//
+// Requests from a single Runner to each scheduler are sequential, but the mutex guards against any
+// overlap anyway.
+type schedulerStream struct {
+	mu     sync.Mutex
+	conn   *schedulerGRPCConn
+	stream grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+// close shuts down the current stream, if there is one
+func (s *schedulerStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *schedulerStream) closeLocked() {
+	if s.stream != nil {
+		_ = s.stream.CloseSend()
+		s.cancel()
+		s.conn, s.stream, s.cancel = nil, nil, nil
+	}
+}
+
+// doGRPCSchedulerRequest sends the request over the Runner's ResourceUpdates stream, opening a new
+// one if necessary.
+//
+// If the request fails or times out, the stream is closed so that the next request starts fresh.
+func (r *Runner) doGRPCSchedulerRequest(
+	ctx context.Context,
+	logger *zap.Logger,
+	client *schedulerGRPCClient,
+	schedIP string,
+	timeout time.Duration,
+	req *api.AgentRequest,
+) (*api.PluginResponse, error) {
+	conn, err := client.get(ctx, logger, schedIP, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := r.schedStreams.get(schedIP)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stream != nil && s.conn != conn {
+		s.closeLocked()
+	}
+	if s.stream == nil {
+		// The stream outlives any individual request, so it can't use ctx. It's instead canceled
+		// by closeLocked, either on error or when the Runner exits.
+		streamCtx, cancel := context.WithCancel(context.Background())
+		stream, err := conn.conn.NewStream(
+			streamCtx,
+			&grpc.StreamDesc{StreamName: "ResourceUpdates", Handler: nil, ServerStreams: true, ClientStreams: true},
+			api.PluginGRPCMethodResourceUpdates,
+		)
+		if err != nil {
+			cancel()
+			client.invalidate(conn)
+			return nil, fmt.Errorf("Error opening stream: %w", err)
+		}
+		s.conn, s.stream, s.cancel = conn, stream, cancel
+	}
+
+	type result struct {
+		resp *api.PluginResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	stream := s.stream
+	go func() {
+		if err := stream.SendMsg(req); err != nil {
+			done <- result{resp: nil, err: fmt.Errorf("Error sending request: %w", err)}
+			return
+		}
+		var resp api.PluginResponse
+		if err := stream.RecvMsg(&resp); err != nil {
+			done <- result{resp: nil, err: fmt.Errorf("Error receiving response: %w", err)}
+			return
+		}
+		done <- result{resp: &resp, err: nil}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(timeout):
+		res = result{resp: nil, err: status.Errorf(codes.DeadlineExceeded, "Timed out after %s", timeout)}
+	case <-ctx.Done():
+		res = result{resp: nil, err: status.FromContextError(ctx.Err()).Err()}
+	}
+
+	if res.err != nil {
+		// We can't tell whether the response is still in-flight, so it's only safe to start again
+		// with a fresh stream.
+		s.closeLocked()
+		return nil, res.err
+	}
+	return res.resp, nil
+}
+
+// grpcSchedulerError returns the error to report for a failed gRPC request, and whether the
+// request should be retried over HTTP.
+//
+// We only fall back to HTTP if we couldn't connect to the scheduler at all. Any other error - in
+// particular, timing out - means that the scheduler may have received the request, and retrying it
+// would both send it twice and double the time spent waiting on a slow scheduler.
+func grpcSchedulerError(err error) (_ error, fallback bool) {
+	if errors.Is(err, errGRPCDial) {
+		return err, true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err, false
+	}
+	class, attached := errclass.FromGRPCStatus(st)
+	if !attached {
+		// The status came from gRPC itself, so its class is guessed from the code - e.g. timeouts
+		// are transient.
+		return errclass.Wrap(class, err), st.Code() == codes.Unavailable
+	}
+
+	if st.Code() == codes.NotFound {
+		return errclass.Wrap(class, fmt.Errorf("%w: %w", err, errSchedulerDoesNotKnowPod)), false
+	}
+	return errclass.Wrap(class, err), false
+}
+
+// grpcRequestErrorDescription returns the label used for the schedulerRequests metric on error
+func grpcRequestErrorDescription(err error) string {
+	if st, ok := status.FromError(err); ok {
+		return fmt.Sprintf("[grpc: %s]", st.Code())
+	}
+	return "[grpc: error doing request]"
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// startFakeGRPCScheduler serves a scheduler that supports Negotiate, but never responds to requests
+// on its ResourceUpdates streams, on ip:port (or a random port, if port is 0)
+func startFakeGRPCScheduler(t *testing.T, ip string, port int) int {
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	require.NoError(t, err)
+
+	server := grpc.NewServer(grpc.ForceServerCodec(api.JSONCodec{}))
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: api.PluginGRPCServiceName,
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Negotiate",
+			Handler: func(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var req api.PluginNegotiateRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return &api.PluginNegotiateResponse{Version: req.Range.Max}, nil
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName: "ResourceUpdates",
+			Handler: func(_ any, stream grpc.ServerStream) error {
+				var req api.AgentRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				<-stream.Context().Done()
+				return stream.Context().Err()
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+		Metadata: nil,
+	}, struct{}{})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startUnresponsiveScheduler accepts connections on ip:port, but never responds on them
+func startUnresponsiveScheduler(t *testing.T, ip string, port int) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+}
+
+func newTestGRPCClient(port int) *schedulerGRPCClient {
+	client := newSchedulerGRPCClient(&SchedulerGRPCConfig{Port: uint16(port)}) //nolint:exhaustruct // TLS is unused
+	client.creds = func() (credentials.TransportCredentials, error) {
+		return insecure.NewCredentials(), nil
+	}
+	return client
+}
+
+func TestSchedulerGRPCClientSlowScheduler(t *testing.T) {
+	const (
+		goodIP = "127.0.0.2"
+		slowIP = "127.0.0.1"
+	)
+
+	port := startFakeGRPCScheduler(t, goodIP, 0)
+	startUnresponsiveScheduler(t, slowIP, port)
+	client := newTestGRPCClient(port)
+	logger := zap.NewNop()
+
+	// The caller's context has no deadline, so only the timeout stops us waiting on the slow
+	// scheduler.
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := client.get(context.Background(), logger, slowIP, time.Second)
+		slowDone <- err
+	}()
+
+	// Give the slow connection a chance to start, so that it would be holding the lock if it
+	// didn't release it while connecting.
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	conn, err := client.get(context.Background(), logger, goodIP, time.Second)
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "should not wait for the slow scheduler")
+	assert.Equal(t, PluginProtocolVersion, conn.version)
+
+	// Later calls reuse the connection
+	again, err := client.get(context.Background(), logger, goodIP, time.Second)
+	require.NoError(t, err)
+	assert.Same(t, conn, again)
+
+	select {
+	case err := <-slowDone:
+		require.Error(t, err)
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		_, fallback := grpcSchedulerError(err)
+		assert.False(t, fallback, "timing out must not fall back to HTTP")
+	case <-time.After(5 * time.Second):
+		t.Fatal("negotiating with the slow scheduler did not time out")
+	}
+
+	client.retain(logger, nil)
+	assert.Empty(t, client.conns)
+}
+
+// A request that times out must be returned as-is, not retried over HTTP
+func TestGRPCSchedulerRequestTimeout(t *testing.T) {
+	const ip = "127.0.0.1"
+
+	port := startFakeGRPCScheduler(t, ip, 0)
+	client := newTestGRPCClient(port)
+	r := &Runner{ //nolint:exhaustruct // only the streams are used
+		schedStreams: schedulerStreams{mu: sync.Mutex{}, byIP: make(map[string]*schedulerStream)},
+	}
+	defer r.schedStreams.close()
+
+	req := &api.AgentRequest{
+		ProtoVersion:  PluginProtocolVersion,
+		Pod:           util.NamespacedName{Namespace: "default", Name: "vm"},
+		ComputeUnit:   api.Resources{VCPU: 250, Mem: 1 << 30},
+		Resources:     api.Resources{VCPU: 250, Mem: 1 << 30},
+		LastPermit:    nil,
+		Metrics:       nil,
+		CorrelationID: "",
+	}
+
+	start := time.Now()
+	_, err := r.doGRPCSchedulerRequest(context.Background(), zap.NewNop(), client, ip, 200*time.Millisecond, req)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	err, fallback := grpcSchedulerError(err)
+	assert.False(t, fallback)
+	assert.Equal(t, errclass.TransientInfra, errclass.Of(err))
+}
+
+func TestGRPCSchedulerError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+
+		expectedFallback   bool
+		expectedClass      errclass.Class
+		expectedUnknownPod bool
+	}{
+		{
+			name:               "classified by scheduler",
+			err:                errclass.GRPCStatus(codes.InvalidArgument, errclass.UserError, "bad request").Err(),
+			expectedFallback:   false,
+			expectedClass:      errclass.UserError,
+			expectedUnknownPod: false,
+		},
+		{
+			name:               "unknown pod",
+			err:                errclass.GRPCStatus(codes.NotFound, errclass.TransientInfra, "pod not found").Err(),
+			expectedFallback:   false,
+			expectedClass:      errclass.TransientInfra,
+			expectedUnknownPod: true,
+		},
+		{
+			name:               "unavailable",
+			err:                status.Error(codes.Unavailable, "connection refused"),
+			expectedFallback:   true,
+			expectedClass:      errclass.TransientInfra,
+			expectedUnknownPod: false,
+		},
+		{
+			name:               "dial error",
+			err:                fmt.Errorf("%w 127.0.0.1:10299: %w", errGRPCDial, errors.New("bad address")),
+			expectedFallback:   true,
+			expectedClass:      errclass.Bug,
+			expectedUnknownPod: false,
+		},
+		{
+			name:               "deadline exceeded",
+			err:                status.Error(codes.DeadlineExceeded, "Timed out after 1s"),
+			expectedFallback:   false,
+			expectedClass:      errclass.TransientInfra,
+			expectedUnknownPod: false,
+		},
+		{
+			name:               "not a status",
+			err:                errors.New("Scheduler negotiated unexpected protocol version v5.0"),
+			expectedFallback:   false,
+			expectedClass:      errclass.Bug,
+			expectedUnknownPod: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err, fallback := grpcSchedulerError(c.err)
+			assert.Equal(t, c.expectedFallback, fallback)
+			assert.Equal(t, c.expectedClass, errclass.Of(err))
+			assert.Equal(t, c.expectedUnknownPod, errors.Is(err, errSchedulerDoesNotKnowPod))
+		})
+	}
+}
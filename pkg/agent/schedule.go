@@ -0,0 +1,58 @@
+package agent
+
+// Applying VMs' scaling schedules
+//
+// A VM's scaling schedule (see api.ScalingSchedule) adjusts its scaling bounds over time, without
+// any change to the VM object itself. So in addition to applying the schedule each time the
+// Runner gets the VmInfo, we periodically check whether the active window has changed, and if so,
+// update the executor with the new bounds.
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// scalingScheduleCheckInterval is how often we check whether the active window of the VM's scaling
+// schedule has changed. Windows start on minute boundaries, so this is precise enough.
+const scalingScheduleCheckInterval = 15 * time.Second
+
+// activeScheduleWindow returns the name of the active window of the VM's scaling schedule, or ""
+// if there is none.
+func (r *Runner) activeScheduleWindow() string {
+	r.status.mu.Lock()
+	defer r.status.mu.Unlock()
+
+	_, window := r.status.vmInfo.WithScalingSchedule(time.Now())
+	return window
+}
+
+// watchScalingSchedule calls update each time the active window of the VM's scaling schedule
+// changes, until the context is canceled.
+func (r *Runner) watchScalingSchedule(ctx context.Context, logger *zap.Logger, update func()) {
+	ticker := time.NewTicker(scalingScheduleCheckInterval)
+	defer ticker.Stop()
+
+	lastWindow := r.activeScheduleWindow()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		window := r.activeScheduleWindow()
+		if window == lastWindow {
+			continue
+		}
+
+		logger.Info(
+			"Active scaling schedule window changed",
+			zap.String("previous", lastWindow),
+			zap.String("window", window),
+		)
+		lastWindow = window
+		update()
+	}
+}
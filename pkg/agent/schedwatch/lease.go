@@ -0,0 +1,142 @@
+package schedwatch
+
+// Tracking the holder of the scheduler's leader election Lease
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"go.uber.org/zap"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+type schedLease struct {
+	mu    sync.RWMutex
+	lease *coordinationv1.Lease
+}
+
+func (s *schedLease) set(lease *coordinationv1.Lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lease = lease
+}
+
+// holderIdentity returns the identity of the lease's holder, ignoring whether the lease has
+// expired, or "" if the lease doesn't exist or has no holder
+func (s *schedLease) holderIdentity() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.lease == nil {
+		return ""
+	}
+	return lo.FromPtr(s.lease.Spec.HolderIdentity)
+}
+
+// holder returns the name of the scheduler pod holding the lease, or "" if it isn't held
+func (s *schedLease) holder(now time.Time) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return leaseHolder(s.lease, now)
+}
+
+// leaseHolder returns the name of the pod holding the leader election lease at the given time, or
+// "" if the lease is nil, has no holder, or has expired.
+//
+// The scheduler's leader election identity is "<hostname>_<uuid>", and the hostname of a pod is
+// its name.
+func leaseHolder(lease *coordinationv1.Lease, now time.Time) string {
+	if lease == nil || lease.Spec.HolderIdentity == nil || lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return ""
+	}
+
+	expiresAt := lease.Spec.RenewTime.Add(time.Second * time.Duration(*lease.Spec.LeaseDurationSeconds))
+	if !now.Before(expiresAt) {
+		return ""
+	}
+
+	name, _, _ := strings.Cut(*lease.Spec.HolderIdentity, "_")
+	return name
+}
+
+func startLeaseWatcher(
+	ctx context.Context,
+	logger *zap.Logger,
+	kubeClient *kubernetes.Clientset,
+	metrics watch.Metrics,
+	leaseName string,
+) (*schedLease, func(), error) {
+	sl := &schedLease{mu: sync.RWMutex{}, lease: nil}
+
+	store, err := watch.Watch(
+		ctx,
+		logger.Named("watch"),
+		kubeClient.CoordinationV1().Leases(schedulerNamespace),
+		watch.Config{
+			ObjectNameLogField: "lease",
+			Metrics: watch.MetricsConfig{
+				Metrics:  metrics,
+				Instance: "Scheduler Lease",
+			},
+			// The lease changing hands is rare, and requests to the previous holder fail in the
+			// meantime, so we want to find out about it quickly.
+			//
+			// FIXME: make these configurable.
+			RetryRelistAfter: util.NewTimeRange(time.Millisecond, 500, 1000),
+			RetryWatchAfter:  util.NewTimeRange(time.Millisecond, 500, 1000),
+		},
+		watch.Accessors[*coordinationv1.LeaseList, coordinationv1.Lease]{
+			Items: func(list *coordinationv1.LeaseList) []coordinationv1.Lease { return list.Items },
+		},
+		watch.InitModeSync,
+		metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", leaseName).String()},
+		watch.HandlerFuncs[*coordinationv1.Lease]{
+			AddFunc: func(lease *coordinationv1.Lease, preexisting bool) {
+				logger.Info("Scheduler lease found", zap.Stringp("holder", lease.Spec.HolderIdentity))
+				sl.set(lease)
+			},
+			UpdateFunc: func(oldLease, newLease *coordinationv1.Lease) {
+				if lo.FromPtr(oldLease.Spec.HolderIdentity) != lo.FromPtr(newLease.Spec.HolderIdentity) {
+					logger.Info(
+						"Scheduler lease holder changed",
+						zap.Stringp("oldHolder", oldLease.Spec.HolderIdentity),
+						zap.Stringp("newHolder", newLease.Spec.HolderIdentity),
+					)
+				}
+				sl.set(newLease)
+			},
+			DeleteFunc: func(lease *coordinationv1.Lease, mayBeStale bool) {
+				logger.Warn("Scheduler lease deleted")
+				sl.set(nil)
+			},
+		},
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The lease is created by the scheduler once it's elected leader. If it doesn't exist, the
+	// scheduler probably isn't running with leader election at all, and we'd never send it requests.
+	if sl.holderIdentity() == "" {
+		store.Stop()
+		return nil, nil, fmt.Errorf(
+			"lease %s/%s does not exist, or has no holder (is the scheduler running with leader election enabled?)",
+			schedulerNamespace, leaseName,
+		)
+	}
+
+	return sl, store.Stop, nil
+}
@@ -0,0 +1,59 @@
+package schedwatch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestLeaseHolder(t *testing.T) {
+	now := time.Now()
+
+	lease := func(holder *string, renewedAgo time.Duration, durationSeconds int32) *coordinationv1.Lease {
+		return &coordinationv1.Lease{
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       holder,
+				LeaseDurationSeconds: &durationSeconds,
+				RenewTime:            &metav1.MicroTime{Time: now.Add(-renewedAgo)},
+			},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		lease    *coordinationv1.Lease
+		expected string
+	}{
+		{"no lease", nil, ""},
+		{"held", lease(lo.ToPtr("scheduler-abc_0a1b2c"), time.Second, 15), "scheduler-abc"},
+		{"held, identity without uuid", lease(lo.ToPtr("scheduler-abc"), time.Second, 15), "scheduler-abc"},
+		{"released", lease(nil, time.Second, 15), ""},
+		{"expired", lease(lo.ToPtr("scheduler-abc_0a1b2c"), 15*time.Second, 15), ""},
+		{"never renewed", &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{HolderIdentity: lo.ToPtr("scheduler-abc_0a1b2c")}}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, leaseHolder(c.lease, now))
+		})
+	}
+}
+
+func TestFindScheduler(t *testing.T) {
+	scheds := []SchedulerInfo{
+		{PodName: util.NamespacedName{Namespace: schedulerNamespace, Name: "scheduler-a"}, UID: "a"},
+		{PodName: util.NamespacedName{Namespace: schedulerNamespace, Name: "scheduler-b"}, UID: "b"},
+	}
+
+	assert.Equal(t, &scheds[1], findScheduler(scheds, "scheduler-b"))
+	// The lease holder isn't ready (or isn't one of the scheduler pods at all)
+	assert.Nil(t, findScheduler(scheds, "scheduler-c"))
+	// Nobody holds the lease
+	assert.Nil(t, findScheduler(scheds, ""))
+}
@@ -3,6 +3,8 @@ package schedwatch
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +25,8 @@ func isActivePod(pod *corev1.Pod) bool {
 
 type SchedulerTracker struct {
 	sp *schedPods
+	// lease is nil if the tracker wasn't given the name of the scheduler's leader election lease
+	lease *schedLease
 
 	Stop func()
 }
@@ -34,6 +38,47 @@ func (s SchedulerTracker) Get() *SchedulerInfo {
 	return s.sp.current
 }
 
+// GetAll returns all of the ready scheduler pods, in order of preference: newest first, like Get.
+func (s SchedulerTracker) GetAll() []SchedulerInfo {
+	s.sp.mu.RLock()
+	defer s.sp.mu.RUnlock()
+
+	all := make([]SchedulerInfo, 0, len(s.sp.pods))
+	for _, pod := range s.sp.pods {
+		all = append(all, *pod)
+	}
+	// Ties are broken by UID, so that the order is stable.
+	slices.SortFunc(all, func(a, b SchedulerInfo) int {
+		if c := b.CreationTimestamp.Compare(a.CreationTimestamp); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.UID), string(b.UID))
+	})
+	return all
+}
+
+// GetLeaseHolder returns the ready scheduler pod holding the scheduler's leader election lease, or
+// nil if there isn't one (or the tracker isn't watching the lease).
+func (s SchedulerTracker) GetLeaseHolder(now time.Time) *SchedulerInfo {
+	if s.lease == nil {
+		return nil
+	}
+	return findScheduler(s.GetAll(), s.lease.holder(now))
+}
+
+// findScheduler returns the scheduler pod with the given name, or nil if there isn't one
+func findScheduler(scheds []SchedulerInfo, name string) *SchedulerInfo {
+	if name == "" {
+		return nil
+	}
+	for i := range scheds {
+		if scheds[i].PodName.Name == name {
+			return &scheds[i]
+		}
+	}
+	return nil
+}
+
 type schedPods struct {
 	mu      sync.RWMutex
 	current *SchedulerInfo
@@ -52,6 +97,7 @@ func StartSchedulerWatcher(
 	kubeClient *kubernetes.Clientset,
 	metrics watch.Metrics,
 	schedulerName string,
+	leaseName string,
 ) (*SchedulerTracker, error) {
 	logger := parentLogger.Named("watch-schedulers")
 
@@ -118,9 +164,25 @@ func StartSchedulerWatcher(
 		return nil, err
 	}
 
+	var lease *schedLease
+	stop := store.Stop
+	if leaseName != "" {
+		var stopLease func()
+		lease, stopLease, err = startLeaseWatcher(ctx, parentLogger.Named("watch-scheduler-lease"), kubeClient, metrics, leaseName)
+		if err != nil {
+			store.Stop()
+			return nil, fmt.Errorf("could not watch scheduler lease: %w", err)
+		}
+		stop = func() {
+			store.Stop()
+			stopLease()
+		}
+	}
+
 	return &SchedulerTracker{
-		sp:   sp,
-		Stop: store.Stop,
+		sp:    sp,
+		lease: lease,
+		Stop:  stop,
 	}, nil
 }
 
@@ -0,0 +1,103 @@
+package agent
+
+// Limits on metrics requests across all VMs on the node
+//
+// Each Runner fetches metrics for its VM on its own schedule, which works fine until many VMs'
+// endpoints are slow at once - at which point the node can have thousands of requests in flight,
+// all competing with the requests that actually scale VMs. If .metrics.scraping is configured, all
+// scrapes go through a single scrapePool, which:
+//
+//  1. bounds the number of requests in flight at once;
+//  2. gives each request a deadline of the VM's interval between requests, including time spent
+//     waiting for a worker, so that slow requests are abandoned rather than piling up; and
+//  3. stretches each VM's interval between requests while there are requests waiting, so that the
+//     load backs off until the pool catches up.
+//
+// Runners whose VM hasn't had metrics fetched successfully recently are counted as having stale
+// metrics; see (podStatus).metricsStale.
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// errScrapeDeadline is returned by (*scrapePool).do if the deadline passed before a worker was
+// available
+var errScrapeDeadline = errors.New("Deadline passed while waiting for a metrics request worker")
+
+type scrapePool struct {
+	config  ScrapingConfig
+	metrics GlobalMetrics
+
+	// workers has a buffered entry for each request in flight
+	workers chan struct{}
+	// waiting is the number of requests waiting for a worker
+	waiting atomic.Int64
+}
+
+// newScrapePool returns a new scrapePool, or nil if config is nil
+func newScrapePool(config *ScrapingConfig, metrics GlobalMetrics) *scrapePool {
+	if config == nil {
+		return nil
+	}
+
+	return &scrapePool{
+		config:  *config,
+		metrics: metrics,
+		workers: make(chan struct{}, config.MaxConcurrentRequests),
+		waiting: atomic.Int64{},
+	}
+}
+
+// do calls f once a worker is available, with a context that's canceled after the deadline.
+//
+// If the pool is nil, f is called immediately, without a deadline.
+func (p *scrapePool) do(ctx context.Context, deadline time.Duration, f func(context.Context) error) error {
+	if p == nil {
+		return f(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	start := time.Now()
+	p.metrics.metricsRequestsWaiting.Set(float64(p.waiting.Add(1)))
+	select {
+	case p.workers <- struct{}{}:
+		p.metrics.metricsRequestsWaiting.Set(float64(p.waiting.Add(-1)))
+	case <-ctx.Done():
+		p.metrics.metricsRequestsWaiting.Set(float64(p.waiting.Add(-1)))
+		p.metrics.metricsRequestsAbandoned.Inc()
+		return errScrapeDeadline
+	}
+	p.metrics.metricsRequestWait.Observe(time.Since(start).Seconds())
+	p.metrics.metricsRequestsInFlight.Set(float64(len(p.workers)))
+
+	defer func() {
+		<-p.workers
+		p.metrics.metricsRequestsInFlight.Set(float64(len(p.workers)))
+	}()
+
+	return f(ctx)
+}
+
+// interval returns the duration to wait before the next request, given the configured base
+// interval.
+//
+// While there are requests waiting for a worker, the interval is stretched in proportion to the
+// backlog, up to the configured MaxIntervalMultiplier.
+func (p *scrapePool) interval(base time.Duration) time.Duration {
+	if p == nil {
+		return base
+	}
+
+	load := float64(len(p.workers)+int(p.waiting.Load())) / float64(cap(p.workers))
+	multiplier := util.Max(1, util.Min(load, p.config.MaxIntervalMultiplier))
+	p.metrics.metricsIntervalMultiplier.Set(multiplier)
+
+	return time.Duration(float64(base) * multiplier)
+}
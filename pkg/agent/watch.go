@@ -15,6 +15,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
@@ -28,6 +29,8 @@ type vmEvent struct {
 	vmInfo  api.VmInfo
 	podName string
 	podIP   string
+	// vmUID is the UID of the VirtualMachine object, for Events about it
+	vmUID types.UID
 	// if present, the ID of the endpoint associated with the VM. May be empty.
 	endpointID string
 }
@@ -174,6 +177,7 @@ func makeVMEvent(logger *zap.Logger, vm *vmapi.VirtualMachine, kind vmEventKind)
 		vmInfo:     *info,
 		podName:    vm.Status.PodName,
 		podIP:      vm.Status.PodIP,
+		vmUID:      vm.UID,
 		endpointID: endpointID,
 	}, nil
 }
@@ -0,0 +1,66 @@
+package api
+
+// gRPC variant of the agent<->scheduler plugin protocol
+//
+// The gRPC service mirrors the HTTP+JSON API: requests and responses are the same AgentRequest and
+// PluginResponse types, encoded with JSONCodec rather than protobuf, so that the two transports
+// share a single set of typed messages and cannot drift apart.
+//
+// The service provides three methods:
+//
+//   - Negotiate, which must be called once per connection to pick the protocol version
+//   - Request, a unary equivalent of the HTTP API
+//   - ResourceUpdates, a bidirectional stream of AgentRequest -> PluginResponse, so that the
+//     autoscaler-agent can reuse a single stream for all requests for a VM.
+//
+// Errors are returned as gRPC statuses with the error's class attached (see errclass.GRPCStatus),
+// like the HTTP API's errclass.HTTPHeader.
+//
+// The HTTP API remains supported, and the autoscaler-agent falls back to it if it can't reach the
+// scheduler over gRPC. Errors from the scheduler's request handler are not retried over HTTP.
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	PluginGRPCServiceName = "neon.autoscaling.AutoscalerPlugin"
+
+	PluginGRPCMethodNegotiate       = "/" + PluginGRPCServiceName + "/Negotiate"
+	PluginGRPCMethodRequest         = "/" + PluginGRPCServiceName + "/Request"
+	PluginGRPCMethodResourceUpdates = "/" + PluginGRPCServiceName + "/ResourceUpdates"
+)
+
+// PluginNegotiateRequest is sent by the autoscaler-agent at the start of each gRPC connection, to
+// determine the protocol version to use for the remainder of the connection.
+type PluginNegotiateRequest struct {
+	// Range is the range of protocol versions that the autoscaler-agent supports
+	Range VersionRange[PluginProtoVersion] `json:"range"`
+}
+
+// PluginNegotiateResponse is the scheduler plugin's response to a PluginNegotiateRequest
+type PluginNegotiateResponse struct {
+	// Version is the latest protocol version supported by both sides. All subsequent AgentRequests
+	// on the connection MUST use this version.
+	Version PluginProtoVersion `json:"version"`
+}
+
+// JSONCodec is a gRPC codec (implementing google.golang.org/grpc/encoding.Codec) that encodes
+// messages as JSON
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error unmarshaling %T: %w", v, err)
+	}
+	return nil
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
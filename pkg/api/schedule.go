@@ -0,0 +1,146 @@
+package api
+
+// Scheduled adjustments to a VM's scaling bounds
+
+import (
+	"fmt"
+	"time"
+	// Include the timezone database, so that schedules can use timezones even if the container
+	// image doesn't have it.
+	_ "time/tzdata"
+
+	"github.com/tychoish/fun/erc"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// ScalingSchedule is the type that we deserialize from the "autoscaling.neon.tech/schedule"
+// annotation. It adjusts the VM's scaling bounds during recurring windows of time, e.g. to raise
+// the minimum during business hours.
+//
+// While a window is active, its bounds replace the VM's, but are restricted to the VM's original
+// bounds - so a window can narrow the range the VM scales within, but never widen it. If more than
+// one window is active, the last one takes precedence.
+type ScalingSchedule struct {
+	// TimeZone is the IANA name of the timezone that the windows' cron expressions are evaluated
+	// in, e.g. "America/New_York". Defaults to UTC.
+	TimeZone string                  `json:"timeZone,omitempty"`
+	Windows  []ScalingScheduleWindow `json:"windows"`
+}
+
+// ScalingScheduleWindow is a single recurring window in a ScalingSchedule
+type ScalingScheduleWindow struct {
+	// Name identifies the window in logs.
+	Name string `json:"name"`
+	// Cron is the standard 5-field cron expression for when the window starts. Refer to
+	// util.CronSchedule for the supported syntax.
+	Cron string `json:"cron"`
+	// DurationSeconds is how long the window lasts after each time it starts. It must be no more
+	// than one week.
+	DurationSeconds uint `json:"durationSeconds"`
+
+	// Min, if set, replaces the VM's minimum resources during the window.
+	Min *ResourceBounds `json:"min,omitempty"`
+	// Max, if set, replaces the VM's maximum resources during the window.
+	Max *ResourceBounds `json:"max,omitempty"`
+}
+
+// maxScheduleWindowDuration is the maximum duration of a ScalingScheduleWindow. It limits how far
+// back we need to search for the start of a window.
+const maxScheduleWindowDuration = 7 * 24 * time.Hour
+
+// Validate checks that the ScalingSchedule has a valid timezone, and that each window has a valid
+// cron expression, a duration, and at least one of min or max.
+func (s ScalingSchedule) Validate(memSlotSize *resource.Quantity) error {
+	ec := &erc.Collector{}
+
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		ec.Add(fmt.Errorf("error at .timeZone: %w", err))
+	}
+
+	names := make(map[string]struct{})
+	for i, w := range s.Windows {
+		path := fmt.Sprintf(".windows[%d]", i)
+
+		erc.Whenf(ec, w.Name == "", "%s.name is a required field", path)
+		if _, ok := names[w.Name]; ok && w.Name != "" {
+			ec.Add(fmt.Errorf("%s.name %q is not unique", path, w.Name))
+		}
+		names[w.Name] = struct{}{}
+
+		if _, err := util.ParseCron(w.Cron); err != nil {
+			ec.Add(fmt.Errorf("error at %s.cron: %w", path, err))
+		}
+
+		erc.Whenf(ec, w.DurationSeconds == 0, "%s.durationSeconds must be set to value > 0", path)
+		erc.Whenf(
+			ec, time.Duration(w.DurationSeconds)*time.Second > maxScheduleWindowDuration,
+			"%s.durationSeconds must be no more than %d", path, int(maxScheduleWindowDuration.Seconds()),
+		)
+
+		erc.Whenf(ec, w.Min == nil && w.Max == nil, "%s must set at least one of .min or .max", path)
+		if w.Min != nil {
+			w.Min.validate(ec, path+".min", memSlotSize)
+		}
+		if w.Max != nil {
+			w.Max.validate(ec, path+".max", memSlotSize)
+		}
+	}
+
+	return ec.Resolve()
+}
+
+// ActiveWindow returns the window that's active at the given time, or nil if there is none.
+//
+// The ScalingSchedule must have passed Validate.
+func (s ScalingSchedule) ActiveWindow(now time.Time) *ScalingScheduleWindow {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil
+	}
+	now = now.In(loc)
+
+	var active *ScalingScheduleWindow
+	for i, w := range s.Windows {
+		cron, err := util.ParseCron(w.Cron)
+		if err != nil {
+			continue
+		}
+		if _, ok := cron.LastAtOrBefore(now, time.Duration(w.DurationSeconds)*time.Second); ok {
+			active = &s.Windows[i]
+		}
+	}
+	return active
+}
+
+// WithScalingSchedule returns a copy of the VmInfo with the bounds from the active window of its
+// ScalingSchedule applied, alongside the name of that window. If the VM has no schedule or no
+// window is active, the VmInfo is returned as-is, with an empty name.
+func (vm VmInfo) WithScalingSchedule(now time.Time) (VmInfo, string) {
+	if vm.Config.ScalingSchedule == nil {
+		return vm, ""
+	}
+	window := vm.Config.ScalingSchedule.ActiveWindow(now)
+	if window == nil {
+		return vm, ""
+	}
+
+	// Restrict the window's bounds to the VM's original ones, and max to be at least min.
+	if window.Min != nil {
+		cpu := vmapi.MilliCPUFromResourceQuantity(window.Min.CPU)
+		mem := uint16(BytesFromResourceQuantity(window.Min.Mem) / vm.Mem.SlotSize)
+		vm.Cpu.Min = util.Max(vm.Cpu.Min, util.Min(cpu, vm.Cpu.Max))
+		vm.Mem.Min = util.Max(vm.Mem.Min, util.Min(mem, vm.Mem.Max))
+	}
+	if window.Max != nil {
+		cpu := vmapi.MilliCPUFromResourceQuantity(window.Max.CPU)
+		mem := uint16(BytesFromResourceQuantity(window.Max.Mem) / vm.Mem.SlotSize)
+		vm.Cpu.Max = util.Max(vm.Cpu.Min, util.Min(cpu, vm.Cpu.Max))
+		vm.Mem.Max = util.Max(vm.Mem.Min, util.Min(mem, vm.Mem.Max))
+	}
+
+	return vm, window.Name
+}
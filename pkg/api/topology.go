@@ -0,0 +1,26 @@
+// Node topology, as reported to the scheduler plugin
+
+package api
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationNUMATopology is the annotation on Nodes giving the node's NUMA topology, as a
+// JSON-encoded []NUMANode.
+//
+// Nothing in this repository sets it: it's expected to be kept up-to-date by a per-node reporter
+// (e.g. a DaemonSet reading /sys/devices/system/node). The scheduler plugin uses it, if present, to
+// prefer placing VMs where they fit within a single NUMA node.
+const AnnotationNUMATopology = "autoscaling.neon.tech/numa-topology"
+
+// NUMANode describes the resources of a single NUMA node on a Node
+type NUMANode struct {
+	// ID is the kernel's number for the NUMA node
+	ID int `json:"id"`
+	// Capacity gives the total resources of the NUMA node. Only "cpu" and "memory" are used.
+	Capacity corev1.ResourceList `json:"capacity"`
+	// Free gives the currently unallocated hugepages of the NUMA node, as the amount of memory
+	// available for each hugepage size - e.g. "hugepages-2Mi" and "hugepages-1Gi".
+	Free corev1.ResourceList `json:"free"`
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -87,9 +89,32 @@ const (
 	//
 	// * Removed AgentRequest.metrics fields loadAvg5M and memoryUsageBytes
 	//
-	// Currently the latest version.
+	// Last used in release version v0.28.0.
 	PluginProtoV5_0
 
+	// PluginProtoV5_1 represents v5.1 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.0:
+	//
+	// * Adds PluginResponse.Ballast
+	PluginProtoV5_1
+
+	// PluginProtoV5_2 represents v5.2 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.1:
+	//
+	// * Adds PluginResponse.Downscale
+	PluginProtoV5_2
+
+	// PluginProtoV5_3 represents v5.3 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v5.2:
+	//
+	// * Adds PluginResponse.Lease
+	//
+	// Currently the latest version.
+	PluginProtoV5_3
+
 	// latestPluginProtoVersion represents the latest version of the agent<->scheduler plugin
 	// protocol
 	//
@@ -119,6 +144,12 @@ func (v PluginProtoVersion) String() string {
 		return "v4.0"
 	case PluginProtoV5_0:
 		return "v5.0"
+	case PluginProtoV5_1:
+		return "v5.1"
+	case PluginProtoV5_2:
+		return "v5.2"
+	case PluginProtoV5_3:
+		return "v5.3"
 	default:
 		diff := v - latestPluginProtoVersion
 		return fmt.Sprintf("<unknown = %v + %d>", latestPluginProtoVersion, diff)
@@ -174,6 +205,30 @@ func (v PluginProtoVersion) IncludesExtendedMetrics() bool {
 	return v < PluginProtoV5_0
 }
 
+// SupportsBallast returns whether this version of the protocol allows the scheduler plugin to
+// include grants from the node's memory ballast in its PluginResponse.
+//
+// This is true for version v5.1 and greater.
+func (v PluginProtoVersion) SupportsBallast() bool {
+	return v >= PluginProtoV5_1
+}
+
+// SupportsDownscaleRequests returns whether this version of the protocol allows the scheduler
+// plugin to ask the autoscaler-agent to downscale, via PluginResponse.Downscale.
+//
+// This is true for version v5.2 and greater.
+func (v PluginProtoVersion) SupportsDownscaleRequests() bool {
+	return v >= PluginProtoV5_2
+}
+
+// SupportsUpscaleLeases returns whether this version of the protocol allows the scheduler plugin
+// to include a short-lived upscale lease in its PluginResponse.
+//
+// This is true for version v5.3 and greater.
+func (v PluginProtoVersion) SupportsUpscaleLeases() bool {
+	return v >= PluginProtoV5_3
+}
+
 // AgentRequest is the type of message sent from an autoscaler-agent to the scheduler plugin
 //
 // All AgentRequests expect a PluginResponse.
@@ -207,6 +262,9 @@ type AgentRequest struct {
 	//
 	// In some protocol versions, this field may be nil.
 	Metrics *Metrics `json:"metrics"`
+	// CorrelationID is the ID of the agent's scaling transaction that this request is part of, if
+	// any. It's only used for logging.
+	CorrelationID string `json:"correlationID,omitempty"`
 }
 
 // Metrics gives the information pulled from vector.dev that the scheduler may use to prioritize
@@ -421,6 +479,65 @@ type PluginResponse struct {
 	// Migrate, if present, notifies the autoscaler-agent that its VM will be migrated away,
 	// alongside whatever other information may be useful.
 	Migrate *MigrateResponse `json:"migrate,omitempty"`
+
+	// Ballast, if present, grants the autoscaler-agent an amount of memory from the node's ballast
+	// that it may upscale into without waiting for a further request.
+	//
+	// The grant is only valid until the next request is sent. Any amount that was used MUST be
+	// included in that request, which the scheduler plugin will then always approve.
+	//
+	// Only sent for protocol versions where SupportsBallast() is true.
+	Ballast *BallastGrant `json:"ballast,omitempty"`
+
+	// Downscale, if present, asks the autoscaler-agent to reduce its VM's resources to at most
+	// Downscale.Target, because other VMs on the node need the capacity.
+	//
+	// The autoscaler-agent should treat the target as an upper bound on its desired resources until
+	// the next response, but may stay above it if the vm-monitor denies downscaling.
+	//
+	// Only sent for protocol versions where SupportsDownscaleRequests() is true.
+	Downscale *PluginDownscaleRequest `json:"downscale,omitempty"`
+
+	// Lease, if present, pre-approves the autoscaler-agent to increase its VM's resources above
+	// Permit, up to the amount given, until the lease expires.
+	//
+	// Like Ballast, the lease is only valid until the next request is sent, and any amount that was
+	// used MUST be included in that request, which the scheduler plugin will then always approve.
+	//
+	// Only sent for protocol versions where SupportsUpscaleLeases() is true.
+	Lease *UpscaleLease `json:"lease,omitempty"`
+
+	// RetryAfterSeconds, if not zero, notifies the autoscaler-agent that the scheduler plugin is
+	// overloaded and deferred the increase it requested. The autoscaler-agent should wait at least
+	// this many seconds before requesting more than Permit again.
+	//
+	// Older autoscaler-agents ignore this, so it's sent for all protocol versions.
+	RetryAfterSeconds uint `json:"retryAfterSeconds,omitempty"`
+}
+
+// PluginDownscaleRequest is the scheduler plugin's request for an autoscaler-agent to downscale, as part
+// of a PluginResponse.
+type PluginDownscaleRequest struct {
+	// Target gives the resources that the scheduler plugin would like the VM to use
+	Target Resources `json:"target"`
+}
+
+// BallastGrant is the portion of a node's ballast lent to a particular VM, as part of a
+// PluginResponse.
+type BallastGrant struct {
+	// Mem gives the amount of memory, above PluginResponse.Permit, that the VM may use
+	Mem Bytes `json:"mem"`
+}
+
+// UpscaleLease is headroom on the node that's reserved for a particular VM for a short time, as part
+// of a PluginResponse.
+type UpscaleLease struct {
+	// Resources gives the amount of each resource, above PluginResponse.Permit, that the VM may use
+	Resources Resources `json:"resources"`
+	// ValidSeconds gives the duration, in seconds, for which the lease may be used. The
+	// autoscaler-agent measures this from when it sent the request, so that it never uses the lease
+	// for longer than the scheduler plugin holds it.
+	ValidSeconds uint `json:"validSeconds"`
 }
 
 // MigrateResponse, when provided, is a notification to the autsocaler-agent that it will migrate
@@ -454,6 +571,70 @@ func (m MoreResources) And(cmp MoreResources) MoreResources {
 	}
 }
 
+// WouldFitRequest is the body of a request to the scheduler plugin's "would fit" endpoint, asking
+// whether a VM with the given resources could currently be scheduled, without creating anything.
+type WouldFitRequest struct {
+	// Use gives the resources that the VM would start with, and so would be reserved for it
+	Use Resources `json:"use"`
+	// Max, if provided, gives the maximum resources the VM may scale up to. It doesn't affect
+	// whether a node fits, but the response reports which nodes currently have room for it.
+	Max *Resources `json:"max,omitempty"`
+	// NodeSelector, if provided, restricts the nodes considered to those with matching labels.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// WouldFitResponse is the scheduler plugin's response to a WouldFitRequest
+type WouldFitResponse struct {
+	// Fits is true iff there's at least one node the VM would fit on
+	Fits bool `json:"fits"`
+	// Nodes lists the nodes that the VM would fit on, in order of name
+	Nodes []WouldFitNode `json:"nodes"`
+}
+
+// WouldFitNode is a node that a VM would fit on, as part of a WouldFitResponse
+type WouldFitNode struct {
+	Name string `json:"name"`
+	// Remaining gives the resources on the node that haven't been reserved, before adding the VM
+	Remaining Resources `json:"remaining"`
+	// FitsMax is true if WouldFitRequest.Max was provided, and the node currently has room for it
+	FitsMax bool `json:"fitsMax"`
+}
+
+// SimulateRequest is the body of a request to the scheduler plugin's "simulate" endpoint, asking
+// how a VM with the given resources would be filtered and scored on each node, without reserving
+// anything.
+type SimulateRequest struct {
+	// Use gives the resources that the VM would start with, and so would be reserved for it
+	Use Resources `json:"use"`
+	// Priority, if provided, gives the VM's priority, which may affect the scores. Defaults to
+	// Standard.
+	Priority vmapi.VirtualMachinePriority `json:"priority,omitempty"`
+	// NodeSelector, if provided, restricts the nodes considered to those with matching labels.
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// SimulateResponse is the scheduler plugin's response to a SimulateRequest
+type SimulateResponse struct {
+	// Nodes lists every node that was considered, with those that pass Filter first, in order of
+	// decreasing score, and then the rest in order of name
+	Nodes []SimulateNode `json:"nodes"`
+}
+
+// SimulateNode is the result of simulating scheduling onto a single node, as part of a
+// SimulateResponse
+type SimulateNode struct {
+	Name string `json:"name"`
+	// PassesFilter is true iff the VM would pass the plugin's Filter on the node
+	PassesFilter bool `json:"passesFilter"`
+	// Reason gives why the VM wouldn't pass Filter, if it wouldn't
+	Reason string `json:"reason,omitempty"`
+	// Score gives the node's score from the plugin's Score, if the VM would pass Filter. It does
+	// not include the randomization from NormalizeScore, if that's enabled.
+	Score int64 `json:"score"`
+	// Remaining gives the resources on the node that haven't been reserved, before adding the VM
+	Remaining Resources `json:"remaining"`
+}
+
 ////////////////////////////////////
 // Controller <-> Runner Messages //
 ////////////////////////////////////
@@ -468,6 +649,100 @@ type VCPUChange struct {
 // it represents the vCPU usage as controlled by cgroup
 type VCPUCgroup struct {
 	VCPUs vmapi.MilliCPU
+	// Burst is the state of CPU bursting, if the VM has .spec.guest.cpuBurst set. VCPUs does not
+	// include any CPU allowed while bursting.
+	Burst *vmapi.CPUBurstStatus `json:",omitempty"`
+}
+
+// SwapChange is used to notify runner that the VM's swap should be resized, when the swap is
+// proportional to memory
+type SwapChange struct {
+	Size resource.Quantity
+}
+
+// TimeSyncResult is returned by the runner's /time_sync endpoint, once it has synchronized the
+// guest's clock
+type TimeSyncResult struct {
+	Method vmapi.TimeSyncMethod
+}
+
+// Attestation is returned by the runner's /attestation endpoint for confidential VMs, giving the
+// parameters that the guest was launched with. Verifiers check the guest's own attestation report
+// against them.
+type Attestation struct {
+	// Technology is "sev-snp" or "tdx"
+	Technology string
+	// Launch is QEMU's response to 'query-sev' for SEV-SNP guests, including the guest policy and
+	// firmware version. It's unset for TDX, where the launch details are only in the guest's report.
+	Launch json.RawMessage `json:",omitempty"`
+}
+
+// HotplugDisk is used to ask the runner to create the image for a hotpluggable disk, before the
+// controller attaches it to the VM
+type HotplugDisk struct {
+	Size      resource.Quantity
+	MountPath string
+	Discard   bool
+}
+
+// HotplugDiskImage is used in runner to reply to controller, with the path of the image created
+// for a HotplugDisk
+type HotplugDiskImage struct {
+	Path string
+}
+
+// GuestStatus is used in runner to reply to controller, describing the state of the guest
+type GuestStatus struct {
+	// Booted is true once the guest's init has finished, as reported on the serial console
+	Booted bool
+}
+
+// ExecRequest is used to ask the runner to run a command in the guest. It's also the body of
+// requests to the NeonVM controller's 'virtualmachines/exec' API.
+type ExecRequest struct {
+	// Command is the command to run, as a list of arguments. It's not run in a shell, unless the
+	// command is itself a shell.
+	Command []string `json:"command"`
+	// TimeoutSeconds, if not zero, gives the maximum duration of the command, after which it's
+	// killed. Defaults to ExecDefaultTimeoutSeconds, and is capped at ExecMaxTimeoutSeconds.
+	TimeoutSeconds uint `json:"timeoutSeconds,omitempty"`
+}
+
+const (
+	ExecDefaultTimeoutSeconds uint = 60
+	ExecMaxTimeoutSeconds     uint = 600
+)
+
+// ExecResult is used in runner to reply to an ExecRequest, once the command has finished
+type ExecResult struct {
+	// ExitCode is the exit code of the command. It's -1 if the command was killed (e.g. because
+	// it timed out).
+	ExitCode int `json:"exitCode"`
+	// Stdout and Stderr are the output of the command, truncated to their first ExecMaxOutputBytes.
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// Truncated is true if either of Stdout or Stderr was truncated.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ExecMaxOutputBytes is the maximum size of each of ExecResult's Stdout and Stderr
+const ExecMaxOutputBytes = 1 << 20 // 1 MiB
+
+// QMPAuthenticateCommand is the QMP command that clients of neonvm-runner's QMP proxy must send
+// before any command other than 'qmp_capabilities'. It's handled by the proxy, and never reaches
+// QEMU.
+const QMPAuthenticateCommand = "neonvm-authenticate"
+
+// QMPAuthenticateArguments are the arguments for QMPAuthenticateCommand
+type QMPAuthenticateArguments struct {
+	Token string `json:"token"`
+}
+
+// QMPAuthTokenHash returns the hash of the QMP auth token that's given to neonvm-runner, so that the
+// token itself isn't visible in the runner pod's spec.
+func QMPAuthTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
 
 // this a similar version type for controller <-> runner communications
@@ -501,7 +776,49 @@ type Allocation struct {
 // Since the agent cannot control if the agent will choose to upscale the VM,
 // it does not return anything. If an upscale is granted, the agent will notify
 // the monitor via an UpscaleConfirmation
-type UpscaleRequest struct{}
+type UpscaleRequest struct {
+	// Severity, if not empty, gives how urgently the VM needs more memory. Higher severities may
+	// upscale the VM by more than one compute unit at a time.
+	//
+	// Only set if MonitorCapUpscaleSeverity was negotiated.
+	Severity UpscaleSeverity `json:"severity,omitempty"`
+	// Reason, if not empty, gives what caused the vm-monitor to request upscaling.
+	//
+	// Only set if MonitorCapUpscaleSeverity was negotiated.
+	Reason UpscaleReason `json:"reason,omitempty"`
+}
+
+// UpscaleSeverity is the urgency of an UpscaleRequest
+//
+// Unknown severities must be treated as UpscaleSeverityLow, so that new levels can be added
+// without requiring the agent to be upgraded first.
+type UpscaleSeverity string
+
+const (
+	// UpscaleSeverityLow is for requests where the VM is expected to need more memory soon, e.g.
+	// from periodic usage polling. It's the same as not setting a severity.
+	UpscaleSeverityLow UpscaleSeverity = "low"
+	// UpscaleSeverityMedium is for requests where the VM's workload is already being slowed down by
+	// lack of memory, e.g. from sustained partial memory pressure.
+	UpscaleSeverityMedium UpscaleSeverity = "medium"
+	// UpscaleSeverityCritical is for requests where the VM is about to run out of memory, or
+	// already has, e.g. from full memory pressure or an OOM kill.
+	UpscaleSeverityCritical UpscaleSeverity = "critical"
+)
+
+// UpscaleReason is the cause of an UpscaleRequest, used for logs and metrics
+type UpscaleReason string
+
+const (
+	// UpscaleReasonUsage is for requests from the vm-monitor's periodic polling of memory usage.
+	UpscaleReasonUsage UpscaleReason = "usage"
+	// UpscaleReasonMemoryPressure is for requests from the guest's memory pressure stall
+	// information (PSI), read from /proc/pressure/memory.
+	UpscaleReasonMemoryPressure UpscaleReason = "memory_pressure"
+	// UpscaleReasonOOMKill is for requests from the guest's kernel killing a process because it
+	// ran out of memory.
+	UpscaleReasonOOMKill UpscaleReason = "oom_kill"
+)
 
 // This type is sent to the agent to confirm it successfully upscaled, meaning
 // it increased its filecache and/or cgroup memory limits. The agent does not
@@ -515,6 +832,13 @@ type DownscaleResult struct {
 	Status string
 }
 
+// This type is sent to the agent in response to a FileCacheTarget, once the monitor has resized
+// the file cache (or failed to). The agent does not need to respond.
+type FileCacheTargetResult struct {
+	Ok     bool   `json:"ok"`
+	Status string `json:"status"`
+}
+
 // ** Types sent by agent **
 
 // This type is sent to the monitor to inform it that it has been granted a geater
@@ -522,6 +846,9 @@ type DownscaleResult struct {
 // file cache size, cgroup memory limits) it should reply with an UpscaleConfirmation.
 type UpscaleNotification struct {
 	Granted Allocation `json:"granted"`
+	// CorrelationID is the ID of the agent's scaling transaction that this is part of. It's only
+	// set if the monitor has MonitorCapCorrelationIDs.
+	CorrelationID string `json:"correlationID,omitempty"`
 }
 
 // This type is sent to the monitor as a request to downscale its resource usage.
@@ -529,6 +856,21 @@ type UpscaleNotification struct {
 // DownscaleResult.
 type DownscaleRequest struct {
 	Target Allocation `json:"target"`
+	// CorrelationID is the ID of the agent's scaling transaction that this is part of. It's only
+	// set if the monitor has MonitorCapCorrelationIDs.
+	CorrelationID string `json:"correlationID,omitempty"`
+}
+
+// This type is sent to the monitor to set the size of the file cache, if the monitor has
+// MonitorCapFileCacheTarget. The target applies until the next FileCacheTarget, or until the VM's
+// memory changes - after which the monitor should keep the file cache at the same size, or as
+// close as the new memory allows, until it receives a new target.
+//
+// Once the monitor has resized the file cache or failed to do so, it should respond with a
+// FileCacheTargetResult.
+type FileCacheTarget struct {
+	// Size is the target size of the file cache, in bytes
+	Size uint64 `json:"size"`
 }
 
 // ** Types shared by agent and monitor **
@@ -556,6 +898,7 @@ type HealthCheck struct{}
 // the following types maybe be sent to the monitor, and thus passed in:
 // - DownscaleRequest
 // - UpscaleNotification
+// - FileCacheTarget (only if the monitor has MonitorCapFileCacheTarget)
 // - InvalidMessage
 // - InternalError
 // - HealthCheck
@@ -573,6 +916,8 @@ func SerializeMonitorMessage(content any, id uint64) ([]byte, error) {
 		typeStr = "DownscaleRequest"
 	case UpscaleNotification:
 		typeStr = "UpscaleNotification"
+	case FileCacheTarget:
+		typeStr = "FileCacheTarget"
 	case InvalidMessage:
 		typeStr = "InvalidMessage"
 	case InternalError:
@@ -601,9 +946,17 @@ type MonitorProtoVersion uint32
 
 const (
 	// MonitorProtoV1_0 represents v1.0 of the agent<->monitor protocol - the initial version.
+	MonitorProtoV1_0 = iota + 1
+
+	// MonitorProtoV1_1 represents v1.1 of the agent<->monitor protocol.
+	//
+	// Changes from v1.0:
+	//
+	// * Adds an exchange of MonitorCapabilities immediately after the version is negotiated (refer
+	//   to SupportsCapabilityExchange).
 	//
 	// Currently the latest version.
-	MonitorProtoV1_0 = iota + 1
+	MonitorProtoV1_1
 
 	// latestMonitorProtoVersion represents the latest version of the agent<->Monitor protocol
 	//
@@ -621,6 +974,8 @@ func (v MonitorProtoVersion) String() string {
 		return "<invalid: zero>"
 	case MonitorProtoV1_0:
 		return "v1.0"
+	case MonitorProtoV1_1:
+		return "v1.1"
 	default:
 		diff := v - latestMonitorProtoVersion
 		return fmt.Sprintf("<unknown = %v + %d>", latestMonitorProtoVersion, diff)
@@ -636,3 +991,88 @@ type MonitorProtocolResponse struct {
 	// Will be nil if no error occurred.
 	Error *string `json:"error,omitempty"`
 }
+
+// SupportsCapabilityExchange returns whether this version of the protocol has the agent and monitor
+// exchange MonitorCapabilitiesMessages immediately after the protocol version is negotiated.
+//
+// With older versions, both sides must assume that the other only has MonitorCapabilitiesV1_0.
+//
+// This is true for version v1.1 and greater.
+func (v MonitorProtoVersion) SupportsCapabilityExchange() bool {
+	return v >= MonitorProtoV1_1
+}
+
+// MonitorCapabilities is a bitmap of optional features of the agent<->monitor protocol, so that
+// new features can be rolled out without requiring the agent and monitor to be upgraded in
+// lockstep.
+//
+// Each side sends the set of features that it supports; a feature may only be used if it's
+// supported by both. New features must only ever be added as new bits - existing bits must never
+// change meaning.
+type MonitorCapabilities uint64
+
+const (
+	// MonitorCapUpscaleRequests is set if the monitor may send UpscaleRequest messages.
+	MonitorCapUpscaleRequests MonitorCapabilities = 1 << iota
+	// MonitorCapFileCacheResize is set if the monitor resizes the file cache along with the VM's
+	// memory, on UpscaleNotification and DownscaleRequest.
+	MonitorCapFileCacheResize
+	// MonitorCapSwapResize is set if the monitor resizes the VM's swap along with its memory.
+	MonitorCapSwapResize
+	// MonitorCapCorrelationIDs is set if the monitor accepts (and logs) the correlation ID of the
+	// agent's scaling transaction in UpscaleNotification and DownscaleRequest.
+	MonitorCapCorrelationIDs
+	// MonitorCapFileCacheTarget is set if the monitor accepts FileCacheTarget messages, setting
+	// the size of the file cache independently of the VM's memory.
+	MonitorCapFileCacheTarget
+	// MonitorCapUpscaleSeverity is set if the monitor may include a Severity and Reason in
+	// UpscaleRequest messages, from watching the guest's memory pressure and OOM kills.
+	MonitorCapUpscaleSeverity
+)
+
+// MonitorCapabilitiesV1_0 is the set of capabilities implied by protocol v1.0, for use when the
+// capabilities were not exchanged.
+const MonitorCapabilitiesV1_0 = MonitorCapUpscaleRequests | MonitorCapFileCacheResize
+
+var monitorCapabilityNames = []struct {
+	cap  MonitorCapabilities
+	name string
+}{
+	{MonitorCapUpscaleRequests, "UpscaleRequests"},
+	{MonitorCapFileCacheResize, "FileCacheResize"},
+	{MonitorCapSwapResize, "SwapResize"},
+	{MonitorCapCorrelationIDs, "CorrelationIDs"},
+	{MonitorCapFileCacheTarget, "FileCacheTarget"},
+	{MonitorCapUpscaleSeverity, "UpscaleSeverity"},
+}
+
+// Has returns whether all of the capabilities in other are present in c
+func (c MonitorCapabilities) Has(other MonitorCapabilities) bool {
+	return c&other == other
+}
+
+// Names returns the names of the capabilities in c, including "Unknown(N)" for any bits that this
+// version doesn't know about.
+func (c MonitorCapabilities) Names() []string {
+	names := []string{}
+	for _, n := range monitorCapabilityNames {
+		if c.Has(n.cap) {
+			names = append(names, n.name)
+			c &^= n.cap
+		}
+	}
+	for bit := 0; c != 0; bit++ {
+		if c&(1<<bit) != 0 {
+			names = append(names, fmt.Sprintf("Unknown(%d)", bit))
+			c &^= 1 << bit
+		}
+	}
+	return names
+}
+
+// MonitorCapabilitiesMessage is sent by both the agent and the monitor, immediately after
+// negotiating a protocol version that SupportsCapabilityExchange. The agent sends first, and the
+// monitor replies with its own.
+type MonitorCapabilitiesMessage struct {
+	Capabilities MonitorCapabilities `json:"capabilities"`
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/samber/lo"
 	"github.com/tychoish/fun/erc"
@@ -26,6 +28,11 @@ const (
 	AnnotationAutoscalingBounds   = "autoscaling.neon.tech/bounds"
 	AnnotationAutoscalingConfig   = "autoscaling.neon.tech/config"
 	AnnotationBillingEndpointID   = "autoscaling.neon.tech/billing-endpoint-id"
+	AnnotationDownscalePriority   = "autoscaling.neon.tech/downscale-priority"
+	AnnotationMetricsSource       = "autoscaling.neon.tech/metrics-source"
+	AnnotationMonitorClass        = "autoscaling.neon.tech/monitor-class"
+	AnnotationMonitorConfig       = "autoscaling.neon.tech/monitor-config"
+	AnnotationScalingSchedule     = "autoscaling.neon.tech/schedule"
 )
 
 func hasTrueLabel(obj metav1.ObjectMetaAccessor, labelName string) bool {
@@ -39,6 +46,12 @@ func HasAutoscalingEnabled(obj metav1.ObjectMetaAccessor) bool {
 	return hasTrueLabel(obj, LabelEnableAutoscaling)
 }
 
+// VmHasAutoscalingEnabled returns true iff autoscaling is in effect for the VM, taking both the
+// label and .spec.autoscaling into account
+func VmHasAutoscalingEnabled(vm *vmapi.VirtualMachine) bool {
+	return vm.Spec.Autoscaling.IsEnabled(HasAutoscalingEnabled(vm))
+}
+
 // HasAutoMigrationEnabled returns true iff the object has the label that enables "automatic"
 // scheduler-triggered migration, and it's set to "true"
 func HasAutoMigrationEnabled(obj metav1.ObjectMetaAccessor) bool {
@@ -112,6 +125,47 @@ type VmConfig struct {
 	AlwaysMigrate  bool           `json:"alwaysMigrate"`
 	ScalingEnabled bool           `json:"scalingEnabled"`
 	ScalingConfig  *ScalingConfig `json:"scalingConfig,omitempty"`
+	// DownscalePriority determines the order in which the scheduler plugin asks VMs on a node to
+	// downscale, when it needs capacity back. VMs with lower priority are asked first.
+	//
+	// It's set by the AnnotationDownscalePriority annotation, and defaults to zero.
+	DownscalePriority int32 `json:"downscalePriority"`
+	// MetricsSource is the name of the source that the autoscaler-agent should fetch the VM's
+	// system metrics from, e.g. "node-exporter". If empty, the default source is used.
+	//
+	// It's set by the AnnotationMetricsSource annotation.
+	MetricsSource string `json:"metricsSource,omitempty"`
+	// MonitorClass is the name of the class of monitor connection settings that the
+	// autoscaler-agent should use for this VM, from its config. If empty, no class is used.
+	//
+	// It's set by the AnnotationMonitorClass annotation.
+	MonitorClass string `json:"monitorClass,omitempty"`
+	// MonitorConfig overrides the autoscaler-agent's settings for its connection to this VM's
+	// vm-monitor, taking precedence over MonitorClass.
+	//
+	// It's set by the AnnotationMonitorConfig annotation.
+	MonitorConfig *MonitorConfigOverrides `json:"monitorConfig,omitempty"`
+	// ScalingSchedule adjusts the VM's scaling bounds during recurring windows of time. The bounds
+	// in VmInfo are not adjusted; see (VmInfo).WithScalingSchedule.
+	//
+	// It's set by the AnnotationScalingSchedule annotation.
+	ScalingSchedule *ScalingSchedule `json:"scalingSchedule,omitempty"`
+	// Priority is the VM's class of priority for resources on its node. If empty, the VM has
+	// standard priority; see (VmConfig).EffectivePriority.
+	//
+	// It's set from .spec.priority, which is mirrored to the runner pod by the
+	// vmapi.VirtualMachinePriorityAnnotation annotation.
+	Priority vmapi.VirtualMachinePriority `json:"priority,omitempty"`
+}
+
+// EffectivePriority returns the VM's priority, treating empty or unknown values as standard.
+func (c VmConfig) EffectivePriority() vmapi.VirtualMachinePriority {
+	switch c.Priority {
+	case vmapi.PriorityLatencySensitive, vmapi.PriorityBatch:
+		return c.Priority
+	default:
+		return vmapi.PriorityStandard
+	}
 }
 
 // Using returns the Resources that this VmInfo says the VM is using
@@ -150,7 +204,7 @@ func (vm VmInfo) NamespacedName() util.NamespacedName {
 
 func ExtractVmInfo(logger *zap.Logger, vm *vmapi.VirtualMachine) (*VmInfo, error) {
 	logger = logger.With(util.VMNameFields(vm))
-	return extractVmInfoGeneric(logger, vm.Name, vm, vm.Spec.Resources())
+	return extractVmInfoGeneric(logger, vm.Name, vm, vm.Spec.Resources(), vm.Spec.Priority, vm.Spec.Autoscaling)
 }
 
 func ExtractVmInfoFromPod(logger *zap.Logger, pod *corev1.Pod) (*VmInfo, error) {
@@ -163,8 +217,17 @@ func ExtractVmInfoFromPod(logger *zap.Logger, pod *corev1.Pod) (*VmInfo, error)
 			vmapi.VirtualMachineResourcesAnnotation, err)
 	}
 
+	var autoscaling *vmapi.AutoscalingSpec
+	if autoscalingJSON, ok := pod.Annotations[vmapi.VirtualMachineAutoscalingAnnotation]; ok {
+		if err := json.Unmarshal([]byte(autoscalingJSON), &autoscaling); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling %q: %w",
+				vmapi.VirtualMachineAutoscalingAnnotation, err)
+		}
+	}
+
 	vmName := pod.Labels[vmapi.VirtualMachineNameLabel]
-	return extractVmInfoGeneric(logger, vmName, pod, resources)
+	priority := vmapi.VirtualMachinePriority(pod.Annotations[vmapi.VirtualMachinePriorityAnnotation])
+	return extractVmInfoGeneric(logger, vmName, pod, resources, priority, autoscaling)
 }
 
 func extractVmInfoGeneric(
@@ -172,12 +235,14 @@ func extractVmInfoGeneric(
 	vmName string,
 	obj metav1.ObjectMetaAccessor,
 	resources vmapi.VirtualMachineResources,
+	priority vmapi.VirtualMachinePriority,
+	autoscaling *vmapi.AutoscalingSpec,
 ) (*VmInfo, error) {
 	cpuInfo := NewVmCpuInfo(resources.CPUs)
 	memInfo := NewVmMemInfo(resources.MemorySlots, resources.MemorySlotSize)
 
 	autoMigrationEnabled := HasAutoMigrationEnabled(obj)
-	scalingEnabled := HasAutoscalingEnabled(obj)
+	scalingEnabled := autoscaling.IsEnabled(HasAutoscalingEnabled(obj))
 	alwaysMigrate := HasAlwaysMigrateLabel(obj)
 
 	info := VmInfo{
@@ -190,6 +255,12 @@ func extractVmInfoGeneric(
 			AlwaysMigrate:        alwaysMigrate,
 			ScalingEnabled:       scalingEnabled,
 			ScalingConfig:        nil, // set below, maybe
+			DownscalePriority:    0,   // set below, maybe
+			MetricsSource:        obj.GetObjectMeta().GetAnnotations()[AnnotationMetricsSource],
+			MonitorClass:         obj.GetObjectMeta().GetAnnotations()[AnnotationMonitorClass],
+			MonitorConfig:        nil, // set below, maybe
+			ScalingSchedule:      nil, // set below, maybe
+			Priority:             priority,
 		},
 	}
 
@@ -205,6 +276,14 @@ func extractVmInfoGeneric(
 		info.applyBounds(bounds)
 	}
 
+	if priority, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationDownscalePriority]; ok {
+		value, err := strconv.ParseInt(priority, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Bad downscale priority in annotation %q: %w", AnnotationDownscalePriority, err)
+		}
+		info.Config.DownscalePriority = int32(value)
+	}
+
 	if configJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationAutoscalingConfig]; ok {
 		var config ScalingConfig
 		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
@@ -217,6 +296,30 @@ func extractVmInfoGeneric(
 		info.Config.ScalingConfig = &config
 	}
 
+	if configJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationMonitorConfig]; ok {
+		var config MonitorConfigOverrides
+		if err := json.Unmarshal([]byte(configJSON), &config); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationMonitorConfig, err)
+		}
+
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("Bad monitor config in annotation %q: %w", AnnotationMonitorConfig, err)
+		}
+		info.Config.MonitorConfig = &config
+	}
+
+	if scheduleJSON, ok := obj.GetObjectMeta().GetAnnotations()[AnnotationScalingSchedule]; ok {
+		var schedule ScalingSchedule
+		if err := json.Unmarshal([]byte(scheduleJSON), &schedule); err != nil {
+			return nil, fmt.Errorf("Error unmarshaling annotation %q: %w", AnnotationScalingSchedule, err)
+		}
+
+		if err := schedule.Validate(&resources.MemorySlotSize); err != nil {
+			return nil, fmt.Errorf("Bad scaling schedule in annotation %q: %w", AnnotationScalingSchedule, err)
+		}
+		info.Config.ScalingSchedule = &schedule
+	}
+
 	min := info.Min()
 	using := info.Using()
 	max := info.Max()
@@ -335,6 +438,129 @@ type ScalingConfig struct {
 	// For an individual VM, if this field is left out the settings will fall back on the global
 	// default.
 	EnableLFCMetrics *bool `json:"enableLFCMetrics,omitempty"`
+
+	// FileCache, if not nil, configures dynamic sizing of the Local File Cache (LFC), based on its
+	// hit rate and working set size. This requires EnableLFCMetrics, and a vm-monitor that supports
+	// MonitorCapFileCacheTarget.
+	//
+	// This field is optional. For an individual VM, if this field is present, it replaces the
+	// global default entirely.
+	FileCache *FileCacheConfig `json:"fileCache,omitempty"`
+
+	// Predictive, if not nil, enables scaling ahead of the VM's forecast load, in addition to its
+	// current load.
+	//
+	// This field is optional. For an individual VM, if this field is present, it replaces the
+	// global default entirely.
+	Predictive *PredictiveScalingConfig `json:"predictive,omitempty"`
+
+	// ScaleDownDelaySeconds, if not zero, is how long the VM's metrics must continuously call for
+	// less resources before we downscale. The delay restarts whenever the VM is rescaled, so that
+	// load oscillating around a threshold doesn't make the VM flap between compute units.
+	//
+	// This field is optional. For an individual VM, if this field is left out the settings will
+	// fall back on the global default.
+	ScaleDownDelaySeconds *uint `json:"scaleDownDelaySeconds,omitempty"`
+
+	// ScaleUpStabilizationWindowSeconds, if not zero, is how long the VM's metrics must
+	// continuously call for more resources before we upscale. Like ScaleDownDelaySeconds, the
+	// window restarts whenever the VM is rescaled. Upscaling requested by the vm-monitor is never
+	// delayed.
+	//
+	// This field is optional. For an individual VM, if this field is left out the settings will
+	// fall back on the global default.
+	ScaleUpStabilizationWindowSeconds *uint `json:"scaleUpStabilizationWindowSeconds,omitempty"`
+}
+
+// FileCachePolicy selects how the size of the Local File Cache (LFC) is chosen
+type FileCachePolicy string
+
+const (
+	// FileCachePolicyFixedFraction leaves the size of the LFC to the vm-monitor, which uses a
+	// fixed fraction of the VM's memory. This is the behavior if FileCacheConfig is not set.
+	FileCachePolicyFixedFraction FileCachePolicy = "FixedFraction"
+	// FileCachePolicyWorkingSet sizes the LFC to fit the estimated working set, with
+	// FileCacheConfig.WorkingSetHeadroom.
+	FileCachePolicyWorkingSet FileCachePolicy = "WorkingSet"
+	// FileCachePolicyHitRate grows the LFC while its hit rate is below
+	// FileCacheConfig.TargetHitRate, and otherwise shrinks it towards the estimated working set.
+	FileCachePolicyHitRate FileCachePolicy = "HitRate"
+)
+
+// FileCacheConfig configures dynamic sizing of the Local File Cache (LFC)
+type FileCacheConfig struct {
+	// Policy selects how the size of the LFC is chosen.
+	Policy FileCachePolicy `json:"policy"`
+	// TargetHitRate is the fraction of LFC reads that we'd like to be hits, between 0 and 1.
+	//
+	// Required for FileCachePolicyHitRate, ignored otherwise.
+	TargetHitRate float64 `json:"targetHitRate,omitempty"`
+	// WorkingSetHeadroom is the factor that the estimated working set size is multiplied by, to
+	// allow for growth. For example, with a value of 1.25 and a working set of 1 GiB, the LFC
+	// would be sized to 1.25 GiB.
+	//
+	// Required (and must be at least 1) for FileCachePolicyWorkingSet and FileCachePolicyHitRate.
+	WorkingSetHeadroom float64 `json:"workingSetHeadroom,omitempty"`
+	// MinMemoryFraction and MaxMemoryFraction bound the size of the LFC as fractions of the VM's
+	// memory. They must satisfy 0 <= MinMemoryFraction <= MaxMemoryFraction < 1.
+	MinMemoryFraction float64 `json:"minMemoryFraction"`
+	MaxMemoryFraction float64 `json:"maxMemoryFraction"`
+}
+
+func (c *FileCacheConfig) validate(ec *erc.Collector) {
+	switch c.Policy {
+	case FileCachePolicyFixedFraction:
+		// Nothing else to check; the other fields are ignored.
+		return
+	case FileCachePolicyWorkingSet:
+		// ok
+	case FileCachePolicyHitRate:
+		erc.Whenf(
+			ec, c.TargetHitRate <= 0.0 || c.TargetHitRate >= 1.0,
+			"%s must be set to value between 0 and 1 (exclusive)", ".fileCache.targetHitRate",
+		)
+	default:
+		ec.Add(fmt.Errorf("%s has unknown value %q", ".fileCache.policy", c.Policy))
+		return
+	}
+
+	erc.Whenf(ec, c.WorkingSetHeadroom < 1.0, "%s must be set to value >= 1", ".fileCache.workingSetHeadroom")
+	erc.Whenf(ec, c.MinMemoryFraction < 0.0, "%s must be set to value >= 0", ".fileCache.minMemoryFraction")
+	erc.Whenf(ec, c.MaxMemoryFraction >= 1.0, "%s must be set to value < 1", ".fileCache.maxMemoryFraction")
+	erc.Whenf(
+		ec, c.MinMemoryFraction > c.MaxMemoryFraction,
+		"%s must not be greater than %s", ".fileCache.minMemoryFraction", ".fileCache.maxMemoryFraction",
+	)
+}
+
+// PredictiveScalingConfig configures scaling ahead of forecast load
+//
+// Load average and memory usage are each forecast with double exponential smoothing (Holt's linear
+// trend method), and the VM is scaled for the greater of the current and forecast values. Forecasts
+// are only used to scale up sooner, never to scale down.
+type PredictiveScalingConfig struct {
+	// HorizonSeconds is how far ahead to forecast, in seconds. It should be about as long as it
+	// takes to upscale the VM.
+	HorizonSeconds uint `json:"horizonSeconds"`
+	// LevelSmoothing is the weight given to the most recent sample when updating the smoothed
+	// value, between 0 (exclusive) and 1 (inclusive). Higher values follow changes more closely.
+	LevelSmoothing float64 `json:"levelSmoothing"`
+	// TrendSmoothing is the weight given to the most recent change when updating the smoothed
+	// trend, between 0 and 1 (both inclusive). Higher values react to new trends faster, but are
+	// more sensitive to noise.
+	TrendSmoothing float64 `json:"trendSmoothing"`
+}
+
+func (c *PredictiveScalingConfig) validate(ec *erc.Collector) {
+	erc.Whenf(ec, c.HorizonSeconds == 0, "%s must be set to value > 0", ".predictive.horizonSeconds")
+	erc.Whenf(
+		ec, c.LevelSmoothing <= 0.0 || c.LevelSmoothing > 1.0,
+		"%s must be set to value > 0 and <= 1", ".predictive.levelSmoothing",
+	)
+	erc.Whenf(
+		ec, c.TrendSmoothing < 0.0 || c.TrendSmoothing > 1.0,
+		"%s must be set to value between 0 and 1 (inclusive)", ".predictive.trendSmoothing",
+	)
 }
 
 // WithOverrides returns a new copy of defaults, where fields set in overrides replace the ones in
@@ -355,6 +581,18 @@ func (defaults ScalingConfig) WithOverrides(overrides *ScalingConfig) ScalingCon
 	if overrides.EnableLFCMetrics != nil {
 		defaults.EnableLFCMetrics = lo.ToPtr(*overrides.EnableLFCMetrics)
 	}
+	if overrides.FileCache != nil {
+		defaults.FileCache = lo.ToPtr(*overrides.FileCache)
+	}
+	if overrides.Predictive != nil {
+		defaults.Predictive = lo.ToPtr(*overrides.Predictive)
+	}
+	if overrides.ScaleDownDelaySeconds != nil {
+		defaults.ScaleDownDelaySeconds = lo.ToPtr(*overrides.ScaleDownDelaySeconds)
+	}
+	if overrides.ScaleUpStabilizationWindowSeconds != nil {
+		defaults.ScaleUpStabilizationWindowSeconds = lo.ToPtr(*overrides.ScaleUpStabilizationWindowSeconds)
+	}
 
 	return defaults
 }
@@ -400,6 +638,58 @@ func (c *ScalingConfig) validate(requireAll bool) error {
 		erc.Whenf(ec, c.EnableLFCMetrics == nil, "%s is a required field", ".enableLFCMetrics")
 	}
 
+	if c.FileCache != nil {
+		c.FileCache.validate(ec)
+	}
+
+	if c.Predictive != nil {
+		c.Predictive.validate(ec)
+	}
+
 	// heads-up! some functions elsewhere depend on the concrete return type of this function.
 	return ec.Resolve()
 }
+
+// ScaleDownDelay returns ScaleDownDelaySeconds as a time.Duration, or zero if it's not set
+func (c *ScalingConfig) ScaleDownDelay() time.Duration {
+	return time.Second * time.Duration(lo.FromPtr(c.ScaleDownDelaySeconds))
+}
+
+// ScaleUpStabilizationWindow returns ScaleUpStabilizationWindowSeconds as a time.Duration, or zero
+// if it's not set
+func (c *ScalingConfig) ScaleUpStabilizationWindow() time.Duration {
+	return time.Second * time.Duration(lo.FromPtr(c.ScaleUpStabilizationWindowSeconds))
+}
+
+// MonitorConfigOverrides overrides the autoscaler-agent's settings for its connection to a VM's
+// vm-monitor. Fields that are left out fall back on the autoscaler-agent's config.
+//
+// Refer to the autoscaler-agent's MonitorConfig for the meaning of each field.
+type MonitorConfigOverrides struct {
+	ResponseTimeoutSeconds                  *uint `json:"responseTimeoutSeconds,omitempty"`
+	ConnectionTimeoutSeconds                *uint `json:"connectionTimeoutSeconds,omitempty"`
+	ConnectionRetryMinWaitSeconds           *uint `json:"connectionRetryMinWaitSeconds,omitempty"`
+	UnhealthyAfterSilenceDurationSeconds    *uint `json:"unhealthyAfterSilenceDurationSeconds,omitempty"`
+	UnhealthyStartupGracePeriodSeconds      *uint `json:"unhealthyStartupGracePeriodSeconds,omitempty"`
+	MaxHealthCheckSequentialFailuresSeconds *uint `json:"maxHealthCheckSequentialFailuresSeconds,omitempty"`
+	RetryFailedRequestSeconds               *uint `json:"retryFailedRequestSeconds,omitempty"`
+}
+
+// Validate checks that all fields that are set are non-zero.
+func (c *MonitorConfigOverrides) Validate() error {
+	ec := &erc.Collector{}
+
+	checkNonZero := func(field string, value *uint) {
+		erc.Whenf(ec, value != nil && *value == 0, "%s must be set to value > 0", field)
+	}
+
+	checkNonZero(".responseTimeoutSeconds", c.ResponseTimeoutSeconds)
+	checkNonZero(".connectionTimeoutSeconds", c.ConnectionTimeoutSeconds)
+	checkNonZero(".connectionRetryMinWaitSeconds", c.ConnectionRetryMinWaitSeconds)
+	checkNonZero(".unhealthyAfterSilenceDurationSeconds", c.UnhealthyAfterSilenceDurationSeconds)
+	checkNonZero(".unhealthyStartupGracePeriodSeconds", c.UnhealthyStartupGracePeriodSeconds)
+	checkNonZero(".maxHealthCheckSequentialFailuresSeconds", c.MaxHealthCheckSequentialFailuresSeconds)
+	checkNonZero(".retryFailedRequestSeconds", c.RetryFailedRequestSeconds)
+
+	return ec.Resolve()
+}
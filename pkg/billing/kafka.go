@@ -0,0 +1,129 @@
+package billing
+
+// Sending billing events to Kafka, via a Kafka REST proxy (REST API v2)
+//
+// Each event is produced as a separate record, keyed by its endpoint ID so that all events for an
+// endpoint end up in the same partition, in order.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type KafkaClientConfig struct {
+	// RESTProxyURL is the base URL of the Kafka REST proxy, e.g. "http://kafka-rest:8082"
+	RESTProxyURL string `json:"restProxyURL"`
+	// Topic is the topic that events are produced to
+	Topic string `json:"topic"`
+}
+
+type KafkaError struct {
+	Err error
+}
+
+func (e KafkaError) Error() string {
+	return fmt.Sprintf("Kafka error: %s", e.Err.Error())
+}
+
+func (e KafkaError) Unwrap() error {
+	return e.Err
+}
+
+type KafkaClient struct {
+	cfg   KafkaClientConfig
+	url   string
+	httpc *http.Client
+}
+
+func NewKafkaClient(cfg KafkaClientConfig, c *http.Client) KafkaClient {
+	return KafkaClient{
+		cfg:   cfg,
+		url:   fmt.Sprintf("%s/topics/%s", cfg.RESTProxyURL, url.PathEscape(cfg.Topic)),
+		httpc: c,
+	}
+}
+
+func (c KafkaClient) LogFields() zap.Field {
+	return zap.Inline(zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+		enc.AddString("restProxyURL", c.cfg.RESTProxyURL)
+		enc.AddString("topic", c.cfg.Topic)
+		return nil
+	}))
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (c KafkaClient) send(ctx context.Context, payload []byte, traceID TraceID) error {
+	// The payload is the batch of events; we need to split it back up into individual records.
+	var batch struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(payload, &batch); err != nil {
+		return KafkaError{Err: fmt.Errorf("could not split events: %w", err)}
+	}
+
+	records := make([]kafkaRecord, 0, len(batch.Events))
+	for _, event := range batch.Events {
+		var keyed struct {
+			EndpointID string `json:"endpoint_id"`
+		}
+		_ = json.Unmarshal(event, &keyed) // events without an endpoint ID are unkeyed
+		records = append(records, kafkaRecord{Key: keyed.EndpointID, Value: event})
+	}
+
+	body, err := json.Marshal(struct {
+		Records []kafkaRecord `json:"records"`
+	}{Records: records})
+	if err != nil {
+		return KafkaError{Err: err}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return RequestError{Err: err}
+	}
+	r.Header.Set("content-type", "application/vnd.kafka.json.v2+json")
+	r.Header.Set("accept", "application/vnd.kafka.v2+json")
+	r.Header.Set("x-trace-id", string(traceID))
+
+	resp, err := c.httpc.Do(r)
+	if err != nil {
+		return RequestError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return UnexpectedStatusCodeError{StatusCode: resp.StatusCode}
+	}
+
+	// The REST proxy can return 200 even if producing some of the records failed, so we have to
+	// check each of them. Retrying the whole batch is fine, because events are idempotent.
+	var produced kafkaProduceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return KafkaError{Err: fmt.Errorf("could not decode response: %w", err)}
+	}
+	for _, o := range produced.Offsets {
+		if o.ErrorCode != nil {
+			return KafkaError{Err: fmt.Errorf("failed to produce record: code %d: %s", *o.ErrorCode, o.Error)}
+		}
+	}
+
+	return nil
+}
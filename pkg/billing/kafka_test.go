@@ -0,0 +1,100 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaClientSend(t *testing.T) {
+	type record struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+
+	cases := []struct {
+		name     string
+		status   int
+		response string
+		check    func(t *testing.T, err error)
+	}{
+		{
+			name:     "success",
+			status:   http.StatusOK,
+			response: `{"offsets":[{"partition":0,"offset":1},{"partition":1,"offset":7}]}`,
+			check: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "per-record error",
+			status:   http.StatusOK,
+			response: `{"offsets":[{"partition":0,"offset":1},{"error_code":50003,"error":"leader not available"}]}`,
+			check: func(t *testing.T, err error) {
+				var kafkaErr KafkaError
+				require.ErrorAs(t, err, &kafkaErr)
+				assert.Contains(t, err.Error(), "code 50003: leader not available")
+			},
+		},
+		{
+			name:     "malformed response",
+			status:   http.StatusOK,
+			response: `not json`,
+			check: func(t *testing.T, err error) {
+				var kafkaErr KafkaError
+				require.ErrorAs(t, err, &kafkaErr)
+			},
+		},
+		{
+			name:   "unexpected status",
+			status: http.StatusServiceUnavailable,
+			check: func(t *testing.T, err error) {
+				var statusErr UnexpectedStatusCodeError
+				require.ErrorAs(t, err, &statusErr)
+				assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var received []record
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/topics/billing%2Fevents", r.URL.RawPath)
+				assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("content-type"))
+				assert.Equal(t, "trace", r.Header.Get("x-trace-id"))
+
+				var body struct {
+					Records []record `json:"records"`
+				}
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				received = body.Records
+
+				w.WriteHeader(c.status)
+				_, _ = w.Write([]byte(c.response))
+			}))
+			defer server.Close()
+
+			client := NewKafkaClient(KafkaClientConfig{RESTProxyURL: server.URL, Topic: "billing/events"}, server.Client())
+			events := []*IncrementalEvent{
+				{IdempotencyKey: "a", EndpointID: "ep-1", Value: 1},
+				{IdempotencyKey: "b", EndpointID: "ep-2", Value: 2},
+			}
+			c.check(t, Send(context.Background(), client, "trace", events))
+
+			// Each event is produced as its own record, keyed by endpoint ID
+			require.Len(t, received, 2)
+			for i, r := range received {
+				assert.Equal(t, events[i].EndpointID, r.Key)
+				var value IncrementalEvent
+				require.NoError(t, json.Unmarshal(r.Value, &value))
+				assert.Equal(t, events[i].IdempotencyKey, value.IdempotencyKey)
+			}
+		})
+	}
+}
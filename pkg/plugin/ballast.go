@@ -0,0 +1,149 @@
+package plugin
+
+// Per-node memory ballast
+//
+// The ballast is an amount of memory on each node that's reserved by the scheduler plugin itself,
+// rather than any particular pod. Portions of it are lent to VMs on the node as a BallastGrant in
+// each PluginResponse, which the autoscaler-agent may use to upscale immediately, without waiting
+// for another round-trip to the scheduler. On the next request, whatever was used is converted into
+// a normal reservation for the pod, and the ballast is replenished from the node's remaining
+// capacity.
+//
+// The ballast is reclaimable: any portion of it that isn't currently lent out is given up to make
+// room for a normal upscale request or a new pod that wouldn't otherwise fit. Filter does the same
+// accounting, only counting the lent-out portion as used.
+//
+// Invariants, for each node:
+//
+//	node.Reserved == sum(pod.Reserved) + node.Ballast
+//	node.BallastGranted == sum(pod.BallastGrant)
+//	node.BallastGranted <= node.Ballast
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/exp/constraints"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type ballastConfig struct {
+	// Memory is the fraction of each node's memory to hold in the ballast. The ballast is never
+	// replenished above the node's memory watermark.
+	Memory float32 `json:"memory"`
+	// MaxGrantComputeUnits gives the maximum amount of ballast that may be lent to a single VM at
+	// a time, in multiples of the compute unit's memory.
+	MaxGrantComputeUnits uint16 `json:"maxGrantComputeUnits"`
+}
+
+func (c *ballastConfig) validate() (string, error) {
+	if c.Memory <= 0.0 {
+		return "memory", errors.New("value must be > 0")
+	} else if c.Memory >= 1.0 {
+		return "memory", errors.New("value must be < 1")
+	}
+	if c.MaxGrantComputeUnits == 0 {
+		return "maxGrantComputeUnits", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// memTarget returns the amount of memory that the node's ballast should hold
+func (c *ballastConfig) memTarget(node *nodeState) api.Bytes {
+	return api.Bytes(c.Memory * float32(node.mem.Total))
+}
+
+// useBallastGrant releases the pod's outstanding grant back to the node's ballast, and removes the
+// portion that the VM has already started using from the ballast, so that it can be reserved for
+// the pod by handleRequested.
+//
+// The autoscaler-agent reports what it's using in lastPermit, which includes any part of the grant
+// that it's upscaled into. The requested resources aren't enough: they're what the agent would
+// like, not what the VM has. If lastPermit is nil, none of the grant was used.
+//
+// The returned value is the minimum amount that handleRequested must approve in order to honor
+// the grant.
+func (r resourceTransitioner[T]) useBallastGrant(lastPermit *T) (forceApprovalMinimum T) {
+	grant := r.pod.BallastGrant
+	r.node.BallastGranted -= grant
+	r.pod.BallastGrant = 0
+
+	var used T
+	if lastPermit != nil {
+		used = util.Min(util.SaturatingSub(*lastPermit, r.pod.Reserved), grant)
+	}
+	r.node.Ballast -= used
+	r.node.Reserved -= used
+
+	return r.pod.Reserved + used
+}
+
+// reclaimBallast gives up as much of the node's unused ballast as is required for the pod's
+// reservation to increase to requested without using the last headroom of the node, if possible.
+func (r resourceTransitioner[T]) reclaimBallast(requested T, headroom T) {
+	remainingReservable := util.SaturatingSub(util.SaturatingSub(r.node.Total, headroom), r.node.Reserved)
+	r.giveUpBallast(util.SaturatingSub(util.SaturatingSub(requested, r.pod.Reserved), remainingReservable))
+}
+
+// reclaimExcessBallast gives up as much of the node's unused ballast as is required to bring the
+// node's reservation back within its total, if possible. It returns the amount reclaimed.
+func (r resourceTransitioner[T]) reclaimExcessBallast() T {
+	return r.giveUpBallast(util.SaturatingSub(r.node.Reserved, r.node.Total))
+}
+
+// giveUpBallast removes up to needed from the node's unused ballast, returning the amount removed
+func (r resourceTransitioner[T]) giveUpBallast(needed T) T {
+	reclaimed := util.Min(needed, r.node.Ballast-r.node.BallastGranted)
+	r.node.Ballast -= reclaimed
+	r.node.Reserved -= reclaimed
+	return reclaimed
+}
+
+// replenishBallast grows the node's ballast towards target, without increasing the node's total
+// reservation above its watermark.
+func (r resourceTransitioner[T]) replenishBallast(target T) {
+	added := util.Min(
+		util.SaturatingSub(target, r.node.Ballast),
+		util.SaturatingSub(r.node.Watermark, r.node.Reserved),
+	)
+	r.node.Ballast += added
+	r.node.Reserved += added
+}
+
+// grantBallast lends up to maxGrant of the node's unused ballast to the pod, rounded down to a
+// multiple of factor and bounded by the pod's maximum.
+func (r resourceTransitioner[T]) grantBallast(maxGrant T, factor T) T {
+	grant := util.Min(maxGrant, r.node.Ballast-r.node.BallastGranted)
+	grant = util.Min(grant, util.SaturatingSub(r.pod.Max, r.pod.Reserved))
+	grant = (grant / factor) * factor
+
+	r.pod.BallastGrant = grant
+	r.node.BallastGranted += grant
+	return grant
+}
+
+// releaseBallastGrant returns the pod's outstanding grant, if any, to the node's ballast. It's
+// used when the pod can no longer make use of the grant (e.g. on deletion or migration).
+func (r resourceTransitioner[T]) releaseBallastGrant() {
+	r.node.BallastGranted -= r.pod.BallastGrant
+	r.pod.BallastGrant = 0
+}
+
+// lentOut returns the amount of the node's resources that's lent to pods on top of their
+// reservations - as ballast grants or upscale leases - and so may already be in use. Unlike the
+// rest of the ballast, it can't be reclaimed.
+func lentOut[T constraints.Unsigned](s *nodeResourceState[T]) T {
+	return s.BallastGranted + s.Leased
+}
+
+// ballastVerdict returns a pretty-formatted summary of changes to the node's ballast, for logging
+func ballastVerdict[T constraints.Unsigned](oldState, newState resourceState[T]) string {
+	return fmt.Sprintf(
+		"pod grant %d -> %d; node ballast %d [granted %d] -> %d [granted %d]",
+		oldState.pod.BallastGrant, newState.pod.BallastGrant,
+		oldState.node.Ballast, oldState.node.BallastGranted, newState.node.Ballast, newState.node.BallastGranted,
+	)
+}
@@ -0,0 +1,220 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// testNodeMem returns a node's memory state with 2 units reserved for pods, plus the given ballast
+func testNodeMem(total, ballast, granted api.Bytes) nodeResourceState[api.Bytes] {
+	return nodeResourceState[api.Bytes]{
+		Total:          total,
+		Watermark:      total,
+		Reserved:       2 + ballast,
+		Ballast:        ballast,
+		BallastGranted: granted,
+	}
+}
+
+func TestUseBallastGrant(t *testing.T) {
+	cases := []struct {
+		name       string
+		lastPermit *api.Bytes
+
+		expectedMinimum api.Bytes
+		expectedBallast api.Bytes
+	}{
+		{"grant partially used", lo.ToPtr[api.Bytes](3), 3, 3},
+		{"grant fully used", lo.ToPtr[api.Bytes](4), 4, 2},
+		{"more than the grant", lo.ToPtr[api.Bytes](6), 4, 2},
+		{"grant unused", lo.ToPtr[api.Bytes](2), 2, 4},
+		{"no last permit", nil, 2, 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := testNodeMem(10, 4, 2)
+			pod := podResourceState[api.Bytes]{Reserved: 2, BallastGrant: 2, Max: 8}
+
+			minimum := makeResourceTransitioner(&node, &pod).useBallastGrant(c.lastPermit)
+
+			assert.Equal(t, c.expectedMinimum, minimum)
+			assert.Equal(t, c.expectedBallast, node.Ballast)
+			assert.Equal(t, api.Bytes(0), node.BallastGranted)
+			assert.Equal(t, api.Bytes(0), pod.BallastGrant)
+			// The used part of the grant is removed from the ballast, but not yet reserved for the
+			// pod. That's up to handleRequested, with the returned minimum.
+			assert.Equal(t, pod.Reserved+node.Ballast, node.Reserved)
+		})
+	}
+}
+
+func TestUseBallastGrantIgnoresRequested(t *testing.T) {
+	node := testNodeMem(10, 4, 2)
+	pod := podResourceState[api.Bytes]{Reserved: 2, BallastGrant: 2, Max: 8}
+	trans := makeResourceTransitioner(&node, &pod)
+
+	// The VM hasn't used any of its grant, but would like to upscale well beyond it. The request
+	// must go through the normal approval process, not be force-approved out of the ballast.
+	minimum := trans.useBallastGrant(lo.ToPtr[api.Bytes](2))
+	trans.handleRequested(8, &minimum, false, 1, 0)
+
+	assert.Equal(t, api.Bytes(4), node.Ballast, "unused grant should return to the ballast")
+	assert.Equal(t, api.Bytes(6), pod.Reserved)
+	assert.Equal(t, api.Bytes(2), pod.CapacityPressure)
+	assert.Equal(t, api.Bytes(10), node.Reserved)
+}
+
+func TestReclaimBallast(t *testing.T) {
+	cases := []struct {
+		name      string
+		requested api.Bytes
+		headroom  api.Bytes
+
+		expectedBallast api.Bytes
+	}{
+		{"fits without reclaiming", 6, 0, 4},
+		{"reclaims what's needed", 8, 0, 2},
+		{"never reclaims granted ballast", 10, 0, 1},
+		{"leaves headroom", 6, 2, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := testNodeMem(10, 4, 1)
+			pod := podResourceState[api.Bytes]{Reserved: 2, Max: 10}
+
+			makeResourceTransitioner(&node, &pod).reclaimBallast(c.requested, c.headroom)
+
+			assert.Equal(t, c.expectedBallast, node.Ballast)
+			assert.Equal(t, api.Bytes(1), node.BallastGranted)
+			assert.Equal(t, pod.Reserved+node.Ballast, node.Reserved)
+		})
+	}
+}
+
+func TestHandleReserveReclaimsBallast(t *testing.T) {
+	cases := []struct {
+		name      string
+		requested api.Bytes
+
+		expectedOverBudget bool
+		expectedBallast    api.Bytes
+	}{
+		{"fits without reclaiming", 4, false, 4},
+		{"fits after reclaiming", 7, false, 3},
+		{"fits after reclaiming all unlent", 9, false, 1},
+		{"doesn't fit", 10, true, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := testNodeMem(12, 4, 1)
+			pod := podResourceState[api.Bytes]{Reserved: c.requested, Min: c.requested, Max: c.requested}
+
+			overBudget, _ := makeResourceTransitioner(&node, &pod).handleReserve()
+
+			assert.Equal(t, c.expectedOverBudget, overBudget)
+			assert.Equal(t, c.expectedBallast, node.Ballast)
+			assert.Equal(t, api.Bytes(1), node.BallastGranted)
+			assert.Equal(t, 2+c.requested+node.Ballast, node.Reserved)
+		})
+	}
+}
+
+// Filter must agree with handleReserve about whether a pod fits, counting the lent-out portion of
+// the ballast (and any upscale leases) as used, but not the rest of the ballast.
+func TestFilterBallastAccounting(t *testing.T) {
+	const gib = api.Bytes(1 << 30)
+
+	cases := []struct {
+		name      string
+		requested api.Bytes
+		leased    api.Bytes
+
+		expectedFits bool
+	}{
+		{"fits in unused ballast", 5 * gib, 0, true},
+		{"would need lent-out ballast", 6 * gib, 0, false},
+		{"fits without the lease", 4 * gib, gib, true},
+		{"would need leased memory", 5 * gib, gib, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := &nodeState{
+				name: "node",
+				cpu:  nodeResourceState[vmapi.MilliCPU]{Total: 8000, Watermark: 8000},
+				// 4 GiB reserved for the existing pod, plus 4 GiB of ballast, 1 GiB of which is lent
+				// out.
+				mem:  testNodeMem(10*gib, 4*gib, gib),
+				pods: make(map[util.NamespacedName]*podState),
+			}
+			node.mem.Reserved = 8*gib + c.leased
+			node.mem.Leased = c.leased
+
+			existingName := util.NamespacedName{Namespace: "default", Name: "existing"}
+			existing := &podState{
+				name: existingName,
+				node: node,
+				cpu:  podResourceState[vmapi.MilliCPU]{Reserved: 1000},
+				mem:  podResourceState[api.Bytes]{Reserved: 4 * gib, BallastGrant: gib, Lease: c.leased},
+			}
+			node.pods[existingName] = existing
+
+			e := &AutoscaleEnforcer{
+				logger: zap.NewNop(),
+				state: pluginState{
+					lock:  util.NewChanMutex(),
+					pods:  map[util.NamespacedName]*podState{existingName: existing},
+					nodes: map[string]*nodeState{"node": node},
+					conf:  &Config{SchedulerName: "autoscale-scheduler"},
+				},
+			}
+			e.makePrometheusRegistry()
+
+			newPod := func(name string, mem api.Bytes) *corev1.Pod {
+				return &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+					Spec: corev1.PodSpec{
+						SchedulerName: "autoscale-scheduler",
+						Containers: []corev1.Container{{
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("1"),
+									corev1.ResourceMemory: *resource.NewQuantity(int64(mem), resource.BinarySI),
+								},
+							},
+						}},
+					},
+				}
+			}
+
+			nodeInfo := framework.NewNodeInfo(newPod("existing", 4*gib))
+			nodeInfo.SetNode(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}})
+
+			status := e.Filter(context.Background(), framework.NewCycleState(), newPod("new", c.requested), nodeInfo)
+
+			// Compare against what handleReserve would do with the same node
+			nodeMem := node.mem
+			podMem := podResourceState[api.Bytes]{Reserved: c.requested, Min: c.requested, Max: c.requested}
+			overBudget, _ := makeResourceTransitioner(&nodeMem, &podMem).handleReserve()
+
+			assert.Equal(t, c.expectedFits, status.IsSuccess(), "Filter status: %v", status)
+			assert.Equal(t, c.expectedFits, !overBudget)
+		})
+	}
+}
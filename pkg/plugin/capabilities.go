@@ -0,0 +1,57 @@
+package plugin
+
+// Matching VMs' required capabilities against nodes
+//
+// VMs can require node features (e.g. virtio-mem or hugepages) with .spec.requiredCapabilities,
+// or implicitly through other fields (e.g. .spec.enableConfidentialCompute requires the
+// confidential-compute capability). The controller copies them into the runner pod's annotations. Nodes publish the capabilities
+// they support as labels, and in Filter we reject any node that's missing one of the pod's
+// required capabilities. Pods without the annotation can run on any node.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+// checkNodeCapabilities returns a non-nil status if the node is missing any of the capabilities
+// required by the pod
+func checkNodeCapabilities(logger *zap.Logger, pod *corev1.Pod, node *corev1.Node) *framework.Status {
+	capabilitiesJSON, ok := pod.Annotations[vmapi.VirtualMachineRequiredCapabilitiesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var required []vmapi.NodeCapability
+	if err := json.Unmarshal([]byte(capabilitiesJSON), &required); err != nil {
+		logger.Error("Error unmarshaling required capabilities", zap.Error(err))
+		return framework.NewStatus(
+			framework.UnschedulableAndUnresolvable,
+			fmt.Sprintf("Error unmarshaling %q: %s", vmapi.VirtualMachineRequiredCapabilitiesAnnotation, err),
+		)
+	}
+
+	var missing []string
+	for _, c := range required {
+		key, value := c.NodeLabel()
+		if node.Labels[key] != value {
+			missing = append(missing, string(c))
+		}
+	}
+
+	if len(missing) != 0 {
+		logger.Info("Rejecting Pod: node is missing required capabilities", zap.Strings("missing", missing))
+		return framework.NewStatus(
+			framework.UnschedulableAndUnresolvable,
+			fmt.Sprintf("Node is missing required capabilities: %s", strings.Join(missing, ", ")),
+		)
+	}
+	return nil
+}
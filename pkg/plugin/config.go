@@ -12,6 +12,7 @@ import (
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/dumpstore"
 )
 
 //////////////////
@@ -74,6 +75,34 @@ type Config struct {
 	// DumpState, if provided, enables a server to dump internal state
 	DumpState *dumpStateConfig `json:"dumpState"`
 
+	// DumpStateUpload, if provided, enables periodically uploading the internal state to object
+	// storage. See pkg/util/dumpstore for more.
+	DumpStateUpload *dumpstore.Config `json:"dumpStateUpload"`
+
+	// GRPC, if provided, enables the gRPC variant of the agent<->scheduler plugin protocol,
+	// alongside the existing HTTP server.
+	GRPC *grpcConfig `json:"grpc"`
+
+	// MigrationPolicy, if provided, sets the order in which VMs are migrated away from a node under
+	// pressure. See migrationpolicy.go for more. Defaults to "lowest-load".
+	MigrationPolicy migrationPolicy `json:"migrationPolicy,omitempty"`
+
+	// ReservationStore, if provided, enables persisting pods' reservations so that they survive
+	// restarts. See reservations.go for more.
+	ReservationStore *reservationStoreConfig `json:"reservationStore,omitempty"`
+
+	// WouldFit, if provided, enables a server that answers whether a proposed VM would fit on any
+	// node, and how each node would be scored for it. See wouldfit.go and simulate.go for more.
+	WouldFit *wouldFitConfig `json:"wouldFit,omitempty"`
+
+	// StartupReclaim, if provided, enables releasing the reservations of pods that don't start
+	// running within a timeout. See startup.go for more.
+	StartupReclaim *startupReclaimConfig `json:"startupReclaim,omitempty"`
+
+	// LoadShedding, if provided, enables deferring large increases from autoscaler-agents while
+	// we're overloaded with requests. See loadshed.go for more.
+	LoadShedding *loadSheddingConfig `json:"loadShedding,omitempty"`
+
 	// JSONString is the JSON string that was used to generate this config struct
 	JSONString string `json:"-"`
 }
@@ -103,6 +132,26 @@ type nodeConfig struct {
 	//
 	// This corresponds to xₚ in the desmos link.
 	ScorePeak float64 `json:"scorePeak"`
+
+	// Ballast, if provided, enables the per-node memory ballast. See ballast.go for more.
+	Ballast *ballastConfig `json:"ballast,omitempty"`
+
+	// UpscaleLeases, if provided, enables granting short-lived upscale leases to VMs, so that they
+	// can upscale without waiting on a request to the scheduler. See lease.go for more.
+	UpscaleLeases *upscaleLeaseConfig `json:"upscaleLeases,omitempty"`
+
+	// RequestDownscales, if true, enables asking VMs on a node to downscale (in order of their
+	// downscale priority) when there isn't enough room for another VM's upscaling. See
+	// downscale.go for more.
+	RequestDownscales bool `json:"requestDownscales,omitempty"`
+
+	// Priority, if provided, enables taking VMs' .spec.priority into account when scoring nodes and
+	// handling upscale requests. See priority.go for more.
+	Priority *priorityConfig `json:"priority,omitempty"`
+
+	// Topology, if provided, enables taking nodes' NUMA topology into account when filtering and
+	// scoring nodes. See topology.go for more.
+	Topology *topologyConfig `json:"topology,omitempty"`
 }
 
 // resourceConfig configures the amount of a particular resource we're willing to allocate to VMs,
@@ -150,6 +199,46 @@ func (c *Config) validate() (string, error) {
 		}
 	}
 
+	if c.DumpStateUpload != nil {
+		if err := c.DumpStateUpload.Validate(); err != nil {
+			return "dumpStateUpload", err
+		}
+	}
+
+	if c.GRPC != nil {
+		if path, err := c.GRPC.validate(); err != nil {
+			return fmt.Sprintf("grpc.%s", path), err
+		}
+	}
+
+	if err := c.MigrationPolicy.validate(); err != nil {
+		return "migrationPolicy", err
+	}
+
+	if c.ReservationStore != nil {
+		if path, err := c.ReservationStore.validate(); err != nil {
+			return fmt.Sprintf("reservationStore.%s", path), err
+		}
+	}
+
+	if c.WouldFit != nil {
+		if path, err := c.WouldFit.validate(); err != nil {
+			return fmt.Sprintf("wouldFit.%s", path), err
+		}
+	}
+
+	if c.StartupReclaim != nil {
+		if path, err := c.StartupReclaim.validate(); err != nil {
+			return fmt.Sprintf("startupReclaim.%s", path), err
+		}
+	}
+
+	if c.LoadShedding != nil {
+		if path, err := c.LoadShedding.validate(); err != nil {
+			return fmt.Sprintf("loadShedding.%s", path), err
+		}
+	}
+
 	if c.MigrationDeletionRetrySeconds == 0 {
 		return "migrationDeletionRetrySeconds", errors.New("value must be > 0")
 	}
@@ -173,6 +262,30 @@ func (c *nodeConfig) validate() (string, error) {
 		return "scorePeak", errors.New("value must be between 0 and 1, inclusive")
 	}
 
+	if c.Topology != nil {
+		if path, err := c.Topology.validate(); err != nil {
+			return fmt.Sprintf("topology.%s", path), err
+		}
+	}
+
+	if c.Ballast != nil {
+		if path, err := c.Ballast.validate(); err != nil {
+			return fmt.Sprintf("ballast.%s", path), err
+		}
+	}
+
+	if c.UpscaleLeases != nil {
+		if path, err := c.UpscaleLeases.validate(); err != nil {
+			return fmt.Sprintf("upscaleLeases.%s", path), err
+		}
+	}
+
+	if c.Priority != nil {
+		if path, err := c.Priority.validate(); err != nil {
+			return fmt.Sprintf("priority.%s", path), err
+		}
+	}
+
 	return "", nil
 }
 
@@ -232,6 +345,10 @@ func (c *nodeConfig) vCpuLimits(total *resource.Quantity) nodeResourceState[vmap
 		Buffer:               0,
 		CapacityPressure:     0,
 		PressureAccountedFor: 0,
+		Ballast:              0,
+		BallastGranted:       0,
+		Leased:               0,
+		Starting:             0,
 	}
 }
 
@@ -245,5 +362,9 @@ func (c *nodeConfig) memoryLimits(total *resource.Quantity) nodeResourceState[ap
 		Buffer:               0,
 		CapacityPressure:     0,
 		PressureAccountedFor: 0,
+		Ballast:              0,
+		BallastGranted:       0,
+		Leased:               0,
+		Starting:             0,
 	}
 }
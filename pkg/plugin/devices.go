@@ -0,0 +1,88 @@
+package plugin
+
+// Checking that nodes have the devices that VMs pass through to the guest
+//
+// VMs with .spec.guest.devices have runner pods that request one of the device plugin's extended
+// resource for each device. The controller also copies the number of each resource into the pod's
+// annotations. In Filter, we reject nodes that don't have enough of each resource left unallocated,
+// counting the pods already on the node - the same way we count hugepages.
+//
+// Unlike CPU and memory, devices can't be scaled, so there's nothing to reserve for them here.
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// checkNodeDevices returns a non-nil status if the node doesn't have enough of the devices
+// required by the pod left unallocated
+func checkNodeDevices(logger *zap.Logger, pod *corev1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	devicesJSON, ok := pod.Annotations[vmapi.VirtualMachineDevicesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	var required map[corev1.ResourceName]int64
+	if err := json.Unmarshal([]byte(devicesJSON), &required); err != nil {
+		logger.Error("Error unmarshaling required devices", zap.Error(err))
+		return framework.NewStatus(
+			framework.UnschedulableAndUnresolvable,
+			fmt.Sprintf("Error unmarshaling %q: %s", vmapi.VirtualMachineDevicesAnnotation, err),
+		)
+	}
+
+	for name, count := range required {
+		allocatable := nodeInfo.Node().Status.Allocatable[name]
+		if allocatable.IsZero() {
+			logger.Info("Rejecting Pod: node has no devices of required resource", zap.String("resource", string(name)))
+			return framework.NewStatus(
+				framework.UnschedulableAndUnresolvable,
+				fmt.Sprintf("Node has no %s devices", name),
+			)
+		}
+
+		var used int64
+		for _, podInfo := range nodeInfo.Pods {
+			if util.PodCompleted(podInfo.Pod) {
+				continue
+			}
+			used += podExtendedResource(podInfo.Pod, name)
+		}
+
+		if used+count > allocatable.Value() {
+			logger.Warn(
+				"Rejecting Pod: not enough devices on node",
+				zap.String("resource", string(name)),
+				zap.Int64("requested", count),
+				zap.Int64("used", used),
+				zap.Int64("allocatable", allocatable.Value()),
+			)
+			return framework.NewStatus(
+				framework.Unschedulable,
+				fmt.Sprintf("Not enough %s: node usage %d + pod %d > node allocatable %d", name, used, count, allocatable.Value()),
+			)
+		}
+	}
+
+	return nil
+}
+
+// podExtendedResource returns the amount of the extended resource that the pod's containers
+// request. Extended resources can't be overcommitted, so limits are the same as requests.
+func podExtendedResource(pod *corev1.Pod, name corev1.ResourceName) int64 {
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		if q, ok := container.Resources.Limits[name]; ok {
+			total += q.Value()
+		}
+	}
+	return total
+}
@@ -0,0 +1,163 @@
+package plugin
+
+// Priority-aware downscale requests
+//
+// When a VM on a node asks for more resources than the node can provide, we'd otherwise just deny
+// the increase (adding to the node's CapacityPressure) and wait for migrations to free up space.
+// If enabled, we also ask other VMs on the node to downscale, starting with those that have the
+// lowest downscale priority (see api.AnnotationDownscalePriority) and then the most
+// over-provisioned.
+//
+// Each request is delivered in the chosen VM's next PluginResponse, and remains outstanding -
+// counting towards the pressure it's expected to relieve - until the VM's following request, by
+// which point the autoscaler-agent will have downscaled if it was able to.
+
+import (
+	"go.uber.org/zap"
+	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/slices"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// vmDownscaleState tracks the downscale requested from a single VM, if any
+type vmDownscaleState struct {
+	// Target is the resources we've asked the VM to downscale to
+	Target api.Resources `json:"target"`
+	// Delivered is true iff Target has already been sent to the autoscaler-agent
+	Delivered bool `json:"delivered"`
+	// Relief gives the amount of resources that we expect the downscale to free up on the node
+	Relief api.Resources `json:"relief"`
+}
+
+// requestDownscalesIfNecessary picks VMs on the node to downscale, if there's capacity pressure
+// that isn't already expected to be relieved by ongoing migrations or earlier downscale requests.
+//
+// The requester is never picked, because it's the one asking for more.
+func (e *AutoscaleEnforcer) requestDownscalesIfNecessary(
+	logger *zap.Logger,
+	node *nodeState,
+	requester *podState,
+	cu api.Resources,
+) {
+	var outstanding api.Resources
+	for _, pod := range node.pods {
+		if pod.vm != nil && pod.vm.Downscale != nil {
+			outstanding.VCPU += pod.vm.Downscale.Relief.VCPU
+			outstanding.Mem += pod.vm.Downscale.Relief.Mem
+		}
+	}
+
+	needed := api.Resources{
+		VCPU: util.SaturatingSub(util.SaturatingSub(node.cpu.CapacityPressure, node.cpu.PressureAccountedFor), outstanding.VCPU),
+		Mem:  util.SaturatingSub(util.SaturatingSub(node.mem.CapacityPressure, node.mem.PressureAccountedFor), outstanding.Mem),
+	}
+	if needed.VCPU == 0 && needed.Mem == 0 {
+		return
+	}
+
+	var candidates []*podState
+	for _, pod := range node.pods {
+		if pod != requester && pod.canBeAskedToDownscale() {
+			candidates = append(candidates, pod)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b *podState) bool {
+		return a.isBetterDownscaleTarget(b)
+	})
+
+	for _, pod := range candidates {
+		if needed.VCPU == 0 && needed.Mem == 0 {
+			break
+		}
+
+		var target, relief api.Resources
+		target.VCPU, relief.VCPU = downscaleTarget(pod.cpu, needed.VCPU, cu.VCPU)
+		target.Mem, relief.Mem = downscaleTarget(pod.mem, needed.Mem, cu.Mem)
+		if relief.VCPU == 0 && relief.Mem == 0 {
+			continue
+		}
+
+		pod.vm.Downscale = &vmDownscaleState{Target: target, Delivered: false, Relief: relief}
+		needed.VCPU = util.SaturatingSub(needed.VCPU, relief.VCPU)
+		needed.Mem = util.SaturatingSub(needed.Mem, relief.Mem)
+
+		logger.Info(
+			"Requesting downscale from VM to relieve capacity pressure",
+			zap.Object("target", pod.vm.Name),
+			zap.Int32("downscalePriority", pod.vm.Config.DownscalePriority),
+			zap.Object("targetResources", target),
+			zap.Object("expectedRelief", relief),
+		)
+	}
+
+	if needed.VCPU != 0 || needed.Mem != 0 {
+		logger.Info(
+			"Could not request enough downscaling to relieve capacity pressure",
+			zap.Object("remaining", needed),
+		)
+	}
+}
+
+// canBeAskedToDownscale returns whether the pod is eligible for a new downscale request
+func (p *podState) canBeAskedToDownscale() bool {
+	return p.vm != nil &&
+		p.vm.Downscale == nil &&
+		p.vm.DownscaleSupported &&
+		p.vm.Config.ScalingEnabled &&
+		!p.vm.currentlyMigrating()
+}
+
+// isBetterDownscaleTarget returns whether p should be asked to downscale before other
+//
+// VMs with lower downscale priority come first. Among VMs with equal priority, we prefer the one
+// with the most unused CPU, as a rough measure of over-provisioning.
+func (p *podState) isBetterDownscaleTarget(other *podState) bool {
+	if p.vm.Config.DownscalePriority != other.vm.Config.DownscalePriority {
+		return p.vm.Config.DownscalePriority < other.vm.Config.DownscalePriority
+	}
+	return p.unusedCPU() > other.unusedCPU()
+}
+
+// unusedCPU returns the amount of CPU reserved by the pod beyond its 1-minute load average. If we
+// don't have metrics for the VM, we conservatively assume all of it is unused.
+func (p *podState) unusedCPU() float32 {
+	reserved := float32(p.cpu.Reserved) / 1000
+	if p.vm.Metrics == nil {
+		return reserved
+	}
+	return reserved - p.vm.Metrics.LoadAverage1Min
+}
+
+// downscaleTarget returns the amount of the resource that the pod should downscale to in order to
+// relieve needed, along with the amount that would actually be relieved.
+//
+// The reduction is rounded up to a multiple of factor, but the target is never below the pod's
+// minimum.
+func downscaleTarget[T constraints.Unsigned](pod podResourceState[T], needed T, factor T) (target T, relief T) {
+	if needed == 0 {
+		return pod.Reserved, 0
+	}
+
+	reduction := ((needed + factor - 1) / factor) * factor
+	relief = util.Min(reduction, util.SaturatingSub(pod.Reserved, pod.Min))
+	return pod.Reserved - relief, relief
+}
+
+// takeDownscaleRequest returns the downscale request to include in the VM's response, if there is
+// one, and updates the VM's state to reflect that.
+//
+// A request that was already delivered is cleared, because the autoscaler-agent has now had a
+// chance to act on it.
+func (s *vmPodState) takeDownscaleRequest() *api.PluginDownscaleRequest {
+	if s.Downscale == nil {
+		return nil
+	} else if s.Downscale.Delivered {
+		s.Downscale = nil
+		return nil
+	}
+
+	s.Downscale.Delivered = true
+	return &api.PluginDownscaleRequest{Target: s.Downscale.Target}
+}
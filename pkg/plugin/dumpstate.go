@@ -15,6 +15,7 @@ import (
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 type dumpStateConfig struct {
@@ -59,7 +60,7 @@ func (p *AutoscaleEnforcer) startDumpStateServer(shutdownCtx context.Context, lo
 			if err != nil {
 				if ctx.Err() != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
 					totalDuration := time.Since(startTime)
-					return nil, 500, fmt.Errorf("timed out after %s while getting state", totalDuration)
+					return nil, 500, errclass.Errorf(errclass.TransientInfra, "timed out after %s while getting state", totalDuration)
 				} else {
 					// some other type of cancel; 400 is a little weird, but there isn't a great
 					// option here.
@@ -127,6 +128,7 @@ type nodeStateDump struct {
 	Mem              nodeResourceState[api.Bytes]               `json:"mem"`
 	Pods             []keyed[util.NamespacedName, podStateDump] `json:"pods"`
 	Mq               []*podNameAndPointer                       `json:"mq"`
+	NUMA             []api.NUMANode                             `json:"numa"`
 }
 
 type podStateDump struct {
@@ -136,6 +138,8 @@ type podStateDump struct {
 	CPU  podResourceState[vmapi.MilliCPU] `json:"cpu"`
 	Mem  podResourceState[api.Bytes]      `json:"mem"`
 	VM   *vmPodState                      `json:"vm"`
+
+	StartingSince *time.Time `json:"startingSince"`
 }
 
 func makePointerString[T any](t *T) pointerString {
@@ -193,12 +197,12 @@ func (s *nodeState) dump() nodeStateDump {
 	}
 	sortSliceByPodName(pods, func(kv keyed[util.NamespacedName, podStateDump]) util.NamespacedName { return kv.Key })
 
-	mq := make([]*podNameAndPointer, 0, len(s.mq))
-	for _, p := range s.mq {
+	mq := make([]*podNameAndPointer, 0, len(s.mq.pods))
+	for _, p := range s.mq.pods {
 		if p == nil {
 			mq = append(mq, nil)
 		} else {
-			v := podNameAndPointer{Obj: makePointerString(p), PodName: p.Name}
+			v := podNameAndPointer{Obj: makePointerString(p.vm), PodName: p.vm.Name}
 			mq = append(mq, &v)
 		}
 	}
@@ -212,6 +216,7 @@ func (s *nodeState) dump() nodeStateDump {
 		Mem:              s.mem,
 		Pods:             pods,
 		Mq:               mq,
+		NUMA:             s.numa,
 	}
 }
 
@@ -229,6 +234,8 @@ func (s *podState) dump() podStateDump {
 		CPU:  s.cpu,
 		Mem:  s.mem,
 		VM:   vm,
+
+		StartingSince: s.startingSince,
 	}
 }
 
@@ -245,12 +252,22 @@ func (s *vmPodState) dump() vmPodState {
 		}
 	}
 
+	var downscale *vmDownscaleState
+	if s.Downscale != nil {
+		downscale = lo.ToPtr(*s.Downscale)
+	}
+
 	return vmPodState{
-		Name:           s.Name,
-		MemSlotSize:    s.MemSlotSize,
-		Config:         s.Config,
-		Metrics:        metrics,
-		MqIndex:        s.MqIndex,
-		MigrationState: migrationState,
+		Name:               s.Name,
+		MemSlotSize:        s.MemSlotSize,
+		Config:             s.Config,
+		Metrics:            metrics,
+		MqIndex:            s.MqIndex,
+		MigrationState:     migrationState,
+		Downscale:          downscale,
+		DownscaleSupported: s.DownscaleSupported,
+		LastScaled:         s.LastScaled,
+		Priority:           s.Priority,
+		LeaseExpiresAt:     s.LeaseExpiresAt,
 	}
 }
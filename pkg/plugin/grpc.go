@@ -0,0 +1,258 @@
+package plugin
+
+// gRPC server for the agent<->scheduler plugin protocol. See pkg/api/grpc.go for more.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+type grpcConfig struct {
+	// Port is the port to serve the gRPC API on
+	Port uint16 `json:"port"`
+	// TLS gives the certificates to use for mutual TLS with autoscaler-agents
+	TLS util.MutualTLSConfig `json:"tls"`
+}
+
+func (c *grpcConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	}
+	if err := c.TLS.Validate(); err != nil {
+		return "tls", err
+	}
+
+	return "", nil
+}
+
+// pluginGRPCServer is the interface that the gRPC service is registered with. It's implemented by
+// *grpcHandler.
+type pluginGRPCServer interface {
+	negotiateGRPC(context.Context, *api.PluginNegotiateRequest) (*api.PluginNegotiateResponse, error)
+	requestGRPC(context.Context, *api.AgentRequest) (*api.PluginResponse, error)
+	resourceUpdatesGRPC(grpc.ServerStream) error
+}
+
+// handwritten equivalent of what protoc-gen-go-grpc would generate, because we use JSON instead of
+// protobuf for messages.
+var pluginServiceDesc = grpc.ServiceDesc{
+	ServiceName: api.PluginGRPCServiceName,
+	HandlerType: (*pluginGRPCServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Negotiate",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var req api.PluginNegotiateRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return srv.(pluginGRPCServer).negotiateGRPC(ctx, &req)
+			},
+		},
+		{
+			MethodName: "Request",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var req api.AgentRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return srv.(pluginGRPCServer).requestGRPC(ctx, &req)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "ResourceUpdates",
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				return srv.(pluginGRPCServer).resourceUpdatesGRPC(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pkg/api/grpc.go",
+}
+
+// startGRPCServer runs the gRPC server for handling agent requests, in addition to the HTTP server
+// from startPermitHandler.
+func (e *AutoscaleEnforcer) startGRPCServer(ctx context.Context, logger *zap.Logger, config *grpcConfig) error {
+	tlsConfig, err := config.TLS.ServerConfig()
+	if err != nil {
+		return fmt.Errorf("Error loading TLS config: %w", err)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4zero, Port: int(config.Port)})
+	if err != nil {
+		return fmt.Errorf("Error listening on TCP port %d: %w", config.Port, err)
+	}
+
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+		grpc.ForceServerCodec(api.JSONCodec{}),
+		grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+	)
+	server.RegisterService(&pluginServiceDesc, &grpcHandler{e: e, logger: logger})
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	go func() {
+		logger.Info("Starting gRPC resource request server", zap.Uint16("port", config.Port))
+		if err := server.Serve(listener); err != nil {
+			logger.Error("gRPC resource request server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+type grpcHandler struct {
+	e      *AutoscaleEnforcer
+	logger *zap.Logger
+}
+
+var _ pluginGRPCServer = (*grpcHandler)(nil)
+
+func (h *grpcHandler) negotiateGRPC(
+	ctx context.Context,
+	req *api.PluginNegotiateRequest,
+) (*api.PluginNegotiateResponse, error) {
+	supported := api.VersionRange[api.PluginProtoVersion]{
+		Min: MinPluginProtocolVersion,
+		Max: MaxPluginProtocolVersion,
+	}
+
+	version, ok := supported.LatestSharedVersion(req.Range)
+	if !ok {
+		return nil, errclass.GRPCStatus(
+			codes.FailedPrecondition,
+			errclass.Bug,
+			fmt.Sprintf("Protocol version mismatch: Need %v but got %v", supported, req.Range),
+		).Err()
+	}
+
+	h.logger.Info(
+		"Negotiated gRPC protocol version with autoscaler-agent",
+		zap.String("client", clientAddr(ctx)),
+		zap.Stringer("version", version),
+	)
+
+	return &api.PluginNegotiateResponse{Version: version}, nil
+}
+
+func (h *grpcHandler) requestGRPC(ctx context.Context, req *api.AgentRequest) (*api.PluginResponse, error) {
+	return h.handle(ctx, clientAddr(ctx), req)
+}
+
+func (h *grpcHandler) resourceUpdatesGRPC(stream grpc.ServerStream) error {
+	client := clientAddr(stream.Context())
+
+	for {
+		var req api.AgentRequest
+		if err := stream.RecvMsg(&req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		resp, err := h.handle(stream.Context(), client, &req)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle is the gRPC equivalent of the HTTP handler in startPermitHandler
+func (h *grpcHandler) handle(ctx context.Context, client string, req *api.AgentRequest) (_ *api.PluginResponse, err error) {
+	logger := util.LoggerWithCorrelationID(h.logger.With(zap.Object("pod", req.Pod)), req.CorrelationID)
+
+	var statusCode int
+	defer func() {
+		h.e.metrics.resourceRequests.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+	}()
+
+	// Catch any potential panics and report them as internal errors
+	defer func() {
+		if r := recover(); r != nil {
+			msg := "request handler panicked"
+			logger.Error(msg, zap.String("error", fmt.Sprint(r)))
+			statusCode = 500
+			h.e.metrics.resourceRequestErrors.WithLabelValues(string(errclass.Bug)).Inc()
+			err = errclass.GRPCStatus(codes.Internal, errclass.Bug, msg).Err()
+		}
+	}()
+
+	logger.Info(
+		"Received autoscaler-agent request over gRPC",
+		zap.String("client", client), zap.Any("request", req),
+	)
+
+	resp, statusCode, err := h.e.handleAgentRequest(ctx, logger, *req)
+	if err != nil {
+		logFunc := logger.Warn
+		if 500 <= statusCode && statusCode < 600 {
+			logFunc = logger.Error
+		}
+		class := errclass.Of(err)
+		h.e.metrics.resourceRequestErrors.WithLabelValues(string(class)).Inc()
+		logFunc(
+			"Responding to autoscaler-agent gRPC request with error",
+			zap.Int("status", statusCode),
+			zap.String("errorClass", string(class)),
+			zap.Error(err),
+		)
+		// Attach the class, like the HTTP handler does with errclass.HTTPHeader, so that the
+		// autoscaler-agent can tell how to handle the error.
+		return nil, errclass.GRPCStatus(grpcCodeForStatus(statusCode), class, err.Error()).Err()
+	}
+
+	logger.Info(
+		"Responding to autoscaler-agent gRPC request",
+		zap.Int("status", statusCode),
+		zap.Any("response", resp),
+	)
+	return resp, nil
+}
+
+// grpcCodeForStatus maps the HTTP status codes returned by handleAgentRequest to gRPC codes
+func grpcCodeForStatus(statusCode int) codes.Code {
+	switch {
+	case statusCode == 404:
+		return codes.NotFound
+	case statusCode == 409:
+		return codes.FailedPrecondition
+	case 400 <= statusCode && statusCode < 500:
+		return codes.InvalidArgument
+	default:
+		return codes.Internal
+	}
+}
+
+func clientAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return "<unknown>"
+}
@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+// newTestGRPCConn serves the plugin's gRPC service in memory, without TLS, returning a connection
+// to it
+func newTestGRPCConn(t *testing.T) *grpc.ClientConn {
+	e := &AutoscaleEnforcer{
+		logger: zap.NewNop(),
+		state: pluginState{
+			lock:  util.NewChanMutex(),
+			pods:  make(map[util.NamespacedName]*podState),
+			nodes: make(map[string]*nodeState),
+			conf:  &Config{},
+		},
+	}
+	e.makePrometheusRegistry()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ForceServerCodec(api.JSONCodec{}))
+	server.RegisterService(&pluginServiceDesc, &grpcHandler{e: e, logger: zap.NewNop()})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(api.JSONCodec{})),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func testAgentRequest(version api.PluginProtoVersion) *api.AgentRequest {
+	metrics := &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: nil, MemoryUsageBytes: nil}
+	if version.IncludesExtendedMetrics() {
+		metrics.LoadAverage5Min = lo.ToPtr[float32](0.5)
+		metrics.MemoryUsageBytes = lo.ToPtr[float32](1 << 20)
+	}
+
+	return &api.AgentRequest{
+		ProtoVersion: version,
+		Pod:          util.NamespacedName{Namespace: "default", Name: "unknown"},
+		ComputeUnit:  api.Resources{VCPU: 250, Mem: 1 << 30},
+		Resources:    api.Resources{VCPU: 250, Mem: 1 << 30},
+		LastPermit:   nil,
+		Metrics:      metrics,
+	}
+}
+
+func TestGRPCNegotiate(t *testing.T) {
+	conn := newTestGRPCConn(t)
+	ctx := context.Background()
+
+	var resp api.PluginNegotiateResponse
+	req := api.PluginNegotiateRequest{
+		Range: api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV1_0, Max: MaxPluginProtocolVersion},
+	}
+	require.NoError(t, conn.Invoke(ctx, api.PluginGRPCMethodNegotiate, &req, &resp))
+	assert.Equal(t, MaxPluginProtocolVersion, resp.Version)
+
+	req.Range = api.VersionRange[api.PluginProtoVersion]{Min: api.PluginProtoV1_0, Max: api.PluginProtoV1_0}
+	err := conn.Invoke(ctx, api.PluginGRPCMethodNegotiate, &req, &resp)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Equal(t, errclass.Bug, errclass.Of(err))
+}
+
+// Error responses must carry their class to the autoscaler-agent, like errclass.HTTPHeader does
+// for HTTP.
+func TestGRPCErrorClass(t *testing.T) {
+	conn := newTestGRPCConn(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		req  *api.AgentRequest
+
+		expectedCode  codes.Code
+		expectedClass errclass.Class
+	}{
+		{"unknown pod", testAgentRequest(MaxPluginProtocolVersion), codes.NotFound, errclass.TransientInfra},
+		{"unsupported version", testAgentRequest(api.PluginProtoV1_0), codes.InvalidArgument, errclass.Bug},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			checkErr := func(t *testing.T, err error) {
+				st, ok := status.FromError(err)
+				require.True(t, ok, "expected gRPC status, got %v", err)
+				assert.Equal(t, c.expectedCode, st.Code())
+				class, attached := errclass.FromGRPCStatus(st)
+				assert.True(t, attached)
+				assert.Equal(t, c.expectedClass, class)
+			}
+
+			t.Run("unary", func(t *testing.T) {
+				var resp api.PluginResponse
+				checkErr(t, conn.Invoke(ctx, api.PluginGRPCMethodRequest, c.req, &resp))
+			})
+
+			t.Run("stream", func(t *testing.T) {
+				stream, err := conn.NewStream(ctx, &pluginServiceDesc.Streams[0], api.PluginGRPCMethodResourceUpdates)
+				require.NoError(t, err)
+				require.NoError(t, stream.SendMsg(c.req))
+				var resp api.PluginResponse
+				checkErr(t, stream.RecvMsg(&resp))
+			})
+		})
+	}
+}
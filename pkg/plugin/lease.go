@@ -0,0 +1,179 @@
+package plugin
+
+// Upscale pre-approval leases
+//
+// Normally, an autoscaler-agent that wants to upscale must first wait for us to approve it, which
+// puts a round-trip to the scheduler in the critical path of every upscale. If upscaleLeases is
+// enabled, we additionally reserve a small amount of the node's free CPU and memory for each VM
+// with every PluginResponse, as an UpscaleLease. The autoscaler-agent may upscale into the lease
+// immediately, and tells us about it with its next request - at which point whatever was used is
+// always approved, and the rest is released before granting a new lease.
+//
+// Leases are short-lived: if the autoscaler-agent doesn't make another request before the lease
+// expires, we release it so that VMs that have gone quiet don't hold onto the node's capacity.
+// The autoscaler-agent measures the lease's validity from before sending its request, so it always
+// stops using the lease before we release it, and renews it in the background ahead of expiry.
+//
+// Even if the agent's request that reports a used lease arrives after we've released it (e.g.
+// because the request was delayed), the used amount is still included in its LastPermit, which we
+// must approve. So the worst case is temporarily reserving more than the node's watermark.
+//
+// Invariants, for each node:
+//
+//	node.Reserved == sum(pod.Reserved) + node.Ballast + node.Leased
+//	node.Leased == sum(pod.Lease)
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/constraints"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type upscaleLeaseConfig struct {
+	// ValidSeconds gives the duration, in seconds, that each lease is valid for. It should be at
+	// least a few times the expected latency of autoscaler-agent requests.
+	ValidSeconds uint `json:"validSeconds"`
+	// MaxComputeUnits gives the maximum amount of each resource that may be leased to a single VM at
+	// a time, in compute units.
+	MaxComputeUnits uint16 `json:"maxComputeUnits"`
+	// CheckIntervalSeconds gives the duration, in seconds, between checks for expired leases.
+	CheckIntervalSeconds uint `json:"checkIntervalSeconds"`
+}
+
+func (c *upscaleLeaseConfig) validate() (string, error) {
+	if c.ValidSeconds == 0 {
+		return "validSeconds", errors.New("value must be > 0")
+	} else if c.MaxComputeUnits == 0 {
+		return "maxComputeUnits", errors.New("value must be > 0")
+	} else if c.CheckIntervalSeconds == 0 {
+		return "checkIntervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// useLease releases the pod's outstanding lease back to the node, returning the minimum amount that
+// handleRequested must approve in order to honor the portion of the lease that the VM has already
+// started using (as indicated by requested).
+//
+// approved is the amount that's already been approved for the pod, e.g. from its reservation and
+// any ballast grant.
+func (r resourceTransitioner[T]) useLease(requested T, approved T) (forceApprovalMinimum T) {
+	lease := r.pod.Lease
+	r.releaseLease()
+
+	return approved + util.Min(util.SaturatingSub(requested, approved), lease)
+}
+
+// grantLease reserves up to maxLease of the node's unused capacity for the pod, rounded down to a
+// multiple of factor and bounded by the pod's maximum.
+//
+// Leases never take the node above its watermark, nor use the last headroom of the node's
+// resources.
+func (r resourceTransitioner[T]) grantLease(maxLease T, factor T, headroom T) T {
+	limit := util.Min(r.node.Watermark, util.SaturatingSub(r.node.Total, headroom))
+	lease := util.Min(maxLease, util.SaturatingSub(limit, r.node.Reserved))
+	lease = util.Min(lease, util.SaturatingSub(r.pod.Max, r.pod.Reserved))
+	lease = (lease / factor) * factor
+
+	r.pod.Lease = lease
+	r.node.Leased += lease
+	r.node.Reserved += lease
+	return lease
+}
+
+// releaseLease returns the pod's outstanding lease, if any, to the node.
+func (r resourceTransitioner[T]) releaseLease() {
+	r.node.Reserved -= r.pod.Lease
+	r.node.Leased -= r.pod.Lease
+	r.pod.Lease = 0
+}
+
+// leaseVerdict returns a pretty-formatted summary of changes to the pod's lease, for logging
+func leaseVerdict[T constraints.Unsigned](oldState, newState resourceState[T]) string {
+	return fmt.Sprintf(
+		"pod lease %d -> %d; node leased %d -> %d",
+		oldState.pod.Lease, newState.pod.Lease, oldState.node.Leased, newState.node.Leased,
+	)
+}
+
+// releaseLease releases any lease held by the pod, for both resources.
+func (p *podState) releaseLease() {
+	makeResourceTransitioner(&p.node.cpu, &p.cpu).releaseLease()
+	makeResourceTransitioner(&p.node.mem, &p.mem).releaseLease()
+	if p.vm != nil {
+		p.vm.LeaseExpiresAt = nil
+	}
+}
+
+// runLeaseExpiry periodically submits the pods with expired leases until the context is canceled.
+func (e *AutoscaleEnforcer) runLeaseExpiry(
+	ctx context.Context,
+	logger *zap.Logger,
+	config upscaleLeaseConfig,
+	submitLeaseExpired func(*zap.Logger, util.NamespacedName),
+) {
+	ticker := time.NewTicker(time.Second * time.Duration(config.CheckIntervalSeconds))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range e.expiredLeases(time.Now()) {
+			submitLeaseExpired(logger, name)
+		}
+	}
+}
+
+// expiredLeases returns the names of all pods with leases that have expired as of now
+func (e *AutoscaleEnforcer) expiredLeases(now time.Time) []util.NamespacedName {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var names []util.NamespacedName
+	for name, p := range e.state.pods {
+		if p.leaseExpired(now) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (p *podState) leaseExpired(now time.Time) bool {
+	return p.vm != nil && p.vm.LeaseExpiresAt != nil && !now.Before(*p.vm.LeaseExpiresAt)
+}
+
+// handleLeaseExpired releases the pod's lease, if it's still expired.
+func (e *AutoscaleEnforcer) handleLeaseExpired(logger *zap.Logger, podName util.NamespacedName) {
+	logger = logger.With(
+		zap.String("action", "Lease expired"),
+		zap.Object("pod", podName),
+	)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	ps, ok := e.state.pods[podName]
+	// The pod may have been deleted, or renewed its lease, since we last checked.
+	if !ok || !ps.leaseExpired(time.Now()) {
+		return
+	}
+	logger = logger.With(zap.String("node", ps.node.name), zap.Object("virtualmachine", ps.vm.Name))
+
+	lease := api.Resources{VCPU: ps.cpu.Lease, Mem: ps.mem.Lease}
+	ps.releaseLease()
+	ps.node.updateMetrics(e.metrics)
+
+	logger.Info("Released expired upscale lease", zap.Object("lease", lease))
+}
@@ -0,0 +1,110 @@
+package plugin
+
+// Load shedding for autoscaler-agent requests
+//
+// All requests from autoscaler-agents are handled while holding the state lock, so a burst of them
+// (e.g. when many VMs' load increases at once) can queue up behind each other for long enough that
+// the agents' requests time out - which then delays all scaling, including downscaling and small
+// increases that we could have quickly approved.
+//
+// With loadShedding enabled, we track the number of requests that are waiting for or holding the
+// lock, and a moving average of how long requests take to be given a verdict. While either is
+// above its threshold, we're "overloaded", and:
+//
+//   - Requests that don't increase the VM's resources by more than SmallUpscaleComputeUnits are
+//     approved as usual, but we skip asking other VMs to downscale on their behalf.
+//   - Larger increases are deferred: the permit stays at what the VM already had (like during
+//     warm-up - see reservations.go), and the response includes RetryAfterSeconds, which the
+//     autoscaler-agent waits for before asking again.
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// loadSheddingLatencyWeight is the weight given to each new request's latency in the moving average
+const loadSheddingLatencyWeight = 0.1
+
+type loadSheddingConfig struct {
+	// MaxPendingRequests gives the number of agent requests, waiting for or being handled, above
+	// which we're overloaded.
+	MaxPendingRequests int `json:"maxPendingRequests"`
+	// MaxLatencyMilliseconds gives the average time, in milliseconds, to give a verdict on each
+	// agent request, above which we're overloaded.
+	MaxLatencyMilliseconds uint `json:"maxLatencyMilliseconds"`
+	// SmallUpscaleComputeUnits gives the largest increase, in compute units, that is still approved
+	// while overloaded.
+	SmallUpscaleComputeUnits uint16 `json:"smallUpscaleComputeUnits"`
+	// RetryAfterSeconds gives the duration, in seconds, that autoscaler-agents should wait before
+	// retrying an increase that was deferred.
+	RetryAfterSeconds uint `json:"retryAfterSeconds"`
+}
+
+func (c *loadSheddingConfig) validate() (string, error) {
+	if c.MaxPendingRequests <= 0 {
+		return "maxPendingRequests", errors.New("value must be > 0")
+	} else if c.MaxLatencyMilliseconds == 0 {
+		return "maxLatencyMilliseconds", errors.New("value must be > 0")
+	} else if c.RetryAfterSeconds == 0 {
+		return "retryAfterSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// loadShedder tracks the load from agent requests
+type loadShedder struct {
+	config loadSheddingConfig
+
+	// pending is the number of agent requests that have started but not yet finished
+	pending atomic.Int64
+
+	mu sync.Mutex
+	// avgLatency is the exponentially weighted moving average of the time to handle requests
+	avgLatency time.Duration
+}
+
+func newLoadShedder(config loadSheddingConfig) *loadShedder {
+	return &loadShedder{
+		config:     config,
+		pending:    atomic.Int64{},
+		mu:         sync.Mutex{},
+		avgLatency: 0,
+	}
+}
+
+// start records the start of a request, returning whether we're overloaded, and a function to call
+// when the request finishes.
+func (l *loadShedder) start() (overloaded bool, finish func()) {
+	// nb: the count includes this request.
+	pending := l.pending.Add(1)
+	startTime := time.Now()
+
+	l.mu.Lock()
+	avgLatency := l.avgLatency
+	l.mu.Unlock()
+
+	overloaded = pending > int64(l.config.MaxPendingRequests) ||
+		avgLatency > time.Millisecond*time.Duration(l.config.MaxLatencyMilliseconds)
+
+	return overloaded, func() {
+		latency := time.Since(startTime)
+		l.pending.Add(-1)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.avgLatency += time.Duration(loadSheddingLatencyWeight * float64(latency-l.avgLatency))
+	}
+}
+
+// isSmallUpscale returns whether the increase from current to requested is small enough to still
+// be approved while overloaded
+func (l *loadShedder) isSmallUpscale(current, requested, cu api.Resources) bool {
+	maxIncrease := cu.Mul(l.config.SmallUpscaleComputeUnits)
+	increase := requested.SaturatingSub(current)
+	return !increase.HasFieldGreaterThan(maxIncrease)
+}
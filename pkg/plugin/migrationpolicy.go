@@ -0,0 +1,69 @@
+package plugin
+
+// Policies for choosing which VM to migrate away from a node under pressure
+//
+// When a node's reserved resources are above the watermark, we migrate the VM at the front of the
+// node's migrationQueue (see queue.go). The policy, set by the 'migrationPolicy' field in the
+// config, determines the order of that queue.
+
+import (
+	"fmt"
+)
+
+type migrationPolicy string
+
+const (
+	// migrationPolicyLowestLoad prefers migrating VMs with the lowest 1-minute load average. This is
+	// the default.
+	migrationPolicyLowestLoad migrationPolicy = "lowest-load"
+	// migrationPolicyLeastRecentlyScaled prefers migrating VMs whose resources have been unchanged
+	// for the longest, because their usage is least likely to change during the migration.
+	migrationPolicyLeastRecentlyScaled migrationPolicy = "least-recently-scaled"
+	// migrationPolicySmallestFootprint prefers migrating VMs with the least reserved memory (and
+	// then CPU), because they are the quickest to migrate.
+	migrationPolicySmallestFootprint migrationPolicy = "smallest-footprint"
+	// migrationPolicyPriority prefers migrating VMs whose pods have the lowest priority, as set by
+	// their PriorityClass.
+	migrationPolicyPriority migrationPolicy = "priority"
+)
+
+func (p migrationPolicy) validate() error {
+	switch p {
+	case "", migrationPolicyLowestLoad, migrationPolicyLeastRecentlyScaled,
+		migrationPolicySmallestFootprint, migrationPolicyPriority:
+		return nil
+	default:
+		return fmt.Errorf("unknown migration policy %q", p)
+	}
+}
+
+// isBetterTarget returns whether pod a should be migrated before pod b. Both pods must be VMs.
+//
+// For all policies, VMs that have provided metrics are always preferred, and ties are broken by
+// load average.
+func (p migrationPolicy) isBetterTarget(a, b *podState) bool {
+	// TODO: this deprioritizes VMs whose metrics we can't collect. Maybe we don't want that?
+	if a.vm.Metrics == nil || b.vm.Metrics == nil {
+		return a.vm.Metrics != nil && b.vm.Metrics == nil
+	}
+
+	switch p {
+	case migrationPolicyLeastRecentlyScaled:
+		if !a.vm.LastScaled.Equal(b.vm.LastScaled) {
+			return a.vm.LastScaled.Before(b.vm.LastScaled)
+		}
+	case migrationPolicySmallestFootprint:
+		if a.mem.Reserved != b.mem.Reserved {
+			return a.mem.Reserved < b.mem.Reserved
+		} else if a.cpu.Reserved != b.cpu.Reserved {
+			return a.cpu.Reserved < b.cpu.Reserved
+		}
+	case migrationPolicyPriority:
+		if a.vm.Priority != b.vm.Priority {
+			return a.vm.Priority < b.vm.Priority
+		}
+	}
+
+	// TODO - this is just a first-pass approximation. Maybe it's ok for now? Maybe it's not. Idk.
+	return a.vm.Metrics.LoadAverage1Min < b.vm.Metrics.LoadAverage1Min
+}
@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/tychoish/fun/srv"
 	"go.uber.org/zap"
 
 	corev1 "k8s.io/api/core/v1"
@@ -19,6 +20,7 @@ import (
 	vmclient "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/dumpstore"
 	"github.com/neondatabase/autoscaling/pkg/util/watch"
 )
 
@@ -37,6 +39,14 @@ type AutoscaleEnforcer struct {
 	// nodeStore provides access to the current-ish state of Nodes in the cluster. If something's
 	// missing, it can be updated with Relist().
 	nodeStore IndexedNodeStore
+
+	// reservations, if not nil, persists pods' reservations across restarts. It's only set if
+	// enabled by the config.
+	reservations *reservationStore
+
+	// loadShedder, if not nil, tracks the load from autoscaler-agent requests. It's only set if
+	// enabled by the config.
+	loadShedder *loadShedder
 }
 
 // abbreviations, because these types are pretty verbose
@@ -97,8 +107,24 @@ func makeAutoscaleEnforcerPlugin(
 			maxTotalReservableMem:     0, // set during event handling
 			conf:                      config,
 		},
-		metrics:   PromMetrics{},      //nolint:exhaustruct // set by makePrometheusRegistry
-		nodeStore: IndexedNodeStore{}, //nolint:exhaustruct // set below
+		metrics:      PromMetrics{},      //nolint:exhaustruct // set by makePrometheusRegistry
+		nodeStore:    IndexedNodeStore{}, //nolint:exhaustruct // set below
+		reservations: nil,                // set below, if enabled
+		loadShedder:  nil,                // set below, if enabled
+	}
+
+	if config.LoadShedding != nil {
+		p.loadShedder = newLoadShedder(*config.LoadShedding)
+	}
+
+	// Stored reservations must be loaded before we start handling events for existing pods, so
+	// that they're used when building the initial state.
+	if config.ReservationStore != nil {
+		logger.Info("Loading stored reservations")
+		p.reservations = newReservationStore(h.ClientSet(), *config.ReservationStore)
+		if err := p.reservations.load(ctx, logger.Named("reservations")); err != nil {
+			return nil, fmt.Errorf("Error loading stored reservations: %w", err)
+		}
 	}
 
 	if p.state.conf.DumpState != nil {
@@ -108,6 +134,16 @@ func makeAutoscaleEnforcerPlugin(
 		}
 	}
 
+	if p.state.conf.DumpStateUpload != nil {
+		logger.Info("Starting 'dump state' uploader")
+		dump := func(ctx context.Context) (*stateDump, error) {
+			return p.dumpState(ctx, false)
+		}
+		if err := dumpstore.Start(ctx, logger.Named("dump-state-upload"), *p.state.conf.DumpStateUpload, "scheduler", dump); err != nil {
+			return nil, fmt.Errorf("Error starting 'dump state' uploader: %w", err)
+		}
+	}
+
 	// makePrometheusRegistry sets p.metrics, which we need to do before calling
 	// newEventQueueSet or handling events, because we set metrics in eventQueueSet and for each
 	// node as watch events get handled.
@@ -146,6 +182,9 @@ func makeAutoscaleEnforcerPlugin(
 		submitNodeDeletion: func(logger *zap.Logger, nodeName string) {
 			pushToQueue(logger, nodeName, func() { p.handleNodeDeletion(hlogger, nodeName) })
 		},
+		submitNodeTopologyUpdated: func(logger *zap.Logger, node *corev1.Node) {
+			pushToQueue(logger, node.Name, func() { p.handleNodeTopologyUpdated(hlogger, node) })
+		},
 	}
 	pwc := podWatchCallbacks{
 		submitStarted: func(logger *zap.Logger, pod *corev1.Pod, preexisting bool) {
@@ -263,9 +302,52 @@ func makeAutoscaleEnforcerPlugin(
 	}
 	logger.Info("Initial events processing complete")
 
+	if p.reservations != nil {
+		// Run the sync as a service, so that the process waits for the final reservations to be
+		// written on shutdown.
+		rs := &srv.Service{ //nolint:exhaustruct // other fields are optional
+			Name: "reservation-sync",
+			Run: func(ctx context.Context) error {
+				p.runReservationSync(ctx, logger.Named("reservations"), p.reservations)
+				return nil
+			},
+		}
+		if err := rs.Start(ctx); err != nil {
+			return nil, fmt.Errorf("Error starting reservation sync: %w", err)
+		}
+		if err := srv.GetOrchestrator(ctx).Add(rs); err != nil {
+			return nil, fmt.Errorf("Error adding reservation sync to orchestrator: %w", err)
+		}
+	}
+
+	if config.StartupReclaim != nil {
+		submitStartupTimeout := func(logger *zap.Logger, name util.NamespacedName) {
+			// Use the same key as pod start/deletion events, so that we don't race with them.
+			pushToQueue(logger, name.Name, func() { p.handleStartupTimeout(hlogger, name) })
+		}
+		go p.runStartupReclaim(ctx, logger.Named("startup-reclaim"), *config.StartupReclaim, submitStartupTimeout)
+	}
+
+	if leaseConf := config.NodeConfig.UpscaleLeases; leaseConf != nil {
+		submitLeaseExpired := func(logger *zap.Logger, name util.NamespacedName) {
+			pushToQueue(logger, name.Name, func() { p.handleLeaseExpired(hlogger, name) })
+		}
+		go p.runLeaseExpiry(ctx, logger.Named("lease-expiry"), *leaseConf, submitLeaseExpired)
+	}
+
 	if err := p.startPermitHandler(ctx, logger.Named("agent-handler")); err != nil {
 		return nil, fmt.Errorf("permit handler: %w", err)
 	}
+	if config.GRPC != nil {
+		if err := p.startGRPCServer(ctx, logger.Named("agent-grpc-handler"), config.GRPC); err != nil {
+			return nil, fmt.Errorf("gRPC server: %w", err)
+		}
+	}
+	if config.WouldFit != nil {
+		if err := p.startWouldFitServer(ctx, logger.Named("would-fit")); err != nil {
+			return nil, fmt.Errorf("would-fit server: %w", err)
+		}
+	}
 
 	// Periodically check that we're not deadlocked
 	go func() {
@@ -461,6 +543,14 @@ func (e *AutoscaleEnforcer) Filter(
 		return status
 	}
 
+	if status := checkNodeCapabilities(logger, pod, nodeInfo.Node()); status != nil {
+		return status
+	}
+
+	if status := checkNodeDevices(logger, pod, nodeInfo); status != nil {
+		return status
+	}
+
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
 
@@ -473,6 +563,10 @@ func (e *AutoscaleEnforcer) Filter(
 		)
 	}
 
+	if status := e.checkNodeHugepages(logger, pod, nodeInfo, node); status != nil {
+		return status
+	}
+
 	// The pod will get resources according to vmInfo.{Cpu,Mem}.Use reserved for it when it does get
 	// scheduled. Now we can check whether this node has capacity for the pod.
 	//
@@ -533,6 +627,12 @@ func (e *AutoscaleEnforcer) Filter(
 		}
 	}
 
+	// The node's ballast and upscale leases aren't part of any pod's reservation. Unused ballast is
+	// reclaimed to make room for new pods (see handleReserve), but whatever's lent out may already
+	// be in use, so it counts.
+	nodeTotal.VCPU += lentOut(&node.cpu)
+	nodeTotal.Mem += lentOut(&node.mem)
+
 	if len(missedPods) != 0 {
 		var missedPodsList []util.NamespacedName
 		for name := range missedPods {
@@ -629,8 +729,6 @@ func (e *AutoscaleEnforcer) Score(
 	logger := e.logger.With(zap.String("method", "Score"), zap.String("node", nodeName), util.PodNameFields(pod))
 	logger.Info("Handling Score request")
 
-	scoreLen := framework.MaxNodeScore - framework.MinNodeScore
-
 	// Double-check that the SchedulerName matches what we're expecting
 	if status := e.checkSchedulerName(logger, pod); status != nil {
 		return framework.MinNodeScore, status
@@ -668,6 +766,30 @@ func (e *AutoscaleEnforcer) Score(
 		return score, nil
 	}
 
+	// Higher priority VMs may prefer less loaded nodes. See priority.go for more.
+	priority := vmapi.PriorityStandard
+	if vmInfo != nil {
+		priority = vmInfo.Config.EffectivePriority()
+	}
+
+	score, verdict := e.scoreNode(node, priority)
+	score = e.applyTopologyPenalty(logger, score, vmInfo, pod, node)
+	logger.Info(
+		"Scored pod placement for node",
+		zap.Int64("score", score),
+		zap.Object("verdict", verdict),
+	)
+
+	return score, nil
+}
+
+// scoreNode returns the score for placing a VM with the given priority on the node, based on the
+// node's current usage, without the topology penalty.
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) scoreNode(node *nodeState, priority vmapi.VirtualMachinePriority) (int64, verdictSet) {
+	scoreLen := framework.MaxNodeScore - framework.MinNodeScore
+
 	cpuRemaining := node.remainingReservableCPU()
 	cpuTotal := node.cpu.Total
 	memRemaining := node.remainingReservableMem()
@@ -679,17 +801,18 @@ func (e *AutoscaleEnforcer) Score(
 	memScale := node.mem.Total.AsFloat64() / e.state.maxTotalReservableMem.AsFloat64()
 
 	nodeConf := e.state.conf.NodeConfig
+	scorePeak := nodeConf.Priority.scorePeak(nodeConf.ScorePeak, priority)
 
 	// Refer to the comments in nodeConfig for more. Also, see: https://www.desmos.com/calculator/wg8s0yn63s
 	calculateScore := func(fraction, scale float64) (float64, int64) {
 		y0 := nodeConf.MinUsageScore
 		y1 := nodeConf.MaxUsageScore
-		xp := nodeConf.ScorePeak
+		xp := scorePeak
 
-		score := float64(1) // if fraction == nodeConf.ScorePeak
-		if fraction < nodeConf.ScorePeak {
+		score := float64(1) // if fraction == scorePeak
+		if fraction < xp {
 			score = y0 + (1-y0)/xp*fraction
-		} else if fraction > nodeConf.ScorePeak {
+		} else if fraction > xp {
 			score = y1 + (1-y1)/(1-xp)*(1-fraction)
 		}
 
@@ -702,22 +825,16 @@ func (e *AutoscaleEnforcer) Score(
 	memFScore, memIScore := calculateScore(memFraction, memScale)
 
 	score := util.Min(cpuIScore, memIScore)
-	logger.Info(
-		"Scored pod placement for node",
-		zap.Int64("score", score),
-		zap.Object("verdict", verdictSet{
-			cpu: fmt.Sprintf(
-				"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
-				cpuRemaining, cpuTotal, cpuFraction, cpuScale, cpuFScore, cpuIScore,
-			),
-			mem: fmt.Sprintf(
-				"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
-				memRemaining, memTotal, memFraction, memScale, memFScore, memIScore,
-			),
-		}),
-	)
-
-	return score, nil
+	return score, verdictSet{
+		cpu: fmt.Sprintf(
+			"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
+			cpuRemaining, cpuTotal, cpuFraction, cpuScale, cpuFScore, cpuIScore,
+		),
+		mem: fmt.Sprintf(
+			"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
+			memRemaining, memTotal, memFraction, memScale, memFScore, memIScore,
+		),
+	}
 }
 
 // NormalizeScore weights scores uniformly in the range [minScore, trueScore], where
@@ -0,0 +1,92 @@
+package plugin
+
+// Per-VM priority classes
+//
+// VMs may set .spec.priority to LatencySensitive, Standard (the default), or Batch. With
+// nodeConfig.priority set, the priority is used in two places:
+//
+//  1. When scoring nodes for a new pod, each priority can have its own score peak, so that (for
+//     example) latency-sensitive VMs are placed on less loaded nodes, and batch VMs are packed
+//     onto busier ones.
+//  2. When handling upscale requests, VMs below LatencySensitive priority may not use the last
+//     fraction of the node's capacity, as given by their headroom. So when a node is running out
+//     of room, batch VMs are denied first, then standard VMs, leaving the rest for
+//     latency-sensitive VMs.
+//
+// The headroom only applies to increases: resources that were already approved (e.g. by a
+// previous scheduler, via lastPermit) are always approved again.
+
+import (
+	"errors"
+
+	"golang.org/x/exp/constraints"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+)
+
+type priorityConfig struct {
+	// ScorePeaks overrides nodeConfig.ScorePeak for VMs with each priority.
+	ScorePeaks map[vmapi.VirtualMachinePriority]float64 `json:"scorePeaks,omitempty"`
+	// StandardHeadroom is the fraction of each node's resources that Standard VMs may not upscale
+	// into.
+	StandardHeadroom float64 `json:"standardHeadroom"`
+	// BatchHeadroom is the fraction of each node's resources that Batch VMs may not upscale into.
+	// It must be at least StandardHeadroom.
+	BatchHeadroom float64 `json:"batchHeadroom"`
+}
+
+func (c *priorityConfig) validate() (string, error) {
+	for p, peak := range c.ScorePeaks {
+		switch p {
+		case vmapi.PriorityLatencySensitive, vmapi.PriorityStandard, vmapi.PriorityBatch:
+		default:
+			return "scorePeaks", errors.New("keys must be one of LatencySensitive, Standard, or Batch")
+		}
+		if peak < 0 || peak > 1 {
+			return "scorePeaks." + string(p), errors.New("value must be between 0 and 1, inclusive")
+		}
+	}
+
+	if c.StandardHeadroom < 0 || c.StandardHeadroom >= 1 {
+		return "standardHeadroom", errors.New("value must be >= 0 and < 1")
+	} else if c.BatchHeadroom < 0 || c.BatchHeadroom >= 1 {
+		return "batchHeadroom", errors.New("value must be >= 0 and < 1")
+	} else if c.BatchHeadroom < c.StandardHeadroom {
+		return "batchHeadroom", errors.New("value must be >= standardHeadroom")
+	}
+
+	return "", nil
+}
+
+// scorePeak returns the score peak to use when scoring nodes for a VM with the priority
+func (c *priorityConfig) scorePeak(defaultPeak float64, priority vmapi.VirtualMachinePriority) float64 {
+	if c == nil {
+		return defaultPeak
+	}
+	if peak, ok := c.ScorePeaks[priority]; ok {
+		return peak
+	}
+	return defaultPeak
+}
+
+// headroomFraction returns the fraction of the node's resources that VMs with the priority may not
+// upscale into
+func (c *priorityConfig) headroomFraction(priority vmapi.VirtualMachinePriority) float64 {
+	if c == nil {
+		return 0
+	}
+	switch priority {
+	case vmapi.PriorityBatch:
+		return c.BatchHeadroom
+	case vmapi.PriorityStandard:
+		return c.StandardHeadroom
+	default:
+		return 0
+	}
+}
+
+// headroom returns the amount of the resource on the node that VMs with the priority may not
+// upscale into
+func headroom[T constraints.Unsigned](c *priorityConfig, priority vmapi.VirtualMachinePriority, total T) T {
+	return T(c.headroomFraction(priority) * float64(total))
+}
@@ -19,6 +19,7 @@ type PromMetrics struct {
 	pluginCallFails       *prometheus.CounterVec
 	resourceRequests      *prometheus.CounterVec
 	validResourceRequests *prometheus.CounterVec
+	resourceRequestErrors *prometheus.CounterVec
 	nodeCPUResources      *prometheus.GaugeVec
 	nodeMemResources      *prometheus.GaugeVec
 	migrationCreations    prometheus.Counter
@@ -26,9 +27,12 @@ type PromMetrics struct {
 	migrationCreateFails  prometheus.Counter
 	migrationDeleteFails  *prometheus.CounterVec
 	reserveShouldDeny     *prometheus.CounterVec
+	startupReclaims       *prometheus.CounterVec
 	eventQueueDepth       prometheus.Gauge
 	eventQueueAddsTotal   prometheus.Counter
 	eventQueueLatency     prometheus.Histogram
+	agentRequestDuration  prometheus.Histogram
+	deferredUpscales      *prometheus.CounterVec
 }
 
 func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
@@ -72,6 +76,13 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"code", "node", "has_metrics"},
 		)),
+		resourceRequestErrors: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_resource_request_errors_total",
+				Help: "Number of resource requests to the scheduler plugin that failed, by error class",
+			},
+			[]string{"class"},
+		)),
 		nodeCPUResources: util.RegisterMetric(reg, prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "autoscaling_plugin_node_cpu_resources_current",
@@ -119,6 +130,13 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"availability_zone", "node", "node_group"},
 		)),
+		startupReclaims: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_startup_reclaims_total",
+				Help: "Number of pods whose reservations were released because they didn't start in time",
+			},
+			[]string{"node", "node_group"},
+		)),
 		eventQueueDepth: util.RegisterMetric(reg, prometheus.NewGauge(
 			prometheus.GaugeOpts{
 				Name: "autoscaling_plugin_eventqueue_depth",
@@ -138,6 +156,20 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 				Buckets: prometheus.ExponentialBuckets(10e-9, 10, 12),
 			},
 		)),
+		agentRequestDuration: util.RegisterMetric(reg, prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "autoscaling_plugin_agent_request_duration_seconds",
+				Help:    "How long in seconds it took to handle requests from the autoscaler-agent",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+			},
+		)),
+		deferredUpscales: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_deferred_upscales_total",
+				Help: "Number of increases requested by autoscaler-agents that were deferred because the plugin was overloaded",
+			},
+			[]string{"node", "node_group"},
+		)),
 	}
 
 	return reg
@@ -155,6 +187,10 @@ func (m *PromMetrics) IncFailIfNotSuccess(method string, pod *corev1.Pod, ignore
 	m.pluginCallFails.WithLabelValues(method, util.PodPreferredAZIfPresent(pod), strconv.FormatBool(ignored), status.Code().String())
 }
 
+func (m *PromMetrics) IncStartupReclaim(node *nodeState) {
+	m.startupReclaims.WithLabelValues(node.name, node.nodeGroup).Inc()
+}
+
 func (m *PromMetrics) IncReserveShouldDeny(pod *corev1.Pod, node *nodeState) {
 	m.reserveShouldDeny.WithLabelValues(util.PodPreferredAZIfPresent(pod), node.name, node.nodeGroup).Inc()
 }
@@ -1,36 +1,44 @@
 package plugin
 
-// Implementation of a metrics-based migration priority queue over vmPodStates
+// Implementation of a policy-based migration priority queue over VM podStates
 
 import (
 	"container/heap"
 )
 
-type migrationQueue []*vmPodState
+type migrationQueue struct {
+	// policy determines the order of the queue. See migrationpolicy.go for more.
+	policy migrationPolicy
+	pods   []*podState
+}
+
+func newMigrationQueue(policy migrationPolicy) migrationQueue {
+	return migrationQueue{policy: policy, pods: nil}
+}
 
 ///////////////////////
 // package-local API //
 ///////////////////////
 
-func (mq *migrationQueue) addOrUpdate(vm *vmPodState) {
-	if vm.MqIndex == -1 {
-		heap.Push(mq, vm)
+func (mq *migrationQueue) addOrUpdate(pod *podState) {
+	if pod.vm.MqIndex == -1 {
+		heap.Push(mq, pod)
 	} else {
-		heap.Fix(mq, vm.MqIndex)
+		heap.Fix(mq, pod.vm.MqIndex)
 	}
 }
 
-func (mq migrationQueue) isNextInQueue(vm *vmPodState) bool {
+func (mq *migrationQueue) isNextInQueue(pod *podState) bool {
 	// the documentation for heap.Pop says that it's equivalent to heap.Remove(h, 0). Therefore,
 	// checking whether something's the next pop target can just be done by checking if its index is
 	// zero.
-	return vm.MqIndex == 0
+	return pod.vm.MqIndex == 0
 }
 
-func (mq *migrationQueue) removeIfPresent(vm *vmPodState) {
-	if vm.MqIndex != -1 {
-		_ = heap.Remove(mq, vm.MqIndex)
-		vm.MqIndex = -1
+func (mq *migrationQueue) removeIfPresent(pod *podState) {
+	if pod.vm.MqIndex != -1 {
+		_ = heap.Remove(mq, pod.vm.MqIndex)
+		pod.vm.MqIndex = -1
 	}
 }
 
@@ -38,32 +46,32 @@ func (mq *migrationQueue) removeIfPresent(vm *vmPodState) {
 // container/heap.Interface methods //
 //////////////////////////////////////
 
-func (mq migrationQueue) Len() int { return len(mq) }
+func (mq *migrationQueue) Len() int { return len(mq.pods) }
 
-func (mq migrationQueue) Less(i, j int) bool {
-	return mq[i].isBetterMigrationTarget(mq[j])
+func (mq *migrationQueue) Less(i, j int) bool {
+	return mq.policy.isBetterTarget(mq.pods[i], mq.pods[j])
 }
 
-func (mq migrationQueue) Swap(i, j int) {
-	mq[i], mq[j] = mq[j], mq[i]
-	mq[i].MqIndex = i
-	mq[j].MqIndex = j
+func (mq *migrationQueue) Swap(i, j int) {
+	mq.pods[i], mq.pods[j] = mq.pods[j], mq.pods[i]
+	mq.pods[i].vm.MqIndex = i
+	mq.pods[j].vm.MqIndex = j
 }
 
 func (mq *migrationQueue) Push(v any) {
-	n := len(*mq)
-	vm := v.(*vmPodState)
-	vm.MqIndex = n
-	*mq = append(*mq, vm)
+	n := len(mq.pods)
+	pod := v.(*podState)
+	pod.vm.MqIndex = n
+	mq.pods = append(mq.pods, pod)
 }
 
 func (mq *migrationQueue) Pop() any {
 	// Function body + comments taken from the example at https://pkg.go.dev/container/heap
-	old := *mq
+	old := mq.pods
 	n := len(old)
-	vm := old[n-1]
-	old[n-1] = nil  // avoid memory leak
-	vm.MqIndex = -1 // for safety
-	*mq = old[0 : n-1]
-	return vm
+	pod := old[n-1]
+	old[n-1] = nil      // avoid memory leak
+	pod.vm.MqIndex = -1 // for safety
+	mq.pods = old[0 : n-1]
+	return pod
 }
@@ -0,0 +1,686 @@
+package plugin
+
+// Persistent store for pods' reservations, so that they survive scheduler restarts
+//
+// Without the store, a new scheduler has to assume that every existing VM may have scaled up to its
+// maximum (see "Startup uncertainty: buffer" in ARCHITECTURE.md). With the store, the scheduler
+// periodically writes each pod's Reserved resources to ConfigMaps, and on startup uses those values
+// as the upper bound on VMs' usage instead.
+//
+// Reservations are sharded by node: each node's are stored in their own ConfigMap, labeled with the
+// name of the store, so that no single object grows past the API server's size limit. The store's
+// main ConfigMap records when the reservations were last saved, and by which scheduler. All writes
+// are made with the resourceVersion we last saw, so that two schedulers can't silently overwrite
+// each other.
+//
+// Until the warm-up period has passed, we also don't approve any increases on nodes that still have
+// buffer - i.e., where some autoscaler-agents haven't yet told us their VM's current usage - so that
+// an agent that reconnects early can't take resources that another VM was granted before the
+// restart.
+//
+// To hand off cleanly during rolling upgrades, a scheduler that's shutting down stops approving
+// increases and then writes its reservations one last time, marked as final. A new scheduler that
+// finds reservations that were saved recently, but not marked as final, assumes the previous one is
+// still running and waits a little while for its handoff before building its state.
+//
+// More than one scheduler may be running at a time - during handoff, or with a standby for
+// failover. Only one of them saves reservations: whichever started first, among those still
+// saving. Others stop saving until that scheduler has handed off, or hasn't saved for a while. A
+// scheduler that starts saving first records itself as the writer in the main ConfigMap, and only
+// then writes the per-node ConfigMaps, so that two schedulers taking over at once can't both write
+// them.
+//
+// If safe mode is enabled, a new scheduler also denies all increases - on every node - until the
+// usage of every VM pod is known (i.e., no node has buffer left), or until the maximum duration of
+// safe mode has passed.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// handoffRecentSyncs is the number of sync intervals within which stored reservations that aren't
+// final are considered recent enough that the scheduler that wrote them may still be running
+const handoffRecentSyncs = 3
+
+// reservationsConfigMapKey is the key in each ConfigMap's data holding its JSON-encoded content
+const reservationsConfigMapKey = "reservations.json"
+
+// reservationsStoreLabel is the label on each node's ConfigMap, set to the name of the store's main
+// ConfigMap
+const reservationsStoreLabel = "autoscaling.neon.tech/reservations-store"
+
+// errNotWriter is returned by (*reservationStore).save when another scheduler is saving
+// reservations instead
+var errNotWriter = errors.New("reservations are being saved by another scheduler")
+
+type reservationStoreConfig struct {
+	// ConfigMapNamespace and ConfigMapName give the main ConfigMap that reservations are stored
+	// with. It will be created if it doesn't already exist. Each node's reservations are stored in
+	// the same namespace, in a ConfigMap named "<ConfigMapName>-<node>" (shortened with a hash if
+	// that's too long).
+	ConfigMapNamespace string `json:"configMapNamespace"`
+	ConfigMapName      string `json:"configMapName"`
+	// SyncIntervalSeconds gives the duration, in seconds, between writes of the current
+	// reservations. Permits approved within this duration before a restart may not be recorded.
+	SyncIntervalSeconds uint `json:"syncIntervalSeconds"`
+	// WarmupSeconds gives the duration, in seconds, after startup during which we deny increases on
+	// nodes that still have buffer.
+	WarmupSeconds uint `json:"warmupSeconds"`
+	// HandoffWaitSeconds, if not zero, gives the maximum duration, in seconds, that we wait on
+	// startup for the previous scheduler to write its final reservations, if it seems to still be
+	// running.
+	HandoffWaitSeconds uint `json:"handoffWaitSeconds,omitempty"`
+	// SafeModeMaxSeconds, if not zero, enables denying all increases after startup until the usage
+	// of every VM pod is known, for at most this duration, in seconds.
+	SafeModeMaxSeconds uint `json:"safeModeMaxSeconds,omitempty"`
+}
+
+func (c *reservationStoreConfig) validate() (string, error) {
+	if c.ConfigMapNamespace == "" {
+		return "configMapNamespace", errors.New("string cannot be empty")
+	} else if c.ConfigMapName == "" {
+		return "configMapName", errors.New("string cannot be empty")
+	} else if errs := validation.IsValidLabelValue(c.ConfigMapName); len(errs) != 0 {
+		return "configMapName", errors.New(strings.Join(errs, "; "))
+	} else if c.SyncIntervalSeconds == 0 {
+		return "syncIntervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// storedReservations is the JSON-encoded content of the main ConfigMap
+//
+// Older versions stored every reservation here - either in Reservations, or as only the list -
+// which we can still read.
+type storedReservations struct {
+	SavedAt time.Time `json:"savedAt"`
+	// Final is true if the reservations were written by a scheduler that was shutting down, after
+	// it stopped approving increases. If so, they're exactly what it last approved.
+	Final bool `json:"final"`
+	// Writer and WriterStartedAt identify the scheduler that saved the reservations
+	Writer          string    `json:"writer,omitempty"`
+	WriterStartedAt time.Time `json:"writerStartedAt"`
+	// Reservations is only set by older versions. Newer versions store them per node - see
+	// storedShard.
+	Reservations []persistedReservation `json:"reservations,omitempty"`
+}
+
+// storedShard is the JSON-encoded content of the ConfigMap with a single node's reservations
+type storedShard struct {
+	Node         string                 `json:"node"`
+	Reservations []persistedReservation `json:"reservations"`
+}
+
+// persistedReservation is the stored form of a single pod's reservation
+type persistedReservation struct {
+	Pod  util.NamespacedName `json:"pod"`
+	Node string              `json:"node"`
+	CPU  vmapi.MilliCPU      `json:"cpu"`
+	Mem  api.Bytes           `json:"mem"`
+}
+
+// shardVersion is what we last read or wrote for a node's ConfigMap
+type shardVersion struct {
+	resourceVersion string
+	content         string
+}
+
+// reservationStore loads and saves reservations from the configured ConfigMaps
+type reservationStore struct {
+	client kubernetes.Interface
+	config reservationStoreConfig
+
+	// identity and startedAt identify this scheduler as the writer of the stored reservations
+	identity  string
+	startedAt time.Time
+
+	warmupUntil   time.Time
+	safeModeUntil time.Time
+
+	// safeModeDone is set once safe mode has ended. It's guarded by the plugin's state lock.
+	safeModeDone bool
+	// handingOff is set once we've started shutting down, after which we don't approve any
+	// increases, so that the final reservations we write are exact.
+	handingOff atomic.Bool
+
+	// mu guards loaded. It's separate from the plugin's state lock because loaded is used both
+	// while holding the state lock and while loading the ConfigMaps.
+	mu sync.Mutex
+	// loaded stores the reservations read on startup that haven't yet been used.
+	//
+	// Entries are removed as they're used, and the map is cleared after the warm-up period, so that
+	// we don't reuse a stale reservation for a new pod that happens to have the same name.
+	loaded map[util.NamespacedName]persistedReservation
+
+	// shards maps the name of each node's ConfigMap to what we last read or wrote for it, or is nil
+	// if the ConfigMaps must be listed again before the next save (e.g. because a write conflicted).
+	//
+	// It's only used by load and save, which never run concurrently.
+	shards map[string]shardVersion
+}
+
+func newReservationStore(client kubernetes.Interface, config reservationStoreConfig) *reservationStore {
+	// The hostname is only informational - the start time is what distinguishes schedulers.
+	identity, _ := os.Hostname()
+
+	return &reservationStore{
+		client:        client,
+		config:        config,
+		identity:      identity,
+		startedAt:     time.Now(),
+		warmupUntil:   time.Now().Add(time.Second * time.Duration(config.WarmupSeconds)),
+		safeModeUntil: time.Now().Add(time.Second * time.Duration(config.SafeModeMaxSeconds)),
+		safeModeDone:  config.SafeModeMaxSeconds == 0,
+		handingOff:    atomic.Bool{},
+		mu:            sync.Mutex{},
+		loaded:        make(map[util.NamespacedName]persistedReservation),
+		shards:        nil,
+	}
+}
+
+func (s *reservationStore) syncInterval() time.Duration {
+	return time.Second * time.Duration(s.config.SyncIntervalSeconds)
+}
+
+// load reads the stored reservations. It must be called before handling any of the initial pod
+// events.
+func (s *reservationStore) load(ctx context.Context, logger *zap.Logger) error {
+	stored, _, err := s.read(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	// If the reservations were saved recently but aren't final, the previous scheduler may still be
+	// running - e.g. during a rolling upgrade. Give it a chance to hand off, so that we don't miss
+	// anything it approves in the meantime.
+	syncInterval := s.syncInterval()
+	if stored != nil && !stored.Final && s.config.HandoffWaitSeconds != 0 && time.Since(stored.SavedAt) < handoffRecentSyncs*syncInterval {
+		logger.Info("Stored reservations are recent but not final, waiting for handoff from previous scheduler")
+
+		deadline := time.Now().Add(time.Second * time.Duration(s.config.HandoffWaitSeconds))
+		for !stored.Final && time.Now().Before(deadline) {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(syncInterval):
+			}
+
+			latest, _, err := s.read(ctx, logger)
+			if err != nil {
+				return err
+			} else if latest != nil {
+				stored = latest
+			}
+		}
+
+		if stored.Final {
+			logger.Info("Received final reservations from previous scheduler")
+		} else {
+			logger.Warn("Timed out waiting for handoff from previous scheduler, using latest stored reservations")
+		}
+	}
+
+	shards, reservations, err := s.listShards(ctx, logger)
+	if err != nil {
+		return err
+	}
+	s.shards = shards
+	if stored != nil {
+		reservations = append(stored.Reservations, reservations...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range reservations {
+		s.loaded[r.Pod] = r
+	}
+
+	logger.Info(
+		"Loaded stored reservations",
+		zap.Int("count", len(s.loaded)),
+		zap.Int("nodes", len(shards)),
+		zap.Bool("final", stored != nil && stored.Final),
+	)
+	return nil
+}
+
+// read fetches and decodes the main ConfigMap, returning nil if it doesn't exist or can't be
+// decoded, along with its resourceVersion ("" if it doesn't exist)
+func (s *reservationStore) read(ctx context.Context, logger *zap.Logger) (*storedReservations, string, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.config.ConfigMapNamespace).
+		Get(ctx, s.config.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logger.Info("Reservations ConfigMap does not exist, starting without stored reservations")
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("Error getting reservations ConfigMap: %w", err)
+	}
+
+	content, ok := cm.Data[reservationsConfigMapKey]
+	if !ok {
+		logger.Warn("Reservations ConfigMap is missing key, ignoring it", zap.String("key", reservationsConfigMapKey))
+		return nil, cm.ResourceVersion, nil
+	}
+
+	var stored storedReservations
+	if strings.HasPrefix(strings.TrimSpace(content), "[") {
+		// Written by an older version, which only stored the list.
+		err = json.Unmarshal([]byte(content), &stored.Reservations)
+	} else {
+		err = json.Unmarshal([]byte(content), &stored)
+	}
+	if err != nil {
+		// Better to fall back to the normal startup behavior than to fail to start at all.
+		logger.Error("Failed to decode reservations ConfigMap, ignoring it", zap.Error(err))
+		return nil, cm.ResourceVersion, nil
+	}
+
+	return &stored, cm.ResourceVersion, nil
+}
+
+// listShards fetches and decodes every node's ConfigMap, returning their versions and the
+// reservations they contain
+func (s *reservationStore) listShards(
+	ctx context.Context,
+	logger *zap.Logger,
+) (map[string]shardVersion, []persistedReservation, error) {
+	list, err := s.client.CoreV1().ConfigMaps(s.config.ConfigMapNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{reservationsStoreLabel: s.config.ConfigMapName}).String(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error listing per-node reservations ConfigMaps: %w", err)
+	}
+
+	shards := make(map[string]shardVersion)
+	var reservations []persistedReservation
+	for _, cm := range list.Items {
+		content := cm.Data[reservationsConfigMapKey]
+		// Record the version even if we can't decode it, so that we can overwrite it.
+		shards[cm.Name] = shardVersion{resourceVersion: cm.ResourceVersion, content: content}
+
+		var shard storedShard
+		if err := json.Unmarshal([]byte(content), &shard); err != nil {
+			logger.Error("Failed to decode per-node reservations ConfigMap, ignoring it", zap.String("name", cm.Name), zap.Error(err))
+			continue
+		}
+		reservations = append(reservations, shard.Reservations...)
+	}
+
+	return shards, reservations, nil
+}
+
+// take returns and removes the stored reservation for the pod, if there is one and it was on the
+// same node.
+func (s *reservationStore) take(podName util.NamespacedName, nodeName string) (persistedReservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.loaded[podName]
+	if !ok {
+		return persistedReservation{}, false
+	}
+	delete(s.loaded, podName)
+
+	return r, r.Node == nodeName
+}
+
+// warmingUp returns whether we're still within the warm-up period after startup
+func (s *reservationStore) warmingUp() bool {
+	return time.Now().Before(s.warmupUntil)
+}
+
+// inSafeMode returns whether increases should be denied on all nodes, because safe mode is enabled
+// and the usage of some VM pods isn't yet known.
+//
+// This method MUST be called while holding e.state.lock.
+func (e *AutoscaleEnforcer) inSafeMode(logger *zap.Logger) bool {
+	store := e.reservations
+	if store == nil || store.safeModeDone {
+		return false
+	}
+
+	if time.Now().After(store.safeModeUntil) {
+		logger.Warn("Ending safe mode after maximum duration, even though some pods' usage is still unknown")
+		store.safeModeDone = true
+		return false
+	}
+
+	for _, node := range e.state.nodes {
+		if node.cpu.Buffer != 0 || node.mem.Buffer != 0 {
+			return true
+		}
+	}
+
+	logger.Info("Ending safe mode, now that every pod's usage is known")
+	store.safeModeDone = true
+	return false
+}
+
+// mayOverwrite returns whether we may save reservations over the ones currently stored
+func (s *reservationStore) mayOverwrite(stored *storedReservations, now time.Time) bool {
+	switch {
+	case stored == nil:
+		return true
+	case stored.Writer == s.identity && stored.WriterStartedAt.Equal(s.startedAt):
+		return true // we wrote them
+	case stored.Final:
+		return true // the scheduler that wrote them has handed off
+	case now.Sub(stored.SavedAt) >= handoffRecentSyncs*s.syncInterval():
+		return true // the scheduler that wrote them seems to have stopped
+	default:
+		// Another scheduler is still saving. Whichever started first keeps saving, so that two
+		// schedulers never take turns.
+		return stored.WriterStartedAt.After(s.startedAt)
+	}
+}
+
+// shardName returns the name of the ConfigMap that stores the node's reservations
+//
+// If "<ConfigMapName>-<node>" is too long to be an object name, the node's name is truncated and a
+// hash of it appended instead.
+func (s *reservationStore) shardName(node string) string {
+	name := fmt.Sprintf("%s-%s", s.config.ConfigMapName, node)
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+
+	hash := sha256.Sum256([]byte(node))
+	suffix := hex.EncodeToString(hash[:])[:16]
+	prefix := strings.TrimRight(name[:validation.DNS1123SubdomainMaxLength-len(suffix)-1], ".-")
+	return fmt.Sprintf("%s-%s", prefix, suffix)
+}
+
+// save writes the reservations, one ConfigMap per node, and then updates the main ConfigMap.
+//
+// If we aren't already recorded as the writer in the main ConfigMap, we first claim it there, so
+// that when two schedulers both decide to start saving, only one of them succeeds and goes on to
+// write the per-node ConfigMaps.
+//
+// ConfigMaps whose content hasn't changed are not written. Returns errNotWriter if another
+// scheduler is saving reservations.
+func (s *reservationStore) save(ctx context.Context, logger *zap.Logger, reservations []persistedReservation, final bool) error {
+	now := time.Now()
+
+	stored, mainVersion, err := s.read(ctx, logger)
+	if err != nil {
+		return err
+	} else if !s.mayOverwrite(stored, now) {
+		// The other scheduler will change the per-node ConfigMaps, so list them again once we take
+		// over.
+		s.shards = nil
+		return fmt.Errorf("%w (%s, started at %s)", errNotWriter, stored.Writer, stored.WriterStartedAt)
+	}
+
+	isOurs := stored != nil && stored.Writer == s.identity && stored.WriterStartedAt.Equal(s.startedAt)
+	if !isOurs {
+		mainVersion, err = s.writeMain(ctx, mainVersion, storedReservations{
+			SavedAt:         now,
+			Final:           false,
+			Writer:          s.identity,
+			WriterStartedAt: s.startedAt,
+			Reservations:    nil,
+		})
+		if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("%w (claimed while we were taking over: %w)", errNotWriter, err)
+		} else if err != nil {
+			return fmt.Errorf("Error claiming reservations ConfigMap: %w", err)
+		}
+		// Whoever was saving before may have changed the per-node ConfigMaps since we last saw them
+		s.shards = nil
+	}
+
+	if s.shards == nil {
+		shards, _, err := s.listShards(ctx, logger)
+		if err != nil {
+			return err
+		}
+		s.shards = shards
+	}
+
+	byNode := make(map[string][]persistedReservation)
+	for _, r := range reservations {
+		byNode[r.Node] = append(byNode[r.Node], r)
+	}
+
+	configMaps := s.client.CoreV1().ConfigMaps(s.config.ConfigMapNamespace)
+	changed := false
+	wanted := make(map[string]struct{})
+
+	for node, nodeReservations := range byNode {
+		name := s.shardName(node)
+		wanted[name] = struct{}{}
+		content, err := json.Marshal(storedShard{Node: node, Reservations: nodeReservations})
+		if err != nil {
+			return fmt.Errorf("Error encoding reservations for node %q: %w", node, err)
+		}
+
+		current, exists := s.shards[name]
+		if exists && current.content == string(content) {
+			continue
+		}
+
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       s.config.ConfigMapNamespace,
+				Labels:          map[string]string{reservationsStoreLabel: s.config.ConfigMapName},
+				ResourceVersion: current.resourceVersion,
+			},
+			Data: map[string]string{reservationsConfigMapKey: string(content)},
+		}
+		if exists {
+			cm, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		} else {
+			cm, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return s.writeFailed(fmt.Sprintf("writing reservations for node %q", node), err)
+		}
+		s.shards[name] = shardVersion{resourceVersion: cm.ResourceVersion, content: string(content)}
+		changed = true
+	}
+
+	for name, current := range s.shards {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+
+		err := configMaps.Delete(ctx, name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: nil, ResourceVersion: &current.resourceVersion},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return s.writeFailed(fmt.Sprintf("deleting per-node reservations ConfigMap %q", name), err)
+		}
+		delete(s.shards, name)
+		changed = true
+	}
+
+	// Skip updating the main ConfigMap if nothing changed, to avoid needless load on the API server
+	// - unless it's been long enough that the next scheduler wouldn't think we're still running.
+	if isOurs && !changed && !final && now.Sub(stored.SavedAt) < (handoffRecentSyncs-1)*s.syncInterval() {
+		return nil
+	}
+
+	_, err = s.writeMain(ctx, mainVersion, storedReservations{
+		SavedAt:         now,
+		Final:           final,
+		Writer:          s.identity,
+		WriterStartedAt: s.startedAt,
+		Reservations:    nil, // stored per node
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing reservations ConfigMap: %w", err)
+	}
+	return nil
+}
+
+// writeMain writes the main ConfigMap, creating it if version is empty, and otherwise only if it's
+// still at that version. It returns the new version.
+func (s *reservationStore) writeMain(ctx context.Context, version string, stored storedReservations) (string, error) {
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding reservations: %w", err)
+	}
+
+	configMaps := s.client.CoreV1().ConfigMaps(s.config.ConfigMapNamespace)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            s.config.ConfigMapName,
+			Namespace:       s.config.ConfigMapNamespace,
+			ResourceVersion: version,
+		},
+		Data: map[string]string{reservationsConfigMapKey: string(content)},
+	}
+	if version != "" {
+		cm, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	} else {
+		cm, err = configMaps.Create(ctx, cm, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.ResourceVersion, nil
+}
+
+// writeFailed handles an error from writing one of the per-node ConfigMaps, returning the error to
+// report
+func (s *reservationStore) writeFailed(action string, err error) error {
+	// If someone else changed the ConfigMap, what we know about the others is likely out of date
+	// as well.
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		s.shards = nil
+	}
+	return fmt.Errorf("Error %s: %w", action, err)
+}
+
+// runReservationSync periodically saves the current reservations until the context is canceled,
+// and clears any unused stored reservations once the warm-up period is over.
+//
+// Once the context is canceled, it hands off to the next scheduler by denying further increases and
+// saving the final reservations.
+func (e *AutoscaleEnforcer) runReservationSync(ctx context.Context, logger *zap.Logger, store *reservationStore) {
+	interval := store.syncInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	clearedLoaded := false
+	notWriter := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			e.handOffReservations(logger, store, interval)
+			return
+		case <-ticker.C:
+		}
+
+		if !clearedLoaded && !store.warmingUp() {
+			store.mu.Lock()
+			if len(store.loaded) != 0 {
+				logger.Info("Warm-up complete, discarding unused stored reservations", zap.Int("count", len(store.loaded)))
+			}
+			store.loaded = make(map[util.NamespacedName]persistedReservation)
+			store.mu.Unlock()
+			clearedLoaded = true
+		}
+
+		reservations := e.currentReservations()
+
+		saveCtx, cancel := context.WithTimeout(ctx, interval)
+		err := store.save(saveCtx, logger, reservations, false)
+		cancel()
+		if errors.Is(err, errNotWriter) {
+			// Only log when this changes, because a standby scheduler may stay here indefinitely.
+			if !notWriter {
+				logger.Info("Not saving reservations while another scheduler is", zap.Error(err))
+				notWriter = true
+			}
+			continue
+		} else if err != nil {
+			logger.Error("Failed to save reservations", zap.Error(err))
+			continue
+		}
+		if notWriter {
+			logger.Info("Taking over saving reservations")
+			notWriter = false
+		}
+	}
+}
+
+// handOffReservations stops approving increases and saves the final reservations, for the next
+// scheduler to pick up
+func (e *AutoscaleEnforcer) handOffReservations(logger *zap.Logger, store *reservationStore, timeout time.Duration) {
+	// Set while holding the lock, so that no request that's already past the check can still
+	// approve an increase after we read the reservations.
+	func() {
+		e.state.lock.Lock()
+		defer e.state.lock.Unlock()
+		store.handingOff.Store(true)
+	}()
+
+	reservations := e.currentReservations()
+
+	// The context we were given is already canceled, so use a fresh one.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := store.save(ctx, logger, reservations, true); errors.Is(err, errNotWriter) {
+		logger.Info("Not saving final reservations, because another scheduler is saving them", zap.Error(err))
+		return
+	} else if err != nil {
+		logger.Error("Failed to save final reservations for handoff", zap.Error(err))
+		return
+	}
+	logger.Info("Saved final reservations for handoff", zap.Int("count", len(reservations)))
+}
+
+// currentReservations returns the Reserved resources of every VM pod, sorted by pod name so that
+// unchanged reservations always encode the same way
+func (e *AutoscaleEnforcer) currentReservations() []persistedReservation {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var reservations []persistedReservation
+	for name, pod := range e.state.pods {
+		if pod.vm == nil {
+			continue
+		}
+		reservations = append(reservations, persistedReservation{
+			Pod:  name,
+			Node: pod.node.name,
+			CPU:  pod.cpu.Reserved,
+			Mem:  pod.mem.Reserved,
+		})
+	}
+
+	slices.SortFunc(reservations, func(a, b persistedReservation) bool {
+		return a.Pod.Namespace < b.Pod.Namespace ||
+			(a.Pod.Namespace == b.Pod.Namespace && a.Pod.Name < b.Pod.Name)
+	})
+	return reservations
+}
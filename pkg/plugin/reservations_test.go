@@ -0,0 +1,472 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+const testReservationsNamespace = "kube-system"
+
+// newVersionedClient returns a fake clientset that assigns resourceVersions to ConfigMaps and
+// enforces them on update and delete, like the API server does. The fake's own object tracker
+// ignores them.
+func newVersionedClient() *fake.Clientset {
+	return newVersionedClients(1)[0]
+}
+
+// newVersionedClients returns n clientsets like newVersionedClient, all sharing the same objects, so
+// that one can be used while another is in the middle of a request.
+func newVersionedClients(n int) []*fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+
+	var mu sync.Mutex
+	version := 0
+	nextVersion := func() string {
+		version += 1
+		return strconv.Itoa(version)
+	}
+	current := func(ns, name string) (*corev1.ConfigMap, error) {
+		obj, err := tracker.Get(gvr, ns, name)
+		if err != nil {
+			return nil, err
+		}
+		return obj.(*corev1.ConfigMap), nil
+	}
+
+	var clients []*fake.Clientset
+	for i := 0; i < n; i++ {
+		client := &fake.Clientset{}
+		client.AddReactor("*", "*", k8stesting.ObjectReaction(tracker))
+
+		client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			cm := action.(k8stesting.CreateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+			cm.ResourceVersion = nextVersion()
+			if err := tracker.Create(gvr, cm, action.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+			return true, cm, nil
+		})
+		client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			cm := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+			existing, err := current(action.GetNamespace(), cm.Name)
+			if err != nil {
+				return true, nil, err
+			} else if cm.ResourceVersion != existing.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), cm.Name, nil)
+			}
+			cm.ResourceVersion = nextVersion()
+			if err := tracker.Update(gvr, cm, action.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+			return true, cm, nil
+		})
+		client.PrependReactor("delete", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			del := action.(k8stesting.DeleteActionImpl)
+			existing, err := current(action.GetNamespace(), del.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			if p := del.DeleteOptions.Preconditions; p != nil && p.ResourceVersion != nil && *p.ResourceVersion != existing.ResourceVersion {
+				return true, nil, apierrors.NewConflict(gvr.GroupResource(), del.Name, nil)
+			}
+			return true, nil, tracker.Delete(gvr, action.GetNamespace(), del.Name)
+		})
+
+		clients = append(clients, client)
+	}
+
+	return clients
+}
+
+func newTestReservationStore(client *fake.Clientset, startedAt time.Time) *reservationStore {
+	store := newReservationStore(client, reservationStoreConfig{
+		ConfigMapNamespace:  testReservationsNamespace,
+		ConfigMapName:       "reservations",
+		SyncIntervalSeconds: 1,
+		WarmupSeconds:       30,
+		HandoffWaitSeconds:  0,
+		SafeModeMaxSeconds:  0,
+	})
+	store.startedAt = startedAt
+	return store
+}
+
+func testReservation(pod, node string, memGiB int) persistedReservation {
+	return persistedReservation{
+		Pod:  util.NamespacedName{Namespace: "default", Name: pod},
+		Node: node,
+		CPU:  1000,
+		Mem:  api.Bytes(memGiB) << 30,
+	}
+}
+
+func listReservationConfigMaps(t *testing.T, client *fake.Clientset) []string {
+	list, err := client.CoreV1().ConfigMaps(testReservationsNamespace).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, cm := range list.Items {
+		names = append(names, cm.Name)
+	}
+	return names
+}
+
+func TestReservationsShardedByNode(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	store := newTestReservationStore(client, time.Now())
+
+	err := store.save(ctx, logger, []persistedReservation{
+		testReservation("a", "node-1", 1),
+		testReservation("b", "node-1", 2),
+		testReservation("c", "node-2", 3),
+	}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"reservations", "reservations-node-1", "reservations-node-2"}, listReservationConfigMaps(t, client))
+
+	// Nodes without any reservations have their ConfigMap removed
+	err = store.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 4)}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"reservations", "reservations-node-1"}, listReservationConfigMaps(t, client))
+
+	// A new scheduler loads the reservations from every node
+	next := newTestReservationStore(client, time.Now())
+	require.NoError(t, next.load(ctx, logger))
+
+	r, sameNode := next.take(util.NamespacedName{Namespace: "default", Name: "a"}, "node-1")
+	assert.True(t, sameNode)
+	assert.Equal(t, testReservation("a", "node-1", 4), r)
+
+	// Reservations are only used once
+	_, sameNode = next.take(util.NamespacedName{Namespace: "default", Name: "a"}, "node-1")
+	assert.False(t, sameNode)
+}
+
+func TestReservationsTakeOtherNode(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+
+	require.NoError(t, newTestReservationStore(client, time.Now()).save(ctx, logger, []persistedReservation{
+		testReservation("a", "node-1", 1),
+	}, false))
+
+	store := newTestReservationStore(client, time.Now())
+	require.NoError(t, store.load(ctx, logger))
+
+	// A pod that's now on a different node must not use its old reservation, nor keep it around
+	_, ok := store.take(util.NamespacedName{Namespace: "default", Name: "a"}, "node-2")
+	assert.False(t, ok)
+	assert.Empty(t, store.loaded)
+}
+
+func TestReservationsLoadLegacy(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	for _, format := range []string{"list", "unsharded"} {
+		t.Run(format, func(t *testing.T) {
+			client := newVersionedClient()
+			reservations := []persistedReservation{testReservation("a", "node-1", 1)}
+
+			var content []byte
+			var err error
+			if format == "list" {
+				content, err = json.Marshal(reservations)
+			} else {
+				content, err = json.Marshal(storedReservations{SavedAt: time.Now().Add(-time.Hour), Final: true, Reservations: reservations})
+			}
+			require.NoError(t, err)
+			_, err = client.CoreV1().ConfigMaps(testReservationsNamespace).Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "reservations", Namespace: testReservationsNamespace},
+				Data:       map[string]string{reservationsConfigMapKey: string(content)},
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			store := newTestReservationStore(client, time.Now())
+			require.NoError(t, store.load(ctx, logger))
+			r, ok := store.take(util.NamespacedName{Namespace: "default", Name: "a"}, "node-1")
+			assert.True(t, ok)
+			assert.Equal(t, reservations[0], r)
+
+			// Saving moves them into the per-node ConfigMaps
+			require.NoError(t, store.save(ctx, logger, reservations, false))
+			assert.ElementsMatch(t, []string{"reservations", "reservations-node-1"}, listReservationConfigMaps(t, client))
+		})
+	}
+}
+
+func TestReservationsShardNameTooLong(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	store := newTestReservationStore(client, time.Now())
+
+	// Node names can be up to 253 characters, as can ConfigMap names
+	longNode := strings.Repeat("a", 240) + ".example.com"
+	otherNode := strings.Repeat("a", 240) + ".example.org"
+
+	name := store.shardName(longNode)
+	assert.LessOrEqual(t, len(name), validation.DNS1123SubdomainMaxLength)
+	assert.Empty(t, validation.IsDNS1123Subdomain(name))
+	assert.NotEqual(t, name, store.shardName(otherNode))
+	assert.Equal(t, "reservations-node-1", store.shardName("node-1"))
+
+	require.NoError(t, store.save(ctx, logger, []persistedReservation{testReservation("a", longNode, 1)}, false))
+	assert.ElementsMatch(t, []string{"reservations", name}, listReservationConfigMaps(t, client))
+
+	next := newTestReservationStore(client, time.Now())
+	require.NoError(t, next.load(ctx, logger))
+	_, ok := next.take(util.NamespacedName{Namespace: "default", Name: "a"}, longNode)
+	assert.True(t, ok)
+
+	// ... and it's removed once the node has no reservations
+	require.NoError(t, store.save(ctx, logger, nil, false))
+	assert.ElementsMatch(t, []string{"reservations"}, listReservationConfigMaps(t, client))
+}
+
+func TestReservationsConflict(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	store := newTestReservationStore(client, time.Now())
+
+	require.NoError(t, store.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 1)}, false))
+
+	// Someone else changes the node's ConfigMap behind our back
+	cms := client.CoreV1().ConfigMaps(testReservationsNamespace)
+	cm, err := cms.Get(ctx, "reservations-node-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	cm.Data[reservationsConfigMapKey] = "{}"
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// We don't blindly overwrite it...
+	err = store.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2)}, false)
+	assert.True(t, apierrors.IsConflict(err), "expected conflict, got %v", err)
+
+	// ... but do on the next attempt, having seen the change
+	require.NoError(t, store.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2)}, false))
+	cm, err = cms.Get(ctx, "reservations-node-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	var shard storedShard
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[reservationsConfigMapKey]), &shard))
+	assert.Equal(t, []persistedReservation{testReservation("a", "node-1", 2)}, shard.Reservations)
+}
+
+func TestReservationsSingleWriter(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	start := time.Now()
+	first := newTestReservationStore(client, start)
+	second := newTestReservationStore(client, start.Add(time.Second))
+
+	require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 1)}, false))
+
+	// While the first scheduler is still saving, the second doesn't overwrite it
+	err := second.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2)}, false)
+	assert.ErrorIs(t, err, errNotWriter)
+
+	// But the first doesn't back off for the second
+	require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 3)}, false))
+
+	// Once the first has handed off, the second takes over
+	require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 3)}, true))
+	require.NoError(t, second.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 4)}, false))
+
+	// ... and a scheduler that started later still doesn't overwrite it
+	third := newTestReservationStore(client, start.Add(2*time.Second))
+	err = third.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 5)}, false)
+	assert.ErrorIs(t, err, errNotWriter)
+}
+
+func TestReservationsTakeOverStopped(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	start := time.Now()
+	first := newTestReservationStore(client, start)
+	second := newTestReservationStore(client, start.Add(time.Second))
+
+	require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 1)}, false))
+
+	// The first scheduler stops without handing off, e.g. because it crashed
+	cms := client.CoreV1().ConfigMaps(testReservationsNamespace)
+	cm, err := cms.Get(ctx, "reservations", metav1.GetOptions{})
+	require.NoError(t, err)
+	var stored storedReservations
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[reservationsConfigMapKey]), &stored))
+	stored.SavedAt = stored.SavedAt.Add(-handoffRecentSyncs * first.syncInterval())
+	content, err := json.Marshal(stored)
+	require.NoError(t, err)
+	cm.Data[reservationsConfigMapKey] = string(content)
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, second.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2)}, false))
+
+	// If the first comes back, it takes over again - having seen what the second saved since - and
+	// the second backs off.
+	require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 3)}, false))
+	err = second.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 4)}, false)
+	assert.ErrorIs(t, err, errNotWriter)
+	assert.Equal(t, []persistedReservation{testReservation("a", "node-1", 3)}, readShard(t, client, "reservations-node-1").Reservations)
+}
+
+// Two schedulers that both decide to start saving at the same time must not both write the
+// per-node ConfigMaps
+func TestReservationsConcurrentClaim(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	clients := newVersionedClients(2)
+	start := time.Now()
+	first := newTestReservationStore(clients[0], start)
+	second := newTestReservationStore(clients[1], start.Add(time.Second))
+
+	// Just after the second scheduler reads the main ConfigMap (which doesn't exist yet), the first
+	// saves its reservations.
+	interleaved := false
+	clients[1].PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		if interleaved || name != "reservations" {
+			return false, nil, nil
+		}
+		interleaved = true
+
+		cm, err := clients[0].CoreV1().ConfigMaps(testReservationsNamespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, first.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 1)}, false))
+		if err != nil {
+			return true, nil, err
+		}
+		return true, cm, nil
+	})
+
+	err := second.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2), testReservation("b", "node-2", 2)}, false)
+	require.True(t, interleaved)
+	assert.ErrorIs(t, err, errNotWriter)
+
+	// The second scheduler didn't write anything
+	assert.Equal(t, []persistedReservation{testReservation("a", "node-1", 1)}, readShard(t, clients[0], "reservations-node-1").Reservations)
+	assert.ElementsMatch(t, []string{"reservations", "reservations-node-1"}, listReservationConfigMaps(t, clients[0]))
+}
+
+// readShard returns the decoded content of the per-node ConfigMap
+func readShard(t *testing.T, client *fake.Clientset, name string) storedShard {
+	cm, err := client.CoreV1().ConfigMaps(testReservationsNamespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	var shard storedShard
+	require.NoError(t, json.Unmarshal([]byte(cm.Data[reservationsConfigMapKey]), &shard))
+	return shard
+}
+
+func TestReservationsHandoff(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	client := newVersionedClient()
+	old := newTestReservationStore(client, time.Now())
+
+	require.NoError(t, old.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 1)}, false))
+
+	// The old scheduler is still running, so the new one waits for its final reservations
+	next := newTestReservationStore(client, time.Now())
+	next.config.HandoffWaitSeconds = 10
+	loaded := make(chan error)
+	go func() {
+		loaded <- next.load(ctx, logger)
+	}()
+
+	select {
+	case err := <-loaded:
+		t.Fatalf("load returned before handoff: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, old.save(ctx, logger, []persistedReservation{testReservation("a", "node-1", 2)}, true))
+
+	select {
+	case err := <-loaded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("load didn't return after handoff")
+	}
+
+	r, ok := next.take(util.NamespacedName{Namespace: "default", Name: "a"}, "node-1")
+	assert.True(t, ok)
+	assert.Equal(t, testReservation("a", "node-1", 2), r, "should use the final reservations")
+}
+
+func TestReservationsSafeMode(t *testing.T) {
+	newEnforcer := func(safeModeUntil time.Time) *AutoscaleEnforcer {
+		store := newTestReservationStore(newVersionedClient(), time.Now())
+		store.safeModeDone = false
+		store.safeModeUntil = safeModeUntil
+
+		return &AutoscaleEnforcer{
+			state: pluginState{
+				nodes: map[string]*nodeState{
+					"node-1": {name: "node-1"},
+					"node-2": {name: "node-2"},
+				},
+			},
+			reservations: store,
+		}
+	}
+
+	t.Run("until usage is known", func(t *testing.T) {
+		e := newEnforcer(time.Now().Add(time.Hour))
+		e.state.nodes["node-2"].mem.Buffer = 1
+
+		assert.True(t, e.inSafeMode(zap.NewNop()))
+
+		e.state.nodes["node-2"].mem.Buffer = 0
+		assert.False(t, e.inSafeMode(zap.NewNop()))
+
+		// Safe mode doesn't restart once it's ended
+		e.state.nodes["node-1"].cpu.Buffer = 1
+		assert.False(t, e.inSafeMode(zap.NewNop()))
+	})
+
+	t.Run("until maximum duration", func(t *testing.T) {
+		e := newEnforcer(time.Now().Add(-time.Second))
+		e.state.nodes["node-1"].cpu.Buffer = 1
+
+		assert.False(t, e.inSafeMode(zap.NewNop()))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		e := newEnforcer(time.Now().Add(time.Hour))
+		e.reservations.safeModeDone = true
+		e.state.nodes["node-1"].cpu.Buffer = 1
+
+		assert.False(t, e.inSafeMode(zap.NewNop()))
+	})
+}
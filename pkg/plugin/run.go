@@ -3,18 +3,22 @@ package plugin
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/samber/lo"
 	"github.com/tychoish/fun/srv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 const (
@@ -23,12 +27,12 @@ const (
 	ContentTypeError string = "text/plain"
 )
 
-// The scheduler plugin currently supports v3.0 to v5.0 of the agent<->scheduler plugin protocol.
+// The scheduler plugin currently supports v3.0 to v5.3 of the agent<->scheduler plugin protocol.
 //
 // If you update either of these values, make sure to also update VERSIONING.md.
 const (
 	MinPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV3_0
-	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_0
+	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_3
 )
 
 // startPermitHandler runs the server for handling each resourceRequest from a pod
@@ -48,6 +52,8 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 				msg := "request handler panicked"
 				logger.Error(msg, zap.String("error", fmt.Sprint(err)))
 				finalStatus = 500
+				e.metrics.resourceRequestErrors.WithLabelValues(string(errclass.Bug)).Inc()
+				w.Header().Set(errclass.HTTPHeader, string(errclass.Bug))
 				w.WriteHeader(finalStatus)
 				_, _ = w.Write([]byte(msg))
 			}
@@ -72,13 +78,17 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 			return
 		}
 
-		logger = logger.With(zap.Object("pod", req.Pod))
+		logger = util.LoggerWithCorrelationID(logger.With(zap.Object("pod", req.Pod)), req.CorrelationID)
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("k8s.pod.name", fmt.Sprint(req.Pod)),
+			attribute.String("autoscaling.correlation_id", req.CorrelationID),
+		)
 		logger.Info(
 			"Received autoscaler-agent request",
 			zap.String("client", r.RemoteAddr), zap.Any("request", req),
 		)
 
-		resp, statusCode, err := e.handleAgentRequest(logger, req)
+		resp, statusCode, err := e.handleAgentRequest(r.Context(), logger, req)
 		finalStatus = statusCode
 
 		if err != nil {
@@ -87,13 +97,18 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 				logFunc = logger.Error
 			}
 
+			class := errclass.Of(err)
+			e.metrics.resourceRequestErrors.WithLabelValues(string(class)).Inc()
+
 			logFunc(
 				"Responding to autoscaler-agent request with error",
 				zap.Int("status", statusCode),
+				zap.String("errorClass", string(class)),
 				zap.Error(err),
 			)
 
 			w.Header().Add("Content-Type", ContentTypeError)
+			w.Header().Set(errclass.HTTPHeader, string(class))
 			w.WriteHeader(statusCode)
 			_, _ = w.Write([]byte(err.Error()))
 			return
@@ -118,7 +133,7 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 	orca := srv.GetOrchestrator(ctx)
 
 	logger.Info("Starting resource request server")
-	hs := srv.HTTP("resource-request", 5*time.Second, &http.Server{Addr: "0.0.0.0:10299", Handler: mux})
+	hs := srv.HTTP("resource-request", 5*time.Second, &http.Server{Addr: "0.0.0.0:10299", Handler: util.InstrumentHTTPHandler(mux, "Resource request")})
 	if err := hs.Start(ctx); err != nil {
 		return fmt.Errorf("Error starting resource request server: %w", err)
 	}
@@ -131,9 +146,15 @@ func (e *AutoscaleEnforcer) startPermitHandler(ctx context.Context, logger *zap.
 
 // Returns body (if successful), status code, error (if unsuccessful)
 func (e *AutoscaleEnforcer) handleAgentRequest(
+	ctx context.Context,
 	logger *zap.Logger,
 	req api.AgentRequest,
 ) (_ *api.PluginResponse, status int, _ error) {
+	start := time.Now()
+	defer func() {
+		util.ObserveWithTrace(ctx, e.metrics.agentRequestDuration, time.Since(start).Seconds())
+	}()
+
 	nodeName := "<none>" // override this later if we have a node name
 	defer func() {
 		hasMetrics := req.Metrics != nil
@@ -149,52 +170,62 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	}
 
 	if !req.ProtoVersion.IsValid() {
-		return nil, 400, fmt.Errorf("Invalid protocol version %v", req.ProtoVersion)
+		return nil, 400, errclass.Errorf(errclass.Bug, "Invalid protocol version %v", req.ProtoVersion)
 	}
 	reqProtoRange := req.ProtocolRange()
 	if _, ok := expectedProtoRange.LatestSharedVersion(reqProtoRange); !ok {
-		return nil, 400, fmt.Errorf(
+		return nil, 400, errclass.Errorf(
+			errclass.Bug,
 			"Protocol version mismatch: Need %v but got %v", expectedProtoRange, reqProtoRange,
 		)
 	}
 
 	// if req.Metrics is nil, check that the protocol version allows that.
 	if req.Metrics == nil && !req.ProtoVersion.AllowsNilMetrics() {
-		return nil, 400, fmt.Errorf("nil metrics not supported for protocol version %v", req.ProtoVersion)
+		return nil, 400, errclass.Errorf(errclass.Bug, "nil metrics not supported for protocol version %v", req.ProtoVersion)
 	}
 
 	// check that req.ComputeUnit has no zeros
 	if err := req.ComputeUnit.ValidateNonZero(); err != nil {
-		return nil, 400, fmt.Errorf("computeUnit fields must be non-zero: %w", err)
+		return nil, 400, errclass.Errorf(errclass.Bug, "computeUnit fields must be non-zero: %w", err)
 	}
 	// check that nil-ness of req.Metrics.{LoadAverage5Min,MemoryUsageBytes} match what's expected
 	// for the protocol version.
 	if req.Metrics != nil {
 		if (req.Metrics.LoadAverage5Min != nil) != (req.Metrics.MemoryUsageBytes != nil) {
-			return nil, 400, fmt.Errorf("presence of metrics.loadAvg5M must match presence of metrics.memoryUsageBytes")
+			return nil, 400, errclass.Errorf(errclass.Bug, "presence of metrics.loadAvg5M must match presence of metrics.memoryUsageBytes")
 		} else if req.Metrics.LoadAverage5Min == nil && req.ProtoVersion.IncludesExtendedMetrics() {
-			return nil, 400, fmt.Errorf("nil metrics.{loadAvg5M,memoryUsageBytes} not supported for protocol version %v", req.ProtoVersion)
+			return nil, 400, errclass.Errorf(errclass.Bug, "nil metrics.{loadAvg5M,memoryUsageBytes} not supported for protocol version %v", req.ProtoVersion)
 		} else if req.Metrics.LoadAverage5Min != nil && !req.ProtoVersion.IncludesExtendedMetrics() {
-			return nil, 400, fmt.Errorf("non-nil metrics.{loadAvg5M,memoryUsageBytes} not supported for protocol version %v", req.ProtoVersion)
+			return nil, 400, errclass.Errorf(errclass.Bug, "non-nil metrics.{loadAvg5M,memoryUsageBytes} not supported for protocol version %v", req.ProtoVersion)
 		}
 	}
 
+	// nb: the load shedder measures the time spent waiting for the lock as well.
+	overloaded := false
+	if e.loadShedder != nil {
+		var finish func()
+		overloaded, finish = e.loadShedder.start()
+		defer finish()
+	}
+
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
 
 	pod, ok := e.state.pods[req.Pod]
 	if !ok {
 		logger.Warn("Received request for Pod we don't know") // pod already in the logger's context
-		return nil, 404, errors.New("pod not found")
+		return nil, 404, errclass.Errorf(errclass.TransientInfra, "pod not found")
 	}
 	if pod.vm == nil {
 		logger.Error("Received request for non-VM Pod")
-		return nil, 400, errors.New("pod is not associated with a VM")
+		return nil, 400, errclass.Errorf(errclass.Bug, "pod is not associated with a VM")
 	}
 
 	// Check that req.ComputeUnit.Mem is divisible by the VM's memory slot size
 	if req.ComputeUnit.Mem%pod.vm.MemSlotSize != 0 {
-		return nil, 400, fmt.Errorf(
+		return nil, 400, errclass.Errorf(
+			errclass.UserError,
 			"computeUnit is not divisible by VM memory slot size: %v not divisible by %v",
 			req.ComputeUnit,
 			pod.vm.MemSlotSize,
@@ -216,11 +247,20 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	mustMigrate := pod.vm.MigrationState == nil &&
 		// Check whether the pod *will* migrate, then update its resources, and THEN start its
 		// migration, using the possibly-changed resources.
-		e.updateMetricsAndCheckMustMigrate(logger, pod.vm, node, req.Metrics)
+		e.updateMetricsAndCheckMustMigrate(logger, pod, node, req.Metrics)
 
 	supportsFractionalCPU := req.ProtoVersion.SupportsFractionalCPU()
+	supportsBallast := req.ProtoVersion.SupportsBallast()
+	supportsLeases := req.ProtoVersion.SupportsUpscaleLeases()
+	pod.vm.DownscaleSupported = req.ProtoVersion.SupportsDownscaleRequests()
 
-	permit, status, err := e.handleResources(
+	deferUpscale := overloaded && !e.loadShedder.isSmallUpscale(
+		api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved},
+		req.Resources,
+		req.ComputeUnit,
+	)
+
+	permit, ballast, lease, status, err := e.handleResources(
 		logger,
 		pod,
 		node,
@@ -229,11 +269,25 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 		req.LastPermit,
 		mustMigrate,
 		supportsFractionalCPU,
+		supportsBallast,
+		supportsLeases,
+		deferUpscale,
 	)
 	if err != nil {
 		return nil, status, err
 	}
 
+	var retryAfterSeconds uint
+	if deferUpscale && req.Resources.HasFieldGreaterThan(permit) {
+		retryAfterSeconds = e.loadShedder.config.RetryAfterSeconds
+		e.metrics.deferredUpscales.WithLabelValues(node.name, node.nodeGroup).Inc()
+	}
+
+	// While overloaded, skip asking other VMs to downscale. It can wait until we've caught up.
+	if !overloaded && e.state.conf.NodeConfig.RequestDownscales && (pod.cpu.CapacityPressure != 0 || pod.mem.CapacityPressure != 0) {
+		e.requestDownscalesIfNecessary(logger, node, pod, req.ComputeUnit)
+	}
+
 	var migrateDecision *api.MigrateResponse
 	if mustMigrate {
 		created, err := e.startMigration(context.Background(), logger, pod)
@@ -250,9 +304,19 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 		}
 	}
 
+	var downscale *api.PluginDownscaleRequest
+	if migrateDecision == nil {
+		downscale = pod.vm.takeDownscaleRequest()
+	}
+
 	resp := api.PluginResponse{
-		Permit:  permit,
-		Migrate: migrateDecision,
+		Permit:    permit,
+		Migrate:   migrateDecision,
+		Ballast:   ballast,
+		Downscale: downscale,
+		Lease:     lease,
+
+		RetryAfterSeconds: retryAfterSeconds,
 	}
 	return &resp, 200, nil
 }
@@ -266,10 +330,13 @@ func (e *AutoscaleEnforcer) handleResources(
 	lastPermit *api.Resources,
 	startingMigration bool,
 	supportsFractionalCPU bool,
-) (api.Resources, int, error) {
+	supportsBallast bool,
+	supportsLeases bool,
+	deferUpscale bool,
+) (api.Resources, *api.BallastGrant, *api.UpscaleLease, int, error) {
 	if !supportsFractionalCPU && req.VCPU%1000 != 0 {
-		err := errors.New("agent requested fractional CPU with protocol version that does not support it")
-		return api.Resources{}, 400, err
+		err := errclass.Errorf(errclass.Bug, "agent requested fractional CPU with protocol version that does not support it")
+		return api.Resources{}, nil, nil, 400, err
 	}
 
 	// Check that we aren't being asked to do something during migration:
@@ -277,10 +344,10 @@ func (e *AutoscaleEnforcer) handleResources(
 		// The agent shouldn't have asked for a change after already receiving notice that it's
 		// migrating.
 		if req.VCPU != pod.cpu.Reserved || req.Mem != pod.mem.Reserved {
-			err := errors.New("cannot change resources: agent has already been informed that pod is migrating")
-			return api.Resources{}, 400, err
+			err := errclass.Errorf(errclass.Bug, "cannot change resources: agent has already been informed that pod is migrating")
+			return api.Resources{}, nil, nil, 400, err
 		}
-		return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
+		return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, nil, nil, 200, nil
 	}
 
 	cpuFactor := cu.VCPU
@@ -296,10 +363,125 @@ func (e *AutoscaleEnforcer) handleResources(
 		lastMemPermit = &lastPermit.Mem
 	}
 
-	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
-		handleRequested(req.VCPU, lastCPUPermit, startingMigration, cpuFactor)
-	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
-		handleRequested(req.Mem, lastMemPermit, startingMigration, memFactor)
+	// Shortly after a restart, other VMs on the node may have been granted resources by the previous
+	// scheduler that we don't know about yet, so don't approve any increases until they've checked
+	// in. The same goes for every node while in safe mode, and we stop approving increases entirely
+	// while handing off to the next scheduler. See reservations.go for more.
+	//
+	// Likewise, don't approve large increases while we're overloaded. See loadshed.go for more.
+	var denyIncreaseReason string
+	if e.reservations != nil && e.reservations.handingOff.Load() {
+		denyIncreaseReason = "while handing off reservations to the next scheduler"
+	} else if e.inSafeMode(logger) {
+		denyIncreaseReason = "in safe mode, until every pod's usage is known after startup"
+	} else if e.reservations != nil && e.reservations.warmingUp() &&
+		(node.cpu.Buffer != pod.cpu.Buffer || node.mem.Buffer != pod.mem.Buffer) {
+		denyIncreaseReason = "during warm-up, because other pods on the node have buffer"
+	} else if deferUpscale {
+		denyIncreaseReason = "while overloaded with requests"
+	}
+	if denyIncreaseReason != "" {
+		maxCPU := pod.cpu.Reserved
+		if lastCPUPermit != nil {
+			maxCPU = util.Max(maxCPU, *lastCPUPermit)
+		}
+		maxMem := pod.mem.Reserved
+		if lastMemPermit != nil {
+			maxMem = util.Max(maxMem, *lastMemPermit)
+		}
+		if req.VCPU > maxCPU || req.Mem > maxMem {
+			logger.Info(
+				fmt.Sprintf("Denying increase %s", denyIncreaseReason),
+				zap.Object("requested", req),
+				zap.Object("max", api.Resources{VCPU: maxCPU, Mem: maxMem}),
+			)
+			req.VCPU = util.Min(req.VCPU, maxCPU)
+			req.Mem = util.Min(req.Mem, maxMem)
+		}
+	}
+
+	oldCPUReserved, oldMemReserved := pod.cpu.Reserved, pod.mem.Reserved
+
+	cpuTransitioner := makeResourceTransitioner(&node.cpu, &pod.cpu)
+	memTransitioner := makeResourceTransitioner(&node.mem, &pod.mem)
+
+	// If the ballast is enabled, first settle any grant from the previous response, so that
+	// whatever the VM has already used is always approved.
+	ballastConf := e.state.conf.NodeConfig.Ballast
+	oldCPUState := cpuTransitioner.snapshotState()
+	oldMemState := memTransitioner.snapshotState()
+	memApproved := pod.mem.Reserved
+	if ballastConf != nil {
+		memApproved = memTransitioner.useBallastGrant(lastMemPermit)
+		if lastMemPermit == nil || *lastMemPermit < memApproved {
+			lastMemPermit = &memApproved
+		}
+	}
+
+	// Likewise for any upscale lease from the previous response. See lease.go for more.
+	hadLease := pod.vm.LeaseExpiresAt != nil
+	if hadLease {
+		cpuApproved := cpuTransitioner.useLease(req.VCPU, pod.cpu.Reserved)
+		memApproved = memTransitioner.useLease(req.Mem, memApproved)
+		pod.vm.LeaseExpiresAt = nil
+		if lastCPUPermit == nil || *lastCPUPermit < cpuApproved {
+			lastCPUPermit = &cpuApproved
+		}
+		if lastMemPermit == nil || *lastMemPermit < memApproved {
+			lastMemPermit = &memApproved
+		}
+	}
+
+	priorityConf := e.state.conf.NodeConfig.Priority
+	priority := pod.vm.Config.EffectivePriority()
+	cpuHeadroom := headroom(priorityConf, priority, node.cpu.Total)
+	memHeadroom := headroom(priorityConf, priority, node.mem.Total)
+
+	if ballastConf != nil && !startingMigration {
+		memTransitioner.reclaimBallast(req.Mem, memHeadroom)
+	}
+
+	cpuVerdict := cpuTransitioner.handleRequested(req.VCPU, lastCPUPermit, startingMigration, cpuFactor, cpuHeadroom)
+	memVerdict := memTransitioner.handleRequested(req.Mem, lastMemPermit, startingMigration, memFactor, memHeadroom)
+
+	var ballast *api.BallastGrant
+	if ballastConf != nil {
+		memTransitioner.replenishBallast(ballastConf.memTarget(node))
+
+		if supportsBallast && !startingMigration && pod.vm.Config.ScalingEnabled {
+			maxGrant := memFactor * api.Bytes(ballastConf.MaxGrantComputeUnits)
+			if grant := memTransitioner.grantBallast(maxGrant, memFactor); grant != 0 {
+				ballast = &api.BallastGrant{Mem: grant}
+			}
+		}
+
+		memVerdict = fmt.Sprintf("%s; %s", memVerdict, ballastVerdict(oldMemState, memTransitioner.snapshotState()))
+	}
+
+	var lease *api.UpscaleLease
+	leaseConf := e.state.conf.NodeConfig.UpscaleLeases
+	if leaseConf != nil && supportsLeases && !startingMigration && pod.vm.Config.ScalingEnabled {
+		maxLease := api.Resources{VCPU: cpuFactor, Mem: memFactor}.Mul(leaseConf.MaxComputeUnits)
+		leased := api.Resources{
+			VCPU: cpuTransitioner.grantLease(maxLease.VCPU, cpuFactor, cpuHeadroom),
+			Mem:  memTransitioner.grantLease(maxLease.Mem, memFactor, memHeadroom),
+		}
+		if leased != (api.Resources{}) {
+			pod.vm.LeaseExpiresAt = lo.ToPtr(time.Now().Add(time.Second * time.Duration(leaseConf.ValidSeconds)))
+			lease = &api.UpscaleLease{
+				Resources:    leased,
+				ValidSeconds: leaseConf.ValidSeconds,
+			}
+		}
+	}
+	if hadLease || lease != nil {
+		cpuVerdict = fmt.Sprintf("%s; %s", cpuVerdict, leaseVerdict(oldCPUState, cpuTransitioner.snapshotState()))
+		memVerdict = fmt.Sprintf("%s; %s", memVerdict, leaseVerdict(oldMemState, memTransitioner.snapshotState()))
+	}
+
+	if pod.cpu.Reserved != oldCPUReserved || pod.mem.Reserved != oldMemReserved {
+		pod.vm.LastScaled = time.Now()
+	}
 
 	logger.Info(
 		"Handled requested resources from pod",
@@ -309,15 +491,17 @@ func (e *AutoscaleEnforcer) handleResources(
 		}),
 	)
 
-	return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
+	return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, ballast, lease, 200, nil
 }
 
 func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	logger *zap.Logger,
-	vm *vmPodState,
+	pod *podState,
 	node *nodeState,
 	metrics *api.Metrics,
 ) bool {
+	vm := pod.vm
+
 	// This pod should migrate if (a) it's allowed to migrate, (b) node resource usage is high
 	// enough that we should migrate *something*, and (c) it's next up in the priority queue.
 	// We will give it a chance later to veto if the metrics have changed too much.
@@ -325,7 +509,7 @@ func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	// Alternatively, "the pod is marked to always migrate" causes it to migrate even if none of
 	// the above conditions are met, so long as it has *previously* provided metrics.
 	canMigrate := vm.Config.AutoMigrationEnabled && e.state.conf.migrationEnabled()
-	shouldMigrate := node.mq.isNextInQueue(vm) && node.tooMuchPressure(logger)
+	shouldMigrate := node.mq.isNextInQueue(pod) && node.tooMuchPressure(logger)
 	forcedMigrate := vm.Config.AlwaysMigrate && vm.Metrics != nil
 
 	logger.Info("Updating pod metrics", zap.Any("metrics", metrics))
@@ -335,7 +519,7 @@ func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 		return false // don't do anything else; it's already migrating.
 	}
 
-	node.mq.addOrUpdate(vm)
+	node.mq.addOrUpdate(pod)
 
 	// nb: forcedMigrate takes priority over canMigrate
 	if (!canMigrate || !shouldMigrate) && !forcedMigrate {
@@ -349,7 +533,7 @@ func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	}
 
 	// ... but override the veto if it's still the best candidate anyways.
-	stillFirst := node.mq.isNextInQueue(vm)
+	stillFirst := node.mq.isNextInQueue(pod)
 
 	if forcedMigrate || stillFirst || veto == nil {
 		if veto != nil {
@@ -0,0 +1,117 @@
+package plugin
+
+// "Simulate" endpoint: dry-run Filter and Score of a hypothetical VM
+//
+// Capacity-planning tooling can ask how a VM with the given resources would be scheduled right
+// now: which nodes would pass Filter, and what each of them would be scored. It's served alongside
+// the "would fit" endpoint (see wouldfit.go), and has the same caveats: only the resources that we
+// track are considered, and nothing is reserved.
+//
+// Because the VM doesn't exist, the parts of Filter and Score that depend on the pod - node
+// capabilities, hugepages, and the NUMA topology penalty - aren't applied.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+func (e *AutoscaleEnforcer) handleSimulate(
+	ctx context.Context,
+	logger *zap.Logger,
+	req *api.SimulateRequest,
+) (*api.SimulateResponse, int, error) {
+	if req.Use.VCPU == 0 || req.Use.Mem == 0 {
+		return nil, 400, errors.New("use.vCPUs and use.mem must be > 0")
+	}
+
+	priority := req.Priority
+	if priority == "" {
+		priority = vmapi.PriorityStandard
+	}
+
+	selector := labels.SelectorFromSet(req.NodeSelector)
+	nodes := e.nodeStore.Items()
+
+	if err := e.state.lock.TryLock(ctx); err != nil {
+		return nil, 500, errclass.Errorf(errclass.TransientInfra, "could not acquire state lock: %w", err)
+	}
+	defer e.state.lock.Unlock()
+
+	resp := &api.SimulateResponse{Nodes: []api.SimulateNode{}}
+	passing := 0
+	for _, node := range nodes {
+		if !selector.Matches(labels.Set(node.Labels)) {
+			continue
+		}
+
+		result := api.SimulateNode{
+			Name:         node.Name,
+			PassesFilter: false,
+			Reason:       "",
+			Score:        framework.MinNodeScore,
+			Remaining:    api.Resources{VCPU: 0, Mem: 0},
+		}
+
+		if node.Spec.Unschedulable {
+			result.Reason = "node is unschedulable"
+			resp.Nodes = append(resp.Nodes, result)
+			continue
+		} else if !nodeIsReady(node) {
+			result.Reason = "node is not ready"
+			resp.Nodes = append(resp.Nodes, result)
+			continue
+		}
+
+		state, err := e.state.getOrFetchNodeState(ctx, logger, e.metrics, e.nodeStore, node.Name)
+		if err != nil {
+			logger.Warn("Error getting node state", zap.String("node", node.Name), zap.Error(err))
+			result.Reason = fmt.Sprintf("error getting node state: %s", err)
+			resp.Nodes = append(resp.Nodes, result)
+			continue
+		}
+
+		result.Remaining = api.Resources{
+			VCPU: state.remainingReservableCPU(),
+			Mem:  state.remainingReservableMem(),
+		}
+		if req.Use.HasFieldGreaterThan(result.Remaining) {
+			result.Reason = "Not enough resources for pod"
+			resp.Nodes = append(resp.Nodes, result)
+			continue
+		}
+
+		result.PassesFilter = true
+		result.Score, _ = e.scoreNode(state, priority)
+		resp.Nodes = append(resp.Nodes, result)
+		passing += 1
+	}
+
+	slices.SortFunc(resp.Nodes, func(a, b api.SimulateNode) bool {
+		if a.PassesFilter != b.PassesFilter {
+			return a.PassesFilter
+		} else if a.PassesFilter && a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return a.Name < b.Name
+	})
+
+	logger.Info(
+		"Responding to simulate request",
+		zap.Object("use", req.Use),
+		zap.String("priority", string(priority)),
+		zap.Int("nodes", len(resp.Nodes)),
+		zap.Int("passingNodes", passing),
+	)
+	return resp, 200, nil
+}
@@ -0,0 +1,147 @@
+package plugin
+
+// Reclaiming reservations from pods that never start
+//
+// We reserve resources for a pod as soon as it's scheduled, but the pod may never actually start
+// running - e.g. if its image can't be pulled, or its containers repeatedly fail to be created.
+// Until the pod is deleted, its reservation still counts against the node, so VM pods that are
+// stuck like this can permanently take up capacity that other VMs could use.
+//
+// To make that visible, we keep track of which pods have reserved resources but aren't yet running,
+// and report their total as each node's Starting resources (a portion of Reserved).
+//
+// If startupReclaim is enabled, we also periodically release the reservations of pods that have
+// been starting for longer than the timeout, as if they'd been deleted. Should one of those pods
+// start after all, its resources are reserved again when we handle the start event, the same way
+// as for pods that weren't scheduled by us.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type startupReclaimConfig struct {
+	// TimeoutSeconds gives the duration, in seconds, that a pod may be reserved without running
+	// before we release its reservation. It should comfortably exceed the time it takes to pull
+	// images onto a fresh node.
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// CheckIntervalSeconds gives the duration, in seconds, between checks for pods that have timed
+	// out.
+	CheckIntervalSeconds uint `json:"checkIntervalSeconds"`
+}
+
+func (c *startupReclaimConfig) validate() (string, error) {
+	if c.TimeoutSeconds == 0 {
+		return "timeoutSeconds", errors.New("value must be > 0")
+	} else if c.CheckIntervalSeconds == 0 {
+		return "checkIntervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// updateStarting recomputes the node's Starting resources from its pods
+func (s *nodeState) updateStarting() {
+	s.cpu.Starting = 0
+	s.mem.Starting = 0
+	for _, p := range s.pods {
+		if p.startingSince != nil {
+			s.cpu.Starting += p.cpu.Reserved
+			s.mem.Starting += p.mem.Reserved
+		}
+	}
+}
+
+// runStartupReclaim periodically submits the pods that have been starting for longer than the
+// timeout until the context is canceled.
+func (e *AutoscaleEnforcer) runStartupReclaim(
+	ctx context.Context,
+	logger *zap.Logger,
+	config startupReclaimConfig,
+	submitStartupTimeout func(*zap.Logger, util.NamespacedName),
+) {
+	timeout := time.Second * time.Duration(config.TimeoutSeconds)
+	ticker := time.NewTicker(time.Second * time.Duration(config.CheckIntervalSeconds))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range e.timedOutStartingPods(timeout) {
+			logger.Info("Pod has not started within timeout", zap.Object("pod", name))
+			submitStartupTimeout(logger, name)
+		}
+	}
+}
+
+// timedOutStartingPods returns the pods that have been starting for at least timeout
+func (e *AutoscaleEnforcer) timedOutStartingPods(timeout time.Duration) []util.NamespacedName {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var names []util.NamespacedName
+	for name, ps := range e.state.pods {
+		if ps.startupTimedOut(timeout) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// startupTimedOut returns whether the pod has been starting for at least timeout
+//
+// Pods that are currently migrating are exempt, because the migration's target pod is expected to
+// be created long before it's running, and its reservation is released when the migration ends.
+func (p *podState) startupTimedOut(timeout time.Duration) bool {
+	if p.startingSince == nil || (p.vm != nil && p.vm.currentlyMigrating()) {
+		return false
+	}
+	return time.Since(*p.startingSince) >= timeout
+}
+
+// handleStartupTimeout releases the reservation for a pod that hasn't started within the timeout
+func (e *AutoscaleEnforcer) handleStartupTimeout(logger *zap.Logger, podName util.NamespacedName) {
+	logger = logger.With(
+		zap.String("action", "Pod startup timeout"),
+		zap.Object("pod", podName),
+	)
+
+	// The pod may have started (or been deleted) since it was submitted, so check again. Because
+	// this is handled in the same queue as the pod's start and deletion events, neither can happen
+	// after we release the lock.
+	e.state.lock.Lock()
+	ps, ok := e.state.pods[podName]
+	timedOut := ok && ps.startupTimedOut(time.Second*time.Duration(e.state.conf.StartupReclaim.TimeoutSeconds))
+	var node *nodeState
+	var startingSince time.Time
+	if timedOut {
+		node = ps.node
+		startingSince = *ps.startingSince
+	}
+	e.state.lock.Unlock()
+
+	if !timedOut {
+		logger.Info("Pod is no longer starting, nothing to reclaim")
+		return
+	}
+
+	logger.Warn("Releasing reservation for Pod that has not started", zap.Time("startingSince", startingSince))
+
+	logFields, kind, _, verdict := e.unreserveResources(logger, podName)
+	e.metrics.IncStartupReclaim(node)
+
+	logger.With(logFields...).Info(
+		fmt.Sprintf("Released reservation for starting %s Pod", kind),
+		zap.Object("verdict", verdict),
+	)
+}
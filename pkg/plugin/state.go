@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
@@ -74,6 +75,10 @@ type nodeState struct {
 
 	// mq is the priority queue tracking which pods should be chosen first for migration
 	mq migrationQueue
+
+	// numa is the node's NUMA topology, from its annotation. It's nil if the node doesn't have a
+	// valid annotation. See topology.go for more.
+	numa []api.NUMANode
 }
 
 type nodeResourceStateField[T any] struct {
@@ -89,10 +94,15 @@ func (s *nodeResourceState[T]) fields() []nodeResourceStateField[T] {
 		{"Buffer", s.Buffer},
 		{"CapacityPressure", s.CapacityPressure},
 		{"PressureAccountedFor", s.PressureAccountedFor},
+		{"Ballast", s.Ballast},
+		{"BallastGranted", s.BallastGranted},
+		{"Leased", s.Leased},
+		{"Starting", s.Starting},
 	}
 }
 
 func (s *nodeState) updateMetrics(metrics PromMetrics) {
+	s.updateStarting()
 	s.cpu.updateMetrics(metrics.nodeCPUResources, s.name, s.nodeGroup, s.availabilityZone, vmapi.MilliCPU.AsFloat64)
 	s.mem.updateMetrics(metrics.nodeMemResources, s.name, s.nodeGroup, s.availabilityZone, api.Bytes.AsFloat64)
 }
@@ -136,7 +146,8 @@ type nodeResourceState[T any] struct {
 	//
 	// For more information, refer to the ARCHITECTURE.md file in this directory.
 	//
-	// Reserved is always exactly equal to the sum of all of this node's pods' Reserved T.
+	// Reserved is always exactly equal to the sum of all of this node's pods' Reserved T, plus the
+	// node's Ballast and Leased.
 	Reserved T `json:"reserved"`
 	// Buffer *mostly* matters during startup. It tracks the total amount of T that we don't
 	// *expect* is currently in use, but is still reserved to the pods because we can't prevent the
@@ -157,6 +168,20 @@ type nodeResourceState[T any] struct {
 	//
 	// The value may be larger than CapacityPressure.
 	PressureAccountedFor T `json:"pressureAccountedFor"`
+	// Ballast is the amount of T held by the node's ballast, which is included in Reserved. It is
+	// only nonzero for memory, and only if the ballast is enabled. See ballast.go for more.
+	Ballast T `json:"ballast"`
+	// BallastGranted is the portion of Ballast that's currently lent to pods on the node. It is
+	// always exactly equal to the sum of all this node's pods' BallastGrant for T.
+	BallastGranted T `json:"ballastGranted"`
+	// Leased is the amount of T that's currently reserved for pods' upscale leases, which is
+	// included in Reserved. It is always exactly equal to the sum of all this node's pods' Lease for
+	// T. See lease.go for more.
+	Leased T `json:"leased"`
+	// Starting is the portion of Reserved that belongs to pods that haven't started running yet.
+	// It's recomputed from the node's pods whenever the node's metrics are updated. See startup.go
+	// for more.
+	Starting T `json:"starting"`
 }
 
 // podState is the information we track for an individual pod, which may or may not be associated
@@ -177,6 +202,10 @@ type podState struct {
 
 	// vm stores the extra information associated with VMs
 	vm *vmPodState
+
+	// startingSince, if not nil, gives the time at which we reserved resources for this pod, while
+	// it's not yet running. It's set to nil once the pod starts. See startup.go for more.
+	startingSince *time.Time
 }
 
 type vmPodState struct {
@@ -202,6 +231,27 @@ type vmPodState struct {
 	// MigrationState gives current information about an ongoing migration, if this pod is currently
 	// migrating.
 	MigrationState *podMigrationState
+
+	// Downscale, if not nil, gives the downscale we've asked this VM to make in order to relieve
+	// pressure on its node. See downscale.go for more.
+	Downscale *vmDownscaleState
+
+	// DownscaleSupported is true iff the protocol version used in the most recent request from
+	// this VM's autoscaler-agent supports downscale requests.
+	DownscaleSupported bool
+
+	// LastScaled is the time at which the pod's reserved resources last changed, or when we started
+	// tracking the pod if they haven't changed since. It's used by the "least-recently-scaled"
+	// migration policy.
+	LastScaled time.Time
+
+	// Priority is the priority of the pod, from its PriorityClass. It's used by the "priority"
+	// migration policy.
+	Priority int32
+
+	// LeaseExpiresAt, if not nil, gives the time at which the pod's current upscale lease expires.
+	// See lease.go for more.
+	LeaseExpiresAt *time.Time
 }
 
 // podMigrationState tracks the information about an ongoing VM pod's migration
@@ -226,6 +276,12 @@ type podResourceState[T any] struct {
 	// CapacityPressure is this pod's contribution to this pod's node's CapacityPressure for this
 	// resource
 	CapacityPressure T `json:"capacityPressure"`
+	// BallastGrant is the amount of the node's ballast lent to this pod in the most recent
+	// PluginResponse. It is NOT included in Reserved.
+	BallastGrant T `json:"ballastGrant"`
+	// Lease is the amount of T reserved on the node for this pod's upscale lease from the most
+	// recent PluginResponse. It is NOT included in Reserved.
+	Lease T `json:"lease"`
 
 	// Min and Max give the minimum and maximum values of this resource that the VM may use.
 	Min T `json:"min"`
@@ -293,9 +349,9 @@ func (s *nodeState) tooMuchPressure(logger *zap.Logger) bool {
 	mem.LogicalPressure = util.SaturatingSub(s.mem.Reserved, s.mem.Watermark)
 
 	// Account for existing slack in the system, to counteract capacityPressure that hasn't been
-	// updated yet
-	cpu.LogicalSlack = s.cpu.Buffer + util.SaturatingSub(s.cpu.Watermark, s.cpu.Reserved)
-	mem.LogicalSlack = s.mem.Buffer + util.SaturatingSub(s.mem.Watermark, s.mem.Reserved)
+	// updated yet. Unused ballast counts as slack, because it will be reclaimed if needed.
+	cpu.LogicalSlack = s.cpu.Buffer + (s.cpu.Ballast - s.cpu.BallastGranted) + util.SaturatingSub(s.cpu.Watermark, s.cpu.Reserved)
+	mem.LogicalSlack = s.mem.Buffer + (s.mem.Ballast - s.mem.BallastGranted) + util.SaturatingSub(s.mem.Watermark, s.mem.Reserved)
 
 	cpu.TooMuch = cpu.LogicalPressure+s.cpu.CapacityPressure > s.cpu.PressureAccountedFor+cpu.LogicalSlack
 	mem.TooMuch = mem.LogicalPressure+s.mem.CapacityPressure > s.mem.PressureAccountedFor+mem.LogicalSlack
@@ -490,7 +546,8 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 		cpu:              cpu,
 		mem:              mem,
 		pods:             make(map[util.NamespacedName]*podState),
-		mq:               migrationQueue{},
+		mq:               newMigrationQueue(conf.MigrationPolicy),
+		numa:             numaTopologyFromNode(logger, node),
 	}
 
 	type resourceInfo[T any] struct {
@@ -631,9 +688,14 @@ func (e *AutoscaleEnforcer) reserveResources(
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
 
-	// If the pod already exists, nothing to do
-	if _, ok := e.state.pods[util.GetNamespacedName(pod)]; ok {
+	// If the pod already exists, nothing to do - other than noting if it's now running.
+	if ps, ok := e.state.pods[util.GetNamespacedName(pod)]; ok {
 		logger.Info("Pod already exists in global state")
+		if ps.startingSince != nil && pod.Status.Phase == corev1.PodRunning {
+			logger.Info("Pod is no longer starting", zap.Duration("startupDuration", time.Since(*ps.startingSince)))
+			ps.startingSince = nil
+			ps.node.updateMetrics(e.metrics)
+		}
 		return true, &verdictSet{cpu: "", mem: ""}, nil
 	}
 
@@ -696,12 +758,20 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 
 	if vmInfo != nil {
 		vmState = &vmPodState{
-			Name:           vmInfo.NamespacedName(),
-			MemSlotSize:    vmInfo.Mem.SlotSize,
-			Config:         vmInfo.Config,
-			Metrics:        nil,
-			MqIndex:        -1,
-			MigrationState: nil,
+			Name:               vmInfo.NamespacedName(),
+			MemSlotSize:        vmInfo.Mem.SlotSize,
+			Config:             vmInfo.Config,
+			Metrics:            nil,
+			MqIndex:            -1,
+			MigrationState:     nil,
+			Downscale:          nil,
+			DownscaleSupported: false,
+			LastScaled:         time.Now(),
+			Priority:           0, // set below, maybe
+			LeaseExpiresAt:     nil,
+		}
+		if pod.Spec.Priority != nil {
+			vmState.Priority = *pod.Spec.Priority
 		}
 		// initially build the resource states assuming that we're including buffer, and then update
 		// later to remove it if that turns out not to be right.
@@ -709,6 +779,8 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 			Reserved:         vmInfo.Max().VCPU,
 			Buffer:           util.SaturatingSub(vmInfo.Max().VCPU, vmInfo.Using().VCPU),
 			CapacityPressure: 0,
+			BallastGrant:     0,
+			Lease:            0,
 			Min:              vmInfo.Min().VCPU,
 			Max:              vmInfo.Max().VCPU,
 		}
@@ -716,6 +788,8 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 			Reserved:         vmInfo.Max().Mem,
 			Buffer:           util.SaturatingSub(vmInfo.Max().Mem, vmInfo.Using().Mem),
 			CapacityPressure: 0,
+			BallastGrant:     0,
+			Lease:            0,
 			Min:              vmInfo.Min().Mem,
 			Max:              vmInfo.Max().Mem,
 		}
@@ -732,6 +806,15 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 			cpuState.Reserved = vmInfo.Using().VCPU
 			memState.Buffer = 0
 			memState.Reserved = vmInfo.Using().Mem
+		} else if e.reservations != nil {
+			// If we stored this pod's reservation before restarting, that's a tighter upper bound
+			// on what the previous scheduler approved than the VM's maximum.
+			if r, ok := e.reservations.take(util.GetNamespacedName(pod), node.name); ok {
+				cpuState.Reserved = util.Min(util.Max(r.CPU, vmInfo.Using().VCPU), vmInfo.Max().VCPU)
+				cpuState.Buffer = cpuState.Reserved - vmInfo.Using().VCPU
+				memState.Reserved = util.Min(util.Max(r.Mem, vmInfo.Using().Mem), vmInfo.Max().Mem)
+				memState.Buffer = memState.Reserved - vmInfo.Using().Mem
+			}
 		}
 	} else {
 		res := extractPodResources(pod)
@@ -740,6 +823,8 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 			Reserved:         res.VCPU,
 			Buffer:           0,
 			CapacityPressure: 0,
+			BallastGrant:     0,
+			Lease:            0,
 			Min:              res.VCPU,
 			Max:              res.VCPU,
 		}
@@ -747,17 +832,23 @@ func (e *AutoscaleEnforcer) speculativeReserve(
 			Reserved:         res.Mem,
 			Buffer:           0,
 			CapacityPressure: 0,
+			BallastGrant:     0,
+			Lease:            0,
 			Min:              res.Mem,
 			Max:              res.Mem,
 		}
 	}
 	podName := util.GetNamespacedName(pod)
 	ps := &podState{
-		name: podName,
-		node: node,
-		cpu:  cpuState,
-		mem:  memState,
-		vm:   vmState,
+		name:          podName,
+		node:          node,
+		cpu:           cpuState,
+		mem:           memState,
+		vm:            vmState,
+		startingSince: nil, // set below, if the pod isn't running
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		ps.startingSince = lo.ToPtr(time.Now())
 	}
 
 	// Speculatively try reserving the pod.
@@ -862,7 +953,7 @@ func (e *AutoscaleEnforcer) unreserveResources(
 	delete(e.state.pods, podName)
 	delete(ps.node.pods, podName)
 	if ps.vm != nil {
-		ps.node.mq.removeIfPresent(ps.vm)
+		ps.node.mq.removeIfPresent(ps)
 	}
 
 	ps.node.updateMetrics(e.metrics)
@@ -904,7 +995,7 @@ func (e *AutoscaleEnforcer) handleVMConfigUpdated(logger *zap.Logger, podName ut
 	logger.Info("Config updated for VM", zap.Any("oldCfg", newCfg), zap.Any("newCfg", newCfg))
 
 	if oldCfg.AutoMigrationEnabled && !newCfg.AutoMigrationEnabled {
-		ps.node.mq.removeIfPresent(ps.vm)
+		ps.node.mq.removeIfPresent(ps)
 	}
 
 	if oldCfg.ScalingEnabled && !newCfg.ScalingEnabled {
@@ -912,6 +1003,7 @@ func (e *AutoscaleEnforcer) handleVMConfigUpdated(logger *zap.Logger, podName ut
 			handleAutoscalingDisabled()
 		memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 			handleAutoscalingDisabled()
+		ps.vm.LeaseExpiresAt = nil
 
 		ps.node.updateMetrics(e.metrics)
 
@@ -954,9 +1046,12 @@ func (e *AutoscaleEnforcer) handlePodStartMigration(logger *zap.Logger, podName,
 		handleStartMigration(source)
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleStartMigration(source)
+	ps.vm.LeaseExpiresAt = nil
 
-	ps.node.mq.removeIfPresent(ps.vm)
+	ps.node.mq.removeIfPresent(ps)
 	ps.vm.MigrationState = &podMigrationState{Name: migrationName}
+	// Any pressure relief from a requested downscale is now accounted for by the migration instead
+	ps.vm.Downscale = nil
 
 	ps.node.updateMetrics(e.metrics)
 
@@ -1169,16 +1264,6 @@ func (e *AutoscaleEnforcer) cleanupMigration(logger *zap.Logger, vmm *vmapi.Virt
 	}
 }
 
-func (s *vmPodState) isBetterMigrationTarget(other *vmPodState) bool {
-	// TODO: this deprioritizes VMs whose metrics we can't collect. Maybe we don't want that?
-	if s.Metrics == nil || other.Metrics == nil {
-		return s.Metrics != nil && other.Metrics == nil
-	}
-
-	// TODO - this is just a first-pass approximation. Maybe it's ok for now? Maybe it's not. Idk.
-	return s.Metrics.LoadAverage1Min < other.Metrics.LoadAverage1Min
-}
-
 // this method can only be called while holding a lock. It will be released temporarily while we
 // send requests to the API server
 //
@@ -0,0 +1,223 @@
+package plugin
+
+// Topology-aware placement: hugepages and NUMA nodes
+//
+// VMs with hugepage-backed memory have runner pods that request "hugepages-2Mi" or "hugepages-1Gi"
+// resources. In Filter, we reject nodes that don't have enough of the requested hugepages left
+// unallocated, counting the requests of the pods already on the node - the same way we count CPU
+// and memory.
+//
+// The Kubernetes API doesn't say how a node's resources are split between its NUMA nodes, so that's
+// read from the api.AnnotationNUMATopology annotation on the node, if present. With
+// nodeConfig.topology set, we use it to:
+//
+//   - In Filter, if requireSingleNUMANode is true, reject nodes where no single NUMA node has
+//     enough free hugepages for the pod. Guest memory split across NUMA nodes is slower to access.
+//   - In Score, reduce the score of nodes where the VM wouldn't fit within a single NUMA node at its
+//     maximum size, by splitPenalty.
+//
+// The annotation is only as accurate as whatever reports it, so we don't track our own
+// reservations against individual NUMA nodes.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+type topologyConfig struct {
+	// RequireSingleNUMANode, if true, rejects nodes where no single NUMA node has enough free
+	// hugepages for a pod that requests them. Nodes without a reported topology aren't rejected.
+	RequireSingleNUMANode bool `json:"requireSingleNUMANode"`
+	// SplitPenalty is the fraction by which we reduce the score of a node where a VM at its maximum
+	// size wouldn't fit within a single NUMA node. It must be between 0 and 1.
+	SplitPenalty float64 `json:"splitPenalty"`
+}
+
+func (c *topologyConfig) validate() (string, error) {
+	if c.SplitPenalty < 0 || c.SplitPenalty > 1 {
+		return "splitPenalty", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	return "", nil
+}
+
+// numaTopologyFromNode returns the NUMA topology in the node's annotation, or nil if it's missing
+// or invalid
+func numaTopologyFromNode(logger *zap.Logger, node *corev1.Node) []api.NUMANode {
+	topologyJSON, ok := node.Annotations[api.AnnotationNUMATopology]
+	if !ok {
+		return nil
+	}
+
+	var topology []api.NUMANode
+	if err := json.Unmarshal([]byte(topologyJSON), &topology); err != nil {
+		logger.Warn("Ignoring invalid NUMA topology annotation on Node", zap.Error(err))
+		return nil
+	}
+	return topology
+}
+
+// handleNodeTopologyUpdated updates our stored NUMA topology for the node from its annotation
+func (e *AutoscaleEnforcer) handleNodeTopologyUpdated(logger *zap.Logger, node *corev1.Node) {
+	logger = logger.With(
+		zap.String("action", "Node topology updated"),
+		zap.String("node", node.Name),
+	)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	n, ok := e.state.nodes[node.Name]
+	if !ok {
+		// We'll read the annotation when we first build the node's state.
+		logger.Info("Node has not yet been processed, nothing to update")
+		return
+	}
+
+	n.numa = numaTopologyFromNode(logger, node)
+	logger.Info("Updated NUMA topology for node", zap.Int("numaNodes", len(n.numa)))
+}
+
+// podHugepages returns the amount of memory for each hugepage size requested by the pod
+func podHugepages(pod *corev1.Pod) map[corev1.ResourceName]resource.Quantity {
+	var hugepages map[corev1.ResourceName]resource.Quantity
+	for _, container := range pod.Spec.Containers {
+		for name, q := range container.Resources.Requests {
+			if !strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix) {
+				continue
+			}
+			if hugepages == nil {
+				hugepages = make(map[corev1.ResourceName]resource.Quantity)
+			}
+			total := hugepages[name]
+			total.Add(q)
+			hugepages[name] = total
+		}
+	}
+	return hugepages
+}
+
+// checkNodeHugepages returns a non-nil status if the node doesn't have enough unallocated hugepages
+// for the pod - or, if required by the config, doesn't have them all within a single NUMA node
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) checkNodeHugepages(
+	logger *zap.Logger,
+	pod *corev1.Pod,
+	nodeInfo *framework.NodeInfo,
+	node *nodeState,
+) *framework.Status {
+	requested := podHugepages(pod)
+	if len(requested) == 0 {
+		return nil
+	}
+
+	for size, q := range requested {
+		var used resource.Quantity
+		for _, podInfo := range nodeInfo.Pods {
+			if util.PodCompleted(podInfo.Pod) {
+				continue
+			}
+			if u, ok := podHugepages(podInfo.Pod)[size]; ok {
+				used.Add(u)
+			}
+		}
+
+		allocatable := nodeInfo.Node().Status.Allocatable[size]
+		if used.Value()+q.Value() > allocatable.Value() {
+			logger.Warn(
+				"Rejecting Pod: not enough hugepages on node",
+				zap.String("size", string(size)),
+				zap.String("requested", q.String()),
+				zap.String("used", used.String()),
+				zap.String("allocatable", allocatable.String()),
+			)
+			return framework.NewStatus(
+				framework.Unschedulable,
+				fmt.Sprintf("Not enough %s: node usage %s + pod %s > node allocatable %s", size, &used, &q, &allocatable),
+			)
+		}
+	}
+
+	topologyConf := e.state.conf.NodeConfig.Topology
+	if topologyConf != nil && topologyConf.RequireSingleNUMANode && node.numa != nil {
+		if _, ok := numaNodeWithHugepages(node.numa, requested); !ok {
+			logger.Warn("Rejecting Pod: no single NUMA node has enough free hugepages")
+			return framework.NewStatus(framework.Unschedulable, "No single NUMA node has enough free hugepages for pod")
+		}
+	}
+
+	return nil
+}
+
+// numaNodeWithHugepages returns the ID of the first NUMA node with enough free hugepages of each
+// size, if there is one
+func numaNodeWithHugepages(numa []api.NUMANode, requested map[corev1.ResourceName]resource.Quantity) (int, bool) {
+	for _, n := range numa {
+		fits := true
+		for size, q := range requested {
+			free := n.Free[size]
+			if free.Cmp(q) < 0 {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return n.ID, true
+		}
+	}
+	return 0, false
+}
+
+// fitsSingleNUMANode returns whether the node has a NUMA node that can hold the pod's VM at its
+// maximum size, including any hugepages it requests
+func fitsSingleNUMANode(numa []api.NUMANode, vmInfo *api.VmInfo, pod *corev1.Pod) bool {
+	requested := podHugepages(pod)
+	maxSize := vmInfo.Max()
+
+	for _, n := range numa {
+		if n.Capacity.Cpu().MilliValue() < int64(maxSize.VCPU) || n.Capacity.Memory().Value() < int64(maxSize.Mem) {
+			continue
+		}
+		if _, ok := numaNodeWithHugepages([]api.NUMANode{n}, requested); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTopologyPenalty returns the score for the node after taking its NUMA topology into account
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) applyTopologyPenalty(
+	logger *zap.Logger,
+	score int64,
+	vmInfo *api.VmInfo,
+	pod *corev1.Pod,
+	node *nodeState,
+) int64 {
+	topologyConf := e.state.conf.NodeConfig.Topology
+	if topologyConf == nil || node.numa == nil || vmInfo == nil || fitsSingleNUMANode(node.numa, vmInfo, pod) {
+		return score
+	}
+
+	// Never go down to the minimum score, which we use to signal that the pod doesn't fit at all.
+	penalized := util.Min(score, util.Max(framework.MinNodeScore+1, score-int64(float64(score)*topologyConf.SplitPenalty)))
+	logger.Info(
+		"VM would not fit within a single NUMA node, reducing score",
+		zap.Int64("score", score),
+		zap.Int64("penalizedScore", penalized),
+	)
+	return penalized
+}
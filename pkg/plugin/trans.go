@@ -112,6 +112,8 @@ func (r resourceTransitioner[T]) handleReserve() (overbudget bool, verdict strin
 			forceApprovalMinimum: requested,
 			// only used for migrations
 			convertIncreaseIntoPressure: false,
+			// new pods are admitted regardless of priority; that's up to the Filter method.
+			headroom: 0,
 			// Yes, add buffer, because this is for reserving a pod for the first time. If the pod
 			// was already known, it's the caller's responsibility to set buffer appropriately.
 			addBuffer: true,
@@ -125,6 +127,12 @@ func (r resourceTransitioner[T]) handleReserve() (overbudget bool, verdict strin
 		},
 	)
 
+	// Unused ballast isn't real usage, so give up whatever's needed to fit the pod before checking.
+	// If the pod is rejected, the caller reverts this along with the rest.
+	if reclaimed := r.reclaimExcessBallast(); reclaimed != 0 {
+		verdict = fmt.Sprintf("%s; reclaimed %v from ballast -> %v [granted %v]", verdict, reclaimed, r.node.Ballast, r.node.BallastGranted)
+	}
+
 	overbudget = r.node.Reserved > r.node.Total
 
 	return overbudget, verdict
@@ -133,7 +141,8 @@ func (r resourceTransitioner[T]) handleReserve() (overbudget bool, verdict strin
 // handleRequested updates r.pod and r.node with changes to match the requested resources, within
 // what's possible given the remaining resources.
 //
-// Any permitted increases are required to be a multiple of factor.
+// Any permitted increases are required to be a multiple of factor, and may not use the last
+// headroom of the node's resources.
 //
 // Unlike handleReserve, this method should be called to update the resources for a preexisting pod
 // on the node.
@@ -144,6 +153,7 @@ func (r resourceTransitioner[T]) handleRequested(
 	lastPermit *T,
 	startingMigration bool,
 	factor T,
+	headroom T,
 ) (verdict string) {
 	normalVerdictCallback := func(oldState, newState resourceState[T]) string {
 		fmtString := "Register %d%s -> %d%s (pressure %d -> %d); " +
@@ -203,6 +213,7 @@ func (r resourceTransitioner[T]) handleRequested(
 			// But we _will_ add the pod's request to the node's pressure, noting that its migration
 			// will resolve it.
 			convertIncreaseIntoPressure: startingMigration,
+			headroom:                    headroom,
 			// don't add buffer to the node; autoscaler-agent requests should reset it.
 			addBuffer: false,
 
@@ -240,6 +251,10 @@ type requestedOptions[T constraints.Unsigned] struct {
 	// the Pod and Node.
 	convertIncreaseIntoPressure bool
 
+	// headroom is the amount of the node's resources that increases may not use, so that they're
+	// left for VMs with higher priority. See priority.go for more.
+	headroom T
+
 	// addBuffer causes handleRequestedGeneric() to additionally add the pod's Buffer field to the
 	// node, under the assumption that the Buffer is completely new.
 	//
@@ -305,7 +320,7 @@ func (r resourceTransitioner[T]) handleRequestedGeneric(
 
 		// note: it's entirely possible to have Reserved > Total, under a variety of
 		// undesirable-but-impossible-to-prevent circumstances.
-		remainingReservable := util.SaturatingSub(r.node.Total, r.node.Reserved)
+		remainingReservable := util.SaturatingSub(util.SaturatingSub(r.node.Total, opts.headroom), r.node.Reserved)
 
 		increase := requested - r.pod.Reserved
 
@@ -351,6 +366,8 @@ func (r resourceTransitioner[T]) handleRequestedGeneric(
 //
 // A pretty-formatted summary of the changes is returned as the verdict, for logging.
 func (r resourceTransitioner[T]) handleDeleted(currentlyMigrating bool) (verdict string) {
+	r.releaseBallastGrant()
+	r.releaseLease()
 	oldState := r.snapshotState()
 
 	r.node.Reserved -= r.pod.Reserved
@@ -401,6 +418,8 @@ func (r resourceTransitioner[T]) handleNonAutoscalingUsageChange(newUsage T) (ve
 //
 // A pretty-formatted summary of the changes is returned as the verdict, for logging.
 func (r resourceTransitioner[T]) handleAutoscalingDisabled() (verdict string) {
+	r.releaseBallastGrant()
+	r.releaseLease()
 	oldState := r.snapshotState()
 
 	// buffer is included in reserved, so we reduce everything by buffer.
@@ -442,6 +461,8 @@ func (r resourceTransitioner[T]) handleStartMigration(source bool) (verdict stri
 	// node's PressureAccountedFor because any pressure generated by the pod will be resolved once
 	// the migration completes and the pod gets deleted.
 
+	r.releaseBallastGrant()
+	r.releaseLease()
 	oldState := r.snapshotState()
 
 	buffer := r.pod.Buffer
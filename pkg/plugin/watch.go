@@ -21,11 +21,12 @@ import (
 )
 
 type nodeWatchCallbacks struct {
-	submitNodeDeletion func(*zap.Logger, string)
+	submitNodeDeletion        func(*zap.Logger, string)
+	submitNodeTopologyUpdated func(*zap.Logger, *corev1.Node)
 }
 
 // watchNodeEvents watches for any deleted Nodes, so that we can clean up the resources that were
-// associated with them.
+// associated with them, and for changes to Nodes' NUMA topology annotations.
 func (e *AutoscaleEnforcer) watchNodeEvents(
 	ctx context.Context,
 	parentLogger *zap.Logger,
@@ -54,6 +55,12 @@ func (e *AutoscaleEnforcer) watchNodeEvents(
 		watch.InitModeSync, // Doesn't matter because AddFunc is nil and node store is only used for events.
 		metav1.ListOptions{},
 		watch.HandlerFuncs[*corev1.Node]{
+			UpdateFunc: func(oldNode, newNode *corev1.Node) {
+				if oldNode.Annotations[api.AnnotationNUMATopology] != newNode.Annotations[api.AnnotationNUMATopology] {
+					logger.Info("Received update event for node NUMA topology", zap.String("node", newNode.Name))
+					callbacks.submitNodeTopologyUpdated(logger, newNode)
+				}
+			},
 			DeleteFunc: func(node *corev1.Node, mayBeStale bool) {
 				logger.Info("Received delete event for node", zap.String("node", node.Name))
 				callbacks.submitNodeDeletion(logger, node.Name)
@@ -0,0 +1,139 @@
+package plugin
+
+// "Would fit" endpoint: dry-run scheduling of a proposed VM
+//
+// External provisioning systems can ask whether a VM with the given resources would fit on any
+// node right now, so that they can fail fast instead of creating a VM that can't be scheduled.
+//
+// This only considers the resources that we track, using the same check as Filter. Other
+// constraints that may prevent scheduling (e.g. taints, affinity, or node capabilities) aren't
+// taken into account, and nothing is reserved - so the answer may be out of date by the time the
+// VM is actually created.
+//
+// The same server also serves the "simulate" endpoint, which additionally gives each node's score.
+// See simulate.go.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+type wouldFitConfig struct {
+	// Port is the port to serve the "would fit" endpoint on
+	Port uint16 `json:"port"`
+}
+
+func (c *wouldFitConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (e *AutoscaleEnforcer) startWouldFitServer(ctx context.Context, logger *zap.Logger) error {
+	// Manually start the TCP listener so we can minimize errors in the background thread.
+	addr := net.TCPAddr{IP: net.IPv4zero, Port: int(e.state.conf.WouldFit.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	mux := http.NewServeMux()
+	util.AddHandler(logger, mux, "/would-fit", http.MethodPost, "WouldFitRequest", e.handleWouldFit)
+	util.AddHandler(logger, mux, "/simulate", http.MethodPost, "SimulateRequest", e.handleSimulate)
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("would-fit server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (e *AutoscaleEnforcer) handleWouldFit(
+	ctx context.Context,
+	logger *zap.Logger,
+	req *api.WouldFitRequest,
+) (*api.WouldFitResponse, int, error) {
+	if req.Use.VCPU == 0 || req.Use.Mem == 0 {
+		return nil, 400, errors.New("use.vCPUs and use.mem must be > 0")
+	}
+
+	selector := labels.SelectorFromSet(req.NodeSelector)
+	nodes := e.nodeStore.Items()
+
+	if err := e.state.lock.TryLock(ctx); err != nil {
+		return nil, 500, errclass.Errorf(errclass.TransientInfra, "could not acquire state lock: %w", err)
+	}
+	defer e.state.lock.Unlock()
+
+	resp := &api.WouldFitResponse{Fits: false, Nodes: []api.WouldFitNode{}}
+	for _, node := range nodes {
+		if node.Spec.Unschedulable || !selector.Matches(labels.Set(node.Labels)) || !nodeIsReady(node) {
+			continue
+		}
+
+		state, err := e.state.getOrFetchNodeState(ctx, logger, e.metrics, e.nodeStore, node.Name)
+		if err != nil {
+			logger.Warn("Error getting node state, skipping node", zap.String("node", node.Name), zap.Error(err))
+			continue
+		}
+
+		remaining := api.Resources{
+			VCPU: state.remainingReservableCPU(),
+			Mem:  state.remainingReservableMem(),
+		}
+		if req.Use.VCPU > remaining.VCPU || req.Use.Mem > remaining.Mem {
+			continue
+		}
+
+		resp.Nodes = append(resp.Nodes, api.WouldFitNode{
+			Name:      node.Name,
+			Remaining: remaining,
+			FitsMax:   req.Max != nil && req.Max.VCPU <= remaining.VCPU && req.Max.Mem <= remaining.Mem,
+		})
+	}
+
+	slices.SortFunc(resp.Nodes, func(a, b api.WouldFitNode) bool {
+		return a.Name < b.Name
+	})
+	resp.Fits = len(resp.Nodes) != 0
+
+	logger.Info(
+		"Responding to would-fit request",
+		zap.Object("use", req.Use),
+		zap.Bool("fits", resp.Fits),
+		zap.Int("nodes", len(resp.Nodes)),
+	)
+	return resp, 200, nil
+}
+
+// nodeIsReady returns whether the node's Ready condition is true
+func nodeIsReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
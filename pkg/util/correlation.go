@@ -0,0 +1,47 @@
+package util
+
+// Correlation IDs for scaling transactions
+//
+// The autoscaler-agent assigns a correlation ID to each scaling attempt, which is then passed along
+// to the scheduler plugin, vm-monitor, and NeonVM controller, so that the logs for a single
+// transaction can be found across all of them.
+
+import (
+	"context"
+
+	"github.com/lithammer/shortuuid"
+	"go.uber.org/zap"
+)
+
+// CorrelationIDLogKey is the key that correlation IDs are logged with, in every component.
+const CorrelationIDLogKey = "correlationID"
+
+type correlationIDContextKey struct{}
+
+// NewCorrelationID returns a new random correlation ID
+func NewCorrelationID() string {
+	return shortuuid.New()
+}
+
+// WithCorrelationID returns a copy of the context carrying the correlation ID, if it's not empty.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationIDContextKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID in the context, or "" if there isn't one.
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDContextKey{}).(string)
+	return id
+}
+
+// LoggerWithCorrelationID returns the logger with the correlation ID added as a field, or the
+// logger unchanged if the ID is empty.
+func LoggerWithCorrelationID(logger *zap.Logger, id string) *zap.Logger {
+	if id == "" {
+		return logger
+	}
+	return logger.With(zap.String(CorrelationIDLogKey, id))
+}
@@ -0,0 +1,163 @@
+package util
+
+// Minimal parsing & evaluation of cron expressions
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed standard 5-field cron expression: minute, hour, day of month, month,
+// and day of week.
+//
+// Each field may be '*', a number, a range 'a-b', or a list of these separated by commas. Ranges
+// and '*' may have a step, e.g. '*/15' or '9-17/2'. Names (e.g. 'MON' or 'JAN') are not supported.
+// Day of week is 0-6, starting from Sunday; 7 is also accepted as Sunday.
+//
+// As with other cron implementations, if both day of month and day of week are restricted (i.e.
+// not '*'), a day matches if it matches either one.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	domRestricted, dowRestricted bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// ParseCron parses a standard 5-field cron expression. Refer to CronSchedule for the supported
+// syntax.
+func ParseCron(expr string) (CronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return CronSchedule{}, fmt.Errorf("expected %d fields, got %d", len(cronFields), len(parts))
+	}
+
+	var bits [5]uint64
+	for i, f := range cronFields {
+		var err error
+		if bits[i], err = parseCronField(parts[i], f); err != nil {
+			return CronSchedule{}, fmt.Errorf("invalid %s field %q: %w", f.name, parts[i], err)
+		}
+	}
+
+	// 7 is Sunday, same as 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = (bits[4] | 1) &^ (1 << 7)
+	}
+
+	return CronSchedule{
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		var start, end int
+		if rangePart == "*" {
+			start, end = f.min, f.max
+		} else if low, high, isRange := strings.Cut(rangePart, "-"); isRange {
+			var err error
+			if start, err = strconv.Atoi(low); err != nil {
+				return 0, fmt.Errorf("invalid value %q", low)
+			}
+			if end, err = strconv.Atoi(high); err != nil {
+				return 0, fmt.Errorf("invalid value %q", high)
+			}
+		} else {
+			var err error
+			if start, err = strconv.Atoi(rangePart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			if hasStep {
+				return 0, errors.New("step is only allowed with '*' or a range")
+			}
+			end = start
+		}
+
+		if start < f.min || end > f.max {
+			return 0, fmt.Errorf("value out of range %d-%d", f.min, f.max)
+		} else if start > end {
+			return 0, fmt.Errorf("invalid range %d-%d", start, end)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (s CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<t.Day()) != 0
+	dowMatch := s.dow&(1<<int(t.Weekday())) != 0
+
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// LastAtOrBefore returns the latest time at or before t (truncated to the minute) that matches the
+// schedule, evaluated in t's location. Only times after t-within are considered; if there are
+// none, LastAtOrBefore returns false.
+func (s CronSchedule) LastAtOrBefore(t time.Time, within time.Duration) (time.Time, bool) {
+	earliest := t.Add(-within)
+	loc := t.Location()
+
+	// Walk backwards, skipping over entire months, days, and hours that don't match.
+	cur := t.Truncate(time.Minute)
+	for cur.After(earliest) {
+		var next time.Time
+		switch {
+		case s.month&(1<<int(cur.Month())) == 0:
+			next = time.Date(cur.Year(), cur.Month(), 1, 0, 0, 0, 0, loc).Add(-time.Minute)
+		case !s.matchesDay(cur):
+			next = time.Date(cur.Year(), cur.Month(), cur.Day(), 0, 0, 0, 0, loc).Add(-time.Minute)
+		case s.hour&(1<<cur.Hour()) == 0:
+			next = time.Date(cur.Year(), cur.Month(), cur.Day(), cur.Hour(), 0, 0, 0, loc).Add(-time.Minute)
+		case s.minute&(1<<cur.Minute()) == 0:
+			next = cur.Add(-time.Minute)
+		default:
+			return cur, true
+		}
+
+		// Around DST transitions, the start of the hour or day might not be before cur.
+		if !next.Before(cur) {
+			next = cur.Add(-time.Minute)
+		}
+		cur = next
+	}
+
+	return time.Time{}, false
+}
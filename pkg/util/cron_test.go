@@ -0,0 +1,100 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"5/2 * * * *",
+		"MON * * * *",
+	}
+	for _, c := range cases {
+		_, err := util.ParseCron(c)
+		assert.Error(t, err, "expression %q", c)
+	}
+}
+
+func TestCronLastAtOrBefore(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, time.May, 15, 12, 34, 56, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		within   time.Duration
+		expected *time.Time
+	}{
+		{
+			expr:     "* * * * *",
+			within:   time.Minute,
+			expected: lo.ToPtr(time.Date(2024, time.May, 15, 12, 34, 0, 0, time.UTC)),
+		},
+		{
+			expr:     "0 9 * * 1-5",
+			within:   8 * time.Hour,
+			expected: lo.ToPtr(time.Date(2024, time.May, 15, 9, 0, 0, 0, time.UTC)),
+		},
+		{
+			expr:     "0 9 * * 1-5",
+			within:   3 * time.Hour,
+			expected: nil,
+		},
+		{
+			// Only on weekends, so the last time was the previous Sunday
+			expr:     "30 23 * * 0,6",
+			within:   7 * 24 * time.Hour,
+			expected: lo.ToPtr(time.Date(2024, time.May, 12, 23, 30, 0, 0, time.UTC)),
+		},
+		{
+			// 7 is also Sunday
+			expr:     "30 23 * * 7",
+			within:   7 * 24 * time.Hour,
+			expected: lo.ToPtr(time.Date(2024, time.May, 12, 23, 30, 0, 0, time.UTC)),
+		},
+		{
+			// day of month or day of week
+			expr:     "0 0 1 * 1",
+			within:   7 * 24 * time.Hour,
+			expected: lo.ToPtr(time.Date(2024, time.May, 13, 0, 0, 0, 0, time.UTC)),
+		},
+		{
+			expr:     "*/20 10-14/2 * 5 *",
+			within:   24 * time.Hour,
+			expected: lo.ToPtr(time.Date(2024, time.May, 15, 12, 20, 0, 0, time.UTC)),
+		},
+		{
+			expr:     "0 0 1 1 *",
+			within:   7 * 24 * time.Hour,
+			expected: nil,
+		},
+	}
+
+	for _, c := range cases {
+		cron, err := util.ParseCron(c.expr)
+		require.NoError(t, err, "expression %q", c.expr)
+
+		last, ok := cron.LastAtOrBefore(now, c.within)
+		if c.expected == nil {
+			assert.False(t, ok, "expression %q", c.expr)
+		} else {
+			assert.True(t, ok, "expression %q", c.expr)
+			assert.Equal(t, *c.expected, last, "expression %q", c.expr)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package dumpstore periodically uploads compressed dump-state snapshots to object storage, so that
+// the internal state of the autoscaler-agent and scheduler plugin can be reconstructed after an
+// incident, without needing to have had a port-forward open at the time.
+//
+// Each snapshot is a gzip-compressed stream of newline-delimited JSON documents: first a header
+// (see Header), followed by the state dump itself.
+package dumpstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/zap"
+)
+
+// Config configures where and how often to upload snapshots
+type Config struct {
+	Bucket         string `json:"bucket"`
+	Region         string `json:"region"`
+	PrefixInBucket string `json:"prefixInBucket"`
+	// Endpoint, if not empty, overrides the default S3 endpoint (e.g. for minio)
+	Endpoint string `json:"endpoint"`
+
+	// IntervalSeconds, if not zero, gives the period between snapshots. Snapshots are also taken
+	// whenever the process receives SIGUSR1.
+	IntervalSeconds uint `json:"intervalSeconds"`
+	// TimeoutSeconds gives the maximum duration, in seconds, allowed for collecting and uploading a
+	// single snapshot.
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+	// RetentionHours gives the age, in hours, after which our snapshots are deleted.
+	RetentionHours uint `json:"retentionHours"`
+}
+
+func (c *Config) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("bucket cannot be empty")
+	} else if c.Region == "" {
+		return errors.New("region cannot be empty")
+	} else if c.PrefixInBucket == "" {
+		return errors.New("prefixInBucket cannot be empty")
+	} else if c.TimeoutSeconds == 0 {
+		return errors.New("timeoutSeconds must be > 0")
+	} else if c.RetentionHours == 0 {
+		return errors.New("retentionHours must be > 0")
+	}
+	return nil
+}
+
+// Header is the first document in each snapshot
+type Header struct {
+	Component string    `json:"component"`
+	Hostname  string    `json:"hostname"`
+	Time      time.Time `json:"time"`
+	// Trigger is the reason the snapshot was taken: either "interval" or "signal"
+	Trigger string `json:"trigger"`
+}
+
+type uploader[T any] struct {
+	cfg       Config
+	client    *s3.Client
+	component string
+	hostname  string
+	dump      func(context.Context) (T, error)
+}
+
+// Start begins uploading snapshots in the background, until ctx is canceled.
+//
+// The component name is used in the object keys, so that snapshots from different components can
+// share a bucket and prefix.
+func Start[T any](
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg Config,
+	component string,
+	dump func(context.Context) (T, error),
+) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Error getting hostname: %w", err)
+	}
+
+	// Timeout in case we have hidden IO inside config creation
+	loadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	s3Config, err := awsconfig.LoadDefaultConfig(loadCtx, awsconfig.WithRegion(cfg.Region))
+	if err != nil {
+		return fmt.Errorf("Error loading S3 config: %w", err)
+	}
+
+	u := &uploader[T]{
+		cfg: cfg,
+		client: s3.NewFromConfig(s3Config, func(o *s3.Options) {
+			if cfg.Endpoint != "" {
+				o.BaseEndpoint = &cfg.Endpoint
+			}
+			o.UsePathStyle = true // required for minio
+		}),
+		component: component,
+		hostname:  hostname,
+		dump:      dump,
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go u.run(ctx, logger, signals)
+	return nil
+}
+
+func (u *uploader[T]) run(ctx context.Context, logger *zap.Logger, signals chan os.Signal) {
+	defer signal.Stop(signals)
+
+	// A nil channel never receives, so without an interval we only upload on SIGUSR1
+	var tick <-chan time.Time
+	if u.cfg.IntervalSeconds != 0 {
+		ticker := time.NewTicker(time.Duration(u.cfg.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		var trigger string
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			trigger = "interval"
+		case <-signals:
+			trigger = "signal"
+		}
+
+		if err := u.upload(ctx, logger, trigger); err != nil {
+			logger.Error("Failed to upload dump-state snapshot", zap.String("trigger", trigger), zap.Error(err))
+		}
+		if err := u.deleteExpired(ctx, logger); err != nil {
+			logger.Warn("Failed to delete expired dump-state snapshots", zap.Error(err))
+		}
+	}
+}
+
+// prefix returns the prefix shared by all of this host's snapshots
+func (u *uploader[T]) prefix() string {
+	return fmt.Sprintf("%s/%s/%s/", u.cfg.PrefixInBucket, u.component, u.hostname)
+}
+
+// encode collects the current state and returns the compressed snapshot
+func (u *uploader[T]) encode(ctx context.Context, now time.Time, trigger string) ([]byte, error) {
+	header := Header{
+		Component: u.component,
+		Hostname:  u.hostname,
+		Time:      now,
+		Trigger:   trigger,
+	}
+
+	state, err := u.dump(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error dumping state: %w", err)
+	}
+
+	buf := bytes.Buffer{}
+	gzW := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gzW)
+	if err := enc.Encode(&header); err != nil {
+		return nil, fmt.Errorf("Error encoding header: %w", err)
+	}
+	if err := enc.Encode(&state); err != nil {
+		return nil, fmt.Errorf("Error encoding state: %w", err)
+	}
+	if err := gzW.Close(); err != nil { // Have to close it before reading the buffer
+		return nil, fmt.Errorf("Error compressing snapshot: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (u *uploader[T]) upload(ctx context.Context, logger *zap.Logger, trigger string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(u.cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	payload, err := u.encode(ctx, now, trigger)
+	if err != nil {
+		return err
+	}
+
+	// Example: prefixInBucket/scheduler/some-host/2024-01-26T15:04:05Z.ndjson.gz
+	key := u.prefix() + now.Format("2006-01-02T15:04:05Z") + ".ndjson.gz"
+	_, err = u.client.PutObject(ctx, &s3.PutObjectInput{ //nolint:exhaustruct // AWS SDK
+		Bucket: &u.cfg.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(payload),
+	})
+	if err != nil {
+		return fmt.Errorf("Error uploading object: %w", err)
+	}
+
+	logger.Info("Uploaded dump-state snapshot", zap.String("key", key), zap.Int("bytes", len(payload)))
+	return nil
+}
+
+// deleteExpired removes this host's snapshots that are older than the retention period
+func (u *uploader[T]) deleteExpired(ctx context.Context, logger *zap.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(u.cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	cutoff := time.Now().Add(-time.Duration(u.cfg.RetentionHours) * time.Hour)
+	prefix := u.prefix()
+
+	var expired []s3types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(u.client, &s3.ListObjectsV2Input{ //nolint:exhaustruct // AWS SDK
+		Bucket: &u.cfg.Bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("Error listing objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified != nil && obj.LastModified.Before(cutoff) {
+				expired = append(expired, s3types.ObjectIdentifier{Key: obj.Key}) //nolint:exhaustruct // AWS SDK
+			}
+		}
+	}
+
+	// DeleteObjects accepts at most 1000 keys per request
+	const maxKeysPerDelete = 1000
+	for len(expired) != 0 {
+		batch := expired[:min(len(expired), maxKeysPerDelete)]
+		expired = expired[len(batch):]
+
+		_, err := u.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{ //nolint:exhaustruct // AWS SDK
+			Bucket: &u.cfg.Bucket,
+			Delete: &s3types.Delete{Objects: batch}, //nolint:exhaustruct // AWS SDK
+		})
+		if err != nil {
+			return fmt.Errorf("Error deleting objects: %w", err)
+		}
+
+		logger.Info("Deleted expired dump-state snapshots", zap.Int("count", len(batch)))
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+// Package errclass classifies errors by their cause, so that the controller, autoscaler-agent, and
+// scheduler plugin can report errors consistently, and alerts can be routed by class instead of by
+// matching on error strings.
+//
+// The class is attached to an error with Wrap (or Errorf), and retrieved with Of. Errors that
+// weren't explicitly classified are given a best guess based on their type.
+package errclass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/status"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Class is the category of an error. The string value is suitable for use as a metrics label.
+type Class string
+
+const (
+	// UserError means the error was caused by invalid input or configuration from the user, like a
+	// VirtualMachine referencing something that doesn't exist. Retrying won't help until the user
+	// makes a change.
+	UserError Class = "user_error"
+	// Capacity means that there weren't enough resources available, e.g. on the node or in a quota.
+	Capacity Class = "capacity"
+	// TransientInfra means that a dependency was temporarily unavailable or too slow, or there was
+	// a conflicting concurrent change. Retrying will probably succeed.
+	TransientInfra Class = "transient_infra"
+	// Bug means that something happened that shouldn't be possible, e.g. components disagreeing
+	// about the protocol. Errors that we can't otherwise classify are also treated as bugs.
+	Bug Class = "bug"
+)
+
+// AllClasses lists every Class, e.g. for initializing metrics
+var AllClasses = []Class{UserError, Capacity, TransientInfra, Bug}
+
+// HTTPHeader is the header that HTTP servers set on error responses to give the error's class
+const HTTPHeader = "X-Error-Class"
+
+// EventAnnotation is the annotation added to Kubernetes events about errors, giving the error's
+// class
+const EventAnnotation = "autoscaling.neon.tech/error-class"
+
+// Reason returns the class in the form used for Kubernetes event and condition reasons, e.g.
+// "UserError" for UserError.
+func (c Class) Reason() string {
+	switch c {
+	case UserError:
+		return "UserError"
+	case Capacity:
+		return "Capacity"
+	case TransientInfra:
+		return "TransientInfra"
+	default:
+		return "Bug"
+	}
+}
+
+type classifiedError struct {
+	class Class
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Wrap returns an error with the same message as err, classified as class.
+//
+// If err is nil, Wrap returns nil.
+func Wrap(class Class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// Errorf is shorthand for Wrap(class, fmt.Errorf(format, args...))
+func Errorf(class Class, format string, args ...any) error {
+	return Wrap(class, fmt.Errorf(format, args...))
+}
+
+// Of returns the class of the error.
+//
+// If any error in the chain was classified with Wrap, the outermost classification is used.
+// Failing that, a class attached to a gRPC status by GRPCStatus is used.
+//
+// Otherwise, the class is guessed from the type of the error: Kubernetes API errors are classified
+// by their status, and timeouts and network errors are transient. Anything else is a Bug.
+//
+// Of returns the empty string if err is nil.
+func Of(err error) Class {
+	if err == nil {
+		return ""
+	}
+
+	var c *classifiedError
+	if errors.As(err, &c) {
+		return c.class
+	}
+
+	// Errors returned by our gRPC servers carry the class they were given there.
+	if st, ok := status.FromError(err); ok {
+		if class, attached := FromGRPCStatus(st); attached {
+			return class
+		}
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return TransientInfra
+	case apierrors.IsConflict(err), apierrors.IsAlreadyExists(err), apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err), apierrors.IsTooManyRequests(err), apierrors.IsServiceUnavailable(err):
+		return TransientInfra
+	case apierrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota"):
+		return Capacity
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err), apierrors.IsNotFound(err),
+		apierrors.IsForbidden(err):
+		return UserError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return TransientInfra
+	}
+
+	return Bug
+}
+
+// FromHTTPResponse returns the class of an error response, using the value of HTTPHeader if it's
+// present, and otherwise guessing from the status code.
+func FromHTTPResponse(resp *http.Response) Class {
+	if c := Class(resp.Header.Get(HTTPHeader)); slices.Contains(AllClasses, c) {
+		return c
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return TransientInfra
+	default:
+		return Bug
+	}
+}
@@ -0,0 +1,92 @@
+package errclass_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
+)
+
+func TestOf(t *testing.T) {
+	podResource := schema.GroupResource{Group: "", Resource: "pods"}
+
+	cases := []struct {
+		name     string
+		err      error
+		expected errclass.Class
+	}{
+		{"nil", nil, ""},
+		{"unclassified", errors.New("oops"), errclass.Bug},
+		{"wrapped", errclass.Wrap(errclass.Capacity, errors.New("full")), errclass.Capacity},
+		{"errorf", errclass.Errorf(errclass.UserError, "bad %s", "input"), errclass.UserError},
+		{
+			"outermost wins",
+			errclass.Wrap(errclass.Bug, fmt.Errorf("context: %w", errclass.Wrap(errclass.UserError, errors.New("inner")))),
+			errclass.Bug,
+		},
+		{
+			"classification survives wrapping",
+			fmt.Errorf("context: %w", errclass.Wrap(errclass.TransientInfra, errors.New("inner"))),
+			errclass.TransientInfra,
+		},
+		{"deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), errclass.TransientInfra},
+		{"conflict", apierrors.NewConflict(podResource, "foo", errors.New("changed")), errclass.TransientInfra},
+		{"not found", apierrors.NewNotFound(podResource, "foo"), errclass.UserError},
+		{"quota", apierrors.NewForbidden(podResource, "foo", errors.New("exceeded quota: compute")), errclass.Capacity},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, errclass.Of(c.err))
+		})
+	}
+
+	assert.Nil(t, errclass.Wrap(errclass.Bug, nil))
+}
+
+func TestFromHTTPResponse(t *testing.T) {
+	withHeader := &http.Response{StatusCode: 400, Header: http.Header{}}
+	withHeader.Header.Set(errclass.HTTPHeader, string(errclass.UserError))
+	assert.Equal(t, errclass.UserError, errclass.FromHTTPResponse(withHeader))
+
+	unavailable := &http.Response{StatusCode: 503, Header: http.Header{}}
+	assert.Equal(t, errclass.TransientInfra, errclass.FromHTTPResponse(unavailable))
+
+	unknown := &http.Response{StatusCode: 500, Header: http.Header{}}
+	unknown.Header.Set(errclass.HTTPHeader, "something-else")
+	assert.Equal(t, errclass.Bug, errclass.FromHTTPResponse(unknown))
+}
+
+func TestFromGRPCStatus(t *testing.T) {
+	withClass := errclass.GRPCStatus(codes.NotFound, errclass.TransientInfra, "pod not found")
+	class, attached := errclass.FromGRPCStatus(withClass)
+	assert.Equal(t, errclass.TransientInfra, class)
+	assert.True(t, attached)
+	assert.Equal(t, codes.NotFound, withClass.Code())
+	assert.Equal(t, "pod not found", withClass.Message())
+
+	// The class survives the status being sent as an error, and wrapped
+	err := fmt.Errorf("Error receiving response: %w", withClass.Err())
+	assert.Equal(t, errclass.TransientInfra, errclass.Of(err))
+
+	class, attached = errclass.FromGRPCStatus(status.New(codes.Unavailable, "connection refused"))
+	assert.Equal(t, errclass.TransientInfra, class)
+	assert.False(t, attached)
+
+	class, attached = errclass.FromGRPCStatus(status.New(codes.Internal, "oops"))
+	assert.Equal(t, errclass.Bug, class)
+	assert.False(t, attached)
+
+	// Without an attached class, Of guesses as usual
+	assert.Equal(t, errclass.Bug, errclass.Of(status.Error(codes.Unavailable, "connection refused")))
+}
@@ -0,0 +1,48 @@
+package errclass
+
+// Passing error classes over gRPC
+
+import (
+	"slices"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCErrorDomain is the domain of the errdetails.ErrorInfo that gRPC servers attach to error
+// statuses to give the error's class - the gRPC equivalent of HTTPHeader. The class is the
+// ErrorInfo's reason.
+const GRPCErrorDomain = "autoscaling.neon.tech"
+
+// GRPCStatus returns a status with the code and message, with the class attached in its details
+func GRPCStatus(code codes.Code, class Class, msg string) *status.Status {
+	st := status.New(code, msg)
+	withClass, err := st.WithDetails(&errdetails.ErrorInfo{Reason: string(class), Domain: GRPCErrorDomain, Metadata: nil})
+	if err != nil {
+		// Only possible if code is OK, which isn't an error anyway.
+		return st
+	}
+	return withClass
+}
+
+// FromGRPCStatus returns the class of an error status, using the class attached by GRPCStatus if
+// it's present, and otherwise guessing from the status code.
+//
+// It also returns whether the class was attached, which means that the error came from the
+// server's handler, rather than from gRPC itself (e.g. because the server was unreachable).
+func FromGRPCStatus(st *status.Status) (_ Class, attached bool) {
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if ok && info.Domain == GRPCErrorDomain && slices.Contains(AllClasses, Class(info.Reason)) {
+			return Class(info.Reason), true
+		}
+	}
+
+	switch st.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Unavailable:
+		return TransientInfra, false
+	default:
+		return Bug, false
+	}
+}
@@ -0,0 +1,24 @@
+package util
+
+// Exemplars linking metrics to traces
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ObserveWithTrace records the value in the observer, attaching the ID of the trace in the context
+// as an exemplar if there's a sampled span in it.
+//
+// Exemplars are only exposed when metrics are served in the OpenMetrics format, which
+// StartPrometheusMetricsServer enables.
+func ObserveWithTrace(ctx context.Context, o prometheus.Observer, value float64) {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && spanCtx.IsSampled() {
+		eo.ObserveWithExemplar(value, prometheus.Labels{"trace_id": spanCtx.TraceID().String()})
+		return
+	}
+	o.Observe(value)
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 
 	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util/errclass"
 )
 
 // AddHandler is a helper function to wrap the handle function with JSON [de]serialization and check
@@ -75,6 +77,7 @@ func AddHandler[T any, R any](
 			}
 			respBodyFormatted = zap.NamedError("response", err)
 			respBody = []byte(err.Error())
+			w.Header().Set(errclass.HTTPHeader, string(errclass.Of(err)))
 		} else {
 			if status == 0 {
 				hlogger.Warn("non-error response with status = 0")
@@ -30,7 +30,7 @@ func StartPrometheusMetricsServer(ctx context.Context, logger *zap.Logger, port
 
 	shutdownCtx, shutdown := context.WithCancel(ctx)
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg, EnableOpenMetrics: true}))
 
 	baseContext := context.Background()
 	srv := &http.Server{Handler: mux, BaseContext: func(net.Listener) context.Context { return baseContext }}
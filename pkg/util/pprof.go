@@ -1,12 +1,20 @@
 package util
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/pprof"
 	"time"
 )
 
-func MakePPROF(addr string) *http.Server {
+// MakePPROF returns the debug server for a component, serving pprof's endpoints under
+// /debug/pprof/.
+//
+// If getConfig is not nil, the server also serves the component's effective configuration at
+// /config, as JSON. getConfig is called on each request, so that what's returned is whatever the
+// component is actually using - after defaults and any reloads - rather than what's in its
+// ConfigMap or flags.
+func MakePPROF(addr string, getConfig func() any) *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -14,6 +22,26 @@ func MakePPROF(addr string) *http.Server {
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	if getConfig != nil {
+		mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				_, _ = w.Write([]byte("request method must be GET"))
+				return
+			}
+
+			body, err := json.MarshalIndent(getConfig(), "", "  ")
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte("failed to marshal config: " + err.Error()))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(body)
+		})
+	}
+
 	return &http.Server{
 		Addr:              addr,
 		Handler:           mux,
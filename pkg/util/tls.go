@@ -0,0 +1,81 @@
+package util
+
+// Helpers for mutual TLS, shared between the autoscaler-agent and scheduler plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// MutualTLSConfig gives the paths to the files required for mutual TLS
+type MutualTLSConfig struct {
+	// CertFile is the path to the PEM-encoded certificate for this side of the connection
+	CertFile string `json:"certFile"`
+	// KeyFile is the path to the PEM-encoded private key for CertFile
+	KeyFile string `json:"keyFile"`
+	// CAFile is the path to the PEM-encoded CA bundle used to verify the other side's certificate
+	CAFile string `json:"caFile"`
+}
+
+func (c MutualTLSConfig) Validate() error {
+	if c.CertFile == "" {
+		return errors.New("certFile cannot be empty")
+	} else if c.KeyFile == "" {
+		return errors.New("keyFile cannot be empty")
+	} else if c.CAFile == "" {
+		return errors.New("caFile cannot be empty")
+	}
+	return nil
+}
+
+func (c MutualTLSConfig) load() (*tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading key pair: %w", err)
+	}
+
+	caPEM, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("No valid certificates found in CA file %q", c.CAFile)
+	}
+
+	return &cert, pool, nil
+}
+
+// ServerConfig returns a *tls.Config for a server that requires and verifies client certificates
+func (c MutualTLSConfig) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig returns a *tls.Config for a client that presents its certificate and verifies the
+// server's
+func (c MutualTLSConfig) ClientConfig(serverName string) (*tls.Config, error) {
+	cert, pool, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,122 @@
+package util
+
+// OpenTelemetry tracing
+//
+// Each component calls StartTracing on startup. Tracing is only enabled if an OTLP endpoint is
+// configured with the standard OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)
+// environment variable - otherwise, spans are still created, but never sampled or exported. The
+// rest of the exporter's configuration (e.g. headers or TLS) is also read from the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+//
+// Trace context is propagated between components in the W3C 'traceparent' header, so that a
+// single scaling request can be followed from the autoscaler-agent to the scheduler plugin and
+// the NeonVM controller. See InstrumentHTTPHandler and InstrumentHTTPClient.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer used for all spans created by this repo
+const TracerName = "github.com/neondatabase/autoscaling"
+
+// StartTracing sets up the global OpenTelemetry tracer provider for the component, returning a
+// function to flush any remaining spans on shutdown.
+//
+// If no OTLP endpoint is configured, tracing is left disabled, and the returned function does
+// nothing.
+func StartTracing(ctx context.Context, serviceName string) (shutdown func(context.Context) error, _ error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create OTLP trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+		semconv.ServiceVersionKey.String(GetBuildInfo().GitInfo),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span with the tracer for this repo
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends the span, recording the error first if it's not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceParentFromContext returns the W3C 'traceparent' for the span in the context, or "" if there's
+// no span.
+func TraceParentFromContext(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// TraceIDFromTraceParent returns the trace ID from a W3C 'traceparent', or "" if it's not valid
+func TraceIDFromTraceParent(traceParent string) string {
+	carrier := propagation.MapCarrier{"traceparent": traceParent}
+	spanCtx := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	if !spanCtx.IsValid() {
+		return ""
+	}
+	return spanCtx.TraceID().String()
+}
+
+// InstrumentHTTPHandler wraps the handler so that each request is served in a span, continuing
+// the trace from the request's headers, if there is one.
+func InstrumentHTTPHandler(handler http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(handler, operation)
+}
+
+// InstrumentHTTPClient returns a copy of the client that sends requests in a span, propagating the
+// trace in their headers.
+func InstrumentHTTPClient(client *http.Client) *http.Client {
+	c := *client
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	c.Transport = otelhttp.NewTransport(transport)
+	return &c
+}